@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtailapi"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// runAgent serves the API of a longtailapi.Agent on listenAddress until it is stopped by SIGINT,
+// SIGTERM or the service manager. Running downsyncs get --interrupt-flush-timeout to complete
+// before they are cancelled and flushed.
+func runAgent(
+	blobStoreURI string,
+	listenAddress string,
+	localCachePath *string,
+	serviceName string) ([]storeStat, []timeStat, error) {
+	storeStats := []storeStat{}
+	timeStats := []timeStat{}
+
+	authenticators, tlsConfig, err := agentAuthenticators()
+	if err != nil {
+		return storeStats, timeStats, err
+	}
+	if len(authenticators) == 0 && !longtailapi.IsLoopbackAddress(listenAddress) {
+		if !*commandAgentAllowUnauthenticated {
+			return storeStats, timeStats, fmt.Errorf("runAgent: the agent API on %s would be open to anyone who can reach it, use --auth-tokens-file, --jwt-secret-file or --client-ca, or --allow-unauthenticated", listenAddress)
+		}
+		log.Printf("WARNING: The agent API on %s can be used by anyone who can reach it, see --auth-tokens-file, --jwt-secret-file and --client-ca\n", listenAddress)
+	}
+
+	err = runService(serviceName, func(stop <-chan struct{}) error {
+		agent, err := longtailapi.NewAgent(longtailapi.AgentOptions{
+			StoreSettings:  cliStoreSettings(),
+			StorageURI:     blobStoreURI,
+			CachePath:      optionalString(localCachePath),
+			MaxCacheSize:   *cacheMaxSize,
+			Authenticators: authenticators,
+			ListenAddress:  listenAddress})
+		if err != nil {
+			return err
+		}
+		listener, err := longtailapi.ListenAgent(listenAddress)
+		if err != nil {
+			agent.Close()
+			return err
+		}
+		server := &http.Server{Handler: agent.Handler(), TLSConfig: tlsConfig}
+		served := make(chan error, 1)
+		go func() {
+			if tlsConfig != nil {
+				served <- server.ServeTLS(listener, "", "")
+				return
+			}
+			served <- server.Serve(listener)
+		}()
+		log.Printf("Agent for `%s` listening on %s\n", blobStoreURI, listenAddress)
+		select {
+		case err = <-served:
+			agent.Close()
+			return err
+		case <-stop:
+		}
+		// The API keeps serving the progress of the running syncs while they complete
+		log.Printf("Stopping agent, waiting up to %v for running syncs\n", *interruptFlushTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *interruptFlushTimeout)
+		defer cancel()
+		agent.Shutdown(ctx)
+		server.Close()
+		log.Printf("Stopped agent\n")
+		return nil
+	})
+	return storeStats, timeStats, err
+}
+
+// agentAuthenticators returns the authentication plugins of the agent API and its TLS config from
+// the flags of the agent command, the API is served without TLS if the config is nil
+func agentAuthenticators() ([]longtailapi.AgentAuthenticator, *tls.Config, error) {
+	authenticators := []longtailapi.AgentAuthenticator{}
+	if *commandAgentAuthTokensFile != "" {
+		tokens, err := longtailapi.ReadBearerTokens(*commandAgentAuthTokensFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		authenticators = append(authenticators, &longtailapi.BearerTokenAuthenticator{Tokens: tokens})
+	}
+	if *commandAgentJWTSecretFile != "" || *commandAgentJWTPublicKey != "" {
+		jwtAuthenticator := &longtailapi.JWTAuthenticator{Issuer: *commandAgentJWTIssuer, Audience: *commandAgentJWTAudience, Leeway: time.Minute}
+		if *commandAgentJWTSecretFile != "" {
+			secret, err := ioutil.ReadFile(*commandAgentJWTSecretFile)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "agentAuthenticators")
+			}
+			jwtAuthenticator.Secret = bytes.TrimSpace(secret)
+		}
+		if *commandAgentJWTPublicKey != "" {
+			publicKey, err := longtailapi.ReadJWTPublicKey(*commandAgentJWTPublicKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			jwtAuthenticator.PublicKey = publicKey
+		}
+		authenticators = append(authenticators, jwtAuthenticator)
+	}
+	if *commandAgentClientCA != "" && *commandAgentTLSCert == "" {
+		return nil, nil, fmt.Errorf("agentAuthenticators: --client-ca needs --tls-cert")
+	}
+	if *commandAgentTLSCert == "" {
+		return authenticators, nil, nil
+	}
+	tlsConfig, err := longtailapi.AgentTLSConfig(*commandAgentTLSCert, *commandAgentTLSKey, *commandAgentClientCA)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *commandAgentClientCA != "" {
+		access := map[string]longtailapi.AgentAccess{}
+		for _, name := range *commandAgentClientCertWrite {
+			access[name] = longtailapi.AgentWriteAccess
+		}
+		authenticators = append(authenticators, &longtailapi.ClientCertAuthenticator{Access: access, DefaultAccess: longtailapi.AgentReadAccess})
+	}
+	return authenticators, tlsConfig, nil
+}
+
+// runUntilSignal runs run with a stop channel that is closed on SIGINT or SIGTERM
+func runUntilSignal(run func(stop <-chan struct{}) error) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Interrupted by %s\n", sig)
+			close(stop)
+		case <-done:
+		}
+	}()
+	return run(stop)
+}
+
+// agentServiceArgs are the arguments the service manager starts the agent service name with, the
+// --interrupt-flush-timeout of the install command is also the flush timeout of the service. The
+// arguments are kept in the service definition, so URIs with credentials are refused.
+func agentServiceArgs(name string, blobStoreURI string, listenAddress string, localCachePath string, extraArgs []string) ([]string, error) {
+	for _, arg := range append([]string{blobStoreURI}, extraArgs...) {
+		if longtailstorelib.HasStoreURICredentials(arg) {
+			return nil, fmt.Errorf("agentServiceArgs: `%s` of a service can not hold credentials, they would be readable in the service definition, use --credential-helper or the credential lookup of the store", longtailstorelib.RedactStoreURI(arg))
+		}
+	}
+	args := []string{
+		"agent",
+		"--service-name", name,
+		"--storage-uri", blobStoreURI,
+		"--listen", listenAddress,
+		"--interrupt-flush-timeout", interruptFlushTimeout.String()}
+	if len(localCachePath) > 0 {
+		args = append(args, "--cache-path", localCachePath)
+	}
+	return append(args, extraArgs...), nil
+}
+
+// agentSync starts a downsync on the agent at listenAddress and prints its progress until it is
+// done, an interrupt cancels the downsync on the agent
+func agentSync(
+	listenAddress string,
+	sourceFilePath string,
+	targetFolderPath string,
+	targetIndexPath *string,
+	retainPermissions bool,
+	validate bool,
+	clientOptions longtailapi.AgentClientOptions,
+	tokenFile string) ([]storeStat, []timeStat, error) {
+	storeStats := []storeStat{}
+	timeStats := []timeStat{}
+
+	if tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return storeStats, timeStats, errors.Wrap(err, "agentSync")
+		}
+		clientOptions.Token = strings.TrimSpace(string(token))
+	}
+	client, baseURL, err := longtailapi.NewAuthenticatedAgentHTTPClient(listenAddress, clientOptions)
+	if err != nil {
+		return storeStats, timeStats, err
+	}
+	body, err := json.Marshal(longtailapi.AgentSyncRequest{
+		SourcePath:        sourceFilePath,
+		TargetPath:        targetFolderPath,
+		TargetIndexPath:   optionalString(targetIndexPath),
+		CachePin:          *cachePin,
+		RetainPermissions: retainPermissions,
+		Validate:          validate})
+	if err != nil {
+		return storeStats, timeStats, err
+	}
+	s, err := readAgentSync(client.Post(baseURL+"/syncs", "application/json", bytes.NewReader(body)))
+	if err != nil {
+		return storeStats, timeStats, errors.Wrapf(err, "agentSync: agent at %s", listenAddress)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	syncURL := fmt.Sprintf("%s/syncs/%d", baseURL, s.ID)
+	progress := consoleProgress()
+	for s.State == longtailapi.AgentSyncRunning {
+		select {
+		case sig := <-signals:
+			log.Printf("Interrupted by %s, cancelling sync %d on the agent\n", sig, s.ID)
+			req, _ := http.NewRequest(http.MethodDelete, syncURL, nil)
+			req.Header.Set("Content-Type", "application/json")
+			_, err = readAgentSync(client.Do(req))
+		case <-time.After(250 * time.Millisecond):
+			s, err = readAgentSync(client.Get(syncURL))
+		}
+		if err != nil {
+			return storeStats, timeStats, errors.Wrapf(err, "agentSync: agent at %s", listenAddress)
+		}
+		for _, p := range s.Progress {
+			progress(p.Task, p.Total, p.Done)
+		}
+	}
+	if s.State != longtailapi.AgentSyncDone {
+		return storeStats, timeStats, fmt.Errorf("agentSync: sync %d %s: %s", s.ID, s.State, s.Error)
+	}
+	fmt.Printf("Updated `%s` to version %s\n", targetFolderPath, s.VersionHash)
+	return storeStats, timeStats, nil
+}
+
+func readAgentSync(resp *http.Response, err error) (longtailapi.AgentSync, error) {
+	if err != nil {
+		return longtailapi.AgentSync{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return longtailapi.AgentSync{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var s longtailapi.AgentSync
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	return s, err
+}
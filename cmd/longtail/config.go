@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// configFileName is the name of the per-project config file in the current directory and the
+// per-user config file in <user config dir>/longtail
+const configFileName = "longtail.json"
+
+// storeReferencePrefix refers to a named store of the config file in any argument, store://main/index/v1.lvi
+// expands to the uri of the store "main" followed by /index/v1.lvi
+const storeReferencePrefix = "store://"
+
+// storeConfig is a named store of the config file
+type storeConfig struct {
+	URI string `json:"uri"`
+	// Environment is set when the store is referenced, for example GOOGLE_APPLICATION_CREDENTIALS
+	Environment map[string]string `json:"environment"`
+	// Flags are flag defaults applied when the store is referenced, for example max-concurrent-requests
+	Flags map[string]interface{} `json:"flags"`
+}
+
+// config holds flag defaults and named stores. Flag values may be strings, numbers, booleans or lists
+// for repeatable flags. ${VAR} references in strings are expanded from the environment.
+type config struct {
+	Flags    map[string]interface{}            `json:"flags"`
+	Commands map[string]map[string]interface{} `json:"commands"`
+	Stores   map[string]storeConfig            `json:"stores"`
+}
+
+func readConfig(path string) (config, error) {
+	cfg := config{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, errors.Wrapf(err, "failed to parse config file `%s`", path)
+	}
+	cfg.expand()
+	return cfg, nil
+}
+
+var configVariableRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandConfigString replaces the ${VAR} references in s with the environment variables, $VAR and
+// $$ are kept as they are so values such as passwords can hold a $
+func expandConfigString(s string) string {
+	return configVariableRegexp.ReplaceAllStringFunc(s, func(reference string) string {
+		return os.Getenv(reference[2 : len(reference)-1])
+	})
+}
+
+// expandConfigValue expands the strings of a flag value, see expandConfigString
+func expandConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return expandConfigString(v)
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, element := range v {
+			expanded[i] = expandConfigValue(element)
+		}
+		return expanded
+	}
+	return value
+}
+
+func expandConfigFlags(flags map[string]interface{}) {
+	for name, value := range flags {
+		flags[name] = expandConfigValue(value)
+	}
+}
+
+// expand replaces the ${VAR} references in the string values of c with the environment variables.
+// The file is parsed first, so a value can not break the JSON or add settings.
+func (c *config) expand() {
+	expandConfigFlags(c.Flags)
+	for _, flags := range c.Commands {
+		expandConfigFlags(flags)
+	}
+	for name, store := range c.Stores {
+		store.URI = expandConfigString(store.URI)
+		for key, value := range store.Environment {
+			store.Environment[key] = expandConfigString(value)
+		}
+		expandConfigFlags(store.Flags)
+		c.Stores[name] = store
+	}
+}
+
+// merge applies the settings of other on top of c
+func (c *config) merge(other config) {
+	if c.Flags == nil {
+		c.Flags = map[string]interface{}{}
+	}
+	for name, value := range other.Flags {
+		c.Flags[name] = value
+	}
+	if c.Commands == nil {
+		c.Commands = map[string]map[string]interface{}{}
+	}
+	for command, flags := range other.Commands {
+		if c.Commands[command] == nil {
+			c.Commands[command] = map[string]interface{}{}
+		}
+		for name, value := range flags {
+			c.Commands[command][name] = value
+		}
+	}
+	if c.Stores == nil {
+		c.Stores = map[string]storeConfig{}
+	}
+	for name, store := range other.Stores {
+		c.Stores[name] = store
+	}
+}
+
+// defaultConfigPaths returns the per-user config followed by the per-project config
+func defaultConfigPaths() []string {
+	paths := []string{}
+	if userConfigDir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(userConfigDir, "longtail", configFileName))
+	}
+	return append(paths, configFileName)
+}
+
+// commandFlags are the flags that run commands. A per-project config file comes with the checkout of
+// a repository, so it can not set them, see checkProjectConfig.
+var commandFlags = []string{"credential-helper", "post-hook", "pre-hook"}
+
+// checkProjectConfig returns an error if the per-project config c sets a flag that runs commands, as
+// a flag default, a command flag, a store flag or the environment variable of the flag for a store
+func checkProjectConfig(app *kingpin.Application, c config) error {
+	for _, name := range commandFlags {
+		set := c.Flags[name] != nil
+		for _, flags := range c.Commands {
+			set = set || flags[name] != nil
+		}
+		for _, store := range c.Stores {
+			_, hasEnvar := store.Environment[flagEnvar(app, name)]
+			set = set || store.Flags[name] != nil || hasEnvar
+		}
+		if set {
+			return fmt.Errorf("`%s` runs commands and can not be set in the per-project %s, set it in the per-user config file, a file given with --config-file or on the command line", name, configFileName)
+		}
+	}
+	return nil
+}
+
+// loadConfig merges the per-user and per-project config files, or reads only configPath if it is set
+func loadConfig(app *kingpin.Application, configPath string) (config, error) {
+	cfg := config{}
+	if configPath != "" {
+		fileConfig, err := readConfig(configPath)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.merge(fileConfig)
+		return cfg, nil
+	}
+	for _, path := range defaultConfigPaths() {
+		fileConfig, err := readConfig(path)
+		if os.IsNotExist(errors.Cause(err)) {
+			continue
+		}
+		if err != nil {
+			return cfg, err
+		}
+		if path == configFileName {
+			err = checkProjectConfig(app, fileConfig)
+			if err != nil {
+				return cfg, err
+			}
+		}
+		cfg.merge(fileConfig)
+	}
+	return cfg, nil
+}
+
+// expandStoreReferences replaces store:// references to the stores of cfg in args and returns the referenced stores
+func expandStoreReferences(cfg config, args []string) ([]string, []string, error) {
+	expanded := make([]string, len(args))
+	referenced := []string{}
+	for i, arg := range args {
+		expanded[i] = arg
+		index := strings.Index(arg, storeReferencePrefix)
+		if index == -1 {
+			continue
+		}
+		reference := arg[index+len(storeReferencePrefix):]
+		name := reference
+		rest := ""
+		if slash := strings.Index(reference, "/"); slash != -1 {
+			name = reference[:slash]
+			rest = reference[slash:]
+		}
+		store, ok := cfg.Stores[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown store `%s` in `%s`, stores are defined in %s", name, arg, configFileName)
+		}
+		expanded[i] = arg[:index] + strings.TrimSuffix(store.URI, "/") + rest
+		referenced = append(referenced, name)
+	}
+	return expanded, referenced, nil
+}
+
+var envarNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// flagEnvar is the environment variable kingpin reads the default of a flag from, see DefaultEnvars
+func flagEnvar(app *kingpin.Application, flagName string) string {
+	return strings.ToUpper(envarNameRegexp.ReplaceAllString(app.Name+"_"+flagName, "_"))
+}
+
+func configValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return fmt.Sprintf("%t", v), nil
+	case float64:
+		return fmt.Sprintf("%v", v), nil
+	case []interface{}:
+		// kingpin splits envar values of repeatable flags on newlines
+		values := make([]string, len(v))
+		for i, element := range v {
+			s, err := configValueString(element)
+			if err != nil {
+				return "", err
+			}
+			values[i] = s
+		}
+		return strings.Join(values, "\n"), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// isKnownFlag returns true if any command has a flag with the name
+func isKnownFlag(app *kingpin.Application, name string) bool {
+	if app.GetFlag(name) != nil {
+		return true
+	}
+	for _, command := range app.Model().Commands {
+		for _, flag := range command.Flags {
+			if flag.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setFlagDefaults sets the environment variables of flags that are not already set. Flags that
+// the selected command does not have are skipped so defaults can be shared between commands.
+func setFlagDefaults(app *kingpin.Application, command *kingpin.CmdClause, cfg config, flags map[string]interface{}) error {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !isKnownFlag(app, name) {
+			return fmt.Errorf("unknown flag `%s` in %s", name, configFileName)
+		}
+		if app.GetFlag(name) == nil && (command == nil || command.GetFlag(name) == nil) {
+			continue
+		}
+		envar := flagEnvar(app, name)
+		if _, ok := os.LookupEnv(envar); ok {
+			continue
+		}
+		value, err := configValueString(flags[name])
+		if err != nil {
+			return errors.Wrapf(err, "flag `%s` in %s", name, configFileName)
+		}
+		expandedValue, _, err := expandStoreReferences(cfg, []string{value})
+		if err != nil {
+			return err
+		}
+		os.Setenv(envar, expandedValue[0])
+	}
+	return nil
+}
+
+// applyConfig loads the config files and returns args with store references expanded. Flag defaults
+// from the config are set as environment variables so command line flags and the environment take
+// precedence, followed by the defaults of referenced stores, the command and all commands.
+func applyConfig(app *kingpin.Application, args []string) ([]string, error) {
+	context, _ := app.ParseContext(args)
+	configPath := os.Getenv(flagEnvar(app, "config-file"))
+	var command *kingpin.CmdClause
+	if context != nil {
+		command = context.SelectedCommand
+		for _, element := range context.Elements {
+			if flag, ok := element.Clause.(*kingpin.FlagClause); ok && flag.Model().Name == "config-file" && element.Value != nil {
+				configPath = *element.Value
+			}
+		}
+	}
+
+	cfg, err := loadConfig(app, configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	expandedArgs, referencedStores, err := expandStoreReferences(cfg, args)
+	if err != nil {
+		return nil, err
+	}
+	if command != nil {
+		// Stores referenced by flag defaults apply as well
+		for _, flags := range []map[string]interface{}{cfg.Commands[command.FullCommand()], cfg.Flags} {
+			for _, value := range flags {
+				s, err := configValueString(value)
+				if err != nil {
+					continue
+				}
+				_, flagStores, err := expandStoreReferences(cfg, []string{s})
+				if err == nil {
+					referencedStores = append(referencedStores, flagStores...)
+				}
+			}
+		}
+	}
+	for _, name := range referencedStores {
+		store := cfg.Stores[name]
+		for key, value := range store.Environment {
+			if _, ok := os.LookupEnv(key); !ok {
+				os.Setenv(key, value)
+			}
+		}
+		err = setFlagDefaults(app, command, cfg, store.Flags)
+		if err != nil {
+			return nil, errors.Wrapf(err, "store `%s`", name)
+		}
+	}
+	if command != nil {
+		err = setFlagDefaults(app, command, cfg, cfg.Commands[command.FullCommand()])
+		if err != nil {
+			return nil, errors.Wrapf(err, "command `%s`", command.FullCommand())
+		}
+	}
+	err = setFlagDefaults(app, command, cfg, cfg.Flags)
+	if err != nil {
+		return nil, err
+	}
+	return expandedArgs, nil
+}
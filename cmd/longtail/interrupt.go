@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// commandContext is cancelled when upsync or downsync is interrupted, see handleInterrupts
+var commandContext = context.Background()
+
+// interruptHandler flushes the stores of an interrupted upsync or downsync before exiting so
+// blocks uploaded before the interrupt are indexed and downloaded blocks are kept in the cache
+type interruptHandler struct {
+	signals chan os.Signal
+	cancel  context.CancelFunc
+	flushed chan error
+}
+
+// handleInterrupts cancels commandContext on SIGINT or SIGTERM and exits once the stores have
+// been flushed or flushTimeout has passed. A second signal exits without waiting for the flush.
+func handleInterrupts(flushTimeout time.Duration) *interruptHandler {
+	h := &interruptHandler{
+		signals: make(chan os.Signal, 2),
+		flushed: make(chan error, 1)}
+	commandContext, h.cancel = context.WithCancel(context.Background())
+	signal.Notify(h.signals, os.Interrupt, syscall.SIGTERM)
+	go h.run(flushTimeout)
+	return h
+}
+
+// onCancelFlushed is the longtailapi.StoreSettings.OnCancelFlushed callback
+func (h *interruptHandler) onCancelFlushed(err error) {
+	select {
+	case h.flushed <- err:
+	default:
+	}
+}
+
+func (h *interruptHandler) run(flushTimeout time.Duration) {
+	sig, ok := <-h.signals
+	if !ok {
+		return
+	}
+	log.Printf("Interrupted by %s, flushing stores, interrupt again to exit without flushing\n", sig)
+	h.cancel()
+	select {
+	case err := <-h.flushed:
+		if err != nil {
+			log.Printf("WARNING: Failed to flush stores after interrupt: %v\n", err)
+		} else {
+			log.Printf("Flushed stores after interrupt\n")
+		}
+	case <-h.signals:
+		log.Printf("WARNING: Exiting without flushing stores, use recover-index to index the uploaded blocks\n")
+	case <-time.After(flushTimeout):
+		log.Printf("WARNING: Timed out after %s flushing stores, use recover-index to index the uploaded blocks\n", flushTimeout)
+	}
+	// Exit with 128 + the signal number like a shell does for a process killed by a signal
+	exitCode := 130
+	if sig == syscall.SIGTERM {
+		exitCode = 143
+	}
+	os.Exit(exitCode)
+}
+
+// stop stops handling signals once the command has completed
+func (h *interruptHandler) stop() {
+	signal.Stop(h.signals)
+	close(h.signals)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+)
+
+// secretPrompt asks on the terminal for the secret of a storage URI such as s3://KEY@bucket/path,
+// see longtailstorelib.WithSecretPrompt. A command opens its store more than once so each secret
+// is only asked for once.
+type secretPrompt struct {
+	lock    sync.Mutex
+	secrets map[string]string
+}
+
+func newSecretPrompt() *secretPrompt {
+	return &secretPrompt{secrets: map[string]string{}}
+}
+
+func (p *secretPrompt) prompt(request longtailstorelib.CredentialRequest, accessKeyID string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key := request.Scheme + "://" + accessKeyID + "@" + request.Host
+	if secret, ok := p.secrets[key]; ok {
+		return secret, nil
+	}
+	fmt.Fprintf(os.Stderr, "Secret for %s of %s://%s: ", accessKeyID, request.Scheme, request.Host)
+	secret, err := readSecret(os.Stdin)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	p.secrets[key] = secret
+	return secret, nil
+}
+
+// readLine reads f up to the end of the line one byte at a time, so nothing after it is consumed
+func readLine(f *os.File) (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		n, err := f.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			if b[0] != '\r' {
+				line = append(line, b[0])
+			}
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return string(line), nil
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// isTerminal returns true if f is a terminal
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), ioctlReadTermios)
+	return err == nil
+}
+
+// readSecret reads a line from the terminal f without echoing it
+func readSecret(f *os.File) (string, error) {
+	fd := int(f.Fd())
+	termios, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+	if err != nil {
+		return "", errors.Wrap(err, "readSecret")
+	}
+	noEcho := *termios
+	noEcho.Lflag &^= unix.ECHO
+	noEcho.Lflag |= unix.ICANON | unix.ISIG
+	noEcho.Iflag |= unix.ICRNL
+	err = unix.IoctlSetTermios(fd, ioctlWriteTermios, &noEcho)
+	if err != nil {
+		return "", errors.Wrap(err, "readSecret")
+	}
+	defer unix.IoctlSetTermios(fd, ioctlWriteTermios, termios)
+	return readLine(f)
+}
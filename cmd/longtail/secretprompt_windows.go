@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// isTerminal returns true if f is a console
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(f.Fd()), &mode) == nil
+}
+
+// readSecret reads a line from the console f without echoing it
+func readSecret(f *os.File) (string, error) {
+	handle := windows.Handle(f.Fd())
+	var mode uint32
+	err := windows.GetConsoleMode(handle, &mode)
+	if err != nil {
+		return "", errors.Wrap(err, "readSecret")
+	}
+	err = windows.SetConsoleMode(handle, (mode&^windows.ENABLE_ECHO_INPUT)|windows.ENABLE_PROCESSED_INPUT|windows.ENABLE_LINE_INPUT)
+	if err != nil {
+		return "", errors.Wrap(err, "readSecret")
+	}
+	defer windows.SetConsoleMode(handle, mode)
+	return readLine(f)
+}
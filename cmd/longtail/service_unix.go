@@ -0,0 +1,140 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// systemdUnitFolder is where installService writes the unit of the agent service
+const systemdUnitFolder = "/etc/systemd/system"
+
+// runService runs run until SIGINT or SIGTERM, systemd stops the service with SIGTERM
+func runService(name string, run func(stop <-chan struct{}) error) error {
+	return runUntilSignal(run)
+}
+
+func systemdUnitPath(name string) string {
+	return filepath.Join(systemdUnitFolder, name+".service")
+}
+
+// systemdQuote quotes an argument of ExecStart, systemd expands % specifiers in unquoted and
+// quoted arguments alike
+func systemdQuote(arg string) string {
+	arg = strings.Replace(arg, "\\", "\\\\", -1)
+	arg = strings.Replace(arg, "\"", "\\\"", -1)
+	arg = strings.Replace(arg, "%", "%%", -1)
+	return "\"" + arg + "\""
+}
+
+func systemctl(args ...string) error {
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "systemctl %s: %s", strings.Join(args, " "), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func checkSystemd() error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("services are only supported with systemd on Linux and on Windows, not on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+// installService writes a systemd unit that runs the agent with args and enables it
+func installService(name string, args []string) error {
+	err := checkSystemd()
+	if err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "installService")
+	}
+	command := []string{systemdQuote(executable)}
+	for _, arg := range args {
+		command = append(command, systemdQuote(arg))
+	}
+	// Give running downsyncs their flush timeout before systemd kills the agent
+	stopTimeout := *interruptFlushTimeout + 30*time.Second
+	unit := fmt.Sprintf(`[Unit]
+Description=Longtail agent %s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+RestartSec=5
+KillSignal=SIGTERM
+TimeoutStopSec=%d
+
+[Install]
+WantedBy=multi-user.target
+`, name, strings.Join(command, " "), int(stopTimeout.Seconds()))
+	unitPath := systemdUnitPath(name)
+	err = ioutil.WriteFile(unitPath, []byte(unit), 0644)
+	if err != nil {
+		return errors.Wrap(err, "installService")
+	}
+	err = systemctl("daemon-reload")
+	if err != nil {
+		return err
+	}
+	err = systemctl("enable", name)
+	if err != nil {
+		return err
+	}
+	log.Printf("Installed service `%s` in `%s`, start it with `longtail service start --name %s`\n", name, unitPath, name)
+	return nil
+}
+
+// uninstallService stops and disables the agent service and removes its unit
+func uninstallService(name string) error {
+	err := checkSystemd()
+	if err != nil {
+		return err
+	}
+	unitPath := systemdUnitPath(name)
+	if _, err := os.Stat(unitPath); err != nil {
+		return errors.Wrapf(err, "uninstallService: service `%s` is not installed", name)
+	}
+	err = systemctl("disable", "--now", name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(unitPath)
+	if err != nil {
+		return errors.Wrap(err, "uninstallService")
+	}
+	return systemctl("daemon-reload")
+}
+
+func startService(name string) error {
+	err := checkSystemd()
+	if err != nil {
+		return err
+	}
+	return systemctl("start", name)
+}
+
+// stopService returns when the agent has stopped, systemctl waits for the running syncs to flush
+func stopService(name string) error {
+	err := checkSystemd()
+	if err != nil {
+		return err
+	}
+	return systemctl("stop", name)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// runService runs run as the Windows service name when started by the service manager, and until
+// Ctrl+C when started from a console
+func runService(name string, run func(stop <-chan struct{}) error) error {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return errors.Wrap(err, "runService")
+	}
+	if interactive {
+		return runUntilSignal(run)
+	}
+	elog, err := eventlog.Open(name)
+	if err == nil {
+		defer elog.Close()
+		log.SetOutput(longtailstorelib.NewRedactingWriter(&eventLogWriter{elog: elog}))
+	}
+	handler := &serviceHandler{run: run}
+	err = svc.Run(name, handler)
+	if err != nil {
+		return errors.Wrapf(err, "runService: service `%s`", name)
+	}
+	return handler.err
+}
+
+// eventLogWriter sends the log of the service to the Windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(string(p))
+	var err error
+	if strings.Contains(message, "ERROR") {
+		err = w.elog.Error(1, message)
+	} else if strings.Contains(message, "WARNING") {
+		err = w.elog.Warning(1, message)
+	} else {
+		err = w.elog.Info(1, message)
+	}
+	return len(p), err
+}
+
+type serviceHandler struct {
+	run func(stop <-chan struct{}) error
+	err error
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- h.run(stop)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case h.err = <-done:
+			if h.err != nil {
+				log.Printf("ERROR: %v\n", h.err)
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// Give running downsyncs their flush timeout before the service manager gives up
+				waitHint := *interruptFlushTimeout + 30*time.Second
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(waitHint / time.Millisecond)}
+				close(stop)
+				h.err = <-done
+				if h.err != nil {
+					log.Printf("ERROR: %v\n", h.err)
+					return true, 1
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+func connectService(name string) (*mgr.Mgr, *mgr.Service, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "connect to service manager")
+	}
+	s, err := m.OpenService(name)
+	if err != nil {
+		m.Disconnect()
+		return nil, nil, errors.Wrapf(err, "service `%s` is not installed", name)
+	}
+	return m, s, nil
+}
+
+// installService creates an automatically started service that runs the agent with args and
+// restarts it if it fails
+func installService(name string, args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "installService")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return errors.Wrap(err, "installService: connect to service manager")
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("installService: service `%s` already exists", name)
+	}
+	s, err = m.CreateService(name, executable, mgr.Config{
+		DisplayName: "Longtail agent " + name,
+		Description: "Keeps a longtail store session and cache warm and downsyncs versions on request",
+		StartType:   mgr.StartAutomatic}, args...)
+	if err != nil {
+		return errors.Wrapf(err, "installService: create service `%s`", name)
+	}
+	defer s.Close()
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second}}, 24*60*60)
+	if err != nil {
+		log.Printf("WARNING: Failed to set recovery actions of service `%s`: %v\n", name, err)
+	}
+	err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return errors.Wrapf(err, "installService: install event log source `%s`", name)
+	}
+	log.Printf("Installed service `%s`, start it with `longtail service start --name %s`\n", name, name)
+	return nil
+}
+
+// uninstallService stops the agent service and removes it
+func uninstallService(name string) error {
+	err := stopService(name)
+	if err != nil {
+		return err
+	}
+	m, s, err := connectService(name)
+	if err != nil {
+		return errors.Wrap(err, "uninstallService")
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	err = s.Delete()
+	if err != nil {
+		return errors.Wrapf(err, "uninstallService: delete service `%s`", name)
+	}
+	err = eventlog.Remove(name)
+	if err != nil {
+		log.Printf("WARNING: Failed to remove event log source `%s`: %v\n", name, err)
+	}
+	return nil
+}
+
+func startService(name string) error {
+	m, s, err := connectService(name)
+	if err != nil {
+		return errors.Wrap(err, "startService")
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	err = s.Start()
+	if err != nil {
+		return errors.Wrapf(err, "startService: start service `%s`", name)
+	}
+	return nil
+}
+
+// stopService returns when the agent has stopped, running syncs are given time to flush
+func stopService(name string) error {
+	m, s, err := connectService(name)
+	if err != nil {
+		return errors.Wrap(err, "stopService")
+	}
+	defer m.Disconnect()
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return errors.Wrapf(err, "stopService: query service `%s`", name)
+	}
+	if status.State == svc.Stopped {
+		return nil
+	}
+	if status.State != svc.StopPending {
+		status, err = s.Control(svc.Stop)
+		if err != nil {
+			return errors.Wrapf(err, "stopService: stop service `%s`", name)
+		}
+	}
+	deadline := time.Now().Add(*interruptFlushTimeout + 30*time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("stopService: service `%s` did not stop", name)
+		}
+		time.Sleep(250 * time.Millisecond)
+		status, err = s.Query()
+		if err != nil {
+			return errors.Wrapf(err, "stopService: query service `%s`", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+)
+
+// handleSessionModeSignals switches the remote stores to background mode on SIGUSR1 and to
+// foreground mode on SIGUSR2 so a launcher can throttle a running command, it returns the
+// function that stops handling the signals
+func handleSessionModeSignals() func() {
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				setSessionMode(longtailstorelib.Background)
+			} else {
+				setSessionMode(longtailstorelib.Foreground)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+// handleSessionModeSignals does nothing on Windows which has no user signals, the mode of the
+// remote stores can only be set with --background
+func handleSessionModeSignals() func() {
+	return func() {}
+}
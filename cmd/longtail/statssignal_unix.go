@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleStatsSignal dumps the stats of the remote stores on SIGHUP, SIGUSR1 and SIGUSR2 switch
+// the session mode, see handleSessionModeSignals. It returns the function that stops handling
+// the signal.
+func handleStatsSignal() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			dumpStats()
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+// handleStatsSignal does nothing on Windows which has no SIGHUP, the stats are written to
+// --stats-path at --stats-interval and when the command ends
+func handleStatsSignal() func() {
+	return func() {}
+}
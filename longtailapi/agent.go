@@ -0,0 +1,510 @@
+package longtailapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// The states of an agent sync
+const (
+	AgentSyncRunning   = "running"
+	AgentSyncDone      = "done"
+	AgentSyncFailed    = "failed"
+	AgentSyncCancelled = "cancelled"
+)
+
+// agentMaxFinishedSyncs is the number of finished syncs an agent remembers for GET /syncs
+const agentMaxFinishedSyncs = 100
+
+// AgentOptions configures an Agent
+type AgentOptions struct {
+	StoreSettings
+	StorageURI string
+	// CachePath is an optional folder where the blocks downloaded by all syncs of the agent are cached
+	CachePath    string
+	MaxCacheSize int64
+	// Authenticators are required for the API of Handler, without them the API is open to anyone
+	// who can reach it, see RequireAgentAuth
+	Authenticators []AgentAuthenticator
+	// ListenAddress is the address the API is served on, see ListenAgent. Without authenticators
+	// the API of an agent on a loopback address, or with no address, only takes requests for a
+	// loopback host, so web pages can not reach it through DNS rebinding.
+	ListenAddress string
+}
+
+// agentSocketHost is the host of the API of an agent on a unix domain socket, see NewAgentHTTPClient
+const agentSocketHost = "longtail-agent"
+
+// AgentSyncRequest is the body of POST /syncs, it downsyncs the version index at SourcePath to
+// the folder at TargetPath
+type AgentSyncRequest struct {
+	SourcePath        string `json:"sourcePath"`
+	TargetPath        string `json:"targetPath"`
+	TargetIndexPath   string `json:"targetIndexPath,omitempty"`
+	CachePin          string `json:"cachePin,omitempty"`
+	RetainPermissions bool   `json:"retainPermissions,omitempty"`
+	Validate          bool   `json:"validate,omitempty"`
+}
+
+// AgentProgress is the progress of a task of a sync
+type AgentProgress struct {
+	Task  string `json:"task"`
+	Total uint32 `json:"total"`
+	Done  uint32 `json:"done"`
+}
+
+// AgentSync is a sync of an agent, the body of GET /syncs/<id>
+type AgentSync struct {
+	ID          int              `json:"id"`
+	Request     AgentSyncRequest `json:"request"`
+	State       string           `json:"state"`
+	Error       string           `json:"error,omitempty"`
+	Progress    []AgentProgress  `json:"progress,omitempty"`
+	VersionHash string           `json:"versionHash,omitempty"`
+	Started     time.Time        `json:"started"`
+	Finished    *time.Time       `json:"finished,omitempty"`
+}
+
+// AgentStatus is the body of GET /status
+type AgentStatus struct {
+	// StorageURI has the secret of credentials in the URI redacted
+	StorageURI   string `json:"storageUri"`
+	CachePath    string `json:"cachePath,omitempty"`
+	Mode         string `json:"mode"`
+	RunningSyncs int    `json:"runningSyncs"`
+	// The transfer rates of the remote store, measured since the previous GET /status
+	DownloadBytesPerSecond float64 `json:"downloadBytesPerSecond"`
+	GetsInFlight           int64   `json:"getsInFlight"`
+	// Bandwidth is the data the store has transferred since the agent started, per backend
+	Bandwidth []longtailstorelib.BandwidthUsage `json:"bandwidth,omitempty"`
+}
+
+// agentModeRequest is the body of POST /mode
+type agentModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+type agentSync struct {
+	AgentSync
+	cancel   context.CancelFunc
+	progress map[string]AgentProgress
+}
+
+// Agent keeps one remote store session and block cache warm for the syncs of all tools on a
+// machine, they share the store index, the cache and in-flight block requests. Tools control the
+// agent through the HTTP API of Handler, usually on a local socket, see ListenAgent.
+type Agent struct {
+	opts        AgentOptions
+	jobs        longtaillib.Longtail_JobAPI
+	remoteStore longtaillib.BlockStoreAPI
+	sharedStore *longtailstorelib.SharedBlockStore
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+
+	lock    sync.Mutex
+	closing bool
+	nextID  int
+	syncs   map[int]*agentSync
+}
+
+// NewAgent creates the remote store for opts.StorageURI, the store is read only
+func NewAgent(opts AgentOptions) (*Agent, error) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(opts.workerCount()), 0)
+	remoteStore, err := longtailstorelib.NewRemoteBlockStoreForURI(jobs, opts.StorageURI, "", opts.workerCount(), longtailstorelib.ReadOnly, opts.StoreOptions...)
+	if err != nil {
+		jobs.Dispose()
+		return nil, errors.Wrap(err, "NewAgent")
+	}
+	if opts.OnRemoteStore != nil {
+		opts.OnRemoteStore(remoteStore)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Agent{
+		opts:        opts,
+		jobs:        jobs,
+		remoteStore: remoteStore,
+		sharedStore: longtailstorelib.NewSharedBlockStore(remoteStore),
+		ctx:         ctx,
+		cancel:      cancel,
+		nextID:      1,
+		syncs:       map[int]*agentSync{}}, nil
+}
+
+// Close cancels the running syncs, waits for them to stop and closes the store
+func (a *Agent) Close() {
+	a.lock.Lock()
+	a.closing = true
+	a.lock.Unlock()
+	a.cancel()
+	a.wg.Wait()
+	a.sharedStore.Close()
+	a.jobs.Dispose()
+}
+
+// Shutdown stops accepting syncs and waits for the running syncs to complete, syncs that are still
+// running when ctx is done are cancelled and flushed. The agent is closed when Shutdown returns.
+func (a *Agent) Shutdown(ctx context.Context) {
+	a.lock.Lock()
+	a.closing = true
+	a.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	a.Close()
+}
+
+// StartSync starts a downsync of request, only one sync at a time may update a target path
+func (a *Agent) StartSync(request AgentSyncRequest) (AgentSync, error) {
+	if len(request.SourcePath) == 0 || len(request.TargetPath) == 0 {
+		return AgentSync{}, fmt.Errorf("StartSync: sourcePath and targetPath are required")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closing {
+		return AgentSync{}, errors.Wrap(longtailstorelib.ErrStoreClosed, "StartSync")
+	}
+	for _, s := range a.syncs {
+		if s.State == AgentSyncRunning && s.Request.TargetPath == request.TargetPath {
+			return AgentSync{}, errors.Wrapf(errAgentConflict, "StartSync: sync %d is updating `%s`", s.ID, request.TargetPath)
+		}
+	}
+	ctx, cancel := context.WithCancel(a.ctx)
+	s := &agentSync{
+		AgentSync: AgentSync{ID: a.nextID, Request: request, State: AgentSyncRunning, Started: time.Now()},
+		cancel:    cancel,
+		progress:  map[string]AgentProgress{}}
+	a.nextID++
+	a.syncs[s.ID] = s
+	a.forgetFinishedSyncs()
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer cancel()
+		result, err := Downsync(ctx, DownsyncOptions{
+			StoreSettings:     StoreSettings{WorkerCount: a.opts.WorkerCount, StoreOptions: a.opts.StoreOptions, SharedStore: a.sharedStore},
+			StorageURI:        a.opts.StorageURI,
+			Targets:           []DownsyncTarget{{SourcePath: request.SourcePath, TargetPath: request.TargetPath, TargetIndexPath: request.TargetIndexPath}},
+			CachePath:         a.opts.CachePath,
+			MaxCacheSize:      a.opts.MaxCacheSize,
+			CachePin:          request.CachePin,
+			RetainPermissions: request.RetainPermissions,
+			Validate:          request.Validate,
+			Progress: func(task string, totalCount uint32, doneCount uint32) {
+				a.lock.Lock()
+				s.progress[task] = AgentProgress{Task: task, Total: totalCount, Done: doneCount}
+				a.lock.Unlock()
+			}})
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		finished := time.Now()
+		s.Finished = &finished
+		s.VersionHash = result.VersionHashes[request.TargetPath]
+		switch {
+		case err == nil:
+			s.State = AgentSyncDone
+		case ctx.Err() != nil:
+			s.State = AgentSyncCancelled
+			s.Error = err.Error()
+		default:
+			s.State = AgentSyncFailed
+			s.Error = err.Error()
+		}
+	}()
+	return s.snapshot(), nil
+}
+
+// forgetFinishedSyncs drops the oldest finished syncs so at most agentMaxFinishedSyncs are kept
+func (a *Agent) forgetFinishedSyncs() {
+	var finished []int
+	for id, s := range a.syncs {
+		if s.State != AgentSyncRunning {
+			finished = append(finished, id)
+		}
+	}
+	if len(finished) <= agentMaxFinishedSyncs {
+		return
+	}
+	sort.Ints(finished)
+	for _, id := range finished[:len(finished)-agentMaxFinishedSyncs] {
+		delete(a.syncs, id)
+	}
+}
+
+func (s *agentSync) snapshot() AgentSync {
+	snapshot := s.AgentSync
+	snapshot.Progress = make([]AgentProgress, 0, len(s.progress))
+	for _, progress := range s.progress {
+		snapshot.Progress = append(snapshot.Progress, progress)
+	}
+	sort.Slice(snapshot.Progress, func(i, j int) bool { return snapshot.Progress[i].Task < snapshot.Progress[j].Task })
+	return snapshot
+}
+
+// GetSync returns the sync with id, false if the agent does not know it
+func (a *Agent) GetSync(id int) (AgentSync, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	s, ok := a.syncs[id]
+	if !ok {
+		return AgentSync{}, false
+	}
+	return s.snapshot(), true
+}
+
+// GetSyncs returns the running syncs and the most recently finished ones
+func (a *Agent) GetSyncs() []AgentSync {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	syncs := make([]AgentSync, 0, len(a.syncs))
+	for _, s := range a.syncs {
+		syncs = append(syncs, s.snapshot())
+	}
+	sort.Slice(syncs, func(i, j int) bool { return syncs[i].ID < syncs[j].ID })
+	return syncs
+}
+
+// CancelSync cancels the sync with id, the target it is updating completes first
+func (a *Agent) CancelSync(id int) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	s, ok := a.syncs[id]
+	if ok {
+		s.cancel()
+	}
+	return ok
+}
+
+// SetSessionMode throttles the store of the agent, see longtailstorelib.SessionModeSwitcher
+func (a *Agent) SetSessionMode(mode longtailstorelib.SessionMode) {
+	if switcher, ok := a.remoteStore.(longtailstorelib.SessionModeSwitcher); ok {
+		switcher.SetSessionMode(mode)
+	}
+}
+
+// Status returns the status of the agent and the transfer rates of its store
+func (a *Agent) Status() AgentStatus {
+	status := AgentStatus{StorageURI: longtailstorelib.RedactStoreURI(a.opts.StorageURI), CachePath: a.opts.CachePath, Mode: longtailstorelib.Foreground.String()}
+	if switcher, ok := a.remoteStore.(longtailstorelib.SessionModeSwitcher); ok {
+		status.Mode = switcher.SessionMode().String()
+	}
+	if provider, ok := a.remoteStore.(longtailstorelib.DetailedStatsProvider); ok {
+		stats := provider.GetDetailedStats()
+		status.DownloadBytesPerSecond = stats.DownloadBytesPerSecond
+		status.GetsInFlight = stats.GetsInFlight
+	}
+	if provider, ok := a.remoteStore.(longtailstorelib.BandwidthUsageProvider); ok {
+		status.Bandwidth = provider.GetBandwidthUsage()
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, s := range a.syncs {
+		if s.State == AgentSyncRunning {
+			status.RunningSyncs++
+		}
+	}
+	return status
+}
+
+var errAgentConflict = errors.New("target is being updated")
+
+// Handler returns the HTTP API of the agent:
+//
+//	GET /status              the AgentStatus of the agent
+//	POST /mode               switch the store to {"mode": "background"} or {"mode": "foreground"}
+//	POST /syncs              start the AgentSyncRequest of the body, returns the AgentSync
+//	GET /syncs               all AgentSyncs the agent knows
+//	GET /syncs/<id>          the AgentSync with id, with its progress
+//	DELETE /syncs/<id>       cancel the sync with id
+//	GET /metrics             the stats of the store in the OpenMetrics text format
+//
+// With AgentOptions.Authenticators the GET requests need read access and the others write access.
+// Requests other than GET need the Content-Type application/json, so web pages can not send them
+// with a plain form.
+func (a *Agent) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeAgentJSON(w, http.StatusOK, a.Status())
+	})
+	mux.HandleFunc("/mode", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var request agentModeRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch request.Mode {
+		case longtailstorelib.Foreground.String():
+			a.SetSessionMode(longtailstorelib.Foreground)
+		case longtailstorelib.Background.String():
+			a.SetSessionMode(longtailstorelib.Background)
+		default:
+			http.Error(w, fmt.Sprintf("unknown mode `%s`, expected foreground or background", request.Mode), http.StatusBadRequest)
+			return
+		}
+		writeAgentJSON(w, http.StatusOK, a.Status())
+	})
+	mux.HandleFunc("/syncs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeAgentJSON(w, http.StatusOK, a.GetSyncs())
+		case http.MethodPost:
+			var request AgentSyncRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s, err := a.StartSync(request)
+			if errors.Cause(err) == errAgentConflict {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if errors.Cause(err) == longtailstorelib.ErrStoreClosed {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeAgentJSON(w, http.StatusAccepted, s)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/syncs/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/syncs/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			a.CancelSync(id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s, ok := a.GetSync(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeAgentJSON(w, http.StatusOK, s)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var stores []longtailstorelib.DetailedStats
+		if provider, ok := a.remoteStore.(longtailstorelib.DetailedStatsProvider); ok {
+			stores = append(stores, provider.GetDetailedStats())
+		}
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		longtailstorelib.WriteOpenMetrics(w, stores)
+	})
+	handler := requireAgentJSON(mux)
+	if len(a.opts.Authenticators) > 0 {
+		return RequireAgentAuth(handler, a.opts.Authenticators...)
+	}
+	if a.opts.ListenAddress == "" || IsLoopbackAddress(a.opts.ListenAddress) {
+		return requireLoopbackHost(handler)
+	}
+	return handler
+}
+
+// requireAgentJSON refuses requests other than GET without the Content-Type application/json with
+// 415 Unsupported Media Type
+func requireAgentJSON(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				http.Error(w, fmt.Sprintf("%s %s needs the Content-Type application/json", r.Method, r.URL.Path), http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// requireLoopbackHost refuses requests with a Host other than localhost, a loopback IP or the host
+// of a unix domain socket with 403 Forbidden
+func requireLoopbackHost(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		ip := net.ParseIP(strings.Trim(host, "[]"))
+		if host != "localhost" && host != agentSocketHost && (ip == nil || !ip.IsLoopback()) {
+			http.Error(w, fmt.Sprintf("host `%s` is not a loopback address", r.Host), http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func writeAgentJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// ListenAgent listens on address, an address starting with unix: is a unix domain socket that is
+// replaced if no agent is listening on it, other addresses are TCP addresses such as 127.0.0.1:7890
+func ListenAgent(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("ListenAgent: an agent is already listening on `%s`", path)
+		}
+		// The socket file of an agent that did not exit cleanly is left behind
+		os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+// NewAgentHTTPClient returns a client for the API of an agent at address, see ListenAgent, and
+// the base URL of the API
+func NewAgentHTTPClient(address string) (*http.Client, string) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		transport := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		}}
+		return &http.Client{Transport: transport}, "http://" + agentSocketHost
+	}
+	return &http.Client{}, "http://" + address
+}
@@ -0,0 +1,515 @@
+package longtailapi
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AgentAccess is what a caller may do with the API of an agent. Reading the status, syncs and
+// metrics of the agent needs AgentReadAccess, starting and cancelling syncs and switching the
+// session mode needs AgentWriteAccess.
+type AgentAccess int
+
+// The access levels of the agent API, each level includes the levels below it
+const (
+	AgentNoAccess AgentAccess = iota
+	AgentReadAccess
+	AgentWriteAccess
+)
+
+func (access AgentAccess) String() string {
+	switch access {
+	case AgentReadAccess:
+		return "read"
+	case AgentWriteAccess:
+		return "write"
+	}
+	return "none"
+}
+
+// ParseAgentAccess parses read or write
+func ParseAgentAccess(s string) (AgentAccess, error) {
+	switch strings.ToLower(s) {
+	case "read":
+		return AgentReadAccess, nil
+	case "write":
+		return AgentWriteAccess, nil
+	}
+	return AgentNoAccess, fmt.Errorf("unknown access `%s`, expected read or write", s)
+}
+
+// AgentCaller is an authenticated caller of the agent API
+type AgentCaller struct {
+	// Name identifies the caller in the log, such as the name of a token or the subject of a certificate
+	Name   string
+	Access AgentAccess
+}
+
+// AgentAuthenticator is an authentication plugin of the agent API, see AgentOptions.Authenticators
+type AgentAuthenticator interface {
+	// Authenticate returns the caller of r. It returns false if r has no credentials that the
+	// authenticator handles and an error if it has credentials that are not valid.
+	Authenticate(r *http.Request) (AgentCaller, bool, error)
+}
+
+// requiredAgentAccess returns the access a request needs, requests that do not change anything need read access
+func requiredAgentAccess(r *http.Request) AgentAccess {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return AgentReadAccess
+	}
+	return AgentWriteAccess
+}
+
+// RequireAgentAuth wraps handler so that only callers authenticated by one of authenticators can
+// use it. The authenticators are tried in order and the first one that finds credentials in the
+// request decides. A request without valid credentials fails with 401 Unauthorized and a caller
+// without the access the method needs with 403 Forbidden, see AgentAccess.
+func RequireAgentAuth(handler http.Handler, authenticators ...AgentAuthenticator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, authenticator := range authenticators {
+			caller, ok, err := authenticator.Authenticate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if !ok {
+				continue
+			}
+			if caller.Access < requiredAgentAccess(r) {
+				http.Error(w, fmt.Sprintf("`%s` has %s access, %s %s needs %s access", caller.Name, caller.Access, r.Method, r.URL.Path, requiredAgentAccess(r)), http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+	})
+}
+
+// bearerToken returns the token of the Authorization header of r
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// BearerTokenAuthenticator authenticates requests with one of a fixed set of bearer tokens
+type BearerTokenAuthenticator struct {
+	// Tokens maps each token to its caller
+	Tokens map[string]AgentCaller
+}
+
+// Authenticate ...
+func (a *BearerTokenAuthenticator) Authenticate(r *http.Request) (AgentCaller, bool, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") == 2 {
+		// A JWT is left to a JWTAuthenticator
+		return AgentCaller{}, false, nil
+	}
+	for known, caller := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return caller, true, nil
+		}
+	}
+	return AgentCaller{}, false, errors.New("unknown bearer token")
+}
+
+// ReadBearerTokens reads the tokens of a BearerTokenAuthenticator from path. Each line is a token,
+// its access, read or write, and an optional name, separated by white space. Empty lines and lines
+// starting with # are skipped.
+func ReadBearerTokens(path string) (map[string]AgentCaller, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadBearerTokens")
+	}
+	defer file.Close()
+	tokens := map[string]AgentCaller{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("ReadBearerTokens: %s:%d: expected a token, read or write and an optional name", path, line)
+		}
+		access, err := ParseAgentAccess(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "ReadBearerTokens: %s:%d", path, line)
+		}
+		name := fmt.Sprintf("token on line %d", line)
+		if len(fields) == 3 {
+			name = fields[2]
+		}
+		tokens[fields[0]] = AgentCaller{Name: name, Access: access}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "ReadBearerTokens")
+	}
+	return tokens, nil
+}
+
+// The default scopes of a JWTAuthenticator
+const (
+	DefaultJWTReadScope  = "longtail:read"
+	DefaultJWTWriteScope = "longtail:write"
+)
+
+// JWTAuthenticator authenticates requests with a JSON Web Token as bearer token, signed with
+// HS256 using Secret or with RS256 or ES256 using PublicKey. The exp and nbf claims are checked
+// if the token has them, iss and aud when Issuer and Audience are set. The scopes in the scope
+// claim, or the scp claim, give the caller access and the sub claim names it.
+type JWTAuthenticator struct {
+	Secret    []byte
+	PublicKey crypto.PublicKey
+	Issuer    string
+	Audience  string
+	// ReadScope and WriteScope grant read and write access, empty uses DefaultJWTReadScope and DefaultJWTWriteScope
+	ReadScope  string
+	WriteScope string
+	// Leeway is the clock skew allowed when exp and nbf are checked
+	Leeway time.Duration
+}
+
+// errJWTKeyMissing is returned by JWTAuthenticator.verify for a token signed with an algorithm it has no key for
+var errJWTKeyMissing = errors.New("no key for the algorithm")
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scopes    []string        `json:"scp"`
+}
+
+// Authenticate ...
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (AgentCaller, bool, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return AgentCaller{}, false, nil
+	}
+	claims, err := a.verify(token, time.Now())
+	if errors.Cause(err) == errJWTKeyMissing {
+		// Left to another JWTAuthenticator with a key for the algorithm
+		return AgentCaller{}, false, nil
+	}
+	if err != nil {
+		return AgentCaller{}, false, errors.Wrap(err, "invalid JWT")
+	}
+	readScope, writeScope := a.ReadScope, a.WriteScope
+	if readScope == "" {
+		readScope = DefaultJWTReadScope
+	}
+	if writeScope == "" {
+		writeScope = DefaultJWTWriteScope
+	}
+	caller := AgentCaller{Name: claims.Subject}
+	for _, scope := range append(strings.Fields(claims.Scope), claims.Scopes...) {
+		if scope == writeScope {
+			caller.Access = AgentWriteAccess
+		} else if scope == readScope && caller.Access < AgentReadAccess {
+			caller.Access = AgentReadAccess
+		}
+	}
+	return caller, true, nil
+}
+
+// verify checks the signature and the claims of token and returns its claims
+func (a *JWTAuthenticator) verify(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return claims, errors.Wrap(err, "header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.Wrap(err, "signature")
+	}
+	err = a.verifySignature(header.Algorithm, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return claims, err
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return claims, errors.Wrap(err, "claims")
+	}
+	if claims.ExpiresAt != nil && now.Add(-a.Leeway).After(time.Unix(int64(*claims.ExpiresAt), 0)) {
+		return claims, errors.New("the token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(a.Leeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return claims, errors.New("the token is not valid yet")
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return claims, fmt.Errorf("issuer `%s` is not `%s`", claims.Issuer, a.Issuer)
+	}
+	if a.Audience != "" && !jwtHasAudience(claims.Audience, a.Audience) {
+		return claims, fmt.Errorf("the token is not for audience `%s`", a.Audience)
+	}
+	return claims, nil
+}
+
+// verifySignature checks signature of signed with the key for algorithm, a token is never accepted
+// with another algorithm than the one the key is for
+func (a *JWTAuthenticator) verifySignature(algorithm string, signed []byte, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	switch algorithm {
+	case "HS256":
+		if len(a.Secret) == 0 {
+			return errors.Wrap(errJWTKeyMissing, "HS256")
+		}
+		mac := hmac.New(sha256.New, a.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case "RS256":
+		key, ok := a.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.Wrap(errJWTKeyMissing, "RS256")
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return errors.New("bad signature")
+		}
+		return nil
+	case "ES256":
+		key, ok := a.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.Wrap(errJWTKeyMissing, "ES256")
+		}
+		if len(signature) != 64 {
+			return errors.New("bad signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm `%s` is not supported", algorithm)
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// jwtHasAudience returns true if the aud claim, a string or a list of strings, has audience
+func jwtHasAudience(claim json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(claim, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(claim, &many) == nil {
+		for _, a := range many {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadJWTPublicKey reads the RSA or ECDSA public key of a JWTAuthenticator from a PEM file with a
+// public key or a certificate
+func ReadJWTPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadJWTPublicKey")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("ReadJWTPublicKey: `%s` is not a PEM file", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "ReadJWTPublicKey")
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "ReadJWTPublicKey")
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("ReadJWTPublicKey: `%s` is not an RSA or ECDSA key", path)
+}
+
+// ClientCertAuthenticator authenticates requests with the TLS client certificate of the
+// connection, see AgentTLSConfig. Only certificates that were verified against the client CAs of
+// the server are accepted, the caller is named by the common name of the certificate.
+type ClientCertAuthenticator struct {
+	// Access maps common names to their access
+	Access map[string]AgentAccess
+	// DefaultAccess is the access of the other verified certificates
+	DefaultAccess AgentAccess
+}
+
+// Authenticate ...
+func (a *ClientCertAuthenticator) Authenticate(r *http.Request) (AgentCaller, bool, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return AgentCaller{}, false, nil
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	access, ok := a.Access[name]
+	if !ok {
+		access = a.DefaultAccess
+	}
+	return AgentCaller{Name: name, Access: access}, true, nil
+}
+
+// AgentTLSConfig returns the TLS config of an agent that serves its API with the certificate and
+// key in certFile and keyFile. If clientCAFile is set, client certificates signed by the CAs in it
+// are verified for a ClientCertAuthenticator. Clients without a certificate can still connect and
+// authenticate with a bearer token.
+func AgentTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "AgentTLSConfig")
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pool, err := readCertPool(clientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "AgentTLSConfig")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func readCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in `%s`", path)
+	}
+	return pool, nil
+}
+
+// IsLoopbackAddress returns true if address, see ListenAgent, can only be reached from this
+// machine, an agent listening on another address should require authentication
+func IsLoopbackAddress(address string) bool {
+	if strings.HasPrefix(address, "unix:") {
+		return true
+	}
+	address = strings.TrimPrefix(address, "https://")
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// AgentClientOptions are the credentials a client of the agent API authenticates with
+type AgentClientOptions struct {
+	// Token is sent as bearer token
+	Token string
+	// RootCAFile verifies the certificate of an agent at an https:// address, empty uses the system roots
+	RootCAFile string
+	// CertFile and KeyFile are the client certificate for a ClientCertAuthenticator
+	CertFile string
+	KeyFile  string
+}
+
+// NewAuthenticatedAgentHTTPClient returns a client for the API of an agent at address that
+// authenticates with opts, and the base URL of the API. An address starting with https:// is
+// reached over TLS, see AgentTLSConfig.
+func NewAuthenticatedAgentHTTPClient(address string, opts AgentClientOptions) (*http.Client, string, error) {
+	var client *http.Client
+	var baseURL string
+	if strings.HasPrefix(address, "https://") {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if opts.RootCAFile != "" {
+			pool, err := readCertPool(opts.RootCAFile)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "NewAuthenticatedAgentHTTPClient")
+			}
+			config.RootCAs = pool
+		}
+		if opts.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "NewAuthenticatedAgentHTTPClient")
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		baseURL = strings.TrimSuffix(address, "/")
+	} else {
+		client, baseURL = NewAgentHTTPClient(address)
+	}
+	if opts.Token != "" {
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		client.Transport = &bearerTokenTransport{base: base, token: opts.Token}
+	}
+	return client, baseURL, nil
+}
+
+// bearerTokenTransport adds a bearer token to the requests of a client
+type bearerTokenTransport struct {
+	base  http.RoundTripper
+	token string
+}
+
+func (t *bearerTokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,159 @@
+package longtailapi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// isEmptyFolder returns true if path is an empty folder or does not exist
+func isEmptyFolder(path string) (bool, error) {
+	folder, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer folder.Close()
+	_, err = folder.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// linkFile clones sourcePath to targetPath with a reflink on file systems that support it so the
+// copies can change independently, and hard links them elsewhere
+func linkFile(sourcePath string, targetPath string, reflinks bool) error {
+	if reflinks && reflinkFile(sourcePath, targetPath) == nil {
+		return nil
+	}
+	return os.Link(sourcePath, targetPath)
+}
+
+// linkBaseFiles links the files of the version that are unchanged in the base folder into the empty
+// target folder, Downsync then only writes the files that differ from the base. The base is
+// indexed with the chunking and hashing of the version so the content hashes can be compared.
+func linkBaseFiles(
+	target DownsyncTarget,
+	sourceVersionIndex longtaillib.Longtail_VersionIndex,
+	fs longtaillib.Longtail_StorageAPI,
+	jobs longtaillib.Longtail_JobAPI,
+	hashRegistry longtaillib.Longtail_HashRegistryAPI,
+	pathFilter longtaillib.Longtail_PathFilterAPI,
+	reflinks bool,
+	progress ProgressFunc,
+	opts []longtailstorelib.StoreOption) (uint32, uint64, error) {
+	linkedCount := uint32(0)
+	linkedSize := uint64(0)
+	empty, err := isEmptyFolder(target.TargetPath)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "Downsync: failed to list `%s`", target.TargetPath)
+	}
+	if !empty {
+		return 0, 0, fmt.Errorf("Downsync: target `%s` must be empty to link files from the base `%s`", target.TargetPath, target.BasePath)
+	}
+
+	baseFolderScanner := FolderScanner{}
+	if len(target.BaseIndexPath) == 0 {
+		baseFolderScanner.Scan(target.BasePath, pathFilter, fs)
+	}
+	baseIndexReader := VersionIndexReader{}
+	baseIndexReader.Read(target.BasePath,
+		target.BaseIndexPath,
+		sourceVersionIndex.GetTargetChunkSize(),
+		NoCompressionType,
+		sourceVersionIndex.GetHashIdentifier(),
+		fs,
+		jobs,
+		hashRegistry,
+		&baseFolderScanner,
+		progress,
+		opts)
+	baseVersionIndex, _, _, err := baseIndexReader.Get()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer baseVersionIndex.Dispose()
+
+	type baseAsset struct {
+		path        string
+		size        uint64
+		permissions uint16
+	}
+	baseAssets := map[uint64]baseAsset{}
+	baseAssetHashes := baseVersionIndex.GetAssetHashes()
+	for a := uint32(0); a < baseVersionIndex.GetAssetCount(); a++ {
+		path := baseVersionIndex.GetAssetPath(a)
+		size := baseVersionIndex.GetAssetSize(a)
+		if isDirPath(path) || size == 0 {
+			continue
+		}
+		baseAssets[baseAssetHashes[a]] = baseAsset{path, size, baseVersionIndex.GetAssetPermissions(a)}
+	}
+
+	assetHashes := sourceVersionIndex.GetAssetHashes()
+	for a := uint32(0); a < sourceVersionIndex.GetAssetCount(); a++ {
+		path := sourceVersionIndex.GetAssetPath(a)
+		base, exists := baseAssets[assetHashes[a]]
+		// Hard links share the permissions so they have to match
+		if !exists || base.size != sourceVersionIndex.GetAssetSize(a) || base.permissions != sourceVersionIndex.GetAssetPermissions(a) {
+			continue
+		}
+		targetPath := filepath.Join(target.TargetPath, filepath.FromSlash(path))
+		err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "Downsync: failed to create the folder of `%s`", targetPath)
+		}
+		err = linkFile(filepath.Join(target.BasePath, filepath.FromSlash(base.path)), targetPath, reflinks)
+		if err != nil {
+			// The file is written from the store instead, for example when the base is on another volume
+			continue
+		}
+		linkedCount++
+		linkedSize += base.size
+	}
+	return linkedCount, linkedSize, nil
+}
+
+// unshareModifiedFiles removes the hard linked files of the target that the version changes before
+// the version is written, they are written in place and would change the other links as well
+func unshareModifiedFiles(
+	targetFolderPath string,
+	sourceVersionIndex longtaillib.Longtail_VersionIndex,
+	targetVersionIndex longtaillib.Longtail_VersionIndex) error {
+	sourceAssets := map[string]uint32{}
+	for a := uint32(0); a < sourceVersionIndex.GetAssetCount(); a++ {
+		sourceAssets[sourceVersionIndex.GetAssetPath(a)] = a
+	}
+	sourceAssetHashes := sourceVersionIndex.GetAssetHashes()
+	targetAssetHashes := targetVersionIndex.GetAssetHashes()
+	for a := uint32(0); a < targetVersionIndex.GetAssetCount(); a++ {
+		path := targetVersionIndex.GetAssetPath(a)
+		s, exists := sourceAssets[path]
+		if isDirPath(path) || !exists {
+			continue
+		}
+		if sourceAssetHashes[s] == targetAssetHashes[a] && sourceVersionIndex.GetAssetPermissions(s) == targetVersionIndex.GetAssetPermissions(a) {
+			continue
+		}
+		targetPath := filepath.Join(targetFolderPath, filepath.FromSlash(path))
+		linkCount, err := fileLinkCount(targetPath)
+		if err != nil {
+			return errors.Wrapf(err, "Downsync: failed to get the link count of `%s`", targetPath)
+		}
+		if linkCount > 1 {
+			err = os.Remove(targetPath)
+			if err != nil {
+				return errors.Wrapf(err, "Downsync: failed to unlink `%s`", targetPath)
+			}
+		}
+	}
+	return nil
+}
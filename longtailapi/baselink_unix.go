@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package longtailapi
+
+import "golang.org/x/sys/unix"
+
+// fileLinkCount returns the number of hard links to the file at path
+func fileLinkCount(path string) (uint64, error) {
+	var stat unix.Stat_t
+	err := unix.Stat(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Nlink), nil
+}
@@ -0,0 +1,22 @@
+package longtailapi
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// fileLinkCount returns the number of hard links to the file at path
+func fileLinkCount(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var info windows.ByHandleFileInformation
+	err = windows.GetFileInformationByHandle(windows.Handle(f.Fd()), &info)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.NumberOfLinks), nil
+}
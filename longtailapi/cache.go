@@ -0,0 +1,257 @@
+package longtailapi
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// cacheLockName is the lock file in the root of a cache folder. Every process that uses the cache
+// holds a shared lock on it and eviction takes an exclusive lock, so blocks are never evicted from
+// under a running downsync. The file system block store writes blocks to a temp file and renames
+// them into place so concurrent downsyncs never read a partially written block.
+const cacheLockName = "cache.lock"
+
+// localCache is a cache folder used by this process, see openLocalCache
+type localCache struct {
+	path     string
+	lockFile *os.File
+
+	usedBlocksLock sync.Mutex
+	usedBlocks     map[uint64]bool
+}
+
+// openLocalCache takes a shared lock on the cache folder at cachePath, it waits while another
+// process is evicting blocks from it
+func openLocalCache(cachePath string) (*localCache, error) {
+	lockFile, err := lockCacheFolder(cachePath, false, true)
+	if err != nil {
+		return nil, err
+	}
+	return &localCache{path: cachePath, lockFile: lockFile, usedBlocks: map[uint64]bool{}}, nil
+}
+
+// LockCache takes a shared lock on the cache folder at cachePath for a command that creates its own
+// file system block store for the cache, so other processes do not evict blocks while it runs. Call
+// the returned function once the block store has been disposed.
+func LockCache(cachePath string) (func(), error) {
+	lockFile, err := lockCacheFolder(cachePath, false, true)
+	if err != nil {
+		return nil, err
+	}
+	return func() { unlockCacheFolder(lockFile) }, nil
+}
+
+// lockCacheFolder returns the locked lock file of the cache folder, or nil if wait is false and
+// another process holds a conflicting lock
+func lockCacheFolder(cachePath string, exclusive bool, wait bool) (*os.File, error) {
+	err := os.MkdirAll(cachePath, os.ModePerm)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lockCacheFolder: failed to create `%s`", cachePath)
+	}
+	lockPath := filepath.Join(cachePath, cacheLockName)
+	lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lockCacheFolder: failed to open `%s`", lockPath)
+	}
+	locked, err := flockFile(lockFile, exclusive, wait)
+	if err != nil {
+		lockFile.Close()
+		return nil, errors.Wrapf(err, "lockCacheFolder: failed to lock `%s`", lockPath)
+	}
+	if !locked {
+		lockFile.Close()
+		return nil, nil
+	}
+	return lockFile, nil
+}
+
+func unlockCacheFolder(lockFile *os.File) {
+	funlockFile(lockFile)
+	lockFile.Close()
+}
+
+func getCachedBlockPath(cachePath string, blockHash uint64) string {
+	hashString := fmt.Sprintf("%016x", blockHash)
+	return filepath.Join(cachePath, "chunks", hashString[:4], "0x"+hashString+".lrb")
+}
+
+// getCachedBlockHash returns the hash of the block at a path from getCachedBlockPath, or zero
+func getCachedBlockHash(blockPath string) uint64 {
+	name := strings.TrimSuffix(filepath.Base(blockPath), ".lrb")
+	blockHash, err := strconv.ParseUint(strings.TrimPrefix(name, "0x"), 16, 64)
+	if err != nil {
+		return 0
+	}
+	return blockHash
+}
+
+func (c *localCache) blockUsed(blockHash uint64) {
+	c.usedBlocksLock.Lock()
+	defer c.usedBlocksLock.Unlock()
+	c.usedBlocks[blockHash] = true
+}
+
+// close marks the blocks read from the cache as recently used and releases the cache. If maxSize is
+// not zero the least recently used blocks are evicted unless another process is using the cache.
+func (c *localCache) close(maxSize int64) {
+	now := time.Now()
+	for blockHash := range c.usedBlocks {
+		os.Chtimes(getCachedBlockPath(c.path, blockHash), now, now)
+	}
+	unlockCacheFolder(c.lockFile)
+	if maxSize <= 0 {
+		return
+	}
+	evictedCount, err := EvictCache(c.path, maxSize)
+	if err != nil {
+		log.Printf("WARNING: Failed to evict blocks from cache `%s`: %v\n", c.path, err)
+		return
+	}
+	if evictedCount > 0 {
+		log.Printf("Evicted %d blocks from cache `%s`\n", evictedCount, c.path)
+	}
+}
+
+type cachedBlock struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// EvictCache removes the least recently used blocks of the cache folder at cachePath until the
+// blocks take at most maxSize bytes and returns the number of removed blocks. Nothing is removed
+// while another process uses the cache, the last process to release it does the eviction. Blocks
+// pinned with PinCacheBlocks are kept and count towards maxSize.
+func EvictCache(cachePath string, maxSize int64) (int, error) {
+	lockFile, err := lockCacheFolder(cachePath, true, false)
+	if err != nil {
+		return 0, errors.Wrap(err, "EvictCache")
+	}
+	if lockFile == nil {
+		return 0, nil
+	}
+	defer unlockCacheFolder(lockFile)
+
+	pinnedBlocks, err := readPinnedBlocks(cachePath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "EvictCache: failed to read pins of `%s`", cachePath)
+	}
+
+	var blocks []cachedBlock
+	totalSize := int64(0)
+	chunksPath := filepath.Join(cachePath, "chunks")
+	err = filepath.Walk(chunksPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == chunksPath {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".lrb") {
+			return nil
+		}
+		totalSize += info.Size()
+		if pinnedBlocks[getCachedBlockHash(path)] {
+			return nil
+		}
+		blocks = append(blocks, cachedBlock{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "EvictCache: failed to list blocks of `%s`", cachePath)
+	}
+	if totalSize <= maxSize {
+		return 0, nil
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].modTime.Before(blocks[j].modTime)
+	})
+	evictedCount := 0
+	for _, block := range blocks {
+		if totalSize <= maxSize {
+			break
+		}
+		err = os.Remove(block.path)
+		if err != nil && !os.IsNotExist(err) {
+			break
+		}
+		totalSize -= block.size
+		evictedCount++
+	}
+	if evictedCount > 0 {
+		// The file system block store rebuilds its store index from the remaining blocks
+		storeIndexErr := os.Remove(filepath.Join(cachePath, "store.lsi"))
+		if storeIndexErr != nil && !os.IsNotExist(storeIndexErr) && err == nil {
+			err = storeIndexErr
+		}
+	}
+	if err != nil {
+		return evictedCount, errors.Wrapf(err, "EvictCache: failed to evict blocks from `%s`", cachePath)
+	}
+	return evictedCount, nil
+}
+
+// cacheUsageStore records the blocks read from the local store of a cache so they can be marked
+// as recently used when the cache is closed
+type cacheUsageStore struct {
+	backingStore longtaillib.Longtail_BlockStoreAPI
+	cache        *localCache
+}
+
+type cacheUsageGetStoredBlockCompletionAPI struct {
+	cache            *localCache
+	blockHash        uint64
+	asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI
+}
+
+func (a *cacheUsageGetStoredBlockCompletionAPI) OnComplete(storedBlock longtaillib.Longtail_StoredBlock, errno int) {
+	if errno == 0 {
+		a.cache.blockUsed(a.blockHash)
+	}
+	a.asyncCompleteAPI.OnComplete(storedBlock, errno)
+}
+
+// PutStoredBlock ...
+func (s *cacheUsageStore) PutStoredBlock(storedBlock longtaillib.Longtail_StoredBlock, asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI) int {
+	return s.backingStore.PutStoredBlock(storedBlock, asyncCompleteAPI)
+}
+
+// PreflightGet ...
+func (s *cacheUsageStore) PreflightGet(blockHashes []uint64, asyncCompleteAPI longtaillib.Longtail_AsyncPreflightStartedAPI) int {
+	return s.backingStore.PreflightGet(blockHashes, asyncCompleteAPI)
+}
+
+// GetStoredBlock ...
+func (s *cacheUsageStore) GetStoredBlock(blockHash uint64, asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI) int {
+	return s.backingStore.GetStoredBlock(blockHash, longtaillib.CreateAsyncGetStoredBlockAPI(&cacheUsageGetStoredBlockCompletionAPI{cache: s.cache, blockHash: blockHash, asyncCompleteAPI: asyncCompleteAPI}))
+}
+
+// GetExistingContent ...
+func (s *cacheUsageStore) GetExistingContent(chunkHashes []uint64, minBlockUsagePercent uint32, asyncCompleteAPI longtaillib.Longtail_AsyncGetExistingContentAPI) int {
+	return s.backingStore.GetExistingContent(chunkHashes, minBlockUsagePercent, asyncCompleteAPI)
+}
+
+// GetStats ...
+func (s *cacheUsageStore) GetStats() (longtaillib.BlockStoreStats, int) {
+	return s.backingStore.GetStats()
+}
+
+// Flush ...
+func (s *cacheUsageStore) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI) int {
+	return s.backingStore.Flush(asyncCompleteAPI)
+}
+
+// Close ...
+func (s *cacheUsageStore) Close() {
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package longtailapi
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// flockFile locks f and returns false if wait is false and another process holds a conflicting lock
+func flockFile(f *os.File, exclusive bool, wait bool) (bool, error) {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EWOULDBLOCK {
+			return false, nil
+		}
+		return err == nil, err
+	}
+}
+
+func funlockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
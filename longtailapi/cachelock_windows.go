@@ -0,0 +1,27 @@
+package longtailapi
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// flockFile locks f and returns false if wait is false and another process holds a conflicting lock
+func flockFile(f *os.File, exclusive bool, wait bool) (bool, error) {
+	flags := uint32(0)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	if !wait {
+		flags |= windows.LOCKFILE_FAIL_IMMEDIATELY
+	}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func funlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
@@ -0,0 +1,161 @@
+package longtailapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// cachePinsFolder holds a file for each pin of a cache folder with the hashes of the pinned blocks
+const cachePinsFolder = "pins"
+
+// cachePin is the JSON content of a pin file
+type cachePin struct {
+	Blocks []IndexHash `json:"blocks"`
+}
+
+func getCachePinPath(cachePath string, name string) (string, error) {
+	if len(name) == 0 || strings.ContainsAny(name, `/\:`) || name == "." || name == ".." {
+		return "", fmt.Errorf("getCachePinPath: invalid pin name `%s`", name)
+	}
+	return filepath.Join(cachePath, cachePinsFolder, name+".json"), nil
+}
+
+// PinCacheBlocks replaces the blocks pinned under name in the cache folder at cachePath, pinned
+// blocks are never evicted by EvictCache. A launcher pins the blocks of the installed version
+// under a fixed name so they stay in the cache while the blocks of older versions age out.
+func PinCacheBlocks(cachePath string, name string, blockHashes []uint64) error {
+	pinPath, err := getCachePinPath(cachePath, name)
+	if err != nil {
+		return err
+	}
+	lockFile, err := lockCacheFolder(cachePath, false, true)
+	if err != nil {
+		return errors.Wrap(err, "PinCacheBlocks")
+	}
+	defer unlockCacheFolder(lockFile)
+
+	pin := cachePin{Blocks: make([]IndexHash, len(blockHashes))}
+	for i, blockHash := range blockHashes {
+		pin.Blocks[i] = IndexHash(blockHash)
+	}
+	data, err := json.Marshal(pin)
+	if err != nil {
+		return errors.Wrapf(err, "PinCacheBlocks: failed to encode pin `%s`", name)
+	}
+	err = os.MkdirAll(filepath.Dir(pinPath), os.ModePerm)
+	if err != nil {
+		return errors.Wrapf(err, "PinCacheBlocks: failed to create `%s`", filepath.Dir(pinPath))
+	}
+	// The pin is renamed into place so an eviction never reads a partially written pin
+	tempPath := pinPath + ".tmp"
+	err = ioutil.WriteFile(tempPath, data, 0644)
+	if err == nil {
+		err = os.Rename(tempPath, pinPath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrapf(err, "PinCacheBlocks: failed to write `%s`", pinPath)
+	}
+	return nil
+}
+
+// UnpinCache removes the pin name from the cache folder at cachePath so its blocks can be evicted
+func UnpinCache(cachePath string, name string) error {
+	pinPath, err := getCachePinPath(cachePath, name)
+	if err != nil {
+		return err
+	}
+	lockFile, err := lockCacheFolder(cachePath, false, true)
+	if err != nil {
+		return errors.Wrap(err, "UnpinCache")
+	}
+	defer unlockCacheFolder(lockFile)
+	err = os.Remove(pinPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.Wrapf(longtaillib.ErrENOENT, "UnpinCache: no pin `%s` in `%s`", name, cachePath)
+		}
+		return errors.Wrapf(err, "UnpinCache: failed to remove `%s`", pinPath)
+	}
+	return nil
+}
+
+// GetCachePins returns the names of the pins of the cache folder at cachePath
+func GetCachePins(cachePath string) ([]string, error) {
+	pinPaths, err := filepath.Glob(filepath.Join(cachePath, cachePinsFolder, "*.json"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "GetCachePins: failed to list pins of `%s`", cachePath)
+	}
+	names := make([]string, len(pinPaths))
+	for i, pinPath := range pinPaths {
+		names[i] = strings.TrimSuffix(filepath.Base(pinPath), ".json")
+	}
+	return names, nil
+}
+
+// readPinnedBlocks returns the blocks of all pins of the cache folder, the caller holds the lock
+// of the cache folder
+func readPinnedBlocks(cachePath string) (map[uint64]bool, error) {
+	pinnedBlocks := map[uint64]bool{}
+	pinPaths, err := filepath.Glob(filepath.Join(cachePath, cachePinsFolder, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, pinPath := range pinPaths {
+		data, err := ioutil.ReadFile(pinPath)
+		if err != nil {
+			return nil, err
+		}
+		pin := cachePin{}
+		err = json.Unmarshal(data, &pin)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read pin `%s`", pinPath)
+		}
+		for _, blockHash := range pin.Blocks {
+			pinnedBlocks[uint64(blockHash)] = true
+		}
+	}
+	return pinnedBlocks, nil
+}
+
+// getVersionChunkHashes adds the chunk hashes of the version indexes at sourcePaths to chunkHashSet
+func getVersionChunkHashes(sourcePaths []string, chunkHashSet map[uint64]bool, opts []longtailstorelib.StoreOption) error {
+	for _, sourcePath := range sourcePaths {
+		vbuffer, err := longtailstorelib.ReadFromURI(sourcePath, opts...)
+		if err != nil {
+			return err
+		}
+		versionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(vbuffer)
+		if errno != 0 {
+			return errors.Wrap(longtaillib.NewError(errno, "ReadVersionIndexFromBuffer", sourcePath, ""), "getVersionChunkHashes")
+		}
+		for _, chunkHash := range versionIndex.GetChunkHashes() {
+			chunkHashSet[chunkHash] = true
+		}
+		versionIndex.Dispose()
+	}
+	return nil
+}
+
+// pinChunkBlocks pins the blocks in indexStore that hold the chunks of chunkHashSet under name
+func pinChunkBlocks(cachePath string, name string, indexStore longtaillib.Longtail_BlockStoreAPI, chunkHashSet map[uint64]bool) error {
+	chunkHashes := make([]uint64, 0, len(chunkHashSet))
+	for chunkHash := range chunkHashSet {
+		chunkHashes = append(chunkHashes, chunkHash)
+	}
+	storeIndex, errno := GetExistingStoreIndexSync(indexStore, chunkHashes, 0)
+	if errno != 0 {
+		return errors.Wrap(longtaillib.NewError(errno, "GetExistingContent", "", ""), "pinChunkBlocks")
+	}
+	blockHashes := append([]uint64{}, storeIndex.GetBlockHashes()...)
+	storeIndex.Dispose()
+	return PinCacheBlocks(cachePath, name, blockHashes)
+}
@@ -0,0 +1,694 @@
+package longtailapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// DownsyncTarget is a version to write to a folder, or to a disk image or block device
+type DownsyncTarget struct {
+	// SourcePath is the path of the version index
+	SourcePath string
+	TargetPath string
+	// TargetIndexPath is an optional pre-computed version index of the current content of TargetPath
+	TargetIndexPath string
+	// Image writes the files of the version into the disk image or block device at TargetPath at
+	// the offsets given by ImageLayout instead of into a folder
+	Image bool
+	// ImageAlignment is the alignment of the files in the image, DefaultImageAlignment if zero
+	ImageAlignment uint64
+	// ImageLayoutPath is an optional path where the ImageLayout of the image is written as JSON
+	ImageLayoutPath string
+	// OpenImage opens the restore target of an Image target, OpenImageFile if nil
+	OpenImage func(path string, size uint64) (RestoreTarget, error)
+	// BasePath is an optional folder with a previous version, the files of the version that are
+	// unchanged in it are reflinked or hard linked into the empty TargetPath instead of written
+	BasePath string
+	// BaseIndexPath is an optional pre-computed version index of BasePath
+	BaseIndexPath string
+}
+
+// DownsyncOptions describes the versions to download from a store
+type DownsyncOptions struct {
+	StoreSettings
+	StorageURI string
+	Targets    []DownsyncTarget
+	// CachePath is an optional folder where downloaded blocks are cached, it can be shared by concurrent processes
+	CachePath string
+	// MaxCacheSize evicts the least recently used blocks from the cache when it holds more bytes, zero keeps all blocks
+	MaxCacheSize int64
+	// CachePin is an optional name that all blocks of the versions are pinned under in the cache
+	// once the targets are updated, so they are not evicted while older versions age out. See
+	// PinCacheBlocks.
+	CachePin          string
+	RetainPermissions bool
+	// Validate re-indexes the targets after the update and compares them to the versions
+	Validate bool
+	// VerifyBlocks re-hashes the chunks of downloaded blocks
+	VerifyBlocks bool
+	// Sparse leaves holes for runs of at least SparseMinZeroRun zero bytes in the written files instead
+	// of writing them, on file systems with sparse files such as ext4, XFS and APFS
+	Sparse bool
+	// NoReflinks turns off cloning of files with the same content on file systems with reflinks, such
+	// as btrfs, XFS, APFS and ReFS, and the reflinks of files from the base folders of the targets
+	NoReflinks bool
+	// VerifyDisk checks the files of targets with a TargetIndexPath against the chunk hashes of the
+	// recorded index before the update and writes the files that differ on disk again, by default
+	// the recorded index is trusted
+	VerifyDisk bool
+	// VersionLocalStoreIndexPath is an optional store index written by Upsync that avoids reading the full store index
+	VersionLocalStoreIndexPath string
+	// SessionStatePath is an optional file where the session state of the remote store and the
+	// targets that have been updated are kept, see longtailstorelib.SessionState. A downsync with
+	// the same SessionStatePath reuses the store index and preflighted blocks of the session while
+	// the store index is unchanged and skips the targets that an interrupted downsync completed.
+	SessionStatePath string
+	// IncludeFilterRegEx and ExcludeFilterRegEx are optional regexes separated with **
+	IncludeFilterRegEx string
+	ExcludeFilterRegEx string
+	Hooks              SyncHooks
+	Progress           ProgressFunc
+}
+
+// SparseMinZeroRun is the shortest run of zeros that Sparse downsyncs leave as a hole
+const SparseMinZeroRun = 32768
+
+// DownsyncResult describes the updated targets
+type DownsyncResult struct {
+	// LinkedFileCount and LinkedSize count the files that were linked from the base folders of the targets
+	LinkedFileCount uint32
+	LinkedSize      uint64
+	// VersionHashes is the SHA-256 of the version index of each target by target path
+	VersionHashes map[string]string
+	StoreStats    []StoreStat
+	TimeStats     []TimeStat
+	// Attempts is the number of times the targets were downsynced, see RestoreWithRetry
+	Attempts int
+}
+
+// Downsync updates all targets concurrently in one store session so they share the store index,
+// the block cache and in-flight block requests. Cancelling ctx flushes the block cache and stops
+// the downsync between its phases, a target that is being updated runs to completion. The hooks
+// of opts run before and after the downsync.
+func Downsync(ctx context.Context, opts DownsyncOptions) (DownsyncResult, error) {
+	return downsyncWithHooks(ctx, opts, downsync)
+}
+
+// downsyncWithHooks runs the hooks of opts before and after run
+func downsyncWithHooks(ctx context.Context, opts DownsyncOptions, run func(ctx context.Context, opts DownsyncOptions) (DownsyncResult, error)) (DownsyncResult, error) {
+	startTime := time.Now()
+	payload := HookPayload{
+		Event:      HookPreDownsync,
+		StorageURI: longtailstorelib.RedactStoreURI(opts.StorageURI),
+		Versions:   make([]HookVersion, len(opts.Targets))}
+	for i, target := range opts.Targets {
+		payload.Versions[i] = HookVersion{SourcePath: target.SourcePath, TargetPath: target.TargetPath}
+	}
+	err := opts.Hooks.runPre(ctx, payload)
+	if err != nil {
+		return DownsyncResult{}, errors.Wrap(err, "Downsync")
+	}
+	result, err := run(ctx, opts)
+	payload.Event = HookPostDownsync
+	for i := range payload.Versions {
+		payload.Versions[i].VersionHash = result.VersionHashes[payload.Versions[i].TargetPath]
+	}
+	payload.Stats = &HookStats{
+		DurationSeconds: time.Since(startTime).Seconds(),
+		LinkedFileCount: result.LinkedFileCount,
+		LinkedSize:      result.LinkedSize,
+		PhaseSeconds:    hookPhaseSeconds(result.TimeStats)}
+	opts.Hooks.runPost(payload, err)
+	return result, err
+}
+
+func downsync(ctx context.Context, opts DownsyncOptions) (DownsyncResult, error) {
+	result := DownsyncResult{VersionHashes: map[string]string{}, Attempts: 1}
+
+	setupStartTime := time.Now()
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(opts.workerCount()), 0)
+	defer jobs.Dispose()
+
+	pathFilter, err := CreatePathFilter(opts.IncludeFilterRegEx, opts.ExcludeFilterRegEx)
+	if err != nil {
+		return result, err
+	}
+
+	for _, target := range opts.Targets {
+		if len(target.BasePath) > 0 && (target.Image || len(target.TargetIndexPath) > 0) {
+			return result, fmt.Errorf("Downsync: the base `%s` of `%s` can not be used with an image or a target index", target.BasePath, target.TargetPath)
+		}
+	}
+
+	checkpoint := downsyncCheckpoint{}
+	skippedSourcePaths := []string{}
+	if len(opts.SessionStatePath) > 0 {
+		var sessionState longtailstorelib.SessionState
+		sessionState, checkpoint = readDownsyncSession(opts.SessionStatePath, opts.StoreOptions)
+		opts.Targets, checkpoint.CompletedTargets, err = skipCompletedTargets(opts.Targets, checkpoint, opts.StoreOptions)
+		if err != nil {
+			return result, err
+		}
+		for _, skippedTarget := range checkpoint.CompletedTargets {
+			skippedSourcePaths = append(skippedSourcePaths, skippedTarget.SourcePath)
+			result.VersionHashes[skippedTarget.TargetPath] = skippedTarget.SourceHash
+		}
+		if len(sessionState.Store) > 0 {
+			opts.StoreOptions = append(append([]longtailstorelib.StoreOption{}, opts.StoreOptions...), longtailstorelib.WithSessionState(sessionState))
+		}
+	}
+
+	fs := longtaillib.CreateFSStorageAPI()
+	defer fs.Dispose()
+	targetFS := fs
+	if opts.Sparse {
+		targetFS = longtaillib.CreateSparseStorageAPI(fs, SparseMinZeroRun)
+		defer targetFS.Dispose()
+	}
+
+	targetFolderScanners := make([]FolderScanner, len(opts.Targets))
+	for i, target := range opts.Targets {
+		// Targets with a base are scanned once the base files are linked
+		if len(target.TargetIndexPath) == 0 && !target.Image && len(target.BasePath) == 0 {
+			targetFolderScanners[i].Scan(target.TargetPath, pathFilter, fs)
+		}
+	}
+
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+
+	readSourceStartTime := time.Now()
+
+	sourceVersionIndexes := make([]longtaillib.Longtail_VersionIndex, len(opts.Targets))
+	sourceHashes := make([]string, len(opts.Targets))
+	defer func() {
+		for _, sourceVersionIndex := range sourceVersionIndexes {
+			sourceVersionIndex.Dispose()
+		}
+	}()
+	for i, target := range opts.Targets {
+		vbuffer, err := longtailstorelib.ReadFromURI(target.SourcePath, opts.StoreOptions...)
+		if err != nil {
+			return result, err
+		}
+		sourceHashes[i] = getSourceHash(vbuffer)
+		result.VersionHashes[target.TargetPath] = sourceHashes[i]
+		var errno int
+		sourceVersionIndexes[i], errno = longtaillib.ReadVersionIndexFromBuffer(vbuffer)
+		if errno != 0 {
+			return result, errors.Wrap(longtaillib.NewError(errno, "ReadVersionIndexFromBuffer", target.SourcePath, ""), "Downsync")
+		}
+	}
+
+	readSourceTime := time.Since(readSourceStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Read source index", readSourceTime})
+
+	targetIndexReaders := make([]VersionIndexReader, len(opts.Targets))
+	defer func() {
+		for i := range targetIndexReaders {
+			targetVersionIndex, _, _, _ := targetIndexReaders[i].Get()
+			targetVersionIndex.Dispose()
+		}
+	}()
+	for i, target := range opts.Targets {
+		if target.Image {
+			continue
+		}
+		if len(target.BasePath) > 0 {
+			linkStartTime := time.Now()
+			linkedCount, linkedSize, err := linkBaseFiles(target, sourceVersionIndexes[i], fs, jobs, hashRegistry, pathFilter, !opts.NoReflinks, opts.Progress, opts.StoreOptions)
+			if err != nil {
+				return result, err
+			}
+			result.LinkedFileCount += linkedCount
+			result.LinkedSize += linkedSize
+			result.TimeStats = append(result.TimeStats, TimeStat{fmt.Sprintf("Link base `%s`", target.BasePath), time.Since(linkStartTime)})
+			targetFolderScanners[i].Scan(target.TargetPath, pathFilter, fs)
+		}
+		targetIndexReaders[i].Read(target.TargetPath,
+			target.TargetIndexPath,
+			sourceVersionIndexes[i].GetTargetChunkSize(),
+			NoCompressionType,
+			sourceVersionIndexes[i].GetHashIdentifier(),
+			fs,
+			jobs,
+			hashRegistry,
+			&targetFolderScanners[i],
+			opts.Progress,
+			opts.StoreOptions)
+	}
+
+	creg := longtaillib.CreateFullCompressionRegistry()
+	defer creg.Dispose()
+
+	localFS := longtaillib.CreateFSStorageAPI()
+	defer localFS.Dispose()
+
+	// The blocks of each target are checked against the remote store before the target is written
+	var preflighter longtailstorelib.BlockPreflighter
+	var hinter longtailstorelib.DownloadOrderHinter
+	var sessionExporter longtailstorelib.SessionStateExporter
+	storeSettings := opts.StoreSettings
+	storeSettings.OnRemoteStore = func(remoteStore longtaillib.BlockStoreAPI) {
+		preflighter, _ = remoteStore.(longtailstorelib.BlockPreflighter)
+		hinter, _ = remoteStore.(longtailstorelib.DownloadOrderHinter)
+		sessionExporter, _ = remoteStore.(longtailstorelib.SessionStateExporter)
+		if opts.OnRemoteStore != nil {
+			opts.OnRemoteStore(remoteStore)
+		}
+	}
+
+	// MaxBlockSize and MaxChunksPerBlock are just temporary values until we get the remote index settings
+	remoteIndexStore, err := CreateBlockStoreForURI(opts.StorageURI, opts.VersionLocalStoreIndexPath, jobs, storeSettings, 8388608, 1024, longtailstorelib.ReadOnly)
+	if err != nil {
+		return result, err
+	}
+	defer remoteIndexStore.Dispose()
+
+	var localIndexStore longtaillib.Longtail_BlockStoreAPI
+	var cacheBlockStore longtaillib.Longtail_BlockStoreAPI
+	var cacheIndexStore longtaillib.Longtail_BlockStoreAPI
+	var compressBlockStore longtaillib.Longtail_BlockStoreAPI
+
+	if len(opts.CachePath) > 0 {
+		cache, err := openLocalCache(NormalizePath(opts.CachePath))
+		if err != nil {
+			return result, err
+		}
+		// Deferred before the stores so it runs after the local store has been disposed
+		defer cache.close(opts.MaxCacheSize)
+
+		localIndexStore = longtaillib.CreateFSBlockStore(jobs, localFS, NormalizePath(opts.CachePath), 8388608, 1024)
+		cacheUsageStore := longtaillib.CreateBlockStoreAPI(&cacheUsageStore{backingStore: localIndexStore, cache: cache})
+		defer cacheUsageStore.Dispose()
+
+		cacheBlockStore = longtaillib.CreateCacheBlockStore(jobs, cacheUsageStore, remoteIndexStore)
+		// Asks the cache and the remote for the existing content in parallel, preferring cached blocks
+		cacheIndexStore = longtaillib.CreateBlockStoreAPI(longtailstorelib.NewCacheIndexBlockStore(cacheUsageStore, remoteIndexStore, cacheBlockStore, opts.StaleCachePolicy))
+
+		compressBlockStore = longtaillib.CreateCompressBlockStore(cacheIndexStore, creg)
+	} else {
+		compressBlockStore = longtaillib.CreateCompressBlockStore(remoteIndexStore, creg)
+	}
+
+	defer cacheBlockStore.Dispose()
+	defer cacheIndexStore.Dispose()
+	defer localIndexStore.Dispose()
+	defer compressBlockStore.Dispose()
+
+	// Verification re-hashes the uncompressed chunks so it has to sit on top of the compress store
+	var verifyBlockStore longtaillib.Longtail_BlockStoreAPI
+	lruBackingStore := compressBlockStore
+	if opts.VerifyBlocks {
+		verifyBlockStore = longtaillib.CreateBlockStoreAPI(longtailstorelib.NewVerifyBlockStore(compressBlockStore, hashRegistry))
+		lruBackingStore = verifyBlockStore
+	}
+	defer verifyBlockStore.Dispose()
+
+	lruBlockStore := longtaillib.CreateLRUBlockStoreAPI(lruBackingStore, 32)
+	defer lruBlockStore.Dispose()
+	// The share store makes concurrent requests for the same block from different targets wait for a single fetch
+	indexStore := longtaillib.CreateShareBlockStore(lruBlockStore)
+	defer indexStore.Dispose()
+
+	// The blocks fetched before an interrupt are kept in the cache for the next downsync
+	stopFlushOnCancel := flushOnCancel(ctx, []longtaillib.Longtail_BlockStoreAPI{compressBlockStore, cacheBlockStore, localIndexStore, remoteIndexStore}, []string{"Compress", "Cache", "Local", "Remote"}, opts.OnCancelFlushed)
+	defer stopFlushOnCancel()
+
+	// preflight checks the blocks of a target that are not in the cache before it is written, so
+	// blocks that are gone from the store fail the target before any file is changed. The blocks
+	// are in the order the target reads them which orders the prefetches of the remote store.
+	var preflight func(blockHashes []uint64) error
+	if preflighter != nil {
+		preflight = func(blockHashes []uint64) error {
+			remoteBlockHashes := []uint64{}
+			for _, blockHash := range blockHashes {
+				if len(opts.CachePath) > 0 {
+					_, err := os.Stat(getCachedBlockPath(NormalizePath(opts.CachePath), blockHash))
+					if err == nil {
+						continue
+					}
+				}
+				remoteBlockHashes = append(remoteBlockHashes, blockHash)
+			}
+			if hinter != nil {
+				hinter.HintDownloadOrder(remoteBlockHashes)
+			}
+			return preflighter.PreflightBlocks(ctx, remoteBlockHashes)
+		}
+	}
+
+	setupTime := time.Since(setupStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Setup", setupTime})
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+
+	targetTimeStats := make([][]TimeStat, len(opts.Targets))
+	targetErrors := make([]error, len(opts.Targets))
+	var wg sync.WaitGroup
+	for i := range opts.Targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			progressSuffix := ""
+			if len(opts.Targets) > 1 {
+				progressSuffix = fmt.Sprintf(" `%s`", opts.Targets[i].TargetPath)
+			}
+			if opts.Targets[i].Image {
+				targetTimeStats[i], targetErrors[i] = downsyncToImage(
+					ctx,
+					opts.Targets[i],
+					sourceVersionIndexes[i],
+					indexStore,
+					preflight,
+					hashRegistry,
+					opts.workerCount(),
+					opts.Validate,
+					opts.Progress,
+					progressSuffix,
+					opts.StoreOptions)
+				return
+			}
+			targetTimeStats[i], targetErrors[i] = downsyncToTarget(
+				ctx,
+				opts.Targets[i].TargetPath,
+				sourceVersionIndexes[i],
+				&targetIndexReaders[i],
+				indexStore,
+				longtailstorelib.RedactStoreURI(opts.StorageURI),
+				preflight,
+				targetFS,
+				jobs,
+				pathFilter,
+				opts.RetainPermissions,
+				!opts.NoReflinks,
+				opts.VerifyDisk && len(opts.Targets[i].TargetIndexPath) > 0,
+				opts.workerCount(),
+				opts.Validate,
+				opts.Progress,
+				progressSuffix)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, target := range opts.Targets {
+		for _, stat := range targetTimeStats[i] {
+			if len(opts.Targets) > 1 {
+				stat.Name = fmt.Sprintf("%s `%s`", stat.Name, target.TargetPath)
+			}
+			result.TimeStats = append(result.TimeStats, stat)
+		}
+	}
+	for i, err := range targetErrors {
+		if err == nil {
+			checkpoint.CompletedTargets = append(checkpoint.CompletedTargets, completedTarget{opts.Targets[i].TargetPath, opts.Targets[i].SourcePath, sourceHashes[i]})
+		}
+	}
+	for _, err := range targetErrors {
+		if err != nil {
+			if len(opts.SessionStatePath) > 0 {
+				writeDownsyncSession(opts.SessionStatePath, sessionExporter, checkpoint, opts.StoreOptions)
+			}
+			return result, err
+		}
+	}
+
+	flushStartTime := time.Now()
+	stores := []longtaillib.Longtail_BlockStoreAPI{indexStore, lruBlockStore, verifyBlockStore, compressBlockStore, cacheBlockStore, localIndexStore, remoteIndexStore}
+	storeNames := []string{"Share", "LRU", "Verify", "Compress", "Cache", "Local", "Remote"}
+	err = flushStores(stores, storeNames)
+	if err != nil {
+		return result, errors.Wrapf(err, "Downsync: failed to flush `%s`", longtailstorelib.RedactStoreURI(opts.StorageURI))
+	}
+	flushTime := time.Since(flushStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Flush", flushTime})
+	result.StoreStats = getStoreStats(stores, storeNames)
+
+	if len(opts.CachePath) > 0 && len(opts.CachePin) > 0 {
+		// The pin holds all blocks of the versions, not only the blocks of the files that changed
+		chunkHashSet := map[uint64]bool{}
+		for _, sourceVersionIndex := range sourceVersionIndexes {
+			for _, chunkHash := range sourceVersionIndex.GetChunkHashes() {
+				chunkHashSet[chunkHash] = true
+			}
+		}
+		err = getVersionChunkHashes(skippedSourcePaths, chunkHashSet, opts.StoreOptions)
+		if err == nil {
+			err = pinChunkBlocks(NormalizePath(opts.CachePath), opts.CachePin, remoteIndexStore, chunkHashSet)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if len(opts.SessionStatePath) > 0 {
+		// All targets are updated so the session is kept without a checkpoint
+		writeDownsyncSession(opts.SessionStatePath, sessionExporter, downsyncCheckpoint{}, opts.StoreOptions)
+	}
+	return result, nil
+}
+
+func downsyncToTarget(
+	ctx context.Context,
+	targetFolderPath string,
+	sourceVersionIndex longtaillib.Longtail_VersionIndex,
+	targetIndexReader *VersionIndexReader,
+	indexStore longtaillib.Longtail_BlockStoreAPI,
+	storageURI string,
+	preflight func(blockHashes []uint64) error,
+	fs longtaillib.Longtail_StorageAPI,
+	jobs longtaillib.Longtail_JobAPI,
+	pathFilter longtaillib.Longtail_PathFilterAPI,
+	retainPermissions bool,
+	reflinks bool,
+	verifyDisk bool,
+	workerCount int,
+	validate bool,
+	progress ProgressFunc,
+	progressSuffix string) ([]TimeStat, error) {
+	timeStats := []TimeStat{}
+
+	targetChunkSize := sourceVersionIndex.GetTargetChunkSize()
+
+	// The target version index is disposed by Downsync
+	targetVersionIndex, hash, readTargetIndexTime, err := targetIndexReader.Get()
+	if err != nil {
+		return timeStats, err
+	}
+	timeStats = append(timeStats, TimeStat{"Read target index", readTargetIndexTime})
+
+	if verifyDisk {
+		verifyStartTime := time.Now()
+		changedPaths, err := verifyTargetFiles(targetFolderPath, sourceVersionIndex, targetVersionIndex, hash, workerCount, progress, progressSuffix)
+		if err != nil {
+			return timeStats, err
+		}
+		// Files that differ from the recorded target index are written again as if they were new
+		if len(changedPaths) > 0 {
+			targetVersionIndex, err = withoutAssets(targetVersionIndex, changedPaths)
+			if err != nil {
+				return timeStats, err
+			}
+			defer targetVersionIndex.Dispose()
+		}
+		timeStats = append(timeStats, TimeStat{"Verify target", time.Since(verifyStartTime)})
+	}
+
+	err = unshareModifiedFiles(targetFolderPath, sourceVersionIndex, targetVersionIndex)
+	if err != nil {
+		return timeStats, err
+	}
+
+	getExistingContentStartTime := time.Now()
+	// Files with the same content as another file of the version are left out when the version is
+	// written and cloned from that file afterwards, if the file system can clone files
+	writeVersionIndex := sourceVersionIndex
+	var clones []clonedAsset
+	if reflinks {
+		clones = findClonedAssets(sourceVersionIndex, targetVersionIndex)
+		if len(clones) > 0 && reflinkSupported(targetFolderPath) {
+			writeVersionIndex, err = withoutAssets(sourceVersionIndex, clonedPaths(clones))
+			if err != nil {
+				return timeStats, err
+			}
+			defer writeVersionIndex.Dispose()
+		} else {
+			clones = nil
+		}
+	}
+
+	versionDiff, errno := longtaillib.CreateVersionDiff(
+		hash,
+		targetVersionIndex,
+		writeVersionIndex)
+	if errno != 0 {
+		return timeStats, errors.Wrap(longtaillib.NewError(errno, "CreateVersionDiff", targetFolderPath, ""), "Downsync")
+	}
+	defer versionDiff.Dispose()
+
+	chunkHashes, errno := longtaillib.GetRequiredChunkHashes(
+		writeVersionIndex,
+		versionDiff)
+	if errno != 0 {
+		return timeStats, errors.Wrap(longtaillib.NewError(errno, "GetRequiredChunkHashes", targetFolderPath, ""), "Downsync")
+	}
+
+	retargettedVersionStoreIndex, errno := GetExistingStoreIndexSync(indexStore, chunkHashes, 0)
+	if errno != 0 {
+		return timeStats, errors.Wrap(longtaillib.NewError(errno, "GetExistingContent", "", storageURI), "Downsync")
+	}
+	defer retargettedVersionStoreIndex.Dispose()
+	getExistingContentTime := time.Since(getExistingContentStartTime)
+	timeStats = append(timeStats, TimeStat{"Get content index", getExistingContentTime})
+
+	if preflight != nil {
+		preflightStartTime := time.Now()
+		err = preflight(longtailstorelib.BlockUseOrder(retargettedVersionStoreIndex, chunkHashes))
+		if err != nil {
+			return timeStats, errors.Wrapf(err, "Downsync: `%s` can not be updated", targetFolderPath)
+		}
+		timeStats = append(timeStats, TimeStat{"Preflight", time.Since(preflightStartTime)})
+	}
+	if ctx.Err() != nil {
+		return timeStats, ctx.Err()
+	}
+
+	changeVersionStartTime := time.Now()
+	changeVersionProgress := CreateProgress("Updating version"+progressSuffix, progress)
+	defer changeVersionProgress.Dispose()
+	errno = longtaillib.ChangeVersion(
+		indexStore,
+		fs,
+		hash,
+		jobs,
+		&changeVersionProgress,
+		retargettedVersionStoreIndex,
+		targetVersionIndex,
+		writeVersionIndex,
+		versionDiff,
+		NormalizePath(targetFolderPath),
+		retainPermissions)
+	if errno != 0 {
+		return timeStats, errors.Wrap(longtaillib.NewError(errno, "ChangeVersion", targetFolderPath, storageURI), "Downsync")
+	}
+
+	changeVersionTime := time.Since(changeVersionStartTime)
+	timeStats = append(timeStats, TimeStat{"Change version", changeVersionTime})
+
+	if len(clones) > 0 {
+		cloneStartTime := time.Now()
+		err = cloneAssets(targetFolderPath, clones, retainPermissions)
+		if err != nil {
+			return timeStats, err
+		}
+		timeStats = append(timeStats, TimeStat{fmt.Sprintf("Clone %d files", len(clones)), time.Since(cloneStartTime)})
+	}
+
+	if validate {
+		if ctx.Err() != nil {
+			return timeStats, ctx.Err()
+		}
+		validateStartTime := time.Now()
+		err := validateTarget(targetFolderPath, sourceVersionIndex, hash, targetChunkSize, fs, jobs, pathFilter, retainPermissions, progress, progressSuffix)
+		if err != nil {
+			return timeStats, err
+		}
+		validateTime := time.Since(validateStartTime)
+		timeStats = append(timeStats, TimeStat{"Validate", validateTime})
+	}
+
+	return timeStats, nil
+}
+
+// validateTarget indexes the target folder and compares the assets to the source version index
+func validateTarget(
+	targetFolderPath string,
+	sourceVersionIndex longtaillib.Longtail_VersionIndex,
+	hash longtaillib.Longtail_HashAPI,
+	targetChunkSize uint32,
+	fs longtaillib.Longtail_StorageAPI,
+	jobs longtaillib.Longtail_JobAPI,
+	pathFilter longtaillib.Longtail_PathFilterAPI,
+	retainPermissions bool,
+	progress ProgressFunc,
+	progressSuffix string) error {
+	validateFileInfos, errno := longtaillib.GetFilesRecursively(
+		fs,
+		pathFilter,
+		NormalizePath(targetFolderPath))
+	if errno != 0 {
+		return errors.Wrap(longtaillib.NewError(errno, "GetFilesRecursively", targetFolderPath, ""), "Downsync")
+	}
+	defer validateFileInfos.Dispose()
+
+	chunker := longtaillib.CreateHPCDCChunkerAPI()
+	defer chunker.Dispose()
+
+	createVersionIndexProgress := CreateProgress("Validating version"+progressSuffix, progress)
+	defer createVersionIndexProgress.Dispose()
+	validateVersionIndex, errno := longtaillib.CreateVersionIndex(
+		fs,
+		hash,
+		chunker,
+		jobs,
+		&createVersionIndexProgress,
+		NormalizePath(targetFolderPath),
+		validateFileInfos,
+		nil,
+		targetChunkSize)
+	if errno != 0 {
+		return errors.Wrap(longtaillib.NewError(errno, "CreateVersionIndex", targetFolderPath, ""), "Downsync")
+	}
+	defer validateVersionIndex.Dispose()
+	if validateVersionIndex.GetAssetCount() != sourceVersionIndex.GetAssetCount() {
+		return fmt.Errorf("Downsync: failed validation: asset count mismatch")
+	}
+	validateAssetSizes := validateVersionIndex.GetAssetSizes()
+	validateAssetHashes := validateVersionIndex.GetAssetHashes()
+
+	sourceAssetSizes := sourceVersionIndex.GetAssetSizes()
+	sourceAssetHashes := sourceVersionIndex.GetAssetHashes()
+
+	assetSizeLookup := map[string]uint64{}
+	assetHashLookup := map[string]uint64{}
+	assetPermissionLookup := map[string]uint16{}
+
+	for i, s := range sourceAssetSizes {
+		path := sourceVersionIndex.GetAssetPath(uint32(i))
+		assetSizeLookup[path] = s
+		assetHashLookup[path] = sourceAssetHashes[i]
+		assetPermissionLookup[path] = sourceVersionIndex.GetAssetPermissions(uint32(i))
+	}
+	for i, validateSize := range validateAssetSizes {
+		validatePath := validateVersionIndex.GetAssetPath(uint32(i))
+		validateHash := validateAssetHashes[i]
+		size, exists := assetSizeLookup[validatePath]
+		hash := assetHashLookup[validatePath]
+		if !exists {
+			return fmt.Errorf("Downsync: failed validation: invalid path %s", validatePath)
+		}
+		if size != validateSize {
+			return fmt.Errorf("Downsync: failed validation: asset %d size mismatch", i)
+		}
+		if hash != validateHash {
+			return fmt.Errorf("Downsync: failed validation: asset %d hash mismatch", i)
+		}
+		if retainPermissions {
+			validatePermissions := validateVersionIndex.GetAssetPermissions(uint32(i))
+			permissions := assetPermissionLookup[validatePath]
+			if permissions != validatePermissions {
+				return fmt.Errorf("Downsync: failed validation: asset %d permission mismatch", i)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+package longtailapi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// The archive formats of Export
+const (
+	ExportFormatTar = "tar"
+	ExportFormatZip = "zip"
+)
+
+// ExportOptions describes a version to stream as an archive
+type ExportOptions struct {
+	StoreSettings
+	StorageURI string
+	// SourcePath is the path of the version index
+	SourcePath string
+	// Format is ExportFormatTar or ExportFormatZip
+	Format string
+	// ModTime is the modification time of the archive entries, the version index has no times.
+	// The Unix epoch is used if zero so exporting a version always gives the same archive.
+	ModTime time.Time
+	// VersionLocalStoreIndexPath is an optional store index written by Upsync that avoids reading the full store index
+	VersionLocalStoreIndexPath string
+	Progress                   ProgressFunc
+}
+
+// ExportResult describes the exported version
+type ExportResult struct {
+	AssetCount uint32
+	// Size is the size of the file content in the archive
+	Size       uint64
+	StoreStats []StoreStat
+	TimeStats  []TimeStat
+}
+
+// exportRun is a run of chunks of a file that are read from the same block
+type exportRun struct {
+	asset     uint32
+	blockHash uint64
+	chunks    []imageWrite
+}
+
+// exportBlock is a block request of an export, done is closed when the request completes
+type exportBlock struct {
+	done        chan struct{}
+	storedBlock longtaillib.Longtail_StoredBlock
+	errno       int
+}
+
+func (b *exportBlock) OnComplete(storedBlock longtaillib.Longtail_StoredBlock, errno int) {
+	b.storedBlock = storedBlock
+	b.errno = errno
+	close(b.done)
+}
+
+// archiveWriter writes the entries of a tar or zip archive
+type archiveWriter interface {
+	// create starts an entry, the content of files is written to the returned writer
+	create(path string, size uint64, permissions uint16, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (w tarArchiveWriter) create(path string, size uint64, permissions uint16, modTime time.Time) (io.Writer, error) {
+	header := &tar.Header{Name: path, Size: int64(size), Mode: int64(permissions), ModTime: modTime, Typeflag: tar.TypeReg}
+	if isDirPath(path) {
+		header.Typeflag = tar.TypeDir
+		header.Size = 0
+	}
+	return w.Writer, w.WriteHeader(header)
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (w zipArchiveWriter) create(path string, size uint64, permissions uint16, modTime time.Time) (io.Writer, error) {
+	header := &zip.FileHeader{Name: path, Method: zip.Deflate, Modified: modTime, UncompressedSize64: size}
+	mode := os.FileMode(permissions) & os.ModePerm
+	if isDirPath(path) {
+		header.Method = zip.Store
+		mode |= os.ModeDir
+	}
+	header.SetMode(mode)
+	return w.CreateHeader(header)
+}
+
+// Export streams the files and folders of a version from the store to w as a tar or zip archive
+// without writing them to disk, for example to serve build downloads from a web service. Blocks
+// are requested ahead of the file being written so the store is read while the archive is sent.
+func Export(ctx context.Context, w io.Writer, opts ExportOptions) (ExportResult, error) {
+	result := ExportResult{}
+
+	var archive archiveWriter
+	switch opts.Format {
+	case ExportFormatTar:
+		archive = tarArchiveWriter{tar.NewWriter(w)}
+	case ExportFormatZip:
+		archive = zipArchiveWriter{zip.NewWriter(w)}
+	default:
+		return result, fmt.Errorf("Export: unsupported archive format `%s`", opts.Format)
+	}
+	modTime := opts.ModTime
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0)
+	}
+
+	setupStartTime := time.Now()
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(opts.workerCount()), 0)
+	defer jobs.Dispose()
+
+	vbuffer, err := longtailstorelib.ReadFromURI(opts.SourcePath, opts.StoreOptions...)
+	if err != nil {
+		return result, err
+	}
+	versionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(vbuffer)
+	if errno != 0 {
+		return result, errors.Wrap(longtaillib.NewError(errno, "ReadVersionIndexFromBuffer", opts.SourcePath, ""), "Export")
+	}
+	defer versionIndex.Dispose()
+
+	creg := longtaillib.CreateFullCompressionRegistry()
+	defer creg.Dispose()
+
+	remoteIndexStore, err := CreateBlockStoreForURI(opts.StorageURI, opts.VersionLocalStoreIndexPath, jobs, opts.StoreSettings, 8388608, 1024, longtailstorelib.ReadOnly)
+	if err != nil {
+		return result, err
+	}
+	defer remoteIndexStore.Dispose()
+	compressBlockStore := longtaillib.CreateCompressBlockStore(remoteIndexStore, creg)
+	defer compressBlockStore.Dispose()
+	// A block is requested again for each run of chunks read from it, the LRU store keeps the
+	// recent ones so they are only downloaded once
+	indexStore := longtaillib.CreateLRUBlockStoreAPI(compressBlockStore, 32)
+	defer indexStore.Dispose()
+
+	storeIndex, errno := GetExistingStoreIndexSync(indexStore, versionIndex.GetChunkHashes(), 0)
+	if errno != 0 {
+		return result, errors.Wrap(longtaillib.NewError(errno, "GetExistingContent", "", longtailstorelib.RedactStoreURI(opts.StorageURI)), "Export")
+	}
+	chunkLocations := locateChunks(storeIndex)
+	storeIndex.Dispose()
+
+	chunkHashes := versionIndex.GetChunkHashes()
+	chunkSizes := versionIndex.GetChunkSizes()
+	assetChunkCounts := versionIndex.GetAssetChunkCounts()
+	assetChunkIndexStarts := versionIndex.GetAssetChunkIndexStarts()
+	assetChunkIndexes := versionIndex.GetAssetChunkIndexes()
+	runs := []exportRun{}
+	for a := uint32(0); a < versionIndex.GetAssetCount(); a++ {
+		start := assetChunkIndexStarts[a]
+		for _, chunkIndex := range assetChunkIndexes[start : start+assetChunkCounts[a]] {
+			location, exists := chunkLocations[chunkHashes[chunkIndex]]
+			if !exists {
+				return result, errors.Wrapf(longtaillib.ErrENOENT, "Export: chunk 0x%016x of `%s` is missing in the store", chunkHashes[chunkIndex], versionIndex.GetAssetPath(a))
+			}
+			if len(runs) == 0 || runs[len(runs)-1].asset != a || runs[len(runs)-1].blockHash != location.blockHash {
+				runs = append(runs, exportRun{asset: a, blockHash: location.blockHash})
+			}
+			run := &runs[len(runs)-1]
+			run.chunks = append(run.chunks, imageWrite{blockOffset: location.offset, size: chunkSizes[chunkIndex]})
+		}
+	}
+	setupTime := time.Since(setupStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Setup", setupTime})
+
+	exportStartTime := time.Now()
+	// Up to window blocks are requested ahead of the run being written
+	window := opts.workerCount()
+	blocks := make([]*exportBlock, len(runs))
+	requested := 0
+	defer func() {
+		for _, block := range blocks[:requested] {
+			if block != nil {
+				<-block.done
+				block.storedBlock.Dispose()
+			}
+		}
+	}()
+	request := func(r int) {
+		block := &exportBlock{done: make(chan struct{})}
+		blocks[r] = block
+		errno := indexStore.GetStoredBlock(runs[r].blockHash, longtaillib.CreateAsyncGetStoredBlockAPI(block))
+		if errno != 0 {
+			block.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
+		}
+	}
+
+	assetSizes := versionIndex.GetAssetSizes()
+	r := 0
+	for a := uint32(0); a < versionIndex.GetAssetCount(); a++ {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		path := versionIndex.GetAssetPath(a)
+		entry, err := archive.create(path, assetSizes[a], versionIndex.GetAssetPermissions(a), modTime)
+		if err != nil {
+			return result, errors.Wrapf(err, "Export: failed to add `%s` to the archive", path)
+		}
+		for ; r < len(runs) && runs[r].asset == a; r++ {
+			for ; requested < len(runs) && requested <= r+window; requested++ {
+				request(requested)
+			}
+			block := blocks[r]
+			<-block.done
+			if block.errno != 0 {
+				return result, errors.Wrap(longtaillib.NewError(block.errno, "GetStoredBlock", fmt.Sprintf("0x%016x", runs[r].blockHash), longtailstorelib.RedactStoreURI(opts.StorageURI)), "Export")
+			}
+			blockData := block.storedBlock.GetChunksBlockData()
+			for _, chunk := range runs[r].chunks {
+				if int(chunk.blockOffset)+int(chunk.size) > len(blockData) {
+					return result, fmt.Errorf("Export: block 0x%016x holds %d bytes, the chunk at %d needs %d", runs[r].blockHash, len(blockData), chunk.blockOffset, chunk.size)
+				}
+				_, err = entry.Write(blockData[chunk.blockOffset : chunk.blockOffset+chunk.size])
+				if err != nil {
+					return result, errors.Wrapf(err, "Export: failed to write `%s` to the archive", path)
+				}
+			}
+			block.storedBlock.Dispose()
+			blocks[r] = nil
+			if opts.Progress != nil {
+				opts.Progress("Exporting version", uint32(len(runs)), uint32(r+1))
+			}
+		}
+		result.AssetCount++
+		result.Size += assetSizes[a]
+	}
+	err = archive.Close()
+	if err != nil {
+		return result, errors.Wrap(err, "Export: failed to finish the archive")
+	}
+	exportTime := time.Since(exportStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Export", exportTime})
+
+	stores := []longtaillib.Longtail_BlockStoreAPI{indexStore, compressBlockStore, remoteIndexStore}
+	storeNames := []string{"LRU", "Compress", "Remote"}
+	result.StoreStats = getStoreStats(stores, storeNames)
+	return result, nil
+}
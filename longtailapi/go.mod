@@ -0,0 +1,14 @@
+module github.com/DanEngelbrecht/golongtail/longtailapi
+
+go 1.13
+
+require (
+	github.com/DanEngelbrecht/golongtail/longtaillib v0.0.0-00010101000000-000000000000
+	github.com/DanEngelbrecht/golongtail/longtailstorelib v0.0.0-00010101000000-000000000000
+	github.com/pkg/errors v0.9.1
+	golang.org/x/sys v0.0.0-20200501052902-10377860bb8e
+)
+
+replace github.com/DanEngelbrecht/golongtail/longtailstorelib => ../longtailstorelib
+
+replace github.com/DanEngelbrecht/golongtail/longtaillib => ../longtaillib
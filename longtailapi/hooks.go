@@ -0,0 +1,177 @@
+package longtailapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The events that hooks are run for
+const (
+	HookPreUpsync    = "pre-upsync"
+	HookPostUpsync   = "post-upsync"
+	HookPreDownsync  = "pre-downsync"
+	HookPostDownsync = "post-downsync"
+)
+
+// hookTimeout is how long a hook may run before it is stopped
+const hookTimeout = 5 * time.Minute
+
+// HookVersion is a version that is uploaded or restored
+type HookVersion struct {
+	// SourcePath is the uploaded folder for upsync and the version index for downsync
+	SourcePath string `json:"sourcePath"`
+	// TargetPath is the written version index for upsync and the updated folder for downsync
+	TargetPath string `json:"targetPath"`
+	// VersionHash is the SHA-256 of the version index, it is not known before an upsync
+	VersionHash string `json:"versionHash,omitempty"`
+}
+
+// HookStats are the stats of a completed upsync or downsync
+type HookStats struct {
+	DurationSeconds    float64            `json:"durationSeconds"`
+	AssetCount         uint32             `json:"assetCount,omitempty"`
+	ChunkCount         uint32             `json:"chunkCount,omitempty"`
+	UploadedBlockCount uint32             `json:"uploadedBlockCount,omitempty"`
+	UploadedChunkCount uint32             `json:"uploadedChunkCount,omitempty"`
+	LinkedFileCount    uint32             `json:"linkedFileCount,omitempty"`
+	LinkedSize         uint64             `json:"linkedSize,omitempty"`
+	PhaseSeconds       map[string]float64 `json:"phaseSeconds,omitempty"`
+}
+
+// HookPayload is the JSON document a hook receives
+type HookPayload struct {
+	Event string `json:"event"`
+	// StorageURI has the secret of credentials in the URI redacted
+	StorageURI string        `json:"storageUri"`
+	Versions   []HookVersion `json:"versions"`
+	// Error is set by post hooks of a failed sync
+	Error string     `json:"error,omitempty"`
+	Stats *HookStats `json:"stats,omitempty"`
+}
+
+// Hook is run before or after an upsync or downsync, see SyncHooks
+type Hook interface {
+	Run(ctx context.Context, payload HookPayload) error
+}
+
+// SyncHooks are the hooks of an Upsync or Downsync, for example to notify a build system that a
+// version was published or restored
+type SyncHooks struct {
+	// Pre hooks run before the sync starts, the sync is not started if one fails
+	Pre []Hook
+	// Post hooks run when the sync has completed or failed, their errors are logged
+	Post []Hook
+}
+
+// NewHook returns a webhook that the payload is POSTed to for http and https URLs, and otherwise a
+// command that is run by the shell with the payload on its standard input and the event in
+// LONGTAIL_HOOK_EVENT
+func NewHook(spec string) (Hook, error) {
+	if len(strings.TrimSpace(spec)) == 0 {
+		return nil, fmt.Errorf("NewHook: empty hook")
+	}
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return &webhook{url: spec, client: &http.Client{Timeout: hookTimeout}}, nil
+	}
+	return &commandHook{command: spec}, nil
+}
+
+type commandHook struct {
+	command string
+}
+
+func (h *commandHook) Run(ctx context.Context, payload HookPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "commandHook")
+	}
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", h.command)
+	}
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "LONGTAIL_HOOK_EVENT="+payload.Event)
+	err = cmd.Run()
+	if err != nil {
+		return errors.Wrapf(err, "%s hook `%s` failed", payload.Event, h.command)
+	}
+	return nil
+}
+
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func (h *webhook) Run(ctx context.Context, payload HookPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "webhook")
+	}
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrapf(err, "%s webhook `%s`", payload.Event, h.url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Longtail-Event", payload.Event)
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "%s webhook `%s` failed", payload.Event, h.url)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s webhook `%s` failed: %s", payload.Event, h.url, resp.Status)
+	}
+	return nil
+}
+
+func (hooks *SyncHooks) runPre(ctx context.Context, payload HookPayload) error {
+	for _, hook := range hooks.Pre {
+		err := hook.Run(ctx, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPost runs the post hooks with the outcome of the sync, they also run if ctx was cancelled
+func (hooks *SyncHooks) runPost(payload HookPayload, syncErr error) {
+	if syncErr != nil {
+		payload.Error = syncErr.Error()
+	}
+	for _, hook := range hooks.Post {
+		err := hook.Run(context.Background(), payload)
+		if err != nil {
+			log.Printf("WARNING: %v\n", err)
+		}
+	}
+}
+
+func hookPhaseSeconds(timeStats []TimeStat) map[string]float64 {
+	if len(timeStats) == 0 {
+		return nil
+	}
+	phases := make(map[string]float64, len(timeStats))
+	for _, stat := range timeStats {
+		phases[stat.Name] += stat.Duration.Seconds()
+	}
+	return phases
+}
@@ -0,0 +1,359 @@
+package longtailapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// DefaultImageAlignment is the alignment of the files in an image if none is given, the sector
+// size of most drives
+const DefaultImageAlignment = uint64(4096)
+
+// ImageAsset is the location of a file of a version in a disk image
+type ImageAsset struct {
+	Path   string `json:"path"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+// ImageLayout places the files of a version one after the other in the order of the version index,
+// each starting at a multiple of alignment. Folders take no space. The offsets only depend on the
+// version index and alignment so a loader can compute them without the layout file.
+// Returns the files and the size of the image.
+func ImageLayout(versionIndex longtaillib.Longtail_VersionIndex, alignment uint64) ([]ImageAsset, uint64) {
+	if alignment == 0 {
+		alignment = DefaultImageAlignment
+	}
+	assetCount := versionIndex.GetAssetCount()
+	assetSizes := versionIndex.GetAssetSizes()
+	assets := make([]ImageAsset, 0, assetCount)
+	offset := uint64(0)
+	for a := uint32(0); a < assetCount; a++ {
+		path := versionIndex.GetAssetPath(a)
+		if isDirPath(path) {
+			continue
+		}
+		assets = append(assets, ImageAsset{Path: path, Offset: offset, Size: assetSizes[a]})
+		offset += (assetSizes[a] + alignment - 1) / alignment * alignment
+	}
+	return assets, offset
+}
+
+func isDirPath(path string) bool {
+	return len(path) > 0 && path[len(path)-1] == '/'
+}
+
+// RestoreTarget receives the content of a version that is downsynced into a disk image or block
+// device instead of a folder, it is validated after the downsync if it is also an io.ReaderAt
+type RestoreTarget interface {
+	io.WriterAt
+	io.Closer
+}
+
+// OpenImageFile opens the disk image or block device at path for writing. A regular file is
+// created or resized to size, a device is written in place and must hold at least size bytes.
+func OpenImageFile(path string, size uint64) (RestoreTarget, error) {
+	info, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "OpenImageFile: os.Stat(%s) failed", path)
+	}
+	isFile := err != nil || info.Mode().IsRegular()
+	flags := os.O_RDWR
+	if isFile {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "OpenImageFile: os.OpenFile(%s) failed", path)
+	}
+	if isFile {
+		err = file.Truncate(int64(size))
+		if err != nil {
+			file.Close()
+			return nil, errors.Wrapf(err, "OpenImageFile: file.Truncate(%s) failed", path)
+		}
+		return file, nil
+	}
+	deviceSize, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "OpenImageFile: file.Seek(%s) failed", path)
+	}
+	if uint64(deviceSize) < size {
+		file.Close()
+		return nil, fmt.Errorf("OpenImageFile: `%s` holds %d bytes, the image needs %d", path, deviceSize, size)
+	}
+	return file, nil
+}
+
+// chunkLocation is the block holding a chunk and the offset of the chunk in the block data
+type chunkLocation struct {
+	blockHash uint64
+	offset    uint32
+}
+
+// locateChunks returns the location of each chunk in storeIndex, the first block wins for chunks
+// stored in several blocks
+func locateChunks(storeIndex longtaillib.Longtail_StoreIndex) map[uint64]chunkLocation {
+	chunkLocations := make(map[uint64]chunkLocation, storeIndex.GetChunkCount())
+	chunkHashes := storeIndex.GetChunkHashes()
+	chunkSizes := storeIndex.GetChunkSizes()
+	blockChunksOffsets := storeIndex.GetBlockChunksOffsets()
+	blockChunkCounts := storeIndex.GetBlockChunkCounts()
+	for b, blockHash := range storeIndex.GetBlockHashes() {
+		offset := uint32(0)
+		for c := blockChunksOffsets[b]; c < blockChunksOffsets[b]+blockChunkCounts[b]; c++ {
+			if _, exists := chunkLocations[chunkHashes[c]]; !exists {
+				chunkLocations[chunkHashes[c]] = chunkLocation{blockHash: blockHash, offset: offset}
+			}
+			offset += chunkSizes[c]
+		}
+	}
+	return chunkLocations
+}
+
+// imageWrite copies a chunk from a block to the image
+type imageWrite struct {
+	blockOffset uint32
+	size        uint32
+	imageOffset uint64
+}
+
+// imageWriter writes the chunks of the blocks it receives to the image, requests holds a slot for
+// each block request in flight
+type imageWriter struct {
+	image    RestoreTarget
+	writes   map[uint64][]imageWrite
+	wg       sync.WaitGroup
+	requests chan struct{}
+	errLock  sync.Mutex
+	err      error
+}
+
+func (w *imageWriter) setErr(err error) {
+	w.errLock.Lock()
+	defer w.errLock.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+type imageGetStoredBlockCompletionAPI struct {
+	w         *imageWriter
+	blockHash uint64
+}
+
+func (a *imageGetStoredBlockCompletionAPI) OnComplete(storedBlock longtaillib.Longtail_StoredBlock, errno int) {
+	w := a.w
+	defer func() {
+		<-w.requests
+		w.wg.Done()
+	}()
+	if errno != 0 {
+		w.setErr(longtaillib.NewError(errno, "GetStoredBlock", fmt.Sprintf("0x%016x", a.blockHash), ""))
+		return
+	}
+	defer storedBlock.Dispose()
+	blockData := storedBlock.GetChunksBlockData()
+	for _, write := range w.writes[a.blockHash] {
+		if int(write.blockOffset)+int(write.size) > len(blockData) {
+			w.setErr(fmt.Errorf("block 0x%016x holds %d bytes, the chunk at %d needs %d", a.blockHash, len(blockData), write.blockOffset, write.size))
+			return
+		}
+		_, err := w.image.WriteAt(blockData[write.blockOffset:write.blockOffset+write.size], int64(write.imageOffset))
+		if err != nil {
+			w.setErr(errors.Wrapf(err, "image.WriteAt(%d) failed", write.imageOffset))
+			return
+		}
+	}
+}
+
+// downsyncToImage writes all files of the version to the image at target.TargetPath, unlike a
+// folder target the image is rewritten in full
+func downsyncToImage(
+	ctx context.Context,
+	target DownsyncTarget,
+	sourceVersionIndex longtaillib.Longtail_VersionIndex,
+	indexStore longtaillib.Longtail_BlockStoreAPI,
+	preflight func(blockHashes []uint64) error,
+	hashRegistry longtaillib.Longtail_HashRegistryAPI,
+	workerCount int,
+	validate bool,
+	progress ProgressFunc,
+	progressSuffix string,
+	opts []longtailstorelib.StoreOption) ([]TimeStat, error) {
+	timeStats := []TimeStat{}
+
+	layout, imageSize := ImageLayout(sourceVersionIndex, target.ImageAlignment)
+	if len(target.ImageLayoutPath) > 0 {
+		layoutJSON, err := json.MarshalIndent(layout, "", "  ")
+		if err != nil {
+			return timeStats, errors.Wrap(err, "Downsync: json.MarshalIndent() failed")
+		}
+		err = longtailstorelib.WriteToURI(target.ImageLayoutPath, layoutJSON, opts...)
+		if err != nil {
+			return timeStats, errors.Wrapf(err, "Downsync: failed to write image layout `%s`", target.ImageLayoutPath)
+		}
+	}
+
+	getExistingContentStartTime := time.Now()
+	storeIndex, errno := GetExistingStoreIndexSync(indexStore, sourceVersionIndex.GetChunkHashes(), 0)
+	if errno != 0 {
+		return timeStats, errors.Wrap(longtaillib.NewError(errno, "GetExistingContent", "", ""), "Downsync")
+	}
+	chunkLocations := locateChunks(storeIndex)
+	blockHashes := append([]uint64{}, storeIndex.GetBlockHashes()...)
+	storeIndex.Dispose()
+	getExistingContentTime := time.Since(getExistingContentStartTime)
+	timeStats = append(timeStats, TimeStat{"Get content index", getExistingContentTime})
+
+	if preflight != nil {
+		preflightStartTime := time.Now()
+		err := preflight(blockHashes)
+		if err != nil {
+			return timeStats, errors.Wrapf(err, "Downsync: `%s` can not be written", target.TargetPath)
+		}
+		timeStats = append(timeStats, TimeStat{"Preflight", time.Since(preflightStartTime)})
+	}
+
+	// The files of the layout are in version index order, folders left out
+	writes := map[uint64][]imageWrite{}
+	chunkHashes := sourceVersionIndex.GetChunkHashes()
+	chunkSizes := sourceVersionIndex.GetChunkSizes()
+	assetChunkCounts := sourceVersionIndex.GetAssetChunkCounts()
+	assetChunkIndexStarts := sourceVersionIndex.GetAssetChunkIndexStarts()
+	assetChunkIndexes := sourceVersionIndex.GetAssetChunkIndexes()
+	l := 0
+	for a := uint32(0); a < sourceVersionIndex.GetAssetCount(); a++ {
+		if isDirPath(sourceVersionIndex.GetAssetPath(a)) {
+			continue
+		}
+		imageOffset := layout[l].Offset
+		l++
+		start := assetChunkIndexStarts[a]
+		for _, chunkIndex := range assetChunkIndexes[start : start+assetChunkCounts[a]] {
+			location, exists := chunkLocations[chunkHashes[chunkIndex]]
+			if !exists {
+				return timeStats, errors.Wrapf(longtaillib.ErrENOENT, "Downsync: chunk 0x%016x of `%s` is missing in the store", chunkHashes[chunkIndex], sourceVersionIndex.GetAssetPath(a))
+			}
+			writes[location.blockHash] = append(writes[location.blockHash], imageWrite{blockOffset: location.offset, size: chunkSizes[chunkIndex], imageOffset: imageOffset})
+			imageOffset += uint64(chunkSizes[chunkIndex])
+		}
+	}
+	if ctx.Err() != nil {
+		return timeStats, ctx.Err()
+	}
+
+	writeImageStartTime := time.Now()
+	openImage := target.OpenImage
+	if openImage == nil {
+		openImage = OpenImageFile
+	}
+	image, err := openImage(target.TargetPath, imageSize)
+	if err != nil {
+		return timeStats, errors.Wrapf(err, "Downsync: failed to open image `%s`", target.TargetPath)
+	}
+	defer func() {
+		if image != nil {
+			image.Close()
+		}
+	}()
+
+	// Limit the requests in flight so the fetched blocks are not all held in memory at once
+	w := &imageWriter{image: image, writes: writes, requests: make(chan struct{}, workerCount*2)}
+	blockCount := uint32(len(writes))
+	done := uint32(0)
+	for blockHash := range writes {
+		if ctx.Err() != nil {
+			break
+		}
+		w.requests <- struct{}{}
+		w.wg.Add(1)
+		completion := &imageGetStoredBlockCompletionAPI{w: w, blockHash: blockHash}
+		errno := indexStore.GetStoredBlock(blockHash, longtaillib.CreateAsyncGetStoredBlockAPI(completion))
+		if errno != 0 {
+			completion.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
+		}
+		done++
+		if progress != nil {
+			progress("Writing image"+progressSuffix, blockCount, done)
+		}
+	}
+	w.wg.Wait()
+	if w.err != nil {
+		return timeStats, errors.Wrapf(w.err, "Downsync: failed to write image `%s`", target.TargetPath)
+	}
+	if ctx.Err() != nil {
+		return timeStats, ctx.Err()
+	}
+	writeImageTime := time.Since(writeImageStartTime)
+	timeStats = append(timeStats, TimeStat{"Write image", writeImageTime})
+
+	if reader, ok := image.(io.ReaderAt); ok && validate {
+		validateStartTime := time.Now()
+		err := validateImage(reader, sourceVersionIndex, layout, hashRegistry)
+		if err != nil {
+			return timeStats, errors.Wrapf(err, "Downsync: failed validation of image `%s`", target.TargetPath)
+		}
+		validateTime := time.Since(validateStartTime)
+		timeStats = append(timeStats, TimeStat{"Validate", validateTime})
+	}
+
+	err = image.Close()
+	image = nil
+	if err != nil {
+		return timeStats, errors.Wrapf(err, "Downsync: failed to close image `%s`", target.TargetPath)
+	}
+	return timeStats, nil
+}
+
+// validateImage reads back the chunks of the files in the image and compares their hashes to the version
+func validateImage(
+	reader io.ReaderAt,
+	sourceVersionIndex longtaillib.Longtail_VersionIndex,
+	layout []ImageAsset,
+	hashRegistry longtaillib.Longtail_HashRegistryAPI) error {
+	hash, errno := hashRegistry.GetHashAPI(sourceVersionIndex.GetHashIdentifier())
+	if errno != 0 {
+		return errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "hashRegistry.GetHashAPI(%d) failed", sourceVersionIndex.GetHashIdentifier())
+	}
+	chunkHashes := sourceVersionIndex.GetChunkHashes()
+	chunkSizes := sourceVersionIndex.GetChunkSizes()
+	assetChunkCounts := sourceVersionIndex.GetAssetChunkCounts()
+	assetChunkIndexStarts := sourceVersionIndex.GetAssetChunkIndexStarts()
+	assetChunkIndexes := sourceVersionIndex.GetAssetChunkIndexes()
+	l := 0
+	for a := uint32(0); a < sourceVersionIndex.GetAssetCount(); a++ {
+		if isDirPath(sourceVersionIndex.GetAssetPath(a)) {
+			continue
+		}
+		imageOffset := layout[l].Offset
+		l++
+		start := assetChunkIndexStarts[a]
+		for _, chunkIndex := range assetChunkIndexes[start : start+assetChunkCounts[a]] {
+			chunk := make([]byte, chunkSizes[chunkIndex])
+			_, err := reader.ReadAt(chunk, int64(imageOffset))
+			if err != nil {
+				return errors.Wrapf(err, "image.ReadAt(%d) failed", imageOffset)
+			}
+			chunkHash, errno := hash.HashBuffer(chunk)
+			if errno != 0 {
+				return errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "hash.HashBuffer() failed")
+			}
+			if chunkHash != chunkHashes[chunkIndex] {
+				return fmt.Errorf("asset `%s` content mismatch at offset %d", sourceVersionIndex.GetAssetPath(a), imageOffset-layout[l-1].Offset)
+			}
+			imageOffset += uint64(chunkSizes[chunkIndex])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,411 @@
+package longtailapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/storeformat"
+	"github.com/pkg/errors"
+)
+
+// The JSON documents of version and store indexes, the schema version is bumped when a field
+// changes meaning, new fields may be added without a bump
+const (
+	VersionIndexJSONSchema = "longtail-version-index"
+	StoreIndexJSONSchema   = "longtail-store-index"
+	IndexJSONSchemaVersion = 1
+)
+
+// The kinds of index files reported by InspectIndex
+const (
+	IndexKindVersionIndex     = "version-index"
+	IndexKindStoreIndex       = "store-index"
+	IndexKindVersionIndexJSON = "version-index-json"
+	IndexKindStoreIndexJSON   = "store-index-json"
+)
+
+// IndexHash is a block, chunk or content hash. It is written to JSON as a 0x prefixed hex string
+// since most JSON parsers can not hold all 64 bit numbers.
+type IndexHash uint64
+
+// MarshalJSON ...
+func (h IndexHash) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"0x%016x\"", uint64(h))), nil
+}
+
+// UnmarshalJSON accepts hex strings with or without a 0x prefix and plain numbers
+func (h *IndexHash) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	base := 10
+	if strings.HasPrefix(text, "\"") {
+		err := json.Unmarshal(data, &text)
+		if err != nil {
+			return err
+		}
+		text = strings.TrimPrefix(strings.TrimPrefix(text, "0x"), "0X")
+		base = 16
+	}
+	value, err := strconv.ParseUint(text, base, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid hash %s", string(data))
+	}
+	*h = IndexHash(value)
+	return nil
+}
+
+// VersionIndexJSON is the JSON document of a version index
+type VersionIndexJSON struct {
+	Schema        string `json:"schema"`
+	SchemaVersion int    `json:"schemaVersion"`
+	// FormatVersion is the version of the binary index the document was made from, a rebuilt index
+	// is always written in the current version
+	FormatVersion   uint32                  `json:"formatVersion"`
+	HashIdentifier  uint32                  `json:"hashIdentifier"`
+	HashAlgorithm   string                  `json:"hashAlgorithm,omitempty"`
+	TargetChunkSize uint32                  `json:"targetChunkSize"`
+	Assets          []VersionIndexAssetJSON `json:"assets"`
+	Chunks          []VersionIndexChunkJSON `json:"chunks"`
+}
+
+// VersionIndexAssetJSON is a file or folder of a version, folder paths end with a slash
+type VersionIndexAssetJSON struct {
+	Path        string    `json:"path"`
+	Size        uint64    `json:"size"`
+	Permissions uint16    `json:"permissions"`
+	ContentHash IndexHash `json:"contentHash"`
+	// Chunks are the positions in VersionIndexJSON.Chunks of the chunks of the asset, in order
+	Chunks []uint32 `json:"chunks"`
+}
+
+// VersionIndexChunkJSON is a chunk of a version, the tag is the compression type of the chunk
+type VersionIndexChunkJSON struct {
+	Hash IndexHash `json:"hash"`
+	Size uint32    `json:"size"`
+	Tag  uint32    `json:"tag"`
+}
+
+// StoreIndexJSON is the JSON document of a store index
+type StoreIndexJSON struct {
+	Schema         string                `json:"schema"`
+	SchemaVersion  int                   `json:"schemaVersion"`
+	FormatVersion  uint32                `json:"formatVersion"`
+	HashIdentifier uint32                `json:"hashIdentifier"`
+	HashAlgorithm  string                `json:"hashAlgorithm,omitempty"`
+	Blocks         []StoreIndexBlockJSON `json:"blocks"`
+}
+
+// StoreIndexBlockJSON is a block of a store, the tag is the compression type of the block
+type StoreIndexBlockJSON struct {
+	Hash   IndexHash             `json:"hash"`
+	Tag    uint32                `json:"tag"`
+	Chunks []StoreIndexChunkJSON `json:"chunks"`
+}
+
+// StoreIndexChunkJSON is a chunk of a block
+type StoreIndexChunkJSON struct {
+	Hash IndexHash `json:"hash"`
+	Size uint32    `json:"size"`
+}
+
+// IndexInfo describes an index file, see InspectIndex
+type IndexInfo struct {
+	Kind string
+	// FormatVersion is the binary format version of the index, or the version a JSON document was made from
+	FormatVersion uint32
+	// CurrentFormatVersion is the binary format version written by this version of longtail
+	CurrentFormatVersion uint32
+	// SchemaVersion is the schema version of JSON documents
+	SchemaVersion  int
+	HashIdentifier uint32
+	// Supported is false for binary indexes in a format version this version of longtail can not read
+	// and JSON documents with a newer schema version
+	Supported bool
+}
+
+func hashAlgorithmName(hashIdentifier uint32) string {
+	for _, name := range []string{"blake2", "blake3", "meow"} {
+		if identifier, err := GetHashIdentifier(name); err == nil && identifier == hashIdentifier {
+			return name
+		}
+	}
+	return ""
+}
+
+func currentVersionIndexVersion() (uint32, error) {
+	versionIndex, errno := longtaillib.BuildVersionIndex(0, 0, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	if errno != 0 {
+		return 0, longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+	}
+	defer versionIndex.Dispose()
+	return versionIndex.GetVersion(), nil
+}
+
+// VersionIndexToJSON returns the JSON document of versionIndex
+func VersionIndexToJSON(versionIndex longtaillib.Longtail_VersionIndex) VersionIndexJSON {
+	doc := VersionIndexJSON{
+		Schema:          VersionIndexJSONSchema,
+		SchemaVersion:   IndexJSONSchemaVersion,
+		FormatVersion:   versionIndex.GetVersion(),
+		HashIdentifier:  versionIndex.GetHashIdentifier(),
+		HashAlgorithm:   hashAlgorithmName(versionIndex.GetHashIdentifier()),
+		TargetChunkSize: versionIndex.GetTargetChunkSize(),
+	}
+	assetCount := versionIndex.GetAssetCount()
+	assetHashes := versionIndex.GetAssetHashes()
+	assetSizes := versionIndex.GetAssetSizes()
+	chunkCounts := versionIndex.GetAssetChunkCounts()
+	chunkIndexStarts := versionIndex.GetAssetChunkIndexStarts()
+	chunkIndexes := versionIndex.GetAssetChunkIndexes()
+	doc.Assets = make([]VersionIndexAssetJSON, assetCount)
+	for a := uint32(0); a < assetCount; a++ {
+		start := chunkIndexStarts[a]
+		doc.Assets[a] = VersionIndexAssetJSON{
+			Path:        versionIndex.GetAssetPath(a),
+			Size:        assetSizes[a],
+			Permissions: versionIndex.GetAssetPermissions(a),
+			ContentHash: IndexHash(assetHashes[a]),
+			Chunks:      append([]uint32{}, chunkIndexes[start:start+chunkCounts[a]]...),
+		}
+	}
+	chunkHashes := versionIndex.GetChunkHashes()
+	chunkSizes := versionIndex.GetChunkSizes()
+	chunkTags := versionIndex.GetChunkTags()
+	doc.Chunks = make([]VersionIndexChunkJSON, len(chunkHashes))
+	for c := range chunkHashes {
+		doc.Chunks[c] = VersionIndexChunkJSON{Hash: IndexHash(chunkHashes[c]), Size: chunkSizes[c], Tag: chunkTags[c]}
+	}
+	return doc
+}
+
+func checkJSONSchema(schema string, schemaVersion int, expectedSchema string) error {
+	if schema != expectedSchema {
+		return fmt.Errorf("document schema `%s` is not `%s`", schema, expectedSchema)
+	}
+	if schemaVersion < 1 || schemaVersion > IndexJSONSchemaVersion {
+		return fmt.Errorf("document schema version %d is not supported, the newest supported version is %d", schemaVersion, IndexJSONSchemaVersion)
+	}
+	return nil
+}
+
+func documentHashIdentifier(hashIdentifier uint32, hashAlgorithm string) (uint32, error) {
+	if hashAlgorithm == "" {
+		return hashIdentifier, nil
+	}
+	identifier, err := GetHashIdentifier(hashAlgorithm)
+	if err != nil {
+		return 0, err
+	}
+	if hashIdentifier != 0 && hashIdentifier != identifier {
+		return 0, fmt.Errorf("hash algorithm `%s` does not match hash identifier %d", hashAlgorithm, hashIdentifier)
+	}
+	return identifier, nil
+}
+
+// VersionIndexFromJSON rebuilds a version index from its JSON document, the path hashes are
+// computed so assets may be added or renamed in the document
+func VersionIndexFromJSON(doc VersionIndexJSON) (longtaillib.Longtail_VersionIndex, error) {
+	err := checkJSONSchema(doc.Schema, doc.SchemaVersion, VersionIndexJSONSchema)
+	if err != nil {
+		return longtaillib.Longtail_VersionIndex{}, errors.Wrap(err, "VersionIndexFromJSON")
+	}
+	hashIdentifier, err := documentHashIdentifier(doc.HashIdentifier, doc.HashAlgorithm)
+	if err != nil {
+		return longtaillib.Longtail_VersionIndex{}, errors.Wrap(err, "VersionIndexFromJSON")
+	}
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+	hashAPI, errno := hashRegistry.GetHashAPI(hashIdentifier)
+	if errno != 0 {
+		return longtaillib.Longtail_VersionIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOENT), "VersionIndexFromJSON: hash identifier %d is not supported", hashIdentifier)
+	}
+
+	assetCount := len(doc.Assets)
+	assetPaths := make([]string, assetCount)
+	assetSizes := make([]uint64, assetCount)
+	assetPermissions := make([]uint16, assetCount)
+	pathHashes := make([]uint64, assetCount)
+	assetHashes := make([]uint64, assetCount)
+	chunkIndexStarts := make([]uint32, assetCount)
+	chunkCounts := make([]uint32, assetCount)
+	var chunkIndexes []uint32
+	for a, asset := range doc.Assets {
+		assetPaths[a] = asset.Path
+		assetSizes[a] = asset.Size
+		assetPermissions[a] = asset.Permissions
+		assetHashes[a] = uint64(asset.ContentHash)
+		pathHashes[a], errno = hashAPI.GetPathHash(asset.Path)
+		if errno != 0 {
+			return longtaillib.Longtail_VersionIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEINVAL), "VersionIndexFromJSON: hashAPI.GetPathHash(%s) failed", asset.Path)
+		}
+		chunkIndexStarts[a] = uint32(len(chunkIndexes))
+		chunkCounts[a] = uint32(len(asset.Chunks))
+		for _, chunk := range asset.Chunks {
+			if int(chunk) >= len(doc.Chunks) {
+				return longtaillib.Longtail_VersionIndex{}, fmt.Errorf("VersionIndexFromJSON: asset `%s` uses chunk %d of %d", asset.Path, chunk, len(doc.Chunks))
+			}
+		}
+		chunkIndexes = append(chunkIndexes, asset.Chunks...)
+	}
+	chunkHashes := make([]uint64, len(doc.Chunks))
+	chunkSizes := make([]uint32, len(doc.Chunks))
+	chunkTags := make([]uint32, len(doc.Chunks))
+	for c, chunk := range doc.Chunks {
+		chunkHashes[c] = uint64(chunk.Hash)
+		chunkSizes[c] = chunk.Size
+		chunkTags[c] = chunk.Tag
+	}
+	versionIndex, errno := longtaillib.BuildVersionIndex(
+		hashIdentifier,
+		doc.TargetChunkSize,
+		assetPaths,
+		assetSizes,
+		assetPermissions,
+		pathHashes,
+		assetHashes,
+		chunkIndexStarts,
+		chunkCounts,
+		chunkIndexes,
+		chunkHashes,
+		chunkSizes,
+		chunkTags)
+	if errno != 0 {
+		return longtaillib.Longtail_VersionIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrEINVAL), "VersionIndexFromJSON: longtaillib.BuildVersionIndex() failed")
+	}
+	return versionIndex, nil
+}
+
+// StoreIndexToJSON returns the JSON document of storeIndex
+func StoreIndexToJSON(storeIndex longtaillib.Longtail_StoreIndex) StoreIndexJSON {
+	doc := StoreIndexJSON{
+		Schema:         StoreIndexJSONSchema,
+		SchemaVersion:  IndexJSONSchemaVersion,
+		FormatVersion:  storeIndex.GetVersion(),
+		HashIdentifier: storeIndex.GetHashIdentifier(),
+		HashAlgorithm:  hashAlgorithmName(storeIndex.GetHashIdentifier()),
+	}
+	blockHashes := storeIndex.GetBlockHashes()
+	blockTags := storeIndex.GetBlockTags()
+	chunksOffsets := storeIndex.GetBlockChunksOffsets()
+	chunkCounts := storeIndex.GetBlockChunkCounts()
+	chunkHashes := storeIndex.GetChunkHashes()
+	chunkSizes := storeIndex.GetChunkSizes()
+	doc.Blocks = make([]StoreIndexBlockJSON, len(blockHashes))
+	for b := range blockHashes {
+		block := StoreIndexBlockJSON{Hash: IndexHash(blockHashes[b]), Tag: blockTags[b], Chunks: make([]StoreIndexChunkJSON, chunkCounts[b])}
+		for c := range block.Chunks {
+			offset := chunksOffsets[b] + uint32(c)
+			block.Chunks[c] = StoreIndexChunkJSON{Hash: IndexHash(chunkHashes[offset]), Size: chunkSizes[offset]}
+		}
+		doc.Blocks[b] = block
+	}
+	return doc
+}
+
+// StoreIndexFromJSON rebuilds a store index from its JSON document
+func StoreIndexFromJSON(doc StoreIndexJSON) (longtaillib.Longtail_StoreIndex, error) {
+	err := checkJSONSchema(doc.Schema, doc.SchemaVersion, StoreIndexJSONSchema)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(err, "StoreIndexFromJSON")
+	}
+	hashIdentifier, err := documentHashIdentifier(doc.HashIdentifier, doc.HashAlgorithm)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(err, "StoreIndexFromJSON")
+	}
+	blockIndexes := make([]longtaillib.Longtail_BlockIndex, 0, len(doc.Blocks))
+	defer func() {
+		for _, blockIndex := range blockIndexes {
+			blockIndex.Dispose()
+		}
+	}()
+	for _, block := range doc.Blocks {
+		chunkHashes := make([]uint64, len(block.Chunks))
+		chunkSizes := make([]uint32, len(block.Chunks))
+		for c, chunk := range block.Chunks {
+			chunkHashes[c] = uint64(chunk.Hash)
+			chunkSizes[c] = chunk.Size
+		}
+		blockIndex, errno := longtaillib.CreateBlockIndex(uint64(block.Hash), hashIdentifier, block.Tag, chunkHashes, chunkSizes)
+		if errno != 0 {
+			return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEINVAL), "StoreIndexFromJSON: longtaillib.CreateBlockIndex() for block 0x%016x failed", uint64(block.Hash))
+		}
+		blockIndexes = append(blockIndexes, blockIndex)
+	}
+	storeIndex, errno := longtaillib.CreateStoreIndexFromBlocks(blockIndexes)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "StoreIndexFromJSON: longtaillib.CreateStoreIndexFromBlocks() failed")
+	}
+	return storeIndex, nil
+}
+
+// InspectIndex detects if data is a binary version or store index or the JSON document of one and
+// which format or schema version it has, without requiring that this version of longtail can read it
+func InspectIndex(data []byte) (IndexInfo, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		header := struct {
+			Schema         string `json:"schema"`
+			SchemaVersion  int    `json:"schemaVersion"`
+			FormatVersion  uint32 `json:"formatVersion"`
+			HashIdentifier uint32 `json:"hashIdentifier"`
+		}{}
+		err := json.Unmarshal(trimmed, &header)
+		if err != nil {
+			return IndexInfo{}, errors.Wrap(err, "InspectIndex: malformed JSON document")
+		}
+		info := IndexInfo{FormatVersion: header.FormatVersion, SchemaVersion: header.SchemaVersion, HashIdentifier: header.HashIdentifier}
+		switch header.Schema {
+		case VersionIndexJSONSchema:
+			info.Kind = IndexKindVersionIndexJSON
+			info.CurrentFormatVersion, err = currentVersionIndexVersion()
+		case StoreIndexJSONSchema:
+			info.Kind = IndexKindStoreIndexJSON
+			info.CurrentFormatVersion, err = longtailstorelib.CurrentStoreIndexVersion()
+		default:
+			return IndexInfo{}, fmt.Errorf("InspectIndex: unknown document schema `%s`", header.Schema)
+		}
+		if err != nil {
+			return IndexInfo{}, errors.Wrap(err, "InspectIndex")
+		}
+		info.Supported = header.SchemaVersion >= 1 && header.SchemaVersion <= IndexJSONSchemaVersion
+		return info, nil
+	}
+
+	info := IndexInfo{}
+	var err error
+	if header, headerErr := storeformat.ReadStoreIndexHeader(data); headerErr == nil {
+		info.Kind = IndexKindStoreIndex
+		info.FormatVersion = header.Version
+		info.HashIdentifier = header.HashIdentifier
+		info.CurrentFormatVersion, err = longtailstorelib.CurrentStoreIndexVersion()
+		if err == nil {
+			var indexData []byte
+			indexData, _, err = storeformat.CheckStoreIndexFooter(data)
+			if err == nil {
+				storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(indexData)
+				info.Supported = errno == 0
+				storeIndex.Dispose()
+			}
+		}
+	} else if header, headerErr := storeformat.ReadVersionIndexHeader(data); headerErr == nil {
+		info.Kind = IndexKindVersionIndex
+		info.FormatVersion = header.Version
+		info.HashIdentifier = header.HashIdentifier
+		info.CurrentFormatVersion, err = currentVersionIndexVersion()
+		if err == nil {
+			versionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(data)
+			info.Supported = errno == 0
+			versionIndex.Dispose()
+		}
+	} else {
+		return IndexInfo{}, errors.Wrap(headerErr, "InspectIndex: not a version or store index")
+	}
+	if err != nil {
+		return IndexInfo{}, errors.Wrap(err, "InspectIndex")
+	}
+	return info, nil
+}
@@ -0,0 +1,631 @@
+package longtailapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// ProgressFunc receives the progress of the long running tasks of a sync, it is called with
+// doneCount equal to totalCount when the task completes
+type ProgressFunc func(task string, totalCount uint32, doneCount uint32)
+
+// TimeStat is the time spent in one phase of a command
+type TimeStat struct {
+	Name     string
+	Duration time.Duration
+}
+
+// StoreStat holds the stats of one of the block stores used by a command
+type StoreStat struct {
+	Name  string
+	Stats longtaillib.BlockStoreStats
+}
+
+// StoreSettings configures the block stores created for a storage URI
+type StoreSettings struct {
+	// WorkerCount is the number of jobs and remote store workers, zero uses the number of logical CPUs
+	WorkerCount  int
+	StoreOptions []longtailstorelib.StoreOption
+	// OnRemoteStore is called with the remote block store created for gs:// and s3:// URIs, or the
+	// handle acquired from SharedStore, for example to poll longtailstorelib.DetailedStatsProvider
+	// for the transfer rate
+	OnRemoteStore func(remoteStore longtaillib.BlockStoreAPI)
+	// SharedStore is used instead of creating a block store for the storage URI when set, so a
+	// service can reuse one remote store and its store index for many operations
+	SharedStore *longtailstorelib.SharedBlockStore
+	// OnCancelFlushed is called when the stores have been flushed after the context of an Upsync or
+	// Downsync was cancelled, the operation itself returns once its current phase completes
+	OnCancelFlushed func(err error)
+	// StaleCachePolicy is how the blocks of a cache folder that the remote store no longer lists
+	// are used, the cache and the remote are asked for their content in parallel and the chunks
+	// in cached blocks are not downloaded again
+	StaleCachePolicy longtailstorelib.StaleCachePolicy
+}
+
+func (s *StoreSettings) workerCount() int {
+	if s.WorkerCount > 0 {
+		return s.WorkerCount
+	}
+	return runtime.NumCPU()
+}
+
+// NoCompressionType is the compression type of uncompressed chunks
+const NoCompressionType = uint32(0)
+
+// NormalizePath converts path to forward slashes and removes duplicated separators
+func NormalizePath(path string) string {
+	doubleForwardRemoved := strings.Replace(path, "//", "/", -1)
+	doubleBackwardRemoved := strings.Replace(doubleForwardRemoved, "\\\\", "/", -1)
+	backwardRemoved := strings.Replace(doubleBackwardRemoved, "\\", "/", -1)
+	return backwardRemoved
+}
+
+// CreateBlockStoreForURI creates a remote block store for gs:// and s3:// URIs and a file system
+// block store for local paths, local paths in network share mode get a remote block store over the
+// file system. A faulty+ prefix, such as faulty+gs://bucket/store, wraps the blob store with
+// longtailstorelib.NewFaultyBlobStoreForURI. Store options may be given as query parameters of
+// uri. If settings has a shared store a handle to it is returned instead.
+func CreateBlockStoreForURI(
+	uri string,
+	optionalStoreIndexPath string,
+	jobAPI longtaillib.Longtail_JobAPI,
+	settings StoreSettings,
+	targetBlockSize uint32,
+	maxChunksPerBlock uint32,
+	accessType longtailstorelib.AccessType) (longtaillib.Longtail_BlockStoreAPI, error) {
+	if settings.SharedStore != nil {
+		handle, err := settings.SharedStore.Acquire()
+		if err != nil {
+			return longtaillib.Longtail_BlockStoreAPI{}, err
+		}
+		if settings.OnRemoteStore != nil {
+			settings.OnRemoteStore(handle)
+		}
+		return longtaillib.CreateBlockStoreAPI(handle), nil
+	}
+	if backendURIs, ok := longtailstorelib.ParseFederatedURI(uri); ok {
+		return createFederatedBlockStore(backendURIs, optionalStoreIndexPath, jobAPI, settings, targetBlockSize, maxChunksPerBlock, accessType)
+	}
+	uri, uriOptions, err := longtailstorelib.ParseStoreURI(uri)
+	if err != nil {
+		return longtaillib.Longtail_BlockStoreAPI{}, err
+	}
+	opts := append(append([]longtailstorelib.StoreOption{}, settings.StoreOptions...), uriOptions...)
+	blobStoreURL, err := url.Parse(uri)
+	if err == nil {
+		var blobStore longtailstorelib.BlobStore
+		switch blobStoreURL.Scheme {
+		case "gs":
+			blobStore, err = longtailstorelib.NewGCSBlobStore(blobStoreURL, opts...)
+		case "s3":
+			blobStore, err = longtailstorelib.NewS3BlobStore(blobStoreURL, opts...)
+		case "ipfs":
+			blobStore, err = longtailstorelib.NewIPFSBlobStore(blobStoreURL, opts...)
+		case "gdrive":
+			blobStore, err = longtailstorelib.NewGDriveBlobStore(blobStoreURL, opts...)
+		case "onedrive":
+			blobStore, err = longtailstorelib.NewOneDriveBlobStore(blobStoreURL, opts...)
+		case "abfs":
+			return longtaillib.Longtail_BlockStoreAPI{}, fmt.Errorf("azure Gen1 storage not yet implemented")
+		case "abfss":
+			return longtaillib.Longtail_BlockStoreAPI{}, fmt.Errorf("azure Gen2 storage not yet implemented")
+		case "file":
+			if !longtailstorelib.IsNetworkShare(opts...) {
+				return longtaillib.CreateFSBlockStore(jobAPI, longtaillib.CreateFSStorageAPI(), blobStoreURL.Path[1:], targetBlockSize, maxChunksPerBlock), nil
+			}
+			blobStore, err = longtailstorelib.NewFSBlobStore(blobStoreURL.Path[1:], opts...)
+		default:
+			if longtailstorelib.IsFaultyURI(uri) {
+				blobStore, err = longtailstorelib.NewFaultyBlobStoreForURI(uri, opts...)
+			} else if longtailstorelib.IsNetworkShare(opts...) {
+				blobStore, err = longtailstorelib.NewFSBlobStore(uri, opts...)
+			}
+		}
+		if err != nil {
+			return longtaillib.Longtail_BlockStoreAPI{}, err
+		}
+		if blobStore != nil {
+			remoteStore, err := longtailstorelib.NewRemoteBlockStore(
+				jobAPI,
+				blobStore,
+				optionalStoreIndexPath,
+				settings.workerCount(),
+				accessType,
+				opts...)
+			if err != nil {
+				return longtaillib.Longtail_BlockStoreAPI{}, err
+			}
+			if settings.OnRemoteStore != nil {
+				settings.OnRemoteStore(remoteStore)
+			}
+			return longtaillib.CreateBlockStoreAPI(remoteStore), nil
+		}
+	}
+	return longtaillib.CreateFSBlockStore(jobAPI, longtaillib.CreateFSStorageAPI(), uri, targetBlockSize, maxChunksPerBlock), nil
+}
+
+// createFederatedBlockStore creates a block store for each backend URI and a federated block store
+// that spreads the blocks over them, see longtailstorelib.NewFederatedBlockStore. A store index for
+// the whole store can not be used by a single backend so optionalStoreIndexPath is ignored.
+func createFederatedBlockStore(
+	backendURIs []string,
+	optionalStoreIndexPath string,
+	jobAPI longtaillib.Longtail_JobAPI,
+	settings StoreSettings,
+	targetBlockSize uint32,
+	maxChunksPerBlock uint32,
+	accessType longtailstorelib.AccessType) (longtaillib.Longtail_BlockStoreAPI, error) {
+	if len(backendURIs) == 0 {
+		return longtaillib.Longtail_BlockStoreAPI{}, fmt.Errorf("federated storage URI has no backend stores")
+	}
+	if optionalStoreIndexPath != "" {
+		log.Printf("Ignoring store index `%s` for federated store\n", optionalStoreIndexPath)
+	}
+	backends := make([]longtaillib.Longtail_BlockStoreAPI, 0, len(backendURIs))
+	names := make([]string, 0, len(backendURIs))
+	for _, backendURI := range backendURIs {
+		backend, err := CreateBlockStoreForURI(backendURI, "", jobAPI, settings, targetBlockSize, maxChunksPerBlock, accessType)
+		if err != nil {
+			for _, backend := range backends {
+				backend.Dispose()
+			}
+			return longtaillib.Longtail_BlockStoreAPI{}, errors.Wrapf(err, "failed to create federated backend `%s`", backendURI)
+		}
+		// The routing only depends on the location of the backend, not the options in its query
+		name, _, _ := longtailstorelib.ParseStoreURI(backendURI)
+		backends = append(backends, backend)
+		names = append(names, name)
+	}
+	return longtaillib.CreateBlockStoreAPI(longtailstorelib.NewFederatedBlockStore(backends, names)), nil
+}
+
+// GetCompressionType returns the compression type of a compression algorithm name such as zstd or brotli_text_max,
+// adaptive picks no compression, lz4 or zstd_max per block from the entropy of the block data
+func GetCompressionType(compressionAlgorithm string) (uint32, error) {
+	switch compressionAlgorithm {
+	case "none":
+		return NoCompressionType, nil
+	case "brotli":
+		return longtaillib.GetBrotliGenericDefaultCompressionType(), nil
+	case "brotli_min":
+		return longtaillib.GetBrotliGenericMinCompressionType(), nil
+	case "brotli_max":
+		return longtaillib.GetBrotliGenericMaxCompressionType(), nil
+	case "brotli_text":
+		return longtaillib.GetBrotliTextDefaultCompressionType(), nil
+	case "brotli_text_min":
+		return longtaillib.GetBrotliTextMinCompressionType(), nil
+	case "brotli_text_max":
+		return longtaillib.GetBrotliTextMaxCompressionType(), nil
+	case "lz4":
+		return longtaillib.GetLZ4DefaultCompressionType(), nil
+	case "zstd":
+		return longtaillib.GetZStdDefaultCompressionType(), nil
+	case "zstd_min":
+		return longtaillib.GetZStdMinCompressionType(), nil
+	case "zstd_max":
+		return longtaillib.GetZStdMaxCompressionType(), nil
+	case "adaptive":
+		return longtailstorelib.AdaptiveCompressionType, nil
+	}
+	registeredCompressionAlgorithmsLock.Lock()
+	defer registeredCompressionAlgorithmsLock.Unlock()
+	if compressionType, exists := registeredCompressionAlgorithms[compressionAlgorithm]; exists {
+		return compressionType, nil
+	}
+	return 0, fmt.Errorf("unsupported compression algorithm: `%s`", compressionAlgorithm)
+}
+
+var registeredCompressionAlgorithmsLock sync.Mutex
+var registeredCompressionAlgorithms = map[string]uint32{}
+
+// RegisterCompressionAlgorithm adds a compression codec implemented in Go under the algorithm name
+// and compression type, the name can then be used as UpsyncOptions.CompressionAlgorithm and blocks
+// compressed with it are decompressed by Downsync. The compression type is stored in the blocks
+// so it must stay the same for as long as the store is in use.
+func RegisterCompressionAlgorithm(name string, compressionType uint32, settingsID uint32, compression longtaillib.CompressionAPI) error {
+	if _, err := GetCompressionType(name); err == nil {
+		return fmt.Errorf("RegisterCompressionAlgorithm: compression algorithm `%s` already exists", name)
+	}
+	errno := longtaillib.RegisterCompressionAPI(compressionType, settingsID, compression)
+	if errno != 0 {
+		return errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "RegisterCompressionAlgorithm: longtaillib.RegisterCompressionAPI(0x%08x) for `%s` failed", compressionType, name)
+	}
+	registeredCompressionAlgorithmsLock.Lock()
+	defer registeredCompressionAlgorithmsLock.Unlock()
+	registeredCompressionAlgorithms[name] = compressionType
+	return nil
+}
+
+// RegisteredCompressionAlgorithms returns the names added with RegisterCompressionAlgorithm
+func RegisteredCompressionAlgorithms() []string {
+	registeredCompressionAlgorithmsLock.Lock()
+	defer registeredCompressionAlgorithmsLock.Unlock()
+	names := make([]string, 0, len(registeredCompressionAlgorithms))
+	for name := range registeredCompressionAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetCompressionTypesForFiles returns compressionType for each file in fileInfos
+func GetCompressionTypesForFiles(fileInfos longtaillib.Longtail_FileInfos, compressionType uint32) []uint32 {
+	pathCount := fileInfos.GetFileCount()
+	compressionTypes := make([]uint32, pathCount)
+	for i := uint32(0); i < pathCount; i++ {
+		compressionTypes[i] = compressionType
+	}
+	return compressionTypes
+}
+
+// GetHashIdentifier returns the hash identifier of blake2, blake3 or meow
+func GetHashIdentifier(hashAlgorithm string) (uint32, error) {
+	switch hashAlgorithm {
+	case "meow":
+		return longtaillib.GetMeowHashIdentifier(), nil
+	case "blake2":
+		return longtaillib.GetBlake2HashIdentifier(), nil
+	case "blake3":
+		return longtaillib.GetBlake3HashIdentifier(), nil
+	}
+	return 0, fmt.Errorf("not a supported hash api: `%s`", hashAlgorithm)
+}
+
+type regexPathFilter struct {
+	compiledIncludeRegexes []*regexp.Regexp
+	compiledExcludeRegexes []*regexp.Regexp
+}
+
+func (f *regexPathFilter) Include(rootPath string, assetPath string, assetName string, isDir bool, size uint64, permissions uint16) bool {
+	for _, r := range f.compiledExcludeRegexes {
+		if r.MatchString(assetPath) {
+			log.Printf("INFO: Skipping `%s`", assetPath)
+			return false
+		}
+	}
+	if len(f.compiledIncludeRegexes) == 0 {
+		return true
+	}
+	for _, r := range f.compiledIncludeRegexes {
+		if r.MatchString(assetPath) {
+			return true
+		}
+	}
+	log.Printf("INFO: Skipping `%s`", assetPath)
+	return false
+}
+
+func splitRegexes(regexes string) ([]*regexp.Regexp, error) {
+	var compiledRegexes []*regexp.Regexp
+	m := 0
+	s := 0
+	for i := 0; i < len(regexes); i++ {
+		if (regexes)[i] == '\\' {
+			m = -1
+		} else if m == 0 && (regexes)[i] == '*' {
+			m++
+		} else if m == 1 && (regexes)[i] == '*' {
+			r := (regexes)[s:(i - 1)]
+			regex, err := regexp.Compile(r)
+			if err != nil {
+				return nil, err
+			}
+			compiledRegexes = append(compiledRegexes, regex)
+			s = i + 1
+			m = 0
+		} else {
+			m = 0
+		}
+	}
+	if s < len(regexes) {
+		r := (regexes)[s:]
+		regex, err := regexp.Compile(r)
+		if err != nil {
+			return nil, err
+		}
+		compiledRegexes = append(compiledRegexes, regex)
+	}
+	return compiledRegexes, nil
+}
+
+// CreatePathFilter creates a filter from include and exclude regexes separated with **. The
+// returned filter is not valid if both are empty.
+func CreatePathFilter(includeFilterRegEx string, excludeFilterRegEx string) (longtaillib.Longtail_PathFilterAPI, error) {
+	regexPathFilter := &regexPathFilter{}
+	compiledIncludeRegexes, err := splitRegexes(includeFilterRegEx)
+	if err != nil {
+		return longtaillib.Longtail_PathFilterAPI{}, err
+	}
+	regexPathFilter.compiledIncludeRegexes = compiledIncludeRegexes
+	compiledExcludeRegexes, err := splitRegexes(excludeFilterRegEx)
+	if err != nil {
+		return longtaillib.Longtail_PathFilterAPI{}, err
+	}
+	regexPathFilter.compiledExcludeRegexes = compiledExcludeRegexes
+	if len(regexPathFilter.compiledIncludeRegexes) == 0 && len(regexPathFilter.compiledExcludeRegexes) == 0 {
+		return longtaillib.Longtail_PathFilterAPI{}, nil
+	}
+	return longtaillib.CreatePathFilterAPI(regexPathFilter), nil
+}
+
+type progressData struct {
+	task     string
+	progress ProgressFunc
+}
+
+func (p *progressData) OnProgress(totalCount uint32, doneCount uint32) {
+	p.progress(p.task, totalCount, doneCount)
+}
+
+// CreateProgress creates a rate limited progress API reporting to progress, a nil progress
+// creates an API that ignores the progress
+func CreateProgress(task string, progress ProgressFunc) longtaillib.Longtail_ProgressAPI {
+	if progress == nil {
+		progress = func(string, uint32, uint32) {}
+	}
+	baseProgress := longtaillib.CreateProgressAPI(&progressData{task: task, progress: progress})
+	return longtaillib.CreateRateLimitedProgressAPI(baseProgress, 5)
+}
+
+// FolderScanner lists the files of a folder in the background
+type FolderScanner struct {
+	wg        sync.WaitGroup
+	fileInfos longtaillib.Longtail_FileInfos
+	elapsed   time.Duration
+	err       error
+}
+
+// Scan starts listing the files of sourceFolderPath
+func (scanner *FolderScanner) Scan(
+	sourceFolderPath string,
+	pathFilter longtaillib.Longtail_PathFilterAPI,
+	fs longtaillib.Longtail_StorageAPI) {
+
+	scanner.wg.Add(1)
+	go func() {
+		startTime := time.Now()
+		fileInfos, errno := longtaillib.GetFilesRecursively(
+			fs,
+			pathFilter,
+			NormalizePath(sourceFolderPath))
+		if errno != 0 {
+			scanner.err = longtaillib.NewError(errno, "GetFilesRecursively", sourceFolderPath, "")
+		}
+		scanner.fileInfos = fileInfos
+		scanner.elapsed = time.Since(startTime)
+		scanner.wg.Done()
+	}()
+}
+
+// Get waits for the scan to complete, the caller owns the returned file infos
+func (scanner *FolderScanner) Get() (longtaillib.Longtail_FileInfos, time.Duration, error) {
+	scanner.wg.Wait()
+	return scanner.fileInfos, scanner.elapsed, scanner.err
+}
+
+func getFolderIndex(
+	sourceFolderPath string,
+	sourceIndexPath string,
+	targetChunkSize uint32,
+	compressionType uint32,
+	hashIdentifier uint32,
+	fs longtaillib.Longtail_StorageAPI,
+	jobs longtaillib.Longtail_JobAPI,
+	hashRegistry longtaillib.Longtail_HashRegistryAPI,
+	scanner *FolderScanner,
+	progress ProgressFunc,
+	opts []longtailstorelib.StoreOption) (longtaillib.Longtail_VersionIndex, longtaillib.Longtail_HashAPI, time.Duration, error) {
+	if len(sourceIndexPath) == 0 {
+		fileInfos, scanTime, err := scanner.Get()
+		if err != nil {
+			return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, scanTime, err
+		}
+		defer fileInfos.Dispose()
+
+		startTime := time.Now()
+
+		compressionTypes := GetCompressionTypesForFiles(fileInfos, compressionType)
+
+		hash, errno := hashRegistry.GetHashAPI(hashIdentifier)
+		if errno != 0 {
+			return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, scanTime + time.Since(startTime), errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "hashRegistry.GetHashAPI(%d) failed", hashIdentifier)
+		}
+
+		chunker := longtaillib.CreateHPCDCChunkerAPI()
+		defer chunker.Dispose()
+
+		createVersionIndexProgress := CreateProgress("Indexing version", progress)
+		defer createVersionIndexProgress.Dispose()
+		vindex, errno := longtaillib.CreateVersionIndex(
+			fs,
+			hash,
+			chunker,
+			jobs,
+			&createVersionIndexProgress,
+			NormalizePath(sourceFolderPath),
+			fileInfos,
+			compressionTypes,
+			targetChunkSize)
+		if errno != 0 {
+			return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, scanTime + time.Since(startTime), longtaillib.NewError(errno, "CreateVersionIndex", sourceFolderPath, "")
+		}
+
+		return vindex, hash, scanTime + time.Since(startTime), nil
+	}
+	startTime := time.Now()
+
+	vbuffer, err := longtailstorelib.ReadFromURI(sourceIndexPath, opts...)
+	if err != nil {
+		return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, time.Since(startTime), err
+	}
+	var errno int
+	vindex, errno := longtaillib.ReadVersionIndexFromBuffer(vbuffer)
+	if errno != 0 {
+		return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, time.Since(startTime), longtaillib.NewError(errno, "ReadVersionIndexFromBuffer", sourceIndexPath, "")
+	}
+
+	hash, errno := hashRegistry.GetHashAPI(hashIdentifier)
+	if errno != 0 {
+		return longtaillib.Longtail_VersionIndex{}, longtaillib.Longtail_HashAPI{}, time.Since(startTime), errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "hashRegistry.GetHashAPI(%d) failed", hashIdentifier)
+	}
+
+	return vindex, hash, time.Since(startTime), nil
+}
+
+// VersionIndexReader creates or reads the version index of a folder in the background
+type VersionIndexReader struct {
+	wg           sync.WaitGroup
+	versionIndex longtaillib.Longtail_VersionIndex
+	hashAPI      longtaillib.Longtail_HashAPI
+	elapsedTime  time.Duration
+	err          error
+}
+
+// Read starts reading the version index from sourceIndexPath, or indexing the files listed by
+// scanner if sourceIndexPath is empty
+func (indexReader *VersionIndexReader) Read(
+	sourceFolderPath string,
+	sourceIndexPath string,
+	targetChunkSize uint32,
+	compressionType uint32,
+	hashIdentifier uint32,
+	fs longtaillib.Longtail_StorageAPI,
+	jobs longtaillib.Longtail_JobAPI,
+	hashRegistry longtaillib.Longtail_HashRegistryAPI,
+	scanner *FolderScanner,
+	progress ProgressFunc,
+	opts []longtailstorelib.StoreOption) {
+	indexReader.wg.Add(1)
+	go func() {
+		indexReader.versionIndex, indexReader.hashAPI, indexReader.elapsedTime, indexReader.err = getFolderIndex(
+			sourceFolderPath,
+			sourceIndexPath,
+			targetChunkSize,
+			compressionType,
+			hashIdentifier,
+			fs,
+			jobs,
+			hashRegistry,
+			scanner,
+			progress,
+			opts)
+		indexReader.wg.Done()
+	}()
+}
+
+// Get waits for the version index, the caller owns the returned version index
+func (indexReader *VersionIndexReader) Get() (longtaillib.Longtail_VersionIndex, longtaillib.Longtail_HashAPI, time.Duration, error) {
+	indexReader.wg.Wait()
+	return indexReader.versionIndex, indexReader.hashAPI, indexReader.elapsedTime, indexReader.err
+}
+
+type getExistingContentCompletionAPI struct {
+	wg         sync.WaitGroup
+	storeIndex longtaillib.Longtail_StoreIndex
+	err        int
+}
+
+func (a *getExistingContentCompletionAPI) OnComplete(storeIndex longtaillib.Longtail_StoreIndex, err int) {
+	a.storeIndex = storeIndex
+	a.err = err
+	a.wg.Done()
+}
+
+// GetExistingStoreIndexSync returns the store index of the blocks of indexStore that hold
+// chunkHashes, see Longtail_BlockStoreAPI.GetExistingContent
+func GetExistingStoreIndexSync(indexStore longtaillib.Longtail_BlockStoreAPI, chunkHashes []uint64, minBlockUsagePercent uint32) (longtaillib.Longtail_StoreIndex, int) {
+	getExistingContentComplete := &getExistingContentCompletionAPI{}
+	getExistingContentComplete.wg.Add(1)
+	errno := indexStore.GetExistingContent(chunkHashes, minBlockUsagePercent, longtaillib.CreateAsyncGetExistingContentAPI(getExistingContentComplete))
+	if errno != 0 {
+		getExistingContentComplete.wg.Done()
+		getExistingContentComplete.wg.Wait()
+		return longtaillib.Longtail_StoreIndex{}, errno
+	}
+	getExistingContentComplete.wg.Wait()
+	return getExistingContentComplete.storeIndex, getExistingContentComplete.err
+}
+
+type flushCompletionAPI struct {
+	wg  sync.WaitGroup
+	err int
+}
+
+func (a *flushCompletionAPI) OnComplete(err int) {
+	a.err = err
+	a.wg.Done()
+}
+
+// flushStores flushes the stores in order, starting all flushes before waiting for them
+func flushStores(stores []longtaillib.Longtail_BlockStoreAPI, names []string) error {
+	completions := make([]*flushCompletionAPI, len(stores))
+	for i, store := range stores {
+		completions[i] = &flushCompletionAPI{}
+		completions[i].wg.Add(1)
+		errno := store.Flush(longtaillib.CreateAsyncFlushAPI(completions[i]))
+		if errno != 0 {
+			completions[i].wg.Done()
+			for _, started := range completions[:i] {
+				started.wg.Wait()
+			}
+			return longtaillib.NewError(errno, names[i]+".Flush", "", "")
+		}
+	}
+	var err error
+	for i, completion := range completions {
+		completion.wg.Wait()
+		if completion.err != 0 && err == nil {
+			err = longtaillib.NewError(completion.err, names[i]+".Flush", "", "")
+		}
+	}
+	return err
+}
+
+// getStoreStats returns the stats of the stores, stores that were not created are skipped
+func getStoreStats(stores []longtaillib.Longtail_BlockStoreAPI, names []string) []StoreStat {
+	storeStats := []StoreStat{}
+	for i, store := range stores {
+		stats, errno := store.GetStats()
+		if errno == 0 {
+			storeStats = append(storeStats, StoreStat{names[i], stats})
+		}
+	}
+	return storeStats
+}
+
+// flushOnCancel flushes the stores if ctx is cancelled before the returned stop function is called,
+// so blocks written before an interrupt are added to the store index and the cache. Stop waits for
+// an ongoing flush so the stores can be disposed after it returns.
+func flushOnCancel(ctx context.Context, stores []longtaillib.Longtail_BlockStoreAPI, names []string, onFlushed func(err error)) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+		}
+		err := flushStores(stores, names)
+		if onFlushed != nil {
+			onFlushed(err)
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
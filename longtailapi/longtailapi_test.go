@@ -0,0 +1,1632 @@
+package longtailapi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/storeformat"
+	"github.com/pkg/errors"
+)
+
+func writeTestFiles(t *testing.T, folder string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(folder, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("writeTestFiles() ioutil.WriteFile(%s) %v != %v", path, err, nil)
+		}
+	}
+}
+
+func TestUpsyncDownsync(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	targetPath := filepath.Join(root, "target")
+	storePath := filepath.Join(root, "store")
+	indexPath := filepath.Join(root, "version.lvi")
+
+	writeTestFiles(t, sourcePath, map[string]string{
+		"a.txt":        "first file",
+		"folder/b.txt": "second file",
+		"folder/c.bin": "third file with some more content",
+	})
+	writeTestFiles(t, targetPath, map[string]string{
+		"a.txt":     "stale content",
+		"stale.txt": "removed by downsync",
+	})
+
+	progressTasks := map[string]bool{}
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	upsyncOptions.Progress = func(task string, totalCount uint32, doneCount uint32) {
+		progressTasks[task] = true
+	}
+	upsyncResult, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestUpsyncDownsync() Upsync() %v != %v", err, nil)
+	}
+	if upsyncResult.AssetCount != 4 {
+		t.Errorf("TestUpsyncDownsync() AssetCount %d != %d", upsyncResult.AssetCount, 4)
+	}
+	if upsyncResult.UploadedBlockCount == 0 {
+		t.Errorf("TestUpsyncDownsync() UploadedBlockCount %d == %d", upsyncResult.UploadedBlockCount, 0)
+	}
+	if !progressTasks["Indexing version"] {
+		t.Errorf("TestUpsyncDownsync() no progress for `Indexing version` in %v", progressTasks)
+	}
+
+	upsyncResult, err = Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestUpsyncDownsync() Upsync() %v != %v", err, nil)
+	}
+	if upsyncResult.UploadedBlockCount != 0 {
+		t.Errorf("TestUpsyncDownsync() second UploadedBlockCount %d != %d", upsyncResult.UploadedBlockCount, 0)
+	}
+
+	downsyncResult, err := Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storePath,
+		Targets:    []DownsyncTarget{{SourcePath: indexPath, TargetPath: targetPath}},
+		Validate:   true,
+	})
+	if err != nil {
+		t.Fatalf("TestUpsyncDownsync() Downsync() %v != %v", err, nil)
+	}
+	if len(downsyncResult.StoreStats) == 0 {
+		t.Errorf("TestUpsyncDownsync() no store stats")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(targetPath, "folder", "c.bin"))
+	if err != nil || string(content) != "third file with some more content" {
+		t.Errorf("TestUpsyncDownsync() folder/c.bin `%s`, %v", string(content), err)
+	}
+	if _, err := os.Stat(filepath.Join(targetPath, "stale.txt")); !os.IsNotExist(err) {
+		t.Errorf("TestUpsyncDownsync() stale.txt not removed: %v", err)
+	}
+}
+
+func TestUpsyncCancelled(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	writeTestFiles(t, sourcePath, map[string]string{"a.txt": "first file"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = filepath.Join(root, "store")
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = filepath.Join(root, "version.lvi")
+	_, err := Upsync(ctx, upsyncOptions)
+	if err != context.Canceled {
+		t.Errorf("TestUpsyncCancelled() Upsync() %v != %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(upsyncOptions.TargetPath); !os.IsNotExist(err) {
+		t.Errorf("TestUpsyncCancelled() version index written: %v", err)
+	}
+}
+
+func TestUpsyncSourceStream(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storePath := filepath.Join(root, "store")
+	indexPath := filepath.Join(root, "version.lvi")
+	content := bytes.Repeat([]byte("streamed content "), 10000)
+
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath
+	upsyncOptions.TargetPath = indexPath
+	upsyncOptions.SourceStream = bytes.NewReader(content)
+	upsyncOptions.SourceStreamName = "build.bin"
+	result, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestUpsyncSourceStream() Upsync() %v != %v", err, nil)
+	}
+	if result.AssetCount != 1 {
+		t.Errorf("TestUpsyncSourceStream() AssetCount %d != %d", result.AssetCount, 1)
+	}
+
+	var tarData bytes.Buffer
+	_, err = Export(context.Background(), &tarData, ExportOptions{StorageURI: storePath, SourcePath: indexPath, Format: ExportFormatTar})
+	if err != nil {
+		t.Fatalf("TestUpsyncSourceStream() Export() %v != %v", err, nil)
+	}
+	tarReader := tar.NewReader(&tarData)
+	header, err := tarReader.Next()
+	if err != nil {
+		t.Fatalf("TestUpsyncSourceStream() tarReader.Next() %v != %v", err, nil)
+	}
+	exported, _ := ioutil.ReadAll(tarReader)
+	if header.Name != "build.bin" || !bytes.Equal(exported, content) {
+		t.Errorf("TestUpsyncSourceStream() exported `%s` with %d bytes", header.Name, len(exported))
+	}
+
+	upsyncOptions.SourceStream = bytes.NewReader(content)
+	upsyncOptions.SourceStreamName = "../build.bin"
+	_, err = Upsync(context.Background(), upsyncOptions)
+	if err == nil {
+		t.Errorf("TestUpsyncSourceStream() Upsync(%s) %v == %v", upsyncOptions.SourceStreamName, err, nil)
+	}
+}
+
+func TestSyncHooks(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	targetPath := filepath.Join(root, "target")
+	indexPath := filepath.Join(root, "version.lvi")
+	writeTestFiles(t, sourcePath, map[string]string{"a.txt": "first file"})
+
+	var lock sync.Mutex
+	var payloads []HookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload HookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		if r.Header.Get("X-Longtail-Event") != payload.Event {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		payloads = append(payloads, payload)
+		lock.Unlock()
+	}))
+	defer server.Close()
+	webhook, err := NewHook(server.URL)
+	if err != nil {
+		t.Fatalf("TestSyncHooks() NewHook() %v != %v", err, nil)
+	}
+	failingHook, _ := NewHook("exit 3")
+
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = filepath.Join(root, "store")
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	upsyncOptions.Hooks = SyncHooks{Pre: []Hook{webhook, failingHook}, Post: []Hook{webhook}}
+	_, err = Upsync(context.Background(), upsyncOptions)
+	if err == nil {
+		t.Errorf("TestSyncHooks() Upsync() failing pre hook %v == %v", err, nil)
+	}
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Errorf("TestSyncHooks() Upsync() ran after a failing pre hook: %v", err)
+	}
+
+	upsyncOptions.Hooks = SyncHooks{Pre: []Hook{webhook}, Post: []Hook{failingHook, webhook}}
+	upsyncResult, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil || len(upsyncResult.VersionHash) != 64 {
+		t.Fatalf("TestSyncHooks() Upsync() %v, `%s`", err, upsyncResult.VersionHash)
+	}
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: upsyncOptions.StorageURI,
+		Targets:    []DownsyncTarget{{SourcePath: indexPath, TargetPath: targetPath}},
+		Hooks:      SyncHooks{Post: []Hook{webhook}}})
+	if err != nil {
+		t.Fatalf("TestSyncHooks() Downsync() %v != %v", err, nil)
+	}
+
+	events := []string{}
+	for _, payload := range payloads {
+		events = append(events, payload.Event)
+	}
+	expected := []string{HookPreUpsync, HookPreUpsync, HookPostUpsync, HookPostDownsync}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("TestSyncHooks() events %v != %v", events, expected)
+	}
+	post := payloads[2]
+	if len(post.Versions) != 1 || post.Versions[0].VersionHash != upsyncResult.VersionHash || post.Versions[0].TargetPath != indexPath || post.Stats == nil || post.Stats.AssetCount != 1 || post.Error != "" {
+		t.Errorf("TestSyncHooks() post-upsync payload %+v", post)
+	}
+	restored := payloads[3]
+	if len(restored.Versions) != 1 || restored.Versions[0].VersionHash != upsyncResult.VersionHash || restored.Versions[0].TargetPath != targetPath {
+		t.Errorf("TestSyncHooks() post-downsync payload %+v", restored)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	storePath := filepath.Join(root, "store")
+	indexPath := filepath.Join(root, "version.lvi")
+	writeTestFiles(t, sourcePath, map[string]string{"a.txt": "first file", "folder/b.txt": "second file"})
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	upsyncOptions.StoreOptions = []longtailstorelib.StoreOption{longtailstorelib.WithNetworkShare()}
+	upsyncResult, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestAgent() Upsync() %v != %v", err, nil)
+	}
+
+	agent, err := NewAgent(AgentOptions{StorageURI: storePath, CachePath: filepath.Join(root, "cache")})
+	if err != nil {
+		t.Fatalf("TestAgent() NewAgent() %v != %v", err, nil)
+	}
+	defer agent.Close()
+	listener, err := ListenAgent("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("TestAgent() ListenAgent() %v != %v", err, nil)
+	}
+	server := &http.Server{Handler: agent.Handler()}
+	go server.Serve(listener)
+	defer server.Close()
+	client, baseURL := NewAgentHTTPClient(listener.Addr().String())
+
+	for i, target := range []string{"target1", "target2"} {
+		body, _ := json.Marshal(AgentSyncRequest{SourcePath: indexPath, TargetPath: filepath.Join(root, target)})
+		resp, err := client.Post(baseURL+"/syncs", "application/json", bytes.NewReader(body))
+		if err != nil || resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("TestAgent() POST /syncs %v, %v", err, resp)
+		}
+		var started AgentSync
+		json.NewDecoder(resp.Body).Decode(&started)
+		resp.Body.Close()
+		if started.ID != i+1 || started.State != AgentSyncRunning {
+			t.Errorf("TestAgent() POST /syncs %+v", started)
+		}
+		var s AgentSync
+		for start := time.Now(); time.Since(start) < 30*time.Second; time.Sleep(10 * time.Millisecond) {
+			resp, err = client.Get(fmt.Sprintf("%s/syncs/%d", baseURL, started.ID))
+			if err != nil {
+				t.Fatalf("TestAgent() GET /syncs/%d %v != %v", started.ID, err, nil)
+			}
+			json.NewDecoder(resp.Body).Decode(&s)
+			resp.Body.Close()
+			if s.State != AgentSyncRunning {
+				break
+			}
+		}
+		if s.State != AgentSyncDone || s.VersionHash != upsyncResult.VersionHash || s.Finished == nil || len(s.Progress) == 0 {
+			t.Errorf("TestAgent() GET /syncs/%d %+v", started.ID, s)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(root, target, "folder", "b.txt"))
+		if err != nil || string(content) != "second file" {
+			t.Errorf("TestAgent() %s/folder/b.txt `%s`, %v", target, string(content), err)
+		}
+	}
+
+	resp, err := client.Post(baseURL+"/syncs", "application/json", strings.NewReader(`{"sourcePath": ""}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("TestAgent() POST /syncs without paths %v, %v", err, resp)
+	}
+
+	// Web pages can only send plain forms to other sites, or reach the agent through DNS rebinding
+	resp, err = client.Post(baseURL+"/mode", "text/plain", strings.NewReader(`{"mode": "background"}`))
+	if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("TestAgent() POST /mode as text/plain %v, %v", err, resp)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, baseURL+"/syncs/1", nil)
+	if resp, err = client.Do(req); err != nil || resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("TestAgent() DELETE /syncs/1 without Content-Type %v, %v", err, resp)
+	}
+	req, _ = http.NewRequest(http.MethodGet, baseURL+"/status", nil)
+	req.Host = "attacker.example.com:7890"
+	if resp, err = client.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("TestAgent() GET /status for another host %v, %v", err, resp)
+	}
+	resp, err = client.Post(baseURL+"/mode", "application/json", strings.NewReader(`{"mode": "background"}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("TestAgent() POST /mode %v, %v", err, resp)
+	}
+	var status AgentStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Mode != "background" || status.RunningSyncs != 0 || status.StorageURI != storePath {
+		t.Errorf("TestAgent() POST /mode %+v", status)
+	}
+	if len(status.Bandwidth) != 1 || status.Bandwidth[0].DownloadedBytes == 0 {
+		t.Errorf("TestAgent() GET /status bandwidth %+v", status.Bandwidth)
+	}
+	if len(agent.GetSyncs()) != 2 {
+		t.Errorf("TestAgent() GetSyncs() %d != %d", len(agent.GetSyncs()), 2)
+	}
+	resp, _ = client.Get(baseURL + "/syncs/7")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("TestAgent() GET /syncs/7 %d != %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestCreatePathFilter(t *testing.T) {
+	pathFilter, err := CreatePathFilter("", "")
+	if err != nil || pathFilter != (longtaillib.Longtail_PathFilterAPI{}) {
+		t.Errorf("TestCreatePathFilter() CreatePathFilter() empty filter %v, %v", pathFilter, err)
+	}
+	_, err = CreatePathFilter("(", "")
+	if err == nil {
+		t.Errorf("TestCreatePathFilter() CreatePathFilter() invalid regex %v == %v", err, nil)
+	}
+	regexes, err := splitRegexes(".*\\.txt$**.*\\.bin$")
+	if err != nil || len(regexes) != 2 {
+		t.Errorf("TestCreatePathFilter() splitRegexes() %d, %v", len(regexes), err)
+	}
+}
+
+func TestSharedStore(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	writeTestFiles(t, sourcePath, map[string]string{"a.txt": "first file", "b.txt": "second file"})
+
+	jobs := longtaillib.CreateBikeshedJobAPI(2, 0)
+	defer jobs.Dispose()
+	remoteStore, err := longtailstorelib.NewRemoteBlockStoreForURI(jobs, filepath.Join(root, "store"), "", 2, longtailstorelib.ReadWrite)
+	if err != nil {
+		t.Fatalf("TestSharedStore() NewRemoteBlockStoreForURI() %v != %v", err, nil)
+	}
+	sharedStore := longtailstorelib.NewSharedBlockStore(remoteStore)
+	defer sharedStore.Close()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			upsyncOptions := DefaultUpsyncOptions()
+			upsyncOptions.SharedStore = sharedStore
+			upsyncOptions.SourcePath = sourcePath
+			upsyncOptions.TargetPath = filepath.Join(root, fmt.Sprintf("version%d.lvi", i))
+			_, errs[i] = Upsync(context.Background(), upsyncOptions)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("TestSharedStore() Upsync() %d %v != %v", i, err, nil)
+		}
+	}
+	if sharedStore.RefCount() != 1 {
+		t.Errorf("TestSharedStore() RefCount() %d != %d", sharedStore.RefCount(), 1)
+	}
+
+	targetPath := filepath.Join(root, "target")
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StoreSettings: StoreSettings{SharedStore: sharedStore},
+		Targets:       []DownsyncTarget{{SourcePath: filepath.Join(root, "version3.lvi"), TargetPath: targetPath}},
+		Validate:      true,
+	})
+	if err != nil {
+		t.Errorf("TestSharedStore() Downsync() %v != %v", err, nil)
+	}
+}
+
+func TestFlushOnCancel(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(2, 0)
+	defer jobs.Dispose()
+	storePath, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(storePath)
+	store := longtaillib.CreateFSBlockStore(jobs, longtaillib.CreateFSStorageAPI(), storePath, 8388608, 1024)
+	defer store.Dispose()
+
+	flushed := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := flushOnCancel(ctx, []longtaillib.Longtail_BlockStoreAPI{store}, []string{"Local"}, func(err error) { flushed <- err })
+	cancel()
+	err := <-flushed
+	if err != nil {
+		t.Errorf("TestFlushOnCancel() flush %v != %v", err, nil)
+	}
+	stop()
+
+	stop = flushOnCancel(context.Background(), []longtaillib.Longtail_BlockStoreAPI{store}, []string{"Local"}, func(err error) { flushed <- err })
+	stop()
+	if len(flushed) != 0 {
+		t.Errorf("TestFlushOnCancel() flushed without cancel")
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	cachePath, _ := ioutil.TempDir("", "longtailapi-cache")
+	defer os.RemoveAll(cachePath)
+
+	blockHashes := []uint64{0x1111000000000001, 0x2222000000000002, 0x3333000000000003}
+	for i, blockHash := range blockHashes {
+		blockPath := getCachedBlockPath(cachePath, blockHash)
+		writeTestFiles(t, filepath.Dir(blockPath), map[string]string{filepath.Base(blockPath): "0123456789"})
+		modTime := time.Now().Add(time.Duration(i-len(blockHashes)) * time.Hour)
+		os.Chtimes(blockPath, modTime, modTime)
+	}
+	writeTestFiles(t, cachePath, map[string]string{"store.lsi": "index"})
+
+	// Blocks are not evicted while another downsync uses the cache
+	cache, err := openLocalCache(cachePath)
+	if err != nil {
+		t.Fatalf("TestEvictCache() openLocalCache() %v != %v", err, nil)
+	}
+	cache.blockUsed(blockHashes[0])
+	evictedCount, err := EvictCache(cachePath, 15)
+	if err != nil || evictedCount != 0 {
+		t.Errorf("TestEvictCache() EvictCache() while in use %d, %v != %d, %v", evictedCount, err, 0, nil)
+	}
+
+	// Closing the cache marks the first block as recently used and evicts the two older blocks
+	cache.close(15)
+	for i, blockHash := range blockHashes {
+		_, err := os.Stat(getCachedBlockPath(cachePath, blockHash))
+		if (i == 0) != (err == nil) {
+			t.Errorf("TestEvictCache() block 0x%016x %v", blockHash, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cachePath, "store.lsi")); !os.IsNotExist(err) {
+		t.Errorf("TestEvictCache() store.lsi not removed: %v", err)
+	}
+}
+
+func TestCachePin(t *testing.T) {
+	cachePath, _ := ioutil.TempDir("", "longtailapi-cache")
+	defer os.RemoveAll(cachePath)
+
+	blockHashes := []uint64{0x1111000000000001, 0x2222000000000002, 0x3333000000000003}
+	for i, blockHash := range blockHashes {
+		blockPath := getCachedBlockPath(cachePath, blockHash)
+		writeTestFiles(t, filepath.Dir(blockPath), map[string]string{filepath.Base(blockPath): "0123456789"})
+		modTime := time.Now().Add(time.Duration(i-len(blockHashes)) * time.Hour)
+		os.Chtimes(blockPath, modTime, modTime)
+	}
+	err := PinCacheBlocks(cachePath, "installed", blockHashes[:1])
+	if err != nil {
+		t.Fatalf("TestCachePin() PinCacheBlocks() %v != %v", err, nil)
+	}
+	if err = PinCacheBlocks(cachePath, "../installed", blockHashes[:1]); err == nil {
+		t.Errorf("TestCachePin() PinCacheBlocks() with invalid name %v", err)
+	}
+	pins, err := GetCachePins(cachePath)
+	if err != nil || len(pins) != 1 || pins[0] != "installed" {
+		t.Errorf("TestCachePin() GetCachePins() %v, %v", pins, err)
+	}
+
+	// The pinned block is the least recently used but counts towards the size and is kept
+	evictedCount, err := EvictCache(cachePath, 15)
+	if err != nil || evictedCount != 2 {
+		t.Errorf("TestCachePin() EvictCache() %d, %v != %d, %v", evictedCount, err, 2, nil)
+	}
+	for i, blockHash := range blockHashes {
+		_, err := os.Stat(getCachedBlockPath(cachePath, blockHash))
+		if (i == 0) != (err == nil) {
+			t.Errorf("TestCachePin() block 0x%016x %v", blockHash, err)
+		}
+	}
+
+	err = UnpinCache(cachePath, "installed")
+	if err != nil {
+		t.Fatalf("TestCachePin() UnpinCache() %v != %v", err, nil)
+	}
+	if err = UnpinCache(cachePath, "installed"); errors.Cause(err) != longtaillib.ErrENOENT {
+		t.Errorf("TestCachePin() UnpinCache() %v != %v", err, longtaillib.ErrENOENT)
+	}
+	evictedCount, err = EvictCache(cachePath, 5)
+	if err != nil || evictedCount != 1 {
+		t.Errorf("TestCachePin() EvictCache() %d, %v != %d, %v", evictedCount, err, 1, nil)
+	}
+}
+
+func TestDownsyncCachePin(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storePath := filepath.Join(root, "store")
+	cachePath := filepath.Join(root, "cache")
+	for i, content := range []string{"first version", "second version"} {
+		sourcePath := filepath.Join(root, fmt.Sprintf("source%d", i))
+		writeTestFiles(t, sourcePath, map[string]string{"a.txt": content})
+		upsyncOptions := DefaultUpsyncOptions()
+		upsyncOptions.StorageURI = storePath
+		upsyncOptions.SourcePath = sourcePath
+		upsyncOptions.TargetPath = filepath.Join(root, fmt.Sprintf("version%d.lvi", i))
+		if _, err := Upsync(context.Background(), upsyncOptions); err != nil {
+			t.Fatalf("TestDownsyncCachePin() Upsync() %v != %v", err, nil)
+		}
+	}
+
+	// Each downsync pins its version, so only the blocks of the previous version are evicted
+	for i := 0; i < 2; i++ {
+		_, err := Downsync(context.Background(), DownsyncOptions{
+			StorageURI:   storePath,
+			Targets:      []DownsyncTarget{{SourcePath: filepath.Join(root, fmt.Sprintf("version%d.lvi", i)), TargetPath: filepath.Join(root, "target")}},
+			CachePath:    cachePath,
+			MaxCacheSize: 1,
+			CachePin:     "installed",
+		})
+		if err != nil {
+			t.Fatalf("TestDownsyncCachePin() Downsync(%d) %v != %v", i, err, nil)
+		}
+		blocks, _ := filepath.Glob(filepath.Join(cachePath, "chunks", "*", "*.lrb"))
+		if len(blocks) != 1 {
+			t.Errorf("TestDownsyncCachePin() %d cached blocks after version %d != %d", len(blocks), i, 1)
+		}
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "target", "a.txt"))
+	if err != nil || string(content) != "second version" {
+		t.Errorf("TestDownsyncCachePin() a.txt `%s`, %v", string(content), err)
+	}
+}
+
+func TestDownsyncMaxCacheSize(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	storePath := filepath.Join(root, "store")
+	cachePath := filepath.Join(root, "cache")
+	indexPath := filepath.Join(root, "version.lvi")
+	writeTestFiles(t, sourcePath, map[string]string{"a.txt": "cached content"})
+
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	if _, err := Upsync(context.Background(), upsyncOptions); err != nil {
+		t.Fatalf("TestDownsyncMaxCacheSize() Upsync() %v != %v", err, nil)
+	}
+
+	for i, maxCacheSize := range []int64{0, 1} {
+		targetPath := filepath.Join(root, fmt.Sprintf("target%d", i))
+		_, err := Downsync(context.Background(), DownsyncOptions{
+			StorageURI:   storePath,
+			Targets:      []DownsyncTarget{{SourcePath: indexPath, TargetPath: targetPath}},
+			CachePath:    cachePath,
+			MaxCacheSize: maxCacheSize,
+		})
+		if err != nil {
+			t.Fatalf("TestDownsyncMaxCacheSize() Downsync(%d) %v != %v", maxCacheSize, err, nil)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(targetPath, "a.txt"))
+		if err != nil || string(content) != "cached content" {
+			t.Errorf("TestDownsyncMaxCacheSize() a.txt `%s`, %v", string(content), err)
+		}
+		blocks, _ := filepath.Glob(filepath.Join(cachePath, "chunks", "*", "*.lrb"))
+		if (maxCacheSize == 0) != (len(blocks) > 0) {
+			t.Errorf("TestDownsyncMaxCacheSize() %d cached blocks with max cache size %d", len(blocks), maxCacheSize)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	storePath := filepath.Join(root, "store")
+	cachePath := filepath.Join(root, "cache")
+	indexPath := filepath.Join(root, "version.lvi")
+	writeTestFiles(t, sourcePath, map[string]string{
+		"a.txt":        "prefetched file",
+		"folder/b.txt": "another prefetched file",
+	})
+
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	if _, err := Upsync(context.Background(), upsyncOptions); err != nil {
+		t.Fatalf("TestPrefetch() Upsync() %v != %v", err, nil)
+	}
+
+	prefetchOptions := PrefetchOptions{StorageURI: storePath, SourcePaths: []string{indexPath}, CachePath: cachePath}
+	result, err := Prefetch(context.Background(), prefetchOptions)
+	if err != nil {
+		t.Fatalf("TestPrefetch() Prefetch() %v != %v", err, nil)
+	}
+	if result.BlockCount == 0 || result.DownloadedBlockCount != result.BlockCount {
+		t.Errorf("TestPrefetch() Prefetch() downloaded %d of %d blocks", result.DownloadedBlockCount, result.BlockCount)
+	}
+	result, err = Prefetch(context.Background(), prefetchOptions)
+	if err != nil || result.DownloadedBlockCount != 0 {
+		t.Errorf("TestPrefetch() Prefetch() again downloaded %d blocks, %v", result.DownloadedBlockCount, err)
+	}
+
+	// The version can be installed from the cache once the blocks are gone from the store
+	os.RemoveAll(filepath.Join(storePath, "chunks"))
+	targetPath := filepath.Join(root, "target")
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storePath,
+		Targets:    []DownsyncTarget{{SourcePath: indexPath, TargetPath: targetPath}},
+		CachePath:  cachePath,
+	})
+	if err != nil {
+		t.Fatalf("TestPrefetch() Downsync() %v != %v", err, nil)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(targetPath, "folder", "b.txt"))
+	if err != nil || string(content) != "another prefetched file" {
+		t.Errorf("TestPrefetch() folder/b.txt `%s`, %v", string(content), err)
+	}
+}
+
+func TestFederatedUpsyncDownsync(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	targetPath := filepath.Join(root, "target")
+	storePaths := []string{filepath.Join(root, "store1"), filepath.Join(root, "store2")}
+	storageURI := "federated:" + storePaths[0] + "," + storePaths[1]
+	indexPath := filepath.Join(root, "version.lvi")
+
+	files := map[string]string{}
+	for i := 0; i < 16; i++ {
+		files[fmt.Sprintf("file%d.txt", i)] = fmt.Sprintf("content of federated file %d", i)
+	}
+	writeTestFiles(t, sourcePath, files)
+
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storageURI
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	upsyncOptions.MaxChunksPerBlock = 1
+	upsyncResult, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestFederatedUpsyncDownsync() Upsync() %v != %v", err, nil)
+	}
+	if upsyncResult.UploadedBlockCount < 16 {
+		t.Errorf("TestFederatedUpsyncDownsync() UploadedBlockCount %d < %d", upsyncResult.UploadedBlockCount, 16)
+	}
+	for _, storePath := range storePaths {
+		if _, err := os.Stat(filepath.Join(storePath, "chunks")); err != nil {
+			t.Errorf("TestFederatedUpsyncDownsync() no blocks in %s: %v", storePath, err)
+		}
+	}
+
+	upsyncResult, err = Upsync(context.Background(), upsyncOptions)
+	if err != nil || upsyncResult.UploadedBlockCount != 0 {
+		t.Errorf("TestFederatedUpsyncDownsync() second Upsync() uploaded %d blocks, %v", upsyncResult.UploadedBlockCount, err)
+	}
+
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storageURI,
+		Targets:    []DownsyncTarget{{SourcePath: indexPath, TargetPath: targetPath}},
+		Validate:   true,
+	})
+	if err != nil {
+		t.Fatalf("TestFederatedUpsyncDownsync() Downsync() %v != %v", err, nil)
+	}
+	for name, expected := range files {
+		content, err := ioutil.ReadFile(filepath.Join(targetPath, name))
+		if err != nil || string(content) != expected {
+			t.Errorf("TestFederatedUpsyncDownsync() %s `%s`, %v", name, string(content), err)
+		}
+	}
+}
+
+func TestNetworkShareUpsyncDownsync(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storePath := filepath.Join(root, "store")
+	storageURI := storePath + "?network-share=true"
+
+	// Two versions are uploaded at the same time, both have to end up in the store index
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := 0; i < 2; i++ {
+		sourcePath := filepath.Join(root, fmt.Sprintf("source%d", i))
+		writeTestFiles(t, sourcePath, map[string]string{"file.txt": fmt.Sprintf("content of version %d", i)})
+		upsyncOptions := DefaultUpsyncOptions()
+		upsyncOptions.StorageURI = storageURI
+		upsyncOptions.SourcePath = sourcePath
+		upsyncOptions.TargetPath = filepath.Join(root, fmt.Sprintf("version%d.lvi", i))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = Upsync(context.Background(), upsyncOptions)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("TestNetworkShareUpsyncDownsync() Upsync() %d %v != %v", i, err, nil)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(storePath, "store.lsi.gen")); err != nil {
+		t.Errorf("TestNetworkShareUpsyncDownsync() store index generation %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		targetPath := filepath.Join(root, fmt.Sprintf("target%d", i))
+		_, err := Downsync(context.Background(), DownsyncOptions{
+			StorageURI: storageURI,
+			Targets:    []DownsyncTarget{{SourcePath: filepath.Join(root, fmt.Sprintf("version%d.lvi", i)), TargetPath: targetPath}},
+			Validate:   true,
+		})
+		if err != nil {
+			t.Fatalf("TestNetworkShareUpsyncDownsync() Downsync() %d %v != %v", i, err, nil)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(targetPath, "file.txt"))
+		if err != nil || string(content) != fmt.Sprintf("content of version %d", i) {
+			t.Errorf("TestNetworkShareUpsyncDownsync() %d `%s`, %v", i, string(content), err)
+		}
+	}
+}
+
+func TestPublishRelease(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storePath := filepath.Join(root, "store")
+
+	opts := PublishReleaseOptions{StorageURI: storePath, Name: "1.0", Tags: []string{"stable"}}
+	for _, platform := range []string{"win64", "linux"} {
+		upsyncOptions := DefaultUpsyncOptions()
+		upsyncOptions.SourcePath = filepath.Join(root, platform)
+		upsyncOptions.TargetPath = filepath.Join(storePath, "index", platform+".lvi")
+		opts.Versions = append(opts.Versions, ReleaseVersionOptions{Name: platform, Options: upsyncOptions})
+	}
+
+	// The linux version fails to upload, the win64 version must not become visible
+	writeTestFiles(t, filepath.Join(root, "win64"), map[string]string{"game.exe": "win64 build"})
+	writeTestFiles(t, filepath.Join(root, "linux"), map[string]string{"game": "linux build"})
+	opts.Versions[1].Options.IncludeFilterRegEx = "("
+	_, err := PublishRelease(context.Background(), opts)
+	if err == nil {
+		t.Errorf("TestPublishRelease() PublishRelease() partial %v == %v", err, nil)
+	}
+	blobStore, _ := longtailstorelib.CreateBlobStoreForURI(storePath)
+	manifest, err := longtailstorelib.ReadVersionManifest(context.Background(), blobStore)
+	if err != nil || len(manifest.Versions) != 0 || len(manifest.Releases) != 0 {
+		t.Errorf("TestPublishRelease() ReadVersionManifest() partial %v, %+v", err, manifest)
+	}
+	for _, version := range opts.Versions {
+		for _, path := range []string{version.Options.TargetPath, longtailstorelib.ReleaseVersionPath(version.Options.TargetPath, opts.Name)} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("TestPublishRelease() PublishRelease() partial left %s: %v", path, err)
+			}
+		}
+	}
+
+	opts.Versions[1].Options.IncludeFilterRegEx = ""
+	result, err := PublishRelease(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("TestPublishRelease() PublishRelease() %v != %v", err, nil)
+	}
+	if len(result.Versions) != 2 || len(result.Release.Versions) != 2 || result.Release.Created.IsZero() {
+		t.Fatalf("TestPublishRelease() PublishRelease() result %+v", result)
+	}
+	if result.Release.Versions[1].Path != longtailstorelib.ReleaseVersionPath(opts.Versions[1].Options.TargetPath, opts.Name) {
+		t.Errorf("TestPublishRelease() PublishRelease() path %s", result.Release.Versions[1].Path)
+	}
+	manifest, _ = longtailstorelib.ReadVersionManifest(context.Background(), blobStore)
+	if len(manifest.Versions) != 2 || len(manifest.Releases) != 1 {
+		t.Errorf("TestPublishRelease() ReadVersionManifest() %+v", manifest)
+	}
+	targetPath := filepath.Join(root, "target")
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storePath,
+		Targets:    []DownsyncTarget{{SourcePath: result.Release.Versions[1].Path, TargetPath: targetPath}}})
+	if err != nil {
+		t.Fatalf("TestPublishRelease() Downsync() %v != %v", err, nil)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(targetPath, "game"))
+	if err != nil || string(content) != "linux build" {
+		t.Errorf("TestPublishRelease() `%s`, %v", string(content), err)
+	}
+
+	_, err = PublishRelease(context.Background(), opts)
+	if !errors.Is(err, longtailstorelib.ErrReleaseExists) {
+		t.Errorf("TestPublishRelease() PublishRelease() again %v != %v", err, longtailstorelib.ErrReleaseExists)
+	}
+}
+
+func TestDownsyncMissingBlocks(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storePath := filepath.Join(root, "store")
+	storageURI := storePath + "?network-share=true"
+	sourcePath := filepath.Join(root, "source")
+	writeTestFiles(t, sourcePath, map[string]string{"file.txt": "new content"})
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storageURI
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = filepath.Join(root, "version.lvi")
+	_, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestDownsyncMissingBlocks() Upsync() %v != %v", err, nil)
+	}
+	os.RemoveAll(filepath.Join(storePath, "chunks"))
+
+	targetPath := filepath.Join(root, "target")
+	writeTestFiles(t, targetPath, map[string]string{"file.txt": "old content"})
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storageURI,
+		Targets:    []DownsyncTarget{{SourcePath: upsyncOptions.TargetPath, TargetPath: targetPath}},
+	})
+	if !longtailstorelib.IsBlocksMissing(err) {
+		t.Fatalf("TestDownsyncMissingBlocks() Downsync() %v is not a *BlocksMissingError", err)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(targetPath, "file.txt"))
+	if string(content) != "old content" {
+		t.Errorf("TestDownsyncMissingBlocks() target changed to `%s`", string(content))
+	}
+}
+
+func TestDownsyncErrorContext(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	versionPath := filepath.Join(root, "version.lvi")
+	ioutil.WriteFile(versionPath, []byte("not a version index"), 0644)
+
+	_, err := Downsync(context.Background(), DownsyncOptions{
+		StorageURI: filepath.Join(root, "store"),
+		Targets:    []DownsyncTarget{{SourcePath: versionPath, TargetPath: filepath.Join(root, "target")}},
+	})
+	var longtailErr *longtaillib.Error
+	if !errors.As(err, &longtailErr) {
+		t.Fatalf("TestDownsyncErrorContext() Downsync() %v is not a *longtaillib.Error", err)
+	}
+	if longtailErr.Op != "ReadVersionIndexFromBuffer" || longtailErr.Key != versionPath || longtailErr.Errno == 0 {
+		t.Errorf("TestDownsyncErrorContext() Downsync() %+v", longtailErr)
+	}
+	if longtaillib.ErrorToErrno(err, 0) != longtailErr.Errno {
+		t.Errorf("TestDownsyncErrorContext() longtaillib.ErrorToErrno() %d != %d", longtaillib.ErrorToErrno(err, 0), longtailErr.Errno)
+	}
+}
+
+func TestDownsyncSessionState(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storageURI := filepath.Join(root, "store") + "?network-share=true"
+	targets := []DownsyncTarget{}
+	for i := 0; i < 2; i++ {
+		sourcePath := filepath.Join(root, fmt.Sprintf("source%d", i))
+		writeTestFiles(t, sourcePath, map[string]string{"file.txt": fmt.Sprintf("content of version %d", i)})
+		upsyncOptions := DefaultUpsyncOptions()
+		upsyncOptions.StorageURI = storageURI
+		upsyncOptions.SourcePath = sourcePath
+		upsyncOptions.TargetPath = filepath.Join(root, fmt.Sprintf("version%d.lvi", i))
+		_, err := Upsync(context.Background(), upsyncOptions)
+		if err != nil {
+			t.Fatalf("TestDownsyncSessionState() Upsync() %d %v != %v", i, err, nil)
+		}
+		targets = append(targets, DownsyncTarget{SourcePath: upsyncOptions.TargetPath, TargetPath: filepath.Join(root, fmt.Sprintf("target%d", i))})
+	}
+	sessionStatePath := filepath.Join(root, "session.json")
+	downsyncOptions := DownsyncOptions{
+		StorageURI:       storageURI,
+		Targets:          targets,
+		SessionStatePath: sessionStatePath}
+
+	// The second target can not be written while it is a file
+	ioutil.WriteFile(targets[1].TargetPath, []byte("not a folder"), 0644)
+	_, err := Downsync(context.Background(), downsyncOptions)
+	if err == nil {
+		t.Fatalf("TestDownsyncSessionState() Downsync() succeeded with a file as target")
+	}
+	state, err := longtailstorelib.ReadSessionState(sessionStatePath)
+	if err != nil {
+		t.Fatalf("TestDownsyncSessionState() ReadSessionState() %v != %v", err, nil)
+	}
+	if state.IndexGeneration == 0 || len(state.Checkpoint) == 0 {
+		t.Errorf("TestDownsyncSessionState() state.IndexGeneration %d, state.Checkpoint `%s`", state.IndexGeneration, string(state.Checkpoint))
+	}
+
+	// The completed target is skipped when resuming
+	writeTestFiles(t, targets[0].TargetPath, map[string]string{"file.txt": "local change"})
+	os.Remove(targets[1].TargetPath)
+	_, err = Downsync(context.Background(), downsyncOptions)
+	if err != nil {
+		t.Fatalf("TestDownsyncSessionState() Downsync() %v != %v", err, nil)
+	}
+	for i, expected := range []string{"local change", "content of version 1"} {
+		content, _ := ioutil.ReadFile(filepath.Join(targets[i].TargetPath, "file.txt"))
+		if string(content) != expected {
+			t.Errorf("TestDownsyncSessionState() target %d `%s` != `%s`", i, string(content), expected)
+		}
+	}
+	state, _ = longtailstorelib.ReadSessionState(sessionStatePath)
+	if state.IndexGeneration == 0 || len(state.Checkpoint) != 0 {
+		t.Errorf("TestDownsyncSessionState() state.IndexGeneration %d, state.Checkpoint `%s`", state.IndexGeneration, string(state.Checkpoint))
+	}
+}
+
+func TestIsTransientRestoreError(t *testing.T) {
+	transient := []error{
+		errors.Wrap(longtaillib.ErrEIO, "GetStoredBlock"),
+		errors.Wrap(longtaillib.ErrEBUSY, "PutStoredBlock"),
+		longtailstorelib.ErrInjectedFault}
+	for _, err := range transient {
+		if !IsTransientRestoreError(err) {
+			t.Errorf("TestIsTransientRestoreError() IsTransientRestoreError(%v) != %v", err, true)
+		}
+	}
+	permanent := []error{
+		nil,
+		context.Canceled,
+		errors.Wrap(longtaillib.ErrENOENT, "ReadFromURI"),
+		errors.Wrap(&longtailstorelib.BlocksMissingError{BlockHashes: []uint64{1}}, "Downsync")}
+	for _, err := range permanent {
+		if IsTransientRestoreError(err) {
+			t.Errorf("TestIsTransientRestoreError() IsTransientRestoreError(%v) != %v", err, false)
+		}
+	}
+}
+
+func TestRestoreWithRetry(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storageURI := filepath.Join(root, "store") + "?network-share=true"
+	targets := []DownsyncTarget{}
+	for i := 0; i < 2; i++ {
+		sourcePath := filepath.Join(root, fmt.Sprintf("source%d", i))
+		writeTestFiles(t, sourcePath, map[string]string{"file.txt": fmt.Sprintf("content of version %d", i)})
+		upsyncOptions := DefaultUpsyncOptions()
+		upsyncOptions.StorageURI = storageURI
+		upsyncOptions.SourcePath = sourcePath
+		upsyncOptions.TargetPath = filepath.Join(root, fmt.Sprintf("version%d.lvi", i))
+		_, err := Upsync(context.Background(), upsyncOptions)
+		if err != nil {
+			t.Fatalf("TestRestoreWithRetry() Upsync() %d %v != %v", i, err, nil)
+		}
+		targets = append(targets, DownsyncTarget{SourcePath: upsyncOptions.TargetPath, TargetPath: filepath.Join(root, fmt.Sprintf("target%d", i))})
+	}
+
+	// The second target can not be written while it is a file, the failure is cleared before the retry
+	ioutil.WriteFile(targets[1].TargetPath, []byte("not a folder"), 0644)
+	retries := []int{}
+	result, err := RestoreWithRetry(context.Background(), DownsyncOptions{StorageURI: storageURI, Targets: targets}, RestoreRetryPolicy{
+		Backoff:     time.Millisecond,
+		IsTransient: func(err error) bool { return true },
+		OnRetry: func(attempt int, err error) {
+			retries = append(retries, attempt)
+			os.Remove(targets[1].TargetPath)
+		}})
+	if err != nil {
+		t.Fatalf("TestRestoreWithRetry() RestoreWithRetry() %v != %v", err, nil)
+	}
+	if result.Attempts != 2 || len(retries) != 1 || retries[0] != 1 {
+		t.Errorf("TestRestoreWithRetry() result.Attempts %d, retries %v", result.Attempts, retries)
+	}
+	for i, target := range targets {
+		expected := fmt.Sprintf("content of version %d", i)
+		content, _ := ioutil.ReadFile(filepath.Join(target.TargetPath, "file.txt"))
+		if string(content) != expected {
+			t.Errorf("TestRestoreWithRetry() target %d `%s` != `%s`", i, string(content), expected)
+		}
+	}
+
+	// Missing blocks are not retried
+	os.RemoveAll(filepath.Join(root, "store", "chunks"))
+	os.RemoveAll(targets[0].TargetPath)
+	result, err = RestoreWithRetry(context.Background(), DownsyncOptions{StorageURI: storageURI, Targets: targets[:1]}, RestoreRetryPolicy{Backoff: time.Millisecond})
+	if !longtailstorelib.IsBlocksMissing(err) {
+		t.Fatalf("TestRestoreWithRetry() RestoreWithRetry() %v is not a *BlocksMissingError", err)
+	}
+	if result.Attempts != 1 {
+		t.Errorf("TestRestoreWithRetry() result.Attempts %d != %d", result.Attempts, 1)
+	}
+}
+
+func TestDownsyncToImage(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	storePath := filepath.Join(root, "store")
+	indexPath := filepath.Join(root, "version.lvi")
+	imagePath := filepath.Join(root, "version.img")
+	layoutPath := filepath.Join(root, "version.json")
+
+	files := map[string]string{
+		"a.txt":        "first file",
+		"folder/b.txt": "second file",
+		"folder/c.bin": string(bytes.Repeat([]byte("third file "), 1000)),
+	}
+	writeTestFiles(t, sourcePath, files)
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	_, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestDownsyncToImage() Upsync() %v != %v", err, nil)
+	}
+
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storePath,
+		Targets:    []DownsyncTarget{{SourcePath: indexPath, TargetPath: imagePath, Image: true, ImageAlignment: 512, ImageLayoutPath: layoutPath}},
+		Validate:   true,
+	})
+	if err != nil {
+		t.Fatalf("TestDownsyncToImage() Downsync() %v != %v", err, nil)
+	}
+
+	layoutJSON, err := ioutil.ReadFile(layoutPath)
+	if err != nil {
+		t.Fatalf("TestDownsyncToImage() ioutil.ReadFile(%s) %v != %v", layoutPath, err, nil)
+	}
+	var layout []ImageAsset
+	err = json.Unmarshal(layoutJSON, &layout)
+	if err != nil || len(layout) != len(files) {
+		t.Fatalf("TestDownsyncToImage() layout %s, %v", string(layoutJSON), err)
+	}
+	image, err := ioutil.ReadFile(imagePath)
+	if err != nil {
+		t.Fatalf("TestDownsyncToImage() ioutil.ReadFile(%s) %v != %v", imagePath, err, nil)
+	}
+	end := uint64(0)
+	for _, asset := range layout {
+		if asset.Offset%512 != 0 || asset.Offset < end {
+			t.Errorf("TestDownsyncToImage() `%s` at offset %d", asset.Path, asset.Offset)
+		}
+		end = asset.Offset + asset.Size
+		if content := string(image[asset.Offset:end]); content != files[asset.Path] {
+			t.Errorf("TestDownsyncToImage() `%s` content `%s`", asset.Path, content)
+		}
+	}
+	if uint64(len(image)) != (end+511)/512*512 {
+		t.Errorf("TestDownsyncToImage() image size %d, last file ends at %d", len(image), end)
+	}
+}
+
+func TestDownsyncBase(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storePath := filepath.Join(root, "store")
+	basePath := filepath.Join(root, "base")
+	targetPath := filepath.Join(root, "target")
+
+	upsync := func(name string, files map[string]string) string {
+		sourcePath := filepath.Join(root, name)
+		writeTestFiles(t, sourcePath, files)
+		upsyncOptions := DefaultUpsyncOptions()
+		upsyncOptions.StorageURI = storePath
+		upsyncOptions.SourcePath = sourcePath
+		upsyncOptions.TargetPath = filepath.Join(root, name+".lvi")
+		_, err := Upsync(context.Background(), upsyncOptions)
+		if err != nil {
+			t.Fatalf("TestDownsyncBase() Upsync(%s) %v != %v", name, err, nil)
+		}
+		return upsyncOptions.TargetPath
+	}
+	v1 := upsync("v1", map[string]string{"a.txt": "unchanged", "folder/b.txt": "first b", "folder/c.txt": "also unchanged"})
+	v2 := upsync("v2", map[string]string{"a.txt": "unchanged", "folder/b.txt": "second b", "folder/c.txt": "also unchanged", "d.txt": "new"})
+	v3 := upsync("v3", map[string]string{"a.txt": "changed", "folder/b.txt": "second b", "folder/c.txt": "also unchanged", "d.txt": "new"})
+
+	_, err := Downsync(context.Background(), DownsyncOptions{StorageURI: storePath, Targets: []DownsyncTarget{{SourcePath: v1, TargetPath: basePath}}})
+	if err != nil {
+		t.Fatalf("TestDownsyncBase() Downsync(v1) %v != %v", err, nil)
+	}
+	result, err := Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storePath,
+		Targets:    []DownsyncTarget{{SourcePath: v2, TargetPath: targetPath, BasePath: basePath}},
+		Validate:   true,
+	})
+	if err != nil {
+		t.Fatalf("TestDownsyncBase() Downsync(v2) %v != %v", err, nil)
+	}
+	if result.LinkedFileCount != 2 {
+		t.Errorf("TestDownsyncBase() LinkedFileCount %d != %d", result.LinkedFileCount, 2)
+	}
+
+	// The base must not change when a linked file is updated in the target
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storePath,
+		Targets:    []DownsyncTarget{{SourcePath: v3, TargetPath: targetPath}},
+		Validate:   true,
+	})
+	if err != nil {
+		t.Fatalf("TestDownsyncBase() Downsync(v3) %v != %v", err, nil)
+	}
+	for path, expected := range map[string]string{
+		filepath.Join(basePath, "a.txt"):   "unchanged",
+		filepath.Join(targetPath, "a.txt"): "changed",
+	} {
+		content, _ := ioutil.ReadFile(path)
+		if string(content) != expected {
+			t.Errorf("TestDownsyncBase() `%s` content `%s` != `%s`", path, string(content), expected)
+		}
+	}
+
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storePath,
+		Targets:    []DownsyncTarget{{SourcePath: v2, TargetPath: targetPath, BasePath: basePath}},
+	})
+	if err == nil {
+		t.Errorf("TestDownsyncBase() Downsync() to a target that is not empty %v == %v", err, nil)
+	}
+}
+
+func TestDownsyncVerifyDisk(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	storePath := filepath.Join(root, "store")
+
+	upsync := func(name string, files map[string]string) string {
+		sourcePath := filepath.Join(root, name)
+		writeTestFiles(t, sourcePath, files)
+		upsyncOptions := DefaultUpsyncOptions()
+		upsyncOptions.StorageURI = storePath
+		upsyncOptions.SourcePath = sourcePath
+		upsyncOptions.TargetPath = filepath.Join(root, name+".lvi")
+		_, err := Upsync(context.Background(), upsyncOptions)
+		if err != nil {
+			t.Fatalf("TestDownsyncVerifyDisk() Upsync(%s) %v != %v", name, err, nil)
+		}
+		return upsyncOptions.TargetPath
+	}
+	v1 := upsync("v1", map[string]string{"a.txt": "unchanged", "b.txt": "first b", "c.txt": "also unchanged"})
+	v2 := upsync("v2", map[string]string{"a.txt": "unchanged", "b.txt": "second b", "c.txt": "also unchanged"})
+
+	for _, verifyDisk := range []bool{false, true} {
+		targetPath := filepath.Join(root, fmt.Sprintf("target-%t", verifyDisk))
+		_, err := Downsync(context.Background(), DownsyncOptions{StorageURI: storePath, Targets: []DownsyncTarget{{SourcePath: v1, TargetPath: targetPath}}})
+		if err != nil {
+			t.Fatalf("TestDownsyncVerifyDisk() Downsync(v1) %v != %v", err, nil)
+		}
+		// The install is modified behind the back of the recorded index
+		ioutil.WriteFile(filepath.Join(targetPath, "a.txt"), []byte("unchanGed and longer"), 0644)
+		os.Remove(filepath.Join(targetPath, "c.txt"))
+
+		_, err = Downsync(context.Background(), DownsyncOptions{
+			StorageURI: storePath,
+			Targets:    []DownsyncTarget{{SourcePath: v2, TargetPath: targetPath, TargetIndexPath: v1}},
+			VerifyDisk: verifyDisk,
+		})
+		if err != nil {
+			t.Fatalf("TestDownsyncVerifyDisk() Downsync(v2, %t) %v != %v", verifyDisk, err, nil)
+		}
+		expected := map[string]string{"a.txt": "unchanGed and longer", "b.txt": "second b", "c.txt": ""}
+		if verifyDisk {
+			expected = map[string]string{"a.txt": "unchanged", "b.txt": "second b", "c.txt": "also unchanged"}
+		}
+		for name, content := range expected {
+			data, _ := ioutil.ReadFile(filepath.Join(targetPath, name))
+			if string(data) != content {
+				t.Errorf("TestDownsyncVerifyDisk() VerifyDisk %t `%s` content `%s` != `%s`", verifyDisk, name, string(data), content)
+			}
+		}
+	}
+}
+
+func TestCloneDuplicates(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	duplicate := string(bytes.Repeat([]byte("duplicated content "), 10000))
+	writeTestFiles(t, sourcePath, map[string]string{
+		"a/first.bin":  duplicate,
+		"b/second.bin": duplicate,
+		"small1.txt":   "small duplicate",
+		"small2.txt":   "small duplicate",
+	})
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = filepath.Join(root, "store")
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = filepath.Join(root, "version.lvi")
+	_, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestCloneDuplicates() Upsync() %v != %v", err, nil)
+	}
+	vbuffer, _ := ioutil.ReadFile(upsyncOptions.TargetPath)
+	versionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(vbuffer)
+	if errno != 0 {
+		t.Fatalf("TestCloneDuplicates() ReadVersionIndexFromBuffer() %d != %d", errno, 0)
+	}
+	defer versionIndex.Dispose()
+	emptyIndex, err := VersionIndexFromJSON(VersionIndexJSON{Schema: VersionIndexJSONSchema, SchemaVersion: IndexJSONSchemaVersion, HashIdentifier: versionIndex.GetHashIdentifier(), TargetChunkSize: versionIndex.GetTargetChunkSize()})
+	if err != nil {
+		t.Fatalf("TestCloneDuplicates() VersionIndexFromJSON() %v != %v", err, nil)
+	}
+	defer emptyIndex.Dispose()
+
+	clones := findClonedAssets(versionIndex, emptyIndex)
+	if len(clones) != 1 || !strings.HasSuffix(clones[0].path, ".bin") || !strings.HasSuffix(clones[0].sourcePath, ".bin") || clones[0].path == clones[0].sourcePath {
+		t.Fatalf("TestCloneDuplicates() findClonedAssets() %v", clones)
+	}
+	if clones := findClonedAssets(versionIndex, versionIndex); len(clones) != 0 {
+		t.Errorf("TestCloneDuplicates() findClonedAssets() of an up to date target %v", clones)
+	}
+	writeIndex, err := withoutAssets(versionIndex, clonedPaths(clones))
+	if err != nil {
+		t.Fatalf("TestCloneDuplicates() withoutAssets() %v != %v", err, nil)
+	}
+	defer writeIndex.Dispose()
+	if writeIndex.GetAssetCount() != versionIndex.GetAssetCount()-1 {
+		t.Errorf("TestCloneDuplicates() withoutAssets() asset count %d != %d", writeIndex.GetAssetCount(), versionIndex.GetAssetCount()-1)
+	}
+
+	// Clones fall back to copies on file systems without reflinks
+	os.Remove(filepath.Join(sourcePath, filepath.FromSlash(clones[0].path)))
+	err = cloneAssets(sourcePath, clones, true)
+	if err != nil {
+		t.Fatalf("TestCloneDuplicates() cloneAssets() %v != %v", err, nil)
+	}
+	content, _ := ioutil.ReadFile(filepath.Join(sourcePath, filepath.FromSlash(clones[0].path)))
+	if string(content) != duplicate {
+		t.Errorf("TestCloneDuplicates() cloned `%s` content differs", clones[0].path)
+	}
+}
+
+func TestExport(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	storePath := filepath.Join(root, "store")
+	indexPath := filepath.Join(root, "version.lvi")
+
+	files := map[string]string{
+		"a.txt":        "first file",
+		"folder/b.txt": "second file",
+		"folder/c.bin": string(bytes.Repeat([]byte("third file "), 10000)),
+	}
+	writeTestFiles(t, sourcePath, files)
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	_, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestExport() Upsync() %v != %v", err, nil)
+	}
+
+	exportOptions := ExportOptions{StorageURI: storePath, SourcePath: indexPath, Format: ExportFormatTar}
+	var tarData bytes.Buffer
+	result, err := Export(context.Background(), &tarData, exportOptions)
+	if err != nil {
+		t.Fatalf("TestExport() Export(tar) %v != %v", err, nil)
+	}
+	if result.AssetCount != 4 {
+		t.Errorf("TestExport() AssetCount %d != %d", result.AssetCount, 4)
+	}
+	exported := map[string]string{}
+	tarReader := tar.NewReader(&tarData)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("TestExport() tarReader.Next() %v != %v", err, nil)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		content, _ := ioutil.ReadAll(tarReader)
+		exported[header.Name] = string(content)
+	}
+	if len(exported) != len(files) {
+		t.Errorf("TestExport() tar files %d != %d", len(exported), len(files))
+	}
+	for path, content := range files {
+		if exported[path] != content {
+			t.Errorf("TestExport() tar `%s` content differs", path)
+		}
+	}
+
+	exportOptions.Format = ExportFormatZip
+	var zipData bytes.Buffer
+	_, err = Export(context.Background(), &zipData, exportOptions)
+	if err != nil {
+		t.Fatalf("TestExport() Export(zip) %v != %v", err, nil)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(zipData.Bytes()), int64(zipData.Len()))
+	if err != nil {
+		t.Fatalf("TestExport() zip.NewReader() %v != %v", err, nil)
+	}
+	for _, file := range zipReader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		reader, _ := file.Open()
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if string(content) != files[file.Name] {
+			t.Errorf("TestExport() zip `%s` content differs", file.Name)
+		}
+	}
+
+	exportOptions.Format = "rar"
+	if _, err := Export(context.Background(), ioutil.Discard, exportOptions); err == nil {
+		t.Errorf("TestExport() Export(rar) %v == %v", err, nil)
+	}
+}
+
+func TestIndexJSON(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	storePath := filepath.Join(root, "store")
+	indexPath := filepath.Join(root, "version.lvi")
+	writeTestFiles(t, sourcePath, map[string]string{
+		"a.txt":        "first file",
+		"empty.txt":    "",
+		"folder/b.txt": "second file with some more content",
+	})
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath + "?network-share=true"
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	_, err := Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestIndexJSON() Upsync() %v != %v", err, nil)
+	}
+
+	versionIndexData, _ := ioutil.ReadFile(indexPath)
+	info, err := InspectIndex(versionIndexData)
+	if err != nil || info.Kind != IndexKindVersionIndex || !info.Supported || info.FormatVersion != info.CurrentFormatVersion {
+		t.Errorf("TestIndexJSON() InspectIndex() version index %+v, %v", info, err)
+	}
+	versionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(versionIndexData)
+	if errno != 0 {
+		t.Fatalf("TestIndexJSON() longtaillib.ReadVersionIndexFromBuffer() %d != %d", errno, 0)
+	}
+	versionDoc := VersionIndexToJSON(versionIndex)
+	versionIndex.Dispose()
+	data, _ := json.Marshal(versionDoc)
+	info, err = InspectIndex(data)
+	if err != nil || info.Kind != IndexKindVersionIndexJSON || !info.Supported {
+		t.Errorf("TestIndexJSON() InspectIndex() version JSON %+v, %v", info, err)
+	}
+	versionDoc = VersionIndexJSON{}
+	json.Unmarshal(data, &versionDoc)
+	if len(versionDoc.Assets) != 4 || versionDoc.HashAlgorithm != "blake3" {
+		t.Errorf("TestIndexJSON() VersionIndexToJSON() %+v", versionDoc)
+	}
+	rebuiltVersionIndex, err := VersionIndexFromJSON(versionDoc)
+	if err != nil {
+		t.Fatalf("TestIndexJSON() VersionIndexFromJSON() %v != %v", err, nil)
+	}
+	rebuiltData, _ := longtaillib.WriteVersionIndexToBuffer(rebuiltVersionIndex)
+	rebuiltVersionIndex.Dispose()
+	if !bytes.Equal(rebuiltData, versionIndexData) {
+		t.Errorf("TestIndexJSON() VersionIndexFromJSON() rebuilt version index differs")
+	}
+
+	storeIndexData, _ := ioutil.ReadFile(filepath.Join(storePath, "store.lsi"))
+	info, err = InspectIndex(storeIndexData)
+	if err != nil || info.Kind != IndexKindStoreIndex || !info.Supported {
+		t.Errorf("TestIndexJSON() InspectIndex() store index %+v, %v", info, err)
+	}
+	corruptStoreIndexData := append([]byte{}, storeIndexData...)
+	corruptStoreIndexData[len(corruptStoreIndexData)/2] ^= 0xff
+	if info, err := InspectIndex(corruptStoreIndexData); err == nil {
+		t.Errorf("TestIndexJSON() InspectIndex() corrupt store index %+v, %v", info, err)
+	}
+	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(storeIndexData)
+	if errno != 0 {
+		t.Fatalf("TestIndexJSON() longtaillib.ReadStoreIndexFromBuffer() %d != %d", errno, 0)
+	}
+	data, _ = json.Marshal(StoreIndexToJSON(storeIndex))
+	storeIndex.Dispose()
+	storeDoc := StoreIndexJSON{}
+	json.Unmarshal(data, &storeDoc)
+	rebuiltStoreIndex, err := StoreIndexFromJSON(storeDoc)
+	if err != nil {
+		t.Fatalf("TestIndexJSON() StoreIndexFromJSON() %v != %v", err, nil)
+	}
+	rebuiltData, _ = longtaillib.WriteStoreIndexToBuffer(rebuiltStoreIndex)
+	rebuiltStoreIndex.Dispose()
+	storeIndexData, _, _ = storeformat.CheckStoreIndexFooter(storeIndexData)
+	if !bytes.Equal(rebuiltData, storeIndexData) {
+		t.Errorf("TestIndexJSON() StoreIndexFromJSON() rebuilt store index differs")
+	}
+
+	// Documents with a newer schema are detected but not rebuilt
+	storeDoc.SchemaVersion = IndexJSONSchemaVersion + 1
+	data, _ = json.Marshal(storeDoc)
+	info, err = InspectIndex(data)
+	if err != nil || info.Kind != IndexKindStoreIndexJSON || info.Supported {
+		t.Errorf("TestIndexJSON() InspectIndex() newer schema %+v, %v", info, err)
+	}
+	if _, err := StoreIndexFromJSON(storeDoc); err == nil {
+		t.Errorf("TestIndexJSON() StoreIndexFromJSON() newer schema %v == %v", err, nil)
+	}
+}
+
+// reverseCompression stores the chunk data reversed and counts the blocks it handled
+type reverseCompression struct {
+	lock            sync.Mutex
+	compressCount   int
+	decompressCount int
+}
+
+func (c *reverseCompression) GetMaxCompressedSize(settingsID uint32, size int) int {
+	return size
+}
+
+func (c *reverseCompression) Compress(settingsID uint32, uncompressed []byte, compressed []byte) (int, int) {
+	c.lock.Lock()
+	c.compressCount++
+	c.lock.Unlock()
+	for i, b := range uncompressed {
+		compressed[len(uncompressed)-1-i] = b
+	}
+	return len(uncompressed), 0
+}
+
+func (c *reverseCompression) Decompress(compressed []byte, uncompressed []byte) (int, int) {
+	c.lock.Lock()
+	c.decompressCount++
+	c.lock.Unlock()
+	if len(compressed) > len(uncompressed) {
+		return 0, longtaillib.EINVAL
+	}
+	for i, b := range compressed {
+		uncompressed[len(compressed)-1-i] = b
+	}
+	return len(compressed), 0
+}
+
+func TestRegisterCompressionAlgorithm(t *testing.T) {
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	sourcePath := filepath.Join(root, "source")
+	targetPath := filepath.Join(root, "target")
+	storePath := filepath.Join(root, "store")
+	indexPath := filepath.Join(root, "version.lvi")
+
+	writeTestFiles(t, sourcePath, map[string]string{
+		"a.txt":        "first file",
+		"folder/b.txt": "second file",
+	})
+
+	compression := &reverseCompression{}
+	err := RegisterCompressionAlgorithm("reverse", 0x72657631, 0, compression)
+	if err != nil {
+		t.Fatalf("TestRegisterCompressionAlgorithm() RegisterCompressionAlgorithm() %v != %v", err, nil)
+	}
+	if err := RegisterCompressionAlgorithm("zstd", 0x72657632, 0, compression); err == nil {
+		t.Errorf("TestRegisterCompressionAlgorithm() RegisterCompressionAlgorithm(zstd) %v == %v", err, nil)
+	}
+	if err := RegisterCompressionAlgorithm("reverse2", 0x72657631, 0, compression); err == nil {
+		t.Errorf("TestRegisterCompressionAlgorithm() RegisterCompressionAlgorithm(0x72657631) %v == %v", err, nil)
+	}
+	if names := RegisteredCompressionAlgorithms(); len(names) != 1 || names[0] != "reverse" {
+		t.Errorf("TestRegisterCompressionAlgorithm() RegisteredCompressionAlgorithms() %v", names)
+	}
+
+	upsyncOptions := DefaultUpsyncOptions()
+	upsyncOptions.StorageURI = storePath
+	upsyncOptions.SourcePath = sourcePath
+	upsyncOptions.TargetPath = indexPath
+	upsyncOptions.CompressionAlgorithm = "reverse"
+	_, err = Upsync(context.Background(), upsyncOptions)
+	if err != nil {
+		t.Fatalf("TestRegisterCompressionAlgorithm() Upsync() %v != %v", err, nil)
+	}
+	if compression.compressCount == 0 {
+		t.Errorf("TestRegisterCompressionAlgorithm() compressCount %d == %d", compression.compressCount, 0)
+	}
+
+	_, err = Downsync(context.Background(), DownsyncOptions{
+		StorageURI: storePath,
+		Targets:    []DownsyncTarget{{SourcePath: indexPath, TargetPath: targetPath}},
+		Validate:   true,
+	})
+	if err != nil {
+		t.Fatalf("TestRegisterCompressionAlgorithm() Downsync() %v != %v", err, nil)
+	}
+	if compression.decompressCount == 0 {
+		t.Errorf("TestRegisterCompressionAlgorithm() decompressCount %d == %d", compression.decompressCount, 0)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(targetPath, "folder", "b.txt"))
+	if err != nil || string(content) != "second file" {
+		t.Errorf("TestRegisterCompressionAlgorithm() folder/b.txt `%s`, %v", string(content), err)
+	}
+}
+
+func signTestJWT(t *testing.T, algorithm string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "ES256":
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			t.Fatalf("signTestJWT() ecdsa.Sign() %v != %v", err, nil)
+		}
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestRequireAgentAuth(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("TestRequireAgentAuth() ecdsa.GenerateKey() %v != %v", err, nil)
+	}
+	secret := []byte("the secret")
+	handler := RequireAgentAuth(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }),
+		&BearerTokenAuthenticator{Tokens: map[string]AgentCaller{
+			"reader": {Name: "ci", Access: AgentReadAccess},
+			"writer": {Name: "build", Access: AgentWriteAccess}}},
+		&JWTAuthenticator{Secret: secret, Audience: "agent"},
+		&JWTAuthenticator{PublicKey: &ecKey.PublicKey},
+		&ClientCertAuthenticator{Access: map[string]AgentAccess{"builder": AgentWriteAccess}, DefaultAccess: AgentReadAccess})
+
+	now := time.Now().Unix()
+	writeClaims := map[string]interface{}{"sub": "alice", "aud": []string{"agent"}, "exp": now + 60, "scope": "openid longtail:write"}
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"no credentials", http.MethodGet, "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "guess", http.StatusUnauthorized},
+		{"read token get", http.MethodGet, "reader", http.StatusOK},
+		{"read token post", http.MethodPost, "reader", http.StatusForbidden},
+		{"write token post", http.MethodPost, "writer", http.StatusOK},
+		{"jwt write", http.MethodDelete, signTestJWT(t, "HS256", secret, writeClaims), http.StatusOK},
+		{"jwt read", http.MethodPost, signTestJWT(t, "HS256", secret, map[string]interface{}{"sub": "bob", "aud": "agent", "scp": []string{"longtail:read"}}), http.StatusForbidden},
+		{"jwt wrong audience", http.MethodGet, signTestJWT(t, "HS256", secret, map[string]interface{}{"aud": "other", "scope": "longtail:read"}), http.StatusUnauthorized},
+		{"jwt expired", http.MethodGet, signTestJWT(t, "HS256", secret, map[string]interface{}{"aud": "agent", "exp": now - 60, "scope": "longtail:read"}), http.StatusUnauthorized},
+		{"jwt bad signature", http.MethodGet, signTestJWT(t, "HS256", []byte("other secret"), writeClaims), http.StatusUnauthorized},
+		{"jwt es256", http.MethodPost, signTestJWT(t, "ES256", ecKey, map[string]interface{}{"sub": "carol", "scope": "longtail:write"}), http.StatusOK},
+		{"jwt none", http.MethodGet, signTestJWT(t, "none", nil, writeClaims), http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/syncs", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("TestRequireAgentAuth() %s %d != %d: %s", test.name, w.Code, test.status, w.Body.String())
+		}
+	}
+
+	for name, status := range map[string]int{"builder": http.StatusOK, "tester": http.StatusForbidden} {
+		r := httptest.NewRequest(http.MethodPost, "/syncs", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: name}}}}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("TestRequireAgentAuth() client certificate %s %d != %d", name, w.Code, status)
+		}
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client, baseURL, err := NewAuthenticatedAgentHTTPClient(strings.TrimPrefix(server.URL, "http://"), AgentClientOptions{Token: "writer"})
+	if err != nil {
+		t.Fatalf("TestRequireAgentAuth() NewAuthenticatedAgentHTTPClient() %v != %v", err, nil)
+	}
+	resp, err := client.Post(baseURL+"/syncs", "application/json", strings.NewReader("{}"))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("TestRequireAgentAuth() client POST /syncs %v, %v", err, resp)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	root, _ := ioutil.TempDir("", "longtailapi")
+	defer os.RemoveAll(root)
+	tokenPath := filepath.Join(root, "tokens")
+	ioutil.WriteFile(tokenPath, []byte("# token access name\nabc read ci\n\ndef write\n"), 0600)
+	tokens, err := ReadBearerTokens(tokenPath)
+	if err != nil || len(tokens) != 2 || tokens["abc"] != (AgentCaller{Name: "ci", Access: AgentReadAccess}) || tokens["def"].Access != AgentWriteAccess {
+		t.Errorf("TestRequireAgentAuth() ReadBearerTokens() %v, %+v", err, tokens)
+	}
+	if !IsLoopbackAddress("127.0.0.1:7890") || !IsLoopbackAddress("unix:/run/longtail.sock") || IsLoopbackAddress("0.0.0.0:7890") {
+		t.Errorf("TestRequireAgentAuth() IsLoopbackAddress()")
+	}
+}
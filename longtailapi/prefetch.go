@@ -0,0 +1,182 @@
+package longtailapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// PrefetchOptions describes versions whose blocks are downloaded to a cache folder so a later
+// Downsync with the same CachePath does not need to read from the store
+type PrefetchOptions struct {
+	StoreSettings
+	StorageURI string
+	// SourcePaths are the paths of the version indexes to prefetch
+	SourcePaths []string
+	CachePath   string
+	// CachePin is an optional name that the blocks of the versions are pinned under in the cache
+	// once they are prefetched, see PinCacheBlocks
+	CachePin string
+	// VersionLocalStoreIndexPath is an optional store index written by Upsync that avoids reading the full store index
+	VersionLocalStoreIndexPath string
+	Progress                   ProgressFunc
+}
+
+// PrefetchResult describes the blocks of the prefetched versions
+type PrefetchResult struct {
+	BlockCount uint32
+	// DownloadedBlockCount is the number of blocks that were not already in the cache
+	DownloadedBlockCount uint32
+	StoreStats           []StoreStat
+	TimeStats            []TimeStat
+}
+
+// prefetchRequests tracks the block requests of a prefetch, requests holds a slot for each request in flight
+type prefetchRequests struct {
+	wg       sync.WaitGroup
+	requests chan struct{}
+	errLock  sync.Mutex
+	err      error
+}
+
+type prefetchGetStoredBlockCompletionAPI struct {
+	r *prefetchRequests
+}
+
+func (a *prefetchGetStoredBlockCompletionAPI) OnComplete(storedBlock longtaillib.Longtail_StoredBlock, errno int) {
+	storedBlock.Dispose()
+	r := a.r
+	if errno != 0 {
+		r.errLock.Lock()
+		if r.err == nil {
+			r.err = longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
+		}
+		r.errLock.Unlock()
+	}
+	<-r.requests
+	r.wg.Done()
+}
+
+// Prefetch downloads the blocks needed by the versions to the cache folder without writing any
+// files. Cancelling ctx stops the prefetch and flushes the blocks downloaded so far to the cache.
+func Prefetch(ctx context.Context, opts PrefetchOptions) (PrefetchResult, error) {
+	result := PrefetchResult{}
+
+	readSourceStartTime := time.Now()
+	chunkHashSet := map[uint64]bool{}
+	err := getVersionChunkHashes(opts.SourcePaths, chunkHashSet, opts.StoreOptions)
+	if err != nil {
+		return result, err
+	}
+	chunkHashes := make([]uint64, 0, len(chunkHashSet))
+	for chunkHash := range chunkHashSet {
+		chunkHashes = append(chunkHashes, chunkHash)
+	}
+	readSourceTime := time.Since(readSourceStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Read source index", readSourceTime})
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(opts.workerCount()), 0)
+	defer jobs.Dispose()
+
+	remoteIndexStore, err := CreateBlockStoreForURI(opts.StorageURI, opts.VersionLocalStoreIndexPath, jobs, opts.StoreSettings, 8388608, 1024, longtailstorelib.ReadOnly)
+	if err != nil {
+		return result, err
+	}
+	defer remoteIndexStore.Dispose()
+
+	cache, err := openLocalCache(NormalizePath(opts.CachePath))
+	if err != nil {
+		return result, err
+	}
+	defer cache.close(0)
+
+	localFS := longtaillib.CreateFSStorageAPI()
+	defer localFS.Dispose()
+	localIndexStore := longtaillib.CreateFSBlockStore(jobs, localFS, NormalizePath(opts.CachePath), 8388608, 1024)
+	defer localIndexStore.Dispose()
+	cacheUsageStore := longtaillib.CreateBlockStoreAPI(&cacheUsageStore{backingStore: localIndexStore, cache: cache})
+	defer cacheUsageStore.Dispose()
+	cacheBlockStore := longtaillib.CreateCacheBlockStore(jobs, cacheUsageStore, remoteIndexStore)
+	defer cacheBlockStore.Dispose()
+	// Chunks that are already in cached blocks are not prefetched again
+	cacheIndexStore := longtaillib.CreateBlockStoreAPI(longtailstorelib.NewCacheIndexBlockStore(cacheUsageStore, remoteIndexStore, cacheBlockStore, opts.StaleCachePolicy))
+	defer cacheIndexStore.Dispose()
+
+	getExistingContentStartTime := time.Now()
+	storeIndex, errno := GetExistingStoreIndexSync(cacheIndexStore, chunkHashes, 0)
+	if errno != 0 {
+		return result, errors.Wrap(longtaillib.NewError(errno, "GetExistingContent", "", longtailstorelib.RedactStoreURI(opts.StorageURI)), "Prefetch")
+	}
+	storedChunkHashes := map[uint64]bool{}
+	for _, chunkHash := range storeIndex.GetChunkHashes() {
+		storedChunkHashes[chunkHash] = true
+	}
+	blockHashes := append([]uint64{}, storeIndex.GetBlockHashes()...)
+	storeIndex.Dispose()
+	missingChunkCount := 0
+	for _, chunkHash := range chunkHashes {
+		if !storedChunkHashes[chunkHash] {
+			missingChunkCount++
+		}
+	}
+	if missingChunkCount > 0 {
+		return result, errors.Wrapf(longtaillib.ErrENOENT, "Prefetch: %d chunks of the versions are missing in `%s`", missingChunkCount, longtailstorelib.RedactStoreURI(opts.StorageURI))
+	}
+	result.BlockCount = uint32(len(blockHashes))
+	getExistingContentTime := time.Since(getExistingContentStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Get content index", getExistingContentTime})
+
+	prefetchStartTime := time.Now()
+	// Limit the requests in flight so the fetched blocks are not all held in memory at once
+	r := &prefetchRequests{requests: make(chan struct{}, opts.workerCount()*2)}
+	for i, blockHash := range blockHashes {
+		if ctx.Err() != nil {
+			break
+		}
+		r.requests <- struct{}{}
+		r.wg.Add(1)
+		completion := &prefetchGetStoredBlockCompletionAPI{r: r}
+		errno := cacheBlockStore.GetStoredBlock(blockHash, longtaillib.CreateAsyncGetStoredBlockAPI(completion))
+		if errno != 0 {
+			completion.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
+		}
+		if opts.Progress != nil {
+			opts.Progress("Prefetching blocks", uint32(len(blockHashes)), uint32(i+1))
+		}
+	}
+	r.wg.Wait()
+
+	stores := []longtaillib.Longtail_BlockStoreAPI{cacheBlockStore, localIndexStore, remoteIndexStore}
+	storeNames := []string{"Cache", "Local", "Remote"}
+	flushErr := flushStores(stores, storeNames)
+	if ctx.Err() != nil && opts.OnCancelFlushed != nil {
+		opts.OnCancelFlushed(flushErr)
+	}
+	result.StoreStats = getStoreStats(stores, storeNames)
+	if remoteStats, errno := remoteIndexStore.GetStats(); errno == 0 {
+		result.DownloadedBlockCount = uint32(remoteStats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Count])
+	}
+	prefetchTime := time.Since(prefetchStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Prefetch", prefetchTime})
+
+	if r.err != nil {
+		return result, errors.Wrapf(r.err, "Prefetch: failed to fetch blocks from `%s`", longtailstorelib.RedactStoreURI(opts.StorageURI))
+	}
+	if flushErr != nil {
+		return result, errors.Wrapf(flushErr, "Prefetch: failed to flush `%s`", opts.CachePath)
+	}
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if len(opts.CachePin) > 0 {
+		err = PinCacheBlocks(NormalizePath(opts.CachePath), opts.CachePin, blockHashes)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
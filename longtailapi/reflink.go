@@ -0,0 +1,164 @@
+package longtailapi
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// reflinkMinSize is the smallest duplicate that is cloned, smaller files are written as usual
+const reflinkMinSize = 65536
+
+// clonedAsset is a file of a version that is cloned from a file with the same content
+type clonedAsset struct {
+	path        string
+	sourcePath  string
+	permissions uint16
+}
+
+// findClonedAssets returns the files of the version that do not have to be written since a file
+// with the same content is already in the target or is written by the version
+func findClonedAssets(sourceVersionIndex longtaillib.Longtail_VersionIndex, targetVersionIndex longtaillib.Longtail_VersionIndex) []clonedAsset {
+	targetAssets := map[string]uint64{}
+	targetAssetHashes := targetVersionIndex.GetAssetHashes()
+	for a := uint32(0); a < targetVersionIndex.GetAssetCount(); a++ {
+		targetAssets[targetVersionIndex.GetAssetPath(a)] = targetAssetHashes[a]
+	}
+
+	assetHashes := sourceVersionIndex.GetAssetHashes()
+	assetSizes := sourceVersionIndex.GetAssetSizes()
+	contentPaths := map[uint64]string{}
+	for a := uint32(0); a < sourceVersionIndex.GetAssetCount(); a++ {
+		path := sourceVersionIndex.GetAssetPath(a)
+		if targetHash, exists := targetAssets[path]; exists && targetHash == assetHashes[a] && !isDirPath(path) {
+			contentPaths[assetHashes[a]] = path
+		}
+	}
+	clones := []clonedAsset{}
+	for a := uint32(0); a < sourceVersionIndex.GetAssetCount(); a++ {
+		path := sourceVersionIndex.GetAssetPath(a)
+		if isDirPath(path) || assetSizes[a] < reflinkMinSize {
+			continue
+		}
+		if targetHash, exists := targetAssets[path]; exists && targetHash == assetHashes[a] {
+			continue
+		}
+		sourcePath, exists := contentPaths[assetHashes[a]]
+		if !exists {
+			contentPaths[assetHashes[a]] = path
+			continue
+		}
+		clones = append(clones, clonedAsset{path, sourcePath, sourceVersionIndex.GetAssetPermissions(a)})
+	}
+	return clones
+}
+
+// clonedPaths returns the paths of the cloned files
+func clonedPaths(clones []clonedAsset) []string {
+	paths := make([]string, len(clones))
+	for i, clone := range clones {
+		paths[i] = clone.path
+	}
+	return paths
+}
+
+// withoutAssets returns a copy of versionIndex without the files in paths and the chunks that only
+// they use, a version index can not hold chunks that no file uses
+func withoutAssets(versionIndex longtaillib.Longtail_VersionIndex, paths []string) (longtaillib.Longtail_VersionIndex, error) {
+	removed := map[string]bool{}
+	for _, path := range paths {
+		removed[path] = true
+	}
+	doc := VersionIndexToJSON(versionIndex)
+	assets := doc.Assets[:0]
+	chunks := []VersionIndexChunkJSON{}
+	chunkIndexes := map[uint32]uint32{}
+	for _, asset := range doc.Assets {
+		if removed[asset.Path] {
+			continue
+		}
+		assetChunks := make([]uint32, len(asset.Chunks))
+		for i, chunk := range asset.Chunks {
+			index, exists := chunkIndexes[chunk]
+			if !exists {
+				index = uint32(len(chunks))
+				chunkIndexes[chunk] = index
+				chunks = append(chunks, doc.Chunks[chunk])
+			}
+			assetChunks[i] = index
+		}
+		asset.Chunks = assetChunks
+		assets = append(assets, asset)
+	}
+	doc.Assets = assets
+	doc.Chunks = chunks
+	return VersionIndexFromJSON(doc)
+}
+
+// reflinkSupported checks if files in folder can be cloned by cloning a probe file
+func reflinkSupported(folder string) bool {
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return false
+	}
+	probe, err := ioutil.TempFile(folder, ".longtail-reflink-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(probe.Name())
+	_, err = probe.Write(make([]byte, 4096))
+	probe.Close()
+	if err != nil {
+		return false
+	}
+	clonePath := probe.Name() + ".clone"
+	err = reflinkFile(probe.Name(), clonePath)
+	if err != nil {
+		return false
+	}
+	os.Remove(clonePath)
+	return true
+}
+
+// copyFile is the fallback of cloneAssets for files that can not be cloned
+func copyFile(sourcePath string, targetPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(target, source)
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// cloneAssets clones the files that were left out when the version was written from the files
+// with the same content
+func cloneAssets(targetFolderPath string, clones []clonedAsset, retainPermissions bool) error {
+	for _, clone := range clones {
+		sourcePath := filepath.Join(targetFolderPath, filepath.FromSlash(clone.sourcePath))
+		targetPath := filepath.Join(targetFolderPath, filepath.FromSlash(clone.path))
+		err := reflinkFile(sourcePath, targetPath)
+		if err != nil {
+			err = copyFile(sourcePath, targetPath)
+		}
+		if err == nil && retainPermissions {
+			err = os.Chmod(targetPath, os.FileMode(clone.permissions)&os.ModePerm)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Downsync: failed to clone `%s` from `%s`", targetPath, sourcePath)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package longtailapi
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflinkFile clones sourcePath to targetPath with clonefile, APFS shares the extents of the files
+func reflinkFile(sourcePath string, targetPath string) error {
+	source, err := unix.BytePtrFromString(sourcePath)
+	if err != nil {
+		return err
+	}
+	target, err := unix.BytePtrFromString(targetPath)
+	if err != nil {
+		return err
+	}
+	cwd := unix.AT_FDCWD
+	_, _, errno := unix.Syscall6(unix.SYS_CLONEFILEAT, uintptr(cwd), uintptr(unsafe.Pointer(source)), uintptr(cwd), uintptr(unsafe.Pointer(target)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
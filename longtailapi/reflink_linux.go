@@ -0,0 +1,37 @@
+package longtailapi
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ficlone is the FICLONE ioctl that shares the extents of a file on btrfs and XFS
+const ficlone = 0x40049409
+
+// reflinkFile clones sourcePath to the new file targetPath, the files share their extents until one of them is written
+func reflinkFile(sourcePath string, targetPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, target.Fd(), ficlone, source.Fd())
+	err = target.Close()
+	if errno != 0 {
+		os.Remove(targetPath)
+		return errno
+	}
+	if err != nil {
+		os.Remove(targetPath)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package longtailapi
+
+import "errors"
+
+func reflinkFile(sourcePath string, targetPath string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,93 @@
+package longtailapi
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	fsctlGetIntegrityInformation = 0x9027c
+	fsctlDuplicateExtentsToFile  = 0x98344
+	// duplicateExtentsMaxSize keeps each request well below the 4 GB limit of ReFS
+	duplicateExtentsMaxSize = 1 << 30
+)
+
+type fsctlGetIntegrityInformationBuffer struct {
+	ChecksumAlgorithm        uint16
+	Reserved                 uint16
+	Flags                    uint32
+	ChecksumChunkSizeInBytes uint32
+	ClusterSizeInBytes       uint32
+}
+
+type duplicateExtentsData struct {
+	FileHandle       windows.Handle
+	SourceFileOffset int64
+	TargetFileOffset int64
+	ByteCount        int64
+}
+
+// reflinkFile clones sourcePath to the new file targetPath with ReFS block cloning, the files share
+// their clusters until one of them is written
+func reflinkFile(sourcePath string, targetPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	// Only ReFS answers this, it also gives the cluster size the clone requests are aligned to
+	var integrity fsctlGetIntegrityInformationBuffer
+	var returned uint32
+	err = windows.DeviceIoControl(windows.Handle(source.Fd()), fsctlGetIntegrityInformation, nil, 0, (*byte)(unsafe.Pointer(&integrity)), uint32(unsafe.Sizeof(integrity)), &returned, nil)
+	if err != nil {
+		return err
+	}
+	target, err := os.OpenFile(targetPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = cloneExtents(source, target, uint64(info.Size()), uint64(integrity.ClusterSizeInBytes))
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(targetPath)
+	}
+	return err
+}
+
+func cloneExtents(source *os.File, target *os.File, size uint64, clusterSize uint64) error {
+	err := target.Truncate(int64(size))
+	if err != nil {
+		return err
+	}
+	if clusterSize == 0 {
+		clusterSize = 4096
+	}
+	for offset := uint64(0); offset < size; offset += duplicateExtentsMaxSize {
+		count := size - offset
+		if count > duplicateExtentsMaxSize {
+			count = duplicateExtentsMaxSize
+		}
+		// The last request is rounded up to a whole cluster, it ends at the end of the file
+		count = (count + clusterSize - 1) / clusterSize * clusterSize
+		data := duplicateExtentsData{
+			FileHandle:       windows.Handle(source.Fd()),
+			SourceFileOffset: int64(offset),
+			TargetFileOffset: int64(offset),
+			ByteCount:        int64(count)}
+		var returned uint32
+		err = windows.DeviceIoControl(windows.Handle(target.Fd()), fsctlDuplicateExtentsToFile, (*byte)(unsafe.Pointer(&data)), uint32(unsafe.Sizeof(data)), nil, 0, &returned, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package longtailapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// ReleaseVersionOptions is a version of a release, the TargetPath of Options is where its version
+// index is published
+type ReleaseVersionOptions struct {
+	Name    string
+	Options UpsyncOptions
+}
+
+// PublishReleaseOptions configures PublishRelease
+type PublishReleaseOptions struct {
+	StoreSettings
+	StorageURI string
+	// Name of the release, a store can only have one release with a name
+	Name     string
+	Tags     []string
+	Versions []ReleaseVersionOptions
+	Hooks    SyncHooks
+}
+
+// PublishReleaseResult describes a published release
+type PublishReleaseResult struct {
+	Release  longtailstorelib.Release
+	Versions []UpsyncResult
+}
+
+// PublishRelease uploads the versions of a release and publishes them together, either all
+// version indexes and their tags become visible in the version manifest of the store or none do.
+// The version indexes are uploaded next to their TargetPath, see longtailstorelib.ReleaseVersionPath,
+// and deleted again if an upload fails. The Release of the result has the paths they are read from. The StorageURI and StoreSettings of the release are
+// used for all versions and the hooks of the release run once before and after all uploads.
+func PublishRelease(ctx context.Context, opts PublishReleaseOptions) (PublishReleaseResult, error) {
+	result := PublishReleaseResult{Release: longtailstorelib.Release{Name: opts.Name, Tags: opts.Tags}}
+	if len(opts.Versions) == 0 {
+		return result, errors.Errorf("PublishRelease: release `%s` has no versions", opts.Name)
+	}
+	storageURI, uriOptions, err := longtailstorelib.ParseStoreURI(opts.StorageURI)
+	if err != nil {
+		return result, errors.Wrap(err, "PublishRelease")
+	}
+	storeOptions := append(append([]longtailstorelib.StoreOption{}, opts.StoreOptions...), uriOptions...)
+	blobStore, err := longtailstorelib.CreateBlobStoreForURI(storageURI, storeOptions...)
+	if err != nil {
+		return result, errors.Wrap(err, "PublishRelease")
+	}
+	// Fail before anything is uploaded rather than when the release is committed
+	_, exists, err := longtailstorelib.ReadRelease(ctx, blobStore, opts.Name)
+	if err != nil {
+		return result, errors.Wrap(err, "PublishRelease")
+	}
+	if exists {
+		return result, errors.Wrapf(longtailstorelib.ErrReleaseExists, "PublishRelease: `%s`", opts.Name)
+	}
+
+	startTime := time.Now()
+	payload := HookPayload{Event: HookPreUpsync, StorageURI: longtailstorelib.RedactStoreURI(opts.StorageURI)}
+	for _, version := range opts.Versions {
+		payload.Versions = append(payload.Versions, HookVersion{SourcePath: version.Options.SourcePath, TargetPath: longtailstorelib.ReleaseVersionPath(version.Options.TargetPath, opts.Name)})
+		result.Release.Versions = append(result.Release.Versions, longtailstorelib.ReleaseVersion{Name: version.Name, Path: version.Options.TargetPath})
+	}
+	err = opts.Hooks.runPre(ctx, payload)
+	if err != nil {
+		return result, errors.Wrap(err, "PublishRelease")
+	}
+	err = publishRelease(ctx, opts, blobStore, storeOptions, &result)
+	payload.Event = HookPostUpsync
+	stats := &HookStats{DurationSeconds: time.Since(startTime).Seconds()}
+	for i, versionResult := range result.Versions {
+		payload.Versions[i].VersionHash = versionResult.VersionHash
+		stats.AssetCount += versionResult.AssetCount
+		stats.ChunkCount += versionResult.ChunkCount
+		stats.UploadedBlockCount += versionResult.UploadedBlockCount
+		stats.UploadedChunkCount += versionResult.UploadedChunkCount
+	}
+	payload.Stats = stats
+	opts.Hooks.runPost(payload, err)
+	return result, err
+}
+
+func publishRelease(
+	ctx context.Context,
+	opts PublishReleaseOptions,
+	blobStore longtailstorelib.BlobStore,
+	storeOptions []longtailstorelib.StoreOption,
+	result *PublishReleaseResult) error {
+	for _, version := range opts.Versions {
+		upsyncOptions := version.Options
+		upsyncOptions.StoreSettings = opts.StoreSettings
+		upsyncOptions.StorageURI = opts.StorageURI
+		upsyncOptions.TargetPath = longtailstorelib.ReleaseVersionPath(version.Options.TargetPath, opts.Name)
+		versionResult, err := upsync(ctx, upsyncOptions)
+		if err != nil {
+			longtailstorelib.DeleteStagedRelease(context.Background(), result.Release, storeOptions...)
+			return errors.Wrapf(err, "PublishRelease: version `%s`", version.Name)
+		}
+		result.Versions = append(result.Versions, versionResult)
+	}
+	err := longtailstorelib.PublishStagedRelease(ctx, blobStore, result.Release, storeOptions...)
+	if err != nil {
+		// A release with the name that was published meanwhile has its version indexes at the same paths
+		if !errors.Is(err, longtailstorelib.ErrReleaseExists) {
+			longtailstorelib.DeleteStagedRelease(context.Background(), result.Release, storeOptions...)
+		}
+		return errors.Wrap(err, "PublishRelease")
+	}
+	release, _, err := longtailstorelib.ReadRelease(ctx, blobStore, opts.Name)
+	if err != nil {
+		return errors.Wrap(err, "PublishRelease")
+	}
+	result.Release = release
+	return nil
+}
@@ -0,0 +1,146 @@
+package longtailapi
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// The defaults of RestoreRetryPolicy
+const (
+	DefaultRestoreAttempts = 3
+	DefaultRestoreBackoff  = 5 * time.Second
+)
+
+// RestoreRetryPolicy is when and how often RestoreWithRetry runs a failed restore again
+type RestoreRetryPolicy struct {
+	// MaxAttempts is the number of times the restore is run, DefaultRestoreAttempts if zero
+	MaxAttempts int
+	// Backoff is the wait before the first retry, it doubles for each retry after it,
+	// DefaultRestoreBackoff if zero
+	Backoff time.Duration
+	// IsTransient tells the errors that are retried, IsTransientRestoreError if nil
+	IsTransient func(err error) bool
+	// OnRetry is called with the failed attempt, counted from 1, and its error before the restore
+	// is run again
+	OnRetry func(attempt int, err error)
+}
+
+// IsTransientRestoreError returns true if a restore that failed with err may succeed if it is run
+// again, such as when a block read failed with an I/O error or a store was busy. Missing, corrupt
+// and archived blocks, quotas, permissions, full disks and cancellation are not transient.
+func IsTransientRestoreError(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if cause == context.Canceled || cause == context.DeadlineExceeded {
+		return false
+	}
+	var blocksMissingErr *longtailstorelib.BlocksMissingError
+	var blockCorruptErr *longtailstorelib.BlockCorruptError
+	var blockArchivedErr *longtailstorelib.BlockArchivedError
+	var storeIndexCorruptErr *longtailstorelib.StoreIndexCorruptError
+	var quotaExceededErr *longtailstorelib.QuotaExceededError
+	var regionNotAllowedErr *longtailstorelib.RegionNotAllowedError
+	if errors.As(err, &blocksMissingErr) || errors.As(err, &blockCorruptErr) || errors.As(err, &blockArchivedErr) ||
+		errors.As(err, &storeIndexCorruptErr) || errors.As(err, &quotaExceededErr) || errors.As(err, &regionNotAllowedErr) {
+		return false
+	}
+	if errors.Is(err, longtailstorelib.ErrInjectedFault) || errors.Is(err, longtailstorelib.ErrFlushTimeout) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return errors.Is(err, longtaillib.ErrEIO) ||
+		errors.Is(err, longtaillib.ErrEBUSY) ||
+		errors.Is(err, longtaillib.ErrEAGAIN) ||
+		errors.Is(err, longtaillib.ErrEINTR)
+}
+
+// RestoreWithRetry updates the targets like Downsync, but when the downsync fails with a transient
+// error it is run again, up to MaxAttempts times, instead of failing on the first network blip.
+// Each retry resumes from the checkpoint of the session state at SessionStatePath, a temporary
+// session state if it is not set: the targets that were updated are skipped and the other targets
+// are scanned again, as the failed attempt may have written some of their files, so only the
+// content that is still missing is downloaded. The existing content of the store is looked up
+// again on every attempt. The hooks of opts run once, before the first and after the last attempt.
+func RestoreWithRetry(ctx context.Context, opts DownsyncOptions, policy RestoreRetryPolicy) (DownsyncResult, error) {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRestoreAttempts
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = DefaultRestoreBackoff
+	}
+	if policy.IsTransient == nil {
+		policy.IsTransient = IsTransientRestoreError
+	}
+	return downsyncWithHooks(ctx, opts, func(ctx context.Context, opts DownsyncOptions) (DownsyncResult, error) {
+		if len(opts.SessionStatePath) == 0 && policy.MaxAttempts > 1 {
+			sessionDir, err := ioutil.TempDir("", "longtail_restore")
+			if err != nil {
+				return DownsyncResult{}, errors.Wrap(err, "RestoreWithRetry")
+			}
+			defer os.RemoveAll(sessionDir)
+			opts.SessionStatePath = filepath.Join(sessionDir, "session.json")
+		}
+		return restoreWithRetry(ctx, opts, policy)
+	})
+}
+
+func restoreWithRetry(ctx context.Context, opts DownsyncOptions, policy RestoreRetryPolicy) (DownsyncResult, error) {
+	result := DownsyncResult{}
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		attemptStartTime := time.Now()
+		attemptResult, err := downsync(ctx, opts)
+		result.LinkedFileCount += attemptResult.LinkedFileCount
+		result.LinkedSize += attemptResult.LinkedSize
+		result.VersionHashes = attemptResult.VersionHashes
+		result.StoreStats = attemptResult.StoreStats
+		result.TimeStats = append(result.TimeStats, attemptResult.TimeStats...)
+		result.Attempts = attempt
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !policy.IsTransient(err) {
+			return result, err
+		}
+		result.TimeStats = append(result.TimeStats, TimeStat{fmt.Sprintf("Failed attempt %d", attempt), time.Since(attemptStartTime)})
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt, err)
+		} else {
+			log.Printf("Restore attempt %d of %d failed, retrying in %s: %v\n", attempt, policy.MaxAttempts, backoff, err)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return result, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+
+		// The failed attempt may have changed the targets, they are scanned again instead of
+		// trusting the recorded index and their base files are already linked
+		retryTargets := make([]DownsyncTarget, len(opts.Targets))
+		for i, target := range opts.Targets {
+			retryTargets[i] = target
+			if !target.Image {
+				retryTargets[i].TargetIndexPath = ""
+				retryTargets[i].BasePath = ""
+				retryTargets[i].BaseIndexPath = ""
+			}
+		}
+		opts.Targets = retryTargets
+	}
+}
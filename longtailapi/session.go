@@ -0,0 +1,100 @@
+package longtailapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// downsyncCheckpoint is the restore checkpoint that Downsync keeps in the session state, it is
+// only kept while a downsync has not completed
+type downsyncCheckpoint struct {
+	CompletedTargets []completedTarget `json:"completedTargets,omitempty"`
+}
+
+// completedTarget is a target that was updated to the version with SourceHash
+type completedTarget struct {
+	TargetPath string `json:"targetPath"`
+	SourcePath string `json:"sourcePath"`
+	SourceHash string `json:"sourceHash"`
+}
+
+func getSourceHash(versionIndexData []byte) string {
+	hash := sha256.Sum256(versionIndexData)
+	return hex.EncodeToString(hash[:])
+}
+
+// readDownsyncSession reads the session state at path, a session state that is missing or can not
+// be read starts a new session
+func readDownsyncSession(path string, opts []longtailstorelib.StoreOption) (longtailstorelib.SessionState, downsyncCheckpoint) {
+	checkpoint := downsyncCheckpoint{}
+	state, err := longtailstorelib.ReadSessionState(path, opts...)
+	if err != nil {
+		if !os.IsNotExist(errors.Cause(err)) && errors.Cause(err) != longtaillib.ErrENOENT {
+			log.Printf("WARNING: Failed to read session state `%s`, starting a new session: %v\n", path, err)
+		}
+		return longtailstorelib.SessionState{}, checkpoint
+	}
+	if len(state.Checkpoint) > 0 {
+		err = json.Unmarshal(state.Checkpoint, &checkpoint)
+		if err != nil {
+			log.Printf("WARNING: Failed to read the checkpoint of session state `%s`: %v\n", path, err)
+		}
+	}
+	return state, checkpoint
+}
+
+// skipCompletedTargets returns the targets that are not in checkpoint with the same version and
+// the completed targets that are skipped
+func skipCompletedTargets(targets []DownsyncTarget, checkpoint downsyncCheckpoint, opts []longtailstorelib.StoreOption) ([]DownsyncTarget, []completedTarget, error) {
+	remaining := []DownsyncTarget{}
+	skipped := []completedTarget{}
+	for _, target := range targets {
+		completed := false
+		for _, completedTarget := range checkpoint.CompletedTargets {
+			if completedTarget.TargetPath != target.TargetPath || completedTarget.SourcePath != target.SourcePath {
+				continue
+			}
+			vbuffer, err := longtailstorelib.ReadFromURI(target.SourcePath, opts...)
+			if err != nil {
+				return nil, nil, err
+			}
+			if getSourceHash(vbuffer) == completedTarget.SourceHash {
+				skipped = append(skipped, completedTarget)
+				completed = true
+			}
+			break
+		}
+		if completed {
+			log.Printf("Skipping `%s`, it was updated by the interrupted downsync\n", target.TargetPath)
+			continue
+		}
+		remaining = append(remaining, target)
+	}
+	return remaining, skipped, nil
+}
+
+// writeDownsyncSession exports the session of the remote store with checkpoint to path, the
+// store index of the session is written next to it
+func writeDownsyncSession(path string, exporter longtailstorelib.SessionStateExporter, checkpoint downsyncCheckpoint, opts []longtailstorelib.StoreOption) {
+	state := longtailstorelib.SessionState{}
+	var err error
+	if exporter != nil {
+		state, err = exporter.ExportSessionState(path + ".lsi")
+	}
+	if err == nil && len(checkpoint.CompletedTargets) > 0 {
+		state.Checkpoint, err = json.Marshal(checkpoint)
+	}
+	if err == nil {
+		err = longtailstorelib.WriteSessionState(path, state, opts...)
+	}
+	if err != nil {
+		log.Printf("WARNING: Failed to write session state `%s`: %v\n", path, err)
+	}
+}
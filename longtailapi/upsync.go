@@ -0,0 +1,318 @@
+package longtailapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib"
+	"github.com/pkg/errors"
+)
+
+// UpsyncOptions describes a folder to upload to a store, see DefaultUpsyncOptions for the defaults of the CLI
+type UpsyncOptions struct {
+	StoreSettings
+	StorageURI string
+	SourcePath string
+	// SourceIndexPath is an optional pre-computed version index of SourcePath
+	SourceIndexPath string
+	// TargetPath is where the version index is written
+	TargetPath           string
+	TargetChunkSize      uint32
+	TargetBlockSize      uint32
+	MaxChunksPerBlock    uint32
+	CompressionAlgorithm string
+	HashAlgorithm        string
+	// IncludeFilterRegEx and ExcludeFilterRegEx are optional regexes separated with **
+	IncludeFilterRegEx   string
+	ExcludeFilterRegEx   string
+	MinBlockUsagePercent uint32
+	// VersionLocalStoreIndexPath is an optional path to write a store index with only the blocks of the version to
+	VersionLocalStoreIndexPath string
+	BlockPacking               longtailstorelib.PackingStrategy
+	// DeterministicBlocks packs the blocks of the version the same way regardless of the store content
+	// so identical sources always give identical blocks, see longtailstorelib.CreateDeterministicContent
+	DeterministicBlocks bool
+	// SourceStream is an optional stream, such as the standard input of a pipe, that is uploaded as a
+	// version with a single file named SourceStreamName instead of the files of SourcePath
+	SourceStream     io.Reader
+	SourceStreamName string
+	Hooks            SyncHooks
+	Progress         ProgressFunc
+}
+
+// DefaultUpsyncOptions returns the options of the upsync command without paths
+func DefaultUpsyncOptions() UpsyncOptions {
+	return UpsyncOptions{
+		TargetChunkSize:      32768,
+		TargetBlockSize:      8388608,
+		MaxChunksPerBlock:    1024,
+		CompressionAlgorithm: "zstd",
+		HashAlgorithm:        "blake3",
+		MinBlockUsagePercent: 80,
+		BlockPacking:         longtailstorelib.DefaultPacking}
+}
+
+// UpsyncResult describes an uploaded version
+type UpsyncResult struct {
+	AssetCount uint32
+	ChunkCount uint32
+	// UploadedBlockCount and UploadedChunkCount count the blocks and chunks that were missing in the store
+	UploadedBlockCount uint32
+	UploadedChunkCount uint32
+	// VersionHash is the SHA-256 of the written version index
+	VersionHash string
+	StoreStats  []StoreStat
+	TimeStats   []TimeStat
+}
+
+// Upsync indexes the source folder, uploads the chunks that are missing in the store and writes
+// the version index. Cancelling ctx flushes the blocks written so far to the store and stops the
+// upsync between its phases, a phase that has started runs to completion. The hooks of opts run
+// before and after the upsync.
+func Upsync(ctx context.Context, opts UpsyncOptions) (UpsyncResult, error) {
+	startTime := time.Now()
+	payload := HookPayload{
+		Event:      HookPreUpsync,
+		StorageURI: longtailstorelib.RedactStoreURI(opts.StorageURI),
+		Versions:   []HookVersion{{SourcePath: opts.SourcePath, TargetPath: opts.TargetPath}}}
+	err := opts.Hooks.runPre(ctx, payload)
+	if err != nil {
+		return UpsyncResult{}, errors.Wrap(err, "Upsync")
+	}
+	result, err := upsync(ctx, opts)
+	payload.Event = HookPostUpsync
+	payload.Versions[0].VersionHash = result.VersionHash
+	payload.Stats = &HookStats{
+		DurationSeconds:    time.Since(startTime).Seconds(),
+		AssetCount:         result.AssetCount,
+		ChunkCount:         result.ChunkCount,
+		UploadedBlockCount: result.UploadedBlockCount,
+		UploadedChunkCount: result.UploadedChunkCount,
+		PhaseSeconds:       hookPhaseSeconds(result.TimeStats)}
+	opts.Hooks.runPost(payload, err)
+	return result, err
+}
+
+func upsync(ctx context.Context, opts UpsyncOptions) (UpsyncResult, error) {
+	result := UpsyncResult{}
+
+	setupStartTime := time.Now()
+	if opts.SourceStream != nil {
+		streamFolder, err := spoolSourceStream(opts.SourceStream, opts.SourceStreamName)
+		if err != nil {
+			return result, err
+		}
+		defer os.RemoveAll(streamFolder)
+		opts.SourcePath = streamFolder
+		opts.SourceIndexPath = ""
+	}
+	pathFilter, err := CreatePathFilter(opts.IncludeFilterRegEx, opts.ExcludeFilterRegEx)
+	if err != nil {
+		return result, err
+	}
+
+	fs := longtaillib.CreateFSStorageAPI()
+	defer fs.Dispose()
+
+	sourceFolderScanner := FolderScanner{}
+	if len(opts.SourceIndexPath) == 0 {
+		sourceFolderScanner.Scan(opts.SourcePath, pathFilter, fs)
+	}
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(opts.workerCount()), 0)
+	defer jobs.Dispose()
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+
+	compressionType, err := GetCompressionType(opts.CompressionAlgorithm)
+	if err != nil {
+		return result, err
+	}
+	hashIdentifier, err := GetHashIdentifier(opts.HashAlgorithm)
+	if err != nil {
+		return result, err
+	}
+
+	setupTime := time.Since(setupStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Setup", setupTime})
+
+	sourceIndexReader := VersionIndexReader{}
+	sourceIndexReader.Read(opts.SourcePath,
+		opts.SourceIndexPath,
+		opts.TargetChunkSize,
+		compressionType,
+		hashIdentifier,
+		fs,
+		jobs,
+		hashRegistry,
+		&sourceFolderScanner,
+		opts.Progress,
+		opts.StoreOptions)
+
+	remoteStore, err := CreateBlockStoreForURI(opts.StorageURI, "", jobs, opts.StoreSettings, opts.TargetBlockSize, opts.MaxChunksPerBlock, longtailstorelib.ReadWrite)
+	if err != nil {
+		vindex, _, _, _ := sourceIndexReader.Get()
+		vindex.Dispose()
+		return result, err
+	}
+	defer remoteStore.Dispose()
+
+	creg := longtaillib.CreateFullCompressionRegistry()
+	defer creg.Dispose()
+
+	indexStore := longtaillib.CreateCompressBlockStore(remoteStore, creg)
+	defer indexStore.Dispose()
+
+	stopFlushOnCancel := flushOnCancel(ctx, []longtaillib.Longtail_BlockStoreAPI{indexStore, remoteStore}, []string{"Compress", "Remote"}, opts.OnCancelFlushed)
+	defer stopFlushOnCancel()
+
+	vindex, hash, readSourceIndexTime, err := sourceIndexReader.Get()
+	if err != nil {
+		return result, err
+	}
+	defer vindex.Dispose()
+	result.TimeStats = append(result.TimeStats, TimeStat{"Read source index", readSourceIndexTime})
+	result.AssetCount = vindex.GetAssetCount()
+	result.ChunkCount = vindex.GetChunkCount()
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+
+	getMissingContentStartTime := time.Now()
+	existingRemoteStoreIndex, errno := GetExistingStoreIndexSync(indexStore, vindex.GetChunkHashes(), opts.MinBlockUsagePercent)
+	if errno != 0 {
+		return result, errors.Wrap(longtaillib.NewError(errno, "GetExistingContent", "", longtailstorelib.RedactStoreURI(opts.StorageURI)), "Upsync")
+	}
+	defer existingRemoteStoreIndex.Dispose()
+
+	createMissingContent := longtailstorelib.CreateMissingContentWithPacking
+	if opts.DeterministicBlocks {
+		createMissingContent = longtailstorelib.CreateDeterministicContent
+	}
+	versionMissingStoreIndex, err := createMissingContent(
+		hash,
+		existingRemoteStoreIndex,
+		vindex,
+		opts.TargetBlockSize,
+		opts.MaxChunksPerBlock,
+		opts.BlockPacking)
+	if err != nil {
+		return result, errors.Wrapf(err, "Upsync: failed to pack the missing content of %s", opts.SourcePath)
+	}
+	defer versionMissingStoreIndex.Dispose()
+	result.UploadedBlockCount = versionMissingStoreIndex.GetBlockCount()
+	result.UploadedChunkCount = versionMissingStoreIndex.GetChunkCount()
+
+	getMissingContentTime := time.Since(getMissingContentStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Get content index", getMissingContentTime})
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+
+	writeContentStartTime := time.Now()
+	if versionMissingStoreIndex.GetBlockCount() > 0 {
+		writeContentProgress := CreateProgress("Writing content blocks", opts.Progress)
+		defer writeContentProgress.Dispose()
+
+		errno = longtaillib.WriteContent(
+			fs,
+			indexStore,
+			jobs,
+			&writeContentProgress,
+			versionMissingStoreIndex,
+			vindex,
+			NormalizePath(opts.SourcePath))
+		if errno != 0 {
+			return result, errors.Wrap(longtaillib.NewError(errno, "WriteContent", opts.SourcePath, longtailstorelib.RedactStoreURI(opts.StorageURI)), "Upsync")
+		}
+	}
+	writeContentTime := time.Since(writeContentStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Write version content", writeContentTime})
+
+	flushStartTime := time.Now()
+	stores := []longtaillib.Longtail_BlockStoreAPI{indexStore, remoteStore}
+	storeNames := []string{"Compress", "Remote"}
+	err = flushStores(stores, storeNames)
+	if err != nil {
+		return result, errors.Wrapf(err, "Upsync: failed to flush `%s`", longtailstorelib.RedactStoreURI(opts.StorageURI))
+	}
+	flushTime := time.Since(flushStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Flush", flushTime})
+	result.StoreStats = getStoreStats(stores, storeNames)
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+
+	writeVersionIndexStartTime := time.Now()
+	vbuffer, errno := longtaillib.WriteVersionIndexToBuffer(vindex)
+	if errno != 0 {
+		return result, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "Upsync: longtaillib.WriteVersionIndexToBuffer() failed")
+	}
+
+	err = longtailstorelib.WriteToURI(opts.TargetPath, vbuffer, opts.StoreOptions...)
+	if err != nil {
+		return result, errors.Wrapf(err, "Upsync: longtailstorelib.WriteToURI() failed")
+	}
+	result.VersionHash = getSourceHash(vbuffer)
+	writeVersionIndexTime := time.Since(writeVersionIndexStartTime)
+	result.TimeStats = append(result.TimeStats, TimeStat{"Write version index", writeVersionIndexTime})
+
+	if len(opts.VersionLocalStoreIndexPath) > 0 {
+		writeVersionLocalStoreIndexStartTime := time.Now()
+		versionLocalStoreIndex, errno := longtaillib.MergeStoreIndex(existingRemoteStoreIndex, versionMissingStoreIndex)
+		if errno != 0 {
+			return result, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "Upsync: longtaillib.MergeStoreIndex() failed")
+		}
+		defer versionLocalStoreIndex.Dispose()
+		versionLocalStoreIndexBuffer, errno := longtaillib.WriteStoreIndexToBuffer(versionLocalStoreIndex)
+		if errno != 0 {
+			return result, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "Upsync: longtaillib.WriteStoreIndexToBuffer() failed")
+		}
+		err = longtailstorelib.WriteToURI(opts.VersionLocalStoreIndexPath, versionLocalStoreIndexBuffer, opts.StoreOptions...)
+		if err != nil {
+			return result, errors.Wrapf(err, "Upsync: longtailstorelib.WriteToURI() failed")
+		}
+		writeVersionLocalStoreIndexTime := time.Since(writeVersionLocalStoreIndexStartTime)
+		result.TimeStats = append(result.TimeStats, TimeStat{"Write version store index", writeVersionLocalStoreIndexTime})
+	}
+
+	return result, nil
+}
+
+// spoolSourceStream reads stream to its end into a file named name in a new temporary folder and
+// returns the folder. The content is chunked and read again when the blocks are written so a stream
+// that can only be read once has to be kept until the upsync is done.
+func spoolSourceStream(stream io.Reader, name string) (string, error) {
+	if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("Upsync: `%s` is not a valid file name for the source stream", name)
+	}
+	folder, err := ioutil.TempDir("", "longtail-stream")
+	if err != nil {
+		return "", errors.Wrap(err, "Upsync: failed to create a folder for the source stream")
+	}
+	path := filepath.Join(folder, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err == nil {
+		_, err = io.Copy(file, stream)
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		// The permissions end up in the version index, do not let the umask change them
+		err = os.Chmod(path, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(folder)
+		return "", errors.Wrapf(err, "Upsync: failed to read the source stream into `%s`", path)
+	}
+	return folder, nil
+}
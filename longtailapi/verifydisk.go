@@ -0,0 +1,119 @@
+package longtailapi
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// fileMatchesChunks reads the file at path and compares it to the chunks of an asset of versionIndex,
+// it stops at the first chunk that differs
+func fileMatchesChunks(path string, versionIndex longtaillib.Longtail_VersionIndex, asset uint32, hash longtaillib.Longtail_HashAPI) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if uint64(info.Size()) != versionIndex.GetAssetSize(asset) {
+		return false, nil
+	}
+	chunkHashes := versionIndex.GetChunkHashes()
+	chunkSizes := versionIndex.GetChunkSizes()
+	start := versionIndex.GetAssetChunkIndexStarts()[asset]
+	count := versionIndex.GetAssetChunkCounts()[asset]
+	var chunk []byte
+	for _, chunkIndex := range versionIndex.GetAssetChunkIndexes()[start : start+count] {
+		if int(chunkSizes[chunkIndex]) > cap(chunk) {
+			chunk = make([]byte, chunkSizes[chunkIndex])
+		}
+		chunk = chunk[:chunkSizes[chunkIndex]]
+		_, err = io.ReadFull(file, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		chunkHash, errno := hash.HashBuffer(chunk)
+		if errno != 0 {
+			return false, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "hash.HashBuffer() failed")
+		}
+		if chunkHash != chunkHashes[chunkIndex] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// verifyTargetFiles compares the files that the version keeps unchanged in the target to their
+// chunks in the recorded target index and returns the paths of the files that are missing or differ
+// on disk. The files are verified by workerCount workers.
+func verifyTargetFiles(
+	targetFolderPath string,
+	sourceVersionIndex longtaillib.Longtail_VersionIndex,
+	targetVersionIndex longtaillib.Longtail_VersionIndex,
+	hash longtaillib.Longtail_HashAPI,
+	workerCount int,
+	progress ProgressFunc,
+	progressSuffix string) ([]string, error) {
+	sourceAssets := map[string]uint64{}
+	sourceAssetHashes := sourceVersionIndex.GetAssetHashes()
+	for a := uint32(0); a < sourceVersionIndex.GetAssetCount(); a++ {
+		sourceAssets[sourceVersionIndex.GetAssetPath(a)] = sourceAssetHashes[a]
+	}
+	// Files that the version changes are written anyway
+	kept := []uint32{}
+	targetAssetHashes := targetVersionIndex.GetAssetHashes()
+	for a := uint32(0); a < targetVersionIndex.GetAssetCount(); a++ {
+		path := targetVersionIndex.GetAssetPath(a)
+		if sourceHash, exists := sourceAssets[path]; exists && sourceHash == targetAssetHashes[a] && !isDirPath(path) {
+			kept = append(kept, a)
+		}
+	}
+
+	var mutex sync.Mutex
+	changedPaths := []string{}
+	var firstErr error
+	done := uint32(0)
+	assets := make(chan uint32)
+	var wg sync.WaitGroup
+	for w := 0; w < workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range assets {
+				path := targetVersionIndex.GetAssetPath(a)
+				matches, err := fileMatchesChunks(filepath.Join(targetFolderPath, filepath.FromSlash(path)), targetVersionIndex, a, hash)
+				mutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = errors.Wrapf(err, "Downsync: failed to verify `%s` in `%s`", path, targetFolderPath)
+				}
+				if err == nil && !matches {
+					changedPaths = append(changedPaths, path)
+				}
+				done++
+				if progress != nil {
+					progress("Verifying target"+progressSuffix, uint32(len(kept)), done)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, a := range kept {
+		assets <- a
+	}
+	close(assets)
+	wg.Wait()
+	return changedPaths, firstErr
+}
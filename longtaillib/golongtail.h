@@ -116,6 +116,54 @@ static struct Longtail_ProgressAPI* CreateProgressProxyAPI(void* context)
         ProgressAPIProxy_OnProgress);
 }
 
+////////////// Longtail_CompressionAPI
+
+struct CompressionAPIProxy
+{
+    struct Longtail_CompressionAPI m_API;
+    void* m_Context;
+};
+
+static void* CompressionAPIProxy_GetContext(void* api) { return ((struct CompressionAPIProxy*)api)->m_Context; }
+void CompressionAPIProxy_Dispose(struct Longtail_API* api);
+size_t CompressionAPIProxy_GetMaxCompressedSize(struct Longtail_CompressionAPI* compression_api, uint32_t settings_id, size_t size);
+int CompressionAPIProxy_Compress(struct Longtail_CompressionAPI* compression_api, uint32_t settings_id, char* uncompressed, char* compressed, size_t uncompressed_size, size_t max_compressed_size, size_t* out_compressed_size);
+int CompressionAPIProxy_Decompress(struct Longtail_CompressionAPI* compression_api, char* compressed, char* uncompressed, size_t compressed_size, size_t max_uncompressed_size, size_t* out_uncompressed_size);
+
+static struct Longtail_CompressionAPI* CreateCompressionProxyAPI(void* context)
+{
+    struct CompressionAPIProxy* api = (struct CompressionAPIProxy*)Longtail_Alloc("CreateCompressionProxyAPI", sizeof(struct CompressionAPIProxy));
+    api->m_Context = context;
+    return Longtail_MakeCompressionAPI(
+        api,
+        CompressionAPIProxy_Dispose,
+        CompressionAPIProxy_GetMaxCompressedSize,
+        (Longtail_CompressionAPI_CompressFunc)CompressionAPIProxy_Compress,         // Constness cast
+        (Longtail_CompressionAPI_DecompressFunc)CompressionAPIProxy_Decompress);    // Constness cast
+}
+
+////////////// Longtail_CompressionRegistryAPI
+
+struct CompressionRegistryAPIProxy
+{
+    struct Longtail_CompressionRegistryAPI m_API;
+    void* m_Context;
+};
+
+static void* CompressionRegistryAPIProxy_GetContext(void* api) { return ((struct CompressionRegistryAPIProxy*)api)->m_Context; }
+void CompressionRegistryAPIProxy_Dispose(struct Longtail_API* api);
+int CompressionRegistryAPIProxy_GetCompressionAPI(struct Longtail_CompressionRegistryAPI* compression_registry, uint32_t compression_type, struct Longtail_CompressionAPI** out_compression_api, uint32_t* out_settings_id);
+
+static struct Longtail_CompressionRegistryAPI* CreateCompressionRegistryProxyAPI(void* context)
+{
+    struct CompressionRegistryAPIProxy* api = (struct CompressionRegistryAPIProxy*)Longtail_Alloc("CreateCompressionRegistryProxyAPI", sizeof(struct CompressionRegistryAPIProxy));
+    api->m_Context = context;
+    return Longtail_MakeCompressionRegistryAPI(
+        api,
+        CompressionRegistryAPIProxy_Dispose,
+        CompressionRegistryAPIProxy_GetCompressionAPI);
+}
+
 ////////////// Longtail_AsyncPutStoredBlockAPI
 
 struct AsyncPutStoredBlockAPIProxy
@@ -204,6 +252,72 @@ static struct Longtail_AsyncFlushAPI* CreateAsyncFlushAPI(void* context)
         AsyncFlushAPIProxy_OnComplete);
 }
 
+////////////// Shared Longtail_StoredBlock
+
+struct SharedStoredBlockRef
+{
+    struct Longtail_StoredBlock m_StoredBlock;
+    struct SharedStoredBlock* m_Shared;
+};
+
+struct SharedStoredBlock
+{
+    int32_t m_RefCount;
+    struct Longtail_StoredBlock* m_StoredBlock;
+    struct SharedStoredBlockRef m_Refs[1];
+};
+
+static int SharedStoredBlockRef_Dispose(struct Longtail_StoredBlock* stored_block)
+{
+    struct SharedStoredBlock* shared = ((struct SharedStoredBlockRef*)stored_block)->m_Shared;
+    if (__atomic_sub_fetch(&shared->m_RefCount, 1, __ATOMIC_ACQ_REL) == 0)
+    {
+        Longtail_StoredBlock_Dispose(shared->m_StoredBlock);
+        Longtail_Free(shared);
+    }
+    return 0;
+}
+
+// ShareStoredBlock makes ref_count stored blocks that reference the block index and data of stored_block,
+// stored_block is disposed when the last of them is disposed
+static int ShareStoredBlock(struct Longtail_StoredBlock* stored_block, uint32_t ref_count, struct Longtail_StoredBlock** out_refs)
+{
+    size_t size = sizeof(struct SharedStoredBlock) + sizeof(struct SharedStoredBlockRef) * (ref_count - 1);
+    struct SharedStoredBlock* shared = (struct SharedStoredBlock*)Longtail_Alloc("ShareStoredBlock", size);
+    if (shared == 0)
+    {
+        return ENOMEM;
+    }
+    shared->m_RefCount = (int32_t)ref_count;
+    shared->m_StoredBlock = stored_block;
+    for (uint32_t r = 0; r < ref_count; ++r)
+    {
+        struct SharedStoredBlockRef* ref = &shared->m_Refs[r];
+        ref->m_StoredBlock.Dispose = SharedStoredBlockRef_Dispose;
+        ref->m_StoredBlock.m_BlockIndex = stored_block->m_BlockIndex;
+        ref->m_StoredBlock.m_BlockData = stored_block->m_BlockData;
+        ref->m_StoredBlock.m_BlockChunksDataSize = stored_block->m_BlockChunksDataSize;
+        ref->m_Shared = shared;
+        out_refs[r] = &ref->m_StoredBlock;
+    }
+    return 0;
+}
+
+static size_t CompressionAPI_GetMaxCompressedSize(struct Longtail_CompressionAPI* compression_api, uint32_t settings_id, size_t size)
+{
+    return compression_api->GetMaxCompressedSize(compression_api, settings_id, size);
+}
+
+static int CompressionAPI_Compress(struct Longtail_CompressionAPI* compression_api, uint32_t settings_id, const char* uncompressed, char* compressed, size_t uncompressed_size, size_t max_compressed_size, size_t* out_compressed_size)
+{
+    return compression_api->Compress(compression_api, settings_id, uncompressed, compressed, uncompressed_size, max_compressed_size, out_compressed_size);
+}
+
+static int CompressionAPI_Decompress(struct Longtail_CompressionAPI* compression_api, const char* compressed, char* uncompressed, size_t compressed_size, size_t max_uncompressed_size, size_t* out_uncompressed_size)
+{
+    return compression_api->Decompress(compression_api, compressed, uncompressed, compressed_size, max_uncompressed_size, out_uncompressed_size);
+}
+
 static const char* GetVersionIndexPath(struct Longtail_VersionIndex* version_index, uint32_t asset_index)
 {
     return &version_index->m_NameData[version_index->m_NameOffsets[asset_index]];
@@ -219,6 +333,345 @@ static uint16_t GetVersionAssetPermissions(struct Longtail_VersionIndex* version
     return version_index->m_Permissions[asset_index];
 }
 
+static struct Longtail_BlockIndex* CreateBlockIndexFromData(
+    TLongtail_Hash block_hash,
+    uint32_t hash_identifier,
+    uint32_t tag,
+    uint32_t chunk_count,
+    const TLongtail_Hash* chunk_hashes,
+    const uint32_t* chunk_sizes)
+{
+    void* mem = Longtail_Alloc("CreateBlockIndexFromData", Longtail_GetBlockIndexSize(chunk_count));
+    if (!mem)
+    {
+        return 0;
+    }
+    struct Longtail_BlockIndex* block_index = Longtail_InitBlockIndex(mem, chunk_count);
+    if (!block_index)
+    {
+        Longtail_Free(mem);
+        return 0;
+    }
+    *block_index->m_BlockHash = block_hash;
+    *block_index->m_HashIdentifier = hash_identifier;
+    *block_index->m_ChunkCount = chunk_count;
+    *block_index->m_Tag = tag;
+    memmove(block_index->m_ChunkHashes, chunk_hashes, sizeof(TLongtail_Hash) * chunk_count);
+    memmove(block_index->m_ChunkSizes, chunk_sizes, sizeof(uint32_t) * chunk_count);
+    return block_index;
+}
+
+static int BuildVersionIndexFromData(
+    uint32_t asset_count,
+    const char* const* asset_paths,
+    const uint64_t* asset_sizes,
+    const uint16_t* asset_permissions,
+    const TLongtail_Hash* path_hashes,
+    const TLongtail_Hash* content_hashes,
+    const uint32_t* asset_chunk_index_starts,
+    const uint32_t* asset_chunk_counts,
+    uint32_t asset_chunk_index_count,
+    const uint32_t* asset_chunk_indexes,
+    uint32_t chunk_count,
+    const uint32_t* chunk_sizes,
+    const TLongtail_Hash* chunk_hashes,
+    const uint32_t* chunk_tags,
+    uint32_t hash_identifier,
+    uint32_t target_chunk_size,
+    struct Longtail_VersionIndex** out_version_index)
+{
+    struct Longtail_FileInfos* file_infos = 0;
+    int err = Longtail_MakeFileInfos(asset_count, asset_paths, asset_sizes, asset_permissions, &file_infos);
+    if (err)
+    {
+        return err;
+    }
+    size_t version_index_size = Longtail_GetVersionIndexSize(asset_count, chunk_count, asset_chunk_index_count, file_infos->m_PathDataSize);
+    void* mem = Longtail_Alloc("BuildVersionIndexFromData", version_index_size);
+    if (!mem)
+    {
+        Longtail_Free(file_infos);
+        return ENOMEM;
+    }
+    err = Longtail_BuildVersionIndex(
+        mem,
+        version_index_size,
+        file_infos,
+        path_hashes,
+        content_hashes,
+        asset_chunk_index_starts,
+        asset_chunk_counts,
+        asset_chunk_index_count,
+        asset_chunk_indexes,
+        chunk_count,
+        chunk_sizes,
+        chunk_hashes,
+        chunk_tags,
+        hash_identifier,
+        target_chunk_size,
+        out_version_index);
+    Longtail_Free(file_infos);
+    if (err)
+    {
+        Longtail_Free(mem);
+    }
+    return err;
+}
+
+////////////// Sparse Longtail_StorageAPI
+
+#define SPARSE_STORAGE_PAGE_SIZE 4096
+
+struct SparseStorageAPI
+{
+    struct Longtail_StorageAPI m_API;
+    struct Longtail_StorageAPI* m_StorageAPI;
+    uint64_t m_MinZeroRun;
+};
+
+struct SparseStorageFile
+{
+    Longtail_StorageAPI_HOpenFile m_File;
+    // m_End is the end of the file including skipped zeros, m_WrittenEnd is the end of the data written to it
+    uint64_t m_End;
+    uint64_t m_WrittenEnd;
+};
+
+static struct Longtail_StorageAPI* SparseStorage_Inner(struct Longtail_StorageAPI* storage_api) { return ((struct SparseStorageAPI*)storage_api)->m_StorageAPI; }
+static Longtail_StorageAPI_HOpenFile SparseStorage_InnerFile(Longtail_StorageAPI_HOpenFile f) { return ((struct SparseStorageFile*)f)->m_File; }
+
+static void SparseStorage_Dispose(struct Longtail_API* api) { Longtail_Free(api); }
+
+// Parts of a file can be written from several jobs at once
+static void SparseStorage_AtomicMax(uint64_t* target, uint64_t value)
+{
+    uint64_t current = __atomic_load_n(target, __ATOMIC_SEQ_CST);
+    while (current < value && !__atomic_compare_exchange_n(target, &current, value, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST))
+    {
+    }
+}
+
+static int SparseStorage_WrapFile(Longtail_StorageAPI_HOpenFile f, uint64_t size, Longtail_StorageAPI_HOpenFile* out_open_file)
+{
+    struct SparseStorageFile* file = (struct SparseStorageFile*)Longtail_Alloc("SparseStorage_WrapFile", sizeof(struct SparseStorageFile));
+    if (!file)
+    {
+        return ENOMEM;
+    }
+    file->m_File = f;
+    file->m_End = size;
+    file->m_WrittenEnd = size;
+    *out_open_file = (Longtail_StorageAPI_HOpenFile)file;
+    return 0;
+}
+
+static int SparseStorage_OpenReadFile(struct Longtail_StorageAPI* storage_api, const char* path, Longtail_StorageAPI_HOpenFile* out_open_file)
+{
+    struct Longtail_StorageAPI* inner = SparseStorage_Inner(storage_api);
+    Longtail_StorageAPI_HOpenFile f;
+    int err = inner->OpenReadFile(inner, path, &f);
+    if (err)
+    {
+        return err;
+    }
+    err = SparseStorage_WrapFile(f, 0, out_open_file);
+    if (err)
+    {
+        inner->CloseFile(inner, f);
+    }
+    return err;
+}
+
+static int SparseStorage_GetSize(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HOpenFile f, uint64_t* out_size) { return SparseStorage_Inner(storage_api)->GetSize(SparseStorage_Inner(storage_api), SparseStorage_InnerFile(f), out_size); }
+static int SparseStorage_Read(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HOpenFile f, uint64_t offset, uint64_t length, void* output) { return SparseStorage_Inner(storage_api)->Read(SparseStorage_Inner(storage_api), SparseStorage_InnerFile(f), offset, length, output); }
+
+// The file is truncated so the parts that are never written read as zeros and not as the old content
+static int SparseStorage_OpenWriteFile(struct Longtail_StorageAPI* storage_api, const char* path, uint64_t initial_size, Longtail_StorageAPI_HOpenFile* out_open_file)
+{
+    struct Longtail_StorageAPI* inner = SparseStorage_Inner(storage_api);
+    Longtail_StorageAPI_HOpenFile f;
+    int err = inner->OpenWriteFile(inner, path, initial_size, &f);
+    if (err)
+    {
+        return err;
+    }
+    err = inner->SetSize(inner, f, 0);
+    if (!err && initial_size > 0)
+    {
+        err = inner->SetSize(inner, f, initial_size);
+    }
+    if (!err)
+    {
+        err = SparseStorage_WrapFile(f, initial_size, out_open_file);
+    }
+    if (err)
+    {
+        inner->CloseFile(inner, f);
+    }
+    return err;
+}
+
+static int SparseStorage_IsZero(const uint8_t* data, uint64_t size)
+{
+    return data[0] == 0 && memcmp(data, data + 1, size - 1) == 0;
+}
+
+static int SparseStorage_WriteData(struct SparseStorageAPI* api, struct SparseStorageFile* file, uint64_t offset, uint64_t length, const uint8_t* data)
+{
+    int err = api->m_StorageAPI->Write(api->m_StorageAPI, file->m_File, offset, length, data);
+    if (!err)
+    {
+        SparseStorage_AtomicMax(&file->m_WrittenEnd, offset + length);
+    }
+    return err;
+}
+
+// SparseStorage_SkipRun writes the data before a run of zeros unless the run is too short to skip
+static int SparseStorage_SkipRun(struct SparseStorageAPI* api, struct SparseStorageFile* file, uint64_t offset, const uint8_t* data, uint64_t* pending, uint64_t run_start, uint64_t run_end)
+{
+    if (run_end - run_start < api->m_MinZeroRun)
+    {
+        return 0;
+    }
+    if (run_start > *pending)
+    {
+        int err = SparseStorage_WriteData(api, file, *pending, run_start - *pending, &data[*pending - offset]);
+        if (err)
+        {
+            return err;
+        }
+    }
+    *pending = run_end;
+    return 0;
+}
+
+// Write skips the runs of at least m_MinZeroRun zeros, the file was truncated when opened so they read
+// as zeros and the file system leaves holes for the pages they cover. The input is scanned in page
+// aligned pieces so writes of zeros that are not aligned are skipped as a whole.
+static int SparseStorage_Write(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HOpenFile f, uint64_t offset, uint64_t length, const void* input)
+{
+    struct SparseStorageAPI* api = (struct SparseStorageAPI*)storage_api;
+    struct SparseStorageFile* file = (struct SparseStorageFile*)f;
+    const uint8_t* data = (const uint8_t*)input;
+    uint64_t end = offset + length;
+    uint64_t pending = offset;
+    uint64_t run_start = end;
+    uint64_t pos = offset;
+    int err = 0;
+    SparseStorage_AtomicMax(&file->m_End, end);
+    while (pos < end && !err)
+    {
+        uint64_t piece_end = (pos & ~(uint64_t)(SPARSE_STORAGE_PAGE_SIZE - 1)) + SPARSE_STORAGE_PAGE_SIZE;
+        if (piece_end > end)
+        {
+            piece_end = end;
+        }
+        if (SparseStorage_IsZero(&data[pos - offset], piece_end - pos))
+        {
+            if (run_start == end)
+            {
+                run_start = pos;
+            }
+        }
+        else if (run_start != end)
+        {
+            err = SparseStorage_SkipRun(api, file, offset, data, &pending, run_start, pos);
+            run_start = end;
+        }
+        pos = piece_end;
+    }
+    if (!err && run_start != end)
+    {
+        err = SparseStorage_SkipRun(api, file, offset, data, &pending, run_start, end);
+    }
+    if (!err && end > pending)
+    {
+        err = SparseStorage_WriteData(api, file, pending, end - pending, &data[pending - offset]);
+    }
+    return err;
+}
+
+static int SparseStorage_SetSize(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HOpenFile f, uint64_t length)
+{
+    struct SparseStorageFile* file = (struct SparseStorageFile*)f;
+    int err = SparseStorage_Inner(storage_api)->SetSize(SparseStorage_Inner(storage_api), file->m_File, length);
+    if (!err)
+    {
+        __atomic_store_n(&file->m_End, length, __ATOMIC_SEQ_CST);
+        __atomic_store_n(&file->m_WrittenEnd, length, __ATOMIC_SEQ_CST);
+    }
+    return err;
+}
+
+// A file that ends with skipped zeros is extended to its full size when it is closed
+static void SparseStorage_CloseFile(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HOpenFile f)
+{
+    struct Longtail_StorageAPI* inner = SparseStorage_Inner(storage_api);
+    struct SparseStorageFile* file = (struct SparseStorageFile*)f;
+    if (file->m_WrittenEnd < file->m_End)
+    {
+        if (inner->SetSize(inner, file->m_File, file->m_End))
+        {
+            uint8_t zero = 0;
+            inner->Write(inner, file->m_File, file->m_End - 1, 1, &zero);
+        }
+    }
+    inner->CloseFile(inner, file->m_File);
+    Longtail_Free(file);
+}
+
+static int SparseStorage_SetPermissions(struct Longtail_StorageAPI* storage_api, const char* path, uint16_t permissions) { return SparseStorage_Inner(storage_api)->SetPermissions(SparseStorage_Inner(storage_api), path, permissions); }
+static int SparseStorage_GetPermissions(struct Longtail_StorageAPI* storage_api, const char* path, uint16_t* out_permissions) { return SparseStorage_Inner(storage_api)->GetPermissions(SparseStorage_Inner(storage_api), path, out_permissions); }
+static int SparseStorage_CreateDir(struct Longtail_StorageAPI* storage_api, const char* path) { return SparseStorage_Inner(storage_api)->CreateDir(SparseStorage_Inner(storage_api), path); }
+static int SparseStorage_RenameFile(struct Longtail_StorageAPI* storage_api, const char* source_path, const char* target_path) { return SparseStorage_Inner(storage_api)->RenameFile(SparseStorage_Inner(storage_api), source_path, target_path); }
+static char* SparseStorage_ConcatPath(struct Longtail_StorageAPI* storage_api, const char* root_path, const char* sub_path) { return SparseStorage_Inner(storage_api)->ConcatPath(SparseStorage_Inner(storage_api), root_path, sub_path); }
+static int SparseStorage_IsDir(struct Longtail_StorageAPI* storage_api, const char* path) { return SparseStorage_Inner(storage_api)->IsDir(SparseStorage_Inner(storage_api), path); }
+static int SparseStorage_IsFile(struct Longtail_StorageAPI* storage_api, const char* path) { return SparseStorage_Inner(storage_api)->IsFile(SparseStorage_Inner(storage_api), path); }
+static int SparseStorage_RemoveDir(struct Longtail_StorageAPI* storage_api, const char* path) { return SparseStorage_Inner(storage_api)->RemoveDir(SparseStorage_Inner(storage_api), path); }
+static int SparseStorage_RemoveFile(struct Longtail_StorageAPI* storage_api, const char* path) { return SparseStorage_Inner(storage_api)->RemoveFile(SparseStorage_Inner(storage_api), path); }
+static int SparseStorage_StartFind(struct Longtail_StorageAPI* storage_api, const char* path, Longtail_StorageAPI_HIterator* out_iterator) { return SparseStorage_Inner(storage_api)->StartFind(SparseStorage_Inner(storage_api), path, out_iterator); }
+static int SparseStorage_FindNext(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HIterator iterator) { return SparseStorage_Inner(storage_api)->FindNext(SparseStorage_Inner(storage_api), iterator); }
+static void SparseStorage_CloseFind(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HIterator iterator) { SparseStorage_Inner(storage_api)->CloseFind(SparseStorage_Inner(storage_api), iterator); }
+static int SparseStorage_GetEntryProperties(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HIterator iterator, struct Longtail_StorageAPI_EntryProperties* out_properties) { return SparseStorage_Inner(storage_api)->GetEntryProperties(SparseStorage_Inner(storage_api), iterator, out_properties); }
+static int SparseStorage_LockFile(struct Longtail_StorageAPI* storage_api, const char* path, Longtail_StorageAPI_HLockFile* out_lock_file) { return SparseStorage_Inner(storage_api)->LockFile(SparseStorage_Inner(storage_api), path, out_lock_file); }
+static int SparseStorage_UnlockFile(struct Longtail_StorageAPI* storage_api, Longtail_StorageAPI_HLockFile file_lock) { return SparseStorage_Inner(storage_api)->UnlockFile(SparseStorage_Inner(storage_api), file_lock); }
+
+static struct Longtail_StorageAPI* CreateSparseStorageAPI(struct Longtail_StorageAPI* storage_api, uint64_t min_zero_run)
+{
+    struct SparseStorageAPI* api = (struct SparseStorageAPI*)Longtail_Alloc("CreateSparseStorageAPI", sizeof(struct SparseStorageAPI));
+    if (!api)
+    {
+        return 0;
+    }
+    api->m_StorageAPI = storage_api;
+    api->m_MinZeroRun = min_zero_run < SPARSE_STORAGE_PAGE_SIZE ? SPARSE_STORAGE_PAGE_SIZE : min_zero_run;
+    return Longtail_MakeStorageAPI(
+        api,
+        SparseStorage_Dispose,
+        SparseStorage_OpenReadFile,
+        SparseStorage_GetSize,
+        SparseStorage_Read,
+        SparseStorage_OpenWriteFile,
+        SparseStorage_Write,
+        SparseStorage_SetSize,
+        SparseStorage_SetPermissions,
+        SparseStorage_GetPermissions,
+        SparseStorage_CloseFile,
+        SparseStorage_CreateDir,
+        SparseStorage_RenameFile,
+        SparseStorage_ConcatPath,
+        SparseStorage_IsDir,
+        SparseStorage_IsFile,
+        SparseStorage_RemoveDir,
+        SparseStorage_RemoveFile,
+        SparseStorage_StartFind,
+        SparseStorage_FindNext,
+        SparseStorage_CloseFind,
+        SparseStorage_GetEntryProperties,
+        SparseStorage_LockFile,
+        SparseStorage_UnlockFile);
+}
+
 static void EnableMemtrace() {
     Longtail_MemTracer_Init();
     Longtail_SetAllocAndFree(Longtail_MemTracer_Alloc, Longtail_MemTracer_Free);
@@ -5,7 +5,9 @@ package longtaillib
 import "C"
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 )
@@ -207,22 +209,62 @@ func ErrnoToError(errno int, fallback error) error {
 	return fallback //errors.New(fmt.Sprintf("Error: %d", errno))
 }
 
-// ErrorToErrno Converts a golang error to a longtail int errno
+// ErrorToErrno Converts a golang error to a longtail int errno, the errors wrapped by err are
+// checked until one maps to an errno
 func ErrorToErrno(err error, fallback int) int {
 	if err == nil {
 		return 0
 	}
-	unwrappedError := errors.Unwrap(err)
-	if unwrappedError == nil {
-		unwrappedError = err
+	var longtailErr *Error
+	if errors.As(err, &longtailErr) {
+		return longtailErr.Errno
 	}
-	errno, exists := errorToErrno[unwrappedError]
-	if exists {
-		return errno
+	for unwrappedError := err; unwrappedError != nil; unwrappedError = errors.Unwrap(unwrappedError) {
+		errno, exists := errorToErrno[unwrappedError]
+		if exists {
+			return errno
+		}
 	}
 	return fallback //ENOENT // Bad catchall
 }
 
+// Error is a failed errno of a longtail operation together with what it was doing. Use errors.As
+// to get it from an error and errors.Is with ErrENOENT, ErrEIO and the other errno errors to check
+// the errno. Key and Store are empty when the operation is not on a single object or store.
+type Error struct {
+	Errno int
+	// Op is the operation that failed, such as "ChangeVersion" or "GetStoredBlock"
+	Op string
+	// Key is the object key, block hash or path the operation was on
+	Key string
+	// Store is the URI of the store the operation was on
+	Store string
+}
+
+func (e *Error) Error() string {
+	message := e.Op
+	if len(e.Key) > 0 {
+		message += " " + e.Key
+	}
+	if len(e.Store) > 0 {
+		message += " in " + e.Store
+	}
+	return fmt.Sprintf("%s failed: %v (errno %d)", message, ErrnoToError(e.Errno, ErrEIO), e.Errno)
+}
+
+// Unwrap returns the errno error of e, ErrEIO for errnos without one
+func (e *Error) Unwrap() error {
+	return ErrnoToError(e.Errno, ErrEIO)
+}
+
+// NewError returns an *Error for an errno returned by op, nil if errno is 0
+func NewError(errno int, op string, key string, store string) error {
+	if errno == 0 {
+		return nil
+	}
+	return &Error{Errno: errno, Op: op, Key: key, Store: store}
+}
+
 type ProgressAPI interface {
 	OnProgress(totalCount uint32, doneCount uint32)
 }
@@ -230,6 +272,14 @@ type PathFilterAPI interface {
 	Include(rootPath string, assetPath string, assetName string, isDir bool, size uint64, permissions uint16) bool
 }
 
+// CompressionAPI is a compression codec implemented in Go, see CreateCompressionAPI and
+// RegisterCompressionAPI. Compress and Decompress return the number of bytes written and an errno.
+type CompressionAPI interface {
+	GetMaxCompressedSize(settingsID uint32, size int) int
+	Compress(settingsID uint32, uncompressed []byte, compressed []byte) (int, int)
+	Decompress(compressed []byte, uncompressed []byte) (int, int)
+}
+
 type AsyncPutStoredBlockAPI interface {
 	OnComplete(errno int)
 }
@@ -638,6 +688,32 @@ func (hashAPI *Longtail_HashAPI) GetIdentifier() uint32 {
 	return uint32(C.Longtail_Hash_GetIdentifier(hashAPI.cHashAPI))
 }
 
+// HashBuffer ...
+func (hashAPI *Longtail_HashAPI) HashBuffer(data []byte) (uint64, int) {
+	var hash C.uint64_t
+	cData := unsafe.Pointer(nil)
+	if len(data) > 0 {
+		cData = unsafe.Pointer(&data[0])
+	}
+	errno := C.Longtail_Hash_HashBuffer(hashAPI.cHashAPI, C.uint32_t(len(data)), cData, &hash)
+	if errno != 0 {
+		return 0, int(errno)
+	}
+	return uint64(hash), 0
+}
+
+// GetPathHash returns the hash of an asset path as stored in a version index
+func (hashAPI *Longtail_HashAPI) GetPathHash(path string) (uint64, int) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var hash C.TLongtail_Hash
+	errno := C.Longtail_GetPathHash(hashAPI.cHashAPI, cPath, &hash)
+	if errno != 0 {
+		return 0, int(errno)
+	}
+	return uint64(hash), 0
+}
+
 func (storeIndex *Longtail_StoreIndex) Copy() (Longtail_StoreIndex, error) {
 	if storeIndex.cStoreIndex == nil {
 		return Longtail_StoreIndex{}, nil
@@ -676,6 +752,11 @@ func (storeIndex *Longtail_StoreIndex) GetChunkCount() uint32 {
 	return uint32(*storeIndex.cStoreIndex.m_ChunkCount)
 }
 
+// GetSize returns the number of bytes of memory used by the store index
+func (storeIndex *Longtail_StoreIndex) GetSize() uint64 {
+	return uint64(C.Longtail_GetStoreIndexSize(*storeIndex.cStoreIndex.m_BlockCount, *storeIndex.cStoreIndex.m_ChunkCount))
+}
+
 func (storeIndex *Longtail_StoreIndex) GetBlockHashes() []uint64 {
 	size := int(C.Longtail_StoreIndex_GetBlockCount(storeIndex.cStoreIndex))
 	return carray2slice64(C.Longtail_StoreIndex_GetBlockHashes(storeIndex.cStoreIndex), size)
@@ -686,6 +767,40 @@ func (storeIndex *Longtail_StoreIndex) GetChunkHashes() []uint64 {
 	return carray2slice64(storeIndex.cStoreIndex.m_ChunkHashes, size)
 }
 
+// GetBlockIndex returns a copy of the block index of block number blockIndex in the store index
+func (storeIndex *Longtail_StoreIndex) GetBlockIndex(blockIndex uint32) (Longtail_BlockIndex, int) {
+	var cBlockIndex C.struct_Longtail_BlockIndex
+	errno := C.Longtail_MakeBlockIndex(storeIndex.cStoreIndex, C.uint32_t(blockIndex), &cBlockIndex)
+	if errno != 0 {
+		return Longtail_BlockIndex{cBlockIndex: nil}, int(errno)
+	}
+	cCopy := C.Longtail_CopyBlockIndex(&cBlockIndex)
+	if cCopy == nil {
+		return Longtail_BlockIndex{cBlockIndex: nil}, ENOMEM
+	}
+	return Longtail_BlockIndex{cBlockIndex: cCopy}, 0
+}
+
+func (storeIndex *Longtail_StoreIndex) GetBlockChunksOffsets() []uint32 {
+	size := int(C.Longtail_StoreIndex_GetBlockCount(storeIndex.cStoreIndex))
+	return carray2slice32(C.Longtail_StoreIndex_GetBlockChunksOffsets(storeIndex.cStoreIndex), size)
+}
+
+func (storeIndex *Longtail_StoreIndex) GetBlockChunkCounts() []uint32 {
+	size := int(C.Longtail_StoreIndex_GetBlockCount(storeIndex.cStoreIndex))
+	return carray2slice32(C.Longtail_StoreIndex_GetBlockChunkCounts(storeIndex.cStoreIndex), size)
+}
+
+func (storeIndex *Longtail_StoreIndex) GetBlockTags() []uint32 {
+	size := int(C.Longtail_StoreIndex_GetBlockCount(storeIndex.cStoreIndex))
+	return carray2slice32(C.Longtail_StoreIndex_GetBlockTags(storeIndex.cStoreIndex), size)
+}
+
+func (storeIndex *Longtail_StoreIndex) GetChunkSizes() []uint32 {
+	size := int(*storeIndex.cStoreIndex.m_ChunkCount)
+	return carray2slice32(C.Longtail_StoreIndex_GetChunkSizes(storeIndex.cStoreIndex), size)
+}
+
 func (versionIndex *Longtail_VersionIndex) Dispose() {
 	if versionIndex.cVersionIndex != nil {
 		C.Longtail_Free(unsafe.Pointer(versionIndex.cVersionIndex))
@@ -948,6 +1063,24 @@ func (blockStoreAPI *Longtail_BlockStoreAPI) PutStoredBlock(
 	return int(errno)
 }
 
+// PreflightGet() ...
+func (blockStoreAPI *Longtail_BlockStoreAPI) PreflightGet(
+	blockHashes []uint64,
+	asyncCompleteAPI Longtail_AsyncPreflightStartedAPI) int {
+
+	blockCount := len(blockHashes)
+	cBlockHashes := (*C.TLongtail_Hash)(unsafe.Pointer(nil))
+	if blockCount > 0 {
+		cBlockHashes = (*C.TLongtail_Hash)(unsafe.Pointer(&blockHashes[0]))
+	}
+	errno := C.Longtail_BlockStore_PreflightGet(
+		blockStoreAPI.cBlockStoreAPI,
+		C.uint32_t(blockCount),
+		cBlockHashes,
+		asyncCompleteAPI.cAsyncCompleteAPI)
+	return int(errno)
+}
+
 // GetStoredBlock() ...
 func (blockStoreAPI *Longtail_BlockStoreAPI) GetStoredBlock(
 	blockHash uint64,
@@ -1072,6 +1205,42 @@ func (storedBlock *Longtail_StoredBlock) GetChunksBlockData() []byte {
 	return carray2sliceByte((*C.char)(storedBlock.cStoredBlock.m_BlockData), size)
 }
 
+// Copy makes a new stored block with the same block index and chunk data without a round trip
+// through the serialized format
+func (storedBlock *Longtail_StoredBlock) Copy() (Longtail_StoredBlock, int) {
+	if storedBlock.cStoredBlock == nil {
+		return Longtail_StoredBlock{}, EINVAL
+	}
+	blockIndex := storedBlock.GetBlockIndex()
+	return CreateStoredBlock(
+		blockIndex.GetBlockHash(),
+		blockIndex.GetHashIdentifier(),
+		blockIndex.GetTag(),
+		blockIndex.GetChunkHashes(),
+		blockIndex.GetChunkSizes(),
+		storedBlock.GetChunksBlockData(),
+		false)
+}
+
+// ShareStoredBlock returns refCount stored blocks that reference the block index and chunk data of
+// storedBlock instead of copying them. Each of them is disposed on its own and storedBlock is disposed
+// with the last one, so the caller must not use or dispose storedBlock after a successful call.
+func ShareStoredBlock(storedBlock Longtail_StoredBlock, refCount int) ([]Longtail_StoredBlock, int) {
+	if storedBlock.cStoredBlock == nil || refCount < 1 {
+		return nil, EINVAL
+	}
+	cRefs := make([]*C.struct_Longtail_StoredBlock, refCount)
+	errno := C.ShareStoredBlock(storedBlock.cStoredBlock, C.uint32_t(refCount), &cRefs[0])
+	if errno != 0 {
+		return nil, int(errno)
+	}
+	refs := make([]Longtail_StoredBlock, refCount)
+	for i, cRef := range cRefs {
+		refs[i] = Longtail_StoredBlock{cStoredBlock: cRef}
+	}
+	return refs, 0
+}
+
 func (storedBlock *Longtail_StoredBlock) Dispose() {
 	if storedBlock.cStoredBlock != nil {
 		C.Longtail_StoredBlock_Dispose(storedBlock.cStoredBlock)
@@ -1087,15 +1256,21 @@ func (blockIndex *Longtail_BlockIndex) Dispose() {
 }
 
 func WriteStoredBlockToBuffer(storedBlock Longtail_StoredBlock) ([]byte, int) {
-	var buffer unsafe.Pointer
+	return AppendStoredBlockToBuffer(nil, storedBlock)
+}
+
+// AppendStoredBlockToBuffer serializes storedBlock to the end of buffer and returns the extended buffer.
+// The serialized block is copied straight from native memory so passing a reused buffer with enough
+// capacity avoids allocating on the Go heap.
+func AppendStoredBlockToBuffer(buffer []byte, storedBlock Longtail_StoredBlock) ([]byte, int) {
+	var cBuffer unsafe.Pointer
 	var size C.size_t
-	errno := C.Longtail_WriteStoredBlockToBuffer(storedBlock.cStoredBlock, &buffer, &size)
+	errno := C.Longtail_WriteStoredBlockToBuffer(storedBlock.cStoredBlock, &cBuffer, &size)
 	if errno != 0 {
-		return nil, int(errno)
+		return buffer, int(errno)
 	}
-	defer C.Longtail_Free(buffer)
-	bytes := C.GoBytes(buffer, C.int(size))
-	return bytes, 0
+	defer C.Longtail_Free(cBuffer)
+	return append(buffer, carray2sliceByte((*C.char)(cBuffer), int(size))...), 0
 }
 
 func ReadStoredBlockFromBuffer(buffer []byte) (Longtail_StoredBlock, int) {
@@ -1112,11 +1287,55 @@ func ReadStoredBlockFromBuffer(buffer []byte) (Longtail_StoredBlock, int) {
 	return Longtail_StoredBlock{cStoredBlock: stored_block}, 0
 }
 
+// ReadStoredBlock reads a stored block from the file at path in storageAPI, the block data is
+// read straight into native memory
+func ReadStoredBlock(storageAPI Longtail_StorageAPI, path string) (Longtail_StoredBlock, int) {
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var stored_block *C.struct_Longtail_StoredBlock
+	errno := C.Longtail_ReadStoredBlock(storageAPI.cStorageAPI, cPath, &stored_block)
+	if errno != 0 {
+		return Longtail_StoredBlock{cStoredBlock: nil}, int(errno)
+	}
+	return Longtail_StoredBlock{cStoredBlock: stored_block}, 0
+}
+
 func ValidateStore(storeIndex Longtail_StoreIndex, versionIndex Longtail_VersionIndex) int {
 	errno := C.Longtail_ValidateStore(storeIndex.cStoreIndex, versionIndex.cVersionIndex)
 	return int(errno)
 }
 
+// CreateBlockIndex creates a block index from its parts, unlike a block index created by the
+// native library the block hash is not computed from the chunk hashes
+func CreateBlockIndex(
+	blockHash uint64,
+	hashIdentifier uint32,
+	tag uint32,
+	chunkHashes []uint64,
+	chunkSizes []uint32) (Longtail_BlockIndex, int) {
+	chunkCount := len(chunkHashes)
+	if chunkCount != len(chunkSizes) {
+		return Longtail_BlockIndex{cBlockIndex: nil}, EINVAL
+	}
+	cChunkHashes := (*C.TLongtail_Hash)(unsafe.Pointer(nil))
+	cChunkSizes := (*C.uint32_t)(unsafe.Pointer(nil))
+	if chunkCount > 0 {
+		cChunkHashes = (*C.TLongtail_Hash)(unsafe.Pointer(&chunkHashes[0]))
+		cChunkSizes = (*C.uint32_t)(unsafe.Pointer(&chunkSizes[0]))
+	}
+	cBlockIndex := C.CreateBlockIndexFromData(
+		C.TLongtail_Hash(blockHash),
+		C.uint32_t(hashIdentifier),
+		C.uint32_t(tag),
+		C.uint32_t(chunkCount),
+		cChunkHashes,
+		cChunkSizes)
+	if cBlockIndex == nil {
+		return Longtail_BlockIndex{cBlockIndex: nil}, ENOMEM
+	}
+	return Longtail_BlockIndex{cBlockIndex: cBlockIndex}, 0
+}
+
 // CreateStoredBlock() ...
 func CreateStoredBlock(
 	blockHash uint64,
@@ -1175,6 +1394,13 @@ func CreateInMemStorageAPI() Longtail_StorageAPI {
 	return Longtail_StorageAPI{cStorageAPI: C.Longtail_CreateInMemStorageAPI()}
 }
 
+// CreateSparseStorageAPI wraps storageAPI so runs of at least minZeroRun zero bytes are not written
+// to files, on file systems with sparse files they become holes that take no disk space. The files
+// are truncated when opened for writing. storageAPI must outlive the returned storage API.
+func CreateSparseStorageAPI(storageAPI Longtail_StorageAPI, minZeroRun uint64) Longtail_StorageAPI {
+	return Longtail_StorageAPI{cStorageAPI: C.CreateSparseStorageAPI(storageAPI.cStorageAPI, C.uint64_t(minZeroRun))}
+}
+
 // Longtail_StorageAPI.Dispose() ...
 func (storageAPI *Longtail_StorageAPI) Dispose() {
 	if storageAPI.cStorageAPI != nil {
@@ -1198,6 +1424,50 @@ func CreateZStdCompressionAPI() Longtail_CompressionAPI {
 	return Longtail_CompressionAPI{cCompressionAPI: C.Longtail_CreateZStdCompressionAPI()}
 }
 
+// GetMaxCompressedSize returns the size of the buffer Compress needs for size bytes
+func (compressionAPI *Longtail_CompressionAPI) GetMaxCompressedSize(settingsID uint32, size int) int {
+	return int(C.CompressionAPI_GetMaxCompressedSize(compressionAPI.cCompressionAPI, C.uint32_t(settingsID), C.size_t(size)))
+}
+
+// Compress compresses uncompressed into compressed and returns the compressed size
+func (compressionAPI *Longtail_CompressionAPI) Compress(settingsID uint32, uncompressed []byte, compressed []byte) (int, int) {
+	if len(uncompressed) == 0 || len(compressed) == 0 {
+		return 0, EINVAL
+	}
+	outSize := C.size_t(0)
+	errno := C.CompressionAPI_Compress(
+		compressionAPI.cCompressionAPI,
+		C.uint32_t(settingsID),
+		(*C.char)(unsafe.Pointer(&uncompressed[0])),
+		(*C.char)(unsafe.Pointer(&compressed[0])),
+		C.size_t(len(uncompressed)),
+		C.size_t(len(compressed)),
+		&outSize)
+	if errno != 0 {
+		return 0, int(errno)
+	}
+	return int(outSize), 0
+}
+
+// Decompress decompresses compressed into uncompressed and returns the uncompressed size
+func (compressionAPI *Longtail_CompressionAPI) Decompress(compressed []byte, uncompressed []byte) (int, int) {
+	if len(compressed) == 0 || len(uncompressed) == 0 {
+		return 0, EINVAL
+	}
+	outSize := C.size_t(0)
+	errno := C.CompressionAPI_Decompress(
+		compressionAPI.cCompressionAPI,
+		(*C.char)(unsafe.Pointer(&compressed[0])),
+		(*C.char)(unsafe.Pointer(&uncompressed[0])),
+		C.size_t(len(compressed)),
+		C.size_t(len(uncompressed)),
+		&outSize)
+	if errno != 0 {
+		return 0, int(errno)
+	}
+	return int(outSize), 0
+}
+
 // Longtail_CompressionAPI.Dispose() ...
 func (compressionAPI *Longtail_CompressionAPI) Dispose() {
 	if compressionAPI.cCompressionAPI != nil {
@@ -1237,14 +1507,97 @@ func (jobAPI *Longtail_JobAPI) Dispose() {
 	}
 }
 
-// CreateFullCompressionRegistry ...
+// CreateFullCompressionRegistry creates a registry with the brotli, lz4 and zstd compression types
+// and the compression types added with RegisterCompressionAPI
 func CreateFullCompressionRegistry() Longtail_CompressionRegistryAPI {
-	return Longtail_CompressionRegistryAPI{cCompressionRegistryAPI: C.Longtail_CreateFullCompressionRegistry()}
+	return withRegisteredCompressionAPIs(Longtail_CompressionRegistryAPI{cCompressionRegistryAPI: C.Longtail_CreateFullCompressionRegistry()})
 }
 
-// CreateZStdCompressionRegistry ...
+// CreateZStdCompressionRegistry creates a registry with the zstd compression types and the
+// compression types added with RegisterCompressionAPI
 func CreateZStdCompressionRegistry() Longtail_CompressionRegistryAPI {
-	return Longtail_CompressionRegistryAPI{cCompressionRegistryAPI: C.Longtail_CreateZStdCompressionRegistry()}
+	return withRegisteredCompressionAPIs(Longtail_CompressionRegistryAPI{cCompressionRegistryAPI: C.Longtail_CreateZStdCompressionRegistry()})
+}
+
+type registeredCompressionAPI struct {
+	compressionType uint32
+	settingsID      uint32
+	compression     CompressionAPI
+}
+
+var registeredCompressionAPIsLock sync.Mutex
+var registeredCompressionAPIs []registeredCompressionAPI
+
+// RegisterCompressionAPI makes compression available as compressionType in the compression
+// registries created after the call, so blocks can be compressed with it during upsync and
+// decompressed when read. settingsID is passed on to the Compress and GetMaxCompressedSize calls.
+// Returns EINVAL for compression type zero and EEXIST if compressionType is already in use.
+func RegisterCompressionAPI(compressionType uint32, settingsID uint32, compression CompressionAPI) int {
+	if compressionType == GetNoCompressionType() || compression == nil {
+		return EINVAL
+	}
+	for _, builtinType := range []uint32{
+		GetBrotliGenericMinCompressionType(),
+		GetBrotliGenericDefaultCompressionType(),
+		GetBrotliGenericMaxCompressionType(),
+		GetBrotliTextMinCompressionType(),
+		GetBrotliTextDefaultCompressionType(),
+		GetBrotliTextMaxCompressionType(),
+		GetLZ4DefaultCompressionType(),
+		GetZStdMinCompressionType(),
+		GetZStdDefaultCompressionType(),
+		GetZStdMaxCompressionType()} {
+		if compressionType == builtinType {
+			return EEXIST
+		}
+	}
+	registeredCompressionAPIsLock.Lock()
+	defer registeredCompressionAPIsLock.Unlock()
+	for _, registered := range registeredCompressionAPIs {
+		if registered.compressionType == compressionType {
+			return EEXIST
+		}
+	}
+	registeredCompressionAPIs = append(registeredCompressionAPIs, registeredCompressionAPI{compressionType: compressionType, settingsID: settingsID, compression: compression})
+	return 0
+}
+
+// compressionRegistryProxy resolves the registered compression types and passes the others on to
+// the built in registry
+type compressionRegistryProxy struct {
+	builtin      Longtail_CompressionRegistryAPI
+	settingsIDs  map[uint32]uint32
+	compressions map[uint32]Longtail_CompressionAPI
+}
+
+func withRegisteredCompressionAPIs(builtin Longtail_CompressionRegistryAPI) Longtail_CompressionRegistryAPI {
+	registeredCompressionAPIsLock.Lock()
+	defer registeredCompressionAPIsLock.Unlock()
+	if len(registeredCompressionAPIs) == 0 {
+		return builtin
+	}
+	registry := &compressionRegistryProxy{
+		builtin:      builtin,
+		settingsIDs:  make(map[uint32]uint32, len(registeredCompressionAPIs)),
+		compressions: make(map[uint32]Longtail_CompressionAPI, len(registeredCompressionAPIs))}
+	for _, registered := range registeredCompressionAPIs {
+		registry.settingsIDs[registered.compressionType] = registered.settingsID
+		registry.compressions[registered.compressionType] = CreateCompressionAPI(registered.compression)
+	}
+	cContext := SavePointer(registry)
+	return Longtail_CompressionRegistryAPI{cCompressionRegistryAPI: C.CreateCompressionRegistryProxyAPI(cContext)}
+}
+
+// GetCompressionAPI returns the compression API and settings id of compressionType, the compression
+// API is owned by the registry
+func (compressionRegistry *Longtail_CompressionRegistryAPI) GetCompressionAPI(compressionType uint32) (Longtail_CompressionAPI, uint32, int) {
+	var cCompressionAPI *C.struct_Longtail_CompressionAPI
+	settingsID := C.uint32_t(0)
+	errno := C.Longtail_GetCompressionRegistry_GetCompressionAPI(compressionRegistry.cCompressionRegistryAPI, C.uint32_t(compressionType), &cCompressionAPI, &settingsID)
+	if errno != 0 {
+		return Longtail_CompressionAPI{}, 0, int(errno)
+	}
+	return Longtail_CompressionAPI{cCompressionAPI: cCompressionAPI}, uint32(settingsID), 0
 }
 
 // Longtail_CompressionRegistryAPI ...
@@ -1405,6 +1758,89 @@ func CreateVersionIndex(
 	return Longtail_VersionIndex{cVersionIndex: vindex}, 0
 }
 
+// BuildVersionIndex creates a version index from its parts as returned by the getters of
+// Longtail_VersionIndex, the path hashes are computed with GetPathHash
+func BuildVersionIndex(
+	hashIdentifier uint32,
+	targetChunkSize uint32,
+	assetPaths []string,
+	assetSizes []uint64,
+	assetPermissions []uint16,
+	pathHashes []uint64,
+	assetHashes []uint64,
+	assetChunkIndexStarts []uint32,
+	assetChunkCounts []uint32,
+	assetChunkIndexes []uint32,
+	chunkHashes []uint64,
+	chunkSizes []uint32,
+	chunkTags []uint32) (Longtail_VersionIndex, int) {
+	assetCount := len(assetPaths)
+	if len(assetSizes) != assetCount ||
+		len(assetPermissions) != assetCount ||
+		len(pathHashes) != assetCount ||
+		len(assetHashes) != assetCount ||
+		len(assetChunkIndexStarts) != assetCount ||
+		len(assetChunkCounts) != assetCount {
+		return Longtail_VersionIndex{cVersionIndex: nil}, EINVAL
+	}
+	chunkCount := len(chunkHashes)
+	if len(chunkSizes) != chunkCount || len(chunkTags) != chunkCount {
+		return Longtail_VersionIndex{cVersionIndex: nil}, EINVAL
+	}
+
+	// The path array is handed to C so it can not hold Go pointers
+	cAssetPaths := (**C.char)(unsafe.Pointer(nil))
+	if assetCount > 0 {
+		cAssetPaths = (**C.char)(C.malloc(C.size_t(assetCount) * C.size_t(unsafe.Sizeof(uintptr(0)))))
+		defer C.free(unsafe.Pointer(cAssetPaths))
+		cPaths := (*[1 << 28]*C.char)(unsafe.Pointer(cAssetPaths))[:assetCount:assetCount]
+		for i, path := range assetPaths {
+			cPaths[i] = C.CString(path)
+			defer C.free(unsafe.Pointer(cPaths[i]))
+		}
+	}
+	uint64Array := func(values []uint64) *C.uint64_t {
+		if len(values) == 0 {
+			return nil
+		}
+		return (*C.uint64_t)(unsafe.Pointer(&values[0]))
+	}
+	uint32Array := func(values []uint32) *C.uint32_t {
+		if len(values) == 0 {
+			return nil
+		}
+		return (*C.uint32_t)(unsafe.Pointer(&values[0]))
+	}
+	cAssetPermissions := (*C.uint16_t)(unsafe.Pointer(nil))
+	if assetCount > 0 {
+		cAssetPermissions = (*C.uint16_t)(unsafe.Pointer(&assetPermissions[0]))
+	}
+
+	var vindex *C.struct_Longtail_VersionIndex
+	errno := C.BuildVersionIndexFromData(
+		C.uint32_t(assetCount),
+		cAssetPaths,
+		uint64Array(assetSizes),
+		cAssetPermissions,
+		(*C.TLongtail_Hash)(uint64Array(pathHashes)),
+		(*C.TLongtail_Hash)(uint64Array(assetHashes)),
+		uint32Array(assetChunkIndexStarts),
+		uint32Array(assetChunkCounts),
+		C.uint32_t(len(assetChunkIndexes)),
+		uint32Array(assetChunkIndexes),
+		C.uint32_t(chunkCount),
+		uint32Array(chunkSizes),
+		(*C.TLongtail_Hash)(uint64Array(chunkHashes)),
+		uint32Array(chunkTags),
+		C.uint32_t(hashIdentifier),
+		C.uint32_t(targetChunkSize),
+		&vindex)
+	if errno != 0 {
+		return Longtail_VersionIndex{cVersionIndex: nil}, int(errno)
+	}
+	return Longtail_VersionIndex{cVersionIndex: vindex}, 0
+}
+
 // WriteVersionIndexToBuffer ...
 func WriteVersionIndexToBuffer(index Longtail_VersionIndex) ([]byte, int) {
 	var buffer unsafe.Pointer
@@ -1496,6 +1932,41 @@ func CreateStoreIndex(
 	return Longtail_StoreIndex{cStoreIndex: sindex}, 0
 }
 
+// CreateStoreIndexFromChunks packs the chunks into blocks in the given order, chunkTags is optional
+func CreateStoreIndexFromChunks(
+	hashAPI Longtail_HashAPI,
+	chunkHashes []uint64,
+	chunkSizes []uint32,
+	chunkTags []uint32,
+	maxBlockSize uint32,
+	maxChunksPerBlock uint32) (Longtail_StoreIndex, int) {
+	chunkCount := uint32(len(chunkHashes))
+	var cChunkHashes *C.TLongtail_Hash
+	var cChunkSizes *C.uint32_t
+	var cChunkTags *C.uint32_t
+	if chunkCount > 0 {
+		cChunkHashes = (*C.TLongtail_Hash)(unsafe.Pointer(&chunkHashes[0]))
+		cChunkSizes = (*C.uint32_t)(unsafe.Pointer(&chunkSizes[0]))
+		if len(chunkTags) > 0 {
+			cChunkTags = (*C.uint32_t)(unsafe.Pointer(&chunkTags[0]))
+		}
+	}
+	var sindex *C.struct_Longtail_StoreIndex
+	errno := C.Longtail_CreateStoreIndex(
+		hashAPI.cHashAPI,
+		C.uint32_t(chunkCount),
+		cChunkHashes,
+		cChunkSizes,
+		cChunkTags,
+		C.uint32_t(maxBlockSize),
+		C.uint32_t(maxChunksPerBlock),
+		&sindex)
+	if errno != 0 {
+		return Longtail_StoreIndex{cStoreIndex: nil}, int(errno)
+	}
+	return Longtail_StoreIndex{cStoreIndex: sindex}, 0
+}
+
 func GetExistingStoreIndex(
 	storeIndex Longtail_StoreIndex,
 	chunkHashes []uint64,
@@ -1597,6 +2068,75 @@ func ProgressAPIProxy_Dispose(api *C.struct_Longtail_API) {
 	C.Longtail_Free(unsafe.Pointer(api))
 }
 
+// CreateCompressionAPI wraps a Go compression codec so it can be used by the longtail compression registries
+func CreateCompressionAPI(compression CompressionAPI) Longtail_CompressionAPI {
+	cContext := SavePointer(compression)
+	compressionAPIProxy := C.CreateCompressionProxyAPI(cContext)
+	return Longtail_CompressionAPI{cCompressionAPI: compressionAPIProxy}
+}
+
+//export CompressionAPIProxy_GetMaxCompressedSize
+func CompressionAPIProxy_GetMaxCompressedSize(compression_api *C.struct_Longtail_CompressionAPI, settings_id C.uint32_t, size C.size_t) C.size_t {
+	context := C.CompressionAPIProxy_GetContext(unsafe.Pointer(compression_api))
+	compression := RestorePointer(context).(CompressionAPI)
+	return C.size_t(compression.GetMaxCompressedSize(uint32(settings_id), int(size)))
+}
+
+//export CompressionAPIProxy_Compress
+func CompressionAPIProxy_Compress(compression_api *C.struct_Longtail_CompressionAPI, settings_id C.uint32_t, uncompressed *C.char, compressed *C.char, uncompressed_size C.size_t, max_compressed_size C.size_t, out_compressed_size *C.size_t) C.int {
+	context := C.CompressionAPIProxy_GetContext(unsafe.Pointer(compression_api))
+	compression := RestorePointer(context).(CompressionAPI)
+	compressedSize, errno := compression.Compress(uint32(settings_id), carray2sliceByte(uncompressed, int(uncompressed_size)), carray2sliceByte(compressed, int(max_compressed_size)))
+	if errno != 0 {
+		return C.int(errno)
+	}
+	*out_compressed_size = C.size_t(compressedSize)
+	return 0
+}
+
+//export CompressionAPIProxy_Decompress
+func CompressionAPIProxy_Decompress(compression_api *C.struct_Longtail_CompressionAPI, compressed *C.char, uncompressed *C.char, compressed_size C.size_t, max_uncompressed_size C.size_t, out_uncompressed_size *C.size_t) C.int {
+	context := C.CompressionAPIProxy_GetContext(unsafe.Pointer(compression_api))
+	compression := RestorePointer(context).(CompressionAPI)
+	uncompressedSize, errno := compression.Decompress(carray2sliceByte(compressed, int(compressed_size)), carray2sliceByte(uncompressed, int(max_uncompressed_size)))
+	if errno != 0 {
+		return C.int(errno)
+	}
+	*out_uncompressed_size = C.size_t(uncompressedSize)
+	return 0
+}
+
+//export CompressionAPIProxy_Dispose
+func CompressionAPIProxy_Dispose(api *C.struct_Longtail_API) {
+	context := C.CompressionAPIProxy_GetContext(unsafe.Pointer(api))
+	UnrefPointer(context)
+	C.Longtail_Free(unsafe.Pointer(api))
+}
+
+//export CompressionRegistryAPIProxy_GetCompressionAPI
+func CompressionRegistryAPIProxy_GetCompressionAPI(compression_registry *C.struct_Longtail_CompressionRegistryAPI, compression_type C.uint32_t, out_compression_api **C.struct_Longtail_CompressionAPI, out_settings_id *C.uint32_t) C.int {
+	context := C.CompressionRegistryAPIProxy_GetContext(unsafe.Pointer(compression_registry))
+	registry := RestorePointer(context).(*compressionRegistryProxy)
+	if compression, exists := registry.compressions[uint32(compression_type)]; exists {
+		*out_compression_api = compression.cCompressionAPI
+		*out_settings_id = C.uint32_t(registry.settingsIDs[uint32(compression_type)])
+		return 0
+	}
+	return C.Longtail_GetCompressionRegistry_GetCompressionAPI(registry.builtin.cCompressionRegistryAPI, compression_type, out_compression_api, out_settings_id)
+}
+
+//export CompressionRegistryAPIProxy_Dispose
+func CompressionRegistryAPIProxy_Dispose(api *C.struct_Longtail_API) {
+	context := C.CompressionRegistryAPIProxy_GetContext(unsafe.Pointer(api))
+	registry := RestorePointer(context).(*compressionRegistryProxy)
+	for _, compression := range registry.compressions {
+		compression.Dispose()
+	}
+	registry.builtin.Dispose()
+	UnrefPointer(context)
+	C.Longtail_Free(unsafe.Pointer(api))
+}
+
 // CreatePathFilterAPI ...
 func CreatePathFilterAPI(pathFilter PathFilterAPI) Longtail_PathFilterAPI {
 	cContext := SavePointer(pathFilter)
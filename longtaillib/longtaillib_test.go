@@ -1,8 +1,12 @@
 package longtaillib
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"runtime"
 	"sync"
 	"testing"
@@ -93,6 +97,30 @@ func TestDebugging(t *testing.T) {
 	SetLogLevel(3)
 }
 
+func TestError(t *testing.T) {
+	if NewError(0, "GetStoredBlock", "", "") != nil {
+		t.Errorf("TestError() NewError() of errno 0 is not nil")
+	}
+	err := fmt.Errorf("Downsync: %w", NewError(ENOENT, "GetStoredBlock", "chunks/0x0001.lsb", "gs://bucket/store"))
+	if !errors.Is(err, ErrENOENT) || errors.Is(err, ErrEIO) {
+		t.Errorf("TestError() errors.Is() %v", err)
+	}
+	var longtailErr *Error
+	if !errors.As(err, &longtailErr) || longtailErr.Op != "GetStoredBlock" || longtailErr.Key != "chunks/0x0001.lsb" || longtailErr.Store != "gs://bucket/store" {
+		t.Errorf("TestError() errors.As() %+v", longtailErr)
+	}
+	if ErrorToErrno(err, EIO) != ENOENT {
+		t.Errorf("TestError() ErrorToErrno() %d != %d", ErrorToErrno(err, EIO), ENOENT)
+	}
+	if ErrorToErrno(fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", ErrEACCES)), EIO) != EACCES {
+		t.Errorf("TestError() ErrorToErrno() of wrapped error != %d", EACCES)
+	}
+	expected := "Downsync: GetStoredBlock chunks/0x0001.lsb in gs://bucket/store failed: No such file or directory (errno 2)"
+	if err.Error() != expected {
+		t.Errorf("TestError() Error() `%s` != `%s`", err.Error(), expected)
+	}
+}
+
 func TestInMemStorage(t *testing.T) {
 	SetLogger(&testLogger{t: t})
 	defer SetLogger(nil)
@@ -116,6 +144,41 @@ func TestInMemStorage(t *testing.T) {
 	}
 }
 
+func TestSparseStorage(t *testing.T) {
+	SetLogger(&testLogger{t: t})
+	defer SetLogger(nil)
+	SetAssert(&testAssert{t: t})
+	defer SetAssert(nil)
+	SetLogLevel(1)
+
+	rootPath, _ := ioutil.TempDir("", "longtaillib")
+	defer os.RemoveAll(rootPath)
+	fs := CreateFSStorageAPI()
+	defer fs.Dispose()
+	storageAPI := CreateSparseStorageAPI(fs, 65536)
+	defer storageAPI.Dispose()
+
+	// Stale content of a previous version must not show through the holes
+	errno := fs.WriteToStorage(rootPath, "file.bin", bytes.Repeat([]byte{0xff}, 300000))
+	if errno != 0 {
+		t.Fatalf("WriteToStorage() %d != %d", errno, 0)
+	}
+	data := append(randomArray(5000), make([]byte, 200000)...)
+	data = append(data, randomArray(100)...)
+	data = append(data, make([]byte, 70000)...)
+	errno = storageAPI.WriteToStorage(rootPath, "file.bin", data)
+	if errno != 0 {
+		t.Fatalf("WriteToStorage() %d != %d", errno, 0)
+	}
+	rbytes, errno := storageAPI.ReadFromStorage(rootPath, "file.bin")
+	if errno != 0 {
+		t.Fatalf("ReadFromStorage() %d != %d", errno, 0)
+	}
+	if !bytes.Equal(rbytes, data) {
+		t.Errorf("ReadFromStorage() %d bytes differ from the %d written", len(rbytes), len(data))
+	}
+}
+
 func TestAPICreate(t *testing.T) {
 	SetLogger(&testLogger{t: t})
 	defer SetLogger(nil)
@@ -267,6 +330,145 @@ func Test_ReadWriteStoredBlockBuffer(t *testing.T) {
 	validateStoredBlock(t, copyBlock, 0xdeadbeef)
 }
 
+func Test_ReadStoredBlock(t *testing.T) {
+	SetLogger(&testLogger{t: t})
+	defer SetLogger(nil)
+	SetAssert(&testAssert{t: t})
+	defer SetAssert(nil)
+	SetLogLevel(1)
+
+	originalBlock, errno := createStoredBlock(2, 0xdeadbeef)
+	if errno != 0 {
+		t.Errorf("createStoredBlock() %d != %d", errno, 0)
+	}
+	storedBlockData, errno := WriteStoredBlockToBuffer(originalBlock)
+	if errno != 0 {
+		t.Errorf("WriteStoredBlockToBuffer() %d != %d", errno, 0)
+	}
+	originalBlock.Dispose()
+
+	storageAPI := CreateInMemStorageAPI()
+	defer storageAPI.Dispose()
+	errno = storageAPI.WriteToStorage("blocks", "block.lsb", storedBlockData)
+	if errno != 0 {
+		t.Fatalf("WriteToStorage() %d != %d", errno, 0)
+	}
+	copyBlock, errno := ReadStoredBlock(storageAPI, "blocks/block.lsb")
+	if errno != 0 {
+		t.Fatalf("ReadStoredBlock() %d != %d", errno, 0)
+	}
+	defer copyBlock.Dispose()
+	validateStoredBlock(t, copyBlock, 0xdeadbeef)
+
+	_, errno = ReadStoredBlock(storageAPI, "blocks/missing.lsb")
+	if errno != ENOENT {
+		t.Errorf("ReadStoredBlock() missing block %d != %d", errno, ENOENT)
+	}
+}
+
+func Test_AppendStoredBlockToBuffer(t *testing.T) {
+	SetLogger(&testLogger{t: t})
+	defer SetLogger(nil)
+	SetAssert(&testAssert{t: t})
+	defer SetAssert(nil)
+	SetLogLevel(1)
+
+	originalBlock, errno := createStoredBlock(2, 0xdeadbeef)
+	if errno != 0 {
+		t.Errorf("createStoredBlock() %d != %d", errno, 0)
+	}
+	defer originalBlock.Dispose()
+
+	storedBlockData, errno := WriteStoredBlockToBuffer(originalBlock)
+	if errno != 0 {
+		t.Errorf("WriteStoredBlockToBuffer() %d != %d", errno, 0)
+	}
+
+	buffer := make([]byte, 0, len(storedBlockData)+16)
+	appendedData, errno := AppendStoredBlockToBuffer(buffer, originalBlock)
+	if errno != 0 {
+		t.Errorf("AppendStoredBlockToBuffer() %d != %d", errno, 0)
+	}
+	if &appendedData[0] != &buffer[:1][0] {
+		t.Errorf("AppendStoredBlockToBuffer() did not reuse the buffer")
+	}
+	if !bytes.Equal(appendedData, storedBlockData) {
+		t.Errorf("AppendStoredBlockToBuffer() data differs from WriteStoredBlockToBuffer()")
+	}
+
+	copyBlock, errno := ReadStoredBlockFromBuffer(appendedData)
+	if errno != 0 {
+		t.Errorf("ReadStoredBlockFromBuffer() %d != %d", errno, 0)
+	}
+	defer copyBlock.Dispose()
+	validateStoredBlock(t, copyBlock, 0xdeadbeef)
+}
+
+func Test_CopyStoredBlock(t *testing.T) {
+	SetLogger(&testLogger{t: t})
+	defer SetLogger(nil)
+	SetAssert(&testAssert{t: t})
+	defer SetAssert(nil)
+	SetLogLevel(1)
+
+	originalBlock, errno := createStoredBlock(2, 0xdeadbeef)
+	if errno != 0 {
+		t.Errorf("createStoredBlock() %d != %d", errno, 0)
+	}
+
+	copyBlock, errno := originalBlock.Copy()
+	if errno != 0 {
+		t.Errorf("Copy() %d != %d", errno, 0)
+	}
+	originalBlock.Dispose()
+	defer copyBlock.Dispose()
+	validateStoredBlock(t, copyBlock, 0xdeadbeef)
+
+	invalidBlock := Longtail_StoredBlock{}
+	_, errno = invalidBlock.Copy()
+	if errno != EINVAL {
+		t.Errorf("Copy() %d != %d", errno, EINVAL)
+	}
+}
+
+func Test_ShareStoredBlock(t *testing.T) {
+	SetLogger(&testLogger{t: t})
+	defer SetLogger(nil)
+	SetAssert(&testAssert{t: t})
+	defer SetAssert(nil)
+	SetLogLevel(1)
+
+	originalBlock, errno := createStoredBlock(2, 0xdeadbeef)
+	if errno != 0 {
+		t.Errorf("createStoredBlock() %d != %d", errno, 0)
+	}
+	originalData := originalBlock.GetChunksBlockData()
+
+	refs, errno := ShareStoredBlock(originalBlock, 3)
+	if errno != 0 {
+		t.Fatalf("ShareStoredBlock() %d != %d", errno, 0)
+	}
+	if len(refs) != 3 {
+		t.Fatalf("ShareStoredBlock() %d != %d", len(refs), 3)
+	}
+	for _, ref := range refs {
+		if &ref.GetChunksBlockData()[0] != &originalData[0] {
+			t.Errorf("ShareStoredBlock() reference does not share the block data")
+		}
+	}
+	// The remaining references must stay valid until they are disposed
+	refs[1].Dispose()
+	validateStoredBlock(t, refs[0], 0xdeadbeef)
+	refs[0].Dispose()
+	validateStoredBlock(t, refs[2], 0xdeadbeef)
+	refs[2].Dispose()
+
+	_, errno = ShareStoredBlock(Longtail_StoredBlock{}, 2)
+	if errno != EINVAL {
+		t.Errorf("ShareStoredBlock() %d != %d", errno, EINVAL)
+	}
+}
+
 func TestFSBlockStore(t *testing.T) {
 	SetLogger(&testLogger{t: t})
 	defer SetLogger(nil)
@@ -613,6 +815,111 @@ func TestBlockStoreProxy(t *testing.T) {
 	blockStoreProxy.Dispose()
 }
 
+// testXorCompression "compresses" by flipping bits so it is easy to verify that it was used
+type testXorCompression struct {
+	lock            sync.Mutex
+	compressCount   int
+	decompressCount int
+}
+
+func (c *testXorCompression) GetMaxCompressedSize(settingsID uint32, size int) int {
+	return size
+}
+
+func (c *testXorCompression) Compress(settingsID uint32, uncompressed []byte, compressed []byte) (int, int) {
+	c.lock.Lock()
+	c.compressCount++
+	c.lock.Unlock()
+	for i, b := range uncompressed {
+		compressed[i] = b ^ byte(settingsID)
+	}
+	return len(uncompressed), 0
+}
+
+func (c *testXorCompression) Decompress(compressed []byte, uncompressed []byte) (int, int) {
+	c.lock.Lock()
+	c.decompressCount++
+	c.lock.Unlock()
+	if len(compressed) > len(uncompressed) {
+		return 0, EINVAL
+	}
+	for i, b := range compressed {
+		uncompressed[i] = b ^ 0x5a
+	}
+	return len(compressed), 0
+}
+
+func TestCompressionAPIProxy(t *testing.T) {
+	SetLogger(&testLogger{t: t})
+	defer SetLogger(nil)
+	SetAssert(&testAssert{t: t})
+	defer SetAssert(nil)
+	SetLogLevel(1)
+
+	// createStoredBlock tags blocks with the chunk count + 10000, the tag selects the compression type
+	compressionType := uint32(3) + uint32(10000)
+	xor := &testXorCompression{}
+	errno := RegisterCompressionAPI(compressionType, 0x5a, xor)
+	if errno != 0 {
+		t.Fatalf("TestCompressionAPIProxy() RegisterCompressionAPI() %d != %d", errno, 0)
+	}
+	errno = RegisterCompressionAPI(compressionType, 0x5a, xor)
+	if errno != EEXIST {
+		t.Errorf("TestCompressionAPIProxy() RegisterCompressionAPI() again %d != %d", errno, EEXIST)
+	}
+	errno = RegisterCompressionAPI(GetZStdDefaultCompressionType(), 0, xor)
+	if errno != EEXIST {
+		t.Errorf("TestCompressionAPIProxy() RegisterCompressionAPI() zstd %d != %d", errno, EEXIST)
+	}
+
+	blockStore := &TestBlockStore{blocks: make(map[uint64]Longtail_StoredBlock), didClose: false}
+	blockStoreProxy := CreateBlockStoreAPI(blockStore)
+	blockStore.blockStoreAPI = blockStoreProxy
+	defer blockStoreProxy.Dispose()
+	compressionRegistry := CreateFullCompressionRegistry()
+	defer compressionRegistry.Dispose()
+	compressBlockStore := CreateCompressBlockStore(blockStoreProxy, compressionRegistry)
+	defer compressBlockStore.Dispose()
+
+	storedBlock, errno := createStoredBlock(3, 0xdeadbeef)
+	if errno != 0 {
+		t.Fatalf("TestCompressionAPIProxy() createStoredBlock() %d != %d", errno, 0)
+	}
+	defer storedBlock.Dispose()
+
+	putStoredBlockComplete := &testPutBlockCompletionAPI{}
+	putStoredBlockComplete.wg.Add(1)
+	errno = compressBlockStore.PutStoredBlock(storedBlock, CreateAsyncPutStoredBlockAPI(putStoredBlockComplete))
+	if errno != 0 {
+		t.Errorf("TestCompressionAPIProxy() PutStoredBlock() %d != %d", errno, 0)
+		putStoredBlockComplete.wg.Done()
+	}
+	putStoredBlockComplete.wg.Wait()
+	if putStoredBlockComplete.errno != 0 {
+		t.Errorf("TestCompressionAPIProxy() putStoredBlockComplete.errno %d != %d", putStoredBlockComplete.errno, 0)
+	}
+
+	getStoredBlockComplete := &testGetBlockCompletionAPI{}
+	storedBlockIndex := storedBlock.GetBlockIndex()
+	getStoredBlockComplete.wg.Add(1)
+	errno = compressBlockStore.GetStoredBlock(storedBlockIndex.GetBlockHash(), CreateAsyncGetStoredBlockAPI(getStoredBlockComplete))
+	if errno != 0 {
+		t.Errorf("TestCompressionAPIProxy() GetStoredBlock() %d != %d", errno, 0)
+		getStoredBlockComplete.wg.Done()
+	}
+	getStoredBlockComplete.wg.Wait()
+	if getStoredBlockComplete.errno != 0 {
+		t.Fatalf("TestCompressionAPIProxy() getStoredBlockComplete.errno %d != %d", getStoredBlockComplete.errno, 0)
+	}
+	getBlock := getStoredBlockComplete.storedBlock
+	defer getBlock.Dispose()
+	validateStoredBlock(t, getBlock, 0xdeadbeef)
+
+	if xor.compressCount != 1 || xor.decompressCount != 1 {
+		t.Errorf("TestCompressionAPIProxy() compress count %d, decompress count %d != %d, %d", xor.compressCount, xor.decompressCount, 1, 1)
+	}
+}
+
 type testPathFilter struct {
 }
 
@@ -774,6 +1081,94 @@ func TestCreateVersionIndex(t *testing.T) {
 	}
 }
 
+func TestBuildVersionIndex(t *testing.T) {
+	storageAPI := createFilledStorage("content")
+	fileInfos, errno := GetFilesRecursively(storageAPI, Longtail_PathFilterAPI{}, "content")
+	if errno != 0 {
+		t.Errorf("TestBuildVersionIndex() GetFilesRecursively() %d != %d", errno, 0)
+	}
+	hashAPI := CreateBlake2HashAPI()
+	defer hashAPI.Dispose()
+	chunkerAPI := CreateHPCDCChunkerAPI()
+	defer chunkerAPI.Dispose()
+	jobAPI := CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+
+	versionIndex, errno := CreateVersionIndex(
+		storageAPI,
+		hashAPI,
+		chunkerAPI,
+		jobAPI,
+		nil,
+		"content",
+		fileInfos,
+		make([]uint32, fileInfos.GetFileCount()),
+		32768)
+	if errno != 0 {
+		t.Fatalf("TestBuildVersionIndex() CreateVersionIndex() %d != %d", errno, 0)
+	}
+	defer versionIndex.Dispose()
+
+	assetCount := versionIndex.GetAssetCount()
+	assetPaths := make([]string, assetCount)
+	assetPermissions := make([]uint16, assetCount)
+	pathHashes := make([]uint64, assetCount)
+	for a := uint32(0); a < assetCount; a++ {
+		assetPaths[a] = versionIndex.GetAssetPath(a)
+		assetPermissions[a] = versionIndex.GetAssetPermissions(a)
+		pathHashes[a], errno = hashAPI.GetPathHash(assetPaths[a])
+		if errno != 0 {
+			t.Errorf("TestBuildVersionIndex() GetPathHash() %d != %d", errno, 0)
+		}
+	}
+	builtVersionIndex, errno := BuildVersionIndex(
+		versionIndex.GetHashIdentifier(),
+		versionIndex.GetTargetChunkSize(),
+		assetPaths,
+		versionIndex.GetAssetSizes(),
+		assetPermissions,
+		pathHashes,
+		versionIndex.GetAssetHashes(),
+		versionIndex.GetAssetChunkIndexStarts(),
+		versionIndex.GetAssetChunkCounts(),
+		versionIndex.GetAssetChunkIndexes(),
+		versionIndex.GetChunkHashes(),
+		versionIndex.GetChunkSizes(),
+		versionIndex.GetChunkTags())
+	if errno != 0 {
+		t.Fatalf("TestBuildVersionIndex() BuildVersionIndex() %d != %d", errno, 0)
+	}
+	defer builtVersionIndex.Dispose()
+	original, _ := WriteVersionIndexToBuffer(versionIndex)
+	built, _ := WriteVersionIndexToBuffer(builtVersionIndex)
+	if !bytes.Equal(original, built) {
+		t.Errorf("TestBuildVersionIndex() BuildVersionIndex() version index differs")
+	}
+}
+
+func TestCreateBlockIndex(t *testing.T) {
+	blockIndex, errno := CreateBlockIndex(0xdeadbeef, GetBlake3HashIdentifier(), 7, []uint64{1, 2, 3}, []uint32{10, 20, 30})
+	if errno != 0 {
+		t.Fatalf("TestCreateBlockIndex() CreateBlockIndex() %d != %d", errno, 0)
+	}
+	defer blockIndex.Dispose()
+	if blockIndex.GetBlockHash() != 0xdeadbeef || blockIndex.GetTag() != 7 || blockIndex.GetChunkCount() != 3 || blockIndex.GetChunkSizes()[2] != 30 {
+		t.Errorf("TestCreateBlockIndex() CreateBlockIndex() block 0x%x tag %d chunks %d", blockIndex.GetBlockHash(), blockIndex.GetTag(), blockIndex.GetChunkCount())
+	}
+	storeIndex, errno := CreateStoreIndexFromBlocks([]Longtail_BlockIndex{blockIndex})
+	if errno != 0 {
+		t.Fatalf("TestCreateBlockIndex() CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer storeIndex.Dispose()
+	if storeIndex.GetBlockCount() != 1 || storeIndex.GetChunkCount() != 3 {
+		t.Errorf("TestCreateBlockIndex() CreateStoreIndexFromBlocks() %d blocks %d chunks", storeIndex.GetBlockCount(), storeIndex.GetChunkCount())
+	}
+	_, errno = CreateBlockIndex(0xdeadbeef, GetBlake3HashIdentifier(), 7, []uint64{1, 2}, []uint32{10})
+	if errno != EINVAL {
+		t.Errorf("TestCreateBlockIndex() CreateBlockIndex() mismatched chunks %d != %d", errno, EINVAL)
+	}
+}
+
 func TestRewriteVersion(t *testing.T) {
 	storageAPI := createFilledStorage("content")
 	fileInfos, errno := GetFilesRecursively(storageAPI, Longtail_PathFilterAPI{}, "content")
@@ -0,0 +1,269 @@
+package longtailstorelib
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// Block access counts are gathered by the remote block store, added to a file per store on the
+// machine when the store is closed and uploaded to the store as access/<unix nano time>-<random>.json
+// once the file is older than the upload interval, see WithBlockAccessTracking. Uploads from many
+// machines never conflict and are summed by QueryBlockAccess.
+const accessPath = "access"
+
+// DefaultBlockAccessUploadInterval is how long block access counts are gathered on a machine
+// before they are uploaded unless another interval is given
+const DefaultBlockAccessUploadInterval = 24 * time.Hour
+
+// BlockAccessLog is the number of times each block was read since Since. Counts is keyed by the
+// block hash formatted as 0x%016x.
+type BlockAccessLog struct {
+	Store  string            `json:"store"`
+	Since  time.Time         `json:"since"`
+	Counts map[string]uint64 `json:"counts"`
+}
+
+func (accessLog *BlockAccessLog) add(counts map[uint64]uint64) {
+	if accessLog.Counts == nil {
+		accessLog.Counts = map[string]uint64{}
+	}
+	for blockHash, count := range counts {
+		accessLog.Counts[fmt.Sprintf("0x%016x", blockHash)] += count
+	}
+}
+
+// blockAccessCounter counts the reads of blocks by a remote block store
+type blockAccessCounter struct {
+	sync.Mutex
+	counts map[uint64]uint64
+}
+
+func newBlockAccessCounter() *blockAccessCounter {
+	return &blockAccessCounter{counts: map[uint64]uint64{}}
+}
+
+// add counts a read of blockHash, a nil blockAccessCounter counts nothing
+func (c *blockAccessCounter) add(blockHash uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.counts[blockHash]++
+}
+
+// take returns the counts and starts over
+func (c *blockAccessCounter) take() map[uint64]uint64 {
+	c.Lock()
+	defer c.Unlock()
+	counts := c.counts
+	c.counts = map[uint64]uint64{}
+	return counts
+}
+
+// blockAccessLogPath is the file in dir that gathers the counts of store
+func blockAccessLogPath(dir string, store string) string {
+	hash := sha256.Sum256([]byte(store))
+	return filepath.Join(dir, hex.EncodeToString(hash[:8])+".json")
+}
+
+// ReadBlockAccessLog reads the block access counts of store gathered in dir that have not been
+// uploaded yet, a missing file is an empty log
+func ReadBlockAccessLog(dir string, store string) (BlockAccessLog, error) {
+	path := blockAccessLogPath(dir, store)
+	accessLog := BlockAccessLog{Store: store}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return accessLog, nil
+	}
+	if err != nil {
+		return accessLog, errors.Wrap(err, "ReadBlockAccessLog")
+	}
+	err = json.Unmarshal(data, &accessLog)
+	if err != nil {
+		return BlockAccessLog{Store: store}, errors.Wrapf(err, "ReadBlockAccessLog: `%s` is malformed", path)
+	}
+	return accessLog, nil
+}
+
+// uploadBlockAccessLog writes accessLog to the access/ prefix of the store
+func uploadBlockAccessLog(blobClient BlobClient, accessLog BlockAccessLog, now time.Time) error {
+	data, err := json.Marshal(accessLog)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	key := fmt.Sprintf("%s/%020d-%s.json", accessPath, now.UnixNano(), hex.EncodeToString(suffix))
+	objHandle, err := blobClient.NewObject(key)
+	if err != nil {
+		return err
+	}
+	_, err = objHandle.Write(data)
+	return err
+}
+
+// recordBlockAccess adds counts to the access log of the store in options.BlockAccessDir and
+// uploads the log if it is older than the upload interval. The file is locked while it is updated
+// so several processes can share it, a failed upload is retried by a later session.
+func recordBlockAccess(blobClient BlobClient, options StoreOptions, counts map[uint64]uint64, now time.Time) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	store := blobClient.String()
+	path := blockAccessLogPath(options.BlockAccessDir, store)
+	err := os.MkdirAll(options.BlockAccessDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "recordBlockAccess")
+	}
+	lock, err := acquireFSLock(path)
+	if err != nil {
+		return errors.Wrap(err, "recordBlockAccess")
+	}
+	defer lock.release()
+	accessLog, err := ReadBlockAccessLog(options.BlockAccessDir, store)
+	if err != nil {
+		return errors.Wrap(err, "recordBlockAccess")
+	}
+	if accessLog.Since.IsZero() {
+		accessLog.Since = now
+	}
+	accessLog.add(counts)
+
+	interval := options.BlockAccessUploadInterval
+	if interval == 0 {
+		interval = DefaultBlockAccessUploadInterval
+	}
+	if !now.Before(accessLog.Since.Add(interval)) {
+		err = uploadBlockAccessLog(blobClient, accessLog, now)
+		if err == nil {
+			accessLog = BlockAccessLog{Store: store, Since: now, Counts: map[string]uint64{}}
+		} else {
+			log.Printf("WARNING: Failed to upload block access counts to %s, they are kept in `%s`: %v\n", store, path, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(accessLog, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "recordBlockAccess")
+	}
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "recordBlockAccess")
+	}
+	return errors.Wrap(renameWithRetry(tmpPath, path), "recordBlockAccess")
+}
+
+// BlockAccessStats is the number of reads of a block in a BlockAccessReport
+type BlockAccessStats struct {
+	BlockHash uint64
+	Count     uint64
+}
+
+// BlockAccessReport is the reads of the blocks of a store that were uploaded from all machines
+type BlockAccessReport struct {
+	// Since is the start of the oldest uploaded counts, zero if none have been uploaded
+	Since time.Time
+	// UploadCount is the number of uploaded access logs that were summed
+	UploadCount int
+	// Blocks has every block in the store index, blocks that were never read have a Count of zero.
+	// The most read blocks come first.
+	Blocks []BlockAccessStats
+}
+
+// Hot returns the blocks read at least minCount times, candidates for pinning in a CDN
+func (r BlockAccessReport) Hot(minCount uint64) []BlockAccessStats {
+	i := sort.Search(len(r.Blocks), func(i int) bool { return r.Blocks[i].Count < minCount })
+	return r.Blocks[:i]
+}
+
+// Cold returns the blocks read fewer than maxCount times, candidates for archive tiering
+func (r BlockAccessReport) Cold(maxCount uint64) []BlockAccessStats {
+	i := sort.Search(len(r.Blocks), func(i int) bool { return r.Blocks[i].Count < maxCount })
+	return r.Blocks[i:]
+}
+
+// QueryBlockAccess sums the block access counts uploaded to the store, see WithBlockAccessTracking.
+// Counts of blocks that are no longer in the store index are left out.
+func QueryBlockAccess(ctx context.Context, blobStore BlobStore) (BlockAccessReport, error) {
+	report := BlockAccessReport{}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	storeIndex, err := readStoreIndexObject(blobClient, "store.lsi")
+	if err != nil {
+		return report, errors.Wrapf(err, "QueryBlockAccess: %s", blobStore.String())
+	}
+	if !storeIndex.IsValid() {
+		return report, errors.Wrapf(longtaillib.ErrENOENT, "QueryBlockAccess: %s has no store index", blobStore.String())
+	}
+	counts := map[uint64]uint64{}
+	for _, blockHash := range storeIndex.GetBlockHashes() {
+		counts[blockHash] = 0
+	}
+	storeIndex.Dispose()
+
+	err = forEachObject(ctx, blobClient, accessPath+"/", func(blob BlobProperties) error {
+		objHandle, err := blobClient.NewObject(blob.Name)
+		if err != nil {
+			return err
+		}
+		data, err := objHandle.Read()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read `%s`", blob.Name)
+		}
+		var accessLog BlockAccessLog
+		err = json.Unmarshal(data, &accessLog)
+		if err != nil {
+			return errors.Wrapf(err, "`%s` is malformed", blob.Name)
+		}
+		for key, count := range accessLog.Counts {
+			blockHash, err := strconv.ParseUint(key, 0, 64)
+			if err != nil {
+				return errors.Wrapf(err, "`%s` has an invalid block hash", blob.Name)
+			}
+			if _, exists := counts[blockHash]; exists {
+				counts[blockHash] += count
+			}
+		}
+		if report.Since.IsZero() || accessLog.Since.Before(report.Since) {
+			report.Since = accessLog.Since
+		}
+		report.UploadCount++
+		return nil
+	})
+	if err != nil {
+		return report, errors.Wrapf(err, "QueryBlockAccess: %s", blobStore.String())
+	}
+
+	report.Blocks = make([]BlockAccessStats, 0, len(counts))
+	for blockHash, count := range counts {
+		report.Blocks = append(report.Blocks, BlockAccessStats{BlockHash: blockHash, Count: count})
+	}
+	sort.Slice(report.Blocks, func(i, j int) bool {
+		if report.Blocks[i].Count != report.Blocks[j].Count {
+			return report.Blocks[i].Count > report.Blocks[j].Count
+		}
+		return report.Blocks[i].BlockHash < report.Blocks[j].BlockHash
+	})
+	return report, nil
+}
@@ -0,0 +1,81 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestBlockAccessTracking(t *testing.T) {
+	accessDir, err := ioutil.TempDir("", "longtail_access_test")
+	if err != nil {
+		t.Fatalf("TestBlockAccessTracking() ioutil.TempDir() %v", err)
+	}
+	defer os.RemoveAll(accessDir)
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blobStore := createDedupTestStore(t, jobs, []uint8{0, 10, 20})
+	hotBlockHash := uint64(10) + 21412151
+	readBlockHash := uint64(20) + 21412151
+
+	// The reads of a session are gathered on the machine when the store is closed
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly, WithBlockAccessTracking(accessDir, time.Hour))
+	if err != nil {
+		t.Fatalf("TestBlockAccessTracking() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	for _, blockHash := range []uint64{hotBlockHash, hotBlockHash, readBlockHash} {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+		if errno != 0 {
+			t.Fatalf("TestBlockAccessTracking() fetchBlockFromStore(0x%016x) %d != %d", blockHash, errno, 0)
+		}
+		storedBlock.Dispose()
+	}
+	storeAPI.Dispose()
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	accessLog, err := ReadBlockAccessLog(accessDir, client.String())
+	if err != nil {
+		t.Fatalf("TestBlockAccessTracking() ReadBlockAccessLog() %v != %v", err, nil)
+	}
+	if len(accessLog.Counts) != 2 || accessLog.Counts["0x000000000146b941"] != 2 || accessLog.Since.IsZero() {
+		t.Errorf("TestBlockAccessTracking() ReadBlockAccessLog() %v", accessLog)
+	}
+	report, err := QueryBlockAccess(context.Background(), blobStore)
+	if err != nil || report.UploadCount != 0 {
+		t.Errorf("TestBlockAccessTracking() QueryBlockAccess() %v, %v", report, err)
+	}
+
+	// The counts are uploaded once they are older than the upload interval
+	options := StoreOptions{BlockAccessDir: accessDir, BlockAccessUploadInterval: time.Hour}
+	err = recordBlockAccess(client, options, map[uint64]uint64{hotBlockHash: 1, 0x1234: 5}, accessLog.Since.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("TestBlockAccessTracking() recordBlockAccess() %v != %v", err, nil)
+	}
+	accessLog, _ = ReadBlockAccessLog(accessDir, client.String())
+	if len(accessLog.Counts) != 0 {
+		t.Errorf("TestBlockAccessTracking() ReadBlockAccessLog() after upload %v", accessLog)
+	}
+
+	report, err = QueryBlockAccess(context.Background(), blobStore)
+	if err != nil {
+		t.Fatalf("TestBlockAccessTracking() QueryBlockAccess() %v != %v", err, nil)
+	}
+	if report.UploadCount != 1 || len(report.Blocks) != 3 || report.Since.IsZero() {
+		t.Fatalf("TestBlockAccessTracking() QueryBlockAccess() %v", report)
+	}
+	if report.Blocks[0].BlockHash != hotBlockHash || report.Blocks[0].Count != 3 || report.Blocks[1].BlockHash != readBlockHash || report.Blocks[1].Count != 1 || report.Blocks[2].Count != 0 {
+		t.Errorf("TestBlockAccessTracking() QueryBlockAccess() blocks %v", report.Blocks)
+	}
+	if hot := report.Hot(2); len(hot) != 1 || hot[0].BlockHash != hotBlockHash {
+		t.Errorf("TestBlockAccessTracking() Hot(2) %v", hot)
+	}
+	if cold := report.Cold(1); len(cold) != 1 || cold[0].BlockHash != uint64(0)+21412151 {
+		t.Errorf("TestBlockAccessTracking() Cold(1) %v", cold)
+	}
+}
@@ -0,0 +1,160 @@
+package longtailstorelib
+
+import (
+	"math"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// AdaptiveCompressionType is the compression type of blocks compressed with the adaptive algorithm,
+// it samples the entropy of each block and stores it uncompressed, with lz4 or with zstd max
+const AdaptiveCompressionType = uint32(0x61647430) // "adt0"
+
+// The method used for a block is stored in the first byte of its compressed data
+const (
+	adaptiveMethodStored = 0
+	adaptiveMethodFast   = 1
+	adaptiveMethodMax    = 2
+)
+
+const (
+	// Blocks sampled above adaptiveStoredEntropy bits per byte are not worth compressing, typically
+	// already compressed content such as archives, video and compressed textures
+	adaptiveStoredEntropy = 7.5
+	// Blocks sampled above adaptiveFastEntropy bits per byte gain little from the slower compressor
+	adaptiveFastEntropy = 6.0
+	adaptiveSampleSize  = 4096
+	adaptiveSampleCount = 16
+)
+
+// adaptiveCompression is registered with longtaillib so any compression registry created by the
+// process can write and read adaptive blocks
+type adaptiveCompression struct {
+	once         sync.Once
+	errno        int
+	registry     longtaillib.Longtail_CompressionRegistryAPI
+	fast         longtaillib.Longtail_CompressionAPI
+	fastSettings uint32
+	max          longtaillib.Longtail_CompressionAPI
+	maxSettings  uint32
+}
+
+func init() {
+	longtaillib.RegisterCompressionAPI(AdaptiveCompressionType, 0, &adaptiveCompression{})
+}
+
+// init creates the lz4 and zstd compression APIs on first use, they live as long as the process
+func (c *adaptiveCompression) init() int {
+	c.once.Do(func() {
+		c.registry = longtaillib.CreateFullCompressionRegistry()
+		c.fast, c.fastSettings, c.errno = c.registry.GetCompressionAPI(longtaillib.GetLZ4DefaultCompressionType())
+		if c.errno != 0 {
+			return
+		}
+		c.max, c.maxSettings, c.errno = c.registry.GetCompressionAPI(longtaillib.GetZStdMaxCompressionType())
+	})
+	return c.errno
+}
+
+func (c *adaptiveCompression) GetMaxCompressedSize(settingsID uint32, size int) int {
+	maxSize := size
+	if c.init() == 0 {
+		if fastSize := c.fast.GetMaxCompressedSize(c.fastSettings, size); fastSize > maxSize {
+			maxSize = fastSize
+		}
+		if maxCompressedSize := c.max.GetMaxCompressedSize(c.maxSettings, size); maxCompressedSize > maxSize {
+			maxSize = maxCompressedSize
+		}
+	}
+	return 1 + maxSize
+}
+
+func (c *adaptiveCompression) Compress(settingsID uint32, uncompressed []byte, compressed []byte) (int, int) {
+	if errno := c.init(); errno != 0 {
+		return 0, errno
+	}
+	if len(compressed) < 1+len(uncompressed) {
+		return 0, longtaillib.EINVAL
+	}
+	method := adaptiveMethod(sampleEntropy(uncompressed))
+	if method != adaptiveMethodStored {
+		api, settings := c.fast, c.fastSettings
+		if method == adaptiveMethodMax {
+			api, settings = c.max, c.maxSettings
+		}
+		size, errno := api.Compress(settings, uncompressed, compressed[1:])
+		// Blocks that did not shrink are stored, reading them back is faster
+		if errno == 0 && size < len(uncompressed) {
+			compressed[0] = byte(method)
+			return 1 + size, 0
+		}
+	}
+	compressed[0] = adaptiveMethodStored
+	return 1 + copy(compressed[1:], uncompressed), 0
+}
+
+func (c *adaptiveCompression) Decompress(compressed []byte, uncompressed []byte) (int, int) {
+	if len(compressed) < 1 {
+		return 0, longtaillib.EBADF
+	}
+	switch compressed[0] {
+	case adaptiveMethodStored:
+		if len(compressed)-1 > len(uncompressed) {
+			return 0, longtaillib.EBADF
+		}
+		return copy(uncompressed, compressed[1:]), 0
+	case adaptiveMethodFast, adaptiveMethodMax:
+		if errno := c.init(); errno != 0 {
+			return 0, errno
+		}
+		if compressed[0] == adaptiveMethodFast {
+			return c.fast.Decompress(compressed[1:], uncompressed)
+		}
+		return c.max.Decompress(compressed[1:], uncompressed)
+	}
+	return 0, longtaillib.EBADF
+}
+
+// adaptiveMethod picks the compression method for a block with the sampled entropy
+func adaptiveMethod(entropy float64) int {
+	if entropy > adaptiveStoredEntropy {
+		return adaptiveMethodStored
+	}
+	if entropy > adaptiveFastEntropy {
+		return adaptiveMethodFast
+	}
+	return adaptiveMethodMax
+}
+
+// sampleEntropy returns the Shannon entropy in bits per byte of adaptiveSampleCount samples spread
+// evenly over data, all of data is used when it is smaller than the samples
+func sampleEntropy(data []byte) float64 {
+	var histogram [256]int
+	count := 0
+	if len(data) <= adaptiveSampleSize*adaptiveSampleCount {
+		for _, b := range data {
+			histogram[b]++
+		}
+		count = len(data)
+	} else {
+		step := len(data) / adaptiveSampleCount
+		for s := 0; s < adaptiveSampleCount; s++ {
+			for _, b := range data[s*step : s*step+adaptiveSampleSize] {
+				histogram[b]++
+			}
+		}
+		count = adaptiveSampleSize * adaptiveSampleCount
+	}
+	if count == 0 {
+		return 0
+	}
+	entropy := 0.0
+	for _, n := range histogram {
+		if n > 0 {
+			p := float64(n) / float64(count)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
@@ -0,0 +1,77 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/storeformat"
+)
+
+func TestSampleEntropy(t *testing.T) {
+	if entropy := sampleEntropy(make([]byte, 1<<20)); entropy != 0 {
+		t.Errorf("TestSampleEntropy() zeros %f != %f", entropy, 0.0)
+	}
+	random := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	if entropy := sampleEntropy(random); entropy < adaptiveStoredEntropy {
+		t.Errorf("TestSampleEntropy() random %f < %f", entropy, adaptiveStoredEntropy)
+	}
+	if entropy := sampleEntropy([]byte("abab")); entropy != 1 {
+		t.Errorf("TestSampleEntropy() abab %f != %f", entropy, 1.0)
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	// Repeats of a seven bit random sequence sample at about seven bits per byte but compress well
+	sequence := make([]byte, 4096)
+	for i := range sequence {
+		sequence[i] = byte(random.Intn(128))
+	}
+	tests := []struct {
+		name   string
+		byteFn func(i int) byte
+		method byte
+	}{
+		{"random", func(i int) byte { return byte(random.Intn(256)) }, adaptiveMethodStored},
+		{"seven bit", func(i int) byte { return sequence[i%len(sequence)] }, adaptiveMethodFast},
+		{"text", func(i int) byte { return "the quick brown fox "[i%20] }, adaptiveMethodMax},
+	}
+
+	codec := newBlockCodec()
+	defer codec.dispose()
+	for n, test := range tests {
+		data := make([]byte, 256*1024)
+		for i := range data {
+			data[i] = test.byteFn(i)
+		}
+		blockHash := uint64(0x1234) + uint64(n)
+		storedBlock, errno := longtaillib.CreateStoredBlock(blockHash, 0xdeadbeef, AdaptiveCompressionType, []uint64{blockHash}, []uint32{uint32(len(data))}, data, false)
+		if errno != 0 {
+			t.Fatalf("TestAdaptiveCompression() CreateStoredBlock(%s) %d != %d", test.name, errno, 0)
+		}
+		blob, errno := codec.encode(storedBlock)
+		storedBlock.Dispose()
+		if errno != 0 {
+			t.Fatalf("TestAdaptiveCompression() encode(%s) %d != %d", test.name, errno, 0)
+		}
+		_, blockData, err := storeformat.ReadBlock(blob)
+		if err != nil {
+			t.Fatalf("TestAdaptiveCompression() ReadBlock(%s) %v != %v", test.name, err, nil)
+		}
+		if blockData.Data[0] != test.method {
+			t.Errorf("TestAdaptiveCompression() %s method %d != %d", test.name, blockData.Data[0], test.method)
+		}
+
+		decoded, errno := codec.decode(blockHash, blob)
+		if errno != 0 {
+			t.Fatalf("TestAdaptiveCompression() decode(%s) %d != %d", test.name, errno, 0)
+		}
+		if !bytes.Equal(decoded.GetChunksBlockData(), data) {
+			t.Errorf("TestAdaptiveCompression() %s decoded data differs", test.name)
+		}
+		decoded.Dispose()
+	}
+}
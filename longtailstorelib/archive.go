@@ -0,0 +1,79 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveStore moves the blocks that are not needed for keepChunkHashes to the cold storageClass,
+// an empty storageClass uses the coldest class of the store. The blocks stay in the store index so
+// older versions can still be restored, reading an archived block fails with a BlockArchivedError
+// unless the remote block store is created with WithRestoreArchived.
+// Nothing is changed if dryRun is set. Returns the hashes of the archived blocks.
+func ArchiveStore(
+	ctx context.Context,
+	blobStore BlobStore,
+	keepChunkHashes []uint64,
+	storageClass string,
+	dryRun bool,
+	opts ...StoreOption) ([]uint64, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	key := "store.lsi"
+	objHandle, err := blobClient.NewObject(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ArchiveStore: blobClient.NewObject(%s) failed", key)
+	}
+	blob, err := objHandle.Read()
+	if err != nil {
+		return nil, errors.Wrapf(err, "ArchiveStore: objHandle.Read(%s) failed", key)
+	}
+	storeIndex, err := readStoreIndexData(blobStore.String(), key, blob)
+	if err != nil {
+		return nil, errors.Wrap(err, "ArchiveStore")
+	}
+	keepStoreIndex, unusedBlockHashes, err := splitStoreIndex(storeIndex, keepChunkHashes)
+	storeIndex.Dispose()
+	if err != nil {
+		return nil, errors.Wrap(err, "ArchiveStore")
+	}
+	keepStoreIndex.Dispose()
+
+	if dryRun {
+		return unusedBlockHashes, nil
+	}
+
+	layout, err := readBlockLayout(blobClient)
+	if err != nil {
+		return nil, errors.Wrap(err, "ArchiveStore")
+	}
+	var archivedBlockHashes []uint64
+	defer func() {
+		if len(archivedBlockHashes) > 0 {
+			recordAudit(blobClient, resolveStoreOptions(blobStore, opts), AuditEntry{Operation: AuditArchive, ArchivedBlockCount: len(archivedBlockHashes)})
+		}
+	}()
+	for _, blockHash := range unusedBlockHashes {
+		path := layout.BlockPath("chunks", blockHash)
+		blockObject, err := blobClient.NewObject(path)
+		if err != nil {
+			return archivedBlockHashes, errors.Wrapf(err, "ArchiveStore: blobClient.NewObject(%s) failed", path)
+		}
+		archivable, ok := blockObject.(ArchivableBlobObject)
+		if !ok {
+			return archivedBlockHashes, fmt.Errorf("ArchiveStore: %s does not support storage classes", blobStore.String())
+		}
+		err = archivable.Archive(storageClass)
+		if err != nil {
+			return archivedBlockHashes, errors.Wrapf(err, "ArchiveStore: failed to archive block 0x%016x", blockHash)
+		}
+		archivedBlockHashes = append(archivedBlockHashes, blockHash)
+	}
+	return archivedBlockHashes, nil
+}
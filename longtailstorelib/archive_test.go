@@ -0,0 +1,75 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestArchiveAndRestore(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestArchiveAndRestore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	keptBlockHash, _ := storeBlockFromSeed(t, storeAPI, 0)
+	archivedBlockHash, _ := storeBlockFromSeed(t, storeAPI, 10)
+	storeAPI.Dispose()
+
+	keepChunkHashes := []uint64{uint64(0) + 1}
+	archivedBlockHashes, err := ArchiveStore(context.Background(), blobStore, keepChunkHashes, "", true)
+	if err != nil || len(archivedBlockHashes) != 1 || archivedBlockHashes[0] != archivedBlockHash {
+		t.Errorf("TestArchiveAndRestore() ArchiveStore() dry run %v, %v != %v, [0x%016x]", err, archivedBlockHashes, nil, archivedBlockHash)
+	}
+	archivedBlockHashes, err = ArchiveStore(context.Background(), blobStore, keepChunkHashes, "", false)
+	if err != nil || len(archivedBlockHashes) != 1 || archivedBlockHashes[0] != archivedBlockHash {
+		t.Errorf("TestArchiveAndRestore() ArchiveStore() %v, %v != %v, [0x%016x]", err, archivedBlockHashes, nil, archivedBlockHash)
+	}
+
+	remoteStore, err = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly)
+	if err != nil {
+		t.Fatalf("TestArchiveAndRestore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, keptBlockHash)
+	if errno != 0 {
+		t.Errorf("TestArchiveAndRestore() fetchBlockFromStore(0x%016x) %d != %d", keptBlockHash, errno, 0)
+	} else {
+		storedBlock.Dispose()
+	}
+	_, errno = fetchBlockFromStore(t, storeAPI, archivedBlockHash)
+	if errno != longtaillib.EACCES {
+		t.Errorf("TestArchiveAndRestore() fetchBlockFromStore(0x%016x) archived %d != %d", archivedBlockHash, errno, longtaillib.EACCES)
+	}
+	storeAPI.Dispose()
+
+	remoteStore, err = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly, WithRestoreArchived(0, time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestArchiveAndRestore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	_, errno = fetchBlockFromStore(t, storeAPI, archivedBlockHash)
+	if errno != longtaillib.EACCES {
+		t.Errorf("TestArchiveAndRestore() fetchBlockFromStore(0x%016x) restore timeout %d != %d", archivedBlockHash, errno, longtaillib.EACCES)
+	}
+	storeAPI.Dispose()
+
+	remoteStore, err = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly, WithRestoreArchived(time.Minute, time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestArchiveAndRestore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	storedBlock, errno = fetchBlockFromStore(t, storeAPI, archivedBlockHash)
+	if errno != 0 {
+		t.Fatalf("TestArchiveAndRestore() fetchBlockFromStore(0x%016x) restore %d != %d", archivedBlockHash, errno, 0)
+	}
+	validateBlockFromSeed(t, 10, storedBlock)
+	storedBlock.Dispose()
+}
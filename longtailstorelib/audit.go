@@ -0,0 +1,151 @@
+package longtailstorelib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Audit entries are written as one object each to audit/<unix nano time>-<random>.json so the log
+// is append-only and entries from concurrent writers never conflict
+const auditPath = "audit"
+
+// Operations recorded in the audit log
+const (
+	AuditUpload        = "upload"
+	AuditPrune         = "prune"
+	AuditCompact       = "compact"
+	AuditUndelete      = "undelete"
+	AuditPurgeTrash    = "purge-trash"
+	AuditArchive       = "archive"
+	AuditRecoverIndex  = "recover-index"
+	AuditRebuildIndex  = "rebuild-index"
+	AuditMigrateLayout = "migrate-layout"
+	AuditScrub         = "scrub"
+	AuditMigrateStore  = "migrate-store"
+	AuditPack          = "pack"
+)
+
+// AuditEntry is a mutation of a store recorded in its audit log, see WithAuditLog
+type AuditEntry struct {
+	Time              time.Time `json:"time"`
+	Identity          string    `json:"identity"`
+	Operation         string    `json:"operation"`
+	AddedBlockCount   int       `json:"addedBlockCount,omitempty"`
+	RemovedBlockCount int       `json:"removedBlockCount,omitempty"`
+	// ArchivedBlockCount is the number of blocks moved to a cold storage class, see ArchiveStore
+	ArchivedBlockCount int `json:"archivedBlockCount,omitempty"`
+	// PackedBlockCount is the number of blocks moved into packs, see PackStoreBlocks
+	PackedBlockCount int `json:"packedBlockCount,omitempty"`
+	// RepairedBlockCount is the number of corrupt or missing blocks replaced from a mirror, see ScrubStore
+	RepairedBlockCount int `json:"repairedBlockCount,omitempty"`
+	// IndexBlockCount is the number of blocks in the store index after the operation, zero if the index was not changed
+	IndexBlockCount int `json:"indexBlockCount,omitempty"`
+	// IndexGeneration is the backend generation of the store index after the operation, zero if the backend has none
+	IndexGeneration int64 `json:"indexGeneration,omitempty"`
+}
+
+// generationBlobObject is implemented by blob objects of backends that version objects
+type generationBlobObject interface {
+	Generation() (int64, error)
+}
+
+// storeOptionsProvider is implemented by blob stores that keep the options they were created with
+type storeOptionsProvider interface {
+	storeOptions() StoreOptions
+}
+
+// resolveStoreOptions returns the options of blobStore, which include the options from the URI of
+// the store, with opts applied on top
+func resolveStoreOptions(blobStore BlobStore, opts []StoreOption) StoreOptions {
+	options := StoreOptions{}
+	if provider, ok := blobStore.(storeOptionsProvider); ok {
+		options = provider.storeOptions()
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+func getAuditEntryPath(entry AuditEntry) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s/%020d-%s.json", auditPath, entry.Time.UnixNano(), hex.EncodeToString(suffix))
+}
+
+// recordAudit appends entry to the audit log of the store if options.AuditLog is set. The
+// operation has already been made so a failure to record it is logged instead of returned.
+func recordAudit(blobClient BlobClient, options StoreOptions, entry AuditEntry) {
+	if !options.AuditLog {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.Identity = storeIdentity(options)
+	if objHandle, err := blobClient.NewObject("store.lsi"); err == nil {
+		if versioned, ok := objHandle.(generationBlobObject); ok {
+			entry.IndexGeneration, _ = versioned.Generation()
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		var objHandle BlobObject
+		objHandle, err = blobClient.NewObject(getAuditEntryPath(entry))
+		if err == nil {
+			_, err = objHandle.Write(data)
+		}
+	}
+	if err != nil {
+		log.Printf("WARNING: Failed to record %s of %s in audit log: %v\n", entry.Operation, blobClient.String(), err)
+	}
+}
+
+// QueryAuditLog returns the entries of the audit log of the store made at or after since, oldest first.
+// All entries are returned if since is zero and only entries of operation if it is not empty.
+func QueryAuditLog(
+	ctx context.Context,
+	blobStore BlobStore,
+	since time.Time,
+	operation string) ([]AuditEntry, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	blobs, err := listObjects(ctx, blobClient, auditPath+"/")
+	if err != nil {
+		return nil, errors.Wrapf(err, "QueryAuditLog: failed to list audit log of %s", blobStore.String())
+	}
+	entries := []AuditEntry{}
+	for _, blob := range blobs {
+		objHandle, err := blobClient.NewObject(blob.Name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := objHandle.Read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "QueryAuditLog: failed to read `%s`", blob.Name)
+		}
+		var entry AuditEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "QueryAuditLog: `%s` is malformed", blob.Name)
+		}
+		if entry.Time.Before(since) || (operation != "" && entry.Operation != operation) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
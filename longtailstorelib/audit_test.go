@@ -0,0 +1,69 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestAuditLog(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	auditStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithAuditLog())
+	if err != nil {
+		t.Fatalf("TestAuditLog() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(auditStore)
+	for seed := uint8(0); seed < 2; seed++ {
+		if _, errno := storeBlockFromSeed(t, storeAPI, seed); errno != 0 {
+			t.Fatalf("TestAuditLog() storeBlockFromSeed(%d) %d != %d", seed, errno, 0)
+		}
+	}
+	storeAPI.Dispose()
+
+	// Mutations without the option are not recorded
+	untrackedStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite)
+	if err != nil {
+		t.Fatalf("TestAuditLog() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(untrackedStore)
+	if _, errno := storeBlockFromSeed(t, storeAPI, 2); errno != 0 {
+		t.Fatalf("TestAuditLog() storeBlockFromSeed(2) %d != %d", errno, 0)
+	}
+	storeAPI.Dispose()
+
+	_, err = PruneStore(context.Background(), blobStore, []uint64{uint64(0) + 1, uint64(0) + 2}, false, WithAuditLog())
+	if err != nil {
+		t.Fatalf("TestAuditLog() PruneStore() %v != %v", err, nil)
+	}
+
+	entries, err := QueryAuditLog(context.Background(), blobStore, time.Time{}, "")
+	if err != nil {
+		t.Fatalf("TestAuditLog() QueryAuditLog() %v != %v", err, nil)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("TestAuditLog() QueryAuditLog() %d entries != %d", len(entries), 2)
+	}
+	upload := entries[0]
+	if upload.Operation != AuditUpload || upload.AddedBlockCount != 2 || upload.IndexBlockCount != 2 || upload.IndexGeneration == 0 || upload.Identity == "" {
+		t.Errorf("TestAuditLog() QueryAuditLog() upload entry %+v", upload)
+	}
+	prune := entries[1]
+	if prune.Operation != AuditPrune || prune.RemovedBlockCount != 2 || prune.IndexBlockCount != 1 {
+		t.Errorf("TestAuditLog() QueryAuditLog() prune entry %+v", prune)
+	}
+
+	entries, err = QueryAuditLog(context.Background(), blobStore, time.Time{}, AuditPrune)
+	if err != nil || len(entries) != 1 || entries[0].Operation != AuditPrune {
+		t.Errorf("TestAuditLog() QueryAuditLog() prune %v, %v", entries, err)
+	}
+	entries, err = QueryAuditLog(context.Background(), blobStore, time.Now().Add(time.Hour), "")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("TestAuditLog() QueryAuditLog() since %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,155 @@
+package longtailstorelib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BandwidthUsage is the data a store session transferred to and from one backend, the blocks and
+// the store index it read and wrote. Failed requests are not counted.
+type BandwidthUsage struct {
+	// Store is the blob store the data was transferred to and from, such as a mirror of the store
+	Store           string `json:"store"`
+	UploadedBytes   uint64 `json:"uploadedBytes"`
+	DownloadedBytes uint64 `json:"downloadedBytes"`
+}
+
+// BandwidthUsageProvider is implemented by block stores that count the data they transfer
+type BandwidthUsageProvider interface {
+	// GetBandwidthUsage returns the data transferred since the store was created, per backend
+	GetBandwidthUsage() []BandwidthUsage
+}
+
+// bandwidthCounter sums the transferred bytes per backend
+type bandwidthCounter struct {
+	sync.Mutex
+	usage map[string]*BandwidthUsage
+}
+
+func newBandwidthCounter() *bandwidthCounter {
+	return &bandwidthCounter{usage: map[string]*BandwidthUsage{}}
+}
+
+// add counts a transfer to or from store, a nil bandwidthCounter counts nothing
+func (c *bandwidthCounter) add(store string, uploaded int, downloaded int) {
+	if c == nil || (uploaded <= 0 && downloaded <= 0) {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	usage, exists := c.usage[store]
+	if !exists {
+		usage = &BandwidthUsage{Store: store}
+		c.usage[store] = usage
+	}
+	if uploaded > 0 {
+		usage.UploadedBytes += uint64(uploaded)
+	}
+	if downloaded > 0 {
+		usage.DownloadedBytes += uint64(downloaded)
+	}
+}
+
+// get returns copies of the usage ordered by backend
+func (c *bandwidthCounter) get() []BandwidthUsage {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	usage := make([]BandwidthUsage, 0, len(c.usage))
+	for _, u := range c.usage {
+		usage = append(usage, *u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Store < usage[j].Store })
+	return usage
+}
+
+// GetBandwidthUsage ...
+func (s *remoteStore) GetBandwidthUsage() []BandwidthUsage {
+	return s.bandwidth.get()
+}
+
+// DailyBandwidthUsage is the data transferred to and from a store on one day, see
+// AddBandwidthUsage
+type DailyBandwidthUsage struct {
+	// Date is the local date, formatted as 2006-01-02
+	Date string `json:"date"`
+	BandwidthUsage
+}
+
+// BandwidthUsageLog is the daily usage of the stores that a machine has used
+type BandwidthUsageLog struct {
+	Days []DailyBandwidthUsage `json:"days"`
+}
+
+// ReadBandwidthUsageLog reads the usage log at path, a missing file is an empty log
+func ReadBandwidthUsageLog(path string) (BandwidthUsageLog, error) {
+	var usageLog BandwidthUsageLog
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return usageLog, nil
+	}
+	if err != nil {
+		return usageLog, errors.Wrap(err, "ReadBandwidthUsageLog")
+	}
+	err = json.Unmarshal(data, &usageLog)
+	if err != nil {
+		return BandwidthUsageLog{}, errors.Wrapf(err, "ReadBandwidthUsageLog: `%s` is malformed", path)
+	}
+	return usageLog, nil
+}
+
+// AddBandwidthUsage adds usage to the totals of the day of now in the usage log at path. The
+// file is locked while it is updated so several processes can share it.
+func AddBandwidthUsage(path string, usage []BandwidthUsage, now time.Time) error {
+	if len(usage) == 0 {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Wrap(err, "AddBandwidthUsage")
+	}
+	lock, err := acquireFSLock(path)
+	if err != nil {
+		return errors.Wrap(err, "AddBandwidthUsage")
+	}
+	defer lock.release()
+	usageLog, err := ReadBandwidthUsageLog(path)
+	if err != nil {
+		return errors.Wrap(err, "AddBandwidthUsage")
+	}
+	date := now.Format("2006-01-02")
+	for _, u := range usage {
+		found := false
+		for i := range usageLog.Days {
+			day := &usageLog.Days[i]
+			if day.Date == date && day.Store == u.Store {
+				day.UploadedBytes += u.UploadedBytes
+				day.DownloadedBytes += u.DownloadedBytes
+				found = true
+				break
+			}
+		}
+		if !found {
+			usageLog.Days = append(usageLog.Days, DailyBandwidthUsage{Date: date, BandwidthUsage: u})
+		}
+	}
+	data, err := json.MarshalIndent(usageLog, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "AddBandwidthUsage")
+	}
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return errors.Wrap(err, "AddBandwidthUsage")
+	}
+	return errors.Wrap(renameWithRetry(tmpPath, path), "AddBandwidthUsage")
+}
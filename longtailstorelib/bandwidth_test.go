@@ -0,0 +1,76 @@
+package longtailstorelib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestBandwidthUsage(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	blobStore, _ := NewTestBlobStore("the_path")
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestBandwidthUsage() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	putTestBlock(t, storeAPI, 101, []uint64{1, 2})
+	errno := flushSync(storeAPI)
+	if errno != 0 {
+		t.Fatalf("TestBandwidthUsage() flushSync() %d != %d", errno, 0)
+	}
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, 101)
+	if errno != 0 {
+		t.Fatalf("TestBandwidthUsage() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	storedBlock.Dispose()
+
+	usage := remoteStore.(BandwidthUsageProvider).GetBandwidthUsage()
+	if len(usage) != 1 || usage[0].Store != blobStore.String() || usage[0].UploadedBytes == 0 || usage[0].DownloadedBytes == 0 {
+		t.Fatalf("TestBandwidthUsage() GetBandwidthUsage() %+v", usage)
+	}
+	// The store index written by the flush is counted with the block
+	stats := remoteStore.(DetailedStatsProvider).GetDetailedStats()
+	blockBytes := stats.Stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Byte_Count]
+	if usage[0].UploadedBytes <= blockBytes {
+		t.Errorf("TestBandwidthUsage() GetBandwidthUsage() uploaded %d <= %d", usage[0].UploadedBytes, blockBytes)
+	}
+}
+
+func TestAddBandwidthUsage(t *testing.T) {
+	folder, err := ioutil.TempDir("", "longtail_bandwidth_test")
+	if err != nil {
+		t.Fatalf("TestAddBandwidthUsage() ioutil.TempDir() %v != %v", err, nil)
+	}
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, "usage", "bandwidth.json")
+
+	day := time.Date(2021, 6, 30, 12, 0, 0, 0, time.Local)
+	for _, now := range []time.Time{day, day.Add(time.Hour), day.AddDate(0, 0, 1)} {
+		err = AddBandwidthUsage(path, []BandwidthUsage{
+			{Store: "gs://a/store", UploadedBytes: 10, DownloadedBytes: 100},
+			{Store: "gs://b/store", DownloadedBytes: 1}}, now)
+		if err != nil {
+			t.Fatalf("TestAddBandwidthUsage() AddBandwidthUsage() %v != %v", err, nil)
+		}
+	}
+	usageLog, err := ReadBandwidthUsageLog(path)
+	if err != nil || len(usageLog.Days) != 4 {
+		t.Fatalf("TestAddBandwidthUsage() ReadBandwidthUsageLog() %v, %+v", err, usageLog)
+	}
+	first := usageLog.Days[0]
+	if first.Date != "2021-06-30" || first.Store != "gs://a/store" || first.UploadedBytes != 20 || first.DownloadedBytes != 200 {
+		t.Errorf("TestAddBandwidthUsage() ReadBandwidthUsageLog() day %+v", first)
+	}
+	if usageLog.Days[3].Date != "2021-07-01" || usageLog.Days[3].DownloadedBytes != 1 {
+		t.Errorf("TestAddBandwidthUsage() ReadBandwidthUsageLog() next day %+v", usageLog.Days[3])
+	}
+}
@@ -0,0 +1,147 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BenchmarkResult holds the measurements of one operation in BenchmarkBlobStore
+type BenchmarkResult struct {
+	Operation   string
+	BlockSize   int
+	Concurrency int
+	Count       int
+	FailCount   int
+	ByteCount   uint64
+	Duration    time.Duration
+	// Latency percentiles of the individual requests
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// Throughput returns the transferred bytes per second
+func (r *BenchmarkResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.ByteCount) / r.Duration.Seconds()
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := (len(sorted)*p + 99) / 100
+	if index > 0 {
+		index--
+	}
+	return sorted[index]
+}
+
+// runBenchmark calls op for 0..count-1 from concurrency goroutines and collects the latencies
+func runBenchmark(operation string, blockSize int, count int, concurrency int, op func(i int) error) BenchmarkResult {
+	latencies := make([]time.Duration, count)
+	failed := make([]bool, count)
+	indexes := make(chan int, count)
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				requestStart := time.Now()
+				err := op(i)
+				latencies[i] = time.Since(requestStart)
+				failed[i] = err != nil
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := BenchmarkResult{Operation: operation, BlockSize: blockSize, Concurrency: concurrency, Count: count, Duration: time.Since(start)}
+	for i := 0; i < count; i++ {
+		if failed[i] {
+			result.FailCount++
+		} else {
+			result.ByteCount += uint64(blockSize)
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.P50 = percentile(latencies, 50)
+	result.P90 = percentile(latencies, 90)
+	result.P99 = percentile(latencies, 99)
+	result.Max = percentile(latencies, 100)
+	return result
+}
+
+// BenchmarkBlobStore writes blockCount synthetic blocks of blockSize bytes to bench/ in blobStore
+// from concurrency parallel requests, reads them back and deletes them.
+// Returns the write and read measurements.
+func BenchmarkBlobStore(
+	ctx context.Context,
+	blobStore BlobStore,
+	blockSize int,
+	blockCount int,
+	concurrency int) ([]BenchmarkResult, error) {
+	if blockSize <= 0 || blockCount <= 0 || concurrency <= 0 {
+		return nil, fmt.Errorf("BenchmarkBlobStore: invalid block size %d, block count %d or concurrency %d", blockSize, blockCount, concurrency)
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	data := make([]byte, blockSize)
+	rand.Read(data)
+	runID := fmt.Sprintf("%d-%08x", time.Now().UnixNano(), rand.Uint32())
+	path := func(i int) string {
+		return fmt.Sprintf("bench/%s/%d_%d.lsb", runID, blockSize, i)
+	}
+
+	var results []BenchmarkResult
+	results = append(results, runBenchmark("Write", blockSize, blockCount, concurrency, func(i int) error {
+		object, err := blobClient.NewObject(path(i))
+		if err != nil {
+			return err
+		}
+		ok, err := object.Write(data)
+		if err == nil && !ok {
+			err = fmt.Errorf("write of `%s` rejected", path(i))
+		}
+		return err
+	}))
+	results = append(results, runBenchmark("Read", blockSize, blockCount, concurrency, func(i int) error {
+		object, err := blobClient.NewObject(path(i))
+		if err != nil {
+			return err
+		}
+		readData, err := object.Read()
+		if err == nil && len(readData) != blockSize {
+			err = fmt.Errorf("read %d bytes from `%s`, expected %d", len(readData), path(i), blockSize)
+		}
+		return err
+	}))
+
+	for i := 0; i < blockCount; i++ {
+		object, err := blobClient.NewObject(path(i))
+		if err == nil {
+			object.Delete()
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,55 @@
+package longtailstorelib
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+	if percentile(latencies, 50) != 50*time.Millisecond {
+		t.Errorf("TestPercentile() p50 %v != %v", percentile(latencies, 50), 50*time.Millisecond)
+	}
+	if percentile(latencies, 99) != 99*time.Millisecond {
+		t.Errorf("TestPercentile() p99 %v != %v", percentile(latencies, 99), 99*time.Millisecond)
+	}
+	if percentile(latencies, 100) != 100*time.Millisecond {
+		t.Errorf("TestPercentile() max %v != %v", percentile(latencies, 100), 100*time.Millisecond)
+	}
+	if percentile(latencies[:1], 50) != time.Millisecond {
+		t.Errorf("TestPercentile() single %v != %v", percentile(latencies[:1], 50), time.Millisecond)
+	}
+}
+
+func TestBenchmarkBlobStore(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	results, err := BenchmarkBlobStore(context.Background(), blobStore, 1024, 32, 4)
+	if err != nil {
+		t.Fatalf("TestBenchmarkBlobStore() BenchmarkBlobStore() %v != %v", err, nil)
+	}
+	if len(results) != 2 {
+		t.Fatalf("TestBenchmarkBlobStore() len(results) %d != %d", len(results), 2)
+	}
+	for _, result := range results {
+		if result.Count != 32 || result.FailCount != 0 || result.ByteCount != 32*1024 {
+			t.Errorf("TestBenchmarkBlobStore() %s %+v", result.Operation, result)
+		}
+		if result.P50 > result.P99 || result.P99 > result.Max {
+			t.Errorf("TestBenchmarkBlobStore() %s percentiles out of order %+v", result.Operation, result)
+		}
+	}
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	objects, _ := client.GetObjects()
+	if len(objects) != 0 {
+		t.Errorf("TestBenchmarkBlobStore() bench objects left %d != %d", len(objects), 0)
+	}
+	_, err = BenchmarkBlobStore(context.Background(), blobStore, 0, 32, 4)
+	if err == nil {
+		t.Errorf("TestBenchmarkBlobStore() BenchmarkBlobStore() zero block size %v == %v", err, nil)
+	}
+}
@@ -1,8 +1,16 @@
 package longtailstorelib
 
-import "context"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 // BlobObject
+// Write must not keep a reference to data once it returns, callers reuse their buffers
 type BlobObject interface {
 	Exists() (bool, error)
 	LockWriteVersion() (bool, error)
@@ -11,15 +19,44 @@ type BlobObject interface {
 	Delete() error
 }
 
+// ArchivableBlobObject is implemented by the blob objects of stores with a cold storage tier
+type ArchivableBlobObject interface {
+	// Archive moves the object to storageClass, an empty storageClass uses the coldest class of the store
+	Archive(storageClass string) error
+	// Restore requests that an archived object is made readable, returns true once it can be read
+	Restore() (bool, error)
+}
+
 type BlobProperties struct {
 	Size int64
 	Name string
 }
 
+// BlobIterator streams the objects of a listing, see BlobClient.ListObjects
+//
+//	it := blobClient.ListObjects("chunks/")
+//	for it.Next() {
+//		blob := it.Blob()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type BlobIterator interface {
+	// Next moves to the next object, it returns false at the end of the listing or on an error
+	Next() bool
+	// Blob returns the object Next moved to
+	Blob() BlobProperties
+	// Err returns the error that ended the listing, nil if all objects were listed
+	Err() error
+}
+
 // BlobClient
+// GetObjects lists the whole store at once, ListObjects lists the objects with names starting with
+// prefix as they are read from the backend so stores with millions of objects can be listed with
+// flat memory use. ListObjects does not send any request until Next is called.
 type BlobClient interface {
 	NewObject(path string) (BlobObject, error)
 	GetObjects() ([]BlobProperties, error)
+	ListObjects(prefix string) BlobIterator
 	String() string
 	Close()
 }
@@ -29,3 +66,42 @@ type BlobStore interface {
 	NewClient(ctx context.Context) (BlobClient, error)
 	String() string
 }
+
+// verifyImmutableObject is used by the blob stores in immutable mode when a create-only write finds
+// an existing object, identical content counts as a successful write
+func verifyImmutableObject(blobObject BlobObject, path string, data []byte) (bool, error) {
+	existing, err := blobObject.Read()
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(existing, data) {
+		return false, errors.Wrap(ErrImmutable, path)
+	}
+	return true, nil
+}
+
+// reservedStoreNames are the top level names used inside a store. A store root can not use them so
+// a store in the bucket root never mistakes the objects of another store for its own.
+var reservedStoreNames = map[string]bool{"chunks": true, trashPath: true, auditPath: true, accessPath: true}
+
+// normalizeStorePrefix returns the object name prefix of the store rooted at storeRoot within a
+// bucket, either empty or ending with a slash. Several stores can share a bucket as long as their
+// roots differ, each store only reads, lists and writes objects under its prefix.
+func normalizeStorePrefix(storeRoot string) (string, error) {
+	var parts []string
+	for _, part := range strings.Split(storeRoot, "/") {
+		switch {
+		case part == "":
+			continue
+		case part == "." || part == "..":
+			return "", fmt.Errorf("store root `%s` can not contain `%s`", storeRoot, part)
+		case reservedStoreNames[part]:
+			return "", fmt.Errorf("store root `%s` can not contain `%s`, it is reserved for the content of stores", storeRoot, part)
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+	return strings.Join(parts, "/") + "/", nil
+}
@@ -3,22 +3,40 @@ package longtailstorelib
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"cloud.google.com/go/storage"
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
 )
 
 type testBlob struct {
 	generation int
 	path       string
 	data       []byte
+	// archived blobs can not be read until restorePolls calls to Restore have been made
+	archived     bool
+	restorePolls int
+	metadata     map[string]string
 }
 
 type testBlobStore struct {
 	blobs      map[string]*testBlob
 	blobsMutex sync.RWMutex
 	prefix     string
+	options    StoreOptions
+	// existsCount is the number of Exists calls
+	existsCount int64
 }
 
 type testBlobClient struct {
@@ -32,8 +50,8 @@ type testBlobObject struct {
 }
 
 // NewTestBlobStore ...
-func NewTestBlobStore(prefix string) (BlobStore, error) {
-	s := &testBlobStore{prefix: prefix, blobs: make(map[string]*testBlob)}
+func NewTestBlobStore(prefix string, opts ...StoreOption) (BlobStore, error) {
+	s := &testBlobStore{prefix: prefix, blobs: make(map[string]*testBlob), options: newStoreOptions(opts)}
 	return s, nil
 }
 
@@ -41,6 +59,10 @@ func (blobStore *testBlobStore) NewClient(ctx context.Context) (BlobClient, erro
 	return &testBlobClient{store: blobStore}, nil
 }
 
+func (blobStore *testBlobStore) storeOptions() StoreOptions {
+	return blobStore.options
+}
+
 func (blobStore *testBlobStore) String() string {
 	return "teststore"
 }
@@ -61,6 +83,32 @@ func (blobClient *testBlobClient) GetObjects() ([]BlobProperties, error) {
 	return properties, nil
 }
 
+func (blobClient *testBlobClient) ListObjects(prefix string) BlobIterator {
+	return newPagedBlobIterator(blobClient, prefix)
+}
+
+func (blobClient *testBlobClient) GetObjectsPage(prefix string, pageToken string, pageSize int) ([]BlobProperties, string, error) {
+	blobClient.store.blobsMutex.RLock()
+	defer blobClient.store.blobsMutex.RUnlock()
+	var keys []string
+	for key := range blobClient.store.blobs {
+		if strings.HasPrefix(key, prefix) && key > pageToken {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	nextPageToken := ""
+	if len(keys) > pageSize {
+		keys = keys[:pageSize]
+		nextPageToken = keys[pageSize-1]
+	}
+	properties := make([]BlobProperties, len(keys))
+	for i, key := range keys {
+		properties[i] = BlobProperties{Name: key, Size: int64(len(blobClient.store.blobs[key].data))}
+	}
+	return properties, nextPageToken, nil
+}
+
 func (blobClient *testBlobClient) Close() {
 }
 
@@ -69,6 +117,7 @@ func (blobClient *testBlobClient) String() string {
 }
 
 func (blobObject *testBlobObject) Exists() (bool, error) {
+	atomic.AddInt64(&blobObject.client.store.existsCount, 1)
 	blobObject.client.store.blobsMutex.RLock()
 	defer blobObject.client.store.blobsMutex.RUnlock()
 	_, exists := blobObject.client.store.blobs[blobObject.path]
@@ -82,9 +131,32 @@ func (blobObject *testBlobObject) Read() ([]byte, error) {
 	if !exists {
 		return nil, fmt.Errorf("testBlobObject object does not exist: %s", blobObject.path)
 	}
+	if blob.archived {
+		return nil, errors.Wrap(ErrArchived, blobObject.path)
+	}
 	return blob.data, nil
 }
 
+func (blobObject *testBlobObject) WriteTo(w io.Writer) (int64, error) {
+	data, err := blobObject.Read()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+func (blobObject *testBlobObject) ReadRange(offset int64, length int64) ([]byte, error) {
+	data, err := blobObject.Read()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < offset+length {
+		return nil, fmt.Errorf("testBlobObject range %d+%d is outside of %s", offset, length, blobObject.path)
+	}
+	return data[offset : offset+length], nil
+}
+
 func (blobObject *testBlobObject) LockWriteVersion() (bool, error) {
 	blobObject.client.store.blobsMutex.RLock()
 	defer blobObject.client.store.blobsMutex.RUnlock()
@@ -114,17 +186,51 @@ func (blobObject *testBlobObject) Write(data []byte) (bool, error) {
 		}
 	}
 
+	metadata := identityMetadata(blobObject.client.store.options)
+	data = append([]byte(nil), data...)
 	if !exists {
-		blob = &testBlob{generation: 0, path: blobObject.path, data: data}
+		blob = &testBlob{generation: 0, path: blobObject.path, data: data, metadata: metadata}
 		blobObject.client.store.blobs[blobObject.path] = blob
 		return true, nil
 	}
 
 	blob.data = data
+	blob.metadata = metadata
 	blob.generation++
 	return true, nil
 }
 
+func (blobObject *testBlobObject) WriteIfAbsent(data []byte) (bool, bool, error) {
+	blobObject.client.store.blobsMutex.Lock()
+	defer blobObject.client.store.blobsMutex.Unlock()
+	if _, exists := blobObject.client.store.blobs[blobObject.path]; exists {
+		return true, true, nil
+	}
+	metadata := identityMetadata(blobObject.client.store.options)
+	blobObject.client.store.blobs[blobObject.path] = &testBlob{generation: 0, path: blobObject.path, data: append([]byte(nil), data...), metadata: metadata}
+	return true, false, nil
+}
+
+func (blobObject *testBlobObject) Generation() (int64, error) {
+	blobObject.client.store.blobsMutex.RLock()
+	defer blobObject.client.store.blobsMutex.RUnlock()
+	blob, exists := blobObject.client.store.blobs[blobObject.path]
+	if !exists {
+		return 0, fmt.Errorf("testBlobObject object does not exist: %s", blobObject.path)
+	}
+	return int64(blob.generation) + 1, nil
+}
+
+func (blobObject *testBlobObject) Metadata() (map[string]string, error) {
+	blobObject.client.store.blobsMutex.RLock()
+	defer blobObject.client.store.blobsMutex.RUnlock()
+	blob, exists := blobObject.client.store.blobs[blobObject.path]
+	if !exists {
+		return nil, fmt.Errorf("testBlobObject object does not exist: %s", blobObject.path)
+	}
+	return blob.metadata, nil
+}
+
 func (blobObject *testBlobObject) Delete() error {
 	blobObject.client.store.blobsMutex.Lock()
 	defer blobObject.client.store.blobsMutex.Unlock()
@@ -142,6 +248,32 @@ func (blobObject *testBlobObject) Delete() error {
 	return nil
 }
 
+func (blobObject *testBlobObject) Archive(storageClass string) error {
+	blobObject.client.store.blobsMutex.Lock()
+	defer blobObject.client.store.blobsMutex.Unlock()
+	blob, exists := blobObject.client.store.blobs[blobObject.path]
+	if !exists {
+		return fmt.Errorf("testBlobObject object does not exist: %s", blobObject.path)
+	}
+	blob.archived = true
+	blob.restorePolls = 3
+	return nil
+}
+
+func (blobObject *testBlobObject) Restore() (bool, error) {
+	blobObject.client.store.blobsMutex.Lock()
+	defer blobObject.client.store.blobsMutex.Unlock()
+	blob, exists := blobObject.client.store.blobs[blobObject.path]
+	if !exists {
+		return false, fmt.Errorf("testBlobObject object does not exist: %s", blobObject.path)
+	}
+	if blob.archived {
+		blob.restorePolls--
+		blob.archived = blob.restorePolls > 0
+	}
+	return !blob.archived, nil
+}
+
 func TestCreateStoreAndClient(t *testing.T) {
 	blobStore, err := NewTestBlobStore("the_path")
 	if err != nil {
@@ -312,3 +444,65 @@ func TestGenerationWrite(t *testing.T) {
 		t.Errorf("TestGenerationWrite() obj.Delete()) %v != %v", err, nil)
 	}
 }
+
+func TestNormalizeStorePrefix(t *testing.T) {
+	prefixes := map[string]string{
+		"":               "",
+		"/":              "",
+		"/teamA":         "teamA/",
+		"/teamA/":        "teamA/",
+		"//teamA//store": "teamA/store/",
+	}
+	for storeRoot, expected := range prefixes {
+		prefix, err := normalizeStorePrefix(storeRoot)
+		if err != nil || prefix != expected {
+			t.Errorf("TestNormalizeStorePrefix() normalizeStorePrefix(%s) %s, %v != %s", storeRoot, prefix, err, expected)
+		}
+	}
+	for _, storeRoot := range []string{"/teamA/../teamB", "/chunks", "/teamA/trash"} {
+		if _, err := normalizeStorePrefix(storeRoot); err == nil {
+			t.Errorf("TestNormalizeStorePrefix() normalizeStorePrefix(%s) %v == %v", storeRoot, err, nil)
+		}
+	}
+	u, _ := url.Parse("gs://bucket/teamA/")
+	blobStore, err := NewGCSBlobStore(u)
+	if err != nil || blobStore.String() != "gs://bucket/teamA/" {
+		t.Errorf("TestNormalizeStorePrefix() NewGCSBlobStore(%s) %v, %v", u, blobStore, err)
+	}
+}
+
+func TestSharedBucketStores(t *testing.T) {
+	bucketPath, err := ioutil.TempDir("", "longtail_bucket_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bucketPath)
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	// A store in the bucket root, one per team and one nested in the store of a team
+	storeRoots := []string{"", "teamA", "teamB", "teamA/nested"}
+	blockHashes := map[string]uint64{}
+	for i, storeRoot := range storeRoots {
+		blobStore, _ := NewFSBlobStore(path.Join(bucketPath, storeRoot))
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+		if err != nil {
+			t.Fatalf("TestSharedBucketStores() NewRemoteBlockStore(%s) %v != %v", storeRoot, err, nil)
+		}
+		storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+		blockHashes[storeRoot], _ = storeBlockFromSeed(t, storeAPI, uint8(i))
+		storeAPI.Dispose()
+	}
+
+	for _, storeRoot := range storeRoots {
+		blobStore, _ := NewFSBlobStore(path.Join(bucketPath, storeRoot))
+		indexedBlockHashes := getStoreIndexBlockHashes(t, blobStore)
+		if len(indexedBlockHashes) != 1 || !indexedBlockHashes[blockHashes[storeRoot]] {
+			t.Errorf("TestSharedBucketStores() store index of `%s` %v != [0x%016x]", storeRoot, indexedBlockHashes, blockHashes[storeRoot])
+		}
+		recoveredBlockHashes, err := RecoverStoreIndex(context.Background(), blobStore, true)
+		if err != nil || len(recoveredBlockHashes) != 0 {
+			t.Errorf("TestSharedBucketStores() RecoverStoreIndex(%s) found blocks of other stores %v, %v", storeRoot, recoveredBlockHashes, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package longtailstorelib
+
+import (
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// bufferBlockStore holds a single block blob, the compress block store reads the blob to decompress
+// it and writes the blob of a block it has compressed
+type bufferBlockStore struct {
+	blob []byte
+}
+
+// PutStoredBlock ...
+func (s *bufferBlockStore) PutStoredBlock(storedBlock longtaillib.Longtail_StoredBlock, asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI) int {
+	blob, errno := longtaillib.WriteStoredBlockToBuffer(storedBlock)
+	s.blob = blob
+	asyncCompleteAPI.OnComplete(errno)
+	return 0
+}
+
+// PreflightGet ...
+func (s *bufferBlockStore) PreflightGet(blockHashes []uint64, asyncCompleteAPI longtaillib.Longtail_AsyncPreflightStartedAPI) int {
+	return longtaillib.EINVAL
+}
+
+// GetStoredBlock ...
+func (s *bufferBlockStore) GetStoredBlock(blockHash uint64, asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI) int {
+	if len(s.blob) == 0 {
+		asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoredBlock{}, longtaillib.EBADF)
+		return 0
+	}
+	storedBlock, errno := longtaillib.ReadStoredBlockFromBuffer(s.blob)
+	asyncCompleteAPI.OnComplete(storedBlock, errno)
+	return 0
+}
+
+// GetExistingContent ...
+func (s *bufferBlockStore) GetExistingContent(chunkHashes []uint64, minBlockUsagePercent uint32, asyncCompleteAPI longtaillib.Longtail_AsyncGetExistingContentAPI) int {
+	return longtaillib.EINVAL
+}
+
+// GetStats ...
+func (s *bufferBlockStore) GetStats() (longtaillib.BlockStoreStats, int) {
+	return longtaillib.BlockStoreStats{}, 0
+}
+
+// Flush ...
+func (s *bufferBlockStore) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI) int {
+	asyncCompleteAPI.OnComplete(0)
+	return 0
+}
+
+// Close ...
+func (s *bufferBlockStore) Close() {
+}
+
+// blockCodec converts between block blobs as written by the remote block store, with the chunk data
+// compressed as given by the block tag, and stored blocks with uncompressed chunk data. A codec is
+// not safe for concurrent use.
+type blockCodec struct {
+	buffer              *bufferBlockStore
+	bufferAPI           longtaillib.Longtail_BlockStoreAPI
+	compressionRegistry longtaillib.Longtail_CompressionRegistryAPI
+	compressStore       longtaillib.Longtail_BlockStoreAPI
+}
+
+func newBlockCodec() *blockCodec {
+	c := &blockCodec{
+		buffer:              &bufferBlockStore{},
+		compressionRegistry: longtaillib.CreateFullCompressionRegistry()}
+	c.bufferAPI = longtaillib.CreateBlockStoreAPI(c.buffer)
+	c.compressStore = longtaillib.CreateCompressBlockStore(c.bufferAPI, c.compressionRegistry)
+	return c
+}
+
+func (c *blockCodec) dispose() {
+	c.compressStore.Dispose()
+	c.bufferAPI.Dispose()
+	c.compressionRegistry.Dispose()
+}
+
+// decode returns the block in blob with its chunk data decompressed
+func (c *blockCodec) decode(blockHash uint64, blob []byte) (longtaillib.Longtail_StoredBlock, int) {
+	c.buffer.blob = blob
+	defer func() { c.buffer.blob = nil }()
+	return getStoredBlockSync(c.compressStore, blockHash)
+}
+
+// encode returns the blob of storedBlock with its chunk data compressed as given by the block tag
+func (c *blockCodec) encode(storedBlock longtaillib.Longtail_StoredBlock) ([]byte, int) {
+	defer func() { c.buffer.blob = nil }()
+	errno := putStoredBlockSync(c.compressStore, storedBlock)
+	if errno != 0 {
+		return nil, errno
+	}
+	return c.buffer.blob, 0
+}
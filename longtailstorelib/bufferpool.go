@@ -0,0 +1,141 @@
+package longtailstorelib
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Buffers larger than this are dropped instead of pooled so a single huge block does not pin its
+// memory for the lifetime of the process
+const maxPooledBlobBufferSize = 64 * 1024 * 1024
+
+// blobBuffer is a reusable buffer for the serialized blocks that pass between the native block store
+// and the blob stores, see getBlobBuffer
+type blobBuffer struct {
+	data []byte
+	// Objects larger than fileThreshold are streamed to a temp file in fileDir by readBlob, when
+	// fileThreshold is set, see WithBlockFiles
+	fileThreshold int64
+	fileDir       string
+	// path is the temp file of a streamed object and size the size of the object
+	path string
+	size int64
+}
+
+var blobBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &blobBuffer{}
+	},
+}
+
+// getBlobBuffer returns an empty buffer from the pool, hand it back with release once the data is no
+// longer referenced
+func getBlobBuffer() *blobBuffer {
+	return blobBufferPool.Get().(*blobBuffer)
+}
+
+func (buffer *blobBuffer) release() {
+	if cap(buffer.data) > maxPooledBlobBufferSize {
+		buffer.data = nil
+	}
+	buffer.data = buffer.data[:0]
+	buffer.removeFile()
+	buffer.fileThreshold = 0
+	buffer.fileDir = ""
+	blobBufferPool.Put(buffer)
+}
+
+func (buffer *blobBuffer) removeFile() {
+	if buffer.path != "" {
+		os.Remove(buffer.path)
+		buffer.path = ""
+	}
+	buffer.size = 0
+}
+
+// bufferedBlobObject is implemented by blob objects that can read into a caller provided buffer
+type bufferedBlobObject interface {
+	// ReadInto reads the object to the end of buffer and returns the extended buffer
+	ReadInto(buffer []byte) ([]byte, error)
+}
+
+// streamedBlobObject is implemented by blob objects that can stream their content
+type streamedBlobObject interface {
+	// WriteTo writes the object to w and returns the number of bytes written
+	WriteTo(w io.Writer) (int64, error)
+}
+
+// readBlob reads objHandle into buffer if the blob store supports it, the returned data is only valid
+// until buffer is released. A nil buffer always reads into newly allocated memory. An object larger
+// than the file threshold of buffer is streamed to the temp file at buffer.path and nil is returned.
+func readBlob(objHandle BlobObject, buffer *blobBuffer) ([]byte, error) {
+	if buffer == nil {
+		return objHandle.Read()
+	}
+	if streamedObject, ok := objHandle.(streamedBlobObject); ok && buffer.fileThreshold > 0 {
+		return readBlobToFile(streamedObject, buffer)
+	}
+	bufferedObject, ok := objHandle.(bufferedBlobObject)
+	if !ok {
+		return objHandle.Read()
+	}
+	data, err := bufferedObject.ReadInto(buffer.data[:0])
+	if err != nil {
+		return nil, err
+	}
+	buffer.data = data
+	return data, nil
+}
+
+// blobFileWriter keeps what is written to it in the buffer until it grows past the file threshold
+// of the buffer, the data is then moved to a temp file and the rest is written there
+type blobFileWriter struct {
+	buffer *blobBuffer
+	file   *os.File
+}
+
+func (w *blobFileWriter) Write(p []byte) (int, error) {
+	if w.file == nil {
+		if int64(len(w.buffer.data)+len(p)) <= w.buffer.fileThreshold {
+			w.buffer.data = append(w.buffer.data, p...)
+			return len(p), nil
+		}
+		f, err := ioutil.TempFile(w.buffer.fileDir, "longtail-block-*.tmp")
+		if err != nil {
+			return 0, err
+		}
+		w.file = f
+		w.buffer.path = f.Name()
+		_, err = f.Write(w.buffer.data)
+		if err != nil {
+			return 0, err
+		}
+		w.buffer.data = w.buffer.data[:0]
+	}
+	return w.file.Write(p)
+}
+
+func readBlobToFile(streamedObject streamedBlobObject, buffer *blobBuffer) ([]byte, error) {
+	// A retried read starts over
+	buffer.data = buffer.data[:0]
+	buffer.removeFile()
+	w := &blobFileWriter{buffer: buffer}
+	size, err := streamedObject.WriteTo(w)
+	if w.file != nil {
+		closeErr := w.file.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		buffer.removeFile()
+		return nil, err
+	}
+	buffer.size = size
+	if buffer.path != "" {
+		return nil, nil
+	}
+	return buffer.data, nil
+}
@@ -0,0 +1,93 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestReadBlobIntoBuffer(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_bufferpool_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	fsBlobStore, _ := NewFSBlobStore(storePath)
+	testBlobStore, _ := NewTestBlobStore("the_path")
+	for _, blobStore := range []BlobStore{fsBlobStore, testBlobStore} {
+		client, _ := blobStore.NewClient(context.Background())
+		object, _ := client.NewObject("test.txt")
+		data := []byte("apa")
+		_, err = object.Write(data)
+		if err != nil {
+			t.Fatalf("TestReadBlobIntoBuffer() %s object.Write() %v", blobStore, err)
+		}
+		// The blob store must not keep referencing the written data
+		data[0] = 'b'
+
+		buffer := getBlobBuffer()
+		backing := make([]byte, 0, 16)
+		buffer.data = backing
+		readData, err := readBlob(object, buffer)
+		if err != nil {
+			t.Fatalf("TestReadBlobIntoBuffer() %s readBlob() %v", blobStore, err)
+		}
+		if !bytes.Equal(readData, []byte("apa")) {
+			t.Errorf("TestReadBlobIntoBuffer() %s readBlob() %q != %q", blobStore, readData, "apa")
+		}
+		if _, buffered := object.(bufferedBlobObject); buffered && &readData[0] != &backing[:1][0] {
+			t.Errorf("TestReadBlobIntoBuffer() %s readBlob() did not read into the buffer", blobStore)
+		}
+		buffer.release()
+		client.Close()
+	}
+}
+
+func TestReadBlobToFile(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_bufferpool_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+	filePath, err := ioutil.TempDir("", "longtail_bufferpool_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filePath)
+
+	fsBlobStore, _ := NewFSBlobStore(storePath)
+	testBlobStore, _ := NewTestBlobStore("the_path")
+	for _, blobStore := range []BlobStore{fsBlobStore, testBlobStore} {
+		client, _ := blobStore.NewClient(context.Background())
+		small, _ := client.NewObject("small.txt")
+		small.Write([]byte("apa"))
+		large, _ := client.NewObject("large.txt")
+		large.Write([]byte("apa bepa cepa"))
+
+		buffer := getBlobBuffer()
+		buffer.fileThreshold = 4
+		buffer.fileDir = filePath
+		readData, err := readBlob(small, buffer)
+		if err != nil || !bytes.Equal(readData, []byte("apa")) || buffer.path != "" {
+			t.Errorf("TestReadBlobToFile() %s readBlob(small) %q, `%s`, %v", blobStore, readData, buffer.path, err)
+		}
+		readData, err = readBlob(large, buffer)
+		if err != nil || readData != nil || buffer.path == "" || buffer.size != 13 {
+			t.Fatalf("TestReadBlobToFile() %s readBlob(large) %q, `%s`, %d, %v", blobStore, readData, buffer.path, buffer.size, err)
+		}
+		fileData, err := ioutil.ReadFile(buffer.path)
+		if err != nil || !bytes.Equal(fileData, []byte("apa bepa cepa")) {
+			t.Errorf("TestReadBlobToFile() %s file %q, %v", blobStore, fileData, err)
+		}
+		path := buffer.path
+		buffer.release()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("TestReadBlobToFile() %s release() did not remove `%s`", blobStore, path)
+		}
+		client.Close()
+	}
+}
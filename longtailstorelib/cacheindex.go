@@ -0,0 +1,306 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// StaleCachePolicy is how a cache index block store uses the blocks of the cache index that the
+// remote did not return. The cache index is stale when it lists blocks that the remote no longer
+// has, for example after the remote was compacted or pruned. The chunks of those blocks are still
+// valid but the blocks can not be fetched again if they are gone from the cache.
+type StaleCachePolicy int
+
+const (
+	// VerifyStaleCache reads the blocks that only the cache returned before they are used, the
+	// chunks of the blocks that can not be read are taken from the remote
+	VerifyStaleCache StaleCachePolicy = iota
+	// TrustStaleCache uses all blocks of the cache index as they are, a block that is gone from
+	// the cache and the remote fails the downsync
+	TrustStaleCache
+	// IgnoreStaleCache uses the index of the remote only, the cache still serves the blocks of
+	// the remote that it holds
+	IgnoreStaleCache
+)
+
+// verifyStaleCacheWorkerCount is the number of cache blocks read at once by VerifyStaleCache
+const verifyStaleCacheWorkerCount = 8
+
+func (policy StaleCachePolicy) String() string {
+	switch policy {
+	case VerifyStaleCache:
+		return "verify"
+	case TrustStaleCache:
+		return "trust"
+	case IgnoreStaleCache:
+		return "ignore"
+	}
+	return fmt.Sprintf("StaleCachePolicy(%d)", int(policy))
+}
+
+// ParseStaleCachePolicy converts a stale cache policy name to a StaleCachePolicy
+func ParseStaleCachePolicy(name string) (StaleCachePolicy, error) {
+	switch name {
+	case "", "verify":
+		return VerifyStaleCache, nil
+	case "trust":
+		return TrustStaleCache, nil
+	case "ignore":
+		return IgnoreStaleCache, nil
+	}
+	return VerifyStaleCache, fmt.Errorf("unsupported stale cache policy `%s`", name)
+}
+
+// cacheIndexBlockStore merges the existing content of a local cache store and a remote store.
+// Both are asked in parallel, unlike longtaillib.CreateCacheBlockStore which asks the remote once
+// the cache is done, and the chunks that the cache holds are taken from its blocks, the remote
+// only adds blocks for the remaining chunks. Blocks are read and written through the
+// caching store, which reads the cache first.
+//
+// Stats: the stats of the caching store.
+type cacheIndexBlockStore struct {
+	cacheStore   longtaillib.Longtail_BlockStoreAPI
+	remoteStore  longtaillib.Longtail_BlockStoreAPI
+	cachingStore longtaillib.Longtail_BlockStoreAPI
+	policy       StaleCachePolicy
+}
+
+// NewCacheIndexBlockStore creates a block store that prefers the blocks of cacheStore over those of
+// remoteStore when the existing content is requested. cachingStore is the store that blocks are
+// read through, usually longtaillib.CreateCacheBlockStore of cacheStore and remoteStore. The
+// store does not own the stores, dispose them after it.
+func NewCacheIndexBlockStore(
+	cacheStore longtaillib.Longtail_BlockStoreAPI,
+	remoteStore longtaillib.Longtail_BlockStoreAPI,
+	cachingStore longtaillib.Longtail_BlockStoreAPI,
+	policy StaleCachePolicy) longtaillib.BlockStoreAPI {
+	return &cacheIndexBlockStore{
+		cacheStore:   cacheStore,
+		remoteStore:  remoteStore,
+		cachingStore: cachingStore,
+		policy:       policy}
+}
+
+// cacheIndexRequest collects the existing content of the cache and the remote and merges them
+// once both are done
+type cacheIndexRequest struct {
+	store            *cacheIndexBlockStore
+	chunkHashes      []uint64
+	asyncCompleteAPI longtaillib.Longtail_AsyncGetExistingContentAPI
+
+	lock        sync.Mutex
+	pending     int
+	cacheIndex  longtaillib.Longtail_StoreIndex
+	cacheErrno  int
+	remoteIndex longtaillib.Longtail_StoreIndex
+	remoteErrno int
+}
+
+type cacheIndexCompletionAPI struct {
+	request   *cacheIndexRequest
+	fromCache bool
+}
+
+func (a *cacheIndexCompletionAPI) OnComplete(storeIndex longtaillib.Longtail_StoreIndex, errno int) {
+	a.request.complete(a.fromCache, storeIndex, errno)
+}
+
+func (r *cacheIndexRequest) complete(fromCache bool, storeIndex longtaillib.Longtail_StoreIndex, errno int) {
+	r.lock.Lock()
+	if fromCache {
+		r.cacheIndex, r.cacheErrno = storeIndex, errno
+	} else {
+		r.remoteIndex, r.remoteErrno = storeIndex, errno
+	}
+	r.pending--
+	done := r.pending == 0
+	r.lock.Unlock()
+	if done {
+		// Verifying reads blocks, which must not wait on the thread of a completion
+		go r.merge()
+	}
+}
+
+func (r *cacheIndexRequest) merge() {
+	defer r.cacheIndex.Dispose()
+	if r.remoteErrno != 0 {
+		r.remoteIndex.Dispose()
+		r.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, r.remoteErrno)
+		return
+	}
+	if r.cacheErrno != 0 {
+		// The cache only saves downloads, the remote has all content
+		log.Printf("WARNING: Failed to get the existing content of the cache: %v\n", longtaillib.ErrnoToError(r.cacheErrno, longtaillib.ErrEIO))
+		r.asyncCompleteAPI.OnComplete(r.remoteIndex, 0)
+		return
+	}
+	storeIndex, errno := r.store.mergeIndexes(r.cacheIndex, r.remoteIndex, r.chunkHashes)
+	if errno != 0 {
+		r.remoteIndex.Dispose()
+		r.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, errno)
+		return
+	}
+	if storeIndex.IsValid() {
+		r.remoteIndex.Dispose()
+		r.asyncCompleteAPI.OnComplete(storeIndex, 0)
+		return
+	}
+	r.asyncCompleteAPI.OnComplete(r.remoteIndex, 0)
+}
+
+// mergeIndexes returns a store index with the usable blocks of cacheIndex first and the blocks of
+// remoteIndex needed for the chunks that they do not hold. The returned store index is invalid if
+// no cache block is usable and remoteIndex should be used as it is.
+func (s *cacheIndexBlockStore) mergeIndexes(
+	cacheIndex longtaillib.Longtail_StoreIndex,
+	remoteIndex longtaillib.Longtail_StoreIndex,
+	chunkHashes []uint64) (longtaillib.Longtail_StoreIndex, int) {
+	remoteBlocks := map[uint64]bool{}
+	for _, blockHash := range remoteIndex.GetBlockHashes() {
+		remoteBlocks[blockHash] = true
+	}
+	cacheBlockHashes := append([]uint64{}, cacheIndex.GetBlockHashes()...)
+	unreadableBlocks := map[uint64]bool{}
+	if s.policy == VerifyStaleCache {
+		staleBlockHashes := []uint64{}
+		for _, blockHash := range cacheBlockHashes {
+			if !remoteBlocks[blockHash] {
+				staleBlockHashes = append(staleBlockHashes, blockHash)
+			}
+		}
+		unreadableBlocks = s.unreadableCacheBlocks(staleBlockHashes)
+	}
+
+	blockIndexes := []longtaillib.Longtail_BlockIndex{}
+	defer func() {
+		for _, blockIndex := range blockIndexes {
+			blockIndex.Dispose()
+		}
+	}()
+	cachedChunks := map[uint64]bool{}
+	for i, blockHash := range cacheBlockHashes {
+		if unreadableBlocks[blockHash] {
+			continue
+		}
+		blockIndex, errno := cacheIndex.GetBlockIndex(uint32(i))
+		if errno != 0 {
+			return longtaillib.Longtail_StoreIndex{}, errno
+		}
+		blockIndexes = append(blockIndexes, blockIndex)
+		for _, chunkHash := range blockIndex.GetChunkHashes() {
+			cachedChunks[chunkHash] = true
+		}
+	}
+	if len(blockIndexes) == 0 {
+		return longtaillib.Longtail_StoreIndex{}, 0
+	}
+
+	remainingChunkHashes := []uint64{}
+	for _, chunkHash := range chunkHashes {
+		if !cachedChunks[chunkHash] {
+			remainingChunkHashes = append(remainingChunkHashes, chunkHash)
+		}
+	}
+	if len(remainingChunkHashes) > 0 {
+		// The usage of the remote blocks was already checked against all chunks
+		remainingIndex, errno := longtaillib.GetExistingStoreIndex(remoteIndex, remainingChunkHashes, 0)
+		if errno != 0 {
+			return longtaillib.Longtail_StoreIndex{}, errno
+		}
+		defer remainingIndex.Dispose()
+		for i := uint32(0); i < remainingIndex.GetBlockCount(); i++ {
+			blockIndex, errno := remainingIndex.GetBlockIndex(i)
+			if errno != 0 {
+				return longtaillib.Longtail_StoreIndex{}, errno
+			}
+			blockIndexes = append(blockIndexes, blockIndex)
+		}
+	}
+	return longtaillib.CreateStoreIndexFromBlocks(blockIndexes)
+}
+
+// unreadableCacheBlocks returns the blocks of blockHashes that can not be read from the cache
+func (s *cacheIndexBlockStore) unreadableCacheBlocks(blockHashes []uint64) map[uint64]bool {
+	unreadableBlocks := map[uint64]bool{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	blockHashChan := make(chan uint64)
+	for w := 0; w < verifyStaleCacheWorkerCount && w < len(blockHashes); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blockHash := range blockHashChan {
+				storedBlock, errno := getStoredBlockSync(s.cacheStore, blockHash)
+				storedBlock.Dispose()
+				if errno != 0 {
+					lock.Lock()
+					unreadableBlocks[blockHash] = true
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, blockHash := range blockHashes {
+		blockHashChan <- blockHash
+	}
+	close(blockHashChan)
+	wg.Wait()
+	if len(unreadableBlocks) > 0 {
+		log.Printf("WARNING: %d blocks of the cache index could not be read from the cache, their chunks are read from the remote\n", len(unreadableBlocks))
+	}
+	return unreadableBlocks
+}
+
+// PutStoredBlock ...
+func (s *cacheIndexBlockStore) PutStoredBlock(storedBlock longtaillib.Longtail_StoredBlock, asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI) int {
+	return s.cachingStore.PutStoredBlock(storedBlock, asyncCompleteAPI)
+}
+
+// PreflightGet ...
+func (s *cacheIndexBlockStore) PreflightGet(blockHashes []uint64, asyncCompleteAPI longtaillib.Longtail_AsyncPreflightStartedAPI) int {
+	return s.cachingStore.PreflightGet(blockHashes, asyncCompleteAPI)
+}
+
+// GetStoredBlock ...
+func (s *cacheIndexBlockStore) GetStoredBlock(blockHash uint64, asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI) int {
+	return s.cachingStore.GetStoredBlock(blockHash, asyncCompleteAPI)
+}
+
+// GetExistingContent ...
+func (s *cacheIndexBlockStore) GetExistingContent(chunkHashes []uint64, minBlockUsagePercent uint32, asyncCompleteAPI longtaillib.Longtail_AsyncGetExistingContentAPI) int {
+	if s.policy == IgnoreStaleCache {
+		return s.remoteStore.GetExistingContent(chunkHashes, minBlockUsagePercent, asyncCompleteAPI)
+	}
+	request := &cacheIndexRequest{
+		store:            s,
+		chunkHashes:      chunkHashes,
+		asyncCompleteAPI: asyncCompleteAPI,
+		pending:          2}
+	// Cached blocks cost no download however few of their chunks are used
+	errno := s.cacheStore.GetExistingContent(chunkHashes, 0, longtaillib.CreateAsyncGetExistingContentAPI(&cacheIndexCompletionAPI{request: request, fromCache: true}))
+	if errno != 0 {
+		request.complete(true, longtaillib.Longtail_StoreIndex{}, errno)
+	}
+	errno = s.remoteStore.GetExistingContent(chunkHashes, minBlockUsagePercent, longtaillib.CreateAsyncGetExistingContentAPI(&cacheIndexCompletionAPI{request: request, fromCache: false}))
+	if errno != 0 {
+		request.complete(false, longtaillib.Longtail_StoreIndex{}, errno)
+	}
+	return 0
+}
+
+// GetStats ...
+func (s *cacheIndexBlockStore) GetStats() (longtaillib.BlockStoreStats, int) {
+	return s.cachingStore.GetStats()
+}
+
+// Flush ...
+func (s *cacheIndexBlockStore) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI) int {
+	return s.cachingStore.Flush(asyncCompleteAPI)
+}
+
+// Close ...
+func (s *cacheIndexBlockStore) Close() {
+}
@@ -0,0 +1,117 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func putTestBlock(t *testing.T, storeAPI longtaillib.Longtail_BlockStoreAPI, blockHash uint64, chunkHashes []uint64) {
+	chunkSizes := make([]uint32, len(chunkHashes))
+	blockDataLen := 0
+	for i := range chunkHashes {
+		chunkSizes[i] = 16
+		blockDataLen += 16
+	}
+	storedBlock, errno := longtaillib.CreateStoredBlock(blockHash, 997, 2, chunkHashes, chunkSizes, make([]uint8, blockDataLen), false)
+	if errno != 0 {
+		t.Fatalf("putTestBlock() longtaillib.CreateStoredBlock() %d != %d", errno, 0)
+	}
+	errno = putStoredBlockSync(storeAPI, storedBlock)
+	if errno != 0 {
+		t.Fatalf("putTestBlock() putStoredBlockSync() %d != %d", errno, 0)
+	}
+}
+
+func TestParseStaleCachePolicy(t *testing.T) {
+	for _, policy := range []StaleCachePolicy{VerifyStaleCache, TrustStaleCache, IgnoreStaleCache} {
+		parsed, err := ParseStaleCachePolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("TestParseStaleCachePolicy() ParseStaleCachePolicy(%s) %v, %v", policy, parsed, err)
+		}
+	}
+	_, err := ParseStaleCachePolicy("sometimes")
+	if err == nil {
+		t.Errorf("TestParseStaleCachePolicy() ParseStaleCachePolicy(sometimes) %v == %v", err, nil)
+	}
+}
+
+func TestCacheIndexBlockStore(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	remoteBlobStore, _ := NewTestBlobStore("the_path")
+	remoteStore, err := NewRemoteBlockStore(jobs, remoteBlobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestCacheIndexBlockStore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	remoteStoreAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer remoteStoreAPI.Dispose()
+	putTestBlock(t, remoteStoreAPI, 101, []uint64{1, 2, 3})
+	putTestBlock(t, remoteStoreAPI, 102, []uint64{4, 5, 6})
+	putTestBlock(t, remoteStoreAPI, 103, []uint64{7, 8, 9})
+
+	// The cache holds blocks that the remote no longer has, one of them is gone from the cache
+	cacheBlobStore, _ := NewTestBlobStore("the_cache")
+	cacheStore, err := NewRemoteBlockStore(jobs, cacheBlobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestCacheIndexBlockStore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	cacheStoreAPI := longtaillib.CreateBlockStoreAPI(cacheStore)
+	putTestBlock(t, cacheStoreAPI, 201, []uint64{1, 2, 3, 4})
+	putTestBlock(t, cacheStoreAPI, 202, []uint64{7, 8})
+	errno := flushSync(cacheStoreAPI)
+	if errno != 0 {
+		t.Fatalf("TestCacheIndexBlockStore() flushSync() %d != %d", errno, 0)
+	}
+	cacheStoreAPI.Dispose()
+	client, _ := cacheBlobStore.NewClient(context.Background())
+	object, _ := client.NewObject(GetBlockPath("chunks", 202))
+	object.Delete()
+	client.Close()
+	cacheStore, err = NewRemoteBlockStore(jobs, cacheBlobStore, "", runtime.NumCPU(), ReadOnly)
+	if err != nil {
+		t.Fatalf("TestCacheIndexBlockStore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	cacheStoreAPI = longtaillib.CreateBlockStoreAPI(cacheStore)
+	defer cacheStoreAPI.Dispose()
+
+	cachingStoreAPI := longtaillib.CreateCacheBlockStore(jobs, cacheStoreAPI, remoteStoreAPI)
+	defer cachingStoreAPI.Dispose()
+
+	chunkHashes := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	expected := map[StaleCachePolicy][]uint64{
+		IgnoreStaleCache: {101, 102, 103},
+		TrustStaleCache:  {102, 103, 201, 202},
+		VerifyStaleCache: {102, 103, 201}}
+	for policy, expectedBlockHashes := range expected {
+		storeAPI := longtaillib.CreateBlockStoreAPI(NewCacheIndexBlockStore(cacheStoreAPI, remoteStoreAPI, cachingStoreAPI, policy))
+		storeIndex, errno := getExistingContent(t, storeAPI, chunkHashes, 0)
+		if errno != 0 {
+			t.Fatalf("TestCacheIndexBlockStore() getExistingContent(%s) %d != %d", policy, errno, 0)
+		}
+		blockHashes := append([]uint64{}, storeIndex.GetBlockHashes()...)
+		sort.Slice(blockHashes, func(i, j int) bool { return blockHashes[i] < blockHashes[j] })
+		storeIndex.Dispose()
+		if len(blockHashes) != len(expectedBlockHashes) {
+			t.Errorf("TestCacheIndexBlockStore() getExistingContent(%s) blocks %v != %v", policy, blockHashes, expectedBlockHashes)
+		} else {
+			for i := range blockHashes {
+				if blockHashes[i] != expectedBlockHashes[i] {
+					t.Errorf("TestCacheIndexBlockStore() getExistingContent(%s) blocks %v != %v", policy, blockHashes, expectedBlockHashes)
+					break
+				}
+			}
+		}
+
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, 201)
+		if errno != 0 {
+			t.Errorf("TestCacheIndexBlockStore() fetchBlockFromStore(%s, 201) %d != %d", policy, errno, 0)
+		}
+		storedBlock.Dispose()
+		storeAPI.Dispose()
+	}
+}
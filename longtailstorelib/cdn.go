@@ -0,0 +1,169 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// cdnKeyPlaceholder is replaced by the key of the block in the URL template of WithCDN
+const cdnKeyPlaceholder = "{key}"
+
+// cdnCooldown is how long the remote block store reads from the store instead of the CDN after a
+// read from the CDN failed
+const cdnCooldown = 30 * time.Second
+
+// cdnBlobStore reads the blocks of a store through a CDN such as CloudFront or Cloud CDN that has
+// the store as its origin, see WithCDN. Blocks never change once written so they cache well, the
+// store index and everything else is read from the store itself. The store is read-only and can
+// not be listed.
+type cdnBlobStore struct {
+	urlTemplate string
+	httpClient  *http.Client
+}
+
+type cdnBlobClient struct {
+	ctx   context.Context
+	store *cdnBlobStore
+}
+
+// cdnBlobObject fetches the object in Exists so the Read that follows does not need a second request
+type cdnBlobObject struct {
+	client  *cdnBlobClient
+	path    string
+	fetched []byte
+}
+
+// cdnObjectURL returns the URL of the object at key, a template without the {key} placeholder is
+// the base URL of the store
+func cdnObjectURL(urlTemplate string, key string) string {
+	if strings.Contains(urlTemplate, cdnKeyPlaceholder) {
+		return strings.Replace(urlTemplate, cdnKeyPlaceholder, key, -1)
+	}
+	return strings.TrimSuffix(urlTemplate, "/") + "/" + key
+}
+
+// newCDNBlobStore ...
+func newCDNBlobStore(urlTemplate string, opts ...StoreOption) (BlobStore, error) {
+	u, err := url.Parse(cdnObjectURL(urlTemplate, "chunks"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid CDN URL `%s`", urlTemplate)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid CDN URL `%s`, expected an http or https URL", urlTemplate)
+	}
+	options := newStoreOptions(opts)
+	transport, err := NewHTTPTransport(options.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return &cdnBlobStore{urlTemplate: urlTemplate, httpClient: &http.Client{Transport: newSigningRoundTripper(transport, options)}}, nil
+}
+
+func (blobStore *cdnBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	return &cdnBlobClient{ctx: ctx, store: blobStore}, nil
+}
+
+func (blobStore *cdnBlobStore) String() string {
+	return blobStore.urlTemplate
+}
+
+func (blobClient *cdnBlobClient) NewObject(path string) (BlobObject, error) {
+	return &cdnBlobObject{client: blobClient, path: path}, nil
+}
+
+func (blobClient *cdnBlobClient) GetObjects() ([]BlobProperties, error) {
+	return nil, fmt.Errorf("CDN %s can not be listed", blobClient.store)
+}
+
+func (blobClient *cdnBlobClient) ListObjects(prefix string) BlobIterator {
+	return newListingBlobIterator(blobClient.GetObjects, prefix)
+}
+
+func (blobClient *cdnBlobClient) Close() {
+}
+
+func (blobClient *cdnBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+// get requests the object, rangeHeader is sent as the Range header if not empty. Returns
+// longtaillib.ErrENOENT if the CDN does not have the object.
+func (blobObject *cdnBlobObject) get(rangeHeader string) ([]byte, error) {
+	store := blobObject.client.store
+	objectURL := cdnObjectURL(store.urlTemplate, blobObject.path)
+	req, err := http.NewRequest(http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := store.httpClient.Do(req.WithContext(blobObject.client.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, longtaillib.ErrENOENT
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("GET %s: %s", objectURL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, objectURL)
+	}
+	return data, nil
+}
+
+func (blobObject *cdnBlobObject) Exists() (bool, error) {
+	data, err := blobObject.get("")
+	if err == longtaillib.ErrENOENT {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	blobObject.fetched = data
+	return true, nil
+}
+
+func (blobObject *cdnBlobObject) Read() ([]byte, error) {
+	if blobObject.fetched != nil {
+		data := blobObject.fetched
+		blobObject.fetched = nil
+		return data, nil
+	}
+	return blobObject.get("")
+}
+
+func (blobObject *cdnBlobObject) ReadRange(offset int64, length int64) ([]byte, error) {
+	data, err := blobObject.get(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("%s: read %d bytes at %d, expected %d", blobObject.path, len(data), offset, length)
+	}
+	return data, nil
+}
+
+func (blobObject *cdnBlobObject) LockWriteVersion() (bool, error) {
+	return false, fmt.Errorf("CDN %s is read-only", blobObject.client.store)
+}
+
+func (blobObject *cdnBlobObject) Write(data []byte) (bool, error) {
+	return false, fmt.Errorf("CDN %s is read-only", blobObject.client.store)
+}
+
+func (blobObject *cdnBlobObject) Delete() error {
+	return fmt.Errorf("CDN %s is read-only", blobObject.client.store)
+}
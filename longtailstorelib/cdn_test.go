@@ -0,0 +1,102 @@
+package longtailstorelib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestCDNObjectURL(t *testing.T) {
+	for _, test := range []struct {
+		template string
+		url      string
+	}{
+		{"https://cdn.example.com/store/{key}", "https://cdn.example.com/store/chunks/0000/0x0000000000000001.lsb"},
+		{"https://cdn.example.com/{key}?v=1", "https://cdn.example.com/chunks/0000/0x0000000000000001.lsb?v=1"},
+		{"https://cdn.example.com/store/", "https://cdn.example.com/store/chunks/0000/0x0000000000000001.lsb"},
+	} {
+		url := cdnObjectURL(test.template, GetBlockPath("chunks", 1))
+		if url != test.url {
+			t.Errorf("TestCDNObjectURL() cdnObjectURL(%s) %s != %s", test.template, url, test.url)
+		}
+	}
+	_, err := newCDNBlobStore("cdn.example.com/{key}")
+	if err == nil {
+		t.Errorf("TestCDNObjectURL() newCDNBlobStore() without scheme %v == %v", err, nil)
+	}
+}
+
+func TestCDNReads(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestCDNReads() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	cachedBlockHash, _ := storeBlockFromSeed(t, storeAPI, 0)
+	uncachedBlockHash, _ := storeBlockFromSeed(t, storeAPI, 10)
+	storeAPI.Dispose()
+
+	var requestCount int64
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requestCount, 1)
+		key := strings.TrimPrefix(r.URL.Path, "/store/")
+		if atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if key != GetBlockPath("chunks", cachedBlockHash) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		client, _ := blobStore.NewClient(context.Background())
+		defer client.Close()
+		object, _ := client.NewObject(key)
+		data, _ := object.Read()
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	remoteStore, err = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly, WithCDN(server.URL+"/store/{key}"), WithMaxRetries(-1))
+	if err != nil {
+		t.Fatalf("TestCDNReads() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	fetch := func(seed uint8, blockHash uint64) {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+		if errno != 0 {
+			t.Fatalf("TestCDNReads() fetchBlockFromStore(0x%016x) %d != %d", blockHash, errno, 0)
+		}
+		validateBlockFromSeed(t, seed, storedBlock)
+		storedBlock.Dispose()
+	}
+	fetch(0, cachedBlockHash)
+	// Not in the CDN, read from the store
+	fetch(10, uncachedBlockHash)
+	if atomic.LoadInt64(&requestCount) != 2 {
+		t.Errorf("TestCDNReads() CDN requests %d != %d", atomic.LoadInt64(&requestCount), 2)
+	}
+	stats := remoteStore.(BlockSourceStatsProvider).GetBlockSourceStats()
+	if len(stats) != 2 || stats[0].GetCount != 1 || stats[1].GetCount != 2 || stats[1].FailCount != 1 {
+		t.Errorf("TestCDNReads() GetBlockSourceStats() %+v", stats)
+	}
+
+	// A failing CDN is skipped
+	atomic.StoreInt32(&failing, 1)
+	fetch(0, cachedBlockHash)
+	fetch(0, cachedBlockHash)
+	if atomic.LoadInt64(&requestCount) != 3 {
+		t.Errorf("TestCDNReads() CDN requests after failure %d != %d", atomic.LoadInt64(&requestCount), 3)
+	}
+}
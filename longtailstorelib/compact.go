@@ -0,0 +1,406 @@
+package longtailstorelib
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+type compactPutStoredBlockCompletionAPI struct {
+	wg  sync.WaitGroup
+	err int
+}
+
+func (a *compactPutStoredBlockCompletionAPI) OnComplete(err int) {
+	a.err = err
+	a.wg.Done()
+}
+
+type compactGetStoredBlockCompletionAPI struct {
+	wg          sync.WaitGroup
+	storedBlock longtaillib.Longtail_StoredBlock
+	err         int
+}
+
+func (a *compactGetStoredBlockCompletionAPI) OnComplete(storedBlock longtaillib.Longtail_StoredBlock, err int) {
+	a.err = err
+	a.storedBlock = storedBlock
+	a.wg.Done()
+}
+
+type compactFlushCompletionAPI struct {
+	wg  sync.WaitGroup
+	err int
+}
+
+func (a *compactFlushCompletionAPI) OnComplete(err int) {
+	a.err = err
+	a.wg.Done()
+}
+
+func getStoredBlockSync(blockStore longtaillib.Longtail_BlockStoreAPI, blockHash uint64) (longtaillib.Longtail_StoredBlock, int) {
+	g := &compactGetStoredBlockCompletionAPI{}
+	g.wg.Add(1)
+	errno := blockStore.GetStoredBlock(blockHash, longtaillib.CreateAsyncGetStoredBlockAPI(g))
+	if errno != 0 {
+		g.wg.Done()
+		return longtaillib.Longtail_StoredBlock{}, errno
+	}
+	g.wg.Wait()
+	return g.storedBlock, g.err
+}
+
+func putStoredBlockSync(blockStore longtaillib.Longtail_BlockStoreAPI, storedBlock longtaillib.Longtail_StoredBlock) int {
+	p := &compactPutStoredBlockCompletionAPI{}
+	p.wg.Add(1)
+	errno := blockStore.PutStoredBlock(storedBlock, longtaillib.CreateAsyncPutStoredBlockAPI(p))
+	if errno != 0 {
+		p.wg.Done()
+		return errno
+	}
+	p.wg.Wait()
+	return p.err
+}
+
+func flushSync(blockStore longtaillib.Longtail_BlockStoreAPI) int {
+	f := &compactFlushCompletionAPI{}
+	f.wg.Add(1)
+	errno := blockStore.Flush(longtaillib.CreateAsyncFlushAPI(f))
+	if errno != 0 {
+		f.wg.Done()
+		return errno
+	}
+	f.wg.Wait()
+	return f.err
+}
+
+// CompactStore rewrites the blocks where less than minBlockUsagePercent of the chunk data is
+// referenced by liveChunkHashes. The referenced chunks are repacked into new, dense blocks which
+// are added to the store index, the old blocks are then removed from the store index and moved
+// to the trash so they can be restored with UndeleteBlocks until PurgeTrash removes them.
+// Blocks without any live chunks are left for PruneStore.
+// Nothing is changed if dryRun is set.
+// Returns the hashes of the compacted blocks and of the blocks that replaces them.
+//
+// As with PruneStore, compaction must not run at the same time as an upsync to the same store.
+func CompactStore(
+	ctx context.Context,
+	jobAPI longtaillib.Longtail_JobAPI,
+	blobStore BlobStore,
+	liveChunkHashes []uint64,
+	minBlockUsagePercent uint32,
+	maxBlockSize uint32,
+	maxChunksPerBlock uint32,
+	dryRun bool,
+	opts ...StoreOption) ([]uint64, []uint64, error) {
+	if !dryRun && newStoreOptions(opts).Immutable {
+		return nil, nil, errors.Wrap(ErrImmutable, blobStore.String())
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	key := "store.lsi"
+	objHandle, err := blobClient.NewObject(key)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "CompactStore: blobClient.NewObject(%s) failed", key)
+	}
+	blob, err := objHandle.Read()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "CompactStore: objHandle.Read(%s) failed", key)
+	}
+	if blob == nil {
+		return nil, nil, errors.Wrapf(longtaillib.ErrENOENT, "CompactStore: %s", key)
+	}
+	storeIndex, err := readStoreIndexData(blobClient.String(), key, blob)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "CompactStore")
+	}
+	defer storeIndex.Dispose()
+
+	liveChunks := map[uint64]bool{}
+	for _, chunkHash := range liveChunkHashes {
+		liveChunks[chunkHash] = true
+	}
+
+	blockHashes := storeIndex.GetBlockHashes()
+	blockChunksOffsets := storeIndex.GetBlockChunksOffsets()
+	blockChunkCounts := storeIndex.GetBlockChunkCounts()
+	blockTags := storeIndex.GetBlockTags()
+	chunkHashes := storeIndex.GetChunkHashes()
+	chunkSizes := storeIndex.GetChunkSizes()
+
+	var compactedBlockHashes []uint64
+	compactedBlockTags := map[uint64]uint32{}
+	keptChunks := map[uint64]bool{}
+	for b, blockHash := range blockHashes {
+		start := blockChunksOffsets[b]
+		end := start + blockChunkCounts[b]
+		blockSize := uint64(0)
+		usedSize := uint64(0)
+		for c := start; c < end; c++ {
+			blockSize += uint64(chunkSizes[c])
+			if liveChunks[chunkHashes[c]] {
+				usedSize += uint64(chunkSizes[c])
+			}
+		}
+		if usedSize == 0 || usedSize*100 >= blockSize*uint64(minBlockUsagePercent) {
+			for c := start; c < end; c++ {
+				keptChunks[chunkHashes[c]] = true
+			}
+			continue
+		}
+		compactedBlockHashes = append(compactedBlockHashes, blockHash)
+		compactedBlockTags[blockHash] = blockTags[b]
+	}
+	if len(compactedBlockHashes) == 0 {
+		return nil, nil, nil
+	}
+
+	// Live chunks that only exists in compacted blocks are repacked, grouped by the block tag
+	chunksByTag := map[uint32]*chunkList{}
+	chunkSources := map[uint64]uint64{}
+	for b, blockHash := range blockHashes {
+		tag, compacted := compactedBlockTags[blockHash]
+		if !compacted {
+			continue
+		}
+		start := blockChunksOffsets[b]
+		for c := start; c < start+blockChunkCounts[b]; c++ {
+			chunkHash := chunkHashes[c]
+			if !liveChunks[chunkHash] || keptChunks[chunkHash] {
+				continue
+			}
+			keptChunks[chunkHash] = true
+			chunkSources[chunkHash] = blockHash
+			if chunksByTag[tag] == nil {
+				chunksByTag[tag] = &chunkList{}
+			}
+			chunksByTag[tag].add(chunkHash, chunkSizes[c], tag)
+		}
+	}
+	tags := make([]uint32, 0, len(chunksByTag))
+	for tag := range chunksByTag {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+	hashAPI, errno := hashRegistry.GetHashAPI(storeIndex.GetHashIdentifier())
+	if errno != 0 {
+		return nil, nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "CompactStore: hashRegistry.GetHashAPI(0x%08x) failed", storeIndex.GetHashIdentifier())
+	}
+	packedStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	if errno != 0 {
+		return nil, nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "CompactStore: longtaillib.CreateStoreIndexFromBlocks() failed")
+	}
+	defer func() {
+		packedStoreIndex.Dispose()
+	}()
+	for _, tag := range tags {
+		list := chunksByTag[tag]
+		tagStoreIndex, errno := longtaillib.CreateStoreIndexFromChunks(hashAPI, list.hashes, list.sizes, list.tags, maxBlockSize, maxChunksPerBlock)
+		if errno != 0 {
+			return nil, nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "CompactStore: longtaillib.CreateStoreIndexFromChunks() failed")
+		}
+		mergedStoreIndex, errno := longtaillib.MergeStoreIndex(packedStoreIndex, tagStoreIndex)
+		tagStoreIndex.Dispose()
+		if errno != 0 {
+			return nil, nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "CompactStore: longtaillib.MergeStoreIndex() failed")
+		}
+		packedStoreIndex.Dispose()
+		packedStoreIndex = mergedStoreIndex
+	}
+	newBlockHashes := append([]uint64{}, packedStoreIndex.GetBlockHashes()...)
+
+	if dryRun {
+		return compactedBlockHashes, newBlockHashes, nil
+	}
+
+	remoteStore, err := NewRemoteBlockStore(jobAPI, blobStore, "", runtime.NumCPU(), ReadWrite, opts...)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "CompactStore: NewRemoteBlockStore() failed")
+	}
+	remoteStoreAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer remoteStoreAPI.Dispose()
+	compressionRegistry := longtaillib.CreateFullCompressionRegistry()
+	defer compressionRegistry.Dispose()
+	compressStore := longtaillib.CreateCompressBlockStore(remoteStoreAPI, compressionRegistry)
+	defer compressStore.Dispose()
+
+	packedChunksOffsets := packedStoreIndex.GetBlockChunksOffsets()
+	packedChunkCounts := packedStoreIndex.GetBlockChunkCounts()
+	packedTags := packedStoreIndex.GetBlockTags()
+	packedChunkHashes := packedStoreIndex.GetChunkHashes()
+	packedChunkSizes := packedStoreIndex.GetChunkSizes()
+
+	// The chunks of a compacted block are only kept in memory from the first to the last new block
+	// that holds any of them. Chunks are packed in the order of the compacted blocks, so only a few
+	// compacted blocks are held at a time.
+	lastUse := map[uint64]int{}
+	for b := range newBlockHashes {
+		start := packedChunksOffsets[b]
+		for _, chunkHash := range packedChunkHashes[start : start+packedChunkCounts[b]] {
+			lastUse[chunkSources[chunkHash]] = b
+		}
+	}
+	sourceChunks := map[uint64]map[uint64][]byte{}
+	for b, blockHash := range newBlockHashes {
+		start := packedChunksOffsets[b]
+		end := start + packedChunkCounts[b]
+		var blockData []byte
+		for _, chunkHash := range packedChunkHashes[start:end] {
+			sourceHash := chunkSources[chunkHash]
+			if sourceChunks[sourceHash] == nil {
+				chunks, err := readCompactedChunks(compressStore, sourceHash, chunkSources)
+				if err != nil {
+					return nil, nil, err
+				}
+				sourceChunks[sourceHash] = chunks
+			}
+			chunkData, ok := sourceChunks[sourceHash][chunkHash]
+			if !ok {
+				return nil, nil, errors.Wrapf(longtaillib.ErrEBADF, "CompactStore: block 0x%016x does not hold chunk 0x%016x", sourceHash, chunkHash)
+			}
+			blockData = append(blockData, chunkData...)
+		}
+		for sourceHash := range sourceChunks {
+			if lastUse[sourceHash] == b {
+				delete(sourceChunks, sourceHash)
+			}
+		}
+		storedBlock, errno := longtaillib.CreateStoredBlock(
+			blockHash,
+			packedStoreIndex.GetHashIdentifier(),
+			packedTags[b],
+			packedChunkHashes[start:end],
+			packedChunkSizes[start:end],
+			blockData,
+			false)
+		if errno != 0 {
+			return nil, nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "CompactStore: longtaillib.CreateStoredBlock() failed")
+		}
+		errno = putStoredBlockSync(compressStore, storedBlock)
+		storedBlock.Dispose()
+		if errno != 0 {
+			return nil, nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "CompactStore: failed to write block 0x%016x", blockHash)
+		}
+	}
+	errno = flushSync(compressStore)
+	if errno != 0 {
+		return nil, nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "CompactStore: failed to flush %s", blobStore.String())
+	}
+
+	err = removeBlocksFromStoreIndex(blobClient, compactedBlockHashes)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "CompactStore")
+	}
+	layout, err := readBlockLayout(blobClient)
+	if err != nil {
+		return compactedBlockHashes, newBlockHashes, errors.Wrap(err, "CompactStore")
+	}
+	options := resolveStoreOptions(blobStore, opts)
+	err = trashBlocks(ctx, blobStore, blobClient, layout, compactedBlockHashes, time.Now(), options)
+	recordAudit(blobClient, options, AuditEntry{Operation: AuditCompact, AddedBlockCount: len(newBlockHashes), RemovedBlockCount: len(compactedBlockHashes)})
+	if err != nil {
+		return compactedBlockHashes, newBlockHashes, errors.Wrap(err, "CompactStore")
+	}
+	return compactedBlockHashes, newBlockHashes, nil
+}
+
+// readCompactedChunks reads the compacted block blockHash and returns the data of the chunks that
+// chunkSources repacks from it
+func readCompactedChunks(store longtaillib.Longtail_BlockStoreAPI, blockHash uint64, chunkSources map[uint64]uint64) (map[uint64][]byte, error) {
+	storedBlock, errno := getStoredBlockSync(store, blockHash)
+	if errno != 0 {
+		return nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "CompactStore: failed to read block 0x%016x", blockHash)
+	}
+	defer storedBlock.Dispose()
+	blockIndex := storedBlock.GetBlockIndex()
+	blockData := storedBlock.GetChunksBlockData()
+	chunks := map[uint64][]byte{}
+	offset := uint32(0)
+	sizes := blockIndex.GetChunkSizes()
+	for c, chunkHash := range blockIndex.GetChunkHashes() {
+		if chunkSources[chunkHash] == blockHash && chunks[chunkHash] == nil {
+			chunks[chunkHash] = append([]byte{}, blockData[offset:offset+sizes[c]]...)
+		}
+		offset += sizes[c]
+	}
+	return chunks, nil
+}
+
+func removeBlocksFromStoreIndex(blobClient BlobClient, blockHashes []uint64) error {
+	remove := map[uint64]bool{}
+	for _, blockHash := range blockHashes {
+		remove[blockHash] = true
+	}
+
+	key := "store.lsi"
+	objHandle, err := blobClient.NewObject(key)
+	if err != nil {
+		return errors.Wrapf(err, "removeBlocksFromStoreIndex: blobClient.NewObject(%s) failed", key)
+	}
+	for {
+		exists, err := objHandle.LockWriteVersion()
+		if err != nil {
+			return errors.Wrapf(err, "removeBlocksFromStoreIndex: objHandle.LockWriteVersion(%s) failed", key)
+		}
+		if !exists {
+			return errors.Wrapf(longtaillib.ErrENOENT, "removeBlocksFromStoreIndex: %s", key)
+		}
+		blob, err := objHandle.Read()
+		if err != nil {
+			return errors.Wrapf(err, "removeBlocksFromStoreIndex: objHandle.Read(%s) failed", key)
+		}
+		storeIndex, err := readStoreIndexData(blobClient.String(), key, blob)
+		if err != nil {
+			return errors.Wrap(err, "removeBlocksFromStoreIndex")
+		}
+		var blockIndexes []longtaillib.Longtail_BlockIndex
+		for b, blockHash := range storeIndex.GetBlockHashes() {
+			if remove[blockHash] {
+				continue
+			}
+			blockIndex, errno := storeIndex.GetBlockIndex(uint32(b))
+			if errno != 0 {
+				for _, blockIndex := range blockIndexes {
+					blockIndex.Dispose()
+				}
+				storeIndex.Dispose()
+				return errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "removeBlocksFromStoreIndex: storeIndex.GetBlockIndex() failed")
+			}
+			blockIndexes = append(blockIndexes, blockIndex)
+		}
+		storeIndex.Dispose()
+		keepStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks(blockIndexes)
+		for _, blockIndex := range blockIndexes {
+			blockIndex.Dispose()
+		}
+		if errno != 0 {
+			return errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "removeBlocksFromStoreIndex: longtaillib.CreateStoreIndexFromBlocks() failed")
+		}
+		storeBlob, err := writeStoreIndexData(keepStoreIndex)
+		keepStoreIndex.Dispose()
+		if err != nil {
+			return errors.Wrap(err, "removeBlocksFromStoreIndex: writeStoreIndexData() failed")
+		}
+		ok, err := objHandle.Write(storeBlob)
+		if err != nil {
+			return errors.Wrapf(err, "removeBlocksFromStoreIndex: objHandle.Write(%s) failed", key)
+		}
+		if ok {
+			return nil
+		}
+		log.Printf("Retrying updating remote store index %s\n", key)
+	}
+}
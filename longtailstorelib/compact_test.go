@@ -0,0 +1,225 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func createTestVersionIndex(t *testing.T, storageAPI longtaillib.Longtail_StorageAPI, hashAPI longtaillib.Longtail_HashAPI, jobAPI longtaillib.Longtail_JobAPI, rootPath string) longtaillib.Longtail_VersionIndex {
+	fileInfos, errno := longtaillib.GetFilesRecursively(storageAPI, longtaillib.Longtail_PathFilterAPI{}, rootPath)
+	if errno != 0 {
+		t.Fatalf("createTestVersionIndex() GetFilesRecursively() %d != %d", errno, 0)
+	}
+	defer fileInfos.Dispose()
+	chunkerAPI := longtaillib.CreateHPCDCChunkerAPI()
+	defer chunkerAPI.Dispose()
+	versionIndex, errno := longtaillib.CreateVersionIndex(
+		storageAPI,
+		hashAPI,
+		chunkerAPI,
+		jobAPI,
+		nil,
+		rootPath,
+		fileInfos,
+		make([]uint32, fileInfos.GetFileCount()),
+		4096)
+	if errno != 0 {
+		t.Fatalf("createTestVersionIndex() CreateVersionIndex() %d != %d", errno, 0)
+	}
+	return versionIndex
+}
+
+func TestCompactStore(t *testing.T) {
+	hashAPI := longtaillib.CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	jobAPI := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	storageAPI := longtaillib.CreateInMemStorageAPI()
+	defer storageAPI.Dispose()
+
+	small := make([]byte, 1000)
+	rand.Read(small)
+	large := make([]byte, 64*1024)
+	rand.Read(large)
+	storageAPI.WriteToStorage("old", "small.txt", small)
+	storageAPI.WriteToStorage("old", "large.bin", large)
+	storageAPI.WriteToStorage("live", "small.txt", small)
+
+	oldVersionIndex := createTestVersionIndex(t, storageAPI, hashAPI, jobAPI, "old")
+	defer oldVersionIndex.Dispose()
+	liveVersionIndex := createTestVersionIndex(t, storageAPI, hashAPI, jobAPI, "live")
+	defer liveVersionIndex.Dispose()
+
+	blobStore, _ := NewTestBlobStore("the_path")
+	remoteStore, err := NewRemoteBlockStore(jobAPI, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestCompactStore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	emptyStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	defer emptyStoreIndex.Dispose()
+	oldStoreIndex, errno := longtaillib.CreateMissingContent(hashAPI, emptyStoreIndex, oldVersionIndex, 1024*1024, 1024)
+	if errno != 0 {
+		t.Fatalf("TestCompactStore() CreateMissingContent() %d != %d", errno, 0)
+	}
+	defer oldStoreIndex.Dispose()
+	errno = longtaillib.WriteContent(storageAPI, storeAPI, jobAPI, nil, oldStoreIndex, oldVersionIndex, "old")
+	if errno != 0 {
+		t.Fatalf("TestCompactStore() WriteContent() %d != %d", errno, 0)
+	}
+	storeAPI.Dispose()
+	if oldStoreIndex.GetBlockCount() != 1 {
+		t.Fatalf("TestCompactStore() oldStoreIndex.GetBlockCount() %d != %d", oldStoreIndex.GetBlockCount(), 1)
+	}
+	oldBlockHash := oldStoreIndex.GetBlockHashes()[0]
+	liveChunkHashes := liveVersionIndex.GetChunkHashes()
+
+	compactedBlockHashes, newBlockHashes, err := CompactStore(context.Background(), jobAPI, blobStore, liveChunkHashes, 1, 1024*1024, 1024, false)
+	if err != nil || len(compactedBlockHashes) != 0 {
+		t.Errorf("TestCompactStore() CompactStore() below threshold %v, %d != %v, %d", err, len(compactedBlockHashes), nil, 0)
+	}
+
+	compactedBlockHashes, newBlockHashes, err = CompactStore(context.Background(), jobAPI, blobStore, liveChunkHashes, 50, 1024*1024, 1024, true)
+	if err != nil {
+		t.Errorf("TestCompactStore() CompactStore() dry run %v != %v", err, nil)
+	}
+	if len(compactedBlockHashes) != 1 || compactedBlockHashes[0] != oldBlockHash || len(newBlockHashes) != 1 {
+		t.Errorf("TestCompactStore() CompactStore() dry run %v, %v", compactedBlockHashes, newBlockHashes)
+	}
+	if !blobExists(t, blobStore, GetBlockPath("chunks", oldBlockHash)) {
+		t.Errorf("TestCompactStore() CompactStore() dry run removed block 0x%016x", oldBlockHash)
+	}
+
+	compactedBlockHashes, newBlockHashes, err = CompactStore(context.Background(), jobAPI, blobStore, liveChunkHashes, 50, 1024*1024, 1024, false)
+	if err != nil {
+		t.Fatalf("TestCompactStore() CompactStore() %v != %v", err, nil)
+	}
+	if len(compactedBlockHashes) != 1 || len(newBlockHashes) != 1 {
+		t.Fatalf("TestCompactStore() CompactStore() %v, %v", compactedBlockHashes, newBlockHashes)
+	}
+	newBlockHash := newBlockHashes[0]
+	blockHashes := getStoreIndexBlockHashes(t, blobStore)
+	if len(blockHashes) != 1 || !blockHashes[newBlockHash] {
+		t.Errorf("TestCompactStore() CompactStore() store index %v != [0x%016x]", blockHashes, newBlockHash)
+	}
+	if blobExists(t, blobStore, GetBlockPath("chunks", oldBlockHash)) {
+		t.Errorf("TestCompactStore() CompactStore() did not remove block 0x%016x", oldBlockHash)
+	}
+
+	remoteStore, err = NewRemoteBlockStore(jobAPI, blobStore, "", runtime.NumCPU(), ReadOnly)
+	if err != nil {
+		t.Fatalf("TestCompactStore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, newBlockHash)
+	if errno != 0 {
+		t.Fatalf("TestCompactStore() fetchBlockFromStore(0x%016x) %d != %d", newBlockHash, errno, 0)
+	}
+	defer storedBlock.Dispose()
+	blockIndex := storedBlock.GetBlockIndex()
+	if blockIndex.GetChunkCount() != uint32(len(liveChunkHashes)) {
+		t.Errorf("TestCompactStore() blockIndex.GetChunkCount() %d != %d", blockIndex.GetChunkCount(), len(liveChunkHashes))
+	}
+	if !bytes.Equal(storedBlock.GetChunksBlockData(), small) {
+		t.Errorf("TestCompactStore() compacted block data does not match small.txt")
+	}
+
+	restoredBlockHashes, err := UndeleteBlocks(context.Background(), blobStore, []uint64{oldBlockHash})
+	if err != nil || len(restoredBlockHashes) != 1 {
+		t.Errorf("TestCompactStore() UndeleteBlocks() %v, %d != %v, %d", err, len(restoredBlockHashes), nil, 1)
+	}
+}
+
+func TestCompactStoreManyBlocks(t *testing.T) {
+	hashAPI := longtaillib.CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	jobAPI := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	storageAPI := longtaillib.CreateInMemStorageAPI()
+	defer storageAPI.Dispose()
+
+	files := map[string][]byte{}
+	for i, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin", "e.bin", "f.bin"} {
+		data := make([]byte, 40*1024)
+		rand.Read(data)
+		files[name] = data
+		storageAPI.WriteToStorage("old", name, data)
+		if i%2 == 0 {
+			storageAPI.WriteToStorage("live", name, data)
+		}
+	}
+	oldVersionIndex := createTestVersionIndex(t, storageAPI, hashAPI, jobAPI, "old")
+	defer oldVersionIndex.Dispose()
+	liveVersionIndex := createTestVersionIndex(t, storageAPI, hashAPI, jobAPI, "live")
+	defer liveVersionIndex.Dispose()
+
+	blobStore, _ := NewTestBlobStore("the_path")
+	remoteStore, err := NewRemoteBlockStore(jobAPI, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestCompactStoreManyBlocks() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	emptyStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	defer emptyStoreIndex.Dispose()
+	oldStoreIndex, errno := longtaillib.CreateMissingContent(hashAPI, emptyStoreIndex, oldVersionIndex, 24*1024, 1024)
+	if errno != 0 {
+		t.Fatalf("TestCompactStoreManyBlocks() CreateMissingContent() %d != %d", errno, 0)
+	}
+	defer oldStoreIndex.Dispose()
+	errno = longtaillib.WriteContent(storageAPI, storeAPI, jobAPI, nil, oldStoreIndex, oldVersionIndex, "old")
+	storeAPI.Dispose()
+	if errno != 0 {
+		t.Fatalf("TestCompactStoreManyBlocks() WriteContent() %d != %d", errno, 0)
+	}
+
+	compactedBlockHashes, newBlockHashes, err := CompactStore(context.Background(), jobAPI, blobStore, liveVersionIndex.GetChunkHashes(), 100, 24*1024, 1024, false)
+	if err != nil {
+		t.Fatalf("TestCompactStoreManyBlocks() CompactStore() %v != %v", err, nil)
+	}
+	if len(compactedBlockHashes) < 2 || len(newBlockHashes) < 2 {
+		t.Fatalf("TestCompactStoreManyBlocks() CompactStore() %v, %v", compactedBlockHashes, newBlockHashes)
+	}
+
+	// Every live chunk must be in a new block or a block that was kept, with its content
+	remoteStore, err = NewRemoteBlockStore(jobAPI, blobStore, "", runtime.NumCPU(), ReadOnly)
+	if err != nil {
+		t.Fatalf("TestCompactStoreManyBlocks() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	chunkData := map[uint64][]byte{}
+	for blockHash := range getStoreIndexBlockHashes(t, blobStore) {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+		if errno != 0 {
+			t.Fatalf("TestCompactStoreManyBlocks() fetchBlockFromStore(0x%016x) %d != %d", blockHash, errno, 0)
+		}
+		blockIndex := storedBlock.GetBlockIndex()
+		data := storedBlock.GetChunksBlockData()
+		offset := uint32(0)
+		for c, chunkHash := range blockIndex.GetChunkHashes() {
+			size := blockIndex.GetChunkSizes()[c]
+			chunkData[chunkHash] = append([]byte{}, data[offset:offset+size]...)
+			offset += size
+		}
+		storedBlock.Dispose()
+	}
+	chunkHashes := liveVersionIndex.GetChunkHashes()
+	chunkIndexes := liveVersionIndex.GetAssetChunkIndexes()
+	chunkStarts := liveVersionIndex.GetAssetChunkIndexStarts()
+	for a, chunkCount := range liveVersionIndex.GetAssetChunkCounts() {
+		var content []byte
+		for _, chunkIndex := range chunkIndexes[chunkStarts[a] : chunkStarts[a]+chunkCount] {
+			content = append(content, chunkData[chunkHashes[chunkIndex]]...)
+		}
+		path := liveVersionIndex.GetAssetPath(uint32(a))
+		if !bytes.Equal(content, files[path]) {
+			t.Errorf("TestCompactStoreManyBlocks() content of %s does not match", path)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package longtailstorelib
+
+import "sync"
+
+// createOnlyBlobObject is implemented by blob objects that can create an object in a single
+// request that fails if the object exists, such as a PUT with If-None-Match: *, see WithConditionalPuts
+type createOnlyBlobObject interface {
+	// WriteIfAbsent writes the object unless it exists. ok is false if the write should be retried
+	// like a failed Write and existed is true if the object was already there, it is not replaced.
+	WriteIfAbsent(data []byte) (ok bool, existed bool, err error)
+}
+
+// knownBlocks are the blocks the remote block store knows are in the store, from the store index
+// it has read and the blocks it has put. It is an exact set rather than a bloom filter since a
+// false positive would skip the upload of a block that is not in the store. The zero value is
+// ready to use.
+type knownBlocks struct {
+	lock        sync.RWMutex
+	blockHashes map[uint64]struct{}
+}
+
+func (k *knownBlocks) add(blockHashes ...uint64) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.blockHashes == nil {
+		k.blockHashes = make(map[uint64]struct{}, len(blockHashes))
+	}
+	for _, blockHash := range blockHashes {
+		k.blockHashes[blockHash] = struct{}{}
+	}
+}
+
+func (k *knownBlocks) contains(blockHash uint64) bool {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	_, ok := k.blockHashes[blockHash]
+	return ok
+}
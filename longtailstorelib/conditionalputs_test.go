@@ -0,0 +1,55 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestConditionalPuts(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	testStore := blobStore.(*testBlobStore)
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestConditionalPuts() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	storeBlockFromSeed(t, storeAPI, 0)
+	storeAPI.Dispose()
+	if atomic.LoadInt64(&testStore.existsCount) == 0 {
+		t.Errorf("TestConditionalPuts() PutStoredBlock() did not check if the block exists")
+	}
+
+	remoteStore, err = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite, WithConditionalPuts())
+	if err != nil {
+		t.Fatalf("TestConditionalPuts() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	atomic.StoreInt64(&testStore.existsCount, 0)
+	for _, seed := range []uint8{0, 10, 10} {
+		_, errno := storeBlockFromSeed(t, storeAPI, seed)
+		if errno != 0 {
+			t.Fatalf("TestConditionalPuts() storeBlockFromSeed(%d) %d != %d", seed, errno, 0)
+		}
+	}
+	if atomic.LoadInt64(&testStore.existsCount) != 0 {
+		t.Errorf("TestConditionalPuts() PutStoredBlock() Exists calls %d != %d", atomic.LoadInt64(&testStore.existsCount), 0)
+	}
+	stats, _ := storeAPI.GetStats()
+	// Only the first put of seed 10 uploaded its three chunks, the block of seed 0 existed and the second put of seed 10 was known
+	if stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count] != 3 || stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Chunk_Count] != 3 {
+		t.Errorf("TestConditionalPuts() GetStats() puts %d, chunks %d != %d, %d", stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count], stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Chunk_Count], 3, 3)
+	}
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, uint64(10)+21412151)
+	if errno != 0 {
+		t.Fatalf("TestConditionalPuts() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	validateBlockFromSeed(t, 10, storedBlock)
+	storedBlock.Dispose()
+}
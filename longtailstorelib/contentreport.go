@@ -0,0 +1,142 @@
+package longtailstorelib
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// ContentStats is the content of a version, or of a part of it, compared with a store. Sizes are
+// uncompressed chunk sizes.
+type ContentStats struct {
+	ChunkCount uint64
+	Size       uint64
+	// NewChunkCount and NewSize are the chunks that are not in the store, what an upsync uploads
+	NewChunkCount uint64
+	NewSize       uint64
+}
+
+// add counts a chunk of size that is new if it is not in the store
+func (s *ContentStats) add(size uint32, isNew bool) {
+	s.ChunkCount++
+	s.Size += uint64(size)
+	if isNew {
+		s.NewChunkCount++
+		s.NewSize += uint64(size)
+	}
+}
+
+// ContentGroupStats is the content of the files of a version in one top level directory or with
+// one extension
+type ContentGroupStats struct {
+	Name string
+	ContentStats
+}
+
+// ContentReport explains the size of an upsync of a version to a store, see CreateContentReport
+type ContentReport struct {
+	Total ContentStats
+	// Directories has the content per top level directory of the version, files in the root of
+	// the version are in ".". Extensions has the content per lower case file extension, files
+	// without an extension are in "". Both are sorted by NewSize, largest first.
+	Directories []ContentGroupStats
+	Extensions  []ContentGroupStats
+}
+
+// CreateContentReport compares the chunks of versionIndex with the chunks in storeIndex to show
+// how much of the version is new to the store, per top level directory and file extension. A
+// chunk that is used by several files, or several times in a file, is counted once for the first
+// file that uses it so the directories and extensions add up to the total. An invalid storeIndex
+// is an empty store.
+func CreateContentReport(versionIndex longtaillib.Longtail_VersionIndex, storeIndex longtaillib.Longtail_StoreIndex) ContentReport {
+	storeChunks := map[uint64]bool{}
+	if storeIndex.IsValid() {
+		for _, chunkHash := range storeIndex.GetChunkHashes() {
+			storeChunks[chunkHash] = true
+		}
+	}
+
+	directories := map[string]*ContentGroupStats{}
+	extensions := map[string]*ContentGroupStats{}
+	group := func(groups map[string]*ContentGroupStats, name string) *ContentGroupStats {
+		g, exists := groups[name]
+		if !exists {
+			g = &ContentGroupStats{Name: name}
+			groups[name] = g
+		}
+		return g
+	}
+
+	report := ContentReport{}
+	counted := map[uint64]bool{}
+	chunkHashes := versionIndex.GetChunkHashes()
+	chunkSizes := versionIndex.GetChunkSizes()
+	assetChunkCounts := versionIndex.GetAssetChunkCounts()
+	assetChunkIndexStarts := versionIndex.GetAssetChunkIndexStarts()
+	assetChunkIndexes := versionIndex.GetAssetChunkIndexes()
+	for a := uint32(0); a < versionIndex.GetAssetCount(); a++ {
+		assetPath := versionIndex.GetAssetPath(a)
+		if strings.HasSuffix(assetPath, "/") || assetChunkCounts[a] == 0 {
+			continue
+		}
+		directory := "."
+		if i := strings.Index(assetPath, "/"); i != -1 {
+			directory = assetPath[:i]
+		}
+		directoryStats := group(directories, directory)
+		extensionStats := group(extensions, strings.ToLower(path.Ext(assetPath)))
+		start := assetChunkIndexStarts[a]
+		for _, chunkIndex := range assetChunkIndexes[start : start+assetChunkCounts[a]] {
+			chunkHash := chunkHashes[chunkIndex]
+			if counted[chunkHash] {
+				continue
+			}
+			counted[chunkHash] = true
+			isNew := !storeChunks[chunkHash]
+			report.Total.add(chunkSizes[chunkIndex], isNew)
+			directoryStats.add(chunkSizes[chunkIndex], isNew)
+			extensionStats.add(chunkSizes[chunkIndex], isNew)
+		}
+	}
+	report.Directories = sortedContentGroups(directories)
+	report.Extensions = sortedContentGroups(extensions)
+	return report
+}
+
+// sortedContentGroups returns groups sorted by NewSize, then Size and Name
+func sortedContentGroups(groups map[string]*ContentGroupStats) []ContentGroupStats {
+	sorted := make([]ContentGroupStats, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, *g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].NewSize != sorted[j].NewSize {
+			return sorted[i].NewSize > sorted[j].NewSize
+		}
+		if sorted[i].Size != sorted[j].Size {
+			return sorted[i].Size > sorted[j].Size
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// CreateStoreContentReport is CreateContentReport with the store index of blobStore, a store
+// without a store index is empty. Only the store index is read, no blocks are downloaded.
+func CreateStoreContentReport(ctx context.Context, blobStore BlobStore, versionIndex longtaillib.Longtail_VersionIndex) (ContentReport, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return ContentReport{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	storeIndex, err := readStoreIndexObject(blobClient, "store.lsi")
+	if err != nil {
+		return ContentReport{}, errors.Wrapf(err, "CreateStoreContentReport: %s", blobStore.String())
+	}
+	defer storeIndex.Dispose()
+	return CreateContentReport(versionIndex, storeIndex), nil
+}
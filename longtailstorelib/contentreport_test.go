@@ -0,0 +1,66 @@
+package longtailstorelib
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestCreateContentReport(t *testing.T) {
+	hashAPI := longtaillib.CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	jobAPI := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	storageAPI := longtaillib.CreateInMemStorageAPI()
+	defer storageAPI.Dispose()
+
+	small := make([]byte, 1000)
+	rand.Read(small)
+	stored := make([]byte, 8000)
+	rand.Read(stored)
+	added := make([]byte, 4000)
+	rand.Read(added)
+	storageAPI.WriteToStorage("old", "small.txt", small)
+	storageAPI.WriteToStorage("old", "data/stored.bin", stored)
+	storageAPI.WriteToStorage("new", "small.txt", small)
+	storageAPI.WriteToStorage("new", "data/stored.bin", stored)
+	storageAPI.WriteToStorage("new", "data/added.BIN", added)
+	// A copy of a file adds no chunks
+	storageAPI.WriteToStorage("new", "data/copy.txt", small)
+
+	oldVersionIndex := createTestVersionIndex(t, storageAPI, hashAPI, jobAPI, "old")
+	defer oldVersionIndex.Dispose()
+	newVersionIndex := createTestVersionIndex(t, storageAPI, hashAPI, jobAPI, "new")
+	defer newVersionIndex.Dispose()
+	storeIndex, errno := longtaillib.CreateStoreIndex(hashAPI, oldVersionIndex, 1024*1024, 1024)
+	if errno != 0 {
+		t.Fatalf("TestCreateContentReport() CreateStoreIndex() %d != %d", errno, 0)
+	}
+	defer storeIndex.Dispose()
+
+	report := CreateContentReport(newVersionIndex, storeIndex)
+	if report.Total.Size != 13000 || report.Total.NewSize != 4000 || report.Total.NewChunkCount == 0 || report.Total.NewChunkCount >= report.Total.ChunkCount {
+		t.Errorf("TestCreateContentReport() Total %v", report.Total)
+	}
+	if len(report.Directories) != 2 || report.Directories[0].Name != "data" || report.Directories[0].NewSize != 4000 || report.Directories[0].Size != 12000 ||
+		report.Directories[1].Name != "." || report.Directories[1].Size != 1000 || report.Directories[1].NewSize != 0 {
+		t.Errorf("TestCreateContentReport() Directories %v", report.Directories)
+	}
+	if len(report.Extensions) != 2 || report.Extensions[0].Name != ".bin" || report.Extensions[0].Size != 12000 || report.Extensions[0].NewSize != 4000 ||
+		report.Extensions[1].Name != ".txt" || report.Extensions[1].Size != 1000 {
+		t.Errorf("TestCreateContentReport() Extensions %v", report.Extensions)
+	}
+
+	// All content is new to a store without a store index
+	blobStore, _ := NewTestBlobStore("the_path")
+	report, err := CreateStoreContentReport(context.Background(), blobStore, newVersionIndex)
+	if err != nil {
+		t.Fatalf("TestCreateContentReport() CreateStoreContentReport() %v != %v", err, nil)
+	}
+	if report.Total.Size != 13000 || report.Total.NewSize != 13000 || report.Total.NewChunkCount != report.Total.ChunkCount {
+		t.Errorf("TestCreateContentReport() CreateStoreContentReport() Total %v", report.Total)
+	}
+}
@@ -0,0 +1,173 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KeychainCredentialHelper is the spec of NewCredentialHelper for the credential helper of the OS keychain
+const KeychainCredentialHelper = "keychain"
+
+// keychainService is the service of the keychain items that hold the credentials of stores
+const keychainService = "longtail"
+
+// credentialHelperTimeout is how long a credential helper may run, a keychain may ask the user to unlock it
+const credentialHelperTimeout = 2 * time.Minute
+
+// CredentialRequest is the store a CredentialHelper looks up the credentials of, command helpers
+// get it as JSON on their standard input
+type CredentialRequest struct {
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+}
+
+// Credentials are the access key and secret of a store, command helpers write them as JSON to
+// their standard output
+type Credentials struct {
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+}
+
+// CredentialHelper looks up the credentials of a store, so the keys do not have to be kept in
+// environment variables, config files or store URIs. ok is false if the helper has no credentials
+// for the store, the store then uses its usual credential lookup.
+type CredentialHelper interface {
+	GetCredentials(ctx context.Context, request CredentialRequest) (credentials Credentials, ok bool, err error)
+}
+
+// SecretPrompt asks the user for the secret of the access key of a store, for a URI such as
+// s3://KEY@bucket/path, see WithSecretPrompt
+type SecretPrompt func(request CredentialRequest, accessKeyID string) (string, error)
+
+// NewCredentialHelper returns the credential helper of the OS keychain for KeychainCredentialHelper
+// and otherwise a command that is run by the shell with the CredentialRequest on its standard
+// input, and the scheme and host in LONGTAIL_CREDENTIAL_SCHEME and LONGTAIL_CREDENTIAL_HOST. The
+// command writes the Credentials to its standard output, or nothing if it has none for the store.
+func NewCredentialHelper(spec string) (CredentialHelper, error) {
+	if len(strings.TrimSpace(spec)) == 0 {
+		return nil, fmt.Errorf("NewCredentialHelper: empty credential helper")
+	}
+	if spec == KeychainCredentialHelper {
+		return &keychainCredentialHelper{}, nil
+	}
+	return &commandCredentialHelper{command: spec}, nil
+}
+
+type commandCredentialHelper struct {
+	command string
+}
+
+func (h *commandCredentialHelper) GetCredentials(ctx context.Context, request CredentialRequest) (Credentials, bool, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return Credentials{}, false, errors.Wrap(err, "commandCredentialHelper")
+	}
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", h.command)
+	}
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "LONGTAIL_CREDENTIAL_SCHEME="+request.Scheme, "LONGTAIL_CREDENTIAL_HOST="+request.Host)
+	output, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, false, errors.Wrapf(err, "credential helper `%s` failed for %s://%s", h.command, request.Scheme, request.Host)
+	}
+	if len(bytes.TrimSpace(output)) == 0 {
+		return Credentials{}, false, nil
+	}
+	var credentials Credentials
+	err = json.Unmarshal(output, &credentials)
+	if err != nil || credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		// The output is not part of the error, it may hold the secret
+		return Credentials{}, false, fmt.Errorf("credential helper `%s` returned invalid credentials for %s://%s", h.command, request.Scheme, request.Host)
+	}
+	return credentials, true, nil
+}
+
+// keychainCredentialHelper reads the credentials of a store from the OS keychain, with the
+// security tool on macOS and secret-tool of libsecret on Linux. The item has the service longtail
+// and the store, such as s3://bucket, as its account and holds KEY:SECRET.
+type keychainCredentialHelper struct {
+}
+
+// keychainLookupCommand is the command that prints the keychain item of account on goos
+func keychainLookupCommand(goos string, account string) ([]string, error) {
+	switch goos {
+	case "darwin":
+		return []string{"security", "find-generic-password", "-s", keychainService, "-a", account, "-w"}, nil
+	case "windows":
+		return nil, fmt.Errorf("the keychain credential helper is not supported on windows, use a credential helper command")
+	default:
+		return []string{"secret-tool", "lookup", "service", keychainService, "account", account}, nil
+	}
+}
+
+// parseKeychainSecret parses the KEY:SECRET of a keychain item
+func parseKeychainSecret(secret []byte) (Credentials, bool) {
+	parts := strings.SplitN(strings.TrimSpace(string(secret)), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Credentials{}, false
+	}
+	return Credentials{AccessKeyID: parts[0], SecretAccessKey: parts[1]}, true
+}
+
+func (h *keychainCredentialHelper) GetCredentials(ctx context.Context, request CredentialRequest) (Credentials, bool, error) {
+	account := request.Scheme + "://" + request.Host
+	args, err := keychainLookupCommand(runtime.GOOS, account)
+	if err != nil {
+		return Credentials{}, false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, credentialHelperTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if _, isExitError := err.(*exec.ExitError); isExitError && len(output) == 0 {
+		// The tools exit with an error when there is no such item
+		return Credentials{}, false, nil
+	}
+	if err != nil {
+		return Credentials{}, false, errors.Wrapf(err, "keychain credential helper failed for %s", account)
+	}
+	credentials, ok := parseKeychainSecret(output)
+	if !ok {
+		return Credentials{}, false, fmt.Errorf("keychain item of %s is not KEY:SECRET", account)
+	}
+	return credentials, true, nil
+}
+
+// lookupCredentials sets the credentials of the store at host from the credential helper of the
+// host, or the helper for all hosts, unless the store has credentials or is anonymous
+func lookupCredentials(options *StoreOptions, scheme string, host string) error {
+	if options.Anonymous || len(options.AccessKeyID) > 0 {
+		return nil
+	}
+	helper, ok := options.CredentialHelpers[host]
+	if !ok {
+		helper, ok = options.CredentialHelpers[""]
+	}
+	if !ok {
+		return nil
+	}
+	credentials, ok, err := helper.GetCredentials(context.Background(), CredentialRequest{Scheme: scheme, Host: host})
+	if err != nil {
+		return err
+	}
+	if ok {
+		options.AccessKeyID = credentials.AccessKeyID
+		options.SecretAccessKey = credentials.SecretAccessKey
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+type testCredentialHelper struct {
+	credentials Credentials
+	requests    []CredentialRequest
+}
+
+func (h *testCredentialHelper) GetCredentials(ctx context.Context, request CredentialRequest) (Credentials, bool, error) {
+	h.requests = append(h.requests, request)
+	return h.credentials, h.credentials.AccessKeyID != "", nil
+}
+
+func TestCredentialHelperPerHost(t *testing.T) {
+	bucketHelper := &testCredentialHelper{credentials: Credentials{AccessKeyID: "BUCKETKEY", SecretAccessKey: "bucket-secret"}}
+	defaultHelper := &testCredentialHelper{credentials: Credentials{AccessKeyID: "DEFAULTKEY", SecretAccessKey: "default-secret"}}
+	opts := []StoreOption{WithCredentialHelper("", defaultHelper), WithCredentialHelper("bucket", bucketHelper)}
+
+	for _, test := range []struct {
+		uri         string
+		accessKeyID string
+	}{
+		{"s3://bucket/store", "BUCKETKEY"},
+		{"s3://other-bucket/store", "DEFAULTKEY"},
+		{"s3://URIKEY:uri-secret@bucket/store", "URIKEY"},
+	} {
+		blobStore, err := CreateBlobStoreForURI(test.uri, opts...)
+		if err != nil {
+			t.Fatalf("TestCredentialHelperPerHost() CreateBlobStoreForURI(%s) %v != %v", test.uri, err, nil)
+		}
+		if accessKeyID := blobStore.(*s3BlobStore).options.AccessKeyID; accessKeyID != test.accessKeyID {
+			t.Errorf("TestCredentialHelperPerHost() CreateBlobStoreForURI(%s) AccessKeyID %s != %s", test.uri, accessKeyID, test.accessKeyID)
+		}
+	}
+	if len(bucketHelper.requests) != 1 || bucketHelper.requests[0] != (CredentialRequest{Scheme: "s3", Host: "bucket"}) {
+		t.Errorf("TestCredentialHelperPerHost() bucket helper requests %v", bucketHelper.requests)
+	}
+	if len(defaultHelper.requests) != 1 || defaultHelper.requests[0].Host != "other-bucket" {
+		t.Errorf("TestCredentialHelperPerHost() default helper requests %v", defaultHelper.requests)
+	}
+
+	// Anonymous stores and stores the helper has no credentials for do not get any
+	u, _ := url.Parse("s3://public-assets/store")
+	blobStore, err := NewS3BlobStore(u, append(opts, WithAnonymous())...)
+	if err != nil || blobStore.(*s3BlobStore).options.AccessKeyID != "" {
+		t.Errorf("TestCredentialHelperPerHost() NewS3BlobStore() anonymous %v", err)
+	}
+	blobStore, err = NewS3BlobStore(u, WithCredentialHelper("", &testCredentialHelper{}))
+	if err != nil || blobStore.(*s3BlobStore).options.AccessKeyID != "" {
+		t.Errorf("TestCredentialHelperPerHost() NewS3BlobStore() without credentials %v", err)
+	}
+}
+
+func TestCommandCredentialHelper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test helper is a shell script")
+	}
+	root, _ := ioutil.TempDir("", "longtailstorelib")
+	defer os.RemoveAll(root)
+	script := filepath.Join(root, "helper.sh")
+	ioutil.WriteFile(script, []byte(`#!/bin/sh
+cat > /dev/null
+if [ "$LONGTAIL_CREDENTIAL_HOST" = "bucket" ]; then
+	echo '{"accessKeyId": "AKIAEXAMPLE", "secretAccessKey": "secret"}'
+elif [ "$LONGTAIL_CREDENTIAL_HOST" = "broken" ]; then
+	echo 'not json secret'
+fi
+`), 0755)
+
+	helper, err := NewCredentialHelper(script)
+	if err != nil {
+		t.Fatalf("TestCommandCredentialHelper() NewCredentialHelper() %v != %v", err, nil)
+	}
+	ctx := context.Background()
+	credentials, ok, err := helper.GetCredentials(ctx, CredentialRequest{Scheme: "s3", Host: "bucket"})
+	if err != nil || !ok || credentials != (Credentials{AccessKeyID: "AKIAEXAMPLE", SecretAccessKey: "secret"}) {
+		t.Errorf("TestCommandCredentialHelper() GetCredentials() %+v, %v, %v", credentials, ok, err)
+	}
+	credentials, ok, err = helper.GetCredentials(ctx, CredentialRequest{Scheme: "s3", Host: "other-bucket"})
+	if err != nil || ok {
+		t.Errorf("TestCommandCredentialHelper() GetCredentials() other-bucket %+v, %v, %v", credentials, ok, err)
+	}
+	_, _, err = helper.GetCredentials(ctx, CredentialRequest{Scheme: "s3", Host: "broken"})
+	if err == nil {
+		t.Errorf("TestCommandCredentialHelper() GetCredentials() broken %v == %v", err, nil)
+	} else if fmt.Sprint(err) != fmt.Sprintf("credential helper `%s` returned invalid credentials for s3://broken", script) {
+		t.Errorf("TestCommandCredentialHelper() GetCredentials() broken %v", err)
+	}
+
+	failing, _ := NewCredentialHelper("exit 3")
+	if _, _, err := failing.GetCredentials(ctx, CredentialRequest{Scheme: "s3", Host: "bucket"}); err == nil {
+		t.Errorf("TestCommandCredentialHelper() GetCredentials() failing %v == %v", err, nil)
+	}
+	if _, err := NewCredentialHelper(" "); err == nil {
+		t.Errorf("TestCommandCredentialHelper() NewCredentialHelper() empty %v == %v", err, nil)
+	}
+}
+
+func TestCredentialHelperStoreOption(t *testing.T) {
+	_, opts, err := ParseStoreURI("s3://bucket/store?credential-helper=keychain")
+	if err != nil {
+		t.Fatalf("TestCredentialHelperStoreOption() ParseStoreURI() %v != %v", err, nil)
+	}
+	if _, ok := newStoreOptions(opts).CredentialHelpers[""].(*keychainCredentialHelper); !ok {
+		t.Errorf("TestCredentialHelperStoreOption() ParseStoreURI() helpers %v", newStoreOptions(opts).CredentialHelpers)
+	}
+
+	// Commands are only taken from the caller, not from store URIs
+	if _, _, err := ParseStoreURI("s3://bucket/store?credential-helper=touch%20pwned"); err == nil {
+		t.Errorf("TestCredentialHelperStoreOption() ParseStoreURI() command %v == %v", err, nil)
+	}
+
+	// LONGTAIL_CREDENTIAL_HELPER belongs to the --credential-helper flag of the CLI, the stores ignore it
+	os.Setenv("LONGTAIL_CREDENTIAL_HELPER", "touch pwned")
+	defer os.Unsetenv("LONGTAIL_CREDENTIAL_HELPER")
+	opts, err = StoreOptionsFromEnvironment()
+	if err != nil || len(newStoreOptions(opts).CredentialHelpers) != 0 {
+		t.Errorf("TestCredentialHelperStoreOption() StoreOptionsFromEnvironment() %v, %v", newStoreOptions(opts).CredentialHelpers, err)
+	}
+	if _, err := CreateBlobStoreForURI("s3://bucket/store"); err != nil {
+		t.Errorf("TestCredentialHelperStoreOption() CreateBlobStoreForURI() %v != %v", err, nil)
+	}
+}
+
+func TestKeychainCredentialHelper(t *testing.T) {
+	args, err := keychainLookupCommand("darwin", "s3://bucket")
+	if err != nil || len(args) == 0 || args[0] != "security" {
+		t.Errorf("TestKeychainCredentialHelper() keychainLookupCommand(darwin) %v, %v", args, err)
+	}
+	args, err = keychainLookupCommand("linux", "s3://bucket")
+	if err != nil || len(args) == 0 || args[0] != "secret-tool" || args[len(args)-1] != "s3://bucket" {
+		t.Errorf("TestKeychainCredentialHelper() keychainLookupCommand(linux) %v, %v", args, err)
+	}
+	if _, err := keychainLookupCommand("windows", "s3://bucket"); err == nil {
+		t.Errorf("TestKeychainCredentialHelper() keychainLookupCommand(windows) %v == %v", err, nil)
+	}
+
+	credentials, ok := parseKeychainSecret([]byte("AKIAEXAMPLE:wJalr/XUtnFEMI:K7MDENG\n"))
+	if !ok || credentials != (Credentials{AccessKeyID: "AKIAEXAMPLE", SecretAccessKey: "wJalr/XUtnFEMI:K7MDENG"}) {
+		t.Errorf("TestKeychainCredentialHelper() parseKeychainSecret() %+v, %v", credentials, ok)
+	}
+	if _, ok := parseKeychainSecret([]byte("no-secret")); ok {
+		t.Errorf("TestKeychainCredentialHelper() parseKeychainSecret() no-secret %v", ok)
+	}
+}
@@ -0,0 +1,59 @@
+package longtailstorelib
+
+import (
+	"context"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// The default number of requests per decode worker that wait in the decode queue, each of them
+// holds the blob of a block
+const defaultDecodeQueueDepthPerWorker = 2
+
+// decodeBlockMessage is a block blob read by a download worker that a decode worker decodes to
+// complete the requests for the block
+type decodeBlockMessage struct {
+	fetched         fetchedBlock
+	prefetchedBlock *pendingPrefetchedBlock
+}
+
+// queueDecode hands a fetched block to the decode workers, the fetching worker waits for room in
+// the decode queue so the decode workers hold back the downloads when they can not keep up
+func queueDecode(s *remoteStore, msg decodeBlockMessage) {
+	s.pendingDecodes.Add(1)
+	select {
+	case s.decodeBlockChan <- msg:
+	default:
+		wait := s.decodeQueue.full(0)
+		s.decodeBlockChan <- msg
+		wait.done(false)
+	}
+}
+
+// decodeWorker decodes the fetched blocks until decodeBlockMessages is closed. Decoding the block
+// and completing the get requests, which decompresses the block in the compress block store, is
+// done here so the download workers can go on with the next read.
+func decodeWorker(
+	ctx context.Context,
+	s *remoteStore,
+	pool *workerPool,
+	decodeBlockMessages <-chan decodeBlockMessage) error {
+	client, err := s.blobStore.NewClient(ctx)
+	if err != nil {
+		for msg := range decodeBlockMessages {
+			msg.fetched.buffer.release()
+			completeFetchedBlock(s, msg.fetched.blockHash, msg.prefetchedBlock, longtaillib.Longtail_StoredBlock{}, err)
+			s.pendingDecodes.Done()
+		}
+		return errors.Wrap(err, s.blobStore.String())
+	}
+	defer client.Close()
+	for msg := range decodeBlockMessages {
+		pool.begin()
+		completeFetchedBlob(ctx, s, client, msg.fetched, msg.prefetchedBlock)
+		pool.end()
+		s.pendingDecodes.Done()
+	}
+	return nil
+}
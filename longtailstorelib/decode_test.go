@@ -0,0 +1,111 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestDecodeWorkers(t *testing.T) {
+	for _, decodeWorkerCount := range []int{2, -1} {
+		blobStore, _ := NewTestBlobStore("the_path")
+		jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 2, ReadWrite, WithDecodeWorkerCount(decodeWorkerCount))
+		if err != nil {
+			t.Fatalf("TestDecodeWorkers() NewRemoteBlockStore() %v != %v", err, nil)
+		}
+		storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+
+		blockHashes := []uint64{}
+		for seed := uint8(0); seed < 40; seed += 10 {
+			blockHash, errno := storeBlockFromSeed(t, storeAPI, seed)
+			if errno != 0 {
+				t.Fatalf("TestDecodeWorkers() storeBlockFromSeed() %d != %d", errno, 0)
+			}
+			blockHashes = append(blockHashes, blockHash)
+		}
+		for i, blockHash := range blockHashes {
+			storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+			if errno != 0 {
+				t.Fatalf("TestDecodeWorkers() fetchBlockFromStore() %d != %d", errno, 0)
+			}
+			validateBlockFromSeed(t, uint8(i*10), storedBlock)
+			storedBlock.Dispose()
+		}
+		_, errno := fetchBlockFromStore(t, storeAPI, 0xdeadbeef)
+		if errno != longtaillib.ENOENT {
+			t.Errorf("TestDecodeWorkers() fetchBlockFromStore() missing block %d != %d", errno, longtaillib.ENOENT)
+		}
+
+		pools := remoteStore.(DetailedStatsProvider).GetDetailedStats().WorkerPools
+		if decodeWorkerCount > 0 {
+			if len(pools) != 2 || pools[1].Name != WorkerPoolDecode || pools[1].WorkerCount != decodeWorkerCount || pools[1].RequestCount != uint64(len(blockHashes)) {
+				t.Errorf("TestDecodeWorkers() GetDetailedStats().WorkerPools %+v", pools)
+			}
+		} else if len(pools) != 1 || pools[0].Name != WorkerPoolShared {
+			t.Errorf("TestDecodeWorkers() GetDetailedStats().WorkerPools without decode workers %+v", pools)
+		}
+		storeAPI.Dispose()
+		jobs.Dispose()
+	}
+}
+
+func TestBlockFiles(t *testing.T) {
+	filePath, err := ioutil.TempDir("", "longtail_block_files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filePath)
+
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blockStore, err := NewRemoteBlockStore(jobs, blobStore, "", 2, ReadWrite, WithBlockFiles(1, filePath), WithDecodeWorkerCount(-1))
+	if err != nil {
+		t.Fatalf("TestBlockFiles() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(blockStore)
+	s := blockStore.(*remoteStore)
+
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Fatalf("TestBlockFiles() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	prefetchedBlockHash, errno := storeBlockFromSeed(t, storeAPI, 10)
+	if errno != 0 {
+		t.Fatalf("TestBlockFiles() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+	if errno != 0 {
+		t.Fatalf("TestBlockFiles() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	validateBlockFromSeed(t, 0, storedBlock)
+	storedBlock.Dispose()
+
+	// A prefetched block stays in its file until it is requested
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	prefetchBlock(context.Background(), s, client, prefetchBlockMessage{blockHash: prefetchedBlockHash})
+	files, _ := ioutil.ReadDir(filePath)
+	if len(files) != 1 || s.prefetchBlocks[prefetchedBlockHash].blockFile == nil || atomic.LoadInt64(&s.prefetchMemory) != 0 {
+		t.Errorf("TestBlockFiles() prefetched block files %d, prefetch memory %d", len(files), s.prefetchMemory)
+	}
+	storedBlock, errno = fetchBlockFromStore(t, storeAPI, prefetchedBlockHash)
+	if errno != 0 {
+		t.Fatalf("TestBlockFiles() fetchBlockFromStore() prefetched %d != %d", errno, 0)
+	}
+	validateBlockFromSeed(t, 10, storedBlock)
+	storedBlock.Dispose()
+
+	storeAPI.Dispose()
+	files, _ = ioutil.ReadDir(filePath)
+	if len(files) != 0 {
+		t.Errorf("TestBlockFiles() %d block files left after close", len(files))
+	}
+}
@@ -0,0 +1,158 @@
+package longtailstorelib
+
+import (
+	"context"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// DedupTitle is a store and the chunks of its versions to compare with other titles in a
+// DedupReport
+type DedupTitle struct {
+	Name      string
+	BlobStore BlobStore
+	// ChunkHashes are the chunks of the versions of the title, all chunks of the store are used if empty
+	ChunkHashes []uint64
+}
+
+// DedupTitleStats is the content of a title in a DedupReport, sizes are uncompressed chunk sizes
+type DedupTitleStats struct {
+	Name       string
+	ChunkCount uint64
+	Size       uint64
+	BlockCount uint64
+	// MissingChunkCount is the number of chunks of the versions that are not in the store
+	MissingChunkCount uint64
+}
+
+// DedupOverlap is the content shared by two titles of a DedupReport
+type DedupOverlap struct {
+	First      int
+	Second     int
+	ChunkCount uint64
+	Size       uint64
+	// BlockCount is the number of identical blocks in both stores, blocks only match when both
+	// stores pack chunks the same way, for example with deterministic block packing
+	BlockCount uint64
+}
+
+// DedupReport describes how much content several titles share
+type DedupReport struct {
+	Titles []DedupTitleStats
+	// Overlaps holds a DedupOverlap for each pair of titles
+	Overlaps []DedupOverlap
+	// CombinedChunkCount and CombinedSize are the unique chunks of all titles, which is the
+	// content of a store that holds all titles
+	CombinedChunkCount uint64
+	CombinedSize       uint64
+}
+
+// Savings returns the bytes saved by keeping all titles in one store instead of separate stores
+func (r DedupReport) Savings() uint64 {
+	size := uint64(0)
+	for _, title := range r.Titles {
+		size += title.Size
+	}
+	return size - r.CombinedSize
+}
+
+// dedupTitleContent is the chunks and blocks used by a title
+type dedupTitleContent struct {
+	chunkSizes map[uint64]uint32
+	blocks     map[uint64]bool
+}
+
+func readDedupTitleContent(ctx context.Context, title DedupTitle) (dedupTitleContent, DedupTitleStats, error) {
+	content := dedupTitleContent{chunkSizes: map[uint64]uint32{}, blocks: map[uint64]bool{}}
+	stats := DedupTitleStats{Name: title.Name}
+
+	blobClient, err := title.BlobStore.NewClient(ctx)
+	if err != nil {
+		return content, stats, errors.Wrap(err, title.BlobStore.String())
+	}
+	defer blobClient.Close()
+	storeIndex, err := readStoreIndexObject(blobClient, "store.lsi")
+	if err != nil {
+		return content, stats, errors.Wrapf(err, "readDedupTitleContent: %s", title.BlobStore.String())
+	}
+	if !storeIndex.IsValid() {
+		return content, stats, errors.Wrapf(longtaillib.ErrENOENT, "readDedupTitleContent: %s has no store index", title.BlobStore.String())
+	}
+	defer storeIndex.Dispose()
+
+	liveChunks := map[uint64]bool{}
+	for _, chunkHash := range title.ChunkHashes {
+		liveChunks[chunkHash] = true
+	}
+	blockHashes := storeIndex.GetBlockHashes()
+	blockChunksOffsets := storeIndex.GetBlockChunksOffsets()
+	blockChunkCounts := storeIndex.GetBlockChunkCounts()
+	chunkHashes := storeIndex.GetChunkHashes()
+	chunkSizes := storeIndex.GetChunkSizes()
+	for b, blockHash := range blockHashes {
+		start := blockChunksOffsets[b]
+		for c := start; c < start+blockChunkCounts[b]; c++ {
+			chunkHash := chunkHashes[c]
+			if len(liveChunks) > 0 && !liveChunks[chunkHash] {
+				continue
+			}
+			content.blocks[blockHash] = true
+			if _, exists := content.chunkSizes[chunkHash]; !exists {
+				content.chunkSizes[chunkHash] = chunkSizes[c]
+				stats.Size += uint64(chunkSizes[c])
+			}
+		}
+	}
+	stats.ChunkCount = uint64(len(content.chunkSizes))
+	stats.BlockCount = uint64(len(content.blocks))
+	for chunkHash := range liveChunks {
+		if _, exists := content.chunkSizes[chunkHash]; !exists {
+			stats.MissingChunkCount++
+		}
+	}
+	return content, stats, nil
+}
+
+// CreateDedupReport compares the content of titles in separate stores to guide which titles to
+// consolidate into one store. Chunks are identified by their hash so the titles must use the same
+// hashing. Only the store indexes are read, no blocks are downloaded.
+func CreateDedupReport(ctx context.Context, titles []DedupTitle) (DedupReport, error) {
+	report := DedupReport{}
+	contents := make([]dedupTitleContent, len(titles))
+	for i, title := range titles {
+		content, stats, err := readDedupTitleContent(ctx, title)
+		if err != nil {
+			return report, err
+		}
+		contents[i] = content
+		report.Titles = append(report.Titles, stats)
+	}
+
+	combinedChunks := map[uint64]bool{}
+	for i := range contents {
+		for chunkHash, chunkSize := range contents[i].chunkSizes {
+			if !combinedChunks[chunkHash] {
+				combinedChunks[chunkHash] = true
+				report.CombinedSize += uint64(chunkSize)
+			}
+		}
+		for j := i + 1; j < len(contents); j++ {
+			overlap := DedupOverlap{First: i, Second: j}
+			for chunkHash, chunkSize := range contents[i].chunkSizes {
+				if _, shared := contents[j].chunkSizes[chunkHash]; shared {
+					overlap.ChunkCount++
+					overlap.Size += uint64(chunkSize)
+				}
+			}
+			for blockHash := range contents[i].blocks {
+				if contents[j].blocks[blockHash] {
+					overlap.BlockCount++
+				}
+			}
+			report.Overlaps = append(report.Overlaps, overlap)
+		}
+	}
+	report.CombinedChunkCount = uint64(len(combinedChunks))
+	return report, nil
+}
@@ -0,0 +1,65 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func createDedupTestStore(t *testing.T, jobs longtaillib.Longtail_JobAPI, seeds []uint8) BlobStore {
+	blobStore, _ := NewTestBlobStore("the_path")
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("createDedupTestStore() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	for _, seed := range seeds {
+		_, errno := storeBlockFromSeed(t, storeAPI, seed)
+		if errno != 0 {
+			t.Fatalf("createDedupTestStore() storeBlockFromSeed(t, storeAPI, %d) %d != %d", seed, errno, 0)
+		}
+	}
+	return blobStore
+}
+
+func TestCreateDedupReport(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	// The block of seed 10 is in both stores
+	firstStore := createDedupTestStore(t, jobs, []uint8{0, 10})
+	secondStore := createDedupTestStore(t, jobs, []uint8{10, 20})
+
+	report, err := CreateDedupReport(context.Background(), []DedupTitle{
+		{Name: "first", BlobStore: firstStore},
+		{Name: "second", BlobStore: secondStore}})
+	if err != nil {
+		t.Fatalf("TestCreateDedupReport() CreateDedupReport() %v != %v", err, nil)
+	}
+	if len(report.Titles) != 2 || report.Titles[0].ChunkCount != 6 || report.Titles[0].Size != 150 || report.Titles[1].Size != 210 || report.Titles[1].BlockCount != 2 {
+		t.Errorf("TestCreateDedupReport() report.Titles %v", report.Titles)
+	}
+	if len(report.Overlaps) != 1 || report.Overlaps[0].ChunkCount != 3 || report.Overlaps[0].Size != 90 || report.Overlaps[0].BlockCount != 1 {
+		t.Errorf("TestCreateDedupReport() report.Overlaps %v", report.Overlaps)
+	}
+	if report.CombinedChunkCount != 9 || report.CombinedSize != 270 || report.Savings() != 90 {
+		t.Errorf("TestCreateDedupReport() combined %d chunks, %d bytes, savings %d", report.CombinedChunkCount, report.CombinedSize, report.Savings())
+	}
+
+	// Only the chunks of the versions of a title are compared
+	report, err = CreateDedupReport(context.Background(), []DedupTitle{
+		{Name: "first", BlobStore: firstStore},
+		{Name: "second", BlobStore: secondStore, ChunkHashes: []uint64{21, 99}}})
+	if err != nil {
+		t.Fatalf("TestCreateDedupReport() CreateDedupReport() %v != %v", err, nil)
+	}
+	second := report.Titles[1]
+	if second.ChunkCount != 1 || second.Size != 30 || second.BlockCount != 1 || second.MissingChunkCount != 1 {
+		t.Errorf("TestCreateDedupReport() report.Titles[1] %v", second)
+	}
+	if report.Overlaps[0].ChunkCount != 0 || report.Savings() != 0 {
+		t.Errorf("TestCreateDedupReport() report.Overlaps %v, savings %d", report.Overlaps, report.Savings())
+	}
+}
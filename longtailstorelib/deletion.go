@@ -0,0 +1,111 @@
+package longtailstorelib
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// deleteBatchSize is the number of objects deleted per batch, the most an S3 DeleteObjects request
+// accepts
+const deleteBatchSize = 1000
+
+// defaultDeleteWorkerCount is the number of batches deleted in parallel unless WithWorkerCount is set
+const defaultDeleteWorkerCount = 8
+
+// BatchDeleteBlobClient is implemented by blob clients that can delete many objects with fewer
+// requests than one per object, such as S3 DeleteObjects. Clients that do not implement it have
+// their objects deleted one at a time.
+type BatchDeleteBlobClient interface {
+	// DeleteObjects deletes the objects at paths, at most deleteBatchSize of them. It returns the
+	// error of each path, nil for an object that was deleted or did not exist.
+	DeleteObjects(paths []string) []error
+}
+
+// deleteObjects deletes the objects at paths with one BatchDeleteBlobClient call or one Delete per object
+func deleteObjects(client BlobClient, paths []string) []error {
+	if batchClient, ok := client.(BatchDeleteBlobClient); ok {
+		return batchClient.DeleteObjects(paths)
+	}
+	errs := make([]error, len(paths))
+	for i, path := range paths {
+		objHandle, err := client.NewObject(path)
+		if err == nil {
+			err = objHandle.Delete()
+		}
+		errs[i] = err
+	}
+	return errs
+}
+
+// deleteBlobs deletes the objects at paths in batches of deleteBatchSize, options.WorkerCount batches
+// at a time each with its own client. The deletes that fail are retried like block reads, see
+// StoreOptions.MaxRetries. Returns which of paths were deleted and the error of the first object
+// that could not be deleted, the batches that were started are finished.
+func deleteBlobs(ctx context.Context, blobStore BlobStore, paths []string, options StoreOptions) ([]bool, error) {
+	deleted := make([]bool, len(paths))
+	batchCount := (len(paths) + deleteBatchSize - 1) / deleteBatchSize
+	workerCount := options.WorkerCount
+	if workerCount < 1 {
+		workerCount = defaultDeleteWorkerCount
+	}
+
+	var mutex sync.Mutex
+	deletedCount := 0
+	deletedBatchCount := 0
+	err := forEachBlob(ctx, blobStore, workerCount, batchCount, func(client BlobClient, b int) error {
+		end := (b + 1) * deleteBatchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+		pending := make([]int, 0, end-b*deleteBatchSize)
+		for i := b * deleteBatchSize; i < end; i++ {
+			pending = append(pending, i)
+		}
+		batchDeletedCount := len(pending)
+		for retryCount := 0; len(pending) > 0; retryCount++ {
+			if retryCount > 0 {
+				delay := retryDelays[len(retryDelays)-1]
+				if retryCount <= len(retryDelays) {
+					delay = retryDelays[retryCount-1]
+				}
+				time.Sleep(delay)
+			}
+			batchPaths := make([]string, len(pending))
+			for j, i := range pending {
+				batchPaths[j] = paths[i]
+			}
+			errs := deleteObjects(client, batchPaths)
+			var failed []int
+			var failedErrs []error
+			for j, i := range pending {
+				if errs[j] == nil {
+					deleted[i] = true
+					continue
+				}
+				failed = append(failed, i)
+				failedErrs = append(failedErrs, errs[j])
+			}
+			if len(failed) > 0 && (retryCount >= options.maxRetries() || ctx.Err() != nil) {
+				return errors.Wrapf(failedErrs[0], "failed to delete `%s`", paths[failed[0]])
+			}
+			for k, i := range failed {
+				options.Hooks.retry(paths[i], retryCount+1, failedErrs[k])
+			}
+			pending = failed
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		deletedCount += batchDeletedCount
+		deletedBatchCount++
+		if batchCount > 1 && deletedBatchCount%((batchCount+15)/16) == 0 {
+			log.Printf("Deleted %d/%d objects from %s\n", deletedCount, len(paths), blobStore.String())
+		}
+		return nil
+	})
+	return deleted, err
+}
@@ -0,0 +1,101 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// batchDeleteBlobStore deletes in batches and fails the first attempt of each path in failOnce
+// and every attempt of the paths in failAlways
+type batchDeleteBlobStore struct {
+	BlobStore
+	sync.Mutex
+	batchSizes []int
+	failOnce   map[string]bool
+	failAlways map[string]bool
+}
+
+type batchDeleteBlobClient struct {
+	BlobClient
+	store *batchDeleteBlobStore
+}
+
+func (blobStore *batchDeleteBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	client, err := blobStore.BlobStore.NewClient(ctx)
+	return &batchDeleteBlobClient{BlobClient: client, store: blobStore}, err
+}
+
+func (blobClient *batchDeleteBlobClient) DeleteObjects(paths []string) []error {
+	s := blobClient.store
+	s.Lock()
+	s.batchSizes = append(s.batchSizes, len(paths))
+	s.Unlock()
+	errs := make([]error, len(paths))
+	for i, path := range paths {
+		s.Lock()
+		fail := s.failAlways[path] || s.failOnce[path]
+		delete(s.failOnce, path)
+		s.Unlock()
+		if fail {
+			errs[i] = fmt.Errorf("delete of %s failed", path)
+			continue
+		}
+		objHandle, _ := blobClient.NewObject(path)
+		errs[i] = objHandle.Delete()
+	}
+	return errs
+}
+
+func TestDeleteBlobs(t *testing.T) {
+	testStore, _ := NewTestBlobStore("the_path")
+	client, _ := testStore.NewClient(context.Background())
+	defer client.Close()
+	var paths []string
+	for i := 0; i < deleteBatchSize*2+10; i++ {
+		path := GetBlockPath("chunks", uint64(i))
+		obj, _ := client.NewObject(path)
+		obj.Write([]byte("block"))
+		paths = append(paths, path)
+	}
+	blobStore := &batchDeleteBlobStore{
+		BlobStore:  testStore,
+		failOnce:   map[string]bool{paths[3]: true, paths[deleteBatchSize+5]: true},
+		failAlways: map[string]bool{}}
+
+	deleted, err := deleteBlobs(context.Background(), blobStore, paths, newStoreOptions([]StoreOption{WithWorkerCount(2)}))
+	if err != nil {
+		t.Fatalf("TestDeleteBlobs() deleteBlobs() %v != %v", err, nil)
+	}
+	for i := range paths {
+		if !deleted[i] {
+			t.Errorf("TestDeleteBlobs() deleteBlobs() %s was not deleted", paths[i])
+		}
+	}
+	objects, _ := client.GetObjects()
+	if len(objects) != 0 {
+		t.Errorf("TestDeleteBlobs() GetObjects() %d != %d", len(objects), 0)
+	}
+	if len(blobStore.batchSizes) != 5 {
+		t.Errorf("TestDeleteBlobs() batches %v, expected three batches and two retries", blobStore.batchSizes)
+	}
+	for _, batchSize := range blobStore.batchSizes {
+		if batchSize > deleteBatchSize {
+			t.Errorf("TestDeleteBlobs() batch size %d > %d", batchSize, deleteBatchSize)
+		}
+	}
+
+	for _, path := range paths[:3] {
+		obj, _ := client.NewObject(path)
+		obj.Write([]byte("block"))
+	}
+	blobStore.failAlways[paths[1]] = true
+	deleted, err = deleteBlobs(context.Background(), blobStore, paths[:3], newStoreOptions([]StoreOption{WithMaxRetries(-1)}))
+	if err == nil {
+		t.Errorf("TestDeleteBlobs() deleteBlobs() %v == %v", err, nil)
+	}
+	if !deleted[0] || deleted[1] || !deleted[2] {
+		t.Errorf("TestDeleteBlobs() deleteBlobs() deleted %v", deleted)
+	}
+}
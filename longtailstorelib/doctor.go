@@ -0,0 +1,208 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DiagnosticStatus is the outcome of a DiagnoseBlobStore check
+type DiagnosticStatus int
+
+const (
+	// DiagnosticOK means the check passed
+	DiagnosticOK DiagnosticStatus = iota
+	// DiagnosticWarning means the store works but is misconfigured or slow
+	DiagnosticWarning
+	// DiagnosticFailed means the operation does not work, the store can not be used
+	DiagnosticFailed
+	// DiagnosticSkipped means the check does not apply to the store
+	DiagnosticSkipped
+)
+
+func (s DiagnosticStatus) String() string {
+	switch s {
+	case DiagnosticOK:
+		return "OK"
+	case DiagnosticWarning:
+		return "WARNING"
+	case DiagnosticFailed:
+		return "FAILED"
+	case DiagnosticSkipped:
+		return "SKIPPED"
+	}
+	return fmt.Sprintf("DiagnosticStatus(%d)", int(s))
+}
+
+// DiagnosticResult describes one check made by DiagnoseBlobStore
+type DiagnosticResult struct {
+	Name     string
+	Status   DiagnosticStatus
+	Duration time.Duration
+	// Details holds measurements or the error of the check, Hint a suggested fix if it did not pass
+	Details string
+	Hint    string
+}
+
+// maxClockSkew is the clock difference at which signed requests to the cloud providers start to fail
+const maxClockSkew = time.Minute
+
+// serverClock is implemented by blob stores that can tell the time of the storage service
+type serverClock interface {
+	serverTime(ctx context.Context) (time.Time, error)
+}
+
+func throughput(byteCount int, duration time.Duration) string {
+	if duration <= 0 {
+		return fmt.Sprintf("%d bytes", byteCount)
+	}
+	return fmt.Sprintf("%d bytes in %v, %.1f MB/s", byteCount, duration, float64(byteCount)/duration.Seconds()/1000000)
+}
+
+// DiagnoseBlobStore exercises client creation, list, write, read, conditional write and delete on
+// blobStore using probe objects of probeSize bytes under doctor/, and compares the clock of the
+// storage service with the local clock. The checks stop at the first failure that makes the
+// following ones meaningless. Note that listing a large store may take a long time.
+func DiagnoseBlobStore(ctx context.Context, blobStore BlobStore, probeSize int) []DiagnosticResult {
+	var results []DiagnosticResult
+	check := func(name string, f func() (DiagnosticStatus, string, string)) bool {
+		start := time.Now()
+		status, details, hint := f()
+		results = append(results, DiagnosticResult{Name: name, Status: status, Duration: time.Since(start), Details: details, Hint: hint})
+		return status != DiagnosticFailed
+	}
+
+	var blobClient BlobClient
+	if !check("Connect", func() (DiagnosticStatus, string, string) {
+		var err error
+		blobClient, err = blobStore.NewClient(ctx)
+		if err != nil {
+			return DiagnosticFailed, err.Error(), "Check the storage URI and the credentials, for GCS see GOOGLE_APPLICATION_CREDENTIALS"
+		}
+		return DiagnosticOK, blobClient.String(), ""
+	}) {
+		return results
+	}
+	defer blobClient.Close()
+
+	check("List", func() (DiagnosticStatus, string, string) {
+		objectCount := 0
+		err := forEachObject(ctx, blobClient, "", func(blob BlobProperties) error {
+			objectCount++
+			return nil
+		})
+		if err != nil {
+			return DiagnosticFailed, err.Error(), "The credentials need permission to list objects, upsync uses it to rebuild a missing store index"
+		}
+		return DiagnosticOK, fmt.Sprintf("%d objects", objectCount), ""
+	})
+
+	probe := make([]byte, probeSize)
+	rand.Read(probe)
+	probePath := fmt.Sprintf("doctor/probe-%d-%08x", time.Now().UnixNano(), rand.Uint32())
+	probeObject, err := blobClient.NewObject(probePath)
+	if err != nil {
+		check("Write", func() (DiagnosticStatus, string, string) { return DiagnosticFailed, err.Error(), "" })
+		return results
+	}
+
+	if !check("Write", func() (DiagnosticStatus, string, string) {
+		start := time.Now()
+		ok, err := probeObject.Write(probe)
+		if err != nil {
+			return DiagnosticFailed, err.Error(), "The credentials need permission to create objects to upsync"
+		}
+		if !ok {
+			return DiagnosticFailed, "write was rejected", "The credentials need permission to create objects to upsync"
+		}
+		return DiagnosticOK, throughput(len(probe), time.Since(start)), ""
+	}) {
+		return results
+	}
+	defer probeObject.Delete()
+
+	check("Read", func() (DiagnosticStatus, string, string) {
+		start := time.Now()
+		data, err := probeObject.Read()
+		if err != nil {
+			return DiagnosticFailed, err.Error(), "The credentials need permission to read objects to downsync"
+		}
+		if !bytes.Equal(data, probe) {
+			return DiagnosticFailed, fmt.Sprintf("read %d bytes that do not match the %d bytes written", len(data), len(probe)), "Check for proxies or caches that modify content"
+		}
+		return DiagnosticOK, throughput(len(data), time.Since(start)), ""
+	})
+
+	check("Conditional write", func() (DiagnosticStatus, string, string) {
+		first, err := blobClient.NewObject(probePath)
+		if err != nil {
+			return DiagnosticFailed, err.Error(), ""
+		}
+		second, err := blobClient.NewObject(probePath)
+		if err != nil {
+			return DiagnosticFailed, err.Error(), ""
+		}
+		for _, object := range []BlobObject{first, second} {
+			exists, err := object.LockWriteVersion()
+			if err != nil {
+				return DiagnosticFailed, err.Error(), "The credentials need permission to read object metadata"
+			}
+			if !exists {
+				return DiagnosticFailed, "written object does not exist", "The store is not read-after-write consistent"
+			}
+		}
+		ok, err := first.Write(probe[:len(probe)/2])
+		if err != nil || !ok {
+			return DiagnosticFailed, fmt.Sprintf("locked write failed: %v", err), "The credentials need permission to overwrite objects to update the store index"
+		}
+		ok, err = second.Write(probe)
+		if err != nil {
+			return DiagnosticFailed, err.Error(), ""
+		}
+		if ok {
+			return DiagnosticWarning, "a write with a stale lock was accepted", "Concurrent upsyncs to this store can lose store index updates, run them one at a time"
+		}
+		return DiagnosticOK, "stale write rejected", ""
+	})
+
+	check("Delete", func() (DiagnosticStatus, string, string) {
+		err := probeObject.Delete()
+		if IsImmutable(err) {
+			return DiagnosticSkipped, "store is immutable", ""
+		}
+		if err != nil {
+			return DiagnosticWarning, err.Error(), "The credentials need permission to delete objects to prune the store"
+		}
+		exists, err := probeObject.Exists()
+		if err != nil {
+			return DiagnosticFailed, err.Error(), ""
+		}
+		if exists {
+			return DiagnosticWarning, "object still exists after delete", "Check the retention policy of the bucket"
+		}
+		return DiagnosticOK, "", ""
+	})
+
+	check("Clock skew", func() (DiagnosticStatus, string, string) {
+		clock, ok := blobStore.(serverClock)
+		if !ok {
+			return DiagnosticSkipped, "store has no server clock", ""
+		}
+		before := time.Now()
+		serverTime, err := clock.serverTime(ctx)
+		if err != nil {
+			return DiagnosticWarning, errors.Wrap(err, "failed to get server time").Error(), ""
+		}
+		skew := serverTime.Sub(before.Add(time.Since(before) / 2)).Round(time.Second)
+		if skew > maxClockSkew || skew < -maxClockSkew {
+			return DiagnosticWarning, fmt.Sprintf("local clock differs by %v", skew), "Synchronize the local clock, signed requests are rejected when the skew is too large"
+		}
+		return DiagnosticOK, fmt.Sprintf("%v", skew), ""
+	})
+
+	return results
+}
@@ -0,0 +1,51 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func getDiagnosticResult(results []DiagnosticResult, name string) DiagnosticResult {
+	for _, result := range results {
+		if result.Name == name {
+			return result
+		}
+	}
+	return DiagnosticResult{Name: name, Status: DiagnosticFailed, Details: "missing"}
+}
+
+func TestDiagnoseBlobStore(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	results := DiagnoseBlobStore(context.Background(), blobStore, 4096)
+	for _, name := range []string{"Connect", "List", "Write", "Read", "Conditional write", "Delete"} {
+		result := getDiagnosticResult(results, name)
+		if result.Status != DiagnosticOK {
+			t.Errorf("TestDiagnoseBlobStore() %s %s != %s: %s", name, result.Status, DiagnosticOK, result.Details)
+		}
+	}
+	if getDiagnosticResult(results, "Clock skew").Status != DiagnosticSkipped {
+		t.Errorf("TestDiagnoseBlobStore() Clock skew %s != %s", getDiagnosticResult(results, "Clock skew").Status, DiagnosticSkipped)
+	}
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	objects, _ := client.GetObjects()
+	if len(objects) != 0 {
+		t.Errorf("TestDiagnoseBlobStore() probe objects left %d != %d", len(objects), 0)
+	}
+}
+
+func TestDiagnoseFSBlobStore(t *testing.T) {
+	storePath, _ := ioutil.TempDir("", "longtail-doctor")
+	defer os.RemoveAll(storePath)
+	blobStore, _ := NewFSBlobStore(storePath)
+	results := DiagnoseBlobStore(context.Background(), blobStore, 4096)
+	// The file system store does not detect concurrent writes
+	if getDiagnosticResult(results, "Conditional write").Status != DiagnosticWarning {
+		t.Errorf("TestDiagnoseFSBlobStore() Conditional write %s != %s", getDiagnosticResult(results, "Conditional write").Status, DiagnosticWarning)
+	}
+	if getDiagnosticResult(results, "Read").Status != DiagnosticOK {
+		t.Errorf("TestDiagnoseFSBlobStore() Read %s != %s", getDiagnosticResult(results, "Read").Status, DiagnosticOK)
+	}
+}
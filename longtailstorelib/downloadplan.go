@@ -0,0 +1,163 @@
+package longtailstorelib
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// DownloadOrderHinter is implemented by block stores that prefetch the blocks of a PreflightGet in
+// the order a restore reads them, see BlockUseOrder
+type DownloadOrderHinter interface {
+	// HintDownloadOrder tells the store the order the blocks of a coming restore are read in, first
+	// block first. The next PreflightGet prefetches its blocks in that order, blocks without a hint
+	// are prefetched after them. The hints of restores that run at the same time are interleaved.
+	HintDownloadOrder(blockHashes []uint64)
+}
+
+// DownloadPlanStats tells how well the prefetches of the remote block store kept ahead of the
+// block reads of restores
+type DownloadPlanStats struct {
+	// PlannedCount is the number of prefetches that were ordered by a hint
+	PlannedCount uint64
+	// ReadyCount is the number of block reads that found the block prefetched, LateCount the reads
+	// that had to wait for a prefetch in flight and MissedCount the reads of blocks that were not
+	// prefetched at all
+	ReadyCount  uint64
+	LateCount   uint64
+	MissedCount uint64
+	// WindowSize is the size of the prefetch window, zero if it is unlimited, see WithPrefetchWindow.
+	// InWindow are the blocks queued or prefetched ahead of the restore and PendingCount the
+	// preflighted blocks waiting to enter the window.
+	WindowSize   int
+	InWindow     int
+	PendingCount int
+}
+
+// DownloadPlanStatsProvider is implemented by block stores that order their prefetches
+type DownloadPlanStatsProvider interface {
+	GetDownloadPlanStats() DownloadPlanStats
+}
+
+// BlockUseOrder returns the blocks of storeIndex in the order their chunks are first used in
+// chunkHashes. The chunks of GetRequiredChunkHashes are in the order the assets of a version diff
+// are written, so the result is the order a restore reads the blocks. Blocks that no chunk uses
+// are put last.
+func BlockUseOrder(storeIndex longtaillib.Longtail_StoreIndex, chunkHashes []uint64) []uint64 {
+	blockHashes := storeIndex.GetBlockHashes()
+	blockChunksOffsets := storeIndex.GetBlockChunksOffsets()
+	blockChunkCounts := storeIndex.GetBlockChunkCounts()
+	storeChunkHashes := storeIndex.GetChunkHashes()
+	chunkBlocks := make(map[uint64]uint64, len(storeChunkHashes))
+	for b, blockHash := range blockHashes {
+		offset := blockChunksOffsets[b]
+		for _, chunkHash := range storeChunkHashes[offset : offset+blockChunkCounts[b]] {
+			if _, exists := chunkBlocks[chunkHash]; !exists {
+				chunkBlocks[chunkHash] = blockHash
+			}
+		}
+	}
+	order := make([]uint64, 0, len(blockHashes))
+	used := make(map[uint64]bool, len(blockHashes))
+	for _, chunkHash := range chunkHashes {
+		blockHash, exists := chunkBlocks[chunkHash]
+		if !exists || used[blockHash] {
+			continue
+		}
+		used[blockHash] = true
+		order = append(order, blockHash)
+	}
+	for _, blockHash := range blockHashes {
+		if !used[blockHash] {
+			order = append(order, blockHash)
+		}
+	}
+	return order
+}
+
+// downloadOrder holds the hints of HintDownloadOrder until the blocks are prefetched. A block is
+// ranked by its position in a hint, so blocks early in the hints of two restores go first.
+type downloadOrder struct {
+	lock  sync.Mutex
+	ranks map[uint64]int
+
+	planned uint64
+	ready   uint64
+	late    uint64
+	missed  uint64
+}
+
+func (o *downloadOrder) hint(blockHashes []uint64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.ranks == nil {
+		o.ranks = make(map[uint64]int, len(blockHashes))
+	}
+	for rank, blockHash := range blockHashes {
+		if existing, exists := o.ranks[blockHash]; !exists || rank < existing {
+			o.ranks[blockHash] = rank
+		}
+	}
+}
+
+// plan returns blockHashes with the hinted blocks first in the hinted order and the others after
+// them in their original order. The hints of the planned blocks are used up.
+func (o *downloadOrder) plan(blockHashes []uint64) []uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.ranks) == 0 {
+		return blockHashes
+	}
+	type plannedBlock struct {
+		blockHash uint64
+		rank      int
+		hinted    bool
+	}
+	blocks := make([]plannedBlock, len(blockHashes))
+	for i, blockHash := range blockHashes {
+		rank, hinted := o.ranks[blockHash]
+		if hinted {
+			delete(o.ranks, blockHash)
+			o.planned++
+		}
+		blocks[i] = plannedBlock{blockHash: blockHash, rank: rank, hinted: hinted}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		if blocks[i].hinted != blocks[j].hinted {
+			return blocks[i].hinted
+		}
+		return blocks[i].hinted && blocks[i].rank < blocks[j].rank
+	})
+	planned := make([]uint64, len(blocks))
+	for i := range blocks {
+		planned[i] = blocks[i].blockHash
+	}
+	return planned
+}
+
+// HintDownloadOrder orders the prefetches of the next PreflightGet, see DownloadOrderHinter
+func (s *remoteStore) HintDownloadOrder(blockHashes []uint64) {
+	s.downloadOrder.hint(blockHashes)
+}
+
+// GetDownloadPlanStats returns how well the prefetches of the store kept ahead of the block reads
+func (s *remoteStore) GetDownloadPlanStats() DownloadPlanStats {
+	s.downloadOrder.lock.Lock()
+	planned := s.downloadOrder.planned
+	s.downloadOrder.lock.Unlock()
+	inWindow, pending := s.prefetchWindow.counts()
+	windowSize := s.prefetchWindow.size
+	if windowSize < 0 {
+		windowSize = 0
+	}
+	return DownloadPlanStats{
+		WindowSize:   windowSize,
+		InWindow:     inWindow,
+		PendingCount: pending,
+		PlannedCount: planned,
+		ReadyCount:   atomic.LoadUint64(&s.downloadOrder.ready),
+		LateCount:    atomic.LoadUint64(&s.downloadOrder.late),
+		MissedCount:  atomic.LoadUint64(&s.downloadOrder.missed)}
+}
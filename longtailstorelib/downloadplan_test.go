@@ -0,0 +1,125 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestDownloadOrderPlan(t *testing.T) {
+	var order downloadOrder
+	if planned := order.plan([]uint64{3, 1, 2}); planned[0] != 3 || planned[1] != 1 || planned[2] != 2 {
+		t.Errorf("TestDownloadOrderPlan() plan() without hints %v", planned)
+	}
+
+	order.hint([]uint64{5, 3, 9})
+	planned := order.plan([]uint64{1, 9, 3, 7, 5})
+	expected := []uint64{5, 3, 9, 1, 7}
+	for i := range expected {
+		if planned[i] != expected[i] {
+			t.Fatalf("TestDownloadOrderPlan() plan() %v != %v", planned, expected)
+		}
+	}
+	if len(order.ranks) != 0 || order.planned != 3 {
+		t.Errorf("TestDownloadOrderPlan() plan() left %d hints, planned %d", len(order.ranks), order.planned)
+	}
+
+	// The hints of two restores are interleaved
+	order.hint([]uint64{1, 2})
+	order.hint([]uint64{3, 4})
+	planned = order.plan([]uint64{4, 3, 2, 1})
+	expected = []uint64{3, 1, 4, 2}
+	for i := range expected {
+		if planned[i] != expected[i] {
+			t.Fatalf("TestDownloadOrderPlan() plan() interleaved %v != %v", planned, expected)
+		}
+	}
+}
+
+func TestBlockUseOrder(t *testing.T) {
+	blockIndexes := []longtaillib.Longtail_BlockIndex{}
+	for _, seed := range []uint8{0, 4, 8, 12} {
+		storedBlock, errno := generateStoredBlock(t, seed)
+		if errno != 0 {
+			t.Fatalf("TestBlockUseOrder() generateStoredBlock() %d != %d", errno, 0)
+		}
+		defer storedBlock.Dispose()
+		blockIndexes = append(blockIndexes, storedBlock.GetBlockIndex())
+	}
+	storeIndex, errno := longtaillib.CreateStoreIndexFromBlocks(blockIndexes)
+	if errno != 0 {
+		t.Fatalf("TestBlockUseOrder() CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer storeIndex.Dispose()
+
+	// Block 12 has no chunk in the restore and goes last
+	blockOrder := BlockUseOrder(storeIndex, []uint64{9, 1, 10, 2, 5})
+	expected := []uint64{8 + 21412151, 0 + 21412151, 4 + 21412151, 12 + 21412151}
+	if len(blockOrder) != len(expected) {
+		t.Fatalf("TestBlockUseOrder() BlockUseOrder() %v != %v", blockOrder, expected)
+	}
+	for i := range expected {
+		if blockOrder[i] != expected[i] {
+			t.Fatalf("TestBlockUseOrder() BlockUseOrder() %v != %v", blockOrder, expected)
+		}
+	}
+
+	// The prefetches of a preflight follow the hint
+	s := &remoteStore{}
+	s.HintDownloadOrder(blockOrder[:2])
+	prefetchBlockMessages := make(chan prefetchBlockMessage, len(expected))
+	onPreflighMessage(s, storeIndex, preflightGetMessage{blockHashes: storeIndex.GetBlockHashes()}, prefetchBlockMessages)
+	for i := range expected {
+		if prefetchMsg := <-prefetchBlockMessages; prefetchMsg.blockHash != expected[i] {
+			t.Errorf("TestBlockUseOrder() prefetch %d 0x%x != 0x%x", i, prefetchMsg.blockHash, expected[i])
+		}
+	}
+}
+
+func TestDownloadPlanStats(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blobStore, _ := NewTestBlobStore("the_path")
+
+	store, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite)
+	if err != nil {
+		t.Fatalf("TestDownloadPlanStats() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(store)
+	defer storeAPI.Dispose()
+	blockHashes := []uint64{}
+	for _, seed := range []uint8{0, 4} {
+		blockHash, errno := storeBlockFromSeed(t, storeAPI, seed)
+		if errno != 0 {
+			t.Fatalf("TestDownloadPlanStats() storeBlockFromSeed() %d != %d", errno, 0)
+		}
+		blockHashes = append(blockHashes, blockHash)
+	}
+	if errno := flushRemoteStore(storeAPI); errno != 0 {
+		t.Fatalf("TestDownloadPlanStats() Flush() %d != %d", errno, 0)
+	}
+
+	store.(DownloadOrderHinter).HintDownloadOrder(blockHashes[:1])
+	store.PreflightGet(blockHashes[:1], longtaillib.Longtail_AsyncPreflightStartedAPI{})
+	s := store.(*remoteStore)
+	for start := time.Now(); atomic.LoadInt64(&s.prefetchMemory) == 0; {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("TestDownloadPlanStats() the preflighted block was not prefetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, blockHash := range blockHashes {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+		if errno != 0 {
+			t.Fatalf("TestDownloadPlanStats() fetchBlockFromStore() %d != %d", errno, 0)
+		}
+		storedBlock.Dispose()
+	}
+	stats := store.(DownloadPlanStatsProvider).GetDownloadPlanStats()
+	if stats.PlannedCount != 1 || stats.ReadyCount != 1 || stats.LateCount != 0 || stats.MissedCount != 1 {
+		t.Errorf("TestDownloadPlanStats() GetDownloadPlanStats() %+v", stats)
+	}
+}
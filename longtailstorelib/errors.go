@@ -0,0 +1,179 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// ErrChecksumMismatch is returned by blob objects when the content does not match the checksum recorded by the storage provider
+var ErrChecksumMismatch = errors.New("blob checksum mismatch")
+
+// ErrImmutable is returned when a write or delete would modify an existing object in an immutable store
+var ErrImmutable = errors.New("object is immutable")
+
+// ErrReleaseExists is returned when publishing a release with the name of a release that was already published
+var ErrReleaseExists = errors.New("release already exists")
+
+// ErrArchived is returned when reading an object that has been moved to a cold storage class and must be restored first
+var ErrArchived = errors.New("object is archived")
+
+// ErrInjectedFault is returned by the blob stores from NewFaultyBlobStore when they fail an operation on purpose
+var ErrInjectedFault = errors.New("injected fault")
+
+// ErrFlushTimeout is returned by FlushWithTimeout when the store did not finish flushing in time
+var ErrFlushTimeout = errors.New("flush timed out")
+
+// BlockCorruptError is returned when a stored block fails an integrity check
+type BlockCorruptError struct {
+	BlockHash uint64
+	Path      string
+	Reason    error
+}
+
+func (e *BlockCorruptError) Error() string {
+	return fmt.Sprintf("block 0x%016x at `%s` is corrupt: %v", e.BlockHash, e.Path, e.Reason)
+}
+
+// Unwrap maps a corrupt block to longtaillib.ErrEBADF so longtaillib.ErrorToErrno reports EBADF
+func (e *BlockCorruptError) Unwrap() error {
+	return longtaillib.ErrEBADF
+}
+
+// IsImmutable returns true if err was caused by an attempt to modify an object in an immutable store
+func IsImmutable(err error) bool {
+	return errors.Cause(err) == ErrImmutable
+}
+
+// BlockArchivedError is returned when a block can not be read because it is in a cold storage class
+type BlockArchivedError struct {
+	BlockHash uint64
+	Path      string
+	Reason    error
+}
+
+func (e *BlockArchivedError) Error() string {
+	return fmt.Sprintf("block 0x%016x at `%s` is archived and must be restored before it can be read: %v", e.BlockHash, e.Path, e.Reason)
+}
+
+// Unwrap maps an archived block to longtaillib.ErrEACCES so longtaillib.ErrorToErrno reports EACCES
+func (e *BlockArchivedError) Unwrap() error {
+	return longtaillib.ErrEACCES
+}
+
+// IsArchived returns true if err was caused by reading an archived object
+func IsArchived(err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(*BlockArchivedError); ok {
+		return true
+	}
+	return cause == ErrArchived
+}
+
+// QuotaExceededError is returned when a write would take a store over its quota, see WithQuota
+type QuotaExceededError struct {
+	Store string
+	Quota string
+	Limit int64
+	Size  int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("store %s is over its %s quota, %d > %d", e.Store, e.Quota, e.Size, e.Limit)
+}
+
+// Unwrap maps an exceeded quota to longtaillib.ErrENOSPC so longtaillib.ErrorToErrno reports ENOSPC
+func (e *QuotaExceededError) Unwrap() error {
+	return longtaillib.ErrENOSPC
+}
+
+// IsQuotaExceeded returns true if err was caused by a write that would take a store over its quota
+func IsQuotaExceeded(err error) bool {
+	_, ok := errors.Cause(err).(*QuotaExceededError)
+	return ok
+}
+
+// RegionNotAllowedError is returned before the first write to a store whose bucket is not in one
+// of the allowed regions, see WithAllowedRegions
+type RegionNotAllowedError struct {
+	Store          string
+	Region         string
+	AllowedRegions []string
+}
+
+func (e *RegionNotAllowedError) Error() string {
+	return fmt.Sprintf("store %s is in region `%s`, writes are only allowed to %s", e.Store, e.Region, strings.Join(e.AllowedRegions, ", "))
+}
+
+// Unwrap maps a region that is not allowed to longtaillib.ErrEACCES so longtaillib.ErrorToErrno reports EACCES
+func (e *RegionNotAllowedError) Unwrap() error {
+	return longtaillib.ErrEACCES
+}
+
+// IsRegionNotAllowed returns true if err was caused by a write to a store outside the allowed regions
+func IsRegionNotAllowed(err error) bool {
+	_, ok := errors.Cause(err).(*RegionNotAllowedError)
+	return ok
+}
+
+// BlocksMissingError is returned by a preflight when blocks that a restore needs are not in the
+// store, see BlockPreflighter
+type BlocksMissingError struct {
+	Store       string
+	BlockHashes []uint64
+}
+
+// maxListedMissingBlocks is the number of block hashes BlocksMissingError lists in its message
+const maxListedMissingBlocks = 16
+
+func (e *BlocksMissingError) Error() string {
+	hashes := make([]string, 0, maxListedMissingBlocks)
+	for i, blockHash := range e.BlockHashes {
+		if i == maxListedMissingBlocks {
+			hashes = append(hashes, fmt.Sprintf("and %d more", len(e.BlockHashes)-maxListedMissingBlocks))
+			break
+		}
+		hashes = append(hashes, fmt.Sprintf("0x%016x", blockHash))
+	}
+	return fmt.Sprintf("%d blocks are missing from store %s: %s", len(e.BlockHashes), e.Store, strings.Join(hashes, ", "))
+}
+
+// Unwrap maps missing blocks to longtaillib.ErrENOENT so longtaillib.ErrorToErrno reports ENOENT
+func (e *BlocksMissingError) Unwrap() error {
+	return longtaillib.ErrENOENT
+}
+
+// IsBlocksMissing returns true if err was caused by a preflight that found blocks missing from the store
+func IsBlocksMissing(err error) bool {
+	_, ok := errors.Cause(err).(*BlocksMissingError)
+	return ok
+}
+
+// IsChecksumMismatch returns true if err was caused by a blob checksum mismatch
+func IsChecksumMismatch(err error) bool {
+	return errors.Cause(err) == ErrChecksumMismatch
+}
+
+// StoreIndexCorruptError is returned when the store index fails its checksum or can not be parsed
+type StoreIndexCorruptError struct {
+	Store  string
+	Key    string
+	Reason error
+}
+
+func (e *StoreIndexCorruptError) Error() string {
+	return fmt.Sprintf("store index `%s` of %s is corrupt: %v", e.Key, e.Store, e.Reason)
+}
+
+// Unwrap maps a corrupt store index to longtaillib.ErrEBADF so longtaillib.ErrorToErrno reports EBADF
+func (e *StoreIndexCorruptError) Unwrap() error {
+	return longtaillib.ErrEBADF
+}
+
+// IsStoreIndexCorrupt returns true if err was caused by a store index that is corrupt
+func IsStoreIndexCorrupt(err error) bool {
+	_, ok := errors.Cause(err).(*StoreIndexCorruptError)
+	return ok
+}
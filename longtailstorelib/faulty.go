@@ -0,0 +1,269 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// faultyURIPrefix in front of a store URI, such as faulty+gs://bucket/store, wraps the store in a
+// fault injecting blob store configured by the fault-* store options, see NewFaultyBlobStore
+const faultyURIPrefix = "faulty+"
+
+// FaultConfig configures the faults a blob store from NewFaultyBlobStore injects. The rates are the
+// probability, from 0 to 1, that an operation fails in that way.
+type FaultConfig struct {
+	// ErrorRate fails listings, existence checks, reads, writes and deletes with ErrInjectedFault
+	ErrorRate float64
+	// ExistsErrorRate also fails existence checks with ErrInjectedFault, while the other operations
+	// only fail at ErrorRate
+	ExistsErrorRate float64
+	// Latency is added to every operation
+	Latency time.Duration
+	// PartialWriteRate writes the first half of the data and then fails the write with ErrInjectedFault
+	PartialWriteRate float64
+	// StaleReadRate makes a read return the content an object had before the last write through the
+	// faulty store, as an eventually consistent store can
+	StaleReadRate float64
+	// ConflictRate makes a write after LockWriteVersion report that another writer replaced the
+	// object, which makes the remote block store merge and retry its store index update
+	ConflictRate float64
+	// PathPrefix limits the faults to the objects whose path starts with it, empty is all objects.
+	// Listings are only failed when PathPrefix is empty.
+	PathPrefix string
+	// Seed makes the injected faults repeat between runs, operations that run in parallel may still
+	// draw the random numbers in a different order
+	Seed int64
+}
+
+// FaultStats counts the faults injected by a blob store from NewFaultyBlobStore
+type FaultStats struct {
+	Errors        uint64
+	PartialWrites uint64
+	StaleReads    uint64
+	Conflicts     uint64
+}
+
+// FaultStatsProvider is implemented by the blob stores from NewFaultyBlobStore
+type FaultStatsProvider interface {
+	GetFaultStats() FaultStats
+}
+
+type faultyBlobStore struct {
+	inner  BlobStore
+	config FaultConfig
+
+	sync.Mutex
+	random *rand.Rand
+	stats  FaultStats
+	// previous is the content objects had before the last write, for stale reads
+	previous map[string][]byte
+}
+
+type faultyBlobClient struct {
+	store *faultyBlobStore
+	inner BlobClient
+}
+
+type faultyBlobObject struct {
+	client *faultyBlobClient
+	inner  BlobObject
+	path   string
+	locked bool
+}
+
+// NewFaultyBlobStore wraps inner in a blob store that injects the faults of config, so retries and
+// store index merges can be tested against a store that misbehaves. The objects of the store do not
+// implement the optional interfaces of inner, such as ranged reads, so the callers use their
+// fallbacks.
+func NewFaultyBlobStore(inner BlobStore, config FaultConfig) BlobStore {
+	return &faultyBlobStore{
+		inner:    inner,
+		config:   config,
+		random:   rand.New(rand.NewSource(config.Seed)),
+		previous: map[string][]byte{},
+	}
+}
+
+// IsFaultyURI returns true if uri has the faulty+ prefix of NewFaultyBlobStoreForURI
+func IsFaultyURI(uri string) bool {
+	return strings.HasPrefix(uri, faultyURIPrefix)
+}
+
+// NewFaultyBlobStoreForURI creates the blob store of uri without its faulty+ prefix and wraps it
+// with NewFaultyBlobStore using the fault-* options in opts
+func NewFaultyBlobStoreForURI(uri string, opts ...StoreOption) (BlobStore, error) {
+	if !IsFaultyURI(uri) {
+		return nil, fmt.Errorf("`%s` does not start with `%s`", uri, faultyURIPrefix)
+	}
+	inner, err := newBlobStoreForURI(uri[len(faultyURIPrefix):], opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewFaultyBlobStore(inner, newStoreOptions(opts).Faults), nil
+}
+
+func (blobStore *faultyBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	inner, err := blobStore.inner.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyBlobClient{store: blobStore, inner: inner}, nil
+}
+
+func (blobStore *faultyBlobStore) String() string {
+	return faultyURIPrefix + blobStore.inner.String()
+}
+
+func (blobStore *faultyBlobStore) storeOptions() StoreOptions {
+	if provider, ok := blobStore.inner.(storeOptionsProvider); ok {
+		return provider.storeOptions()
+	}
+	return StoreOptions{}
+}
+
+func (blobStore *faultyBlobStore) GetFaultStats() FaultStats {
+	blobStore.Lock()
+	defer blobStore.Unlock()
+	return blobStore.stats
+}
+
+// inject returns true with a probability of rate if path is subject to faults, count is the
+// statistic to increase when it does
+func (blobStore *faultyBlobStore) inject(path string, rate float64, count *uint64) bool {
+	if rate <= 0 || !strings.HasPrefix(path, blobStore.config.PathPrefix) {
+		return false
+	}
+	blobStore.Lock()
+	defer blobStore.Unlock()
+	if blobStore.random.Float64() >= rate {
+		return false
+	}
+	*count++
+	return true
+}
+
+// injectError is called first by every operation, it waits for the configured latency and fails
+// the operation with a probability of ErrorRate
+func (blobStore *faultyBlobStore) injectError(path string, operation string) error {
+	if blobStore.config.Latency > 0 {
+		time.Sleep(blobStore.config.Latency)
+	}
+	if blobStore.inject(path, blobStore.config.ErrorRate, &blobStore.stats.Errors) {
+		return errors.Wrapf(ErrInjectedFault, "%s `%s`", operation, path)
+	}
+	return nil
+}
+
+func (blobClient *faultyBlobClient) NewObject(path string) (BlobObject, error) {
+	inner, err := blobClient.inner.NewObject(path)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyBlobObject{client: blobClient, inner: inner, path: path}, nil
+}
+
+func (blobClient *faultyBlobClient) GetObjects() ([]BlobProperties, error) {
+	if err := blobClient.injectListError(); err != nil {
+		return nil, err
+	}
+	return blobClient.inner.GetObjects()
+}
+
+func (blobClient *faultyBlobClient) ListObjects(prefix string) BlobIterator {
+	if err := blobClient.injectListError(); err != nil {
+		return newListingBlobIterator(func() ([]BlobProperties, error) { return nil, err }, prefix)
+	}
+	return blobClient.inner.ListObjects(prefix)
+}
+
+// injectListError fails a listing with a probability of ErrorRate, listings are not limited to a
+// PathPrefix so they only get the latency if one is set
+func (blobClient *faultyBlobClient) injectListError() error {
+	store := blobClient.store
+	if store.config.PathPrefix != "" {
+		time.Sleep(store.config.Latency)
+		return nil
+	}
+	return store.injectError("", "list")
+}
+
+func (blobClient *faultyBlobClient) String() string {
+	return faultyURIPrefix + blobClient.inner.String()
+}
+
+func (blobClient *faultyBlobClient) Close() {
+	blobClient.inner.Close()
+}
+
+func (blobObject *faultyBlobObject) Exists() (bool, error) {
+	store := blobObject.client.store
+	if err := store.injectError(blobObject.path, "exists"); err != nil {
+		return false, err
+	}
+	if store.inject(blobObject.path, store.config.ExistsErrorRate, &store.stats.Errors) {
+		return false, errors.Wrapf(ErrInjectedFault, "exists `%s`", blobObject.path)
+	}
+	return blobObject.inner.Exists()
+}
+
+func (blobObject *faultyBlobObject) LockWriteVersion() (bool, error) {
+	if err := blobObject.client.store.injectError(blobObject.path, "lock"); err != nil {
+		return false, err
+	}
+	exists, err := blobObject.inner.LockWriteVersion()
+	blobObject.locked = err == nil
+	return exists, err
+}
+
+func (blobObject *faultyBlobObject) Read() ([]byte, error) {
+	store := blobObject.client.store
+	if err := store.injectError(blobObject.path, "read"); err != nil {
+		return nil, err
+	}
+	store.Lock()
+	previous, hasPrevious := store.previous[blobObject.path]
+	store.Unlock()
+	if hasPrevious && store.inject(blobObject.path, store.config.StaleReadRate, &store.stats.StaleReads) {
+		return previous, nil
+	}
+	return blobObject.inner.Read()
+}
+
+func (blobObject *faultyBlobObject) Write(data []byte) (bool, error) {
+	store := blobObject.client.store
+	if err := store.injectError(blobObject.path, "write"); err != nil {
+		return false, err
+	}
+	if blobObject.locked && store.inject(blobObject.path, store.config.ConflictRate, &store.stats.Conflicts) {
+		return false, nil
+	}
+	if store.config.StaleReadRate > 0 && strings.HasPrefix(blobObject.path, store.config.PathPrefix) {
+		// Only content that was read back is kept, a missing object is never read stale
+		if previous, err := blobObject.inner.Read(); err == nil && previous != nil {
+			store.Lock()
+			store.previous[blobObject.path] = previous
+			store.Unlock()
+		}
+	}
+	if store.inject(blobObject.path, store.config.PartialWriteRate, &store.stats.PartialWrites) {
+		_, err := blobObject.inner.Write(data[:len(data)/2])
+		if err != nil {
+			return false, err
+		}
+		return false, errors.Wrapf(ErrInjectedFault, "partial write `%s`", blobObject.path)
+	}
+	return blobObject.inner.Write(data)
+}
+
+func (blobObject *faultyBlobObject) Delete() error {
+	if err := blobObject.client.store.injectError(blobObject.path, "delete"); err != nil {
+		return err
+	}
+	return blobObject.inner.Delete()
+}
@@ -0,0 +1,208 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// writeFaultPattern writes count objects to blobStore and returns which writes failed
+func writeFaultPattern(t *testing.T, blobStore BlobStore, count int) []bool {
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	failed := make([]bool, count)
+	for i := range failed {
+		objHandle, _ := client.NewObject(fmt.Sprintf("object-%d", i))
+		_, err := objHandle.Write([]byte("data"))
+		if err != nil && errors.Cause(err) != ErrInjectedFault {
+			t.Fatalf("writeFaultPattern() objHandle.Write() %v", err)
+		}
+		failed[i] = err != nil
+	}
+	return failed
+}
+
+func TestFaultyBlobStore(t *testing.T) {
+	config := FaultConfig{ErrorRate: 0.5, Seed: 7}
+	innerStore, _ := NewTestBlobStore("the_path")
+	blobStore := NewFaultyBlobStore(innerStore, config)
+	pattern := writeFaultPattern(t, blobStore, 32)
+	otherStore, _ := NewTestBlobStore("the_path")
+	otherPattern := writeFaultPattern(t, NewFaultyBlobStore(otherStore, config), 32)
+	failCount := uint64(0)
+	for i := range pattern {
+		if pattern[i] != otherPattern[i] {
+			t.Fatalf("TestFaultyBlobStore() the faults of the same seed differ %v != %v", pattern, otherPattern)
+		}
+		if pattern[i] {
+			failCount++
+		}
+	}
+	if failCount == 0 || failCount == 32 || blobStore.(FaultStatsProvider).GetFaultStats().Errors != failCount {
+		t.Errorf("TestFaultyBlobStore() %d failed writes, stats %v", failCount, blobStore.(FaultStatsProvider).GetFaultStats())
+	}
+
+	// Partial writes leave half of the data behind
+	blobStore = NewFaultyBlobStore(innerStore, FaultConfig{PartialWriteRate: 1})
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	objHandle, _ := client.NewObject("partial")
+	_, err := objHandle.Write([]byte("abcdef"))
+	if errors.Cause(err) != ErrInjectedFault {
+		t.Errorf("TestFaultyBlobStore() partial Write() %v != %v", err, ErrInjectedFault)
+	}
+	innerClient, _ := innerStore.NewClient(context.Background())
+	defer innerClient.Close()
+	innerObject, _ := innerClient.NewObject("partial")
+	if data, _ := innerObject.Read(); string(data) != "abc" {
+		t.Errorf("TestFaultyBlobStore() partial write content `%s` != `%s`", string(data), "abc")
+	}
+
+	// Stale reads return the content before the last write
+	blobStore = NewFaultyBlobStore(innerStore, FaultConfig{StaleReadRate: 1})
+	client, _ = blobStore.NewClient(context.Background())
+	defer client.Close()
+	objHandle, _ = client.NewObject("stale")
+	objHandle.Write([]byte("old"))
+	if data, _ := objHandle.Read(); string(data) != "old" {
+		t.Errorf("TestFaultyBlobStore() Read() of new object `%s` != `%s`", string(data), "old")
+	}
+	objHandle.Write([]byte("new"))
+	if data, _ := objHandle.Read(); string(data) != "old" {
+		t.Errorf("TestFaultyBlobStore() stale Read() `%s` != `%s`", string(data), "old")
+	}
+
+	// Conflicts only fail writes after LockWriteVersion
+	blobStore = NewFaultyBlobStore(innerStore, FaultConfig{ConflictRate: 1})
+	client, _ = blobStore.NewClient(context.Background())
+	defer client.Close()
+	objHandle, _ = client.NewObject("conflict")
+	if ok, err := objHandle.Write([]byte("a")); !ok || err != nil {
+		t.Errorf("TestFaultyBlobStore() Write() %t, %v", ok, err)
+	}
+	objHandle.LockWriteVersion()
+	if ok, err := objHandle.Write([]byte("b")); ok || err != nil {
+		t.Errorf("TestFaultyBlobStore() conflicting Write() %t, %v", ok, err)
+	}
+	if blobStore.(FaultStatsProvider).GetFaultStats().Conflicts != 1 {
+		t.Errorf("TestFaultyBlobStore() stats %v", blobStore.(FaultStatsProvider).GetFaultStats())
+	}
+}
+
+func TestFaultyBlobStoreForURI(t *testing.T) {
+	uri, opts, err := ParseStoreURI("faulty+the_path?fault-error-rate=0.25&fault-conflict-rate=1&fault-latency=1ms&fault-seed=3")
+	if err != nil {
+		t.Fatalf("TestFaultyBlobStoreForURI() ParseStoreURI() %v != %v", err, nil)
+	}
+	config := newStoreOptions(opts).Faults
+	if config.ErrorRate != 0.25 || config.ConflictRate != 1 || config.Latency.Milliseconds() != 1 || config.Seed != 3 {
+		t.Errorf("TestFaultyBlobStoreForURI() Faults %v", config)
+	}
+	_, _, err = ParseStoreURI("faulty+the_path?fault-error-rate=2")
+	if err == nil {
+		t.Errorf("TestFaultyBlobStoreForURI() ParseStoreURI() invalid rate %v", err)
+	}
+	blobStore, err := createBlobStoreForURI(uri, opts...)
+	if err != nil {
+		t.Fatalf("TestFaultyBlobStoreForURI() createBlobStoreForURI() %v != %v", err, nil)
+	}
+	if _, ok := blobStore.(FaultStatsProvider); !ok {
+		t.Errorf("TestFaultyBlobStoreForURI() %s is not a faulty blob store", blobStore.String())
+	}
+}
+
+func TestRemoteStoreWithFaults(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	innerStore, _ := NewTestBlobStore("the_path")
+
+	// Block writes and reads are retried and index updates that conflict are merged and retried
+	for _, config := range []FaultConfig{
+		{ErrorRate: 0.2, PathPrefix: "chunks/", Seed: 6},
+		{ConflictRate: 0.75, PathPrefix: "store.lsi", Seed: 2}} {
+		blobStore := NewFaultyBlobStore(innerStore, config)
+		seeds := []uint8{0, 10, 20}
+		if config.ConflictRate > 0 {
+			seeds = []uint8{30, 40}
+		}
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite)
+		if err != nil {
+			t.Fatalf("TestRemoteStoreWithFaults() NewRemoteBlockStore() %v != %v", err, nil)
+		}
+		storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+		for _, seed := range seeds {
+			if _, errno := storeBlockFromSeed(t, storeAPI, seed); errno != 0 {
+				t.Fatalf("TestRemoteStoreWithFaults() storeBlockFromSeed(%d) %d != %d", seed, errno, 0)
+			}
+		}
+		for _, seed := range seeds {
+			storedBlock, errno := fetchBlockFromStore(t, storeAPI, uint64(seed)+21412151)
+			if errno != 0 {
+				t.Fatalf("TestRemoteStoreWithFaults() fetchBlockFromStore(%d) %d != %d", seed, errno, 0)
+			}
+			validateBlockFromSeed(t, seed, storedBlock)
+			storedBlock.Dispose()
+		}
+		storeAPI.Dispose()
+		stats := blobStore.(FaultStatsProvider).GetFaultStats()
+		if stats.Errors+stats.Conflicts == 0 {
+			t.Errorf("TestRemoteStoreWithFaults() no faults were injected with %v", config)
+		}
+	}
+
+	client, _ := innerStore.NewClient(context.Background())
+	defer client.Close()
+	storeIndex, err := readStoreIndexObject(client, "store.lsi")
+	if err != nil {
+		t.Fatalf("TestRemoteStoreWithFaults() readStoreIndexObject() %v != %v", err, nil)
+	}
+	defer storeIndex.Dispose()
+	if len(storeIndex.GetBlockHashes()) != 5 {
+		t.Errorf("TestRemoteStoreWithFaults() store index has %d blocks, expected %d", len(storeIndex.GetBlockHashes()), 5)
+	}
+}
+
+func TestRemoteStorePutExistsFault(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	root, _ := ioutil.TempDir("", "longtailstorelib")
+	defer os.RemoveAll(root)
+
+	// A block whose existence check keeps failing is neither written nor added to the store index
+	blobStore, err := CreateBlobStoreForURI("faulty+" + filepath.Join(root, "store") + "?fault-exists-error-rate=1&fault-path-prefix=chunks/")
+	if err != nil {
+		t.Fatalf("TestRemoteStorePutExistsFault() CreateBlobStoreForURI() %v != %v", err, nil)
+	}
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithMaxRetries(-1))
+	if err != nil {
+		t.Fatalf("TestRemoteStorePutExistsFault() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	if _, errno := storeBlockFromSeed(t, storeAPI, 0); errno == 0 {
+		t.Errorf("TestRemoteStorePutExistsFault() storeBlockFromSeed() %d == %d", errno, 0)
+	}
+	flushRemoteStore(storeAPI)
+	stats, _ := storeAPI.GetStats()
+	if failCount := stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount]; failCount != 1 {
+		t.Errorf("TestRemoteStorePutExistsFault() PutStoredBlock_FailCount %d != %d", failCount, 1)
+	}
+	if blobStore.(FaultStatsProvider).GetFaultStats().Errors != 1 {
+		t.Errorf("TestRemoteStorePutExistsFault() Errors %d != %d", blobStore.(FaultStatsProvider).GetFaultStats().Errors, 1)
+	}
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	if storeIndex, err := readStoreIndexObject(client, "store.lsi"); err == nil && storeIndex.IsValid() {
+		if len(storeIndex.GetBlockHashes()) != 0 {
+			t.Errorf("TestRemoteStorePutExistsFault() store index has %d blocks, expected %d", len(storeIndex.GetBlockHashes()), 0)
+		}
+		storeIndex.Dispose()
+	}
+}
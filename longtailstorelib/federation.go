@@ -0,0 +1,221 @@
+package longtailstorelib
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// federatedURIPrefix starts a storage URI that spreads a store over several backend stores, such as
+// federated:gs://bucket-a/store,gs://bucket-b/store
+const federatedURIPrefix = "federated:"
+
+// ParseFederatedURI returns the backend URIs of a federated storage URI, ok is false if uri is not federated
+func ParseFederatedURI(uri string) (backendURIs []string, ok bool) {
+	if !strings.HasPrefix(uri, federatedURIPrefix) {
+		return nil, false
+	}
+	for _, backendURI := range strings.Split(uri[len(federatedURIPrefix):], ",") {
+		if backendURI != "" {
+			backendURIs = append(backendURIs, backendURI)
+		}
+	}
+	return backendURIs, true
+}
+
+// federatedBlockStore spreads the blocks of a store over several backend stores. Each block is put
+// in and read from the backend picked by rendezvous hashing of the block hash and the backend name,
+// so adding a backend only moves the blocks that the new backend wins. The existing content of the
+// store is the content of all backends merged.
+//
+// Stats: the sum of the stats of the backends.
+type federatedBlockStore struct {
+	backends []longtaillib.Longtail_BlockStoreAPI
+	seeds    []uint64
+}
+
+// NewFederatedBlockStore creates a block store on top of backends, names identify the backends
+// for the routing and must stay the same for as long as the store is used. The federated store
+// owns the backends and disposes them when it is closed.
+func NewFederatedBlockStore(backends []longtaillib.Longtail_BlockStoreAPI, names []string) longtaillib.BlockStoreAPI {
+	seeds := make([]uint64, len(names))
+	for i, name := range names {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		seeds[i] = h.Sum64()
+	}
+	return &federatedBlockStore{backends: backends, seeds: seeds}
+}
+
+// mixHash is the splitmix64 finalizer, it spreads the bits of x so nearby inputs give unrelated scores
+func mixHash(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// route returns the index of the backend of blockHash, the backend with the highest score wins
+func route(seeds []uint64, blockHash uint64) int {
+	best := 0
+	bestScore := uint64(0)
+	for i, seed := range seeds {
+		score := mixHash(seed ^ blockHash)
+		if i == 0 || score > bestScore {
+			best = i
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// federatedCompletion collects the results of a request made to all backends and completes the
+// request once when the last backend is done, with the first error if any backend failed
+type federatedCompletion struct {
+	lock       sync.Mutex
+	pending    int
+	errno      int
+	storeIndex longtaillib.Longtail_StoreIndex
+	onDone     func(storeIndex longtaillib.Longtail_StoreIndex, errno int)
+}
+
+func (a *federatedCompletion) complete(storeIndex longtaillib.Longtail_StoreIndex, errno int) {
+	a.lock.Lock()
+	if errno == 0 && a.errno == 0 && storeIndex.IsValid() {
+		if !a.storeIndex.IsValid() {
+			a.storeIndex = storeIndex
+		} else {
+			merged, mergeErrno := longtaillib.MergeStoreIndex(a.storeIndex, storeIndex)
+			a.storeIndex.Dispose()
+			storeIndex.Dispose()
+			a.storeIndex = merged
+			errno = mergeErrno
+		}
+	} else {
+		storeIndex.Dispose()
+	}
+	if errno != 0 && a.errno == 0 {
+		a.errno = errno
+	}
+	a.pending--
+	done := a.pending == 0
+	a.lock.Unlock()
+	if !done {
+		return
+	}
+	if a.errno != 0 {
+		a.storeIndex.Dispose()
+		a.onDone(longtaillib.Longtail_StoreIndex{}, a.errno)
+		return
+	}
+	a.onDone(a.storeIndex, 0)
+}
+
+type federatedGetExistingContentCompletionAPI struct {
+	completion *federatedCompletion
+}
+
+func (a *federatedGetExistingContentCompletionAPI) OnComplete(storeIndex longtaillib.Longtail_StoreIndex, errno int) {
+	a.completion.complete(storeIndex, errno)
+}
+
+type federatedFlushCompletionAPI struct {
+	completion *federatedCompletion
+}
+
+func (a *federatedFlushCompletionAPI) OnComplete(errno int) {
+	a.completion.complete(longtaillib.Longtail_StoreIndex{}, errno)
+}
+
+// PutStoredBlock ...
+func (s *federatedBlockStore) PutStoredBlock(storedBlock longtaillib.Longtail_StoredBlock, asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI) int {
+	blockIndex := storedBlock.GetBlockIndex()
+	backend := s.backends[route(s.seeds, blockIndex.GetBlockHash())]
+	return backend.PutStoredBlock(storedBlock, asyncCompleteAPI)
+}
+
+// PreflightGet ...
+func (s *federatedBlockStore) PreflightGet(blockHashes []uint64, asyncCompleteAPI longtaillib.Longtail_AsyncPreflightStartedAPI) int {
+	backendBlockHashes := make([][]uint64, len(s.backends))
+	for _, blockHash := range blockHashes {
+		b := route(s.seeds, blockHash)
+		backendBlockHashes[b] = append(backendBlockHashes[b], blockHash)
+	}
+	for b, backend := range s.backends {
+		if len(backendBlockHashes[b]) == 0 {
+			continue
+		}
+		errno := backend.PreflightGet(backendBlockHashes[b], longtaillib.Longtail_AsyncPreflightStartedAPI{})
+		if errno != 0 {
+			return errno
+		}
+	}
+	asyncCompleteAPI.OnComplete(blockHashes, 0)
+	return 0
+}
+
+// GetStoredBlock ...
+func (s *federatedBlockStore) GetStoredBlock(blockHash uint64, asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI) int {
+	return s.backends[route(s.seeds, blockHash)].GetStoredBlock(blockHash, asyncCompleteAPI)
+}
+
+// GetExistingContent ...
+func (s *federatedBlockStore) GetExistingContent(chunkHashes []uint64, minBlockUsagePercent uint32, asyncCompleteAPI longtaillib.Longtail_AsyncGetExistingContentAPI) int {
+	completion := &federatedCompletion{
+		pending: len(s.backends),
+		onDone: func(storeIndex longtaillib.Longtail_StoreIndex, errno int) {
+			if errno == 0 && !storeIndex.IsValid() {
+				storeIndex, errno = longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+			}
+			asyncCompleteAPI.OnComplete(storeIndex, errno)
+		}}
+	for _, backend := range s.backends {
+		errno := backend.GetExistingContent(chunkHashes, minBlockUsagePercent, longtaillib.CreateAsyncGetExistingContentAPI(&federatedGetExistingContentCompletionAPI{completion: completion}))
+		if errno != 0 {
+			completion.complete(longtaillib.Longtail_StoreIndex{}, errno)
+		}
+	}
+	return 0
+}
+
+// GetStats ...
+func (s *federatedBlockStore) GetStats() (longtaillib.BlockStoreStats, int) {
+	stats := longtaillib.BlockStoreStats{}
+	for _, backend := range s.backends {
+		backendStats, errno := backend.GetStats()
+		if errno != 0 {
+			return longtaillib.BlockStoreStats{}, errno
+		}
+		for i, value := range backendStats.StatU64 {
+			stats.StatU64[i] += value
+		}
+	}
+	return stats, 0
+}
+
+// Flush ...
+func (s *federatedBlockStore) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI) int {
+	completion := &federatedCompletion{
+		pending: len(s.backends),
+		onDone: func(storeIndex longtaillib.Longtail_StoreIndex, errno int) {
+			asyncCompleteAPI.OnComplete(errno)
+		}}
+	for _, backend := range s.backends {
+		errno := backend.Flush(longtaillib.CreateAsyncFlushAPI(&federatedFlushCompletionAPI{completion: completion}))
+		if errno != 0 {
+			completion.complete(longtaillib.Longtail_StoreIndex{}, errno)
+		}
+	}
+	return 0
+}
+
+// Close ...
+func (s *federatedBlockStore) Close() {
+	for _, backend := range s.backends {
+		backend.Dispose()
+	}
+}
@@ -0,0 +1,119 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestParseFederatedURI(t *testing.T) {
+	backendURIs, ok := ParseFederatedURI("federated:gs://a/store,gs://b/store?worker-count=2")
+	if !ok || len(backendURIs) != 2 || backendURIs[0] != "gs://a/store" || backendURIs[1] != "gs://b/store?worker-count=2" {
+		t.Errorf("TestParseFederatedURI() ParseFederatedURI() %v, %t", backendURIs, ok)
+	}
+	_, ok = ParseFederatedURI("gs://a/store")
+	if ok {
+		t.Errorf("TestParseFederatedURI() ParseFederatedURI(gs://a/store) %t != %t", ok, false)
+	}
+}
+
+func TestRouteIsStable(t *testing.T) {
+	seeds := []uint64{11, 22, 33}
+	counts := make([]int, len(seeds))
+	moved := 0
+	for blockHash := uint64(0); blockHash < 3000; blockHash++ {
+		b := route(seeds, blockHash*0x9e3779b97f4a7c15)
+		counts[b]++
+		// Adding a backend only moves blocks to the new backend
+		grown := route(append(seeds, 44), blockHash*0x9e3779b97f4a7c15)
+		if grown != b {
+			if grown != 3 {
+				t.Fatalf("TestRouteIsStable() block moved from backend %d to %d", b, grown)
+			}
+			moved++
+		}
+	}
+	for b, count := range counts {
+		if count < 800 {
+			t.Errorf("TestRouteIsStable() backend %d got %d of 3000 blocks", b, count)
+		}
+	}
+	if moved < 500 || moved > 1000 {
+		t.Errorf("TestRouteIsStable() %d of 3000 blocks moved to the new backend", moved)
+	}
+}
+
+func TestFederatedBlockStore(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	names := []string{"gs://a/store", "gs://b/store", "gs://c/store"}
+	blobStores := make([]BlobStore, len(names))
+	backends := make([]longtaillib.Longtail_BlockStoreAPI, len(names))
+	for i := range names {
+		blobStores[i], _ = NewTestBlobStore("the_path")
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStores[i], "", runtime.NumCPU(), ReadWrite)
+		if err != nil {
+			t.Fatalf("TestFederatedBlockStore() NewRemoteBlockStore() %v != %v", err, nil)
+		}
+		backends[i] = longtaillib.CreateBlockStoreAPI(remoteStore)
+	}
+	federatedStore := NewFederatedBlockStore(backends, names)
+	federatedStoreAPI := longtaillib.CreateBlockStoreAPI(federatedStore)
+	defer federatedStoreAPI.Dispose()
+
+	blockHashes := []uint64{}
+	chunkHashes := []uint64{}
+	for seed := uint8(0); seed < 30; seed++ {
+		blockHash, errno := storeBlockFromSeed(t, federatedStoreAPI, seed)
+		if errno != 0 {
+			t.Fatalf("TestFederatedBlockStore() storeBlockFromSeed() %d != %d", errno, 0)
+		}
+		blockHashes = append(blockHashes, blockHash)
+		chunkHashes = append(chunkHashes, uint64(seed)+1, uint64(seed)+2, uint64(seed)+3)
+	}
+
+	// Each block is in exactly one backend
+	seeds := federatedStore.(*federatedBlockStore).seeds
+	for _, blockHash := range blockHashes {
+		for b, blobStore := range blobStores {
+			client, _ := blobStore.NewClient(context.Background())
+			object, _ := client.NewObject(GetBlockPath("chunks", blockHash))
+			exists, _ := object.Exists()
+			client.Close()
+			if exists != (b == route(seeds, blockHash)) {
+				t.Errorf("TestFederatedBlockStore() block 0x%016x in backend %d %t", blockHash, b, exists)
+			}
+		}
+		storedBlock, errno := fetchBlockFromStore(t, federatedStoreAPI, blockHash)
+		if errno != 0 {
+			t.Errorf("TestFederatedBlockStore() fetchBlockFromStore(0x%016x) %d != %d", blockHash, errno, 0)
+			continue
+		}
+		storedBlock.Dispose()
+	}
+
+	f := &flushCompletionAPI{}
+	f.wg.Add(1)
+	federatedStoreAPI.Flush(longtaillib.CreateAsyncFlushAPI(f))
+	f.wg.Wait()
+	if f.err != 0 {
+		t.Errorf("TestFederatedBlockStore() Flush() %d != %d", f.err, 0)
+	}
+
+	existingContent, errno := getExistingContent(t, federatedStoreAPI, chunkHashes, 0)
+	if errno != 0 {
+		t.Fatalf("TestFederatedBlockStore() getExistingContent() %d != %d", errno, 0)
+	}
+	defer existingContent.Dispose()
+	if int(existingContent.GetBlockCount()) != len(blockHashes) {
+		t.Errorf("TestFederatedBlockStore() existingContent.GetBlockCount() %d != %d", existingContent.GetBlockCount(), len(blockHashes))
+	}
+
+	stats, errno := federatedStoreAPI.GetStats()
+	if errno != 0 || stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count] != uint64(len(blockHashes)) {
+		t.Errorf("TestFederatedBlockStore() GetStats() put count %d != %d", stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count], len(blockHashes))
+	}
+}
@@ -0,0 +1,44 @@
+package longtailstorelib
+
+import "sync/atomic"
+
+// FetchDedupStats counts the block requests of the remote block store that did not read the block
+// again as the same block was being fetched or had been fetched already. The fetches in flight and
+// the fetched blocks nobody has read yet are tracked in prefetchBlocks, a request for a block that
+// is in it joins the fetch in flight or takes the fetched block.
+type FetchDedupStats struct {
+	// JoinedGetCount is the number of block reads that waited for the fetch of another read
+	JoinedGetCount uint64
+	// JoinedPrefetchCount is the number of block reads that waited for a prefetch in flight
+	JoinedPrefetchCount uint64
+	// SkippedPrefetchCount is the number of prefetches that were dropped as the block was being
+	// fetched, had been prefetched or had been read already
+	SkippedPrefetchCount uint64
+}
+
+// fetchDedupCounter counts the deduplicated block requests of a remote block store
+type fetchDedupCounter struct {
+	joinedGets        uint64
+	joinedPrefetches  uint64
+	skippedPrefetches uint64
+}
+
+// joined is called when a block read waits for the fetch of prefetchedBlock
+func (c *fetchDedupCounter) joined(prefetchedBlock *pendingPrefetchedBlock) {
+	if prefetchedBlock.requested {
+		atomic.AddUint64(&c.joinedGets, 1)
+	} else {
+		atomic.AddUint64(&c.joinedPrefetches, 1)
+	}
+}
+
+func (c *fetchDedupCounter) skippedPrefetch() {
+	atomic.AddUint64(&c.skippedPrefetches, 1)
+}
+
+func (c *fetchDedupCounter) stats() FetchDedupStats {
+	return FetchDedupStats{
+		JoinedGetCount:       atomic.LoadUint64(&c.joinedGets),
+		JoinedPrefetchCount:  atomic.LoadUint64(&c.joinedPrefetches),
+		SkippedPrefetchCount: atomic.LoadUint64(&c.skippedPrefetches)}
+}
@@ -0,0 +1,64 @@
+package longtailstorelib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestFetchDedup(t *testing.T) {
+	blobStore, s, client, blockHash, closeStore := newGatedRemoteStore(t, 7)
+	defer closeStore()
+	ctx := context.Background()
+
+	// A second get and a prefetch of a block that a get is fetching do not read it again, the
+	// gated store would block a second read
+	waiters, _ := newOrderedWaiters(2)
+	fetchDone := make(chan struct{})
+	go func() {
+		fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[0])})
+		close(fetchDone)
+	}()
+	<-blobStore.readStarted
+	fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[1])})
+	prefetchBlock(ctx, s, client, prefetchBlockMessage{blockHash: blockHash})
+	close(blobStore.gate)
+	<-fetchDone
+	for i, w := range waiters {
+		w.wg.Wait()
+		if w.err != 0 {
+			t.Fatalf("TestFetchDedup() waiter %d err %d != %d", i, w.err, 0)
+		}
+		validateBlockFromSeed(t, 7, w.storedBlock)
+		w.storedBlock.Dispose()
+	}
+	stats := s.GetDetailedStats().FetchDedup
+	if stats.JoinedGetCount != 1 || stats.JoinedPrefetchCount != 0 || stats.SkippedPrefetchCount != 1 {
+		t.Errorf("TestFetchDedup() FetchDedup %+v", stats)
+	}
+
+	// A get of a block that is being prefetched waits for the prefetch
+	blobStore, s, client, blockHash, closePrefetchStore := newGatedRemoteStore(t, 11)
+	defer closePrefetchStore()
+	waiters, _ = newOrderedWaiters(1)
+	prefetchDone := make(chan struct{})
+	go func() {
+		prefetchBlock(ctx, s, client, prefetchBlockMessage{blockHash: blockHash})
+		close(prefetchDone)
+	}()
+	<-blobStore.readStarted
+	fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[0])})
+	close(blobStore.gate)
+	<-prefetchDone
+	waiters[0].wg.Wait()
+	if waiters[0].err != 0 {
+		t.Fatalf("TestFetchDedup() prefetch waiter err %d != %d", waiters[0].err, 0)
+	}
+	validateBlockFromSeed(t, 11, waiters[0].storedBlock)
+	waiters[0].storedBlock.Dispose()
+	stats = s.GetDetailedStats().FetchDedup
+	if stats.JoinedGetCount != 0 || stats.JoinedPrefetchCount != 1 || stats.SkippedPrefetchCount != 0 {
+		t.Errorf("TestFetchDedup() FetchDedup after prefetch %+v", stats)
+	}
+}
@@ -1,7 +1,13 @@
 package longtailstorelib
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -30,3 +36,174 @@ func TestFSBlobStore(t *testing.T) {
 		t.Errorf("object.Write() err == %q", err)
 	}
 }
+
+func TestImmutableFSBlobStore(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_immutable_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath, WithImmutable())
+	client, _ := blobStore.NewClient(context.Background())
+	object, _ := client.NewObject("test.txt")
+	ok, err := object.Write([]byte("apa"))
+	if !ok || err != nil {
+		t.Errorf("TestImmutableFSBlobStore() object.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+	ok, err = object.Write([]byte("apa"))
+	if !ok || err != nil {
+		t.Errorf("TestImmutableFSBlobStore() object.Write() same data %t, %v != %t, %v", ok, err, true, nil)
+	}
+	ok, err = object.Write([]byte("banan"))
+	if ok || !IsImmutable(err) {
+		t.Errorf("TestImmutableFSBlobStore() object.Write() new data %t, %v != %t, %v", ok, err, false, ErrImmutable)
+	}
+	err = object.Delete()
+	if !IsImmutable(err) {
+		t.Errorf("TestImmutableFSBlobStore() object.Delete() %v != %v", err, ErrImmutable)
+	}
+	data, _ := object.Read()
+	if string(data) != "apa" {
+		t.Errorf("TestImmutableFSBlobStore() object.Read() %s != %s", string(data), "apa")
+	}
+
+	lockedObject, _ := client.NewObject("test.txt")
+	lockedObject.LockWriteVersion()
+	ok, err = lockedObject.Write([]byte("banan"))
+	if !ok || err != nil {
+		t.Errorf("TestImmutableFSBlobStore() lockedObject.Write() %t, %v != %t, %v", ok, err, true, nil)
+	}
+}
+
+func TestFSBlobStoreAtomicWrite(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_atomic_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	client, _ := blobStore.NewClient(context.Background())
+	object, _ := client.NewObject("index/version.lvi")
+	for _, data := range []string{"apa", "banan"} {
+		ok, err := object.Write([]byte(data))
+		if !ok || err != nil {
+			t.Errorf("TestFSBlobStoreAtomicWrite() object.Write(%s) %t, %v != %t, %v", data, ok, err, true, nil)
+		}
+	}
+	data, err := object.Read()
+	if err != nil || string(data) != "banan" {
+		t.Errorf("TestFSBlobStoreAtomicWrite() object.Read() %s, %v != %s, %v", data, err, "banan", nil)
+	}
+	objects, _ := client.GetObjects()
+	if len(objects) != 1 {
+		t.Errorf("TestFSBlobStoreAtomicWrite() temp files left %v", objects)
+	}
+}
+
+func TestNetworkShareFSBlobStore(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_network_share_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	// Each writer has its own store like separate machines on a share, every increment of the
+	// counter must survive
+	const writerCount = 8
+	const incrementCount = 10
+	var wg sync.WaitGroup
+	for w := 0; w < writerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			blobStore, _ := NewFSBlobStore(storePath, WithNetworkShare())
+			client, _ := blobStore.NewClient(context.Background())
+			defer client.Close()
+			for i := 0; i < incrementCount; i++ {
+				for {
+					object, _ := client.NewObject("store.lsi")
+					exists, err := object.LockWriteVersion()
+					if err != nil {
+						t.Errorf("TestNetworkShareFSBlobStore() LockWriteVersion() %v", err)
+						return
+					}
+					count := 0
+					if exists {
+						data, err := object.Read()
+						if err != nil {
+							t.Errorf("TestNetworkShareFSBlobStore() Read() %v", err)
+							return
+						}
+						count, _ = strconv.Atoi(string(data))
+					}
+					// Give the other writers a chance to update the counter in between
+					time.Sleep(time.Millisecond)
+					ok, err := object.Write([]byte(strconv.Itoa(count + 1)))
+					if err != nil {
+						t.Errorf("TestNetworkShareFSBlobStore() Write() %v", err)
+						return
+					}
+					if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	blobStore, _ := NewFSBlobStore(storePath, WithNetworkShare())
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	data, err := object.Read()
+	if err != nil || string(data) != strconv.Itoa(writerCount*incrementCount) {
+		t.Errorf("TestNetworkShareFSBlobStore() Read() %s, %v != %d", data, err, writerCount*incrementCount)
+	}
+	objects, _ := client.GetObjects()
+	if len(objects) != 1 || objects[0].Name != "store.lsi" {
+		t.Errorf("TestNetworkShareFSBlobStore() GetObjects() %v", objects)
+	}
+
+	// A lock left behind by a crashed writer is broken once it is stale
+	lockPath := filepath.Join(storePath, "store.lsi"+fsLockSuffix)
+	ioutil.WriteFile(lockPath, []byte("crashed"), 0644)
+	staleTime := time.Now().Add(-2 * fsLockStaleAfter)
+	os.Chtimes(lockPath, staleTime, staleTime)
+	object.LockWriteVersion()
+	ok, err := object.Write([]byte("0"))
+	if !ok || err != nil {
+		t.Errorf("TestNetworkShareFSBlobStore() Write() with stale lock %t, %v", ok, err)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Errorf("TestNetworkShareFSBlobStore() lock left after Write() %v", err)
+	}
+}
+
+func TestFSBlobStoreWriteIfAbsent(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_create_only_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	client, _ := blobStore.NewClient(context.Background())
+	object, _ := client.NewObject("chunks/0000/0x0000000000000001.lsb")
+	for i, data := range []string{"apa", "banan"} {
+		ok, existed, err := object.(createOnlyBlobObject).WriteIfAbsent([]byte(data))
+		if !ok || existed != (i > 0) || err != nil {
+			t.Errorf("TestFSBlobStoreWriteIfAbsent() WriteIfAbsent(%s) %t, %t, %v != %t, %t, %v", data, ok, existed, err, true, i > 0, nil)
+		}
+	}
+	data, err := object.Read()
+	if err != nil || string(data) != "apa" {
+		t.Errorf("TestFSBlobStoreWriteIfAbsent() object.Read() %s, %v != %s, %v", data, err, "apa", nil)
+	}
+	objects, _ := client.GetObjects()
+	if len(objects) != 1 {
+		t.Errorf("TestFSBlobStoreWriteIfAbsent() temp files left %v", objects)
+	}
+}
@@ -0,0 +1,88 @@
+package longtailstorelib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// Flush stages of FlushResult besides the worker pools, which use the worker pool names
+const (
+	FlushStageDecode     = "decode"
+	FlushStageStoreIndex = "store-index"
+)
+
+// FlushResult is how far a flush of the remote block store got. A flush waits for the worker
+// pools, by the worker pool names, then for the decodes of fetched blocks and last for the store
+// index update, in that order.
+type FlushResult struct {
+	// Drained are the stages that finished flushing
+	Drained []string
+	// Pending are the stages that were still flushing, or waiting for an earlier stage, when the
+	// timeout passed
+	Pending []string
+	// Errno is the first error of the drained stages
+	Errno int
+}
+
+// Completed returns true if all stages drained
+func (r FlushResult) Completed() bool {
+	return len(r.Pending) == 0
+}
+
+// TimeoutFlusher is implemented by block stores that can give up waiting for a flush
+type TimeoutFlusher interface {
+	// FlushWithTimeout flushes the store like Flush but stops waiting after timeout, then the error
+	// is ErrFlushTimeout and the result tells which stages are pending. The flush itself can not be
+	// abandoned, it continues in the background and later flushes wait for it. A caller can retry
+	// with another FlushWithTimeout or give up on the store.
+	FlushWithTimeout(timeout time.Duration) (FlushResult, error)
+}
+
+// flushStages are the stages of a flush of s in the order they drain
+func (s *remoteStore) flushStages() []string {
+	stages := make([]string, 0, len(s.workerPools)+2)
+	for _, pool := range s.workerPools {
+		stages = append(stages, pool.name)
+	}
+	return append(stages, FlushStageDecode, FlushStageStoreIndex)
+}
+
+// FlushWithTimeout flushes the store and waits at most timeout for it, see TimeoutFlusher
+func (s *remoteStore) FlushWithTimeout(timeout time.Duration) (FlushResult, error) {
+	var lock sync.Mutex
+	result := FlushResult{Drained: []string{}, Pending: s.flushStages()}
+	done := make(chan int, 1)
+	go func() {
+		done <- s.flush(func(stage string, errno int) {
+			lock.Lock()
+			defer lock.Unlock()
+			result.Drained = append(result.Drained, stage)
+			result.Pending = result.Pending[1:]
+			if errno != 0 && result.Errno == 0 {
+				result.Errno = errno
+			}
+		})
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case errno := <-done:
+		if errno != 0 {
+			err = errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "FlushWithTimeout: %s", s.String())
+		}
+	case <-timer.C:
+		err = errors.Wrapf(ErrFlushTimeout, "FlushWithTimeout: %s did not flush within %v", s.String(), timeout)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	// The flush may still be running, the caller gets a copy
+	return FlushResult{
+		Drained: append([]string{}, result.Drained...),
+		Pending: append([]string{}, result.Pending...),
+		Errno:   result.Errno}, err
+}
@@ -0,0 +1,54 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+func TestFlushWithTimeout(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	innerStore, _ := NewTestBlobStore("the_path")
+	blobStore := NewFaultyBlobStore(innerStore, FaultConfig{Latency: 200 * time.Millisecond})
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithWorkerPools(1, 1))
+	if err != nil {
+		t.Fatalf("TestFlushWithTimeout() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	flusher := remoteStore.(TimeoutFlusher)
+
+	// The upload worker is busy with the slow put of the block
+	put := make(chan int, 1)
+	go func() {
+		_, errno := storeBlockFromSeed(t, storeAPI, 0)
+		put <- errno
+	}()
+	time.Sleep(50 * time.Millisecond)
+	result, err := flusher.FlushWithTimeout(10 * time.Millisecond)
+	if errors.Cause(err) != ErrFlushTimeout {
+		t.Errorf("TestFlushWithTimeout() FlushWithTimeout() %v != %v", err, ErrFlushTimeout)
+	}
+	if result.Completed() || len(result.Pending) != 4 || result.Pending[0] != WorkerPoolUpload || result.Pending[3] != FlushStageStoreIndex || len(result.Drained) != 0 {
+		t.Errorf("TestFlushWithTimeout() FlushWithTimeout() timed out %v", result)
+	}
+
+	// A retry waits for the abandoned flush and then flushes again
+	result, err = flusher.FlushWithTimeout(10 * time.Second)
+	if err != nil {
+		t.Fatalf("TestFlushWithTimeout() FlushWithTimeout() %v != %v", err, nil)
+	}
+	if !result.Completed() || len(result.Drained) != 4 || result.Drained[1] != WorkerPoolDownload || result.Drained[2] != FlushStageDecode || result.Errno != 0 {
+		t.Errorf("TestFlushWithTimeout() FlushWithTimeout() %v", result)
+	}
+	if errno := <-put; errno != 0 {
+		t.Errorf("TestFlushWithTimeout() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	if indexed := getStoreIndexBlockHashes(t, innerStore); len(indexed) != 1 {
+		t.Errorf("TestFlushWithTimeout() store index has %d blocks, expected %d", len(indexed), 1)
+	}
+}
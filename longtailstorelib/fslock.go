@@ -0,0 +1,204 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// In network share mode, see WithNetworkShare, a write after LockWriteVersion is a compare and swap
+// on the generation of the object. The generation is kept in a .gen file next to the object and a
+// writer holds a .lock file next to the object while it checks the generation, replaces the object
+// and bumps the generation. The lock is only held for the duration of the write so callers that
+// never write after LockWriteVersion leave nothing behind.
+const (
+	fsLockSuffix       = ".lock"
+	fsGenerationSuffix = ".gen"
+	fsStaleLockSuffix  = ".stale"
+)
+
+// The lock is taken and released within a single write, a lock older than fsLockStaleAfter is left
+// behind by a crashed writer and is broken
+var fsLockTimeout = 60 * time.Second
+var fsLockStaleAfter = 2 * time.Minute
+var fsLockRetryDelay = 50 * time.Millisecond
+
+// Renames onto a file that is open by a reader fail on SMB shares, they are retried this many times
+const fsRenameRetries = 20
+
+// isFSLockFile returns true for the files used by network share mode, they are not objects of the store
+func isFSLockFile(name string) bool {
+	return strings.HasSuffix(name, fsLockSuffix) || strings.HasSuffix(name, fsGenerationSuffix) || strings.Contains(name, fsLockSuffix+fsStaleLockSuffix)
+}
+
+// readFSGeneration returns the generation of the object at path, zero if it has never been written
+// in network share mode
+func readFSGeneration(path string) (int64, error) {
+	data, err := ioutil.ReadFile(path + fsGenerationSuffix)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	generation, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid generation of `%s`", path)
+	}
+	return generation, nil
+}
+
+// fsLock is a lock file held by this process
+type fsLock struct {
+	path  string
+	token string
+}
+
+// acquireFSLock creates the lock file of path, it waits while another writer holds it and breaks
+// locks that have been held for longer than fsLockStaleAfter
+func acquireFSLock(path string) (*fsLock, error) {
+	hostname, _ := os.Hostname()
+	lock := &fsLock{
+		path:  path + fsLockSuffix,
+		token: fmt.Sprintf("%s:%d:%016x", hostname, os.Getpid(), rand.Uint64())}
+	deadline := time.Now().Add(fsLockTimeout)
+	for {
+		f, err := os.OpenFile(lock.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write([]byte(lock.token))
+			err2 := f.Close()
+			if err == nil {
+				err = err2
+			}
+			if err != nil {
+				os.Remove(lock.path)
+				return nil, err
+			}
+			return lock, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lock.path); err == nil && time.Since(info.ModTime()) > fsLockStaleAfter {
+			breakStaleFSLock(lock.path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock `%s`", lock.path)
+		}
+		time.Sleep(fsLockRetryDelay + time.Duration(rand.Int63n(int64(fsLockRetryDelay))))
+	}
+}
+
+// breakStaleFSLock moves a stale lock out of the way. Renaming only succeeds for one of several
+// writers that find the same stale lock, and a lock that turns out to be fresh is moved back.
+func breakStaleFSLock(lockPath string) {
+	stalePath := fmt.Sprintf("%s%s.%016x", lockPath, fsStaleLockSuffix, rand.Uint64())
+	if os.Rename(lockPath, stalePath) != nil {
+		return
+	}
+	if info, err := os.Stat(stalePath); err == nil && time.Since(info.ModTime()) <= fsLockStaleAfter {
+		if os.Link(stalePath, lockPath) == nil {
+			os.Remove(stalePath)
+			return
+		}
+	}
+	os.Remove(stalePath)
+}
+
+// held returns true if the lock file still holds our token, another writer may have broken it as stale
+func (lock *fsLock) held() bool {
+	data, err := ioutil.ReadFile(lock.path)
+	return err == nil && string(data) == lock.token
+}
+
+func (lock *fsLock) release() {
+	if lock.held() {
+		os.Remove(lock.path)
+	}
+}
+
+// renameWithRetry retries renames that fail because the target is open on a network share
+func renameWithRetry(from string, to string) error {
+	var err error
+	for attempt := 0; attempt < fsRenameRetries; attempt++ {
+		err = os.Rename(from, to)
+		if err == nil {
+			return nil
+		}
+		time.Sleep(fsLockRetryDelay)
+	}
+	return err
+}
+
+// writeFileFenced writes data to a temp file next to path and renames it into place, the rename is
+// only made while lock is still held
+func writeFileFenced(path string, data []byte, lock *fsLock) (bool, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	if !lock.held() {
+		os.Remove(f.Name())
+		return false, nil
+	}
+	err = renameWithRetry(f.Name(), path)
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// writeLocked replaces the object at path if its generation is still lockedGeneration and bumps
+// the generation, returns false if another writer got there first
+func writeLocked(path string, data []byte, lockedGeneration int64) (bool, error) {
+	lock, err := acquireFSLock(path)
+	if err != nil {
+		return false, err
+	}
+	defer lock.release()
+	generation, err := readFSGeneration(path)
+	if err != nil {
+		return false, err
+	}
+	if generation != lockedGeneration {
+		return false, nil
+	}
+	// The object is replaced before the generation so a writer that sees the new generation also
+	// sees the new object
+	ok, err := writeFileFenced(path, data, lock)
+	if !ok || err != nil {
+		return false, err
+	}
+	ok, err = writeFileFenced(path+fsGenerationSuffix, []byte(strconv.FormatInt(generation+1, 10)), lock)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("lost lock `%s` after writing `%s`", lock.path, path)
+	}
+	return true, nil
+}
@@ -2,14 +2,19 @@ package longtailstorelib
 
 import (
 	"context"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
 )
 
 type fsBlobStore struct {
-	prefix string
+	prefix  string
+	options StoreOptions
 }
 
 type fsBlobClient struct {
@@ -17,13 +22,15 @@ type fsBlobClient struct {
 }
 
 type fsBlobObject struct {
-	client *fsBlobClient
-	path   string
+	client           *fsBlobClient
+	path             string
+	locked           bool
+	lockedGeneration int64
 }
 
 // NewFSBlobStore ...
-func NewFSBlobStore(prefix string) (BlobStore, error) {
-	s := &fsBlobStore{prefix: prefix}
+func NewFSBlobStore(prefix string, opts ...StoreOption) (BlobStore, error) {
+	s := &fsBlobStore{prefix: prefix, options: newStoreOptions(opts)}
 	return s, nil
 }
 
@@ -31,6 +38,10 @@ func (blobStore *fsBlobStore) NewClient(ctx context.Context) (BlobClient, error)
 	return &fsBlobClient{store: blobStore}, nil
 }
 
+func (blobStore *fsBlobStore) storeOptions() StoreOptions {
+	return blobStore.options
+}
+
 func (blobStore *fsBlobStore) String() string {
 	return "fsstore"
 }
@@ -41,7 +52,49 @@ func (blobClient *fsBlobClient) NewObject(filepath string) (BlobObject, error) {
 }
 
 func (blobClient *fsBlobClient) GetObjects() ([]BlobProperties, error) {
-	return make([]BlobProperties, 0), nil
+	return blobClient.listFiles("")
+}
+
+func (blobClient *fsBlobClient) ListObjects(prefix string) BlobIterator {
+	return newListingBlobIterator(func() ([]BlobProperties, error) { return blobClient.listFiles(prefix) }, prefix)
+}
+
+// listFiles lists the files with names starting with prefix, only the folder of the prefix is walked
+func (blobClient *fsBlobClient) listFiles(prefix string) ([]BlobProperties, error) {
+	objects := make([]BlobProperties, 0)
+	root := blobClient.store.prefix
+	walkRoot := root
+	if i := strings.LastIndex(prefix, "/"); i != -1 {
+		walkRoot = filepath.Join(root, filepath.FromSlash(prefix[:i]))
+	}
+	err := filepath.Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == walkRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if blobClient.store.options.NetworkShare && isFSLockFile(path) {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		objects = append(objects, BlobProperties{Size: info.Size(), Name: name})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
 }
 
 func (blobClient *fsBlobClient) Close() {
@@ -70,7 +123,72 @@ func (blobObject *fsBlobObject) Read() ([]byte, error) {
 	return data, nil
 }
 
+func (blobObject *fsBlobObject) ReadInto(buffer []byte) ([]byte, error) {
+	f, err := os.Open(blobObject.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := len(buffer)
+	size := offset + int(info.Size())
+	if cap(buffer) < size {
+		grown := make([]byte, offset, size)
+		copy(grown, buffer)
+		buffer = grown
+	}
+	buffer = buffer[:size]
+	_, err = io.ReadFull(f, buffer[offset:])
+	if err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func (blobObject *fsBlobObject) WriteTo(w io.Writer) (int64, error) {
+	f, err := os.Open(blobObject.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func (blobObject *fsBlobObject) ReadRange(offset int64, length int64) ([]byte, error) {
+	f, err := os.Open(blobObject.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, length)
+	_, err = f.ReadAt(data, offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: failed to read %d bytes at %d", blobObject.path, length, offset)
+	}
+	return data, nil
+}
+
+// Generation returns the generation of the object in network share mode, zero if the object has
+// never been written in network share mode
+func (blobObject *fsBlobObject) Generation() (int64, error) {
+	if !blobObject.client.store.options.NetworkShare {
+		return 0, nil
+	}
+	return readFSGeneration(blobObject.path)
+}
+
 func (blobObject *fsBlobObject) LockWriteVersion() (bool, error) {
+	blobObject.locked = true
+	if blobObject.client.store.options.NetworkShare {
+		generation, err := readFSGeneration(blobObject.path)
+		if err != nil {
+			return false, err
+		}
+		blobObject.lockedGeneration = generation
+	}
 	return blobObject.Exists()
 }
 
@@ -79,13 +197,107 @@ func (blobObject *fsBlobObject) Write(data []byte) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	err = ioutil.WriteFile(blobObject.path, data, 0644)
+	if blobObject.client.store.options.Immutable && !blobObject.locked {
+		return blobObject.writeOnce(data)
+	}
+	if blobObject.client.store.options.NetworkShare && blobObject.locked {
+		return writeLocked(blobObject.path, data, blobObject.lockedGeneration)
+	}
+	err = writeFileAtomic(blobObject.path, data)
 	if err != nil {
 		return false, err
 	}
 	return true, err
 }
 
+// WriteIfAbsent writes data to a temp file and links it into place, the link fails if the file exists.
+// File systems without hard links check if the file exists before it is renamed into place.
+func (blobObject *fsBlobObject) WriteIfAbsent(data []byte) (bool, bool, error) {
+	err := os.MkdirAll(filepath.Dir(blobObject.path), os.ModePerm)
+	if err != nil {
+		return false, false, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(blobObject.path), filepath.Base(blobObject.path)+".*.tmp")
+	if err != nil {
+		return false, false, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		return false, false, err
+	}
+	err = os.Link(f.Name(), blobObject.path)
+	if os.IsExist(err) {
+		return true, true, nil
+	}
+	if err == nil {
+		return true, false, nil
+	}
+	exists, err := blobObject.Exists()
+	if err != nil || exists {
+		return err == nil, exists, err
+	}
+	err = os.Rename(f.Name(), blobObject.path)
+	if err != nil {
+		return false, false, err
+	}
+	return true, false, nil
+}
+
+// writeFileAtomic writes data to a temp file next to path and renames it into place so readers in
+// other processes never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (blobObject *fsBlobObject) writeOnce(data []byte) (bool, error) {
+	f, err := os.OpenFile(blobObject.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return verifyImmutableObject(blobObject, blobObject.path, data)
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(data)
+	err2 := f.Close()
+	if err != nil {
+		return false, err
+	}
+	if err2 != nil {
+		return false, err2
+	}
+	return true, nil
+}
+
 func (blobObject *fsBlobObject) Delete() error {
+	if blobObject.client.store.options.Immutable {
+		return errors.Wrap(ErrImmutable, blobObject.path)
+	}
 	return os.Remove(blobObject.path)
 }
@@ -1,16 +1,22 @@
 package longtailstorelib
 
 import (
+	"crypto/tls"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"net/url"
+	"os"
 	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
 )
 
 func TestGCSBlobStore(t *testing.T) {
@@ -169,7 +175,7 @@ func TestGCSBlobStoreVersioningStressTest(t *testing.T) {
 			go func(number int, blobStore BlobStore) {
 				err := writeANumberWithRetry(number, blobStore)
 				if err != nil {
-					t.Fatal(err)
+					t.Error(err)
 				}
 				wg.Done()
 			}(i*20+n+1, blobStore)
@@ -201,3 +207,50 @@ func TestGCSBlobStoreVersioningStressTest(t *testing.T) {
 		}
 	}
 }
+
+func TestGCSAnonymousClient(t *testing.T) {
+	// Credentials that can not be loaded make any credential lookup fail
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "does-not-exist.json")
+	defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+	u, _ := url.Parse("gs://public-bucket/store")
+	for _, opts := range [][]StoreOption{{WithAnonymous()}, {WithAnonymous(), WithMaxConcurrentRequests(2), WithTLSMinVersion(tls.VersionTLS12)}} {
+		blobStore, _ := NewGCSBlobStore(u, opts...)
+		client, err := blobStore.NewClient(context.Background())
+		if err != nil {
+			t.Fatalf("TestGCSAnonymousClient() NewClient() %v != %v", err, nil)
+		}
+		client.Close()
+	}
+	blobStore, _ := NewGCSBlobStore(u)
+	if client, err := blobStore.NewClient(context.Background()); err == nil {
+		client.Close()
+		t.Errorf("TestGCSAnonymousClient() NewClient() without anonymous %v == %v", err, nil)
+	}
+}
+
+func TestGCSChecksumErrors(t *testing.T) {
+	data := []byte("block data")
+	attrs := &storage.ObjectAttrs{Size: int64(len(data)), CRC32C: crc32.Checksum(data, crc32cTable)}
+	if err := checkGCSChecksum("chunks/0001.lsb", attrs, attrs.Size, crc32.Checksum(data, crc32cTable)); err != nil {
+		t.Errorf("TestGCSChecksumErrors() checkGCSChecksum() %v != %v", err, nil)
+	}
+	damaged := []byte("block dbta")
+	if err := checkGCSChecksum("chunks/0001.lsb", attrs, attrs.Size, crc32.Checksum(damaged, crc32cTable)); errors.Cause(err) != ErrChecksumMismatch {
+		t.Errorf("TestGCSChecksumErrors() checkGCSChecksum() damaged %v != %v", err, ErrChecksumMismatch)
+	}
+	// A partial read fails with its own error
+	if err := checkGCSChecksum("chunks/0001.lsb", attrs, 4, crc32.Checksum(data[:4], crc32cTable)); err != nil {
+		t.Errorf("TestGCSChecksumErrors() checkGCSChecksum() partial %v != %v", err, nil)
+	}
+
+	rejected := &googleapi.Error{Code: 400, Message: "any wording", Errors: []googleapi.ErrorItem{{Reason: "invalid"}}}
+	if !isGCSChecksumError(errors.Wrap(rejected, "chunks/0001.lsb")) {
+		t.Errorf("TestGCSChecksumErrors() isGCSChecksumError() %v", rejected)
+	}
+	for _, err := range []error{nil, &googleapi.Error{Code: 400, Message: "CRC32C"}, &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "invalid"}}}, fmt.Errorf("storage: bad CRC on read")} {
+		if isGCSChecksumError(err) {
+			t.Errorf("TestGCSChecksumErrors() isGCSChecksumError(%v) %v", err, true)
+		}
+	}
+}
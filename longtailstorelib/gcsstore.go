@@ -1,20 +1,32 @@
 package longtailstorelib
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/pkg/errors"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 type gcsBlobStore struct {
 	bucketName string
 	prefix     string
+	options    StoreOptions
+	pacer      *requestPacer
+	region     regionCheck
 }
 
 type gcsBlobClient struct {
@@ -36,28 +48,137 @@ const (
 	// If the meta generation changes between our lock and write/close we get a gcs error with code 412
 	writeConditionFailed = 412
 	rateLimitExceeded    = 429
+	serviceUnavailable   = 503
 )
 
 // NewGCSBlobStore ...
-func NewGCSBlobStore(u *url.URL) (BlobStore, error) {
+func NewGCSBlobStore(u *url.URL, opts ...StoreOption) (BlobStore, error) {
 	if u.Scheme != "gs" {
 		return nil, fmt.Errorf("invalid scheme '%s', expected 'gs'", u.Scheme)
 	}
-	prefix := u.Path
-	if len(u.Path) > 0 {
-		prefix = u.Path[1:] // strip initial slash
+	prefix, err := normalizeStorePrefix(u.Path)
+	if err != nil {
+		return nil, err
 	}
 
-	if prefix != "" {
-		prefix += "/"
+	options := newStoreOptions(opts)
+	s := &gcsBlobStore{bucketName: u.Host, prefix: prefix, options: options}
+	s.pacer = newRequestPacer(s.String(), options.MaxConcurrentRequests, options.MaxThrottleBackoff)
+	return s, nil
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// gcsDeleteConcurrency is the number of parallel deletes of a DeleteObjects call
+const gcsDeleteConcurrency = 16
+
+// isGCSChecksumError detects writes the GCS service refused because the content does not match the
+// CRC32C sent with it, GCS reports them as a 400 with the reason invalid. Reads are checked with
+// checkGCSChecksum.
+func isGCSChecksumError(err error) bool {
+	e, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok || e.Code != 400 {
+		return false
+	}
+	for _, item := range e.Errors {
+		if item.Reason == "invalid" {
+			return true
+		}
 	}
+	return false
+}
 
-	s := &gcsBlobStore{bucketName: u.Host, prefix: prefix}
-	return s, nil
+// newGCSChecksumReader opens the object for reading along with its attributes. The reader is
+// pinned to the generation of the attributes so checkGCSChecksum compares the content with the
+// CRC32C of the same object.
+func newGCSChecksumReader(blobObject *gcsBlobObject) (*storage.Reader, *storage.ObjectAttrs, error) {
+	attrs, err := blobObject.objHandle.Attrs(blobObject.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := blobObject.objHandle.Generation(attrs.Generation).NewReader(blobObject.ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, attrs, nil
+}
+
+// checkGCSChecksum returns ErrChecksumMismatch if size bytes with the CRC32C checksum were read
+// and they do not match the object with attrs. Partial reads fail with the error of the read and
+// gzip encoded objects are checked by storage.Reader as GCS computes their CRC32C before
+// decompression.
+func checkGCSChecksum(path string, attrs *storage.ObjectAttrs, size int64, checksum uint32) error {
+	if size != attrs.Size || attrs.ContentEncoding == "gzip" || checksum == attrs.CRC32C {
+		return nil
+	}
+	return errors.Wrapf(ErrChecksumMismatch, "%s: CRC32C 0x%08x, the object has 0x%08x", path, checksum, attrs.CRC32C)
+}
+
+// isGCSRetentionError detects writes and deletes refused by a bucket retention policy or an object hold
+func isGCSRetentionError(err error) bool {
+	if e, ok := errors.Cause(err).(*googleapi.Error); ok {
+		message := strings.ToLower(e.Message)
+		return e.Code == 403 && (strings.Contains(message, "retention") || strings.Contains(message, "hold"))
+	}
+	return false
+}
+
+func isGCSThrottleError(err error) bool {
+	if e, ok := errors.Cause(err).(*googleapi.Error); ok {
+		if e.Code == rateLimitExceeded || e.Code == serviceUnavailable {
+			return true
+		}
+		for _, item := range e.Errors {
+			if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (blobStore *gcsBlobStore) newStorageClient(ctx context.Context) (*storage.Client, error) {
+	if blobStore.options.Transport.IsDefault() {
+		if blobStore.options.Anonymous {
+			return storage.NewClient(ctx, option.WithoutAuthentication())
+		}
+		return storage.NewClient(ctx)
+	}
+	base, err := NewHTTPTransport(blobStore.options.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if blobStore.options.Anonymous {
+		return storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: base}))
+	}
+	// Wrap our transport with the default credentials, option.WithHTTPClient alone would skip authentication
+	transport, err := htransport.NewTransport(ctx, base, option.WithScopes(storage.ScopeFullControl))
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewClient(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
+}
+
+// serverTime returns the Date reported by the GCS endpoint, used to detect clock skew
+func (blobStore *gcsBlobStore) serverTime(ctx context.Context) (time.Time, error) {
+	transport, err := NewHTTPTransport(blobStore.options.Transport)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req, err := http.NewRequest(http.MethodHead, "https://storage.googleapis.com/", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req.WithContext(ctx))
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	return http.ParseTime(resp.Header.Get("Date"))
 }
 
 func (blobStore *gcsBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
-	client, err := storage.NewClient(ctx)
+	client, err := blobStore.newStorageClient(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, blobStore.bucketName)
 	}
@@ -66,10 +187,36 @@ func (blobStore *gcsBlobStore) NewClient(ctx context.Context) (BlobClient, error
 	return &gcsBlobClient{client: client, ctx: ctx, store: blobStore, bucket: bucket}, nil
 }
 
+func (blobStore *gcsBlobStore) storeOptions() StoreOptions {
+	return blobStore.options
+}
+
 func (blobStore *gcsBlobStore) String() string {
 	return "gs://" + blobStore.bucketName + "/" + blobStore.prefix
 }
 
+// Region returns the location of the bucket, such as US-EAST1 or EU
+func (blobStore *gcsBlobStore) Region(ctx context.Context) (string, error) {
+	client, err := blobStore.newStorageClient(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, blobStore.bucketName)
+	}
+	defer client.Close()
+	blobStore.pacer.begin()
+	attrs, err := client.Bucket(blobStore.bucketName).Attrs(ctx)
+	blobStore.pacer.end(isGCSThrottleError(err))
+	if err != nil {
+		return "", errors.Wrap(err, blobStore.bucketName)
+	}
+	return attrs.Location, nil
+}
+
+// checkRegion refuses writes to a bucket outside the allowed regions, see WithAllowedRegions
+func (blobObject *gcsBlobObject) checkRegion() error {
+	store := blobObject.client.store
+	return store.region.check(blobObject.ctx, store.String(), store, store.options.AllowedRegions)
+}
+
 func (blobClient *gcsBlobClient) NewObject(path string) (BlobObject, error) {
 	gcsPath := blobClient.store.prefix + path
 	objHandle := blobClient.bucket.Object(gcsPath)
@@ -88,20 +235,88 @@ func (blobClient *gcsBlobClient) GetObjects() ([]BlobProperties, error) {
 		Prefix: blobClient.store.prefix,
 	})
 
+	// The listing is paged by the iterator, hold a single request slot for the whole listing
+	blobClient.store.pacer.begin()
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
+			blobClient.store.pacer.end(isGCSThrottleError(err))
 			return nil, err
 		}
 		itemName := attrs.Name[len(blobClient.store.prefix):]
 		items = append(items, BlobProperties{Size: attrs.Size, Name: itemName})
 	}
+	blobClient.store.pacer.end(false)
 	return items, nil
 }
 
+func (blobClient *gcsBlobClient) ListObjects(prefix string) BlobIterator {
+	return newPagedBlobIterator(blobClient, prefix)
+}
+
+// DeleteObjects deletes the objects with parallel requests, the client library does not expose the
+// batch endpoint of the JSON API
+func (blobClient *gcsBlobClient) DeleteObjects(paths []string) []error {
+	errs := make([]error, len(paths))
+	store := blobClient.store
+	if store.options.Immutable {
+		for i, path := range paths {
+			errs[i] = errors.Wrap(ErrImmutable, store.prefix+path)
+		}
+		return errs
+	}
+	err := store.region.check(blobClient.ctx, store.String(), store, store.options.AllowedRegions)
+	if err != nil {
+		for i := range paths {
+			errs[i] = err
+		}
+		return errs
+	}
+	slots := make(chan struct{}, gcsDeleteConcurrency)
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, gcsPath string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			store.pacer.begin()
+			err := blobClient.bucket.Object(gcsPath).Delete(blobClient.ctx)
+			store.pacer.end(isGCSThrottleError(err))
+			if err == storage.ErrObjectNotExist {
+				err = nil
+			}
+			if isGCSRetentionError(err) {
+				err = errors.Wrapf(ErrImmutable, "%s: %v", gcsPath, err)
+			}
+			errs[i] = err
+		}(i, store.prefix+path)
+	}
+	wg.Wait()
+	return errs
+}
+
+func (blobClient *gcsBlobClient) GetObjectsPage(prefix string, pageToken string, pageSize int) ([]BlobProperties, string, error) {
+	it := blobClient.bucket.Objects(blobClient.ctx, &storage.Query{
+		Prefix: blobClient.store.prefix + prefix,
+	})
+	var attrs []*storage.ObjectAttrs
+	blobClient.store.pacer.begin()
+	nextPageToken, err := iterator.NewPager(it, pageSize, pageToken).NextPage(&attrs)
+	blobClient.store.pacer.end(isGCSThrottleError(err))
+	if err != nil {
+		return nil, "", err
+	}
+	items := make([]BlobProperties, len(attrs))
+	for i, a := range attrs {
+		items[i] = BlobProperties{Size: a.Size, Name: a.Name[len(blobClient.store.prefix):]}
+	}
+	return items, nextPageToken, nil
+}
+
 func (blobClient *gcsBlobClient) Close() {
 	blobClient.client.Close()
 }
@@ -111,12 +326,20 @@ func (blobClient *gcsBlobClient) String() string {
 }
 
 func (blobObject *gcsBlobObject) Read() ([]byte, error) {
-	reader, err := blobObject.objHandle.NewReader(blobObject.ctx)
+	pacer := blobObject.client.store.pacer
+	pacer.begin()
+	reader, attrs, err := newGCSChecksumReader(blobObject)
 	if err != nil {
+		pacer.end(isGCSThrottleError(err))
 		return nil, errors.Wrap(err, blobObject.path)
 	}
 	data, err := ioutil.ReadAll(reader)
 	err2 := reader.Close()
+	pacer.end(isGCSThrottleError(err))
+	// storage.Reader may have failed the read on its own check, the content decides either way
+	if checksumErr := checkGCSChecksum(blobObject.path, attrs, int64(len(data)), crc32.Checksum(data, crc32cTable)); checksumErr != nil {
+		return nil, checksumErr
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, blobObject.path)
 	} else if err2 != nil {
@@ -125,8 +348,80 @@ func (blobObject *gcsBlobObject) Read() ([]byte, error) {
 	return data, nil
 }
 
+func (blobObject *gcsBlobObject) ReadInto(buffer []byte) ([]byte, error) {
+	pacer := blobObject.client.store.pacer
+	pacer.begin()
+	reader, attrs, err := newGCSChecksumReader(blobObject)
+	if err != nil {
+		pacer.end(isGCSThrottleError(err))
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	data := bytes.NewBuffer(buffer)
+	data.Grow(int(reader.Attrs.Size))
+	size, err := data.ReadFrom(reader)
+	err2 := reader.Close()
+	pacer.end(isGCSThrottleError(err))
+	content := data.Bytes()[int64(data.Len())-size:]
+	if checksumErr := checkGCSChecksum(blobObject.path, attrs, size, crc32.Checksum(content, crc32cTable)); checksumErr != nil {
+		return nil, checksumErr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	} else if err2 != nil {
+		return nil, err2
+	}
+	return data.Bytes(), nil
+}
+
+func (blobObject *gcsBlobObject) WriteTo(w io.Writer) (int64, error) {
+	pacer := blobObject.client.store.pacer
+	pacer.begin()
+	reader, attrs, err := newGCSChecksumReader(blobObject)
+	if err != nil {
+		pacer.end(isGCSThrottleError(err))
+		return 0, errors.Wrap(err, blobObject.path)
+	}
+	checksum := crc32.New(crc32cTable)
+	size, err := io.Copy(io.MultiWriter(w, checksum), reader)
+	err2 := reader.Close()
+	pacer.end(isGCSThrottleError(err))
+	if checksumErr := checkGCSChecksum(blobObject.path, attrs, size, checksum.Sum32()); checksumErr != nil {
+		return 0, checksumErr
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, blobObject.path)
+	} else if err2 != nil {
+		return 0, err2
+	}
+	return size, nil
+}
+
+func (blobObject *gcsBlobObject) ReadRange(offset int64, length int64) ([]byte, error) {
+	pacer := blobObject.client.store.pacer
+	pacer.begin()
+	reader, err := blobObject.objHandle.NewRangeReader(blobObject.ctx, offset, length)
+	if err != nil {
+		pacer.end(isGCSThrottleError(err))
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	data, err := ioutil.ReadAll(reader)
+	err2 := reader.Close()
+	pacer.end(isGCSThrottleError(err))
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	} else if err2 != nil {
+		return nil, err2
+	}
+	if int64(len(data)) != length {
+		return nil, fmt.Errorf("%s: read %d bytes at %d, expected %d", blobObject.path, len(data), offset, length)
+	}
+	return data, nil
+}
+
 func (blobObject *gcsBlobObject) LockWriteVersion() (bool, error) {
+	blobObject.client.store.pacer.begin()
 	objAttrs, err := blobObject.objHandle.Attrs(blobObject.ctx)
+	blobObject.client.store.pacer.end(isGCSThrottleError(err))
 	if err == storage.ErrObjectNotExist {
 		blobObject.writeCondition = &storage.Conditions{DoesNotExist: true}
 		return false, nil
@@ -138,8 +433,30 @@ func (blobObject *gcsBlobObject) LockWriteVersion() (bool, error) {
 	return true, nil
 }
 
+func (blobObject *gcsBlobObject) Generation() (int64, error) {
+	blobObject.client.store.pacer.begin()
+	objAttrs, err := blobObject.objHandle.Attrs(blobObject.ctx)
+	blobObject.client.store.pacer.end(isGCSThrottleError(err))
+	if err != nil {
+		return 0, err
+	}
+	return objAttrs.Generation, nil
+}
+
+func (blobObject *gcsBlobObject) Metadata() (map[string]string, error) {
+	blobObject.client.store.pacer.begin()
+	objAttrs, err := blobObject.objHandle.Attrs(blobObject.ctx)
+	blobObject.client.store.pacer.end(isGCSThrottleError(err))
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	return objAttrs.Metadata, nil
+}
+
 func (blobObject *gcsBlobObject) Exists() (bool, error) {
+	blobObject.client.store.pacer.begin()
 	_, err := blobObject.objHandle.Attrs(blobObject.ctx)
+	blobObject.client.store.pacer.end(isGCSThrottleError(err))
 	if err == storage.ErrObjectNotExist {
 		return false, nil
 	}
@@ -150,46 +467,142 @@ func (blobObject *gcsBlobObject) Exists() (bool, error) {
 }
 
 func (blobObject *gcsBlobObject) Write(data []byte) (bool, error) {
+	ok, _, err := blobObject.write(data, false)
+	return ok, err
+}
+
+// WriteIfAbsent writes the object with the ifGenerationMatch=0 precondition, GCS refuses the write
+// if the object exists
+func (blobObject *gcsBlobObject) WriteIfAbsent(data []byte) (bool, bool, error) {
+	return blobObject.write(data, true)
+}
+
+// write writes the object, if ifAbsent is set an existing object is left as it is and reported
+// as existing instead of replaced
+func (blobObject *gcsBlobObject) write(data []byte, ifAbsent bool) (bool, bool, error) {
+	if err := blobObject.checkRegion(); err != nil {
+		return false, false, err
+	}
+	pacer := blobObject.client.store.pacer
+	// In immutable mode an unlocked write may only create the object
+	writeOnce := blobObject.client.store.options.Immutable && blobObject.writeCondition == nil
+	pacer.begin()
 	var writer *storage.Writer
-	if blobObject.writeCondition == nil {
+	if writeOnce || ifAbsent {
+		writer = blobObject.objHandle.If(storage.Conditions{DoesNotExist: true}).NewWriter(blobObject.ctx)
+	} else if blobObject.writeCondition == nil {
 		writer = blobObject.objHandle.NewWriter(blobObject.ctx)
 	} else {
 		writer = blobObject.objHandle.If(*blobObject.writeCondition).NewWriter(blobObject.ctx)
 	}
+	writer.CRC32C = crc32.Checksum(data, crc32cTable)
+	writer.SendCRC32C = true
+	writer.Metadata = identityMetadata(blobObject.client.store.options)
+	if strings.HasPrefix(blobObject.path, blobObject.client.store.prefix+"chunks/") {
+		writer.CacheControl = blobObject.client.store.options.BlockCacheControl
+	}
 
 	_, err := writer.Write(data)
 	err2 := writer.Close()
+	pacer.end(isGCSThrottleError(err) || isGCSThrottleError(err2))
 	if err != nil {
-		return false, errors.Wrap(err, blobObject.path)
+		return false, false, errors.Wrap(err, blobObject.path)
+	}
+	if isGCSChecksumError(err2) {
+		return false, false, errors.Wrapf(ErrChecksumMismatch, "%s: %v", blobObject.path, err2)
+	}
+	if isGCSRetentionError(err2) {
+		return false, false, errors.Wrapf(ErrImmutable, "%s: %v", blobObject.path, err2)
 	}
 	if e, ok := err2.(*googleapi.Error); ok {
+		if ifAbsent && e.Code == writeConditionFailed {
+			return true, true, nil
+		}
+		if writeOnce && e.Code == writeConditionFailed {
+			ok, err := verifyImmutableObject(blobObject, blobObject.path, data)
+			return ok, false, err
+		}
 		if e.Code == writeConditionFailed || e.Code == rateLimitExceeded {
-			return false, nil
+			return false, false, nil
 		}
-		return false, err2
+		return false, false, err2
 	} else if err2 != nil {
-		return false, err2
+		return false, false, err2
 	}
 
+	pacer.begin()
 	_, err = blobObject.objHandle.Update(blobObject.ctx, storage.ObjectAttrsToUpdate{ContentType: "application/octet-stream"})
+	pacer.end(isGCSThrottleError(err))
 	if err != nil {
-		return true, err
+		return true, false, err
 	}
-	return true, nil
+	return true, false, nil
 }
 
 func (blobObject *gcsBlobObject) Delete() error {
+	if blobObject.client.store.options.Immutable {
+		return errors.Wrap(ErrImmutable, blobObject.path)
+	}
+	if err := blobObject.checkRegion(); err != nil {
+		return err
+	}
+	pacer := blobObject.client.store.pacer
+	pacer.begin()
 	_, err := blobObject.objHandle.Attrs(blobObject.ctx)
+	pacer.end(isGCSThrottleError(err))
 	if err == storage.ErrObjectNotExist {
 		return nil
 	}
 	if err != nil {
 		return err
 	}
+	pacer.begin()
 	if blobObject.writeCondition == nil {
 		err = blobObject.objHandle.Delete(blobObject.ctx)
 	} else {
 		err = blobObject.objHandle.If(*blobObject.writeCondition).Delete(blobObject.ctx)
 	}
+	pacer.end(isGCSThrottleError(err))
+	if isGCSRetentionError(err) {
+		return errors.Wrapf(ErrImmutable, "%s: %v", blobObject.path, err)
+	}
 	return err
 }
+
+// Archive rewrites the object in place with storageClass, ARCHIVE if empty. The rewrite replaces
+// the attributes of the object so its metadata and cache control are copied over.
+func (blobObject *gcsBlobObject) Archive(storageClass string) error {
+	if storageClass == "" {
+		storageClass = "ARCHIVE"
+	}
+	pacer := blobObject.client.store.pacer
+	pacer.begin()
+	attrs, err := blobObject.objHandle.Attrs(blobObject.ctx)
+	if err != nil {
+		pacer.end(isGCSThrottleError(err))
+		return errors.Wrap(err, blobObject.path)
+	}
+	copier := blobObject.objHandle.CopierFrom(blobObject.objHandle)
+	copier.StorageClass = storageClass
+	copier.ContentType = attrs.ContentType
+	if copier.ContentType == "" {
+		copier.ContentType = "application/octet-stream"
+	}
+	copier.Metadata = attrs.Metadata
+	copier.CacheControl = attrs.CacheControl
+	copier.ContentEncoding = attrs.ContentEncoding
+	_, err = copier.Run(blobObject.ctx)
+	pacer.end(isGCSThrottleError(err))
+	if isGCSRetentionError(err) {
+		return errors.Wrapf(ErrImmutable, "%s: %v", blobObject.path, err)
+	}
+	if err != nil {
+		return errors.Wrap(err, blobObject.path)
+	}
+	return nil
+}
+
+// Restore returns true directly, objects in the GCS cold storage classes can be read without a restore
+func (blobObject *gcsBlobObject) Restore() (bool, error) {
+	return true, nil
+}
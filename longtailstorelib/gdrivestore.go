@@ -0,0 +1,386 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// gdriveBlobStore keeps the objects of a store as files in a Google Drive folder. The URI
+// gdrive://<folder-id>/store uses the folder with the id from the address of the folder in Drive,
+// or the root of My Drive for gdrive://root/store. Drive has no real paths so each object is a file
+// in the folder named by its path, such as store/chunks/0000/0000a1b2c3d4e5f6.lsb.
+//
+// Access is granted with the OAuth device flow the first time the store is used, see
+// WithOAuthClient. Conditional writes are checked with the version of the file before writing, so
+// only one process at a time may update the store index.
+type gdriveBlobStore struct {
+	folderID  string
+	prefix    string
+	options   StoreOptions
+	apiURL    string
+	uploadURL string
+
+	lock       sync.Mutex
+	httpClient *http.Client
+	fileIDs    map[string]string
+}
+
+type gdriveBlobClient struct {
+	ctx        context.Context
+	store      *gdriveBlobStore
+	httpClient *http.Client
+}
+
+type gdriveBlobObject struct {
+	client        *gdriveBlobClient
+	path          string
+	lockedVersion *string
+}
+
+// gdriveFile is the metadata of a Drive file, Drive reports int64 values as strings
+type gdriveFile struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Size    string `json:"size"`
+	Version string `json:"version"`
+}
+
+// NewGDriveBlobStore ...
+func NewGDriveBlobStore(u *url.URL, opts ...StoreOption) (BlobStore, error) {
+	if u.Scheme != "gdrive" {
+		return nil, fmt.Errorf("invalid scheme '%s', expected 'gdrive'", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing Drive folder id in '%s'", u)
+	}
+	prefix, err := normalizeStorePrefix(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	s := &gdriveBlobStore{
+		folderID:  u.Host,
+		prefix:    prefix,
+		options:   newStoreOptions(opts),
+		apiURL:    "https://www.googleapis.com/drive/v3/",
+		uploadURL: "https://www.googleapis.com/upload/drive/v3/",
+		fileIDs:   map[string]string{}}
+	return s, nil
+}
+
+func (blobStore *gdriveBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	blobStore.lock.Lock()
+	defer blobStore.lock.Unlock()
+	if blobStore.httpClient == nil {
+		httpClient, err := newOAuthHTTPClient(ctx, googleDriveOAuth, blobStore.options)
+		if err != nil {
+			return nil, errors.Wrap(err, blobStore.String())
+		}
+		blobStore.httpClient = httpClient
+	}
+	return &gdriveBlobClient{ctx: ctx, store: blobStore, httpClient: blobStore.httpClient}, nil
+}
+
+func (blobStore *gdriveBlobStore) storeOptions() StoreOptions {
+	return blobStore.options
+}
+
+func (blobStore *gdriveBlobStore) String() string {
+	return "gdrive://" + blobStore.folderID + "/" + blobStore.prefix
+}
+
+// do sends req and returns the response body, a missing file is reported as a nil body and no error
+func (blobClient *gdriveBlobClient) do(req *http.Request) ([]byte, error) {
+	resp, err := blobClient.httpClient.Do(req.WithContext(blobClient.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiError := struct {
+			Error struct{ Message string }
+		}{}
+		if json.Unmarshal(data, &apiError) != nil || apiError.Error.Message == "" {
+			apiError.Error.Message = resp.Status
+		}
+		return nil, fmt.Errorf("gdrive %s: %s", req.Method, apiError.Error.Message)
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+// escapeQuery quotes value for a Drive search query
+func escapeQuery(value string) string {
+	return "'" + strings.Replace(strings.Replace(value, `\`, `\\`, -1), `'`, `\'`, -1) + "'"
+}
+
+// find returns the file with name in the folder of the store, nil if there is none
+func (blobClient *gdriveBlobClient) find(name string) (*gdriveFile, error) {
+	store := blobClient.store
+	query := url.Values{
+		"q":                         {"name = " + escapeQuery(name) + " and " + escapeQuery(store.folderID) + " in parents and trashed = false"},
+		"fields":                    {"files(id,name,size,version)"},
+		"supportsAllDrives":         {"true"},
+		"includeItemsFromAllDrives": {"true"}}
+	req, err := http.NewRequest(http.MethodGet, store.apiURL+"files?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := blobClient.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, name)
+	}
+	list := struct{ Files []gdriveFile }{}
+	if data != nil {
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if len(list.Files) == 0 {
+		delete(store.fileIDs, name)
+		return nil, nil
+	}
+	store.fileIDs[name] = list.Files[0].ID
+	return &list.Files[0], nil
+}
+
+// fileID returns the id of the file with name, nil if there is none
+func (blobClient *gdriveBlobClient) fileID(name string) (string, error) {
+	store := blobClient.store
+	store.lock.Lock()
+	id, ok := store.fileIDs[name]
+	store.lock.Unlock()
+	if ok {
+		return id, nil
+	}
+	file, err := blobClient.find(name)
+	if err != nil || file == nil {
+		return "", err
+	}
+	return file.ID, nil
+}
+
+func (blobClient *gdriveBlobClient) NewObject(path string) (BlobObject, error) {
+	return &gdriveBlobObject{client: blobClient, path: blobClient.store.prefix + path}, nil
+}
+
+func (blobClient *gdriveBlobClient) GetObjects() ([]BlobProperties, error) {
+	store := blobClient.store
+	objects := []BlobProperties{}
+	pageToken := ""
+	for {
+		query := url.Values{
+			"q":                         {escapeQuery(store.folderID) + " in parents and trashed = false"},
+			"fields":                    {"nextPageToken,files(id,name,size)"},
+			"pageSize":                  {"1000"},
+			"supportsAllDrives":         {"true"},
+			"includeItemsFromAllDrives": {"true"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest(http.MethodGet, store.apiURL+"files?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		data, err := blobClient.do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, store.String())
+		}
+		list := struct {
+			NextPageToken string
+			Files         []gdriveFile
+		}{}
+		if data != nil {
+			err = json.Unmarshal(data, &list)
+			if err != nil {
+				return nil, errors.Wrap(err, store.String())
+			}
+		}
+		for _, file := range list.Files {
+			if !strings.HasPrefix(file.Name, store.prefix) {
+				continue
+			}
+			size, _ := strconv.ParseInt(file.Size, 10, 64)
+			objects = append(objects, BlobProperties{Size: size, Name: file.Name[len(store.prefix):]})
+		}
+		if list.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+func (blobClient *gdriveBlobClient) ListObjects(prefix string) BlobIterator {
+	return newListingBlobIterator(blobClient.GetObjects, prefix)
+}
+
+func (blobClient *gdriveBlobClient) Close() {
+}
+
+func (blobClient *gdriveBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+func (blobObject *gdriveBlobObject) Exists() (bool, error) {
+	file, err := blobObject.client.find(blobObject.path)
+	return file != nil, err
+}
+
+func (blobObject *gdriveBlobObject) Read() ([]byte, error) {
+	client := blobObject.client
+	id, err := client.fileID(blobObject.path)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("gdrive object does not exist: %s", blobObject.path)
+	}
+	req, err := http.NewRequest(http.MethodGet, client.store.apiURL+"files/"+url.PathEscape(id)+"?alt=media&supportsAllDrives=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	if data == nil {
+		return nil, fmt.Errorf("gdrive object does not exist: %s", blobObject.path)
+	}
+	return data, nil
+}
+
+func (blobObject *gdriveBlobObject) LockWriteVersion() (bool, error) {
+	file, err := blobObject.client.find(blobObject.path)
+	if err != nil {
+		return false, err
+	}
+	version := ""
+	if file != nil {
+		version = file.Version
+	}
+	blobObject.lockedVersion = &version
+	return file != nil, nil
+}
+
+func (blobObject *gdriveBlobObject) Write(data []byte) (bool, error) {
+	client := blobObject.client
+	store := client.store
+	file, err := client.find(blobObject.path)
+	if err != nil {
+		return false, err
+	}
+	if blobObject.lockedVersion != nil {
+		version := ""
+		if file != nil {
+			version = file.Version
+		}
+		if version != *blobObject.lockedVersion {
+			return false, nil
+		}
+	} else if file != nil && store.options.Immutable {
+		return verifyImmutableObject(blobObject, blobObject.path, data)
+	}
+
+	var req *http.Request
+	if file != nil {
+		req, err = http.NewRequest(http.MethodPatch, store.uploadURL+"files/"+url.PathEscape(file.ID)+"?uploadType=media&supportsAllDrives=true", bytes.NewReader(data))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+	} else {
+		metadata, _ := json.Marshal(map[string]interface{}{"name": blobObject.path, "parents": []string{store.folderID}})
+		body, contentType, err := multipartRelated(metadata, data)
+		if err != nil {
+			return false, err
+		}
+		req, err = http.NewRequest(http.MethodPost, store.uploadURL+"files?uploadType=multipart&fields=id&supportsAllDrives=true", body)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	result, err := client.do(req)
+	if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+	if result == nil {
+		return false, fmt.Errorf("gdrive folder does not exist: %s", store.folderID)
+	}
+	created := gdriveFile{}
+	if json.Unmarshal(result, &created) == nil && created.ID != "" {
+		store.lock.Lock()
+		store.fileIDs[blobObject.path] = created.ID
+		store.lock.Unlock()
+	}
+	return true, nil
+}
+
+func (blobObject *gdriveBlobObject) Delete() error {
+	client := blobObject.client
+	store := client.store
+	if store.options.Immutable {
+		return errors.Wrap(ErrImmutable, blobObject.path)
+	}
+	id, err := client.fileID(blobObject.path)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("gdrive object does not exist: %s", blobObject.path)
+	}
+	req, err := http.NewRequest(http.MethodDelete, store.apiURL+"files/"+url.PathEscape(id)+"?supportsAllDrives=true", nil)
+	if err != nil {
+		return err
+	}
+	_, err = client.do(req)
+	store.lock.Lock()
+	delete(store.fileIDs, blobObject.path)
+	store.lock.Unlock()
+	return errors.Wrap(err, blobObject.path)
+}
+
+// multipartRelated builds the body of a Drive multipart upload, the JSON metadata followed by the content
+func multipartRelated(metadata []byte, data []byte) (io.Reader, string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(metadata)
+	part, err = writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/octet-stream"}})
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(data)
+	err = writer.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return body, "multipart/related; boundary=" + writer.Boundary(), nil
+}
@@ -0,0 +1,172 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeDriveFile struct {
+	name    string
+	parent  string
+	data    []byte
+	version int
+}
+
+// fakeDrive implements the parts of the Drive v3 API used by the gdrive:// blob store
+type fakeDrive struct {
+	lock   sync.Mutex
+	files  map[string]*fakeDriveFile
+	nextID int
+}
+
+var driveNameQuery = regexp.MustCompile(`name = '((?:[^'\\]|\\.)*)'`)
+var driveParentQuery = regexp.MustCompile(`'([^']*)' in parents`)
+
+func (drive *fakeDrive) serve(w http.ResponseWriter, r *http.Request) {
+	drive.lock.Lock()
+	defer drive.lock.Unlock()
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodGet && path == "/drive/v3/files":
+		q := r.URL.Query().Get("q")
+		parent := driveParentQuery.FindStringSubmatch(q)[1]
+		name := ""
+		if m := driveNameQuery.FindStringSubmatch(q); m != nil {
+			name = strings.Replace(strings.Replace(m[1], `\'`, `'`, -1), `\\`, `\`, -1)
+		}
+		files := []map[string]string{}
+		for id, file := range drive.files {
+			if file.parent == parent && (name == "" || file.name == name) {
+				files = append(files, map[string]string{"id": id, "name": file.name, "size": strconv.Itoa(len(file.data)), "version": strconv.Itoa(file.version)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": files})
+	case r.Method == http.MethodPost && path == "/upload/drive/v3/files":
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		part, _ := reader.NextPart()
+		metadata := struct {
+			Name    string
+			Parents []string
+		}{}
+		json.NewDecoder(part).Decode(&metadata)
+		part, _ = reader.NextPart()
+		data, _ := ioutil.ReadAll(part)
+		drive.nextID++
+		id := fmt.Sprintf("file%d", drive.nextID)
+		drive.files[id] = &fakeDriveFile{name: metadata.Name, parent: metadata.Parents[0], data: data, version: 1}
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+	case strings.HasPrefix(path, "/upload/drive/v3/files/") && r.Method == http.MethodPatch:
+		file, ok := drive.files[strings.TrimPrefix(path, "/upload/drive/v3/files/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		file.data, _ = ioutil.ReadAll(r.Body)
+		file.version++
+		w.Write([]byte("{}"))
+	case strings.HasPrefix(path, "/drive/v3/files/"):
+		id := strings.TrimPrefix(path, "/drive/v3/files/")
+		file, ok := drive.files[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.Write(file.data)
+		case http.MethodDelete:
+			delete(drive.files, id)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func newTestGDriveBlobStore(t *testing.T, serverURL string, opts ...StoreOption) BlobStore {
+	u, _ := url.Parse("gdrive://folder-1/store")
+	blobStore, err := NewGDriveBlobStore(u, opts...)
+	if err != nil {
+		t.Fatalf("NewGDriveBlobStore() %v != %v", err, nil)
+	}
+	s := blobStore.(*gdriveBlobStore)
+	s.apiURL = serverURL + "/drive/v3/"
+	s.uploadURL = serverURL + "/upload/drive/v3/"
+	s.httpClient = newTestOAuthHTTPClient()
+	return blobStore
+}
+
+func TestGDriveBlobStore(t *testing.T) {
+	drive := &fakeDrive{files: map[string]*fakeDriveFile{}}
+	server := httptest.NewServer(http.HandlerFunc(drive.serve))
+	defer server.Close()
+
+	blobStore := newTestGDriveBlobStore(t, server.URL)
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject("chunks/0000/it's.lsb")
+	if exists, err := object.Exists(); exists || err != nil {
+		t.Errorf("TestGDriveBlobStore() Exists() %t, %v", exists, err)
+	}
+	if ok, err := object.Write([]byte("block")); !ok || err != nil {
+		t.Fatalf("TestGDriveBlobStore() Write() %t, %v", ok, err)
+	}
+	if ok, err := object.Write([]byte("block v2")); !ok || err != nil || len(drive.files) != 1 {
+		t.Fatalf("TestGDriveBlobStore() Write() again %t, %v, %d files", ok, err, len(drive.files))
+	}
+	data, err := object.Read()
+	if err != nil || string(data) != "block v2" {
+		t.Errorf("TestGDriveBlobStore() Read() `%s`, %v", data, err)
+	}
+	if drive.files["file1"].name != "store/chunks/0000/it's.lsb" || drive.files["file1"].parent != "folder-1" {
+		t.Errorf("TestGDriveBlobStore() file %+v", drive.files["file1"])
+	}
+
+	indexObject, _ := client.NewObject("store.lsi")
+	if exists, err := indexObject.LockWriteVersion(); exists || err != nil {
+		t.Errorf("TestGDriveBlobStore() LockWriteVersion() %t, %v", exists, err)
+	}
+	otherObject, _ := client.NewObject("store.lsi")
+	otherObject.LockWriteVersion()
+	if ok, err := indexObject.Write([]byte("index")); !ok || err != nil {
+		t.Errorf("TestGDriveBlobStore() Write() locked %t, %v", ok, err)
+	}
+	if ok, err := otherObject.Write([]byte("other index")); ok || err != nil {
+		t.Errorf("TestGDriveBlobStore() Write() conflict %t, %v", ok, err)
+	}
+
+	objects, err := client.GetObjects()
+	if err != nil || len(objects) != 2 {
+		t.Errorf("TestGDriveBlobStore() GetObjects() %v, %v", objects, err)
+	}
+	if err := object.Delete(); err != nil {
+		t.Errorf("TestGDriveBlobStore() Delete() %v", err)
+	}
+	if exists, err := object.Exists(); exists || err != nil || len(drive.files) != 1 {
+		t.Errorf("TestGDriveBlobStore() Exists() after Delete() %t, %v", exists, err)
+	}
+
+	immutableClient, _ := newTestGDriveBlobStore(t, server.URL, WithImmutable()).NewClient(context.Background())
+	defer immutableClient.Close()
+	immutableObject, _ := immutableClient.NewObject("store.lsi")
+	if _, err := immutableObject.Write([]byte("changed index")); !IsImmutable(err) {
+		t.Errorf("TestGDriveBlobStore() Write() immutable %v", err)
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/DanEngelbrecht/golongtail/longtaillib v0.0.0-00010101000000-000000000000
 	github.com/pkg/errors v0.9.1
 	golang.org/x/net v0.0.0-20200501053045-e0ff5e5a1de5
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	google.golang.org/api v0.22.0
 )
 
@@ -0,0 +1,125 @@
+package longtailstorelib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer fires once a worker of the remote block store has had no requests for the idle timeout
+// of WithIdleHibernation. The worker then hibernates, it releases its blob client until the next
+// request, and the last block worker to hibernate releases the prefetched blocks. A worker only uses
+// its own idleTimer so it needs no locking.
+type idleTimer struct {
+	timeout     time.Duration
+	timer       *time.Timer
+	hibernating bool
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.NewTimer(timeout)
+	}
+	return t
+}
+
+// C fires when the worker has been idle for the timeout, it is nil if hibernation is disabled or
+// the worker already hibernates
+func (t *idleTimer) C() <-chan time.Time {
+	if t.timer == nil || t.hibernating {
+		return nil
+	}
+	return t.timer.C
+}
+
+// hibernate is called when C has fired
+func (t *idleTimer) hibernate() {
+	t.hibernating = true
+}
+
+// active restarts the timer when the worker handles a request, it returns true if the worker was
+// hibernating and has to set itself up again
+func (t *idleTimer) active() bool {
+	if t.timer == nil {
+		return false
+	}
+	wasHibernating := t.hibernating
+	if !wasHibernating && !t.timer.Stop() {
+		<-t.timer.C
+	}
+	t.timer.Reset(t.timeout)
+	t.hibernating = false
+	return wasHibernating
+}
+
+func (t *idleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// HibernationStats is how often the workers of the remote block store have hibernated, see
+// WithIdleHibernation
+type HibernationStats struct {
+	// WorkerCount is the number of block and store index workers that hibernate when idle
+	WorkerCount int
+	// HibernatingCount is the number of workers that are hibernating now
+	HibernatingCount int64
+	// HibernationCount is the number of times a worker has hibernated
+	HibernationCount uint64
+	// StoreIndexReloadCount is the number of times the store index was read again after the store
+	// index worker had dropped it
+	StoreIndexReloadCount uint64
+}
+
+// HibernationStatsProvider is implemented by block stores that hibernate when idle
+type HibernationStatsProvider interface {
+	GetHibernationStats() HibernationStats
+}
+
+// hibernationCounter counts the hibernations of the workers of a remote block store
+type hibernationCounter struct {
+	hibernating  int64
+	hibernations uint64
+	indexReloads uint64
+	// blockWorkersHibernating is the number of hibernating block workers, the prefetched blocks
+	// they share are released when all of them hibernate
+	blockWorkersHibernating int64
+}
+
+func (c *hibernationCounter) hibernated() {
+	atomic.AddInt64(&c.hibernating, 1)
+	atomic.AddUint64(&c.hibernations, 1)
+}
+
+func (c *hibernationCounter) woke() {
+	atomic.AddInt64(&c.hibernating, -1)
+}
+
+// blockWorkerHibernated is called by a block worker that hibernates after hibernated, it returns the
+// number of hibernating block workers
+func (c *hibernationCounter) blockWorkerHibernated() int64 {
+	return atomic.AddInt64(&c.blockWorkersHibernating, 1)
+}
+
+func (c *hibernationCounter) blockWorkerWoke() {
+	atomic.AddInt64(&c.blockWorkersHibernating, -1)
+}
+
+// blockWorkerCount is the number of workers in the worker pools of the store
+func (s *remoteStore) blockWorkerCount() int {
+	workerCount := 0
+	for _, pool := range s.workerPools {
+		workerCount += pool.workerCount
+	}
+	return workerCount
+}
+
+// GetHibernationStats returns how often the workers of the store have hibernated
+func (s *remoteStore) GetHibernationStats() HibernationStats {
+	return HibernationStats{
+		WorkerCount:           1 + s.blockWorkerCount(),
+		HibernatingCount:      atomic.LoadInt64(&s.hibernation.hibernating),
+		HibernationCount:      atomic.LoadUint64(&s.hibernation.hibernations),
+		StoreIndexReloadCount: atomic.LoadUint64(&s.hibernation.indexReloads)}
+}
@@ -0,0 +1,153 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestIdleHibernation(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blobStore, _ := NewTestBlobStore("the_path")
+
+	store, err := NewRemoteBlockStore(jobs, blobStore, "", 2, ReadWrite, WithIdleHibernation(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestIdleHibernation() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(store)
+	defer storeAPI.Dispose()
+	if _, errno := storeBlockFromSeed(t, storeAPI, 0); errno != 0 {
+		t.Fatalf("TestIdleHibernation() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	if errno := flushRemoteStore(storeAPI); errno != 0 {
+		t.Fatalf("TestIdleHibernation() Flush() %d != %d", errno, 0)
+	}
+	existing, errno := getExistingContent(t, storeAPI, []uint64{1, 2, 3}, 0)
+	if errno != 0 || existing.GetBlockCount() != 1 {
+		t.Fatalf("TestIdleHibernation() getExistingContent() %d blocks, %d", existing.GetBlockCount(), errno)
+	}
+	existing.Dispose()
+
+	time.Sleep(300 * time.Millisecond)
+	stats := store.(HibernationStatsProvider).GetHibernationStats()
+	if stats.WorkerCount != 3 || stats.HibernatingCount != 3 || stats.StoreIndexReloadCount != 0 {
+		t.Errorf("TestIdleHibernation() GetHibernationStats() idle %+v", stats)
+	}
+	if prefetchMemory := atomic.LoadInt64(&store.(*remoteStore).prefetchMemory); prefetchMemory != 0 {
+		t.Errorf("TestIdleHibernation() prefetchMemory %d != %d", prefetchMemory, 0)
+	}
+
+	// Another client adds a block while the store hibernates, the store index is read again
+	otherStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite)
+	if err != nil {
+		t.Fatalf("TestIdleHibernation() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	otherStoreAPI := longtaillib.CreateBlockStoreAPI(otherStore)
+	storeBlockFromSeed(t, otherStoreAPI, 10)
+	otherStoreAPI.Dispose()
+
+	existing, errno = getExistingContent(t, storeAPI, []uint64{1, 2, 3, 11, 12, 13}, 0)
+	if errno != 0 || existing.GetBlockCount() != 2 {
+		t.Errorf("TestIdleHibernation() getExistingContent() after hibernation %d blocks, %d", existing.GetBlockCount(), errno)
+	}
+	existing.Dispose()
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, uint64(10)+21412151)
+	if errno != 0 {
+		t.Fatalf("TestIdleHibernation() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	validateBlockFromSeed(t, 10, storedBlock)
+	storedBlock.Dispose()
+	stats = store.(HibernationStatsProvider).GetHibernationStats()
+	if stats.StoreIndexReloadCount != 1 || stats.HibernationCount < 3 || stats.HibernatingCount == 3 {
+		t.Errorf("TestIdleHibernation() GetHibernationStats() after wake %+v", stats)
+	}
+
+	// Blocks put after a hibernation are added to the store index
+	time.Sleep(300 * time.Millisecond)
+	if _, errno := storeBlockFromSeed(t, storeAPI, 20); errno != 0 {
+		t.Fatalf("TestIdleHibernation() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	if errno := flushRemoteStore(storeAPI); errno != 0 {
+		t.Fatalf("TestIdleHibernation() Flush() %d != %d", errno, 0)
+	}
+	if indexed := getStoreIndexBlockHashes(t, blobStore); len(indexed) != 3 {
+		t.Errorf("TestIdleHibernation() store index has %d blocks, expected %d", len(indexed), 3)
+	}
+}
+
+func TestIdleUploadWorkerKeepsPrefetches(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blobStore, _ := NewTestBlobStore("the_path")
+
+	store, err := NewRemoteBlockStore(jobs, blobStore, "", 2, ReadWrite, WithWorkerPools(1, 1), WithIdleHibernation(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestIdleUploadWorkerKeepsPrefetches() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(store)
+	defer storeAPI.Dispose()
+	blockHashes := []uint64{}
+	for _, seed := range []uint8{0, 10, 20} {
+		blockHash, errno := storeBlockFromSeed(t, storeAPI, seed)
+		if errno != 0 {
+			t.Fatalf("TestIdleUploadWorkerKeepsPrefetches() storeBlockFromSeed() %d != %d", errno, 0)
+		}
+		blockHashes = append(blockHashes, blockHash)
+	}
+	if errno := flushRemoteStore(storeAPI); errno != 0 {
+		t.Fatalf("TestIdleUploadWorkerKeepsPrefetches() Flush() %d != %d", errno, 0)
+	}
+
+	store.PreflightGet(blockHashes[:2], longtaillib.Longtail_AsyncPreflightStartedAPI{})
+	s := store.(*remoteStore)
+	prefetchedCount := func() int {
+		s.fetchedBlocksSync.Lock()
+		defer s.fetchedBlocksSync.Unlock()
+		count := 0
+		for _, blockHash := range blockHashes[:2] {
+			if b := s.prefetchBlocks[blockHash]; b != nil && b.storedBlock.IsValid() {
+				count++
+			}
+		}
+		return count
+	}
+	for start := time.Now(); prefetchedCount() != 2; {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("TestIdleUploadWorkerKeepsPrefetches() the preflighted blocks were not prefetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The download worker stays busy while the upload worker goes idle
+	for start := time.Now(); time.Since(start) < 300*time.Millisecond; {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHashes[2])
+		if errno != 0 {
+			t.Fatalf("TestIdleUploadWorkerKeepsPrefetches() fetchBlockFromStore() %d != %d", errno, 0)
+		}
+		storedBlock.Dispose()
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := store.(HibernationStatsProvider).GetHibernationStats()
+	if stats.HibernationCount < 1 {
+		t.Errorf("TestIdleUploadWorkerKeepsPrefetches() GetHibernationStats() %+v", stats)
+	}
+	if count := prefetchedCount(); count != 2 {
+		t.Errorf("TestIdleUploadWorkerKeepsPrefetches() %d prefetched blocks != %d", count, 2)
+	}
+	if prefetchMemory := atomic.LoadInt64(&s.prefetchMemory); prefetchMemory == 0 {
+		t.Errorf("TestIdleUploadWorkerKeepsPrefetches() prefetchMemory %d", prefetchMemory)
+	}
+
+	// Once the download worker is idle too the prefetched blocks are released
+	time.Sleep(300 * time.Millisecond)
+	if count := prefetchedCount(); count != 0 {
+		t.Errorf("TestIdleUploadWorkerKeepsPrefetches() %d prefetched blocks after hibernation != %d", count, 0)
+	}
+	if prefetchMemory := atomic.LoadInt64(&s.prefetchMemory); prefetchMemory != 0 {
+		t.Errorf("TestIdleUploadWorkerKeepsPrefetches() prefetchMemory after hibernation %d != %d", prefetchMemory, 0)
+	}
+}
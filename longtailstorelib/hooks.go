@@ -0,0 +1,50 @@
+package longtailstorelib
+
+import "time"
+
+// StoreHooks are optional callbacks the remote block store makes on block and index transfers, see WithHooks.
+// They are called from the store workers so they must be safe for concurrent use and return quickly.
+type StoreHooks struct {
+	// OnBlockUploaded is called when a block has been written to the store, size is the stored size in bytes
+	OnBlockUploaded func(blockHash uint64, size int, duration time.Duration)
+	// OnBlockDownloaded is called when a block has been read from the store or one of its mirrors
+	OnBlockDownloaded func(blockHash uint64, size int, duration time.Duration)
+	// OnIndexUpdated is called when the store index has been written, blockCount is the number of blocks in the written index
+	OnIndexUpdated func(blockCount int, duration time.Duration)
+	// OnRetry is called before a failed read or write of path is retried, err is nil when a conditional write was rejected
+	OnRetry func(path string, attempt int, err error)
+
+	// onIndexTransferred is called with the bytes of the store index read and written while the
+	// store index is updated, the remote block store counts them in its bandwidth usage
+	onIndexTransferred func(uploaded int, downloaded int)
+}
+
+func (h *StoreHooks) blockUploaded(blockHash uint64, size int, duration time.Duration) {
+	if h.OnBlockUploaded != nil {
+		h.OnBlockUploaded(blockHash, size, duration)
+	}
+}
+
+func (h *StoreHooks) blockDownloaded(blockHash uint64, size int, duration time.Duration) {
+	if h.OnBlockDownloaded != nil {
+		h.OnBlockDownloaded(blockHash, size, duration)
+	}
+}
+
+func (h *StoreHooks) indexUpdated(blockCount int, duration time.Duration) {
+	if h.OnIndexUpdated != nil {
+		h.OnIndexUpdated(blockCount, duration)
+	}
+}
+
+func (h *StoreHooks) retry(path string, attempt int, err error) {
+	if h.OnRetry != nil {
+		h.OnRetry(path, attempt, err)
+	}
+}
+
+func (h *StoreHooks) indexTransferred(uploaded int, downloaded int) {
+	if h.onIndexTransferred != nil {
+		h.onIndexTransferred(uploaded, downloaded)
+	}
+}
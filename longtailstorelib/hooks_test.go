@@ -0,0 +1,75 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestStoreHooks(t *testing.T) {
+	var lock sync.Mutex
+	uploaded := map[uint64]int{}
+	downloaded := map[uint64]int{}
+	indexBlockCounts := []int{}
+	hooks := StoreHooks{
+		OnBlockUploaded: func(blockHash uint64, size int, duration time.Duration) {
+			lock.Lock()
+			defer lock.Unlock()
+			uploaded[blockHash] = size
+		},
+		OnBlockDownloaded: func(blockHash uint64, size int, duration time.Duration) {
+			lock.Lock()
+			defer lock.Unlock()
+			downloaded[blockHash] = size
+		},
+		OnIndexUpdated: func(blockCount int, duration time.Duration) {
+			lock.Lock()
+			defer lock.Unlock()
+			indexBlockCounts = append(indexBlockCounts, blockCount)
+		},
+	}
+
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite, WithHooks(hooks))
+	if err != nil {
+		t.Fatalf("TestStoreHooks() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Fatalf("TestStoreHooks() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	_, errno = storeBlockFromSeed(t, storeAPI, 10)
+	if errno != 0 {
+		t.Fatalf("TestStoreHooks() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+	if errno != 0 {
+		t.Fatalf("TestStoreHooks() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	storedBlock.Dispose()
+
+	remoteStoreFlushComplete := &flushCompletionAPI{}
+	remoteStoreFlushComplete.wg.Add(1)
+	_ = remoteStore.Flush(longtaillib.CreateAsyncFlushAPI(remoteStoreFlushComplete))
+	remoteStoreFlushComplete.wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(uploaded) != 2 || uploaded[blockHash] == 0 {
+		t.Errorf("TestStoreHooks() uploaded %v", uploaded)
+	}
+	if len(downloaded) != 1 || downloaded[blockHash] != uploaded[blockHash] {
+		t.Errorf("TestStoreHooks() downloaded %v, uploaded %v", downloaded, uploaded)
+	}
+	if len(indexBlockCounts) != 1 || indexBlockCounts[0] != 2 {
+		t.Errorf("TestStoreHooks() index updates %v != [2]", indexBlockCounts)
+	}
+}
@@ -0,0 +1,78 @@
+package longtailstorelib
+
+import (
+	"context"
+	"os"
+	"os/user"
+)
+
+// identityMetadataKey is the object metadata key for the identity of the writer, see WithIdentity
+const identityMetadataKey = "longtail-identity"
+
+// metadataBlobObject is implemented by blob objects of backends that keep metadata with objects
+type metadataBlobObject interface {
+	Metadata() (map[string]string, error)
+}
+
+// defaultIdentity is user@host of the current process
+func defaultIdentity() string {
+	userName := "unknown"
+	if u, err := user.Current(); err == nil {
+		userName = u.Username
+	}
+	hostName, err := os.Hostname()
+	if err != nil {
+		hostName = "unknown"
+	}
+	return userName + "@" + hostName
+}
+
+// storeIdentity is the identity set with WithIdentity, or user@host if none was set
+func storeIdentity(options StoreOptions) string {
+	if options.Identity != "" {
+		return options.Identity
+	}
+	return defaultIdentity()
+}
+
+// identityMetadata is the metadata to write objects with, nil if no identity was set
+func identityMetadata(options StoreOptions) map[string]string {
+	if options.Identity == "" {
+		return nil
+	}
+	return map[string]string{identityMetadataKey: options.Identity}
+}
+
+// getObjectIdentity returns the identity objHandle was written with, empty if it was written
+// without one or the backend does not keep object metadata
+func getObjectIdentity(objHandle BlobObject) (string, error) {
+	object, ok := objHandle.(metadataBlobObject)
+	if !ok {
+		return "", nil
+	}
+	metadata, err := object.Metadata()
+	if err != nil {
+		return "", err
+	}
+	return metadata[identityMetadataKey], nil
+}
+
+// ReadIdentityFromURI returns the identity the object at uri was written with, see WithIdentity.
+// It is empty if the object was written without one or the backend does not keep object metadata.
+func ReadIdentityFromURI(uri string, opts ...StoreOption) (string, error) {
+	uriParent, uriName := splitURI(uri)
+	blobStore, err := CreateBlobStoreForURI(uriParent, opts...)
+	if err != nil {
+		return "", err
+	}
+	client, err := blobStore.NewClient(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	object, err := client.NewObject(uriName)
+	if err != nil {
+		return "", err
+	}
+	return getObjectIdentity(object)
+}
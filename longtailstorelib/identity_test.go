@@ -0,0 +1,52 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestIdentityStamping(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path", WithIdentity("ci/job-42"), WithAuditLog())
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	identityStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite)
+	if err != nil {
+		t.Fatalf("TestIdentityStamping() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(identityStore)
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Fatalf("TestIdentityStamping() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	storeAPI.Dispose()
+
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	for _, key := range []string{GetBlockPath("chunks", blockHash), "store.lsi"} {
+		objHandle, _ := client.NewObject(key)
+		identity, err := getObjectIdentity(objHandle)
+		if err != nil || identity != "ci/job-42" {
+			t.Errorf("TestIdentityStamping() getObjectIdentity(%s) %s, %v != %s", key, identity, err, "ci/job-42")
+		}
+	}
+
+	entries, err := QueryAuditLog(context.Background(), blobStore, time.Time{}, AuditUpload)
+	if err != nil || len(entries) != 1 || entries[0].Identity != "ci/job-42" {
+		t.Errorf("TestIdentityStamping() QueryAuditLog() %v, %v", entries, err)
+	}
+
+	// Objects written without an identity have none
+	plainStore, _ := NewTestBlobStore("the_path")
+	plainClient, _ := plainStore.NewClient(context.Background())
+	defer plainClient.Close()
+	objHandle, _ := plainClient.NewObject("version.lvi")
+	objHandle.Write([]byte("version"))
+	if identity, err := getObjectIdentity(objHandle); err != nil || identity != "" {
+		t.Errorf("TestIdentityStamping() getObjectIdentity() without identity %s, %v", identity, err)
+	}
+}
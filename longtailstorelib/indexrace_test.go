@@ -0,0 +1,101 @@
+package longtailstorelib
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// runConcurrentUpsyncs runs clientCount remote block stores against the store from newBlobStore at
+// the same time, like upsyncs from separate machines. Each client puts blocksPerClient blocks of
+// its own and flushes after every block so the store index updates of the clients race in
+// tryUpdateRemoteStoreIndex. It returns the hashes of the blocks that were put.
+func runConcurrentUpsyncs(t *testing.T, jobs longtaillib.Longtail_JobAPI, newBlobStore func() BlobStore, clientCount int, blocksPerClient int) []uint64 {
+	// The chunks of the seeds of generateStoredBlock overlap unless the seeds are 3 apart
+	if clientCount*blocksPerClient*4 > 256 {
+		t.Fatalf("runConcurrentUpsyncs() %d clients with %d blocks is more than the 64 test blocks", clientCount, blocksPerClient)
+	}
+	blockHashes := make([]uint64, 0, clientCount*blocksPerClient)
+	var blockHashesLock sync.Mutex
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for c := 0; c < clientCount; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			remoteStore, err := NewRemoteBlockStore(jobs, newBlobStore(), "", 1, ReadWrite)
+			if err != nil {
+				t.Errorf("runConcurrentUpsyncs() NewRemoteBlockStore() %v != %v", err, nil)
+				return
+			}
+			storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+			defer storeAPI.Dispose()
+			<-start
+			for b := 0; b < blocksPerClient; b++ {
+				seed := uint8((c*blocksPerClient + b) * 4)
+				blockHash, errno := storeBlockFromSeed(t, storeAPI, seed)
+				if errno != 0 {
+					t.Errorf("runConcurrentUpsyncs() storeBlockFromSeed(%d) %d != %d", seed, errno, 0)
+					return
+				}
+				if errno := flushRemoteStore(storeAPI); errno != 0 {
+					t.Errorf("runConcurrentUpsyncs() Flush() %d != %d", errno, 0)
+					return
+				}
+				blockHashesLock.Lock()
+				blockHashes = append(blockHashes, blockHash)
+				blockHashesLock.Unlock()
+			}
+		}(c)
+	}
+	close(start)
+	wg.Wait()
+	return blockHashes
+}
+
+// verifyConcurrentUpsyncs fails the test unless the store index of blobStore has every block put by runConcurrentUpsyncs
+func verifyConcurrentUpsyncs(t *testing.T, name string, blobStore BlobStore, blockHashes []uint64) {
+	indexed := getStoreIndexBlockHashes(t, blobStore)
+	for _, blockHash := range blockHashes {
+		if !indexed[blockHash] {
+			t.Errorf("verifyConcurrentUpsyncs() %s: block 0x%016x is missing in the store index", name, blockHash)
+		}
+	}
+	if len(indexed) != len(blockHashes) {
+		t.Errorf("verifyConcurrentUpsyncs() %s: store index has %d blocks, expected %d", name, len(indexed), len(blockHashes))
+	}
+}
+
+func TestConcurrentStoreIndexUpdates(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	const clientCount = 8
+	const blocksPerClient = 4
+
+	memStore, _ := NewTestBlobStore("the_path")
+	blockHashes := runConcurrentUpsyncs(t, jobs, func() BlobStore { return memStore }, clientCount, blocksPerClient)
+	verifyConcurrentUpsyncs(t, "mem", memStore, blockHashes)
+
+	// Conflicts injected on top of the real races make every client merge and retry more often
+	conflictStore, _ := NewTestBlobStore("the_path")
+	faultyStore := NewFaultyBlobStore(conflictStore, FaultConfig{ConflictRate: 0.5, PathPrefix: "store.lsi", Seed: 1})
+	blockHashes = runConcurrentUpsyncs(t, jobs, func() BlobStore { return faultyStore }, clientCount, blocksPerClient)
+	verifyConcurrentUpsyncs(t, "faulty", conflictStore, blockHashes)
+
+	// Each client has its own file store like separate machines on a network share
+	storePath, err := ioutil.TempDir("", "longtail_index_race_test")
+	if err != nil {
+		t.Fatalf("TestConcurrentStoreIndexUpdates() ioutil.TempDir() %v", err)
+	}
+	defer os.RemoveAll(storePath)
+	newFSStore := func() BlobStore {
+		blobStore, _ := NewFSBlobStore(storePath, WithNetworkShare())
+		return blobStore
+	}
+	blockHashes = runConcurrentUpsyncs(t, jobs, newFSStore, clientCount, blocksPerClient)
+	verifyConcurrentUpsyncs(t, "file", newFSStore(), blockHashes)
+}
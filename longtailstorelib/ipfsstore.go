@@ -0,0 +1,411 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ipfsManifestPath is the path of the manifest in the files API (MFS) of the IPFS node
+const ipfsManifestPath = "/longtail/manifest.json"
+
+// ipfsManifestEntry is the content of an object in the store
+type ipfsManifestEntry struct {
+	CID  string `json:"cid"`
+	Size int64  `json:"size"`
+}
+
+// ipfsManifest maps the object paths of the stores on a node, such as the path of a block, to IPFS CIDs
+type ipfsManifest struct {
+	Version int                          `json:"version"`
+	Objects map[string]ipfsManifestEntry `json:"objects"`
+}
+
+// ipfsManifestState is the manifest of a node or a published manifest, shared by all blob stores of
+// the process that use it so stores with different roots, such as a store and its index folder, do
+// not overwrite each other's objects
+type ipfsManifestState struct {
+	lock     sync.Mutex
+	manifest *ipfsManifest
+	dirty    bool
+}
+
+var ipfsManifestsLock sync.Mutex
+var ipfsManifests = map[string]*ipfsManifestState{}
+
+func sharedIPFSManifest(key string) *ipfsManifestState {
+	ipfsManifestsLock.Lock()
+	defer ipfsManifestsLock.Unlock()
+	state, ok := ipfsManifests[key]
+	if !ok {
+		state = &ipfsManifestState{}
+		ipfsManifests[key] = state
+	}
+	return state
+}
+
+// ipfsBlobStore keeps the objects of a store as pinned files on an IPFS node and the paths of the
+// objects in a manifest. The URI ipfs://127.0.0.1:5001/store uses the RPC API of the node at
+// 127.0.0.1:5001 and keeps the manifest of all stores on the node at /longtail/manifest.json in the
+// files API of the node.
+//
+// The manifest is written when an object outside of chunks/ is written, such as the store index,
+// and when a client is closed, so blocks are batched but an index is never stored without its blocks.
+// The manifest is shared within a process but not between processes, only one process may write to
+// the stores of a node at a time.
+//
+// Others can read a published store without access to the node that wrote it by opening the CID of
+// its manifest with WithIPFSManifest, such stores are read-only.
+type ipfsBlobStore struct {
+	host       string
+	apiURL     string
+	prefix     string
+	options    StoreOptions
+	httpClient *http.Client
+	manifest   *ipfsManifestState
+}
+
+type ipfsBlobClient struct {
+	ctx   context.Context
+	store *ipfsBlobStore
+}
+
+type ipfsBlobObject struct {
+	client    *ipfsBlobClient
+	path      string
+	lockedCID *string
+}
+
+// NewIPFSBlobStore ...
+func NewIPFSBlobStore(u *url.URL, opts ...StoreOption) (BlobStore, error) {
+	if u.Scheme != "ipfs" {
+		return nil, fmt.Errorf("invalid scheme '%s', expected 'ipfs'", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing IPFS API address in '%s'", u)
+	}
+	prefix, err := normalizeStorePrefix(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	options := newStoreOptions(opts)
+	transport, err := NewHTTPTransport(options.Transport)
+	if err != nil {
+		return nil, err
+	}
+	apiURL := "http://" + u.Host + "/api/v0/"
+	s := &ipfsBlobStore{
+		host:       u.Host,
+		apiURL:     apiURL,
+		prefix:     prefix,
+		options:    options,
+		httpClient: &http.Client{Transport: transport},
+		manifest:   sharedIPFSManifest(apiURL + ipfsManifestPath + "?" + options.IPFSManifestCID)}
+	return s, nil
+}
+
+func (blobStore *ipfsBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	return &ipfsBlobClient{ctx: ctx, store: blobStore}, nil
+}
+
+func (blobStore *ipfsBlobStore) storeOptions() StoreOptions {
+	return blobStore.options
+}
+
+func (blobStore *ipfsBlobStore) String() string {
+	if blobStore.options.IPFSManifestCID != "" {
+		return "ipfs://" + blobStore.options.IPFSManifestCID + "/" + blobStore.prefix
+	}
+	return "ipfs://" + blobStore.host + "/" + blobStore.prefix
+}
+
+// call makes a request to the RPC API of the node, body is sent as the file of the request if not nil
+func (blobStore *ipfsBlobStore) call(ctx context.Context, command string, args url.Values, body []byte) ([]byte, error) {
+	var content bytes.Buffer
+	contentType := ""
+	if body != nil {
+		writer := multipart.NewWriter(&content)
+		part, err := writer.CreateFormFile("file", "data")
+		if err != nil {
+			return nil, err
+		}
+		part.Write(body)
+		writer.Close()
+		contentType = writer.FormDataContentType()
+	}
+	req, err := http.NewRequest(http.MethodPost, blobStore.apiURL+command+"?"+args.Encode(), &content)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := blobStore.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiError := struct{ Message string }{}
+		if json.Unmarshal(data, &apiError) != nil || apiError.Message == "" {
+			apiError.Message = resp.Status
+		}
+		return nil, fmt.Errorf("ipfs %s: %s", command, apiError.Message)
+	}
+	return data, nil
+}
+
+// isIPFSNotExist detects errors for missing files in the files API of the node
+func isIPFSNotExist(err error) bool {
+	return strings.Contains(err.Error(), "does not exist")
+}
+
+func (blobStore *ipfsBlobStore) add(ctx context.Context, data []byte) (string, error) {
+	result, err := blobStore.call(ctx, "add", url.Values{"pin": {"true"}, "cid-version": {"1"}}, data)
+	if err != nil {
+		return "", err
+	}
+	added := struct{ Hash string }{}
+	err = json.Unmarshal(result, &added)
+	if err != nil {
+		return "", err
+	}
+	return added.Hash, nil
+}
+
+func (blobStore *ipfsBlobStore) cat(ctx context.Context, cid string) ([]byte, error) {
+	return blobStore.call(ctx, "cat", url.Values{"arg": {cid}}, nil)
+}
+
+// loadManifest reads the manifest the first time it is used, call with the manifest lock held
+func (blobStore *ipfsBlobStore) loadManifest(ctx context.Context) (*ipfsManifest, error) {
+	if blobStore.manifest.manifest != nil {
+		return blobStore.manifest.manifest, nil
+	}
+	var data []byte
+	var err error
+	if blobStore.options.IPFSManifestCID != "" {
+		data, err = blobStore.cat(ctx, blobStore.options.IPFSManifestCID)
+	} else {
+		data, err = blobStore.call(ctx, "files/read", url.Values{"arg": {ipfsManifestPath}}, nil)
+		if err != nil && isIPFSNotExist(err) {
+			data, err = []byte("{}"), nil
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	manifest := &ipfsManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid manifest %s", blobStore)
+	}
+	if manifest.Objects == nil {
+		manifest.Objects = map[string]ipfsManifestEntry{}
+	}
+	manifest.Version = 1
+	blobStore.manifest.manifest = manifest
+	return manifest, nil
+}
+
+// saveManifest writes the manifest if it has changed, call with the manifest lock held
+func (blobStore *ipfsBlobStore) saveManifest(ctx context.Context) error {
+	if !blobStore.manifest.dirty {
+		return nil
+	}
+	data, err := json.Marshal(blobStore.manifest.manifest)
+	if err != nil {
+		return err
+	}
+	args := url.Values{"arg": {ipfsManifestPath}, "create": {"true"}, "truncate": {"true"}, "parents": {"true"}}
+	_, err = blobStore.call(ctx, "files/write", args, data)
+	if err != nil {
+		return errors.Wrap(err, blobStore.String())
+	}
+	blobStore.manifest.dirty = false
+	return nil
+}
+
+func (blobStore *ipfsBlobStore) lookup(ctx context.Context, path string) (ipfsManifestEntry, bool, error) {
+	blobStore.manifest.lock.Lock()
+	defer blobStore.manifest.lock.Unlock()
+	manifest, err := blobStore.loadManifest(ctx)
+	if err != nil {
+		return ipfsManifestEntry{}, false, err
+	}
+	entry, exists := manifest.Objects[path]
+	return entry, exists, nil
+}
+
+func (blobClient *ipfsBlobClient) NewObject(path string) (BlobObject, error) {
+	return &ipfsBlobObject{client: blobClient, path: blobClient.store.prefix + path}, nil
+}
+
+func (blobClient *ipfsBlobClient) GetObjects() ([]BlobProperties, error) {
+	store := blobClient.store
+	store.manifest.lock.Lock()
+	defer store.manifest.lock.Unlock()
+	manifest, err := store.loadManifest(blobClient.ctx)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]BlobProperties, 0, len(manifest.Objects))
+	for name, entry := range manifest.Objects {
+		if strings.HasPrefix(name, store.prefix) {
+			objects = append(objects, BlobProperties{Size: entry.Size, Name: name[len(store.prefix):]})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (blobClient *ipfsBlobClient) ListObjects(prefix string) BlobIterator {
+	return newListingBlobIterator(blobClient.GetObjects, prefix)
+}
+
+func (blobClient *ipfsBlobClient) Close() {
+	store := blobClient.store
+	store.manifest.lock.Lock()
+	defer store.manifest.lock.Unlock()
+	err := store.saveManifest(blobClient.ctx)
+	if err != nil {
+		log.Printf("Failed to save manifest of %s: %v\n", store, err)
+	}
+}
+
+func (blobClient *ipfsBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+func (blobObject *ipfsBlobObject) checkWritable() error {
+	store := blobObject.client.store
+	if store.options.IPFSManifestCID != "" {
+		return fmt.Errorf("store %s is published and read-only", store)
+	}
+	return nil
+}
+
+func (blobObject *ipfsBlobObject) Exists() (bool, error) {
+	_, exists, err := blobObject.client.store.lookup(blobObject.client.ctx, blobObject.path)
+	return exists, err
+}
+
+func (blobObject *ipfsBlobObject) Read() ([]byte, error) {
+	entry, exists, err := blobObject.client.store.lookup(blobObject.client.ctx, blobObject.path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("ipfs object does not exist: %s", blobObject.path)
+	}
+	data, err := blobObject.client.store.cat(blobObject.client.ctx, entry.CID)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	return data, nil
+}
+
+func (blobObject *ipfsBlobObject) LockWriteVersion() (bool, error) {
+	entry, exists, err := blobObject.client.store.lookup(blobObject.client.ctx, blobObject.path)
+	if err != nil {
+		return false, err
+	}
+	blobObject.lockedCID = &entry.CID
+	return exists, nil
+}
+
+func (blobObject *ipfsBlobObject) Write(data []byte) (bool, error) {
+	err := blobObject.checkWritable()
+	if err != nil {
+		return false, err
+	}
+	store := blobObject.client.store
+	ctx := blobObject.client.ctx
+	cid, err := store.add(ctx, data)
+	if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+
+	store.manifest.lock.Lock()
+	defer store.manifest.lock.Unlock()
+	manifest, err := store.loadManifest(ctx)
+	if err != nil {
+		return false, err
+	}
+	existing, exists := manifest.Objects[blobObject.path]
+	if blobObject.lockedCID != nil && existing.CID != *blobObject.lockedCID {
+		return false, store.unpinUnused(ctx, manifest, cid)
+	}
+	if exists && blobObject.lockedCID == nil && store.options.Immutable && existing.CID != cid {
+		store.unpinUnused(ctx, manifest, cid)
+		return false, errors.Wrap(ErrImmutable, blobObject.path)
+	}
+	manifest.Objects[blobObject.path] = ipfsManifestEntry{CID: cid, Size: int64(len(data))}
+	store.manifest.dirty = true
+	if !strings.HasPrefix(blobObject.path, store.prefix+"chunks/") {
+		err = store.saveManifest(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (blobObject *ipfsBlobObject) Delete() error {
+	err := blobObject.checkWritable()
+	if err != nil {
+		return err
+	}
+	store := blobObject.client.store
+	if store.options.Immutable {
+		return errors.Wrap(ErrImmutable, blobObject.path)
+	}
+	ctx := blobObject.client.ctx
+	store.manifest.lock.Lock()
+	defer store.manifest.lock.Unlock()
+	manifest, err := store.loadManifest(ctx)
+	if err != nil {
+		return err
+	}
+	entry, exists := manifest.Objects[blobObject.path]
+	if !exists {
+		return fmt.Errorf("ipfs object does not exist: %s", blobObject.path)
+	}
+	delete(manifest.Objects, blobObject.path)
+	store.manifest.dirty = true
+	err = store.saveManifest(ctx)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(store.unpinUnused(ctx, manifest, entry.CID), blobObject.path)
+}
+
+// unpinUnused unpins cid unless an object in manifest has the same content, unpinned content stays
+// on the node until it is garbage collected
+func (blobStore *ipfsBlobStore) unpinUnused(ctx context.Context, manifest *ipfsManifest, cid string) error {
+	for _, entry := range manifest.Objects {
+		if entry.CID == cid {
+			return nil
+		}
+	}
+	_, err := blobStore.call(ctx, "pin/rm", url.Values{"arg": {cid}}, nil)
+	if err != nil && !strings.Contains(err.Error(), "not pinned") {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package longtailstorelib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// fakeIPFSNode implements the parts of the RPC API of an IPFS node used by the ipfs:// blob store
+type fakeIPFSNode struct {
+	lock   sync.Mutex
+	blocks map[string][]byte
+	pins   map[string]bool
+	files  map[string][]byte
+}
+
+func newFakeIPFSNode() (*fakeIPFSNode, *httptest.Server) {
+	node := &fakeIPFSNode{blocks: map[string][]byte{}, pins: map[string]bool{}, files: map[string][]byte{}}
+	return node, httptest.NewServer(http.HandlerFunc(node.serve))
+}
+
+func (node *fakeIPFSNode) add(data []byte) string {
+	sum := sha256.Sum256(data)
+	cid := "bafk" + hex.EncodeToString(sum[:16])
+	node.blocks[cid] = data
+	return cid
+}
+
+func (node *fakeIPFSNode) serve(w http.ResponseWriter, r *http.Request) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	fail := func(message string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"Message": message, "Code": 0, "Type": "error"})
+	}
+	readFile := func() []byte {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			return nil
+		}
+		data, _ := ioutil.ReadAll(file)
+		return data
+	}
+	arg := r.URL.Query().Get("arg")
+	switch strings.TrimPrefix(r.URL.Path, "/api/v0/") {
+	case "add":
+		cid := node.add(readFile())
+		node.pins[cid] = true
+		json.NewEncoder(w).Encode(map[string]string{"Name": cid, "Hash": cid})
+	case "cat":
+		data, ok := node.blocks[arg]
+		if !ok {
+			fail("block was not found locally (offline): ipld: could not find " + arg)
+			return
+		}
+		w.Write(data)
+	case "files/read":
+		data, ok := node.files[arg]
+		if !ok {
+			fail("file does not exist")
+			return
+		}
+		w.Write(data)
+	case "files/write":
+		node.files[arg] = readFile()
+	case "pin/rm":
+		if !node.pins[arg] {
+			fail("not pinned or pinned indirectly")
+			return
+		}
+		delete(node.pins, arg)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestIPFSBlobStore(t *testing.T) {
+	node, server := newFakeIPFSNode()
+	defer server.Close()
+	u, _ := url.Parse("ipfs://" + server.Listener.Addr().String() + "/store")
+
+	blobStore, err := NewIPFSBlobStore(u)
+	if err != nil {
+		t.Fatalf("TestIPFSBlobStore() NewIPFSBlobStore() %v != %v", err, nil)
+	}
+	client, _ := blobStore.NewClient(context.Background())
+	object, _ := client.NewObject("chunks/0000/test.lsb")
+	if exists, err := object.Exists(); exists || err != nil {
+		t.Errorf("TestIPFSBlobStore() Exists() %t, %v", exists, err)
+	}
+	if ok, err := object.Write([]byte("block")); !ok || err != nil {
+		t.Fatalf("TestIPFSBlobStore() Write() %t, %v", ok, err)
+	}
+	// Blocks are batched until an index is written or the client is closed
+	if _, ok := node.files[ipfsManifestPath]; ok {
+		t.Errorf("TestIPFSBlobStore() manifest written for a block")
+	}
+	data, err := object.Read()
+	if err != nil || string(data) != "block" {
+		t.Errorf("TestIPFSBlobStore() Read() `%s`, %v", data, err)
+	}
+
+	indexObject, _ := client.NewObject("store.lsi")
+	exists, err := indexObject.LockWriteVersion()
+	if exists || err != nil {
+		t.Errorf("TestIPFSBlobStore() LockWriteVersion() %t, %v", exists, err)
+	}
+	otherClient, _ := blobStore.NewClient(context.Background())
+	otherIndexObject, _ := otherClient.NewObject("store.lsi")
+	otherIndexObject.LockWriteVersion()
+	if ok, err := indexObject.Write([]byte("index")); !ok || err != nil {
+		t.Errorf("TestIPFSBlobStore() Write() locked %t, %v", ok, err)
+	}
+	if ok, err := otherIndexObject.Write([]byte("other index")); ok || err != nil {
+		t.Errorf("TestIPFSBlobStore() Write() conflict %t, %v", ok, err)
+	}
+	otherClient.Close()
+
+	manifest := ipfsManifest{}
+	err = json.Unmarshal(node.files[ipfsManifestPath], &manifest)
+	if err != nil || len(manifest.Objects) != 2 || manifest.Objects["store/store.lsi"].Size != 5 {
+		t.Errorf("TestIPFSBlobStore() manifest %+v, %v", manifest, err)
+	}
+	objects, err := client.GetObjects()
+	if err != nil || len(objects) != 2 || objects[0].Name != "chunks/0000/test.lsb" || objects[1].Name != "store.lsi" {
+		t.Errorf("TestIPFSBlobStore() GetObjects() %v, %v", objects, err)
+	}
+
+	if err := object.Delete(); err != nil {
+		t.Errorf("TestIPFSBlobStore() Delete() %v", err)
+	}
+	if exists, _ := object.Exists(); exists || len(node.pins) != 1 {
+		t.Errorf("TestIPFSBlobStore() Delete() left %t, %d pins", exists, len(node.pins))
+	}
+	client.Close()
+}
+
+func TestIPFSPublishedStore(t *testing.T) {
+	node, server := newFakeIPFSNode()
+	defer server.Close()
+	storeURI := "ipfs://" + server.Listener.Addr().String() + "/store"
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStoreForURI(jobs, storeURI, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestIPFSPublishedStore() NewRemoteBlockStoreForURI() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 7)
+	if errno != 0 {
+		t.Fatalf("TestIPFSPublishedStore() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	storeAPI.Dispose()
+
+	// Anyone with the CID of the manifest can read the store, without the manifest of the node
+	node.lock.Lock()
+	manifestCID := node.add(node.files[ipfsManifestPath])
+	delete(node.files, ipfsManifestPath)
+	node.lock.Unlock()
+	remoteStore, err = NewRemoteBlockStoreForURI(jobs, storeURI+"?ipfs-manifest="+manifestCID, "", runtime.NumCPU(), ReadOnly)
+	if err != nil {
+		t.Fatalf("TestIPFSPublishedStore() NewRemoteBlockStoreForURI() published %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+	if errno != 0 {
+		t.Fatalf("TestIPFSPublishedStore() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	validateBlockFromSeed(t, 7, storedBlock)
+	storedBlock.Dispose()
+
+	u, _ := url.Parse(storeURI)
+	blobStore, _ := NewIPFSBlobStore(u, WithIPFSManifest(manifestCID))
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	if _, err := object.Write([]byte("index")); err == nil {
+		t.Errorf("TestIPFSPublishedStore() Write() published %v == %v", err, nil)
+	}
+}
@@ -0,0 +1,171 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The operations of the remote block store that latencies are recorded for
+const (
+	OperationGetBlock    = "get-block"
+	OperationPutBlock    = "put-block"
+	OperationGetIndex    = "get-index"
+	OperationUpdateIndex = "update-index"
+)
+
+// LatencyBucketBounds are the upper bounds of the buckets of a LatencyHistogram, the last bucket
+// of a histogram holds the operations slower than the last bound
+var LatencyBucketBounds = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+	10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// LatencyHistogram counts the operations of one kind to one backend by duration, failed
+// operations included
+type LatencyHistogram struct {
+	Operation string
+	// Backend is the blob store the operations were made to, such as a mirror of the store
+	Backend   string
+	Count     uint64
+	FailCount uint64
+	// RetryCount is the number of retries made by the operations
+	RetryCount uint64
+	// SlowCount is the number of operations that took longer than the slow operation threshold, see WithSlowOperationThreshold
+	SlowCount uint64
+	Total     time.Duration
+	Max       time.Duration
+	// Buckets has one count per bound in LatencyBucketBounds and one for slower operations
+	Buckets []uint64
+}
+
+// Mean returns the average duration of the operations
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+// Percentile returns the upper bound of the bucket holding the p:th percentile, p in 1 to 100.
+// Operations slower than the last bound are reported as Max.
+func (h *LatencyHistogram) Percentile(p int) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := (h.Count*uint64(p) + 99) / 100
+	if rank == 0 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for b, count := range h.Buckets {
+		seen += count
+		if seen >= rank {
+			if b < len(LatencyBucketBounds) && LatencyBucketBounds[b] < h.Max {
+				return LatencyBucketBounds[b]
+			}
+			return h.Max
+		}
+	}
+	return h.Max
+}
+
+// operationLatencies records a histogram per operation and backend and logs operations slower than slowThreshold
+type operationLatencies struct {
+	sync.Mutex
+	slowThreshold time.Duration
+	histograms    map[string]*LatencyHistogram
+}
+
+// operation describes one timed request for the slow operation log
+type operation struct {
+	name       string
+	key        string
+	blockHash  uint64
+	backend    string
+	size       int
+	retryCount int
+	err        error
+}
+
+func newOperationLatencies(slowThreshold time.Duration) *operationLatencies {
+	return &operationLatencies{slowThreshold: slowThreshold, histograms: map[string]*LatencyHistogram{}}
+}
+
+// record adds an operation to its histogram, a nil operationLatencies records nothing
+func (l *operationLatencies) record(op operation, duration time.Duration) {
+	if l == nil {
+		return
+	}
+	slow := l.slowThreshold > 0 && duration > l.slowThreshold
+	if slow {
+		log.Printf("Slow %s\n", op.describe(duration))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	key := op.name + "|" + op.backend
+	h, exists := l.histograms[key]
+	if !exists {
+		h = &LatencyHistogram{Operation: op.name, Backend: op.backend, Buckets: make([]uint64, len(LatencyBucketBounds)+1)}
+		l.histograms[key] = h
+	}
+	bucket := sort.Search(len(LatencyBucketBounds), func(i int) bool { return duration <= LatencyBucketBounds[i] })
+	h.Buckets[bucket]++
+	h.Count++
+	h.Total += duration
+	if duration > h.Max {
+		h.Max = duration
+	}
+	h.RetryCount += uint64(op.retryCount)
+	if op.err != nil {
+		h.FailCount++
+	}
+	if slow {
+		h.SlowCount++
+	}
+}
+
+// get returns copies of the histograms ordered by operation and backend
+func (l *operationLatencies) get() []LatencyHistogram {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	histograms := make([]LatencyHistogram, 0, len(l.histograms))
+	for _, h := range l.histograms {
+		histogram := *h
+		histogram.Buckets = append([]uint64{}, h.Buckets...)
+		histograms = append(histograms, histogram)
+	}
+	sort.Slice(histograms, func(i, j int) bool {
+		if histograms[i].Operation != histograms[j].Operation {
+			return histograms[i].Operation < histograms[j].Operation
+		}
+		return histograms[i].Backend < histograms[j].Backend
+	})
+	return histograms
+}
+
+func (op *operation) describe(duration time.Duration) string {
+	description := fmt.Sprintf("%s of %s from %s took %s", op.name, op.key, op.backend, duration.Round(time.Microsecond))
+	if op.blockHash != 0 {
+		description = fmt.Sprintf("%s of block 0x%016x at %s from %s took %s", op.name, op.blockHash, op.key, op.backend, duration.Round(time.Microsecond))
+	}
+	if op.size > 0 {
+		description += fmt.Sprintf(", %d bytes", op.size)
+	}
+	if op.retryCount > 0 {
+		description += fmt.Sprintf(", %d retries", op.retryCount)
+	}
+	if op.err != nil {
+		description += fmt.Sprintf(", failed: %v", op.err)
+	}
+	return description
+}
@@ -0,0 +1,100 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	latencies := newOperationLatencies(0)
+	for i := 0; i < 90; i++ {
+		latencies.record(operation{name: OperationGetBlock}, 3*time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		latencies.record(operation{name: OperationGetBlock}, 150*time.Millisecond)
+	}
+	latencies.record(operation{name: OperationGetBlock, err: errors.New("timeout")}, 90*time.Second)
+	latencies.record(operation{name: OperationPutBlock}, time.Millisecond)
+
+	histograms := latencies.get()
+	if len(histograms) != 2 || histograms[0].Operation != OperationGetBlock || histograms[1].Operation != OperationPutBlock {
+		t.Fatalf("TestLatencyHistogram() get() %+v", histograms)
+	}
+	h := histograms[0]
+	if h.Count != 100 || h.FailCount != 1 || h.SlowCount != 0 || h.Max != 90*time.Second {
+		t.Errorf("TestLatencyHistogram() counts %+v", h)
+	}
+	if h.Buckets[2] != 90 || h.Buckets[7] != 9 || h.Buckets[len(LatencyBucketBounds)] != 1 {
+		t.Errorf("TestLatencyHistogram() buckets %v", h.Buckets)
+	}
+	if h.Percentile(50) != 5*time.Millisecond || h.Percentile(95) != 200*time.Millisecond || h.Percentile(100) != 90*time.Second {
+		t.Errorf("TestLatencyHistogram() percentiles %v %v %v", h.Percentile(50), h.Percentile(95), h.Percentile(100))
+	}
+	if histograms[1].Percentile(99) != time.Millisecond || histograms[1].Mean() != time.Millisecond {
+		t.Errorf("TestLatencyHistogram() single operation %v %v", histograms[1].Percentile(99), histograms[1].Mean())
+	}
+	var nilLatencies *operationLatencies
+	nilLatencies.record(operation{name: OperationGetBlock}, time.Second)
+	if nilLatencies.get() != nil {
+		t.Errorf("TestLatencyHistogram() nil get() %v != %v", nilLatencies.get(), nil)
+	}
+}
+
+func TestSlowOperationLog(t *testing.T) {
+	storePath, _ := ioutil.TempDir("", "longtail-slow")
+	defer os.RemoveAll(storePath)
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	var logOutput bytes.Buffer
+	log.SetOutput(&logOutput)
+	defer log.SetOutput(os.Stderr)
+
+	fsStore, _ := NewFSBlobStore(storePath)
+	blobStore := &slowBlobStore{BlobStore: fsStore, delay: 50 * time.Millisecond}
+	blockStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite, WithSlowOperationThreshold(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("TestSlowOperationLog() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(blockStore)
+	defer storeAPI.Dispose()
+
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Fatalf("TestSlowOperationLog() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+	if errno != 0 {
+		t.Fatalf("TestSlowOperationLog() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	storedBlock.Dispose()
+
+	expected := fmt.Sprintf("Slow get-block of block 0x%016x at %s from %s took", blockHash, GetBlockPath("chunks", blockHash), fsStore.String())
+	if !strings.Contains(logOutput.String(), expected) {
+		t.Errorf("TestSlowOperationLog() log `%s` does not contain `%s`", logOutput.String(), expected)
+	}
+	if strings.Contains(logOutput.String(), "Slow put-block") {
+		t.Errorf("TestSlowOperationLog() log `%s` has a slow put", logOutput.String())
+	}
+
+	var getBlock *LatencyHistogram
+	latencies := blockStore.(DetailedStatsProvider).GetDetailedStats().Latencies
+	for i := range latencies {
+		if latencies[i].Operation == OperationGetBlock {
+			getBlock = &latencies[i]
+		}
+	}
+	if getBlock == nil || getBlock.Count != 1 || getBlock.SlowCount != 1 || getBlock.Max < blobStore.delay {
+		t.Errorf("TestSlowOperationLog() GetDetailedStats() latencies %+v", latencies)
+	}
+}
@@ -0,0 +1,273 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/storeformat"
+	"github.com/pkg/errors"
+)
+
+// blockLayoutKey is the object recording the block layout of a store, stores without it use DefaultBlockLayout
+const blockLayoutKey = storeformat.BlockLayoutKey
+
+// blockLayoutVersion is the newest block layout version this package can read
+const blockLayoutVersion = storeformat.BlockLayoutVersion
+
+// BlockLayout describes where the blocks of a store are placed. Blocks are stored as
+// chunks/<prefix>/.../0x<block hash>.lsb with PrefixDepth prefix directories, each named by the
+// next PrefixWidth hex digits of the block hash. Deep layouts spread blocks over more prefixes
+// which suits backends that partition listings and request rates by prefix.
+type BlockLayout struct {
+	Version     int `json:"version"`
+	PrefixDepth int `json:"prefixDepth"`
+	PrefixWidth int `json:"prefixWidth"`
+}
+
+// DefaultBlockLayout is chunks/<4 hex digits>/0x<block hash>.lsb, used by stores that do not record a layout
+var DefaultBlockLayout = BlockLayout{Version: blockLayoutVersion, PrefixDepth: 1, PrefixWidth: 4}
+
+// NewBlockLayout returns a layout with prefixDepth directories of prefixWidth hex digits each
+func NewBlockLayout(prefixDepth int, prefixWidth int) (BlockLayout, error) {
+	if prefixDepth == 0 {
+		prefixWidth = 0
+	}
+	layout := BlockLayout{Version: blockLayoutVersion, PrefixDepth: prefixDepth, PrefixWidth: prefixWidth}
+	return layout, layout.validate()
+}
+
+func (layout BlockLayout) validate() error {
+	if layout.Version < 1 || layout.Version > blockLayoutVersion {
+		return fmt.Errorf("block layout version %d is not supported, the newest supported version is %d", layout.Version, blockLayoutVersion)
+	}
+	if layout.PrefixDepth < 0 || layout.PrefixDepth > 4 {
+		return fmt.Errorf("block layout prefix depth %d is not in the range 0 to 4", layout.PrefixDepth)
+	}
+	if layout.PrefixDepth > 0 && (layout.PrefixWidth < 1 || layout.PrefixWidth > 4) {
+		return fmt.Errorf("block layout prefix width %d is not in the range 1 to 4", layout.PrefixWidth)
+	}
+	return nil
+}
+
+func (layout BlockLayout) String() string {
+	return fmt.Sprintf("v%d prefix depth %d width %d", layout.Version, layout.PrefixDepth, layout.PrefixWidth)
+}
+
+// BlockPath returns the path of the block with blockHash under basePath
+func (layout BlockLayout) BlockPath(basePath string, blockHash uint64) string {
+	return storeformat.BlockLayout(layout).BlockPath(basePath, blockHash)
+}
+
+// parseBlockPath is the inverse of BlockPath for blocks stored under chunks/
+func (layout BlockLayout) parseBlockPath(blockPath string) (uint64, bool) {
+	name := path.Base(blockPath)
+	if !strings.HasSuffix(name, ".lsb") {
+		return 0, false
+	}
+	blockHash, err := strconv.ParseUint(strings.TrimSuffix(name, ".lsb"), 0, 64)
+	if err != nil {
+		return 0, false
+	}
+	return blockHash, layout.BlockPath("chunks", blockHash) == blockPath
+}
+
+// hashPrefix returns the path prefix shared by all blocks whose hash starts with the hex digits hashHex
+func (layout BlockLayout) hashPrefix(hashHex string) string {
+	prefix := "chunks/"
+	rest := hashHex
+	for d := 0; d < layout.PrefixDepth; d++ {
+		if len(rest) <= layout.PrefixWidth {
+			return prefix + rest
+		}
+		prefix += rest[:layout.PrefixWidth] + "/"
+		rest = rest[layout.PrefixWidth:]
+	}
+	return prefix + "0x" + hashHex
+}
+
+// readBlockLayout returns the layout recorded in the store, DefaultBlockLayout if there is none
+func readBlockLayout(blobClient BlobClient) (BlockLayout, error) {
+	objHandle, err := blobClient.NewObject(blockLayoutKey)
+	if err != nil {
+		return BlockLayout{}, err
+	}
+	exists, err := objHandle.Exists()
+	if err != nil {
+		return BlockLayout{}, errors.Wrapf(err, "readBlockLayout: objHandle.Exists(%s) failed", blockLayoutKey)
+	}
+	if !exists {
+		return DefaultBlockLayout, nil
+	}
+	data, err := objHandle.Read()
+	if err != nil {
+		return BlockLayout{}, errors.Wrapf(err, "readBlockLayout: objHandle.Read(%s) failed", blockLayoutKey)
+	}
+	var layout BlockLayout
+	err = json.Unmarshal(data, &layout)
+	if err != nil {
+		return BlockLayout{}, errors.Wrapf(err, "readBlockLayout: %s is malformed", blockLayoutKey)
+	}
+	err = layout.validate()
+	if err != nil {
+		return BlockLayout{}, errors.Wrapf(err, "readBlockLayout: %s", blobClient.String())
+	}
+	return layout, nil
+}
+
+func writeBlockLayout(blobClient BlobClient, layout BlockLayout) error {
+	data, err := json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+	objHandle, err := blobClient.NewObject(blockLayoutKey)
+	if err != nil {
+		return err
+	}
+	// Lock the version so the layout may be replaced in immutable stores
+	_, err = objHandle.LockWriteVersion()
+	if err != nil {
+		return errors.Wrapf(err, "writeBlockLayout: objHandle.LockWriteVersion(%s) failed", blockLayoutKey)
+	}
+	ok, err := objHandle.Write(data)
+	if err != nil {
+		return errors.Wrapf(err, "writeBlockLayout: objHandle.Write(%s) failed", blockLayoutKey)
+	}
+	if !ok {
+		return fmt.Errorf("writeBlockLayout: %s was changed by someone else", blockLayoutKey)
+	}
+	return nil
+}
+
+// forEachBlob calls fn for 0 to count-1 on workerCount workers, each with its own client, and
+// returns the first error
+func forEachBlob(ctx context.Context, blobStore BlobStore, workerCount int, count int, fn func(client BlobClient, i int) error) error {
+	indexes := make(chan int, count)
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for w := 0; w < workerCount && w < count; w++ {
+		client, err := blobStore.NewClient(ctx)
+		if err != nil {
+			wg.Wait()
+			return errors.Wrap(err, blobStore.String())
+		}
+		wg.Add(1)
+		go func(client BlobClient) {
+			defer wg.Done()
+			defer client.Close()
+			for i := range indexes {
+				err := ctx.Err()
+				if err == nil {
+					err = fn(client, i)
+				}
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+					return
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// MigrateBlockLayout moves all blocks of the store to layout and records the layout in the store.
+// The blocks are copied before the layout is recorded and the old copies are deleted after, so
+// readers are not affected, but it must not run at the same time as an upsync to the store.
+// Mirrors of the store need to be migrated as well. Returns the number of blocks moved, with
+// dryRun they are only counted.
+func MigrateBlockLayout(
+	ctx context.Context,
+	blobStore BlobStore,
+	layout BlockLayout,
+	dryRun bool,
+	opts ...StoreOption) (int, error) {
+	err := layout.validate()
+	if err != nil {
+		return 0, errors.Wrap(err, "MigrateBlockLayout")
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	workerCount := newStoreOptions(opts).WorkerCount
+	if workerCount <= 0 {
+		workerCount = 8
+	}
+
+	currentLayout, err := readBlockLayout(blobClient)
+	if err != nil {
+		return 0, errors.Wrap(err, "MigrateBlockLayout")
+	}
+	if currentLayout == layout {
+		return 0, nil
+	}
+	storeBlockKeys, err := listStoreBlocks(ctx, blobStore, blobClient, currentLayout, workerCount)
+	if err != nil {
+		return 0, errors.Wrapf(err, "MigrateBlockLayout: failed to list blocks of %s", blobStore.String())
+	}
+	var blockKeys []string
+	var blockHashes []uint64
+	for _, blockKey := range storeBlockKeys {
+		if blockHash, ok := currentLayout.parseBlockPath(blockKey); ok {
+			blockKeys = append(blockKeys, blockKey)
+			blockHashes = append(blockHashes, blockHash)
+		}
+	}
+	if dryRun {
+		return len(blockKeys), nil
+	}
+
+	err = forEachBlob(ctx, blobStore, workerCount, len(blockKeys), func(client BlobClient, i int) error {
+		blockPath := layout.BlockPath("chunks", blockHashes[i])
+		if blockKeys[i] == blockPath {
+			return nil
+		}
+		err := copyBlob(client, blockKeys[i], blockPath)
+		if err != nil {
+			return errors.Wrapf(err, "failed to copy block 0x%016x", blockHashes[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "MigrateBlockLayout")
+	}
+	err = writeBlockLayout(blobClient, layout)
+	if err != nil {
+		return 0, errors.Wrap(err, "MigrateBlockLayout")
+	}
+	recordAudit(blobClient, resolveStoreOptions(blobStore, opts), AuditEntry{Operation: AuditMigrateLayout})
+	log.Printf("Copied %d blocks of %s to layout %s\n", len(blockKeys), blobStore.String(), layout)
+
+	err = forEachBlob(ctx, blobStore, workerCount, len(blockKeys), func(client BlobClient, i int) error {
+		if blockKeys[i] == layout.BlockPath("chunks", blockHashes[i]) {
+			return nil
+		}
+		objHandle, err := client.NewObject(blockKeys[i])
+		if err != nil {
+			return err
+		}
+		return objHandle.Delete()
+	})
+	if err != nil {
+		return len(blockKeys), errors.Wrap(err, "MigrateBlockLayout: failed to delete blocks in old layout")
+	}
+	return len(blockKeys), nil
+}
@@ -0,0 +1,114 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestBlockLayoutPaths(t *testing.T) {
+	blockHash := uint64(0xa3b4c5d6e7f80912)
+	if GetBlockPath("chunks", blockHash) != "chunks/a3b4/0xa3b4c5d6e7f80912.lsb" {
+		t.Errorf("TestBlockLayoutPaths() GetBlockPath() %s", GetBlockPath("chunks", blockHash))
+	}
+	layouts := []struct {
+		depth  int
+		width  int
+		path   string
+		prefix string
+	}{
+		{0, 0, "chunks/0xa3b4c5d6e7f80912.lsb", "chunks/0xa3"},
+		{1, 1, "chunks/a/0xa3b4c5d6e7f80912.lsb", "chunks/a/0xa3"},
+		{1, 4, "chunks/a3b4/0xa3b4c5d6e7f80912.lsb", "chunks/a3"},
+		{2, 2, "chunks/a3/b4/0xa3b4c5d6e7f80912.lsb", "chunks/a3"},
+		{3, 1, "chunks/a/3/b/0xa3b4c5d6e7f80912.lsb", "chunks/a/3"},
+	}
+	for _, l := range layouts {
+		layout, err := NewBlockLayout(l.depth, l.width)
+		if err != nil {
+			t.Fatalf("TestBlockLayoutPaths() NewBlockLayout(%d, %d) %v != %v", l.depth, l.width, err, nil)
+		}
+		blockPath := layout.BlockPath("chunks", blockHash)
+		if blockPath != l.path {
+			t.Errorf("TestBlockLayoutPaths() %s BlockPath() %s != %s", layout, blockPath, l.path)
+		}
+		if parsed, ok := layout.parseBlockPath(blockPath); !ok || parsed != blockHash {
+			t.Errorf("TestBlockLayoutPaths() %s parseBlockPath(%s) 0x%016x, %t", layout, blockPath, parsed, ok)
+		}
+		if _, ok := layout.parseBlockPath(DefaultBlockLayout.BlockPath("chunks", blockHash)); ok != (layout == DefaultBlockLayout) {
+			t.Errorf("TestBlockLayoutPaths() %s parseBlockPath() of default layout path %t", layout, ok)
+		}
+		if prefix := layout.hashPrefix("a3"); prefix != l.prefix {
+			t.Errorf("TestBlockLayoutPaths() %s hashPrefix() %s != %s", layout, prefix, l.prefix)
+		}
+	}
+	if _, err := NewBlockLayout(2, 5); err == nil {
+		t.Errorf("TestBlockLayoutPaths() NewBlockLayout(2, 5) %v == %v", err, nil)
+	}
+}
+
+func TestMigrateBlockLayout(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestMigrateBlockLayout() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	var blockHashes []uint64
+	for seed := uint8(0); seed < 4; seed++ {
+		blockHash, errno := storeBlockFromSeed(t, storeAPI, seed)
+		if errno != 0 {
+			t.Fatalf("TestMigrateBlockLayout() storeBlockFromSeed() %d != %d", errno, 0)
+		}
+		blockHashes = append(blockHashes, blockHash)
+	}
+	storeAPI.Dispose()
+
+	layout, _ := NewBlockLayout(2, 2)
+	movedCount, err := MigrateBlockLayout(context.Background(), blobStore, layout, true)
+	if err != nil || movedCount != len(blockHashes) {
+		t.Fatalf("TestMigrateBlockLayout() MigrateBlockLayout() dry run %d, %v", movedCount, err)
+	}
+	movedCount, err = MigrateBlockLayout(context.Background(), blobStore, layout, false)
+	if err != nil || movedCount != len(blockHashes) {
+		t.Fatalf("TestMigrateBlockLayout() MigrateBlockLayout() %d, %v", movedCount, err)
+	}
+
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	storedLayout, err := readBlockLayout(client)
+	if err != nil || storedLayout != layout {
+		t.Errorf("TestMigrateBlockLayout() readBlockLayout() %s, %v != %s", storedLayout, err, layout)
+	}
+	for _, blockHash := range blockHashes {
+		oldBlock, _ := client.NewObject(GetBlockPath("chunks", blockHash))
+		if exists, _ := oldBlock.Exists(); exists {
+			t.Errorf("TestMigrateBlockLayout() block 0x%016x left in old layout", blockHash)
+		}
+	}
+
+	// The store index can be rebuilt from the blocks in the new layout
+	storeIndex, _ := client.NewObject("store.lsi")
+	storeIndex.Delete()
+	recoveredBlockHashes, err := RecoverStoreIndex(context.Background(), blobStore, false)
+	if err != nil || len(recoveredBlockHashes) != len(blockHashes) {
+		t.Errorf("TestMigrateBlockLayout() RecoverStoreIndex() %d, %v", len(recoveredBlockHashes), err)
+	}
+	remoteStore, err = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly)
+	if err != nil {
+		t.Fatalf("TestMigrateBlockLayout() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	for _, blockHash := range blockHashes {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+		if errno != 0 {
+			t.Errorf("TestMigrateBlockLayout() fetchBlockFromStore(0x%016x) %d != %d", blockHash, errno, 0)
+		}
+		storedBlock.Dispose()
+	}
+}
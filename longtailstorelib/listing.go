@@ -0,0 +1,221 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PagedBlobClient is implemented by blob clients that can list the objects under a prefix one page
+// at a time. Stores with millions of blocks are listed with one paged listing per block prefix in
+// parallel instead of one call to GetObjects.
+type PagedBlobClient interface {
+	// GetObjectsPage lists up to pageSize objects with names starting with prefix, starting at
+	// pageToken. Returns the token of the next page, the token is empty for the last page.
+	GetObjectsPage(prefix string, pageToken string, pageSize int) ([]BlobProperties, string, error)
+}
+
+// listPageSize is the maximum number of objects requested per page when listing blocks
+const listPageSize = 1000
+
+// listPrefixCount is the number of block prefixes, one per value of the first byte of the block hash, listed in parallel
+const listPrefixCount = 256
+
+// pagedBlobIterator lists the objects of a PagedBlobClient one page at a time, the next page is
+// requested when the objects of the current page have been used
+type pagedBlobIterator struct {
+	client    PagedBlobClient
+	prefix    string
+	page      []BlobProperties
+	index     int
+	pageToken string
+	lastPage  bool
+	err       error
+}
+
+// newPagedBlobIterator is the ListObjects of blob clients that implement PagedBlobClient
+func newPagedBlobIterator(client PagedBlobClient, prefix string) BlobIterator {
+	return &pagedBlobIterator{client: client, prefix: prefix, index: -1}
+}
+
+func (it *pagedBlobIterator) Next() bool {
+	it.index++
+	for it.index >= len(it.page) {
+		if it.lastPage || it.err != nil {
+			return false
+		}
+		page, nextPageToken, err := it.client.GetObjectsPage(it.prefix, it.pageToken, listPageSize)
+		if err != nil {
+			it.err = errors.Wrapf(err, "failed to list %s", it.prefix)
+			return false
+		}
+		it.page = page
+		it.index = 0
+		it.pageToken = nextPageToken
+		it.lastPage = nextPageToken == ""
+	}
+	return true
+}
+
+func (it *pagedBlobIterator) Blob() BlobProperties {
+	return it.page[it.index]
+}
+
+func (it *pagedBlobIterator) Err() error {
+	return it.err
+}
+
+// listingBlobIterator iterates over the objects of a backend that lists all objects at once, the
+// objects are listed by the first call to Next
+type listingBlobIterator struct {
+	list   func() ([]BlobProperties, error)
+	prefix string
+	blobs  []BlobProperties
+	index  int
+	listed bool
+	err    error
+}
+
+// newListingBlobIterator is the ListObjects of blob clients that can not list a page at a time,
+// the objects returned by list that do not start with prefix are skipped
+func newListingBlobIterator(list func() ([]BlobProperties, error), prefix string) BlobIterator {
+	return &listingBlobIterator{list: list, prefix: prefix, index: -1}
+}
+
+func (it *listingBlobIterator) Next() bool {
+	if !it.listed {
+		it.listed = true
+		it.blobs, it.err = it.list()
+		if it.err != nil {
+			return false
+		}
+	}
+	for it.index++; it.index < len(it.blobs); it.index++ {
+		if strings.HasPrefix(it.blobs[it.index].Name, it.prefix) {
+			return true
+		}
+	}
+	it.blobs = nil
+	return false
+}
+
+func (it *listingBlobIterator) Blob() BlobProperties {
+	return it.blobs[it.index]
+}
+
+func (it *listingBlobIterator) Err() error {
+	return it.err
+}
+
+// forEachObject calls fn for each object with a name starting with prefix as they are listed
+func forEachObject(ctx context.Context, blobClient BlobClient, prefix string, fn func(blob BlobProperties) error) error {
+	it := blobClient.ListObjects(prefix)
+	for it.Next() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := fn(it.Blob())
+		if err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// listObjects lists all objects starting with prefix
+func listObjects(ctx context.Context, blobClient BlobClient, prefix string) ([]BlobProperties, error) {
+	var items []BlobProperties
+	err := forEachObject(ctx, blobClient, prefix, func(blob BlobProperties) error {
+		items = append(items, blob)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// isStoreBlock returns true for the blobs in chunks/ that are complete blocks
+func isStoreBlock(blob BlobProperties) bool {
+	return blob.Size > 0 && strings.HasPrefix(blob.Name, "chunks/") && strings.HasSuffix(blob.Name, ".lsb")
+}
+
+// listStoreBlocks returns the keys of all blocks in the store sorted by name. Clients implementing
+// PagedBlobClient are listed with one paged listing per block prefix, workerCount prefixes at a
+// time, unless the whole store fits in the first page.
+func listStoreBlocks(ctx context.Context, blobStore BlobStore, blobClient BlobClient, layout BlockLayout, workerCount int) ([]string, error) {
+	pagedClient, ok := blobClient.(PagedBlobClient)
+	if !ok {
+		blockKeys, err := listStoreBlockKeys(ctx, blobClient, "chunks/")
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(blockKeys)
+		return blockKeys, nil
+	}
+
+	blobs, nextPageToken, err := pagedClient.GetObjectsPage("chunks/", "", listPageSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "listStoreBlocks: failed to list chunks/")
+	}
+	if nextPageToken == "" {
+		return getStoreBlockKeys(blobs), nil
+	}
+
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	var mutex sync.Mutex
+	var blockKeys []string
+	listedPrefixCount := 0
+	err = forEachBlob(ctx, blobStore, workerCount, listPrefixCount, func(client BlobClient, p int) error {
+		prefixBlockKeys, err := listStoreBlockKeys(ctx, client, layout.hashPrefix(fmt.Sprintf("%02x", p)))
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		blockKeys = append(blockKeys, prefixBlockKeys...)
+		listedPrefixCount++
+		if listedPrefixCount%(listPrefixCount/16) == 0 {
+			log.Printf("Listed %d blocks in %d/%d prefixes of %s\n", len(blockKeys), listedPrefixCount, listPrefixCount, blobStore.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(blockKeys)
+	return blockKeys, nil
+}
+
+// listStoreBlockKeys returns the keys of the blocks with names starting with prefix, the other
+// objects are skipped as they are listed
+func listStoreBlockKeys(ctx context.Context, blobClient BlobClient, prefix string) ([]string, error) {
+	var blockKeys []string
+	err := forEachObject(ctx, blobClient, prefix, func(blob BlobProperties) error {
+		if isStoreBlock(blob) {
+			blockKeys = append(blockKeys, blob.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blockKeys, nil
+}
+
+func getStoreBlockKeys(blobs []BlobProperties) []string {
+	var blockKeys []string
+	for _, blob := range blobs {
+		if isStoreBlock(blob) {
+			blockKeys = append(blockKeys, blob.Name)
+		}
+	}
+	return blockKeys
+}
@@ -0,0 +1,179 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+// unpagedBlobClient hides GetObjectsPage so listing falls back to GetObjects
+type unpagedBlobClient struct {
+	BlobClient
+}
+
+func (c *unpagedBlobClient) ListObjects(prefix string) BlobIterator {
+	return newListingBlobIterator(c.GetObjects, prefix)
+}
+
+// failingPageBlobClient fails to list the pages after the first
+type failingPageBlobClient struct {
+	*testBlobClient
+	pages int
+}
+
+func (c *failingPageBlobClient) GetObjectsPage(prefix string, pageToken string, pageSize int) ([]BlobProperties, string, error) {
+	c.pages++
+	if pageToken != "" {
+		return nil, "", fmt.Errorf("listing failed")
+	}
+	return c.testBlobClient.GetObjectsPage(prefix, pageToken, pageSize)
+}
+
+func TestListStoreBlocks(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+
+	// More blocks than fit in one page so the listing is split per prefix
+	var expected []string
+	for i := 0; i < listPageSize*2+500; i++ {
+		blockKey := GetBlockPath("chunks", uint64(i)*0x9E3779B97F4A7C15)
+		obj, _ := client.NewObject(blockKey)
+		obj.Write([]byte("block"))
+		expected = append(expected, blockKey)
+	}
+	sort.Strings(expected)
+	obj, _ := client.NewObject(GetBlockPath("chunks", 0x1234))
+	obj.Write([]byte{})
+	obj, _ = client.NewObject(trashPath + "/" + GetBlockPath("chunks", 0x5678))
+	obj.Write([]byte("block"))
+	obj, _ = client.NewObject("store.lsi")
+	obj.Write([]byte("index"))
+
+	blockKeys, err := listStoreBlocks(context.Background(), blobStore, client, DefaultBlockLayout, 8)
+	if err != nil {
+		t.Fatalf("TestListStoreBlocks() listStoreBlocks() %v != %v", err, nil)
+	}
+	if len(blockKeys) != len(expected) {
+		t.Fatalf("TestListStoreBlocks() listStoreBlocks() %d != %d", len(blockKeys), len(expected))
+	}
+	for i := range expected {
+		if blockKeys[i] != expected[i] {
+			t.Fatalf("TestListStoreBlocks() listStoreBlocks()[%d] %s != %s", i, blockKeys[i], expected[i])
+		}
+	}
+
+	blockKeys, err = listStoreBlocks(context.Background(), blobStore, &unpagedBlobClient{client}, DefaultBlockLayout, 8)
+	if err != nil {
+		t.Fatalf("TestListStoreBlocks() listStoreBlocks() unpaged %v != %v", err, nil)
+	}
+	if len(blockKeys) != len(expected) {
+		t.Errorf("TestListStoreBlocks() listStoreBlocks() unpaged %d != %d", len(blockKeys), len(expected))
+	}
+}
+
+func TestListObjectsPaged(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	for i := 0; i < listPageSize+1; i++ {
+		obj, _ := client.NewObject(GetBlockPath("chunks", uint64(i)))
+		obj.Write([]byte("block"))
+	}
+	obj, _ := client.NewObject("store.lsi")
+	obj.Write([]byte("index"))
+
+	blobs, err := listObjects(context.Background(), client, "chunks/0000")
+	if err != nil {
+		t.Fatalf("TestListObjectsPaged() listObjects() %v != %v", err, nil)
+	}
+	if len(blobs) != listPageSize+1 {
+		t.Errorf("TestListObjectsPaged() listObjects() %d != %d", len(blobs), listPageSize+1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = listObjects(ctx, client, "chunks/")
+	if err != context.Canceled {
+		t.Errorf("TestListObjectsPaged() listObjects() cancelled %v != %v", err, context.Canceled)
+	}
+}
+
+func TestBlobIterator(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	for i := 0; i < listPageSize*2+1; i++ {
+		obj, _ := client.NewObject(GetBlockPath("chunks", uint64(i)))
+		obj.Write([]byte("block"))
+	}
+	obj, _ := client.NewObject("store.lsi")
+	obj.Write([]byte("index"))
+
+	pagedClient := &failingPageBlobClient{testBlobClient: client.(*testBlobClient)}
+	it := newPagedBlobIterator(pagedClient, "chunks/")
+	if pagedClient.pages != 0 {
+		t.Errorf("TestBlobIterator() newPagedBlobIterator() listed %d pages before Next", pagedClient.pages)
+	}
+	count := 0
+	for it.Next() {
+		count++
+	}
+	if count != listPageSize {
+		t.Errorf("TestBlobIterator() Next() %d != %d", count, listPageSize)
+	}
+	if it.Err() == nil {
+		t.Errorf("TestBlobIterator() Err() %v == %v", it.Err(), nil)
+	}
+	if it.Next() {
+		t.Errorf("TestBlobIterator() Next() after error %t != %t", true, false)
+	}
+
+	for _, c := range []BlobClient{client, &unpagedBlobClient{client}} {
+		names := map[string]bool{}
+		it = c.ListObjects("chunks/")
+		for it.Next() {
+			names[it.Blob().Name] = true
+		}
+		if it.Err() != nil {
+			t.Fatalf("TestBlobIterator() Err() %v != %v", it.Err(), nil)
+		}
+		if len(names) != listPageSize*2+1 || names["store.lsi"] {
+			t.Errorf("TestBlobIterator() ListObjects(\"chunks/\") %d != %d", len(names), listPageSize*2+1)
+		}
+	}
+}
+
+func TestFSBlobStoreListObjects(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_list_test")
+	if err != nil {
+		t.Fatalf("TestFSBlobStoreListObjects() ioutil.TempDir() %v", err)
+	}
+	defer os.RemoveAll(storePath)
+	blobStore, _ := NewFSBlobStore(storePath)
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	for _, name := range []string{"chunks/0001/0x0001000000000000.lsb", "chunks/0002/0x0002000000000000.lsb", "trash/1/chunks/0001/0x0001000000000000.lsb", "store.lsi"} {
+		obj, _ := client.NewObject(name)
+		obj.Write([]byte("data"))
+	}
+
+	blobs, err := listObjects(context.Background(), client, "chunks/0001/")
+	if err != nil {
+		t.Fatalf("TestFSBlobStoreListObjects() listObjects() %v != %v", err, nil)
+	}
+	if len(blobs) != 1 || blobs[0].Name != "chunks/0001/0x0001000000000000.lsb" {
+		t.Errorf("TestFSBlobStoreListObjects() listObjects() %v", blobs)
+	}
+	blobs, err = listObjects(context.Background(), client, "chunks/000")
+	if err != nil || len(blobs) != 2 {
+		t.Errorf("TestFSBlobStoreListObjects() listObjects() %v, %v", blobs, err)
+	}
+	blobs, err = listObjects(context.Background(), client, "missing/")
+	if err != nil || len(blobs) != 0 {
+		t.Errorf("TestFSBlobStoreListObjects() listObjects() missing %v, %v", blobs, err)
+	}
+}
@@ -0,0 +1,202 @@
+package longtailstorelib
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// Memory kinds of MemoryStats
+const (
+	MemoryPrefetch   = "prefetch"
+	MemoryPuts       = "puts"
+	MemoryStoreIndex = "store-index"
+)
+
+type memoryKind int
+
+const (
+	memoryPrefetch memoryKind = iota
+	memoryPuts
+	memoryStoreIndex
+	memoryKindCount
+)
+
+var memoryKindNames = [memoryKindCount]string{MemoryPrefetch, MemoryPuts, MemoryStoreIndex}
+
+// MemoryUsage is the memory of one kind accounted to the remote block store
+type MemoryUsage struct {
+	Kind  string
+	Bytes int64
+}
+
+// MemoryStats is the memory held by the remote block store, see WithMaxMemory. It covers the
+// prefetched blocks nobody has asked for yet, the blocks queued or being put and the store index.
+type MemoryStats struct {
+	// Limit is the hard cap of WithMaxMemory, zero is unlimited
+	Limit int64
+	// Used is the memory accounted to the store now and PeakUsed the most it has held
+	Used     int64
+	PeakUsed int64
+	// Usage is Used by kind
+	Usage []MemoryUsage
+	// WaitCount is the number of puts that waited for the store to get below the limit and
+	// WaitTime the total time they waited
+	WaitCount uint64
+	WaitTime  time.Duration
+	// TimeoutCount is the number of puts that were failed as the store stayed above the limit for
+	// the queue timeout, see WithQueueTimeout
+	TimeoutCount uint64
+}
+
+// MemoryStatsProvider is implemented by block stores that account their memory
+type MemoryStatsProvider interface {
+	GetMemoryStats() MemoryStats
+}
+
+// memoryAccount is the memory held by a remote block store. Puts wait in acquire while the store
+// is above the limit, prefetches are not started while it is above the limit and the store index
+// is accounted but never waits as the store can not work without it. A put is let through when no
+// other put is in flight, otherwise a single block larger than the limit, or a store index that
+// fills it, would wait forever.
+type memoryAccount struct {
+	lock     sync.Mutex
+	limit    int64
+	used     int64
+	peak     int64
+	usage    [memoryKindCount]int64
+	released chan struct{}
+
+	waitCount    uint64
+	waitNanos    int64
+	timeoutCount uint64
+}
+
+func newMemoryAccount(limit int64) *memoryAccount {
+	return &memoryAccount{limit: limit, released: make(chan struct{})}
+}
+
+func (m *memoryAccount) addLocked(kind memoryKind, bytes int64) {
+	m.usage[kind] += bytes
+	m.used += bytes
+	if m.used > m.peak {
+		m.peak = m.used
+	}
+	if bytes < 0 {
+		close(m.released)
+		m.released = make(chan struct{})
+	}
+}
+
+// add accounts bytes of kind without waiting, a negative size releases memory
+func (m *memoryAccount) add(kind memoryKind, bytes int64) {
+	if bytes == 0 {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.addLocked(kind, bytes)
+}
+
+// set replaces the memory accounted to kind
+func (m *memoryAccount) set(kind memoryKind, bytes int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if bytes != m.usage[kind] {
+		m.addLocked(kind, bytes-m.usage[kind])
+	}
+}
+
+// overLimit returns true if the store holds as much memory as the limit allows
+func (m *memoryAccount) overLimit() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.limit > 0 && m.used >= m.limit
+}
+
+// acquire accounts bytes of kind once they fit in the limit. It returns false if they did not fit
+// within timeout, a zero timeout waits until they fit.
+func (m *memoryAccount) acquire(kind memoryKind, bytes int64, timeout time.Duration) bool {
+	var start time.Time
+	var timer *time.Timer
+	var timedOut <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	m.lock.Lock()
+	for {
+		if m.limit <= 0 || m.used+bytes <= m.limit || m.usage[memoryPuts] == 0 {
+			m.addLocked(kind, bytes)
+			if !start.IsZero() {
+				m.waitNanos += int64(time.Since(start))
+			}
+			m.lock.Unlock()
+			return true
+		}
+		if start.IsZero() {
+			start = time.Now()
+			m.waitCount++
+			if timeout > 0 {
+				timer = time.NewTimer(timeout)
+				timedOut = timer.C
+			}
+		}
+		released := m.released
+		m.lock.Unlock()
+		select {
+		case <-released:
+			m.lock.Lock()
+		case <-timedOut:
+			m.lock.Lock()
+			m.waitNanos += int64(time.Since(start))
+			m.timeoutCount++
+			m.lock.Unlock()
+			return false
+		}
+	}
+}
+
+func (m *memoryAccount) stats() MemoryStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats := MemoryStats{
+		Limit:        m.limit,
+		Used:         m.used,
+		PeakUsed:     m.peak,
+		Usage:        make([]MemoryUsage, memoryKindCount),
+		WaitCount:    m.waitCount,
+		WaitTime:     time.Duration(m.waitNanos),
+		TimeoutCount: m.timeoutCount}
+	for kind := range m.usage {
+		stats.Usage[kind] = MemoryUsage{Kind: memoryKindNames[kind], Bytes: m.usage[kind]}
+	}
+	return stats
+}
+
+// GetMemoryStats returns the memory held by the store, see WithMaxMemory
+func (s *remoteStore) GetMemoryStats() MemoryStats {
+	return s.memory.stats()
+}
+
+// addPrefetchMemory accounts the prefetched blocks that nobody has asked for yet
+func (s *remoteStore) addPrefetchMemory(bytes int64) {
+	atomic.AddInt64(&s.prefetchMemory, bytes)
+	s.memory.add(memoryPrefetch, bytes)
+}
+
+// canPrefetch returns true if the store has room for more prefetched blocks
+func (s *remoteStore) canPrefetch() bool {
+	return atomic.LoadInt64(&s.prefetchMemory) < s.maxPrefetchMemory && !s.memory.overLimit()
+}
+
+// storeIndexMemory returns the memory used by storeIndex, zero if it is not loaded
+func storeIndexMemory(storeIndex longtaillib.Longtail_StoreIndex) int64 {
+	if !storeIndex.IsValid() {
+		return 0
+	}
+	return int64(storeIndex.GetSize())
+}
@@ -0,0 +1,94 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestMemoryAccount(t *testing.T) {
+	memory := newMemoryAccount(100)
+	if !memory.acquire(memoryPuts, 60, 0) {
+		t.Fatalf("TestMemoryAccount() acquire() below the limit failed")
+	}
+	if memory.acquire(memoryPuts, 60, 10*time.Millisecond) {
+		t.Errorf("TestMemoryAccount() acquire() above the limit did not time out")
+	}
+
+	acquired := make(chan bool, 1)
+	go func() {
+		acquired <- memory.acquire(memoryPuts, 60, 0)
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("TestMemoryAccount() acquire() did not wait for the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	memory.add(memoryPuts, -60)
+	if ok := <-acquired; !ok {
+		t.Errorf("TestMemoryAccount() acquire() after release failed")
+	}
+
+	// The store index never waits, a put is let through when no other put is in flight
+	memory.set(memoryStoreIndex, 500)
+	if !memory.overLimit() {
+		t.Errorf("TestMemoryAccount() overLimit() with the store index above the limit")
+	}
+	memory.add(memoryPuts, -60)
+	if !memory.acquire(memoryPuts, 60, 10*time.Millisecond) {
+		t.Errorf("TestMemoryAccount() acquire() without puts in flight failed")
+	}
+	memory.add(memoryPuts, -60)
+	memory.set(memoryStoreIndex, 0)
+
+	stats := memory.stats()
+	if stats.Used != 0 || stats.PeakUsed != 560 || stats.WaitCount != 2 || stats.TimeoutCount != 1 {
+		t.Errorf("TestMemoryAccount() stats() %+v", stats)
+	}
+	if len(stats.Usage) != 3 || stats.Usage[1].Kind != MemoryPuts || stats.Usage[2].Kind != MemoryStoreIndex {
+		t.Errorf("TestMemoryAccount() stats() usage %+v", stats.Usage)
+	}
+}
+
+func TestRemoteStoreMaxMemory(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	innerStore, _ := NewTestBlobStore("the_path")
+	blobStore := NewFaultyBlobStore(innerStore, FaultConfig{Latency: 20 * time.Millisecond, PathPrefix: "chunks/"})
+	store, err := NewRemoteBlockStore(jobs, blobStore, "", 4, ReadWrite, WithMaxMemory(1))
+	if err != nil {
+		t.Fatalf("TestRemoteStoreMaxMemory() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(store)
+	defer storeAPI.Dispose()
+
+	// Every block is above the limit so the puts go to the store one at a time
+	var wg sync.WaitGroup
+	for seed := 0; seed < 4; seed++ {
+		wg.Add(1)
+		go func(seed uint8) {
+			defer wg.Done()
+			if _, errno := storeBlockFromSeed(t, storeAPI, seed); errno != 0 {
+				t.Errorf("TestRemoteStoreMaxMemory() storeBlockFromSeed(%d) %d != %d", seed, errno, 0)
+			}
+		}(uint8(seed * 4))
+	}
+	wg.Wait()
+	if errno := flushRemoteStore(storeAPI); errno != 0 {
+		t.Fatalf("TestRemoteStoreMaxMemory() Flush() %d != %d", errno, 0)
+	}
+
+	stats := store.(MemoryStatsProvider).GetMemoryStats()
+	if stats.Limit != 1 || stats.WaitCount == 0 || stats.TimeoutCount != 0 {
+		t.Errorf("TestRemoteStoreMaxMemory() GetMemoryStats() %+v", stats)
+	}
+	if stats.Usage[memoryPuts].Bytes != 0 || stats.Usage[memoryStoreIndex].Bytes == 0 || stats.Used != stats.Usage[memoryStoreIndex].Bytes {
+		t.Errorf("TestRemoteStoreMaxMemory() GetMemoryStats() usage %+v", stats.Usage)
+	}
+	if indexed := getStoreIndexBlockHashes(t, innerStore); len(indexed) != 4 {
+		t.Errorf("TestRemoteStoreMaxMemory() store index has %d blocks, expected %d", len(indexed), 4)
+	}
+}
@@ -0,0 +1,606 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// The progress of MigrateStore is kept in the target store so an interrupted migration resumes
+// where it left off, migrateIndexPath is the store index of the blocks migrated so far
+const (
+	migrateStatePath = "migrate/state.json"
+	migrateIndexPath = "migrate/store.lsi"
+)
+
+// migrateBatchSize is the number of blocks migrated between checks if the progress should be saved
+const migrateBatchSize = 256
+
+// migrateCheckpointInterval is how often MigrateStore saves its progress
+var migrateCheckpointInterval = time.Minute
+
+// MigrateOptions is the format MigrateStore converts a store to
+type MigrateOptions struct {
+	// Layout is the block layout of the migrated store, the zero value keeps the layout of the store
+	Layout BlockLayout
+	// Recompress rewrites the blocks that are not compressed with CompressionType. The compression
+	// type of a block is its tag, see longtailapi.GetCompressionType.
+	Recompress      bool
+	CompressionType uint32
+}
+
+// StoreCompatibility describes the format of a store and what MigrateStore changes
+type StoreCompatibility struct {
+	Layout BlockLayout
+	// LayoutRecorded is false for stores without layout.json, they use DefaultBlockLayout
+	LayoutRecorded    bool
+	StoreIndexVersion uint32
+	// CurrentStoreIndexVersion is the store index version written by this version of longtail
+	CurrentStoreIndexVersion uint32
+	BlockCount               int
+	// BlockCountByCompression is the number of blocks of each compression type
+	BlockCountByCompression map[uint32]int
+	// RecompressedBlockCount is the number of blocks MigrateStore recompresses
+	RecompressedBlockCount int
+	// Changes lists what MigrateStore changes, it is empty if the store already has the format
+	Changes []string
+	// Warnings lists the clients that can not use the migrated store
+	Warnings []string
+}
+
+// MigrateResult holds the blocks written by MigrateStore
+type MigrateResult struct {
+	// CopiedBlockCount is the number of blocks written unchanged to a new path or store
+	CopiedBlockCount int
+	// RecompressedBlockCount is the number of blocks rewritten with a new compression type
+	RecompressedBlockCount int
+	// ResumedBlockCount is the number of blocks migrated by an earlier, interrupted, MigrateStore
+	ResumedBlockCount int
+}
+
+type migrateState struct {
+	Source             string      `json:"source"`
+	Layout             BlockLayout `json:"layout"`
+	Recompress         bool        `json:"recompress"`
+	CompressionType    uint32      `json:"compressionType"`
+	MigratedBlockCount int         `json:"migratedBlockCount"`
+}
+
+func (state migrateState) sameMigration(other migrateState) bool {
+	return state.Source == other.Source && state.Layout == other.Layout && state.Recompress == other.Recompress && state.CompressionType == other.CompressionType
+}
+
+// CurrentStoreIndexVersion returns the version of the store indexes created by the native library
+func CurrentStoreIndexVersion() (uint32, error) {
+	storeIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	if errno != 0 {
+		return 0, longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+	}
+	defer storeIndex.Dispose()
+	return storeIndex.GetVersion(), nil
+}
+
+// readStoreIndexObject reads the store index at key, the returned index is not valid if it does not exist
+func readStoreIndexObject(blobClient BlobClient, key string) (longtaillib.Longtail_StoreIndex, error) {
+	blob, err := readScrubBlob(blobClient, key)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "failed to read %s", key)
+	}
+	if blob == nil {
+		return longtaillib.Longtail_StoreIndex{}, nil
+	}
+	return readStoreIndexData(blobClient.String(), key, blob)
+}
+
+func writeStoreIndexObject(blobClient BlobClient, key string, storeIndex longtaillib.Longtail_StoreIndex) error {
+	blob, err := writeStoreIndexData(storeIndex)
+	if err != nil {
+		return errors.Wrapf(err, "writeStoreIndexData() for %s failed", key)
+	}
+	return writeJSONObjectData(blobClient, key, blob)
+}
+
+// writeJSONObjectData replaces the object at key, it is only used for objects written by a single
+// maintenance command at a time
+func writeJSONObjectData(blobClient BlobClient, key string, data []byte) error {
+	objHandle, err := blobClient.NewObject(key)
+	if err != nil {
+		return err
+	}
+	// Lock the version so the object may be replaced in immutable stores
+	_, err = objHandle.LockWriteVersion()
+	if err != nil {
+		return errors.Wrapf(err, "objHandle.LockWriteVersion(%s) failed", key)
+	}
+	ok, err := objHandle.Write(data)
+	if err != nil {
+		return errors.Wrapf(err, "objHandle.Write(%s) failed", key)
+	}
+	if !ok {
+		return fmt.Errorf("%s was changed by someone else", key)
+	}
+	return nil
+}
+
+// CheckStoreCompatibility reports the format of the store and what MigrateStore with options changes
+func CheckStoreCompatibility(ctx context.Context, blobStore BlobStore, options MigrateOptions) (StoreCompatibility, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return StoreCompatibility{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	compatibility, err := checkStoreCompatibility(blobClient, options)
+	if err != nil {
+		return StoreCompatibility{}, errors.Wrap(err, "CheckStoreCompatibility")
+	}
+	return compatibility, nil
+}
+
+func checkStoreCompatibility(blobClient BlobClient, options MigrateOptions) (StoreCompatibility, error) {
+	compatibility := StoreCompatibility{BlockCountByCompression: map[uint32]int{}}
+	var err error
+	compatibility.Layout, err = readBlockLayout(blobClient)
+	if err != nil {
+		return compatibility, err
+	}
+	layoutObject, err := blobClient.NewObject(blockLayoutKey)
+	if err != nil {
+		return compatibility, err
+	}
+	compatibility.LayoutRecorded, err = layoutObject.Exists()
+	if err != nil {
+		return compatibility, err
+	}
+	compatibility.CurrentStoreIndexVersion, err = CurrentStoreIndexVersion()
+	if err != nil {
+		return compatibility, err
+	}
+	storeIndex, err := readStoreIndexObject(blobClient, "store.lsi")
+	if err != nil {
+		return compatibility, err
+	}
+	if !storeIndex.IsValid() {
+		return compatibility, errors.Wrapf(longtaillib.ErrENOENT, "%s has no store index, run recover-index first", blobClient.String())
+	}
+	defer storeIndex.Dispose()
+	compatibility.StoreIndexVersion = storeIndex.GetVersion()
+	compatibility.BlockCount = int(storeIndex.GetBlockCount())
+	for _, tag := range storeIndex.GetBlockTags() {
+		compatibility.BlockCountByCompression[tag]++
+		if options.Recompress && tag != options.CompressionType {
+			compatibility.RecompressedBlockCount++
+		}
+	}
+
+	layout := options.Layout
+	if layout == (BlockLayout{}) {
+		layout = compatibility.Layout
+	}
+	if compatibility.StoreIndexVersion != compatibility.CurrentStoreIndexVersion {
+		compatibility.Changes = append(compatibility.Changes, fmt.Sprintf("store index version %d is rewritten as version %d", compatibility.StoreIndexVersion, compatibility.CurrentStoreIndexVersion))
+		compatibility.Warnings = append(compatibility.Warnings, fmt.Sprintf("clients that only read store index version %d can not read the migrated store", compatibility.StoreIndexVersion))
+	}
+	if layout != compatibility.Layout {
+		compatibility.Changes = append(compatibility.Changes, fmt.Sprintf("blocks move from layout %s to %s", compatibility.Layout, layout))
+	}
+	if layout != DefaultBlockLayout {
+		compatibility.Warnings = append(compatibility.Warnings, "clients that do not read layout.json look for blocks in the default layout and can not read the migrated store")
+	}
+	if compatibility.RecompressedBlockCount > 0 {
+		compatibility.Changes = append(compatibility.Changes, fmt.Sprintf("%d blocks are recompressed with compression type 0x%08x", compatibility.RecompressedBlockCount, options.CompressionType))
+	}
+	return compatibility, nil
+}
+
+// migrateWorker migrates single blocks, each worker has its own clients and codec
+type migrateWorker struct {
+	sourceClient BlobClient
+	targetClient BlobClient
+	codec        *blockCodec
+}
+
+// migrateBlock writes the block at position b of storeIndex to targetPath, recompressed if
+// recompress is set, and returns its block index in the migrated store
+func (w *migrateWorker) migrateBlock(
+	storeIndex longtaillib.Longtail_StoreIndex,
+	b int,
+	sourcePath string,
+	targetPath string,
+	recompress bool,
+	compressionType uint32) (longtaillib.Longtail_BlockIndex, error) {
+	blockHash := storeIndex.GetBlockHashes()[b]
+	blob, err := readScrubBlob(w.sourceClient, sourcePath)
+	if err != nil {
+		return longtaillib.Longtail_BlockIndex{}, errors.Wrapf(err, "failed to read block 0x%016x", blockHash)
+	}
+	if blob == nil {
+		return longtaillib.Longtail_BlockIndex{}, errors.Wrapf(longtaillib.ErrENOENT, "block 0x%016x in the store index is missing, run scrub to find missing blocks", blockHash)
+	}
+	var blockIndex longtaillib.Longtail_BlockIndex
+	if recompress {
+		storedBlock, errno := w.codec.decode(blockHash, blob)
+		if errno != 0 {
+			return longtaillib.Longtail_BlockIndex{}, &BlockCorruptError{BlockHash: blockHash, Path: sourcePath, Reason: longtaillib.ErrnoToError(errno, longtaillib.ErrEBADF)}
+		}
+		decodedIndex := storedBlock.GetBlockIndex()
+		recompressedBlock, errno := longtaillib.CreateStoredBlock(
+			blockHash,
+			decodedIndex.GetHashIdentifier(),
+			compressionType,
+			decodedIndex.GetChunkHashes(),
+			decodedIndex.GetChunkSizes(),
+			storedBlock.GetChunksBlockData(),
+			false)
+		storedBlock.Dispose()
+		if errno != 0 {
+			return longtaillib.Longtail_BlockIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.CreateStoredBlock() for block 0x%016x failed", blockHash)
+		}
+		blob, errno = w.codec.encode(recompressedBlock)
+		if errno != 0 {
+			recompressedBlock.Dispose()
+			return longtaillib.Longtail_BlockIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "failed to compress block 0x%016x with compression type 0x%08x", blockHash, compressionType)
+		}
+		recompressedIndex := recompressedBlock.GetBlockIndex()
+		blockIndex, err = recompressedIndex.Copy()
+		recompressedBlock.Dispose()
+		if err != nil {
+			return longtaillib.Longtail_BlockIndex{}, err
+		}
+	} else {
+		var errno int
+		blockIndex, errno = storeIndex.GetBlockIndex(uint32(b))
+		if errno != 0 {
+			return longtaillib.Longtail_BlockIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "storeIndex.GetBlockIndex() failed")
+		}
+	}
+	objHandle, err := w.targetClient.NewObject(targetPath)
+	if err == nil {
+		var ok bool
+		ok, err = objHandle.Write(blob)
+		if err == nil && !ok {
+			err = fmt.Errorf("write of %s was rejected", targetPath)
+		}
+	}
+	if err != nil {
+		blockIndex.Dispose()
+		return longtaillib.Longtail_BlockIndex{}, errors.Wrapf(err, "failed to write block 0x%016x", blockHash)
+	}
+	return blockIndex, nil
+}
+
+// MigrateStore converts the store to the block layout and compression of options and rewrites the
+// store index in the current store index version, see CheckStoreCompatibility. The blocks are
+// migrated into target if it is not nil and in place otherwise. The progress is saved every minute
+// so MigrateStore with the same options resumes an interrupted migration.
+//
+// In place, the moved blocks are copied before the layout is recorded and the old copies are deleted
+// after so readers are not affected. Recompressed blocks keep their block hash. Do not upsync to the
+// store while it is migrated, the store index update fails if the index was changed and MigrateStore
+// has to be run again.
+func MigrateStore(
+	ctx context.Context,
+	source BlobStore,
+	target BlobStore,
+	options MigrateOptions,
+	opts ...StoreOption) (MigrateResult, error) {
+	result := MigrateResult{}
+	inPlace := target == nil
+	if inPlace {
+		target = source
+	}
+	if options.Layout != (BlockLayout{}) {
+		err := options.Layout.validate()
+		if err != nil {
+			return result, errors.Wrap(err, "MigrateStore")
+		}
+	}
+	sourceClient, err := source.NewClient(ctx)
+	if err != nil {
+		return result, errors.Wrap(err, source.String())
+	}
+	defer sourceClient.Close()
+	targetClient, err := target.NewClient(ctx)
+	if err != nil {
+		return result, errors.Wrap(err, target.String())
+	}
+	defer targetClient.Close()
+
+	sourceLayout, err := readBlockLayout(sourceClient)
+	if err != nil {
+		return result, errors.Wrap(err, "MigrateStore")
+	}
+	layout := options.Layout
+	if layout == (BlockLayout{}) {
+		layout = sourceLayout
+	}
+	if inPlace && (layout != sourceLayout || options.Recompress) && resolveStoreOptions(source, opts).Immutable {
+		return result, errors.Wrap(ErrImmutable, source.String())
+	}
+
+	// The version of the source store index is locked first so an upsync during the migration is detected
+	sourceIndexObject, err := sourceClient.NewObject("store.lsi")
+	if err != nil {
+		return result, errors.Wrap(err, "MigrateStore")
+	}
+	exists, err := sourceIndexObject.LockWriteVersion()
+	if err != nil {
+		return result, errors.Wrapf(err, "MigrateStore: failed to lock store index of %s", source.String())
+	}
+	if !exists {
+		return result, errors.Wrapf(longtaillib.ErrENOENT, "MigrateStore: %s has no store index, run recover-index first", source.String())
+	}
+	storeIndex, err := readStoreIndexObject(sourceClient, "store.lsi")
+	if err != nil {
+		return result, errors.Wrap(err, "MigrateStore")
+	}
+	defer storeIndex.Dispose()
+
+	state := migrateState{Source: source.String(), Layout: layout, Recompress: options.Recompress, CompressionType: options.CompressionType}
+	migratedIndex, err := resumeMigration(targetClient, state, inPlace)
+	if err != nil {
+		return result, errors.Wrap(err, "MigrateStore")
+	}
+	defer func() {
+		migratedIndex.Dispose()
+	}()
+	migrated := map[uint64]bool{}
+	for _, blockHash := range migratedIndex.GetBlockHashes() {
+		migrated[blockHash] = true
+	}
+	result.ResumedBlockCount = len(migrated)
+	state.MigratedBlockCount = len(migrated)
+
+	blockHashes := storeIndex.GetBlockHashes()
+	blockTags := storeIndex.GetBlockTags()
+	order := make([]int, 0, len(blockHashes))
+	for b, blockHash := range blockHashes {
+		if !migrated[blockHash] {
+			order = append(order, b)
+		}
+	}
+	sort.Slice(order, func(i, j int) bool { return blockHashes[order[i]] < blockHashes[order[j]] })
+
+	workerCount := newStoreOptions(opts).WorkerCount
+	if workerCount <= 0 {
+		workerCount = 8
+	}
+	if workerCount > migrateBatchSize {
+		workerCount = migrateBatchSize
+	}
+	workers := make([]*migrateWorker, 0, workerCount)
+	defer func() {
+		for _, worker := range workers {
+			worker.codec.dispose()
+			worker.sourceClient.Close()
+			worker.targetClient.Close()
+		}
+	}()
+	for w := 0; w < workerCount; w++ {
+		workerSourceClient, err := source.NewClient(ctx)
+		if err != nil {
+			return result, errors.Wrap(err, source.String())
+		}
+		workerTargetClient, err := target.NewClient(ctx)
+		if err != nil {
+			workerSourceClient.Close()
+			return result, errors.Wrap(err, target.String())
+		}
+		workers = append(workers, &migrateWorker{sourceClient: workerSourceClient, targetClient: workerTargetClient, codec: newBlockCodec()})
+	}
+
+	// checkpoint adds the blocks migrated since the last checkpoint to the saved progress
+	var pending []longtaillib.Longtail_BlockIndex
+	lastCheckpoint := time.Now()
+	checkpoint := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		batchIndex, errno := longtaillib.CreateStoreIndexFromBlocks(pending)
+		for _, blockIndex := range pending {
+			blockIndex.Dispose()
+		}
+		pending = nil
+		if errno != 0 {
+			return longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+		}
+		mergedIndex, errno := longtaillib.MergeStoreIndex(migratedIndex, batchIndex)
+		batchIndex.Dispose()
+		if errno != 0 {
+			return longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+		}
+		migratedIndex.Dispose()
+		migratedIndex = mergedIndex
+		lastCheckpoint = time.Now()
+		err := writeStoreIndexObject(targetClient, migrateIndexPath, migratedIndex)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return writeJSONObjectData(targetClient, migrateStatePath, data)
+	}
+	defer func() {
+		for _, blockIndex := range pending {
+			blockIndex.Dispose()
+		}
+	}()
+
+	for batchStart := 0; batchStart < len(order); batchStart += migrateBatchSize {
+		batch := order[batchStart:]
+		if len(batch) > migrateBatchSize {
+			batch = batch[:migrateBatchSize]
+		}
+		blockIndexes := make([]longtaillib.Longtail_BlockIndex, len(batch))
+		recompressed := make([]bool, len(batch))
+		errs := make([]error, len(batch))
+		positions := make(chan int, len(batch))
+		for i := range batch {
+			positions <- i
+		}
+		close(positions)
+		var wg sync.WaitGroup
+		for _, worker := range workers {
+			wg.Add(1)
+			go func(worker *migrateWorker) {
+				defer wg.Done()
+				for i := range positions {
+					if ctx.Err() != nil {
+						errs[i] = ctx.Err()
+						continue
+					}
+					b := batch[i]
+					sourcePath := sourceLayout.BlockPath("chunks", blockHashes[b])
+					targetPath := layout.BlockPath("chunks", blockHashes[b])
+					recompressed[i] = options.Recompress && blockTags[b] != options.CompressionType
+					if inPlace && !recompressed[i] && sourcePath == targetPath {
+						var errno int
+						blockIndexes[i], errno = storeIndex.GetBlockIndex(uint32(b))
+						if errno != 0 {
+							errs[i] = longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+						}
+						continue
+					}
+					blockIndexes[i], errs[i] = worker.migrateBlock(storeIndex, b, sourcePath, targetPath, recompressed[i], options.CompressionType)
+				}
+			}(worker)
+		}
+		wg.Wait()
+
+		var firstErr error
+		for i := range batch {
+			if errs[i] != nil {
+				if firstErr == nil {
+					firstErr = errs[i]
+				}
+				continue
+			}
+			pending = append(pending, blockIndexes[i])
+			state.MigratedBlockCount++
+			if recompressed[i] {
+				result.RecompressedBlockCount++
+			} else if !inPlace || sourceLayout != layout {
+				result.CopiedBlockCount++
+			}
+		}
+		if firstErr != nil || time.Since(lastCheckpoint) >= migrateCheckpointInterval {
+			err := checkpoint()
+			if err != nil {
+				log.Printf("WARNING: Failed to save migration progress of %s: %v\n", target.String(), err)
+			}
+		}
+		if firstErr != nil {
+			return result, errors.Wrapf(firstErr, "MigrateStore: migrated %d of %d blocks, run again with the same options to resume", state.MigratedBlockCount, len(blockHashes))
+		}
+		log.Printf("Migrated %d/%d blocks of %s\n", state.MigratedBlockCount, len(blockHashes), source.String())
+	}
+	err = checkpoint()
+	if err != nil {
+		return result, errors.Wrap(err, "MigrateStore: failed to save migration progress")
+	}
+
+	if !inPlace || layout != sourceLayout {
+		err = writeBlockLayout(targetClient, layout)
+		if err != nil {
+			return result, errors.Wrap(err, "MigrateStore")
+		}
+	}
+	storeIndexBlob, err := writeStoreIndexData(migratedIndex)
+	if err != nil {
+		return result, errors.Wrap(err, "MigrateStore: writeStoreIndexData() failed")
+	}
+	targetIndexObject := sourceIndexObject
+	if !inPlace {
+		targetIndexObject, err = targetClient.NewObject("store.lsi")
+		if err == nil {
+			_, err = targetIndexObject.LockWriteVersion()
+		}
+		if err != nil {
+			return result, errors.Wrapf(err, "MigrateStore: failed to lock store index of %s", target.String())
+		}
+	}
+	ok, err := targetIndexObject.Write(storeIndexBlob)
+	if err != nil {
+		return result, errors.Wrapf(err, "MigrateStore: failed to write store index of %s", target.String())
+	}
+	if !ok {
+		return result, fmt.Errorf("MigrateStore: the store index of %s was changed during the migration, run again with the same options to migrate the new blocks", target.String())
+	}
+	recordAudit(targetClient, resolveStoreOptions(target, opts), AuditEntry{Operation: AuditMigrateStore, IndexBlockCount: int(migratedIndex.GetBlockCount())})
+
+	if inPlace && layout != sourceLayout {
+		for _, blockHash := range blockHashes {
+			objHandle, err := targetClient.NewObject(sourceLayout.BlockPath("chunks", blockHash))
+			if err == nil {
+				err = objHandle.Delete()
+			}
+			if err != nil {
+				log.Printf("WARNING: Failed to delete block 0x%016x in layout %s: %v\n", blockHash, sourceLayout, err)
+			}
+		}
+	}
+	for _, key := range []string{migrateStatePath, migrateIndexPath} {
+		objHandle, err := targetClient.NewObject(key)
+		if err == nil {
+			err = objHandle.Delete()
+		}
+		if err != nil {
+			log.Printf("WARNING: Failed to delete %s of %s: %v\n", key, target.String(), err)
+		}
+	}
+	return result, nil
+}
+
+// resumeMigration returns the store index of the blocks migrated by an earlier run of the same
+// migration, an empty store index if there is none
+func resumeMigration(targetClient BlobClient, state migrateState, inPlace bool) (longtaillib.Longtail_StoreIndex, error) {
+	emptyIndex := func() (longtaillib.Longtail_StoreIndex, error) {
+		storeIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+		if errno != 0 {
+			return longtaillib.Longtail_StoreIndex{}, longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+		}
+		return storeIndex, nil
+	}
+	data, err := readScrubBlob(targetClient, migrateStatePath)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, err
+	}
+	if data != nil {
+		savedState := migrateState{}
+		err = json.Unmarshal(data, &savedState)
+		if err == nil && savedState.sameMigration(state) {
+			migratedIndex, err := readStoreIndexObject(targetClient, migrateIndexPath)
+			if err != nil {
+				return longtaillib.Longtail_StoreIndex{}, err
+			}
+			if migratedIndex.IsValid() {
+				log.Printf("Resuming migration of %s with %d migrated blocks\n", state.Source, migratedIndex.GetBlockCount())
+				return migratedIndex, nil
+			}
+		} else {
+			log.Printf("Discarding progress of an earlier migration of %s to another format\n", savedState.Source)
+		}
+	}
+	if !inPlace {
+		targetIndexObject, err := targetClient.NewObject("store.lsi")
+		if err != nil {
+			return longtaillib.Longtail_StoreIndex{}, err
+		}
+		exists, err := targetIndexObject.Exists()
+		if err != nil {
+			return longtaillib.Longtail_StoreIndex{}, err
+		}
+		if exists {
+			return longtaillib.Longtail_StoreIndex{}, fmt.Errorf("%s already has a store index, migrate into an empty store", targetClient.String())
+		}
+	}
+	return emptyIndex()
+}
@@ -0,0 +1,161 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func createMigrateTestStore(t *testing.T, path string) []uint64 {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+	hashAPI, errno := hashRegistry.GetHashAPI(longtaillib.GetBlake3HashIdentifier())
+	if errno != 0 {
+		t.Fatalf("createMigrateTestStore() hashRegistry.GetHashAPI() %d != %d", errno, 0)
+	}
+	blobStore, _ := NewFSBlobStore(path)
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("createMigrateTestStore() NewRemoteBlockStore(%s) %v != %v", path, err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	var blockHashes []uint64
+	for seed := uint8(1); seed <= 4; seed++ {
+		storedBlock := createHashedStoredBlock(t, hashAPI, seed)
+		blockIndex := storedBlock.GetBlockIndex()
+		blockHashes = append(blockHashes, blockIndex.GetBlockHash())
+		errno := putStoredBlockSync(storeAPI, storedBlock)
+		storedBlock.Dispose()
+		if errno != 0 {
+			t.Fatalf("createMigrateTestStore() putStoredBlockSync() %d != %d", errno, 0)
+		}
+	}
+	return blockHashes
+}
+
+func readMigrateTestTags(t *testing.T, blobStore BlobStore) []uint32 {
+	blobClient, _ := blobStore.NewClient(context.Background())
+	defer blobClient.Close()
+	storeIndex, err := readStoreIndexObject(blobClient, "store.lsi")
+	if err != nil || !storeIndex.IsValid() {
+		t.Fatalf("readMigrateTestTags() readStoreIndexObject() %v != %v", err, nil)
+	}
+	defer storeIndex.Dispose()
+	return append([]uint32{}, storeIndex.GetBlockTags()...)
+}
+
+func TestMigrateStore(t *testing.T) {
+	sourcePath, _ := ioutil.TempDir("", "longtail-source")
+	defer os.RemoveAll(sourcePath)
+	targetPath, _ := ioutil.TempDir("", "longtail-target")
+	defer os.RemoveAll(targetPath)
+	blockHashes := createMigrateTestStore(t, sourcePath)
+
+	source, _ := NewFSBlobStore(sourcePath)
+	target, _ := NewFSBlobStore(targetPath)
+	layout, _ := NewBlockLayout(2, 2)
+	options := MigrateOptions{Layout: layout, Recompress: true, CompressionType: longtaillib.GetZStdDefaultCompressionType()}
+
+	compatibility, err := CheckStoreCompatibility(context.Background(), source, options)
+	if err != nil {
+		t.Fatalf("TestMigrateStore() CheckStoreCompatibility() %v != %v", err, nil)
+	}
+	if compatibility.BlockCount != 4 || compatibility.RecompressedBlockCount != 4 || compatibility.LayoutRecorded || len(compatibility.Changes) != 2 {
+		t.Errorf("TestMigrateStore() CheckStoreCompatibility() %+v", compatibility)
+	}
+
+	result, err := MigrateStore(context.Background(), source, target, options)
+	if err != nil {
+		t.Fatalf("TestMigrateStore() MigrateStore() %v != %v", err, nil)
+	}
+	if result.RecompressedBlockCount != 4 {
+		t.Errorf("TestMigrateStore() MigrateStore() %+v", result)
+	}
+	for _, tag := range readMigrateTestTags(t, target) {
+		if tag != options.CompressionType {
+			t.Errorf("TestMigrateStore() MigrateStore() tag 0x%08x != 0x%08x", tag, options.CompressionType)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetPath, layout.BlockPath("chunks", blockHashes[0]))); err != nil {
+		t.Errorf("TestMigrateStore() MigrateStore() block not in new layout: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(targetPath, migrateStatePath)); !os.IsNotExist(err) {
+		t.Errorf("TestMigrateStore() MigrateStore() left %s behind", migrateStatePath)
+	}
+	scrubResult, err := ScrubStore(context.Background(), target, ScrubOptions{Passes: 1})
+	if err != nil || scrubResult.ScrubbedBlockCount != 4 || len(scrubResult.CorruptBlockHashes) != 0 || len(scrubResult.MissingBlockHashes) != 0 {
+		t.Errorf("TestMigrateStore() ScrubStore() of target %+v, %v", scrubResult, err)
+	}
+
+	// A second migration into the same store is refused
+	_, err = MigrateStore(context.Background(), source, target, options)
+	if err == nil {
+		t.Errorf("TestMigrateStore() MigrateStore() into migrated store %v == %v", err, nil)
+	}
+
+	// In place the blocks move to the new layout and the old copies are deleted
+	result, err = MigrateStore(context.Background(), source, nil, MigrateOptions{Layout: layout})
+	if err != nil {
+		t.Fatalf("TestMigrateStore() MigrateStore() in place %v != %v", err, nil)
+	}
+	if result.CopiedBlockCount != 4 || result.RecompressedBlockCount != 0 {
+		t.Errorf("TestMigrateStore() MigrateStore() in place %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(sourcePath, GetBlockPath("chunks", blockHashes[0]))); !os.IsNotExist(err) {
+		t.Errorf("TestMigrateStore() MigrateStore() in place left block in old layout")
+	}
+	compatibility, err = CheckStoreCompatibility(context.Background(), source, MigrateOptions{Layout: layout})
+	if err != nil || !compatibility.LayoutRecorded || compatibility.Layout != layout || len(compatibility.Changes) != 0 {
+		t.Errorf("TestMigrateStore() CheckStoreCompatibility() after migration %+v, %v", compatibility, err)
+	}
+	scrubResult, err = ScrubStore(context.Background(), source, ScrubOptions{Passes: 1})
+	if err != nil || scrubResult.ScrubbedBlockCount != 4 || len(scrubResult.MissingBlockHashes) != 0 {
+		t.Errorf("TestMigrateStore() ScrubStore() of source %+v, %v", scrubResult, err)
+	}
+}
+
+func TestMigrateStoreResume(t *testing.T) {
+	storePath, _ := ioutil.TempDir("", "longtail-source")
+	defer os.RemoveAll(storePath)
+	blockHashes := createMigrateTestStore(t, storePath)
+	blobStore, _ := NewFSBlobStore(storePath)
+	options := MigrateOptions{Recompress: true, CompressionType: longtaillib.GetZStdDefaultCompressionType()}
+
+	// A missing block stops the migration after the other blocks are migrated
+	missingPath := filepath.Join(storePath, GetBlockPath("chunks", blockHashes[2]))
+	missingBlob, _ := ioutil.ReadFile(missingPath)
+	os.Remove(missingPath)
+	_, err := MigrateStore(context.Background(), blobStore, nil, options)
+	if err == nil {
+		t.Fatalf("TestMigrateStoreResume() MigrateStore() with missing block %v == %v", err, nil)
+	}
+	if _, err := os.Stat(filepath.Join(storePath, migrateIndexPath)); err != nil {
+		t.Fatalf("TestMigrateStoreResume() MigrateStore() did not save progress: %v", err)
+	}
+
+	ioutil.WriteFile(missingPath, missingBlob, 0644)
+	result, err := MigrateStore(context.Background(), blobStore, nil, options)
+	if err != nil {
+		t.Fatalf("TestMigrateStoreResume() MigrateStore() %v != %v", err, nil)
+	}
+	if result.ResumedBlockCount != 3 || result.RecompressedBlockCount != 1 {
+		t.Errorf("TestMigrateStoreResume() MigrateStore() %+v", result)
+	}
+	for _, tag := range readMigrateTestTags(t, blobStore) {
+		if tag != options.CompressionType {
+			t.Errorf("TestMigrateStoreResume() MigrateStore() tag 0x%08x != 0x%08x", tag, options.CompressionType)
+		}
+	}
+	scrubResult, err := ScrubStore(context.Background(), blobStore, ScrubOptions{Passes: 1})
+	if err != nil || scrubResult.ScrubbedBlockCount != 4 || len(scrubResult.CorruptBlockHashes) != 0 {
+		t.Errorf("TestMigrateStoreResume() ScrubStore() %+v, %v", scrubResult, err)
+	}
+}
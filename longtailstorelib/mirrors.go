@@ -0,0 +1,410 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// BlockSourceStats holds the block read counters of the primary store or one of its mirrors
+type BlockSourceStats struct {
+	Name      string
+	GetCount  uint64
+	FailCount uint64
+	// Score is the current health penalty, sources with a lower score are tried first
+	Score uint64
+	// HedgeCount is the number of hedged reads sent to the source and HedgeWinCount the number of
+	// them that answered before the source they were hedging, see WithHedgedReads
+	HedgeCount    uint64
+	HedgeWinCount uint64
+}
+
+// BlockSourceStatsProvider is implemented by block stores that can read from mirrors, see WithMirrorURIs
+type BlockSourceStatsProvider interface {
+	GetBlockSourceStats() []BlockSourceStats
+}
+
+// blockSource is a store blocks can be read from, client is nil for the primary store which
+// uses the client of the calling worker
+type blockSource struct {
+	name   string
+	client BlobClient
+	stats  BlockSourceStats
+	// preferred is set for the CDN of the store, it is read first unless it has failed within
+	// cdnCooldown, until skipUntil
+	preferred bool
+	skipUntil time.Time
+}
+
+// hedgeLatencyWindow is the number of recent read latencies the hedge delay is picked from and
+// hedgeMinSamples the number of latencies needed before reads are hedged
+const (
+	hedgeLatencyWindow = 256
+	hedgeMinSamples    = 16
+)
+
+// blockSources orders the primary store and its mirrors by health, a failed read adds one to
+// the score of a source and a successful read halves it so a recovered source is soon preferred again
+type blockSources struct {
+	sync.Mutex
+	sources []*blockSource
+	// latencies is a ring of the durations of recent successful reads from any source
+	latencies    [hedgeLatencyWindow]time.Duration
+	latencyCount int
+}
+
+// newBlockSources returns the sources of a store with the CDN of cdnURLTemplate, see WithCDN, and
+// the mirrors of mirrorURIs
+func newBlockSources(ctx context.Context, primary BlobStore, cdnURLTemplate string, mirrorURIs []string, opts []StoreOption) (*blockSources, error) {
+	sources := &blockSources{sources: []*blockSource{{name: primary.String()}}}
+	if cdnURLTemplate != "" {
+		cdnStore, err := newCDNBlobStore(cdnURLTemplate, opts...)
+		if err != nil {
+			return nil, err
+		}
+		client, err := cdnStore.NewClient(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create client for CDN `%s`", cdnURLTemplate)
+		}
+		sources.sources = append(sources.sources, &blockSource{name: cdnStore.String(), client: client, preferred: true})
+	}
+	for _, mirrorURI := range mirrorURIs {
+		mirrorStore, err := CreateBlobStoreForURI(mirrorURI, opts...)
+		if err != nil {
+			sources.close()
+			return nil, errors.Wrapf(err, "failed to create mirror `%s`", mirrorURI)
+		}
+		client, err := mirrorStore.NewClient(ctx)
+		if err != nil {
+			sources.close()
+			return nil, errors.Wrapf(err, "failed to create client for mirror `%s`", mirrorURI)
+		}
+		sources.sources = append(sources.sources, &blockSource{name: mirrorURI, client: client})
+	}
+	return sources, nil
+}
+
+func (b *blockSources) ordered() []*blockSource {
+	b.Lock()
+	defer b.Unlock()
+	ordered := append([]*blockSource{}, b.sources...)
+	now := time.Now()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		preferredI := ordered[i].preferred && now.After(ordered[i].skipUntil)
+		preferredJ := ordered[j].preferred && now.After(ordered[j].skipUntil)
+		if preferredI != preferredJ {
+			return preferredI
+		}
+		return ordered[i].stats.Score < ordered[j].stats.Score
+	})
+	return ordered
+}
+
+// primaryFirst moves the store itself to the front of sources
+func primaryFirst(sources []*blockSource) []*blockSource {
+	for i, source := range sources {
+		if source.client == nil {
+			return append(append([]*blockSource{source}, sources[:i]...), sources[i+1:]...)
+		}
+	}
+	return sources
+}
+
+func (b *blockSources) record(source *blockSource, err error) {
+	b.Lock()
+	defer b.Unlock()
+	source.stats.GetCount++
+	if err != nil {
+		source.stats.FailCount++
+		source.stats.Score++
+		if source.preferred && !isBadBlockRead(err) {
+			// A CDN that is down would add a failed request to every block read
+			source.skipUntil = time.Now().Add(cdnCooldown)
+		}
+	} else {
+		source.stats.Score /= 2
+	}
+}
+
+func (b *blockSources) recordLatency(latency time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.latencies[b.latencyCount%hedgeLatencyWindow] = latency
+	b.latencyCount++
+}
+
+func (b *blockSources) recordHedge(source *blockSource, won bool) {
+	b.Lock()
+	defer b.Unlock()
+	if won {
+		source.stats.HedgeWinCount++
+	} else {
+		source.stats.HedgeCount++
+	}
+}
+
+// hedgeDelay returns the percentile of the recent read latencies, false if reads should not be
+// hedged because hedging is off or there are too few latencies yet
+func (b *blockSources) hedgeDelay(percentile float64) (time.Duration, bool) {
+	if percentile <= 0 {
+		return 0, false
+	}
+	b.Lock()
+	count := b.latencyCount
+	if count > hedgeLatencyWindow {
+		count = hedgeLatencyWindow
+	}
+	latencies := append([]time.Duration{}, b.latencies[:count]...)
+	b.Unlock()
+	if count < hedgeMinSamples {
+		return 0, false
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	index := int(math.Ceil(percentile/100*float64(count))) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= count {
+		index = count - 1
+	}
+	return latencies[index], true
+}
+
+func (b *blockSources) getStats() []BlockSourceStats {
+	b.Lock()
+	defer b.Unlock()
+	stats := make([]BlockSourceStats, len(b.sources))
+	for i, source := range b.sources {
+		stats[i] = source.stats
+		stats[i].Name = source.name
+	}
+	return stats
+}
+
+func (b *blockSources) close() {
+	for _, source := range b.sources {
+		if source.client != nil {
+			source.client.Close()
+		}
+	}
+}
+
+// isBadBlockRead returns true if a block read failed because the block is missing or corrupt, as
+// opposed to the source being unavailable
+func isBadBlockRead(err error) bool {
+	return err == longtaillib.ErrENOENT || IsChecksumMismatch(err)
+}
+
+// readBlockBlob reads a block from the healthiest source first and falls back to the others,
+// the error from the primary store is returned if no source has the block. With hedged reads the
+// two healthiest sources are raced, see readBlockBlobHedged. Returns the name of the source the
+// block was read from and true if the primary store was read and is missing the block or has a
+// corrupt copy of it.
+func readBlockBlob(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	key string,
+	buffer *blobBuffer) ([]byte, int, string, bool, error) {
+	if s.blockSources == nil {
+		blobData, retryCount, err := readBlobWithRetry(ctx, s, client, key, buffer)
+		return blobData, retryCount, s.blobStore.String(), isBadBlockRead(err), err
+	}
+	retryCount := 0
+	var primaryErr error
+	primaryBad := false
+	sources := s.blockSources.ordered()
+	if s.options.RepairFromMirrors {
+		// The store is read first, also when it has failed recently, so its damaged blocks are found and repaired
+		sources = primaryFirst(sources)
+	}
+	if delay, ok := s.blockSources.hedgeDelay(s.options.HedgePercentile); ok && len(sources) > 1 {
+		blobData, hedgeRetryCount, sourceName, hedgePrimaryBad, err := readBlockBlobHedged(ctx, s, client, key, sources[0], sources[1], delay)
+		retryCount += hedgeRetryCount
+		primaryBad = hedgePrimaryBad
+		if err == nil {
+			return blobData, retryCount, sourceName, primaryBad, nil
+		}
+		primaryErr = err
+		sources = sources[2:]
+	}
+	for _, source := range sources {
+		sourceClient := source.client
+		if sourceClient == nil {
+			sourceClient = client
+		}
+		start := time.Now()
+		blobData, sourceRetryCount, err := readBlobWithRetry(ctx, s, sourceClient, key, buffer)
+		retryCount += sourceRetryCount
+		s.blockSources.record(source, err)
+		if err == nil {
+			s.blockSources.recordLatency(time.Since(start))
+			return blobData, retryCount, source.name, primaryBad, nil
+		}
+		if source.client == nil {
+			primaryBad = isBadBlockRead(err)
+		}
+		if source.client == nil || primaryErr == nil {
+			primaryErr = err
+		}
+		if err != longtaillib.ErrENOENT {
+			log.Printf("Failed to read %s from %s, trying next source: %v\n", key, source.name, err)
+		}
+	}
+	return nil, retryCount, s.blobStore.String(), primaryBad, primaryErr
+}
+
+type hedgedRead struct {
+	source     *blockSource
+	blobData   []byte
+	retryCount int
+	err        error
+}
+
+// readBlockBlobHedged reads a block from first and, if it has not answered within delay or has
+// failed, also from second. The first successful read is returned and the other one is cancelled,
+// it stops before its next retry but a request that is in flight completes and is discarded. The
+// reads do not use a pooled buffer since the losing read may still be writing to it.
+func readBlockBlobHedged(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	key string,
+	first *blockSource,
+	second *blockSource,
+	delay time.Duration) ([]byte, int, string, bool, error) {
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgedRead, 2)
+	read := func(source *blockSource) {
+		sourceClient := source.client
+		if sourceClient == nil {
+			sourceClient = client
+		}
+		start := time.Now()
+		blobData, retryCount, err := readBlobWithRetry(hedgeCtx, s, sourceClient, key, nil)
+		if err == nil {
+			s.blockSources.recordLatency(time.Since(start))
+		}
+		results <- hedgedRead{source: source, blobData: blobData, retryCount: retryCount, err: err}
+	}
+	go read(first)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	hedgeTimer := timer.C
+	hedged := false
+	pending := 1
+	retryCount := 0
+	var primaryErr error
+	primaryBad := false
+	for pending > 0 {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			hedged = true
+			s.blockSources.recordHedge(second, false)
+			go read(second)
+			pending++
+		case result := <-results:
+			pending--
+			retryCount += result.retryCount
+			s.blockSources.record(result.source, result.err)
+			if result.err == nil {
+				if result.source == second && hedged {
+					s.blockSources.recordHedge(second, true)
+				}
+				return result.blobData, retryCount, result.source.name, primaryBad, nil
+			}
+			if result.source.client == nil {
+				primaryBad = isBadBlockRead(result.err)
+			}
+			if result.source.client == nil || primaryErr == nil {
+				primaryErr = result.err
+			}
+			if result.err != longtaillib.ErrENOENT {
+				log.Printf("Failed to read %s from %s, trying next source: %v\n", key, result.source.name, result.err)
+			}
+			if result.source == first && hedgeTimer != nil {
+				// The first source failed before the hedge delay, read from the second right away
+				hedgeTimer = nil
+				go read(second)
+				pending++
+			}
+		}
+	}
+	return nil, retryCount, s.blobStore.String(), primaryBad, primaryErr
+}
+
+// readMirrorStoredBlock reads a block from the mirrors when the copy in the primary store could not
+// be decoded, the block and its blob are returned with the name of the mirror that had it
+func readMirrorStoredBlock(
+	ctx context.Context,
+	s *remoteStore,
+	key string,
+	blockHash uint64) (longtaillib.Longtail_StoredBlock, []byte, string, error) {
+	var lastErr error = longtaillib.ErrENOENT
+	for _, source := range s.blockSources.ordered() {
+		if source.client == nil {
+			continue
+		}
+		blobData, _, err := readBlobWithRetry(ctx, s, source.client, key, nil)
+		s.blockSources.record(source, err)
+		if err == nil {
+			var storedBlock longtaillib.Longtail_StoredBlock
+			storedBlock, err = decodeStoredBlock(blockHash, key, blobData)
+			if err == nil {
+				return storedBlock, blobData, source.name, nil
+			}
+		}
+		lastErr = err
+	}
+	return longtaillib.Longtail_StoredBlock{}, nil, "", lastErr
+}
+
+// mirrorHasBlock returns true if a mirror has an object for the block at key
+func mirrorHasBlock(s *remoteStore, key string) bool {
+	for _, source := range s.blockSources.ordered() {
+		if source.client == nil {
+			continue
+		}
+		exists, err := blockObjectExists(source.client, key)
+		if err == nil && exists {
+			return true
+		}
+	}
+	return false
+}
+
+// repairBlockFromMirror writes a block that was read from a mirror back to the primary store where
+// it is missing or corrupt, see WithRepairFromMirrors. A failed repair is logged, the block has
+// been read so the restore goes on.
+func repairBlockFromMirror(s *remoteStore, client BlobClient, key string, blockHash uint64, blob []byte, mirrorName string) {
+	objHandle, err := client.NewObject(key)
+	if err == nil {
+		var ok bool
+		ok, err = objHandle.Write(blob)
+		if err == nil && !ok {
+			err = fmt.Errorf("the write was rejected")
+		}
+	}
+	if err != nil {
+		log.Printf("WARNING: Failed to repair block 0x%016x at `%s` in %s from mirror %s: %v\n", blockHash, key, s.blobStore.String(), mirrorName, err)
+		return
+	}
+	log.Printf("Repaired block 0x%016x at `%s` in %s from mirror %s\n", blockHash, key, s.blobStore.String(), mirrorName)
+}
+
+// GetBlockSourceStats ...
+func (s *remoteStore) GetBlockSourceStats() []BlockSourceStats {
+	if s.blockSources == nil {
+		return nil
+	}
+	return s.blockSources.getStats()
+}
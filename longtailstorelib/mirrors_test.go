@@ -0,0 +1,219 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestMirrorFallback(t *testing.T) {
+	primaryPath, _ := ioutil.TempDir("", "longtail-primary")
+	defer os.RemoveAll(primaryPath)
+	mirrorPath, _ := ioutil.TempDir("", "longtail-mirror")
+	defer os.RemoveAll(mirrorPath)
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	for _, path := range []string{primaryPath, mirrorPath} {
+		blobStore, _ := NewFSBlobStore(path)
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+		if err != nil {
+			t.Fatalf("TestMirrorFallback() NewRemoteBlockStore(%s) %v != %v", path, err, nil)
+		}
+		storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+		storeBlockFromSeed(t, storeAPI, 0)
+		storeBlockFromSeed(t, storeAPI, 10)
+		storeAPI.Dispose()
+	}
+	mirroredBlockHash := uint64(10) + 21412151
+	os.Remove(filepath.Join(primaryPath, GetBlockPath("chunks", mirroredBlockHash)))
+
+	blobStore, _ := NewFSBlobStore(primaryPath)
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly, WithMirrorURIs(mirrorPath))
+	if err != nil {
+		t.Fatalf("TestMirrorFallback() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	for i := 0; i < 2; i++ {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, mirroredBlockHash)
+		if errno != 0 {
+			t.Fatalf("TestMirrorFallback() fetchBlockFromStore(0x%016x) %d != %d", mirroredBlockHash, errno, 0)
+		}
+		validateBlockFromSeed(t, 10, storedBlock)
+		storedBlock.Dispose()
+	}
+	_, errno := fetchBlockFromStore(t, storeAPI, uint64(20)+21412151)
+	if errno != longtaillib.ENOENT {
+		t.Errorf("TestMirrorFallback() fetchBlockFromStore() missing block %d != %d", errno, longtaillib.ENOENT)
+	}
+
+	stats := remoteStore.(BlockSourceStatsProvider).GetBlockSourceStats()
+	if len(stats) != 2 {
+		t.Fatalf("TestMirrorFallback() GetBlockSourceStats() %d != %d", len(stats), 2)
+	}
+	// The second read goes straight to the mirror since the primary failed the first one
+	if stats[0].GetCount != 2 || stats[0].FailCount != 2 {
+		t.Errorf("TestMirrorFallback() primary stats %+v", stats[0])
+	}
+	if stats[1].Name != mirrorPath || stats[1].GetCount != 3 || stats[1].FailCount != 1 {
+		t.Errorf("TestMirrorFallback() mirror stats %+v", stats[1])
+	}
+}
+
+func TestRepairFromMirrors(t *testing.T) {
+	primaryPath, _ := ioutil.TempDir("", "longtail-primary")
+	defer os.RemoveAll(primaryPath)
+	mirrorPath, _ := ioutil.TempDir("", "longtail-mirror")
+	defer os.RemoveAll(mirrorPath)
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	for _, path := range []string{primaryPath, mirrorPath} {
+		blobStore, _ := NewFSBlobStore(path)
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+		if err != nil {
+			t.Fatalf("TestRepairFromMirrors() NewRemoteBlockStore(%s) %v != %v", path, err, nil)
+		}
+		storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+		storeBlockFromSeed(t, storeAPI, 0)
+		storeBlockFromSeed(t, storeAPI, 10)
+		storeAPI.Dispose()
+	}
+	corruptBlockHash := uint64(0) + 21412151
+	missingBlockHash := uint64(10) + 21412151
+	ioutil.WriteFile(filepath.Join(primaryPath, GetBlockPath("chunks", corruptBlockHash)), []byte("not a block"), 0644)
+	os.Remove(filepath.Join(primaryPath, GetBlockPath("chunks", missingBlockHash)))
+
+	blobStore, _ := NewFSBlobStore(primaryPath)
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly, WithMirrorURIs(mirrorPath), WithRepairFromMirrors())
+	if err != nil {
+		t.Fatalf("TestRepairFromMirrors() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	err = remoteStore.(BlockPreflighter).PreflightBlocks(context.Background(), []uint64{corruptBlockHash, missingBlockHash})
+	if err != nil {
+		t.Errorf("TestRepairFromMirrors() PreflightBlocks() %v != %v", err, nil)
+	}
+	for seed, blockHash := range map[uint8]uint64{0: corruptBlockHash, 10: missingBlockHash} {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+		if errno != 0 {
+			t.Fatalf("TestRepairFromMirrors() fetchBlockFromStore(0x%016x) %d != %d", blockHash, errno, 0)
+		}
+		validateBlockFromSeed(t, seed, storedBlock)
+		storedBlock.Dispose()
+
+		repaired, err := ioutil.ReadFile(filepath.Join(primaryPath, GetBlockPath("chunks", blockHash)))
+		if err != nil {
+			t.Fatalf("TestRepairFromMirrors() block 0x%016x was not repaired: %v", blockHash, err)
+		}
+		mirrored, _ := ioutil.ReadFile(filepath.Join(mirrorPath, GetBlockPath("chunks", blockHash)))
+		if string(repaired) != string(mirrored) {
+			t.Errorf("TestRepairFromMirrors() block 0x%016x differs from the mirror", blockHash)
+		}
+	}
+}
+
+// slowBlobStore delays reads of blocks to simulate a primary store on a flaky link
+type slowBlobStore struct {
+	BlobStore
+	delay time.Duration
+}
+
+type slowBlobClient struct {
+	BlobClient
+	delay time.Duration
+}
+
+type slowBlobObject struct {
+	BlobObject
+	path  string
+	delay time.Duration
+}
+
+func (blobStore *slowBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	client, err := blobStore.BlobStore.NewClient(ctx)
+	return &slowBlobClient{BlobClient: client, delay: blobStore.delay}, err
+}
+
+func (blobClient *slowBlobClient) NewObject(path string) (BlobObject, error) {
+	object, err := blobClient.BlobClient.NewObject(path)
+	return &slowBlobObject{BlobObject: object, path: path, delay: blobClient.delay}, err
+}
+
+func (blobObject *slowBlobObject) Read() ([]byte, error) {
+	if strings.HasSuffix(blobObject.path, ".lsb") {
+		time.Sleep(blobObject.delay)
+	}
+	return blobObject.BlobObject.Read()
+}
+
+func TestHedgedReads(t *testing.T) {
+	primaryPath, _ := ioutil.TempDir("", "longtail-primary")
+	defer os.RemoveAll(primaryPath)
+	mirrorPath, _ := ioutil.TempDir("", "longtail-mirror")
+	defer os.RemoveAll(mirrorPath)
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	for _, path := range []string{primaryPath, mirrorPath} {
+		blobStore, _ := NewFSBlobStore(path)
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+		if err != nil {
+			t.Fatalf("TestHedgedReads() NewRemoteBlockStore(%s) %v != %v", path, err, nil)
+		}
+		storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+		storeBlockFromSeed(t, storeAPI, 0)
+		storeAPI.Dispose()
+	}
+	blockHash := uint64(0) + 21412151
+
+	fsStore, _ := NewFSBlobStore(primaryPath)
+	primary := &slowBlobStore{BlobStore: fsStore, delay: 2 * time.Second}
+	blockStore, err := NewRemoteBlockStore(jobs, primary, "", runtime.NumCPU(), ReadOnly, WithMirrorURIs(mirrorPath), WithHedgedReads(95))
+	if err != nil {
+		t.Fatalf("TestHedgedReads() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(blockStore)
+	defer storeAPI.Dispose()
+
+	// Recent reads took a millisecond, the read from the slow primary is hedged after that
+	sources := blockStore.(*remoteStore).blockSources
+	if _, ok := sources.hedgeDelay(95); ok {
+		t.Errorf("TestHedgedReads() hedgeDelay() without latencies %v != %v", ok, false)
+	}
+	for i := 0; i < hedgeMinSamples; i++ {
+		sources.recordLatency(time.Millisecond)
+	}
+	start := time.Now()
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+	if errno != 0 {
+		t.Fatalf("TestHedgedReads() fetchBlockFromStore(0x%016x) %d != %d", blockHash, errno, 0)
+	}
+	validateBlockFromSeed(t, 0, storedBlock)
+	storedBlock.Dispose()
+	if elapsed := time.Since(start); elapsed >= primary.delay {
+		t.Errorf("TestHedgedReads() fetchBlockFromStore() took %v, the hedged read did not win", elapsed)
+	}
+
+	stats := blockStore.(BlockSourceStatsProvider).GetBlockSourceStats()
+	if stats[0].GetCount != 0 || stats[0].HedgeCount != 0 {
+		t.Errorf("TestHedgedReads() primary stats %+v", stats[0])
+	}
+	if stats[1].GetCount != 1 || stats[1].FailCount != 0 || stats[1].HedgeCount != 1 || stats[1].HedgeWinCount != 1 {
+		t.Errorf("TestHedgedReads() mirror stats %+v", stats[1])
+	}
+}
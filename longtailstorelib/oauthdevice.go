@@ -0,0 +1,246 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// oauthProvider holds the OAuth 2.0 device authorization grant (RFC 8628) endpoints of a consumer
+// cloud drive
+type oauthProvider struct {
+	name          string
+	deviceAuthURL string
+	tokenURL      string
+	scopes        []string
+}
+
+// deviceFlowIntervalUnit is the unit of the polling interval reported by the device authorization endpoint
+var deviceFlowIntervalUnit = time.Second
+
+var googleDriveOAuth = oauthProvider{
+	name:          "gdrive",
+	deviceAuthURL: "https://oauth2.googleapis.com/device/code",
+	tokenURL:      "https://oauth2.googleapis.com/token",
+	// The device flow only grants access to the files the application created
+	scopes: []string{"https://www.googleapis.com/auth/drive.file"},
+}
+
+var oneDriveOAuth = oauthProvider{
+	name:          "onedrive",
+	deviceAuthURL: "https://login.microsoftonline.com/common/oauth2/v2.0/devicecode",
+	tokenURL:      "https://login.microsoftonline.com/common/oauth2/v2.0/token",
+	scopes:        []string{"Files.ReadWrite", "offline_access"},
+}
+
+// deviceAuthorization is the response to a device authorization request, Google calls the
+// verification URI verification_url
+type deviceAuthorization struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURI string `json:"verification_uri"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// oauthTokenFile returns where the token of provider is cached, the token file store option or a
+// file per provider and client id in the user cache directory
+func oauthTokenFile(provider oauthProvider, options StoreOptions) (string, error) {
+	if options.OAuthTokenFile != "" {
+		return options.OAuthTokenFile, nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(options.OAuthClientID))
+	return filepath.Join(cacheDir, "longtail", "oauth", fmt.Sprintf("%s-%016x.json", provider.name, h.Sum64())), nil
+}
+
+func readOAuthToken(path string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{}
+	err = json.Unmarshal(data, token)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid token file `%s`", path)
+	}
+	return token, nil
+}
+
+func writeOAuthToken(path string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// postForm posts values to endpoint and decodes the JSON response into result, error responses are
+// decoded too since the device flow reports its state as errors
+func postForm(ctx context.Context, httpClient *http.Client, endpoint string, values url.Values, result interface{}) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// authorizeDevice runs the device flow, the user signs in on another device by opening the
+// verification URI and entering the code that is printed
+func authorizeDevice(ctx context.Context, httpClient *http.Client, provider oauthProvider, options StoreOptions) (*oauth2.Token, error) {
+	authorization := deviceAuthorization{}
+	status, err := postForm(ctx, httpClient, provider.deviceAuthURL, url.Values{
+		"client_id": {options.OAuthClientID},
+		"scope":     {strings.Join(provider.scopes, " ")}}, &authorization)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK || authorization.DeviceCode == "" {
+		return nil, fmt.Errorf("device authorization for %s failed with status %d", provider.name, status)
+	}
+	verificationURI := authorization.VerificationURI
+	if verificationURI == "" {
+		verificationURI = authorization.VerificationURL
+	}
+	fmt.Fprintf(os.Stderr, "To give longtail access to %s, open %s and enter the code %s\n", provider.name, verificationURI, authorization.UserCode)
+
+	interval := time.Duration(authorization.Interval) * deviceFlowIntervalUnit
+	if interval <= 0 {
+		interval = 5 * deviceFlowIntervalUnit
+	}
+	deadline := time.Now().Add(time.Duration(authorization.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		response := deviceTokenResponse{}
+		_, err = postForm(ctx, httpClient, provider.tokenURL, url.Values{
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code":   {authorization.DeviceCode},
+			"client_id":     {options.OAuthClientID},
+			"client_secret": {options.OAuthClientSecret}}, &response)
+		if err != nil {
+			return nil, err
+		}
+		switch response.Error {
+		case "":
+			token := &oauth2.Token{AccessToken: response.AccessToken, TokenType: response.TokenType, RefreshToken: response.RefreshToken}
+			if response.ExpiresIn > 0 {
+				token.Expiry = time.Now().Add(time.Duration(response.ExpiresIn) * time.Second)
+			}
+			return token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * deviceFlowIntervalUnit
+		default:
+			return nil, fmt.Errorf("device authorization for %s failed: %s", provider.name, response.Error)
+		}
+	}
+	return nil, fmt.Errorf("device authorization for %s expired", provider.name)
+}
+
+// cachingTokenSource writes refreshed tokens back to the token file
+type cachingTokenSource struct {
+	lock   sync.Mutex
+	source oauth2.TokenSource
+	path   string
+	last   string
+}
+
+func (s *cachingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if token.AccessToken != s.last {
+		s.last = token.AccessToken
+		err = writeOAuthToken(s.path, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
+// newOAuthHTTPClient returns an HTTP client that authenticates as the user of provider. The token is
+// read from the token file, or requested with the device flow if there is none, and kept refreshed.
+func newOAuthHTTPClient(ctx context.Context, provider oauthProvider, options StoreOptions) (*http.Client, error) {
+	if options.OAuthClientID == "" {
+		return nil, fmt.Errorf("%s stores need an OAuth client id, set the oauth-client-id store option", provider.name)
+	}
+	transport, err := NewHTTPTransport(options.Transport)
+	if err != nil {
+		return nil, err
+	}
+	baseClient := &http.Client{Transport: transport}
+	path, err := oauthTokenFile(provider, options)
+	if err != nil {
+		return nil, err
+	}
+	token, err := readOAuthToken(path)
+	if os.IsNotExist(errors.Cause(err)) {
+		token, err = authorizeDevice(ctx, baseClient, provider, options)
+		if err == nil {
+			err = writeOAuthToken(path, token)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := &oauth2.Config{
+		ClientID:     options.OAuthClientID,
+		ClientSecret: options.OAuthClientSecret,
+		Endpoint:     oauth2.Endpoint{TokenURL: provider.tokenURL, AuthStyle: oauth2.AuthStyleInParams},
+		Scopes:       provider.scopes}
+	// Refreshes outlive the context of the client that created the HTTP client
+	refreshCtx := context.WithValue(context.Background(), oauth2.HTTPClient, baseClient)
+	source := &cachingTokenSource{source: config.TokenSource(refreshCtx, token), path: path, last: token.AccessToken}
+	return &http.Client{Transport: &oauth2.Transport{Base: transport, Source: source}}, nil
+}
@@ -0,0 +1,116 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeOAuthServer implements the device authorization and token endpoints, the user approves the
+// device after the first poll
+type fakeOAuthServer struct {
+	lock      sync.Mutex
+	polls     int
+	refreshes int
+}
+
+func (server *fakeOAuthServer) serve(w http.ResponseWriter, r *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	r.ParseForm()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/device":
+		json.NewEncoder(w).Encode(map[string]interface{}{"device_code": "device-1", "user_code": "ABCD-EFGH", "verification_url": "https://example.com/device", "expires_in": 60, "interval": 1})
+	case "/token":
+		switch r.Form.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			server.polls++
+			if r.Form.Get("device_code") != "device-1" || r.Form.Get("client_id") != "client-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			if server.polls == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "authorization_pending"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access-1", "token_type": "Bearer", "refresh_token": "refresh-1", "expires_in": 3600})
+		case "refresh_token":
+			server.refreshes++
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access-2", "token_type": "Bearer", "expires_in": 3600})
+		}
+	case "/api":
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}
+}
+
+func TestOAuthDeviceFlow(t *testing.T) {
+	deviceFlowIntervalUnit = time.Millisecond
+	defer func() { deviceFlowIntervalUnit = time.Second }()
+	root, _ := ioutil.TempDir("", "longtail_oauth_test")
+	defer os.RemoveAll(root)
+	oauthServer := &fakeOAuthServer{}
+	server := httptest.NewServer(http.HandlerFunc(oauthServer.serve))
+	defer server.Close()
+
+	provider := oauthProvider{name: "test", deviceAuthURL: server.URL + "/device", tokenURL: server.URL + "/token", scopes: []string{"files"}}
+	tokenFile := filepath.Join(root, "oauth", "token.json")
+	options := newStoreOptions([]StoreOption{WithOAuthClient("client-1", "secret-1"), WithOAuthTokenFile(tokenFile)})
+	get := func(httpClient *http.Client) string {
+		resp, err := httpClient.Get(server.URL + "/api")
+		if err != nil {
+			t.Fatalf("TestOAuthDeviceFlow() Get() %v != %v", err, nil)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return string(data)
+	}
+
+	httpClient, err := newOAuthHTTPClient(context.Background(), provider, options)
+	if err != nil {
+		t.Fatalf("TestOAuthDeviceFlow() newOAuthHTTPClient() %v != %v", err, nil)
+	}
+	if authorization := get(httpClient); authorization != "Bearer access-1" || oauthServer.polls != 2 {
+		t.Errorf("TestOAuthDeviceFlow() authorization `%s` after %d polls", authorization, oauthServer.polls)
+	}
+
+	// The cached token is used without asking the user again and refreshed once it expires
+	token, err := readOAuthToken(tokenFile)
+	if err != nil || token.RefreshToken != "refresh-1" {
+		t.Fatalf("TestOAuthDeviceFlow() readOAuthToken() %+v, %v", token, err)
+	}
+	token.Expiry = time.Now().Add(-time.Hour)
+	writeOAuthToken(tokenFile, token)
+	httpClient, err = newOAuthHTTPClient(context.Background(), provider, options)
+	if err != nil {
+		t.Fatalf("TestOAuthDeviceFlow() newOAuthHTTPClient() cached %v != %v", err, nil)
+	}
+	if authorization := get(httpClient); authorization != "Bearer access-2" || oauthServer.polls != 2 || oauthServer.refreshes != 1 {
+		t.Errorf("TestOAuthDeviceFlow() authorization `%s` after %d polls and %d refreshes", authorization, oauthServer.polls, oauthServer.refreshes)
+	}
+	token, err = readOAuthToken(tokenFile)
+	if err != nil || token.AccessToken != "access-2" || token.RefreshToken != "refresh-1" {
+		t.Errorf("TestOAuthDeviceFlow() refreshed token %+v, %v", token, err)
+	}
+
+	_, err = newOAuthHTTPClient(context.Background(), provider, StoreOptions{})
+	if err == nil {
+		t.Errorf("TestOAuthDeviceFlow() newOAuthHTTPClient() without client id %v == %v", err, nil)
+	}
+}
+
+// newTestOAuthHTTPClient returns a client that sends a fixed bearer token, for tests of the drive stores
+func newTestOAuthHTTPClient() *http.Client {
+	return &http.Client{Transport: &oauth2.Transport{Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token"})}}
+}
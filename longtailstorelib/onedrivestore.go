@@ -0,0 +1,363 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Files up to this size are written with a single request, larger files use an upload session
+const oneDriveSimpleUploadSize = 4 * 1024 * 1024
+
+// The fragments of an upload session must be a multiple of 320 KiB
+const oneDriveUploadFragmentSize = 32 * 320 * 1024
+
+// oneDriveBlobStore keeps the objects of a store as files in the OneDrive of the signed in user,
+// onedrive://mods/store uses the folder mods/store. Access is granted with the OAuth device flow
+// the first time the store is used, see WithOAuthClient.
+type oneDriveBlobStore struct {
+	prefix       string
+	options      StoreOptions
+	apiURL       string
+	uploadClient *http.Client
+
+	lock       sync.Mutex
+	httpClient *http.Client
+}
+
+type oneDriveBlobClient struct {
+	ctx        context.Context
+	store      *oneDriveBlobStore
+	httpClient *http.Client
+}
+
+type oneDriveBlobObject struct {
+	client     *oneDriveBlobClient
+	path       string
+	lockedETag *string
+}
+
+// oneDriveItem is the metadata of a OneDrive file or folder
+type oneDriveItem struct {
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	ETag   string    `json:"eTag"`
+	Folder *struct{} `json:"folder"`
+}
+
+// NewOneDriveBlobStore ...
+func NewOneDriveBlobStore(u *url.URL, opts ...StoreOption) (BlobStore, error) {
+	if u.Scheme != "onedrive" {
+		return nil, fmt.Errorf("invalid scheme '%s', expected 'onedrive'", u.Scheme)
+	}
+	prefix, err := normalizeStorePrefix(u.Host + u.Path)
+	if err != nil {
+		return nil, err
+	}
+	options := newStoreOptions(opts)
+	transport, err := NewHTTPTransport(options.Transport)
+	if err != nil {
+		return nil, err
+	}
+	s := &oneDriveBlobStore{
+		prefix:  prefix,
+		options: options,
+		apiURL:  "https://graph.microsoft.com/v1.0/me/drive/",
+		// Upload session URLs are pre-authenticated and must be used without the authorization header
+		uploadClient: &http.Client{Transport: transport}}
+	return s, nil
+}
+
+func (blobStore *oneDriveBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	blobStore.lock.Lock()
+	defer blobStore.lock.Unlock()
+	if blobStore.httpClient == nil {
+		httpClient, err := newOAuthHTTPClient(ctx, oneDriveOAuth, blobStore.options)
+		if err != nil {
+			return nil, errors.Wrap(err, blobStore.String())
+		}
+		blobStore.httpClient = httpClient
+	}
+	return &oneDriveBlobClient{ctx: ctx, store: blobStore, httpClient: blobStore.httpClient}, nil
+}
+
+func (blobStore *oneDriveBlobStore) storeOptions() StoreOptions {
+	return blobStore.options
+}
+
+func (blobStore *oneDriveBlobStore) String() string {
+	return "onedrive://" + blobStore.prefix
+}
+
+// itemURL returns the address of the item at path in the drive, path is relative to the drive root
+func (blobStore *oneDriveBlobStore) itemURL(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	if path == "" {
+		return blobStore.apiURL + "root"
+	}
+	return blobStore.apiURL + "root:/" + (&url.URL{Path: path}).EscapedPath() + ":"
+}
+
+// do sends req and returns the status and body of the response, error statuses other than
+// 404 Not Found, 409 Conflict and 412 Precondition Failed are returned as errors
+func (blobClient *oneDriveBlobClient) do(req *http.Request) (int, []byte, error) {
+	resp, err := blobClient.httpClient.Do(req.WithContext(blobClient.ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+	case resp.StatusCode == http.StatusNotFound, resp.StatusCode == http.StatusConflict, resp.StatusCode == http.StatusPreconditionFailed:
+	default:
+		apiError := struct {
+			Error struct{ Message string }
+		}{}
+		if json.Unmarshal(data, &apiError) != nil || apiError.Error.Message == "" {
+			apiError.Error.Message = resp.Status
+		}
+		return resp.StatusCode, nil, fmt.Errorf("onedrive %s: %s", req.Method, apiError.Error.Message)
+	}
+	return resp.StatusCode, data, nil
+}
+
+// item returns the metadata of the item at path, nil if there is none
+func (blobClient *oneDriveBlobClient) item(path string) (*oneDriveItem, error) {
+	req, err := http.NewRequest(http.MethodGet, blobClient.store.itemURL(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	status, data, err := blobClient.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	item := &oneDriveItem{}
+	err = json.Unmarshal(data, item)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return item, nil
+}
+
+func (blobClient *oneDriveBlobClient) NewObject(path string) (BlobObject, error) {
+	return &oneDriveBlobObject{client: blobClient, path: blobClient.store.prefix + path}, nil
+}
+
+// listFolder adds the files in folder and its sub folders to objects
+func (blobClient *oneDriveBlobClient) listFolder(folder string, objects []BlobProperties) ([]BlobProperties, error) {
+	next := blobClient.store.itemURL(folder) + "/children?$select=name,size,folder&$top=1000"
+	for next != "" {
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		status, data, err := blobClient.do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, folder)
+		}
+		if status == http.StatusNotFound {
+			return objects, nil
+		}
+		page := struct {
+			Value    []oneDriveItem `json:"value"`
+			NextLink string         `json:"@odata.nextLink"`
+		}{}
+		err = json.Unmarshal(data, &page)
+		if err != nil {
+			return nil, errors.Wrap(err, folder)
+		}
+		for _, item := range page.Value {
+			path := folder + item.Name
+			if item.Folder != nil {
+				objects, err = blobClient.listFolder(path+"/", objects)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			objects = append(objects, BlobProperties{Size: item.Size, Name: path[len(blobClient.store.prefix):]})
+		}
+		next = page.NextLink
+	}
+	return objects, nil
+}
+
+func (blobClient *oneDriveBlobClient) GetObjects() ([]BlobProperties, error) {
+	return blobClient.listFolder(blobClient.store.prefix, []BlobProperties{})
+}
+
+func (blobClient *oneDriveBlobClient) ListObjects(prefix string) BlobIterator {
+	return newListingBlobIterator(blobClient.GetObjects, prefix)
+}
+
+func (blobClient *oneDriveBlobClient) Close() {
+}
+
+func (blobClient *oneDriveBlobClient) String() string {
+	return blobClient.store.String()
+}
+
+func (blobObject *oneDriveBlobObject) Exists() (bool, error) {
+	item, err := blobObject.client.item(blobObject.path)
+	return item != nil, err
+}
+
+func (blobObject *oneDriveBlobObject) Read() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, blobObject.client.store.itemURL(blobObject.path)+"/content", nil)
+	if err != nil {
+		return nil, err
+	}
+	status, data, err := blobObject.client.do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	if status == http.StatusNotFound {
+		return nil, fmt.Errorf("onedrive object does not exist: %s", blobObject.path)
+	}
+	return data, nil
+}
+
+func (blobObject *oneDriveBlobObject) LockWriteVersion() (bool, error) {
+	item, err := blobObject.client.item(blobObject.path)
+	if err != nil {
+		return false, err
+	}
+	eTag := ""
+	if item != nil {
+		eTag = item.ETag
+	}
+	blobObject.lockedETag = &eTag
+	return item != nil, nil
+}
+
+// writeCondition returns the If-Match header and conflict behavior of a write, a locked write only
+// replaces the version it locked and an immutable write never replaces a file
+func (blobObject *oneDriveBlobObject) writeCondition() (string, string) {
+	if blobObject.lockedETag != nil {
+		if *blobObject.lockedETag == "" {
+			return "", "fail"
+		}
+		return *blobObject.lockedETag, "replace"
+	}
+	if blobObject.client.store.options.Immutable {
+		return "", "fail"
+	}
+	return "", "replace"
+}
+
+func (blobObject *oneDriveBlobObject) Write(data []byte) (bool, error) {
+	ifMatch, conflictBehavior := blobObject.writeCondition()
+	var status int
+	var err error
+	if len(data) <= oneDriveSimpleUploadSize {
+		status, err = blobObject.writeSimple(data, ifMatch, conflictBehavior)
+	} else {
+		status, err = blobObject.writeSession(data, ifMatch, conflictBehavior)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+	if status == http.StatusConflict || status == http.StatusPreconditionFailed {
+		if blobObject.lockedETag == nil && blobObject.client.store.options.Immutable {
+			return verifyImmutableObject(blobObject, blobObject.path, data)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func (blobObject *oneDriveBlobObject) writeSimple(data []byte, ifMatch string, conflictBehavior string) (int, error) {
+	query := url.Values{"@microsoft.graph.conflictBehavior": {conflictBehavior}}
+	req, err := http.NewRequest(http.MethodPut, blobObject.client.store.itemURL(blobObject.path)+"/content?"+query.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	status, _, err := blobObject.client.do(req)
+	return status, err
+}
+
+// writeSession uploads data that is too large for a single request in fragments
+func (blobObject *oneDriveBlobObject) writeSession(data []byte, ifMatch string, conflictBehavior string) (int, error) {
+	client := blobObject.client
+	body, _ := json.Marshal(map[string]interface{}{"item": map[string]string{"@microsoft.graph.conflictBehavior": conflictBehavior}})
+	req, err := http.NewRequest(http.MethodPost, client.store.itemURL(blobObject.path)+"/createUploadSession", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	status, result, err := client.do(req)
+	if err != nil || status == http.StatusConflict || status == http.StatusPreconditionFailed {
+		return status, err
+	}
+	if status == http.StatusNotFound {
+		return status, fmt.Errorf("onedrive folder does not exist: %s", blobObject.path)
+	}
+	session := struct{ UploadURL string }{}
+	err = json.Unmarshal(result, &session)
+	if err != nil {
+		return 0, err
+	}
+	for offset := 0; offset < len(data); offset += oneDriveUploadFragmentSize {
+		end := offset + oneDriveUploadFragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+		req, err := http.NewRequest(http.MethodPut, session.UploadURL, bytes.NewReader(data[offset:end]))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, len(data)))
+		resp, err := client.store.uploadClient.Do(req.WithContext(client.ctx))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusConflict {
+			return resp.StatusCode, nil
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return resp.StatusCode, fmt.Errorf("onedrive upload: %s", resp.Status)
+		}
+	}
+	return http.StatusCreated, nil
+}
+
+func (blobObject *oneDriveBlobObject) Delete() error {
+	if blobObject.client.store.options.Immutable {
+		return errors.Wrap(ErrImmutable, blobObject.path)
+	}
+	req, err := http.NewRequest(http.MethodDelete, blobObject.client.store.itemURL(blobObject.path), nil)
+	if err != nil {
+		return err
+	}
+	status, _, err := blobObject.client.do(req)
+	if err != nil {
+		return errors.Wrap(err, blobObject.path)
+	}
+	if status == http.StatusNotFound {
+		return fmt.Errorf("onedrive object does not exist: %s", blobObject.path)
+	}
+	return nil
+}
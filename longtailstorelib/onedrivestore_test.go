@@ -0,0 +1,202 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeOneDriveFile struct {
+	data []byte
+	eTag string
+}
+
+// fakeOneDrive implements the parts of the Microsoft Graph drive API used by the onedrive:// blob store
+type fakeOneDrive struct {
+	lock      sync.Mutex
+	serverURL string
+	files     map[string]*fakeOneDriveFile
+	sessions  map[string][]byte
+	writes    int
+}
+
+func (drive *fakeOneDrive) put(path string, data []byte, ifMatch string, conflictBehavior string) int {
+	file, exists := drive.files[path]
+	if exists && conflictBehavior == "fail" {
+		return http.StatusConflict
+	}
+	if ifMatch != "" && (!exists || file.eTag != ifMatch) {
+		return http.StatusPreconditionFailed
+	}
+	drive.writes++
+	drive.files[path] = &fakeOneDriveFile{data: data, eTag: fmt.Sprintf("etag-%d", drive.writes)}
+	return http.StatusCreated
+}
+
+func (drive *fakeOneDrive) serve(w http.ResponseWriter, r *http.Request) {
+	drive.lock.Lock()
+	defer drive.lock.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		if r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/upload/")
+		data, _ := ioutil.ReadAll(r.Body)
+		drive.sessions[path] = append(drive.sessions[path], data...)
+		var first, last, total int
+		fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &total)
+		if last+1 == total {
+			w.WriteHeader(drive.put(path, drive.sessions[path], "", "replace"))
+			delete(drive.sessions, path)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	item := strings.TrimPrefix(r.URL.Path, "/me/drive/root:/")
+	split := strings.LastIndex(item, ":")
+	path, action := item[:split], item[split+1:]
+	file, exists := drive.files[path]
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": path, "size": len(file.data), "eTag": file.eTag})
+	case action == "" && r.Method == http.MethodDelete:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(drive.files, path)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "/content" && r.Method == http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(file.data)
+	case action == "/content" && r.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(drive.put(path, data, r.Header.Get("If-Match"), r.URL.Query().Get("@microsoft.graph.conflictBehavior")))
+	case action == "/createUploadSession":
+		json.NewEncoder(w).Encode(map[string]string{"uploadUrl": drive.serverURL + "/upload/" + path})
+	case action == "/children":
+		children := map[string]map[string]interface{}{}
+		for name, file := range drive.files {
+			if !strings.HasPrefix(name, path+"/") {
+				continue
+			}
+			name = name[len(path)+1:]
+			if i := strings.Index(name, "/"); i != -1 {
+				children[name[:i]] = map[string]interface{}{"name": name[:i], "folder": map[string]int{"childCount": 1}}
+				continue
+			}
+			children[name] = map[string]interface{}{"name": name, "size": len(file.data)}
+		}
+		value := []map[string]interface{}{}
+		for _, child := range children {
+			value = append(value, child)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func newTestOneDriveBlobStore(t *testing.T, serverURL string, opts ...StoreOption) BlobStore {
+	u, _ := url.Parse("onedrive://mods/store")
+	blobStore, err := NewOneDriveBlobStore(u, opts...)
+	if err != nil {
+		t.Fatalf("NewOneDriveBlobStore() %v != %v", err, nil)
+	}
+	s := blobStore.(*oneDriveBlobStore)
+	s.apiURL = serverURL + "/me/drive/"
+	s.httpClient = newTestOAuthHTTPClient()
+	return blobStore
+}
+
+func TestOneDriveBlobStore(t *testing.T) {
+	drive := &fakeOneDrive{files: map[string]*fakeOneDriveFile{}, sessions: map[string][]byte{}}
+	server := httptest.NewServer(http.HandlerFunc(drive.serve))
+	defer server.Close()
+	drive.serverURL = server.URL
+
+	blobStore := newTestOneDriveBlobStore(t, server.URL)
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject("chunks/0000/block 1.lsb")
+	if exists, err := object.Exists(); exists || err != nil {
+		t.Errorf("TestOneDriveBlobStore() Exists() %t, %v", exists, err)
+	}
+	if ok, err := object.Write([]byte("block")); !ok || err != nil {
+		t.Fatalf("TestOneDriveBlobStore() Write() %t, %v", ok, err)
+	}
+	data, err := object.Read()
+	if err != nil || string(data) != "block" {
+		t.Errorf("TestOneDriveBlobStore() Read() `%s`, %v", data, err)
+	}
+
+	// Large blocks are written with an upload session
+	largeData := bytes.Repeat([]byte("0123456789abcdef"), (oneDriveSimpleUploadSize+oneDriveUploadFragmentSize)/16)
+	largeObject, _ := client.NewObject("chunks/0001/large.lsb")
+	if ok, err := largeObject.Write(largeData); !ok || err != nil {
+		t.Fatalf("TestOneDriveBlobStore() Write() large %t, %v", ok, err)
+	}
+	data, err = largeObject.Read()
+	if err != nil || !bytes.Equal(data, largeData) {
+		t.Errorf("TestOneDriveBlobStore() Read() large %d bytes, %v", len(data), err)
+	}
+
+	indexObject, _ := client.NewObject("store.lsi")
+	if exists, err := indexObject.LockWriteVersion(); exists || err != nil {
+		t.Errorf("TestOneDriveBlobStore() LockWriteVersion() %t, %v", exists, err)
+	}
+	otherObject, _ := client.NewObject("store.lsi")
+	otherObject.LockWriteVersion()
+	if ok, err := indexObject.Write([]byte("index")); !ok || err != nil {
+		t.Errorf("TestOneDriveBlobStore() Write() locked %t, %v", ok, err)
+	}
+	if ok, err := otherObject.Write([]byte("other index")); ok || err != nil {
+		t.Errorf("TestOneDriveBlobStore() Write() conflict %t, %v", ok, err)
+	}
+	indexObject.LockWriteVersion()
+	if ok, err := indexObject.Write([]byte("index v2")); !ok || err != nil {
+		t.Errorf("TestOneDriveBlobStore() Write() locked existing %t, %v", ok, err)
+	}
+
+	objects, err := client.GetObjects()
+	if err != nil || len(objects) != 3 {
+		t.Errorf("TestOneDriveBlobStore() GetObjects() %v, %v", objects, err)
+	}
+	if err := object.Delete(); err != nil {
+		t.Errorf("TestOneDriveBlobStore() Delete() %v", err)
+	}
+	if exists, err := object.Exists(); exists || err != nil {
+		t.Errorf("TestOneDriveBlobStore() Exists() after Delete() %t, %v", exists, err)
+	}
+
+	immutableClient, _ := newTestOneDriveBlobStore(t, server.URL, WithImmutable()).NewClient(context.Background())
+	defer immutableClient.Close()
+	immutableObject, _ := immutableClient.NewObject("store.lsi")
+	if ok, err := immutableObject.Write([]byte("index v2")); !ok || err != nil {
+		t.Errorf("TestOneDriveBlobStore() Write() immutable identical %t, %v", ok, err)
+	}
+	if _, err := immutableObject.Write([]byte("changed index")); !IsImmutable(err) {
+		t.Errorf("TestOneDriveBlobStore() Write() immutable %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package longtailstorelib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// openMetricsCounters are the names of the counters of longtaillib.BlockStoreStats in
+// WriteOpenMetrics, indexed by the Longtail_BlockStoreAPI_StatU64_* constants
+var openMetricsCounters = [longtaillib.Longtail_BlockStoreAPI_StatU64_Count]string{
+	"longtail_get_stored_block",
+	"longtail_get_stored_block_retries",
+	"longtail_get_stored_block_failures",
+	"longtail_get_stored_block_chunks",
+	"longtail_get_stored_block_bytes",
+	"longtail_put_stored_block",
+	"longtail_put_stored_block_retries",
+	"longtail_put_stored_block_failures",
+	"longtail_put_stored_block_chunks",
+	"longtail_put_stored_block_bytes",
+	"longtail_get_existing_content",
+	"longtail_get_existing_content_retries",
+	"longtail_get_existing_content_failures",
+	"longtail_preflight_get",
+	"longtail_preflight_get_retries",
+	"longtail_preflight_get_failures",
+	"longtail_flush",
+	"longtail_flush_failures",
+	"longtail_get_stats",
+}
+
+// openMetricsLabel escapes value for a label of the OpenMetrics text format
+func openMetricsLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatOpenMetricsFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// WriteOpenMetrics writes a snapshot of the stats of block stores in the OpenMetrics text format,
+// so the state of a sync job can be inspected after the fact or scraped by a Prometheus
+// compatible agent. The stores are labelled with their index and backend.
+func WriteOpenMetrics(w io.Writer, stores []DetailedStats) error {
+	b := bufio.NewWriter(w)
+	storeLabels := make([]string, len(stores))
+	for i, stats := range stores {
+		storeLabels[i] = fmt.Sprintf(`store="%d",backend="%s"`, i, openMetricsLabel(stats.Backend))
+	}
+
+	for s, name := range openMetricsCounters {
+		fmt.Fprintf(b, "# TYPE %s counter\n", name)
+		for i, stats := range stores {
+			fmt.Fprintf(b, "%s_total{%s} %d\n", name, storeLabels[i], stats.Stats.StatU64[s])
+		}
+	}
+
+	gauges := []struct {
+		name  string
+		value func(stats *DetailedStats) float64
+	}{
+		{"longtail_upload_bytes_per_second", func(stats *DetailedStats) float64 { return stats.UploadBytesPerSecond }},
+		{"longtail_download_bytes_per_second", func(stats *DetailedStats) float64 { return stats.DownloadBytesPerSecond }},
+		{"longtail_put_blocks_per_second", func(stats *DetailedStats) float64 { return stats.PutBlocksPerSecond }},
+		{"longtail_get_blocks_per_second", func(stats *DetailedStats) float64 { return stats.GetBlocksPerSecond }},
+		{"longtail_puts_in_flight", func(stats *DetailedStats) float64 { return float64(stats.PutsInFlight) }},
+		{"longtail_gets_in_flight", func(stats *DetailedStats) float64 { return float64(stats.GetsInFlight) }},
+		{"longtail_put_queue_depth", func(stats *DetailedStats) float64 { return float64(stats.PutQueueDepth) }},
+		{"longtail_get_queue_depth", func(stats *DetailedStats) float64 { return float64(stats.GetQueueDepth) }},
+		{"longtail_prefetch_queue_depth", func(stats *DetailedStats) float64 { return float64(stats.PrefetchQueueDepth) }},
+		{"longtail_prefetch_memory_bytes", func(stats *DetailedStats) float64 { return float64(stats.PrefetchMemory) }},
+		{"longtail_max_prefetch_memory_bytes", func(stats *DetailedStats) float64 { return float64(stats.MaxPrefetchMemory) }},
+		{"longtail_memory_limit_bytes", func(stats *DetailedStats) float64 { return float64(stats.Memory.Limit) }},
+		{"longtail_memory_peak_bytes", func(stats *DetailedStats) float64 { return float64(stats.Memory.PeakUsed) }},
+	}
+	for _, gauge := range gauges {
+		fmt.Fprintf(b, "# TYPE %s gauge\n", gauge.name)
+		for i := range stores {
+			fmt.Fprintf(b, "%s{%s} %s\n", gauge.name, storeLabels[i], formatOpenMetricsFloat(gauge.value(&stores[i])))
+		}
+	}
+
+	fmt.Fprintf(b, "# TYPE longtail_memory_bytes gauge\n")
+	for i, stats := range stores {
+		for _, usage := range stats.Memory.Usage {
+			fmt.Fprintf(b, "longtail_memory_bytes{%s,kind=\"%s\"} %d\n", storeLabels[i], usage.Kind, usage.Bytes)
+		}
+	}
+	fmt.Fprintf(b, "# TYPE longtail_memory_waits counter\n")
+	for i, stats := range stores {
+		fmt.Fprintf(b, "longtail_memory_waits_total{%s} %d\n", storeLabels[i], stats.Memory.WaitCount)
+	}
+
+	fmt.Fprintf(b, "# TYPE longtail_block_fetch_dedup counter\n")
+	for i, stats := range stores {
+		fmt.Fprintf(b, "longtail_block_fetch_dedup_total{%s,request=\"joined-get\"} %d\n", storeLabels[i], stats.FetchDedup.JoinedGetCount)
+		fmt.Fprintf(b, "longtail_block_fetch_dedup_total{%s,request=\"joined-prefetch\"} %d\n", storeLabels[i], stats.FetchDedup.JoinedPrefetchCount)
+		fmt.Fprintf(b, "longtail_block_fetch_dedup_total{%s,request=\"skipped-prefetch\"} %d\n", storeLabels[i], stats.FetchDedup.SkippedPrefetchCount)
+	}
+
+	queueMetrics := []struct {
+		name       string
+		metricType string
+		value      func(q *QueueStats) string
+	}{
+		{"longtail_queue_depth", "gauge", func(q *QueueStats) string { return strconv.Itoa(q.Depth) }},
+		{"longtail_queue_capacity", "gauge", func(q *QueueStats) string { return strconv.Itoa(q.Capacity) }},
+		{"longtail_queue_full", "counter", func(q *QueueStats) string { return strconv.FormatUint(q.FullCount, 10) }},
+		{"longtail_queue_wait_seconds", "counter", func(q *QueueStats) string { return formatOpenMetricsFloat(q.WaitTime.Seconds()) }},
+		{"longtail_queue_timeouts", "counter", func(q *QueueStats) string { return strconv.FormatUint(q.TimeoutCount, 10) }},
+	}
+	for _, metric := range queueMetrics {
+		fmt.Fprintf(b, "# TYPE %s %s\n", metric.name, metric.metricType)
+		suffix := ""
+		if metric.metricType == "counter" {
+			suffix = "_total"
+		}
+		for i, stats := range stores {
+			for q := range stats.Queues {
+				fmt.Fprintf(b, "%s%s{%s,queue=\"%s\"} %s\n", metric.name, suffix, storeLabels[i], stats.Queues[q].Name, metric.value(&stats.Queues[q]))
+			}
+		}
+	}
+
+	poolMetrics := []struct {
+		name       string
+		metricType string
+		value      func(p *WorkerPoolStats) string
+	}{
+		{"longtail_pool_workers", "gauge", func(p *WorkerPoolStats) string { return strconv.Itoa(p.WorkerCount) }},
+		{"longtail_pool_busy_workers", "gauge", func(p *WorkerPoolStats) string { return strconv.FormatInt(p.BusyCount, 10) }},
+		{"longtail_pool_requests", "counter", func(p *WorkerPoolStats) string { return strconv.FormatUint(p.RequestCount, 10) }},
+	}
+	for _, metric := range poolMetrics {
+		fmt.Fprintf(b, "# TYPE %s %s\n", metric.name, metric.metricType)
+		suffix := ""
+		if metric.metricType == "counter" {
+			suffix = "_total"
+		}
+		for i, stats := range stores {
+			for p := range stats.WorkerPools {
+				fmt.Fprintf(b, "%s%s{%s,pool=\"%s\"} %s\n", metric.name, suffix, storeLabels[i], stats.WorkerPools[p].Name, metric.value(&stats.WorkerPools[p]))
+			}
+		}
+	}
+
+	fmt.Fprintf(b, "# TYPE longtail_request_duration_seconds histogram\n")
+	for i, stats := range stores {
+		for _, h := range stats.Latencies {
+			labels := fmt.Sprintf(`store="%d",backend="%s",operation="%s"`, i, openMetricsLabel(h.Backend), openMetricsLabel(h.Operation))
+			cumulative := uint64(0)
+			for bucket, count := range h.Buckets {
+				cumulative += count
+				bound := "+Inf"
+				if bucket < len(LatencyBucketBounds) {
+					bound = formatOpenMetricsFloat(LatencyBucketBounds[bucket].Seconds())
+				}
+				fmt.Fprintf(b, "longtail_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, bound, cumulative)
+			}
+			fmt.Fprintf(b, "longtail_request_duration_seconds_count{%s} %d\n", labels, h.Count)
+			fmt.Fprintf(b, "longtail_request_duration_seconds_sum{%s} %s\n", labels, formatOpenMetricsFloat(h.Total.Seconds()))
+		}
+	}
+	requestCounters := []struct {
+		name  string
+		value func(h *LatencyHistogram) uint64
+	}{
+		{"longtail_request_failures", func(h *LatencyHistogram) uint64 { return h.FailCount }},
+		{"longtail_request_retries", func(h *LatencyHistogram) uint64 { return h.RetryCount }},
+		{"longtail_slow_requests", func(h *LatencyHistogram) uint64 { return h.SlowCount }},
+	}
+	for _, counter := range requestCounters {
+		fmt.Fprintf(b, "# TYPE %s counter\n", counter.name)
+		for i, stats := range stores {
+			for _, h := range stats.Latencies {
+				fmt.Fprintf(b, "%s_total{store=\"%d\",backend=\"%s\",operation=\"%s\"} %d\n", counter.name, i, openMetricsLabel(h.Backend), openMetricsLabel(h.Operation), counter.value(&h))
+			}
+		}
+	}
+	fmt.Fprintf(b, "# EOF\n")
+	return b.Flush()
+}
@@ -0,0 +1,62 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestWriteOpenMetrics(t *testing.T) {
+	latencies := newOperationLatencies(0)
+	latencies.record(operation{name: OperationGetBlock, backend: "primary"}, 3*time.Millisecond)
+	latencies.record(operation{name: OperationGetBlock, backend: "primary", retryCount: 2, err: errors.New("timeout")}, 90*time.Second)
+	latencies.record(operation{name: OperationGetBlock, backend: "mirror \"eu\""}, time.Millisecond)
+	stats := DetailedStats{Backend: "primary", PrefetchMemory: 4096, GetQueueDepth: 3, Latencies: latencies.get(),
+		Queues:      []QueueStats{{Name: QueuePut, Depth: 2, Capacity: 8, FullCount: 4, WaitTime: 1500 * time.Millisecond}},
+		WorkerPools: []WorkerPoolStats{{Name: WorkerPoolUpload, WorkerCount: 2, BusyCount: 1, RequestCount: 7}},
+		Memory:      MemoryStats{Limit: 65536, Usage: []MemoryUsage{{Kind: MemoryPuts, Bytes: 8192}}, WaitCount: 5},
+		FetchDedup:  FetchDedupStats{JoinedGetCount: 6}}
+	stats.Stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Count] = 3
+	if len(stats.Latencies) != 2 || stats.Latencies[1].Backend != "primary" || stats.Latencies[1].RetryCount != 2 {
+		t.Fatalf("TestWriteOpenMetrics() latencies %+v", stats.Latencies)
+	}
+
+	var buffer bytes.Buffer
+	err := WriteOpenMetrics(&buffer, []DetailedStats{stats})
+	if err != nil {
+		t.Fatalf("TestWriteOpenMetrics() WriteOpenMetrics() %v != %v", err, nil)
+	}
+	metrics := buffer.String()
+	for _, line := range []string{
+		"# TYPE longtail_get_stored_block counter\n",
+		"longtail_get_stored_block_total{store=\"0\",backend=\"primary\"} 3\n",
+		"longtail_get_queue_depth{store=\"0\",backend=\"primary\"} 3\n",
+		"longtail_prefetch_memory_bytes{store=\"0\",backend=\"primary\"} 4096\n",
+		"longtail_memory_limit_bytes{store=\"0\",backend=\"primary\"} 65536\n",
+		"longtail_memory_bytes{store=\"0\",backend=\"primary\",kind=\"puts\"} 8192\n",
+		"longtail_memory_waits_total{store=\"0\",backend=\"primary\"} 5\n",
+		"longtail_block_fetch_dedup_total{store=\"0\",backend=\"primary\",request=\"joined-get\"} 6\n",
+		"longtail_request_duration_seconds_bucket{store=\"0\",backend=\"primary\",operation=\"get-block\",le=\"0.005\"} 1\n",
+		"longtail_request_duration_seconds_bucket{store=\"0\",backend=\"primary\",operation=\"get-block\",le=\"+Inf\"} 2\n",
+		"longtail_request_duration_seconds_count{store=\"0\",backend=\"mirror \\\"eu\\\"\",operation=\"get-block\"} 1\n",
+		"longtail_request_retries_total{store=\"0\",backend=\"primary\",operation=\"get-block\"} 2\n",
+		"longtail_request_failures_total{store=\"0\",backend=\"primary\",operation=\"get-block\"} 1\n",
+		"longtail_queue_capacity{store=\"0\",backend=\"primary\",queue=\"put\"} 8\n",
+		"longtail_queue_full_total{store=\"0\",backend=\"primary\",queue=\"put\"} 4\n",
+		"longtail_queue_wait_seconds_total{store=\"0\",backend=\"primary\",queue=\"put\"} 1.5\n",
+		"longtail_pool_workers{store=\"0\",backend=\"primary\",pool=\"upload\"} 2\n",
+		"longtail_pool_busy_workers{store=\"0\",backend=\"primary\",pool=\"upload\"} 1\n",
+		"longtail_pool_requests_total{store=\"0\",backend=\"primary\",pool=\"upload\"} 7\n",
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("TestWriteOpenMetrics() missing `%s` in\n%s", strings.TrimSpace(line), metrics)
+		}
+	}
+	if !strings.HasSuffix(metrics, "# EOF\n") {
+		t.Errorf("TestWriteOpenMetrics() does not end with # EOF")
+	}
+}
@@ -0,0 +1,556 @@
+package longtailstorelib
+
+import "time"
+
+// StoreOptions holds the optional settings shared by the blob stores and the remote block store
+type StoreOptions struct {
+	Transport TransportOptions
+	// MaxConcurrentRequests limits the number of in-flight backend requests across all workers, zero is unlimited
+	MaxConcurrentRequests int
+	// MaxThrottleBackoff caps the adaptive delay applied when the backend throttles us, zero uses 30 seconds
+	MaxThrottleBackoff time.Duration
+	// Immutable makes existing objects write-once, see WithImmutable
+	Immutable bool
+	// RestoreArchived makes reads of archived blocks request a restore and wait for it, see WithRestoreArchived
+	RestoreArchived     bool
+	RestoreTimeout      time.Duration
+	RestorePollInterval time.Duration
+	// MirrorURIs are read-only copies of the store that blocks are read from when the store fails, see WithMirrorURIs
+	MirrorURIs []string
+	// HedgePercentile makes block reads that are slower than this percentile of recent reads race a mirror, see WithHedgedReads
+	HedgePercentile float64
+	// RepairFromMirrors writes blocks read from a mirror back to the store when the store is missing them, see WithRepairFromMirrors
+	RepairFromMirrors bool
+	// Hooks are telemetry callbacks of the remote block store, see WithHooks
+	Hooks StoreHooks
+	// SlowOperationThreshold logs block and index operations of the remote block store that take longer, see WithSlowOperationThreshold
+	SlowOperationThreshold time.Duration
+	// WorkerCount, AccessType and MaxPrefetchMemory override the arguments and defaults of NewRemoteBlockStore when set
+	WorkerCount       int
+	AccessType        *AccessType
+	MaxPrefetchMemory int64
+	// MaxRetries is the number of times a failed block read or write is retried, zero uses 3 and a negative value disables retries
+	MaxRetries int
+	// MaxStoreBytes and MaxStoreBlockCount are the quota of the store, zero is unlimited, see WithQuota
+	MaxStoreBytes      int64
+	MaxStoreBlockCount int64
+	// AuditLog records mutations of the store in its audit log, see WithAuditLog
+	AuditLog bool
+	// Identity is stamped on the objects written to the store, see WithIdentity
+	Identity string
+	// RequesterPays bills reads of the store to the caller instead of the bucket owner, see WithRequesterPays
+	RequesterPays bool
+	// Anonymous skips the credential lookup and sends unauthenticated requests, see WithAnonymous
+	Anonymous bool
+	// AccessKeyID and SecretAccessKey are the credentials of S3 stores, see WithStaticCredentials
+	AccessKeyID     string
+	SecretAccessKey string
+	// CredentialHelpers look up the credentials of S3 stores by bucket, "" is the helper of all
+	// buckets, see WithCredentialHelper
+	CredentialHelpers map[string]CredentialHelper
+	// SecretPrompt asks for the secret of an access key without one, see WithSecretPrompt
+	SecretPrompt SecretPrompt
+	// IPFSManifestCID opens a published IPFS store read-only, see WithIPFSManifest
+	IPFSManifestCID string
+	// OAuthClientID, OAuthClientSecret and OAuthTokenFile authenticate gdrive:// and onedrive:// stores, see WithOAuthClient
+	OAuthClientID     string
+	OAuthClientSecret string
+	OAuthTokenFile    string
+	// NetworkShare makes locked writes of file stores safe for concurrent writers, see WithNetworkShare
+	NetworkShare bool
+	// SessionMode is the mode the remote block store starts in, see WithSessionMode
+	SessionMode SessionMode
+	// BackgroundWorkerCount and BackgroundBytesPerSecond limit block transfers in Background mode, see WithBackgroundLimits
+	BackgroundWorkerCount    int
+	BackgroundBytesPerSecond int64
+	// SessionState is the exported state of an earlier session of the remote block store, see WithSessionState
+	SessionState *SessionState
+	// The queue depths of the remote block store, zero uses the default for the worker count, see WithQueueDepths
+	PutQueueDepth        int
+	GetQueueDepth        int
+	PrefetchQueueDepth   int
+	BlockIndexQueueDepth int
+	// QueueTimeout fails block requests that wait longer for room in a full queue, see WithQueueTimeout
+	QueueTimeout time.Duration
+	// UploadWorkerCount and DownloadWorkerCount split the workers of the remote block store into
+	// separate upload and download pools, see WithWorkerPools
+	UploadWorkerCount   int
+	DownloadWorkerCount int
+	// DecodeWorkerCount is the number of workers that decode fetched blocks, see WithDecodeWorkerCount
+	DecodeWorkerCount int
+	// BlockFileThreshold and BlockFilePath stream large blocks to temp files, see WithBlockFiles
+	BlockFileThreshold int64
+	BlockFilePath      string
+	// CDNURLTemplate is a CDN in front of the store that blocks are read from, see WithCDN
+	CDNURLTemplate string
+	// BlockCacheControl is the Cache-Control header of the blocks written to the store, see WithBlockCacheControl
+	BlockCacheControl string
+	// ConditionalPuts skips the existence check before a block is written, see WithConditionalPuts
+	ConditionalPuts bool
+	// AllowedRegions are the regions the bucket of the store must be in before it is written to, see WithAllowedRegions
+	AllowedRegions []string
+	// RequestSigningKeyID and RequestSigningSecret sign the requests to HTTP block servers, see WithRequestSigning
+	RequestSigningKeyID  string
+	RequestSigningSecret []byte
+	// BlockAccessDir and BlockAccessUploadInterval gather and upload block read counts, see WithBlockAccessTracking
+	BlockAccessDir            string
+	BlockAccessUploadInterval time.Duration
+	// IdleTimeout makes the remote block store release its resources when it gets no requests, see WithIdleHibernation
+	IdleTimeout time.Duration
+	// MaxMemory is the hard cap of the memory held by the remote block store, zero is unlimited, see WithMaxMemory
+	MaxMemory int64
+	// PrefetchWindow is the number of blocks prefetched ahead of a restore, see WithPrefetchWindow
+	PrefetchWindow int
+	// Faults are the faults injected by stores with a faulty+ URI, see NewFaultyBlobStoreForURI
+	Faults FaultConfig
+}
+
+// StoreOption modifies StoreOptions, pass to the store constructors
+type StoreOption func(options *StoreOptions)
+
+// WithProxy routes all backend requests via proxyURL
+func WithProxy(proxyURL string) StoreOption {
+	return func(options *StoreOptions) {
+		options.Transport.ProxyURL = proxyURL
+	}
+}
+
+// WithRootCAFile trusts the certificates in the PEM file rootCAFile in addition to the system roots
+func WithRootCAFile(rootCAFile string) StoreOption {
+	return func(options *StoreOptions) {
+		options.Transport.RootCAFile = rootCAFile
+	}
+}
+
+// WithTLSMinVersion sets the minimum accepted TLS version, use the crypto/tls version constants
+func WithTLSMinVersion(version uint16) StoreOption {
+	return func(options *StoreOptions) {
+		options.Transport.TLSMinVersion = version
+	}
+}
+
+// WithMaxConcurrentRequests limits the number of in-flight backend requests shared by all workers of a store
+func WithMaxConcurrentRequests(maxConcurrentRequests int) StoreOption {
+	return func(options *StoreOptions) {
+		options.MaxConcurrentRequests = maxConcurrentRequests
+	}
+}
+
+// WithMaxThrottleBackoff caps the delay added between requests when the backend reports throttling
+func WithMaxThrottleBackoff(maxBackoff time.Duration) StoreOption {
+	return func(options *StoreOptions) {
+		options.MaxThrottleBackoff = maxBackoff
+	}
+}
+
+// WithImmutable turns the store into write-once-read-many mode. Existing objects are verified
+// instead of rewritten and deletes are refused. Only writes made after LockWriteVersion, such as
+// the store index update, may replace an existing object.
+func WithImmutable() StoreOption {
+	return func(options *StoreOptions) {
+		options.Immutable = true
+	}
+}
+
+// WithRestoreArchived makes the remote block store request a restore when it reads an archived block.
+// It polls every pollInterval until the block can be read or timeout has passed.
+func WithRestoreArchived(timeout time.Duration, pollInterval time.Duration) StoreOption {
+	return func(options *StoreOptions) {
+		options.RestoreArchived = true
+		options.RestoreTimeout = timeout
+		options.RestorePollInterval = pollInterval
+	}
+}
+
+// WithMirrorURIs adds read-only mirrors of the store. The remote block store reads blocks from the
+// primary store and the mirrors in order of their health and only fails when none of them has the block.
+func WithMirrorURIs(mirrorURIs ...string) StoreOption {
+	return func(options *StoreOptions) {
+		options.MirrorURIs = append(options.MirrorURIs, mirrorURIs...)
+	}
+}
+
+// WithHedgedReads lowers the tail latency of block reads from a store with mirrors. When a read has
+// not completed within the given percentile of the latencies of recent reads, for example 95, the
+// block is also read from the next healthiest source. The first answer is used and the other read
+// is cancelled. Reads are not hedged until a few latencies have been recorded.
+func WithHedgedReads(percentile float64) StoreOption {
+	return func(options *StoreOptions) {
+		options.HedgePercentile = percentile
+	}
+}
+
+// WithRepairFromMirrors makes the remote block store heal a partially pruned or damaged store. When
+// a block is missing or corrupt in the store and is read from a mirror instead, the copy from the
+// mirror is written back to the store, also when the store is opened read-only. Blocks are always
+// read from the store first so its damaged blocks are found. Needs WithMirrorURIs.
+func WithRepairFromMirrors() StoreOption {
+	return func(options *StoreOptions) {
+		options.RepairFromMirrors = true
+	}
+}
+
+// WithHooks registers callbacks that the remote block store makes when blocks are uploaded or downloaded,
+// the store index is updated and requests are retried. Only the last WithHooks option is used.
+func WithHooks(hooks StoreHooks) StoreOption {
+	return func(options *StoreOptions) {
+		options.Hooks = hooks
+	}
+}
+
+// WithSlowOperationThreshold logs the block reads and writes and store index reads and updates of
+// the remote block store that take longer than threshold, with the block hash, the object key and
+// the backend or mirror that served it. Zero turns the logging off. The latencies of all
+// operations are counted in histograms regardless, see DetailedStats.
+func WithSlowOperationThreshold(threshold time.Duration) StoreOption {
+	return func(options *StoreOptions) {
+		options.SlowOperationThreshold = threshold
+	}
+}
+
+// WithWorkerCount sets the number of workers of the remote block store
+func WithWorkerCount(workerCount int) StoreOption {
+	return func(options *StoreOptions) {
+		options.WorkerCount = workerCount
+	}
+}
+
+// WithAccessType sets how the remote block store accesses the store
+func WithAccessType(accessType AccessType) StoreOption {
+	return func(options *StoreOptions) {
+		options.AccessType = &accessType
+	}
+}
+
+// WithMaxPrefetchMemory limits the memory used by blocks the remote block store has prefetched, the default is 512 MB
+func WithMaxPrefetchMemory(maxPrefetchMemory int64) StoreOption {
+	return func(options *StoreOptions) {
+		options.MaxPrefetchMemory = maxPrefetchMemory
+	}
+}
+
+// WithMaxRetries sets the number of times a failed block read or write is retried, zero disables retries
+func WithMaxRetries(maxRetries int) StoreOption {
+	return func(options *StoreOptions) {
+		if maxRetries == 0 {
+			maxRetries = -1
+		}
+		options.MaxRetries = maxRetries
+	}
+}
+
+// WithQuota limits the chunk data and the number of blocks in the store index, zero is unlimited.
+// The remote block store rejects blocks that would take the store over its quota.
+func WithQuota(maxBytes int64, maxBlockCount int64) StoreOption {
+	return func(options *StoreOptions) {
+		options.MaxStoreBytes = maxBytes
+		options.MaxStoreBlockCount = maxBlockCount
+	}
+}
+
+// WithAuditLog records uploads, prunes and other mutations of the store as entries in its audit/
+// prefix, see QueryAuditLog
+func WithAuditLog() StoreOption {
+	return func(options *StoreOptions) {
+		options.AuditLog = true
+	}
+}
+
+// WithIdentity stamps the objects written to the store, such as blocks and version indexes, with
+// identity, for example a user or CI job id, so they can be traced back to the upload that wrote them.
+// Backends without object metadata ignore it. The identity is also used for audit log entries.
+func WithIdentity(identity string) StoreOption {
+	return func(options *StoreOptions) {
+		options.Identity = identity
+	}
+}
+
+// WithRequesterPays accepts the charges for reading from an S3 bucket that has requester pays enabled,
+// such as a public asset bucket. Stores opened this way are read-only, writes and deletes are refused.
+func WithRequesterPays() StoreOption {
+	return func(options *StoreOptions) {
+		options.RequesterPays = true
+	}
+}
+
+// WithAnonymous accesses public buckets without credentials. No credentials are looked up, which
+// avoids waiting for a metadata server that can not be reached, and only public objects can be read.
+func WithAnonymous() StoreOption {
+	return func(options *StoreOptions) {
+		options.Anonymous = true
+	}
+}
+
+// WithIPFSManifest reads the objects of an ipfs:// store from the published manifest with the CID
+// manifestCID instead of the manifest kept by the node, so anyone can download from a store that was
+// uploaded to another node. Stores opened this way are read-only.
+func WithIPFSManifest(manifestCID string) StoreOption {
+	return func(options *StoreOptions) {
+		options.IPFSManifestCID = manifestCID
+	}
+}
+
+// WithOAuthClient sets the OAuth client of the application registered with Google or Microsoft that
+// gdrive:// and onedrive:// stores sign in with. The first time a store is used the user is asked to
+// open a web page and enter a code, the token is then kept in the user cache directory.
+func WithOAuthClient(clientID string, clientSecret string) StoreOption {
+	return func(options *StoreOptions) {
+		options.OAuthClientID = clientID
+		options.OAuthClientSecret = clientSecret
+	}
+}
+
+// WithOAuthTokenFile keeps the OAuth token of gdrive:// and onedrive:// stores in tokenFile instead of
+// the user cache directory
+func WithOAuthTokenFile(tokenFile string) StoreOption {
+	return func(options *StoreOptions) {
+		options.OAuthTokenFile = tokenFile
+	}
+}
+
+// WithNetworkShare makes a file store safe to update from several machines when it is on an SMB or NFS
+// share. A write after LockWriteVersion, such as the store index update, takes a lock file next to the
+// object and only replaces the object if no other writer has replaced it since LockWriteVersion.
+func WithNetworkShare() StoreOption {
+	return func(options *StoreOptions) {
+		options.NetworkShare = true
+	}
+}
+
+// WithSessionMode sets the mode the remote block store starts in, the mode can be switched while
+// the store is in use with SessionModeSwitcher
+func WithSessionMode(mode SessionMode) StoreOption {
+	return func(options *StoreOptions) {
+		options.SessionMode = mode
+	}
+}
+
+// WithBackgroundLimits limits the remote block store in Background mode to workerCount block
+// transfers at a time and bytesPerSecond of block data, zero workerCount uses one worker and zero
+// bytesPerSecond does not limit the rate
+func WithBackgroundLimits(workerCount int, bytesPerSecond int64) StoreOption {
+	return func(options *StoreOptions) {
+		options.BackgroundWorkerCount = workerCount
+		options.BackgroundBytesPerSecond = bytesPerSecond
+	}
+}
+
+// WithSessionState resumes the session of a remote block store exported with SessionStateExporter.
+// The saved store index and preflighted blocks are used while the store index has not changed and
+// the blocks that were prefetched are prefetched again.
+func WithSessionState(state SessionState) StoreOption {
+	return func(options *StoreOptions) {
+		options.SessionState = &state
+	}
+}
+
+// IsNetworkShare returns true if opts turn on network share mode, file stores in network share mode
+// have to be accessed through NewFSBlobStore rather than the native file system block store
+func IsNetworkShare(opts ...StoreOption) bool {
+	return newStoreOptions(opts).NetworkShare
+}
+
+func newStoreOptions(opts []StoreOption) StoreOptions {
+	options := StoreOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithQueueDepths sets the number of requests the queues of the remote block store hold before
+// callers have to wait. Zero keeps the default of a queue, 8 block puts and 2048 block gets,
+// prefetches and block index updates per worker. Smaller queues use less memory and make
+// backpressure show up sooner in the QueueStats of DetailedStats.
+func WithQueueDepths(putQueueDepth int, getQueueDepth int, prefetchQueueDepth int, blockIndexQueueDepth int) StoreOption {
+	return func(options *StoreOptions) {
+		options.PutQueueDepth = putQueueDepth
+		options.GetQueueDepth = getQueueDepth
+		options.PrefetchQueueDepth = prefetchQueueDepth
+		options.BlockIndexQueueDepth = blockIndexQueueDepth
+	}
+}
+
+// WithQueueTimeout limits how long a block put or get waits for room in a full queue of the remote
+// block store, it then fails with EBUSY. Prefetches that do not fit in the queue in time are
+// dropped. Zero, the default, waits until there is room.
+func WithQueueTimeout(timeout time.Duration) StoreOption {
+	return func(options *StoreOptions) {
+		options.QueueTimeout = timeout
+	}
+}
+
+// WithWorkerPools gives block puts and block gets separate pools of workers of the remote block
+// store so heavy uploads do not delay reads. Zero for one of the pools uses the worker count of
+// the store for it. By default, when neither is set, all workers handle both puts and gets.
+// The put and block index queues are sized for the upload pool and the get and prefetch queues
+// for the download pool.
+func WithWorkerPools(uploadWorkerCount int, downloadWorkerCount int) StoreOption {
+	return func(options *StoreOptions) {
+		options.UploadWorkerCount = uploadWorkerCount
+		options.DownloadWorkerCount = downloadWorkerCount
+	}
+}
+
+// WithBlockFiles streams blocks larger than threshold bytes to temp files in path as they are
+// read from the store, instead of buffering the whole block in memory, and the native library reads
+// the block from the file. Prefetched blocks in temp files stay there until they are requested and
+// do not count towards the max prefetch memory. An empty path uses the temp folder of the system.
+// By default blocks are read into memory.
+func WithBlockFiles(threshold int64, path string) StoreOption {
+	return func(options *StoreOptions) {
+		options.BlockFileThreshold = threshold
+		options.BlockFilePath = path
+	}
+}
+
+// WithDecodeWorkerCount sets the number of workers that decode the blocks read by the remote block
+// store, the default is one per CPU. The download workers hand the blocks they have read to the
+// decode workers and go on with the next read, so reads overlap with the decoding and
+// decompression of the blocks. A negative count decodes the blocks on the download workers.
+func WithDecodeWorkerCount(decodeWorkerCount int) StoreOption {
+	return func(options *StoreOptions) {
+		options.DecodeWorkerCount = decodeWorkerCount
+	}
+}
+
+// WithCDN makes the remote block store read blocks through a CDN that has the store as its origin,
+// such as CloudFront or Cloud CDN, while writes and the store index go to the store. The {key} in
+// urlTemplate is replaced by the key of the block, for example
+// https://d111111abcdef8.cloudfront.net/store/{key}, a template without {key} is the base URL of
+// the store. Blocks the CDN does not have are read from the store, and after a failed request the
+// store is read instead of the CDN for a while.
+func WithCDN(urlTemplate string) StoreOption {
+	return func(options *StoreOptions) {
+		options.CDNURLTemplate = urlTemplate
+	}
+}
+
+// WithBlockCacheControl sets the Cache-Control header of the blocks written to GCS stores, for
+// example "public, max-age=31536000, immutable", so a CDN in front of the store caches them.
+// Blocks never change once written, the store index and version indexes are written without it.
+func WithBlockCacheControl(cacheControl string) StoreOption {
+	return func(options *StoreOptions) {
+		options.BlockCacheControl = cacheControl
+	}
+}
+
+// WithConditionalPuts saves a request per uploaded block. Blocks are content addressed and never
+// change, so instead of checking if a block exists before it is written the remote block store
+// skips blocks that are in the store index it has read or that it has put itself, and writes the
+// others with a create-only request that leaves an existing block as it is, such as a PUT with
+// If-None-Match: *. Blocks that are in the store index but missing from the store are not written
+// again, run ScrubStore to find them. Stores that can not write conditionally check if the block
+// exists first as before.
+func WithConditionalPuts() StoreOption {
+	return func(options *StoreOptions) {
+		options.ConditionalPuts = true
+	}
+}
+
+// WithAllowedRegions only allows writes to stores whose bucket is in one of regions, for
+// organizations with data residency rules. The region is queried from the provider before the
+// first write and compared without regard to case with the location the provider reports, such
+// as EU or EUROPE-WEST1 for GCS, a multi-region is not expanded to the regions it covers. Writes
+// to a store in another region fail with a RegionNotAllowedError. Local file stores keep the data
+// on the machine and are not checked, stores that can not report a region are refused. Only the
+// last WithAllowedRegions option is used.
+func WithAllowedRegions(regions ...string) StoreOption {
+	return func(options *StoreOptions) {
+		options.AllowedRegions = regions
+	}
+}
+
+// WithRequestSigning signs the requests to an HTTP block server read through WithCDN with the
+// shared secret of the key keyID, so a self-hosted block server can authenticate its clients
+// without TLS client certificates. See SignRequest for the scheme and VerifySignedRequest to
+// check the requests on the server.
+func WithRequestSigning(keyID string, secret []byte) StoreOption {
+	return func(options *StoreOptions) {
+		options.RequestSigningKeyID = keyID
+		options.RequestSigningSecret = secret
+	}
+}
+
+// WithBlockAccessTracking counts the reads of each block by the remote block store. The counts are
+// added to a file per store in dir when the store is closed, so the sessions on a machine are
+// gathered, and uploaded to the access/ prefix of the store once the file is older than
+// uploadInterval, DefaultBlockAccessUploadInterval if it is zero. Use QueryBlockAccess to find hot
+// and cold blocks from the uploads of all machines.
+func WithBlockAccessTracking(dir string, uploadInterval time.Duration) StoreOption {
+	return func(options *StoreOptions) {
+		options.BlockAccessDir = dir
+		options.BlockAccessUploadInterval = uploadInterval
+	}
+}
+
+// WithIdleHibernation makes the workers of the remote block store hibernate when they have had no
+// requests for idleTimeout. A hibernating block worker closes its blob client and frees the
+// prefetched blocks nobody waits for, the store index worker drops the store index unless it has
+// blocks to save. They are set up again on the next request, which reads the store index again, so
+// a long running process such as a launcher does not hold on to the memory between syncs.
+func WithIdleHibernation(idleTimeout time.Duration) StoreOption {
+	return func(options *StoreOptions) {
+		options.IdleTimeout = idleTimeout
+	}
+}
+
+// WithMaxMemory caps the memory held by the remote block store at maxMemory bytes, counting the
+// prefetched blocks, the blocks queued or being put and the store index. Above the cap no blocks
+// are prefetched and PutStoredBlock waits for queued puts to finish, up to the queue timeout of
+// WithQueueTimeout, before it fails with EBUSY. This keeps 32-bit and other constrained clients
+// from running out of memory when the store is slower than the caller. The store index is counted
+// but never waits, a store index larger than the cap lets one put through at a time.
+func WithMaxMemory(maxMemory int64) StoreOption {
+	return func(options *StoreOptions) {
+		options.MaxMemory = maxMemory
+	}
+}
+
+// WithPrefetchWindow limits the blocks the remote block store prefetches for a PreflightGet to the
+// next blocks the restore needs, in the order of HintDownloadOrder. The window moves on as
+// the restore reads the blocks, so the prefetch memory holds the blocks needed soon rather than
+// blocks far into the restore. The default is 8 blocks per download worker, a negative count
+// prefetches all blocks at once.
+func WithPrefetchWindow(blocks int) StoreOption {
+	return func(options *StoreOptions) {
+		options.PrefetchWindow = blocks
+	}
+}
+
+// WithStaticCredentials authenticates S3 stores with the access key and secret instead of looking
+// up the credentials of the caller. ParseStoreURI sets them from a URI such as
+// s3://KEY:SECRET@bucket/path for quick ad-hoc use, the secret is never part of the name of the
+// store and RedactStoreURI removes it from logged URIs.
+func WithStaticCredentials(accessKeyID string, secretAccessKey string) StoreOption {
+	return func(options *StoreOptions) {
+		options.AccessKeyID = accessKeyID
+		options.SecretAccessKey = secretAccessKey
+	}
+}
+
+// WithSecretPrompt asks prompt for the secret of S3 stores that have an access key without a
+// secret, such as s3://KEY@bucket/path, when the store is opened. Without a prompt such stores fail
+// to open. Only pass a prompt when there is a user to answer it, such as when standard input is a
+// terminal.
+func WithSecretPrompt(prompt SecretPrompt) StoreOption {
+	return func(options *StoreOptions) {
+		options.SecretPrompt = prompt
+	}
+}
+
+// WithCredentialHelper looks up the credentials of S3 stores in the bucket host with helper, or of
+// all buckets without a helper of their own if host is empty, see NewCredentialHelper. The helper is
+// asked when the store is opened, unless the store has credentials from WithStaticCredentials or
+// is anonymous, and the store uses the credentials of the caller if the helper has none.
+func WithCredentialHelper(host string, helper CredentialHelper) StoreOption {
+	return func(options *StoreOptions) {
+		credentialHelpers := map[string]CredentialHelper{host: helper}
+		for h, existing := range options.CredentialHelpers {
+			if h != host {
+				credentialHelpers[h] = existing
+			}
+		}
+		options.CredentialHelpers = credentialHelpers
+	}
+}
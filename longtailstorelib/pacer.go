@@ -0,0 +1,101 @@
+package longtailstorelib
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minThrottleBackoff        = 100 * time.Millisecond
+	defaultMaxThrottleBackoff = 30 * time.Second
+)
+
+// requestPacer limits the number of concurrent backend requests for a blob store and
+// adaptively delays requests when the backend reports that we are being throttled.
+// It is shared by all clients created from the same blob store.
+type requestPacer struct {
+	name       string
+	slots      chan struct{}
+	backoff    int64
+	maxBackoff int64
+
+	// lock serializes changes of backoff, lastChange is the time of the last change in UnixNano
+	lock       sync.Mutex
+	lastChange int64
+
+	throttledCount uint64
+}
+
+func newRequestPacer(name string, maxConcurrentRequests int, maxBackoff time.Duration) *requestPacer {
+	p := &requestPacer{name: name, maxBackoff: int64(maxBackoff)}
+	if maxConcurrentRequests > 0 {
+		p.slots = make(chan struct{}, maxConcurrentRequests)
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = int64(defaultMaxThrottleBackoff)
+	}
+	return p
+}
+
+// begin blocks until a request slot is available and any current throttle backoff has passed
+func (p *requestPacer) begin() {
+	if p.slots != nil {
+		p.slots <- struct{}{}
+	}
+	backoff := atomic.LoadInt64(&p.backoff)
+	if backoff > 0 {
+		time.Sleep(time.Duration(backoff))
+	}
+}
+
+// end releases the request slot. A throttled request doubles the backoff, it is halved once for
+// each backoff interval without a throttled request, so the successes of the requests that are in
+// flight when the backend throttles do not undo the backoff at once.
+func (p *requestPacer) end(throttled bool) {
+	if p.slots != nil {
+		<-p.slots
+	}
+	if throttled {
+		atomic.AddUint64(&p.throttledCount, 1)
+	} else if atomic.LoadInt64(&p.backoff) == 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	backoff := atomic.LoadInt64(&p.backoff)
+	if throttled {
+		newBackoff := backoff * 2
+		if newBackoff < int64(minThrottleBackoff) {
+			newBackoff = int64(minThrottleBackoff)
+		}
+		if newBackoff > p.maxBackoff {
+			newBackoff = p.maxBackoff
+		}
+		p.lastChange = now
+		if newBackoff != backoff {
+			atomic.StoreInt64(&p.backoff, newBackoff)
+			log.Printf("Throttled by %s, delaying requests by %v\n", p.name, time.Duration(newBackoff))
+		}
+		return
+	}
+	if backoff == 0 || now-p.lastChange < backoff {
+		return
+	}
+	newBackoff := backoff / 2
+	if newBackoff < int64(minThrottleBackoff) {
+		newBackoff = 0
+	}
+	atomic.StoreInt64(&p.backoff, newBackoff)
+	p.lastChange = now
+}
+
+func (p *requestPacer) currentBackoff() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.backoff))
+}
+
+func (p *requestPacer) getThrottledCount() uint64 {
+	return atomic.LoadUint64(&p.throttledCount)
+}
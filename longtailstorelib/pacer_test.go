@@ -0,0 +1,70 @@
+package longtailstorelib
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestPacerConcurrency(t *testing.T) {
+	pacer := newRequestPacer("test", 2, 0)
+	var inFlight int32
+	var maxInFlight int32
+	var wg sync.WaitGroup
+	wg.Add(16)
+	for i := 0; i < 16; i++ {
+		go func() {
+			pacer.begin()
+			current := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			pacer.end(false)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if maxInFlight > 2 {
+		t.Errorf("TestRequestPacerConcurrency() maxInFlight %d > %d", maxInFlight, 2)
+	}
+}
+
+func TestRequestPacerBackoff(t *testing.T) {
+	pacer := newRequestPacer("test", 0, 400*time.Millisecond)
+	pacer.begin()
+	pacer.end(true)
+	if pacer.currentBackoff() != minThrottleBackoff {
+		t.Errorf("TestRequestPacerBackoff() pacer.currentBackoff() %v != %v", pacer.currentBackoff(), minThrottleBackoff)
+	}
+	pacer.end(true)
+	pacer.end(true)
+	pacer.end(true)
+	if pacer.currentBackoff() != 400*time.Millisecond {
+		t.Errorf("TestRequestPacerBackoff() pacer.currentBackoff() %v != %v", pacer.currentBackoff(), 400*time.Millisecond)
+	}
+	if pacer.getThrottledCount() != 4 {
+		t.Errorf("TestRequestPacerBackoff() pacer.getThrottledCount() %d != %d", pacer.getThrottledCount(), 4)
+	}
+
+	// Successes right after a throttle keep the backoff, it is halved once per backoff interval
+	for i := 0; i < 8; i++ {
+		pacer.end(false)
+	}
+	if pacer.currentBackoff() != 400*time.Millisecond {
+		t.Errorf("TestRequestPacerBackoff() pacer.currentBackoff() after successes %v != %v", pacer.currentBackoff(), 400*time.Millisecond)
+	}
+	for _, expected := range []time.Duration{200 * time.Millisecond, 100 * time.Millisecond, 0} {
+		pacer.lastChange -= int64(pacer.currentBackoff())
+		pacer.end(false)
+		pacer.end(false)
+		if pacer.currentBackoff() != expected {
+			t.Errorf("TestRequestPacerBackoff() pacer.currentBackoff() %v != %v", pacer.currentBackoff(), expected)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// PackingStrategy controls how the chunks missing from a store are grouped into new blocks
+type PackingStrategy int
+
+const (
+	// DefaultPacking fills blocks with the missing chunks in version index order
+	DefaultPacking PackingStrategy = iota
+	// CoalesceSmallFilesPacking puts the chunks of files smaller than the target chunk size in
+	// blocks of their own which may hold coalescedChunksPerBlockFactor times more chunks.
+	// The block size limit still applies so stores with many tiny assets get far fewer objects.
+	CoalesceSmallFilesPacking
+)
+
+const coalescedChunksPerBlockFactor = 16
+
+// ParsePackingStrategy converts a packing strategy name to a PackingStrategy
+func ParsePackingStrategy(name string) (PackingStrategy, error) {
+	switch name {
+	case "", "default":
+		return DefaultPacking, nil
+	case "coalesce-small-files":
+		return CoalesceSmallFilesPacking, nil
+	}
+	return DefaultPacking, fmt.Errorf("unsupported packing strategy `%s`", name)
+}
+
+// CreateMissingContentWithPacking returns a store index with new blocks for all chunks in versionIndex
+// that are not in storeIndex, the blocks are laid out according to packing
+func CreateMissingContentWithPacking(
+	hashAPI longtaillib.Longtail_HashAPI,
+	storeIndex longtaillib.Longtail_StoreIndex,
+	versionIndex longtaillib.Longtail_VersionIndex,
+	maxBlockSize uint32,
+	maxChunksPerBlock uint32,
+	packing PackingStrategy) (longtaillib.Longtail_StoreIndex, error) {
+	if packing == DefaultPacking {
+		missingStoreIndex, errno := longtaillib.CreateMissingContent(hashAPI, storeIndex, versionIndex, maxBlockSize, maxChunksPerBlock)
+		if errno != 0 {
+			return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "CreateMissingContentWithPacking: longtaillib.CreateMissingContent() failed")
+		}
+		return missingStoreIndex, nil
+	}
+
+	knownChunks := map[uint64]bool{}
+	for _, chunkHash := range storeIndex.GetChunkHashes() {
+		knownChunks[chunkHash] = true
+	}
+	assetOrder := make([]int, versionIndex.GetAssetCount())
+	for assetIndex := range assetOrder {
+		assetOrder[assetIndex] = assetIndex
+	}
+	small, regular := collectChunks(versionIndex, assetOrder, knownChunks, packing)
+	missingStoreIndex, err := packChunks(hashAPI, small, regular, maxBlockSize, maxChunksPerBlock)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(err, "CreateMissingContentWithPacking")
+	}
+	return missingStoreIndex, nil
+}
+
+// CreateDeterministicContent returns a store index with the blocks for versionIndex that are not in
+// storeIndex. All chunks of versionIndex are packed in asset path order without regard to which of them
+// are in the store already, so the same version content, chunking and hashing gives the same blocks on
+// every machine and independent uploads to the same store share their blocks. Blocks in storeIndex
+// are left out, chunks that are in other blocks of the store are stored again.
+func CreateDeterministicContent(
+	hashAPI longtaillib.Longtail_HashAPI,
+	storeIndex longtaillib.Longtail_StoreIndex,
+	versionIndex longtaillib.Longtail_VersionIndex,
+	maxBlockSize uint32,
+	maxChunksPerBlock uint32,
+	packing PackingStrategy) (longtaillib.Longtail_StoreIndex, error) {
+	assetOrder := make([]int, versionIndex.GetAssetCount())
+	assetPaths := make([]string, len(assetOrder))
+	for assetIndex := range assetOrder {
+		assetOrder[assetIndex] = assetIndex
+		assetPaths[assetIndex] = versionIndex.GetAssetPath(uint32(assetIndex))
+	}
+	sort.Slice(assetOrder, func(i, j int) bool {
+		return assetPaths[assetOrder[i]] < assetPaths[assetOrder[j]]
+	})
+	small, regular := collectChunks(versionIndex, assetOrder, map[uint64]bool{}, packing)
+	versionStoreIndex, err := packChunks(hashAPI, small, regular, maxBlockSize, maxChunksPerBlock)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(err, "CreateDeterministicContent")
+	}
+	defer versionStoreIndex.Dispose()
+
+	knownBlocks := map[uint64]bool{}
+	for _, blockHash := range storeIndex.GetBlockHashes() {
+		knownBlocks[blockHash] = true
+	}
+	missingBlocks := []longtaillib.Longtail_BlockIndex{}
+	defer func() {
+		for _, blockIndex := range missingBlocks {
+			blockIndex.Dispose()
+		}
+	}()
+	for b, blockHash := range versionStoreIndex.GetBlockHashes() {
+		if knownBlocks[blockHash] {
+			continue
+		}
+		blockIndex, errno := versionStoreIndex.GetBlockIndex(uint32(b))
+		if errno != 0 {
+			return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "CreateDeterministicContent: versionStoreIndex.GetBlockIndex() failed")
+		}
+		missingBlocks = append(missingBlocks, blockIndex)
+	}
+	missingStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks(missingBlocks)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "CreateDeterministicContent: longtaillib.CreateStoreIndexFromBlocks() failed")
+	}
+	return missingStoreIndex, nil
+}
+
+// collectChunks lists the chunks of the assets of versionIndex in assetOrder that are not in knownChunks,
+// each chunk once. With CoalesceSmallFilesPacking the chunks of small assets go in a list of their own.
+func collectChunks(
+	versionIndex longtaillib.Longtail_VersionIndex,
+	assetOrder []int,
+	knownChunks map[uint64]bool,
+	packing PackingStrategy) (small chunkList, regular chunkList) {
+	chunkHashes := versionIndex.GetChunkHashes()
+	chunkSizes := versionIndex.GetChunkSizes()
+	chunkTags := versionIndex.GetChunkTags()
+	assetSizes := versionIndex.GetAssetSizes()
+	assetChunkCounts := versionIndex.GetAssetChunkCounts()
+	assetChunkIndexStarts := versionIndex.GetAssetChunkIndexStarts()
+	assetChunkIndexes := versionIndex.GetAssetChunkIndexes()
+	smallAssetSize := uint64(versionIndex.GetTargetChunkSize())
+
+	for _, assetIndex := range assetOrder {
+		list := &regular
+		if packing == CoalesceSmallFilesPacking && assetSizes[assetIndex] < smallAssetSize {
+			list = &small
+		}
+		start := assetChunkIndexStarts[assetIndex]
+		for _, chunkIndex := range assetChunkIndexes[start : start+assetChunkCounts[assetIndex]] {
+			chunkHash := chunkHashes[chunkIndex]
+			if knownChunks[chunkHash] {
+				continue
+			}
+			knownChunks[chunkHash] = true
+			list.add(chunkHash, chunkSizes[chunkIndex], chunkTags[chunkIndex])
+		}
+	}
+	return small, regular
+}
+
+// packChunks fills blocks with the chunks of each list in order, blocks of small assets may hold
+// coalescedChunksPerBlockFactor times more chunks
+func packChunks(
+	hashAPI longtaillib.Longtail_HashAPI,
+	small chunkList,
+	regular chunkList,
+	maxBlockSize uint32,
+	maxChunksPerBlock uint32) (longtaillib.Longtail_StoreIndex, error) {
+	regularStoreIndex, errno := longtaillib.CreateStoreIndexFromChunks(hashAPI, regular.hashes, regular.sizes, regular.tags, maxBlockSize, maxChunksPerBlock)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.CreateStoreIndexFromChunks() failed")
+	}
+	defer regularStoreIndex.Dispose()
+	smallStoreIndex, errno := longtaillib.CreateStoreIndexFromChunks(hashAPI, small.hashes, small.sizes, small.tags, maxBlockSize, maxChunksPerBlock*coalescedChunksPerBlockFactor)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.CreateStoreIndexFromChunks() failed")
+	}
+	defer smallStoreIndex.Dispose()
+
+	storeIndex, errno := longtaillib.MergeStoreIndex(regularStoreIndex, smallStoreIndex)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, errors.Wrap(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.MergeStoreIndex() failed")
+	}
+	return storeIndex, nil
+}
+
+type chunkList struct {
+	hashes []uint64
+	sizes  []uint32
+	tags   []uint32
+}
+
+func (l *chunkList) add(hash uint64, size uint32, tag uint32) {
+	l.hashes = append(l.hashes, hash)
+	l.sizes = append(l.sizes, size)
+	l.tags = append(l.tags, tag)
+}
@@ -0,0 +1,189 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func createSmallFilesVersionIndex(t *testing.T, hashAPI longtaillib.Longtail_HashAPI) (longtaillib.Longtail_StorageAPI, longtaillib.Longtail_VersionIndex) {
+	storageAPI := longtaillib.CreateInMemStorageAPI()
+	for i := 0; i < 600; i++ {
+		data := make([]byte, 100)
+		rand.Read(data)
+		storageAPI.WriteToStorage("content", fmt.Sprintf("small/%d.txt", i), data)
+	}
+	large := make([]byte, 256*1024)
+	rand.Read(large)
+	storageAPI.WriteToStorage("content", "large.bin", large)
+
+	fileInfos, errno := longtaillib.GetFilesRecursively(storageAPI, longtaillib.Longtail_PathFilterAPI{}, "content")
+	if errno != 0 {
+		t.Fatalf("createSmallFilesVersionIndex() GetFilesRecursively() %d != %d", errno, 0)
+	}
+	defer fileInfos.Dispose()
+	chunkerAPI := longtaillib.CreateHPCDCChunkerAPI()
+	defer chunkerAPI.Dispose()
+	jobAPI := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	versionIndex, errno := longtaillib.CreateVersionIndex(
+		storageAPI,
+		hashAPI,
+		chunkerAPI,
+		jobAPI,
+		nil,
+		"content",
+		fileInfos,
+		make([]uint32, fileInfos.GetFileCount()),
+		32768)
+	if errno != 0 {
+		t.Fatalf("createSmallFilesVersionIndex() CreateVersionIndex() %d != %d", errno, 0)
+	}
+	return storageAPI, versionIndex
+}
+
+func TestParsePackingStrategy(t *testing.T) {
+	packing, err := ParsePackingStrategy("coalesce-small-files")
+	if err != nil || packing != CoalesceSmallFilesPacking {
+		t.Errorf("TestParsePackingStrategy() ParsePackingStrategy(\"coalesce-small-files\") %d, %v != %d, %v", packing, err, CoalesceSmallFilesPacking, nil)
+	}
+	_, err = ParsePackingStrategy("tight")
+	if err == nil {
+		t.Errorf("TestParsePackingStrategy() ParsePackingStrategy(\"tight\") %v == %v", err, nil)
+	}
+}
+
+func TestCoalesceSmallFilesPacking(t *testing.T) {
+	hashAPI := longtaillib.CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	storageAPI, versionIndex := createSmallFilesVersionIndex(t, hashAPI)
+	defer storageAPI.Dispose()
+	defer versionIndex.Dispose()
+
+	emptyStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	if errno != 0 {
+		t.Fatalf("TestCoalesceSmallFilesPacking() CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer emptyStoreIndex.Dispose()
+
+	defaultStoreIndex, err := CreateMissingContentWithPacking(hashAPI, emptyStoreIndex, versionIndex, 1024*1024, 64, DefaultPacking)
+	if err != nil {
+		t.Fatalf("TestCoalesceSmallFilesPacking() CreateMissingContentWithPacking(DefaultPacking) %v != %v", err, nil)
+	}
+	defer defaultStoreIndex.Dispose()
+
+	coalescedStoreIndex, err := CreateMissingContentWithPacking(hashAPI, emptyStoreIndex, versionIndex, 1024*1024, 64, CoalesceSmallFilesPacking)
+	if err != nil {
+		t.Fatalf("TestCoalesceSmallFilesPacking() CreateMissingContentWithPacking(CoalesceSmallFilesPacking) %v != %v", err, nil)
+	}
+	defer coalescedStoreIndex.Dispose()
+
+	if coalescedStoreIndex.GetChunkCount() != defaultStoreIndex.GetChunkCount() {
+		t.Errorf("TestCoalesceSmallFilesPacking() GetChunkCount() %d != %d", coalescedStoreIndex.GetChunkCount(), defaultStoreIndex.GetChunkCount())
+	}
+	if coalescedStoreIndex.GetBlockCount() != 2 {
+		t.Errorf("TestCoalesceSmallFilesPacking() GetBlockCount() %d != %d", coalescedStoreIndex.GetBlockCount(), 2)
+	}
+	if coalescedStoreIndex.GetBlockCount() >= defaultStoreIndex.GetBlockCount() {
+		t.Errorf("TestCoalesceSmallFilesPacking() GetBlockCount() %d >= %d", coalescedStoreIndex.GetBlockCount(), defaultStoreIndex.GetBlockCount())
+	}
+
+	// The coalesced blocks must be writable from the version
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobAPI := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobAPI, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestCoalesceSmallFilesPacking() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	errno = longtaillib.WriteContent(storageAPI, storeAPI, jobAPI, nil, coalescedStoreIndex, versionIndex, "content")
+	if errno != 0 {
+		t.Errorf("TestCoalesceSmallFilesPacking() WriteContent() %d != %d", errno, 0)
+	}
+	for _, blockHash := range coalescedStoreIndex.GetBlockHashes() {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+		if errno != 0 {
+			t.Errorf("TestCoalesceSmallFilesPacking() fetchBlockFromStore(0x%016x) %d != %d", blockHash, errno, 0)
+			continue
+		}
+		storedBlock.Dispose()
+	}
+}
+
+func TestDeterministicContent(t *testing.T) {
+	hashAPI := longtaillib.CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	storageAPI, versionIndex := createSmallFilesVersionIndex(t, hashAPI)
+	defer storageAPI.Dispose()
+	defer versionIndex.Dispose()
+
+	emptyStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	if errno != 0 {
+		t.Fatalf("TestDeterministicContent() CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer emptyStoreIndex.Dispose()
+
+	fullStoreIndex, err := CreateDeterministicContent(hashAPI, emptyStoreIndex, versionIndex, 1024*1024, 64, DefaultPacking)
+	if err != nil {
+		t.Fatalf("TestDeterministicContent() CreateDeterministicContent() %v != %v", err, nil)
+	}
+	defer fullStoreIndex.Dispose()
+	if fullStoreIndex.GetChunkCount() != versionIndex.GetChunkCount() {
+		t.Errorf("TestDeterministicContent() GetChunkCount() %d != %d", fullStoreIndex.GetChunkCount(), versionIndex.GetChunkCount())
+	}
+	fullBlockHashes := fullStoreIndex.GetBlockHashes()
+
+	// A store that holds some of the chunks in other blocks does not change the packing
+	chunkHashes := versionIndex.GetChunkHashes()[:10]
+	chunkSizes := versionIndex.GetChunkSizes()[:10]
+	otherStoreIndex, errno := longtaillib.CreateStoreIndexFromChunks(hashAPI, chunkHashes, chunkSizes, nil, 1024*1024, 64)
+	if errno != 0 {
+		t.Fatalf("TestDeterministicContent() CreateStoreIndexFromChunks() %d != %d", errno, 0)
+	}
+	defer otherStoreIndex.Dispose()
+	otherMissingStoreIndex, err := CreateDeterministicContent(hashAPI, otherStoreIndex, versionIndex, 1024*1024, 64, DefaultPacking)
+	if err != nil {
+		t.Fatalf("TestDeterministicContent() CreateDeterministicContent(other store) %v != %v", err, nil)
+	}
+	defer otherMissingStoreIndex.Dispose()
+	otherBlockHashes := otherMissingStoreIndex.GetBlockHashes()
+	if len(otherBlockHashes) != len(fullBlockHashes) {
+		t.Fatalf("TestDeterministicContent() other store GetBlockCount() %d != %d", len(otherBlockHashes), len(fullBlockHashes))
+	}
+	for i, blockHash := range otherBlockHashes {
+		if blockHash != fullBlockHashes[i] {
+			t.Errorf("TestDeterministicContent() other store block %d 0x%016x != 0x%016x", i, blockHash, fullBlockHashes[i])
+		}
+	}
+
+	// Blocks that are in the store already are left out
+	firstBlockIndex, errno := fullStoreIndex.GetBlockIndex(0)
+	if errno != 0 {
+		t.Fatalf("TestDeterministicContent() GetBlockIndex() %d != %d", errno, 0)
+	}
+	defer firstBlockIndex.Dispose()
+	partialStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{firstBlockIndex})
+	if errno != 0 {
+		t.Fatalf("TestDeterministicContent() CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer partialStoreIndex.Dispose()
+	partialMissingStoreIndex, err := CreateDeterministicContent(hashAPI, partialStoreIndex, versionIndex, 1024*1024, 64, DefaultPacking)
+	if err != nil {
+		t.Fatalf("TestDeterministicContent() CreateDeterministicContent(partial store) %v != %v", err, nil)
+	}
+	defer partialMissingStoreIndex.Dispose()
+	partialBlockHashes := partialMissingStoreIndex.GetBlockHashes()
+	if len(partialBlockHashes) != len(fullBlockHashes)-1 {
+		t.Fatalf("TestDeterministicContent() partial store GetBlockCount() %d != %d", len(partialBlockHashes), len(fullBlockHashes)-1)
+	}
+	for i, blockHash := range partialBlockHashes {
+		if blockHash != fullBlockHashes[i+1] {
+			t.Errorf("TestDeterministicContent() partial store block %d 0x%016x != 0x%016x", i, blockHash, fullBlockHashes[i+1])
+		}
+	}
+}
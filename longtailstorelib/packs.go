@@ -0,0 +1,368 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// Blocks that are rarely read can be grouped into larger pack objects in packs/, see PackStoreBlocks.
+// A pack is the blobs of its blocks one after the other and packIndexKey lists the packs with the
+// offset and size of each block in them. The packed blocks stay in the store index and reads of
+// them are served from their pack.
+const (
+	packPath     = "packs"
+	packIndexKey = "packs/index.json"
+)
+
+var packCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// DefaultMaxPackSize is the size of the packs written by PackStoreBlocks unless another size is given
+const DefaultMaxPackSize = 256 * 1024 * 1024
+
+type packedBlock struct {
+	BlockHash uint64 `json:"blockHash"`
+	Offset    int64  `json:"offset"`
+	Size      int64  `json:"size"`
+}
+
+type blockPack struct {
+	Key    string        `json:"key"`
+	Blocks []packedBlock `json:"blocks"`
+}
+
+type packIndex struct {
+	Packs []blockPack `json:"packs"`
+}
+
+// packLocation is where the blob of a packed block is
+type packLocation struct {
+	key    string
+	offset int64
+	size   int64
+}
+
+func (index *packIndex) locations() map[uint64]packLocation {
+	locations := map[uint64]packLocation{}
+	for _, pack := range index.Packs {
+		for _, block := range pack.Blocks {
+			locations[block.BlockHash] = packLocation{key: pack.Key, offset: block.Offset, size: block.Size}
+		}
+	}
+	return locations
+}
+
+// remove drops blocks from the index, their data stays in the packs. Packs without blocks are
+// returned so they can be deleted.
+func (index *packIndex) remove(blockHashes map[uint64]bool) []string {
+	var emptyPacks []string
+	packs := index.Packs[:0]
+	for _, pack := range index.Packs {
+		blocks := pack.Blocks[:0]
+		for _, block := range pack.Blocks {
+			if !blockHashes[block.BlockHash] {
+				blocks = append(blocks, block)
+			}
+		}
+		pack.Blocks = blocks
+		if len(blocks) == 0 {
+			emptyPacks = append(emptyPacks, pack.Key)
+			continue
+		}
+		packs = append(packs, pack)
+	}
+	index.Packs = packs
+	return emptyPacks
+}
+
+// readPackIndex reads the pack index of the store, a store without packs has an empty index
+func readPackIndex(blobClient BlobClient) (packIndex, error) {
+	data, err := readScrubBlob(blobClient, packIndexKey)
+	if err != nil {
+		return packIndex{}, errors.Wrapf(err, "readPackIndex: failed to read %s", packIndexKey)
+	}
+	var index packIndex
+	if data == nil {
+		return index, nil
+	}
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return packIndex{}, errors.Wrapf(err, "readPackIndex: %s is malformed", packIndexKey)
+	}
+	return index, nil
+}
+
+func writePackIndex(blobClient BlobClient, index packIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrap(err, "writePackIndex")
+	}
+	return errors.Wrap(writeJSONObjectData(blobClient, packIndexKey, data), "writePackIndex")
+}
+
+// storePacks is the pack index of a remote store, it is read the first time a block is not found
+// in chunks/. The zero value is ready to use.
+type storePacks struct {
+	lock      sync.Mutex
+	locations map[uint64]packLocation
+}
+
+// locate returns where blockHash is packed, false if it is not in a pack
+func (p *storePacks) locate(blobClient BlobClient, blockHash uint64) (packLocation, bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.locations == nil {
+		index, err := readPackIndex(blobClient)
+		if err != nil {
+			return packLocation{}, false, err
+		}
+		p.locations = index.locations()
+	}
+	location, ok := p.locations[blockHash]
+	return location, ok, nil
+}
+
+// rangedBlobObject is implemented by blob objects that can read a part of the object
+type rangedBlobObject interface {
+	ReadRange(offset int64, length int64) ([]byte, error)
+}
+
+// readPackedBlob extracts the blob of a packed block from its pack, with a ranged read if the blob
+// store supports it
+func readPackedBlob(blobClient BlobClient, location packLocation) ([]byte, error) {
+	objHandle, err := blobClient.NewObject(location.key)
+	if err != nil {
+		return nil, err
+	}
+	if rangedObject, ok := objHandle.(rangedBlobObject); ok {
+		return rangedObject.ReadRange(location.offset, location.size)
+	}
+	data, err := objHandle.Read()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < location.offset+location.size {
+		return nil, errors.Wrapf(longtaillib.ErrEBADF, "%s is truncated, %d bytes", location.key, len(data))
+	}
+	return data[location.offset : location.offset+location.size], nil
+}
+
+// appendPackedBlockKeys adds the keys of the packed blocks to the sorted block keys of a listing
+func appendPackedBlockKeys(blobClient BlobClient, layout BlockLayout, blockKeys []string) ([]string, error) {
+	index, err := readPackIndex(blobClient)
+	if err != nil || len(index.Packs) == 0 {
+		return blockKeys, err
+	}
+	listed := map[string]bool{}
+	for _, blockKey := range blockKeys {
+		listed[blockKey] = true
+	}
+	for blockHash := range index.locations() {
+		blockKey := layout.BlockPath("chunks", blockHash)
+		if !listed[blockKey] {
+			blockKeys = append(blockKeys, blockKey)
+		}
+	}
+	sort.Strings(blockKeys)
+	return blockKeys, nil
+}
+
+// PackStoreBlocks groups the blocks that are not needed for keepChunkHashes into pack objects of
+// up to maxPackSize bytes, zero uses DefaultMaxPackSize. This reduces the number of objects, and
+// with it the request and listing cost, of blocks on archival tiers that are rarely read. The
+// blocks stay in the store index and remote block stores read them from their pack. The block
+// objects are deleted once their pack has been written and added to the pack index.
+// Nothing is changed if dryRun is set. Returns the hashes of the packed blocks.
+func PackStoreBlocks(
+	ctx context.Context,
+	blobStore BlobStore,
+	keepChunkHashes []uint64,
+	maxPackSize int64,
+	dryRun bool,
+	opts ...StoreOption) ([]uint64, error) {
+	if !dryRun && newStoreOptions(opts).Immutable {
+		return nil, errors.Wrap(ErrImmutable, blobStore.String())
+	}
+	if maxPackSize <= 0 {
+		maxPackSize = DefaultMaxPackSize
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	storeIndex, err := readStoreIndexObject(blobClient, "store.lsi")
+	if err != nil {
+		return nil, errors.Wrap(err, "PackStoreBlocks")
+	}
+	if !storeIndex.IsValid() {
+		return nil, errors.Wrapf(longtaillib.ErrENOENT, "PackStoreBlocks: store.lsi")
+	}
+	keepStoreIndex, unusedBlockHashes, err := splitStoreIndex(storeIndex, keepChunkHashes)
+	storeIndex.Dispose()
+	if err != nil {
+		return nil, errors.Wrap(err, "PackStoreBlocks")
+	}
+	keepStoreIndex.Dispose()
+
+	index, err := readPackIndex(blobClient)
+	if err != nil {
+		return nil, errors.Wrap(err, "PackStoreBlocks")
+	}
+	packed := index.locations()
+	var blockHashes []uint64
+	for _, blockHash := range unusedBlockHashes {
+		if _, ok := packed[blockHash]; !ok {
+			blockHashes = append(blockHashes, blockHash)
+		}
+	}
+	if dryRun || len(blockHashes) == 0 {
+		return blockHashes, nil
+	}
+
+	layout, err := readBlockLayout(blobClient)
+	if err != nil {
+		return nil, errors.Wrap(err, "PackStoreBlocks")
+	}
+	var packedBlockHashes []uint64
+	defer func() {
+		if len(packedBlockHashes) > 0 {
+			recordAudit(blobClient, resolveStoreOptions(blobStore, opts), AuditEntry{Operation: AuditPack, PackedBlockCount: len(packedBlockHashes)})
+		}
+	}()
+
+	var data []byte
+	var pack blockPack
+	flushPack := func() error {
+		if len(pack.Blocks) == 0 {
+			return nil
+		}
+		pack.Key = fmt.Sprintf("%s/0x%016x.lsp", packPath, crc64.Checksum(data, packCRCTable))
+		err := writePack(blobClient, pack.Key, data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to write pack %s", pack.Key)
+		}
+		index.Packs = append(index.Packs, pack)
+		err = writePackIndex(blobClient, index)
+		if err != nil {
+			return err
+		}
+		for _, block := range pack.Blocks {
+			path := layout.BlockPath("chunks", block.BlockHash)
+			objHandle, err := blobClient.NewObject(path)
+			if err == nil {
+				err = objHandle.Delete()
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to delete packed block %s", path)
+			}
+			packedBlockHashes = append(packedBlockHashes, block.BlockHash)
+		}
+		log.Printf("Packed %d blocks in %s\n", len(pack.Blocks), pack.Key)
+		data = nil
+		pack = blockPack{}
+		return nil
+	}
+	for _, blockHash := range blockHashes {
+		path := layout.BlockPath("chunks", blockHash)
+		blob, err := readScrubBlob(blobClient, path)
+		if err != nil {
+			return packedBlockHashes, errors.Wrapf(err, "PackStoreBlocks: failed to read block 0x%016x", blockHash)
+		}
+		if blob == nil {
+			log.Printf("WARNING: Block 0x%016x is missing from %s, it is not packed\n", blockHash, blobStore.String())
+			continue
+		}
+		pack.Blocks = append(pack.Blocks, packedBlock{BlockHash: blockHash, Offset: int64(len(data)), Size: int64(len(blob))})
+		data = append(data, blob...)
+		if int64(len(data)) >= maxPackSize {
+			err = flushPack()
+			if err != nil {
+				return packedBlockHashes, errors.Wrap(err, "PackStoreBlocks")
+			}
+		}
+	}
+	err = flushPack()
+	if err != nil {
+		return packedBlockHashes, errors.Wrap(err, "PackStoreBlocks")
+	}
+	return packedBlockHashes, nil
+}
+
+func writePack(blobClient BlobClient, key string, data []byte) error {
+	objHandle, err := blobClient.NewObject(key)
+	if err != nil {
+		return err
+	}
+	ok, err := objHandle.Write(data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("failed to write `%s`", key)
+	}
+	return nil
+}
+
+// unpackBlocks writes the packed blocks of blockHashes as block objects at the paths returned by
+// blockPath and removes them from the pack index, packs that have no blocks left are deleted.
+// Blocks that are not packed are left out of the returned hashes.
+func unpackBlocks(blobClient BlobClient, blockHashes []uint64, blockPath func(blockHash uint64) string) ([]uint64, error) {
+	index, err := readPackIndex(blobClient)
+	if err != nil || len(index.Packs) == 0 {
+		return nil, err
+	}
+	locations := index.locations()
+	unpacked := map[uint64]bool{}
+	var unpackedBlockHashes []uint64
+	for _, blockHash := range blockHashes {
+		location, ok := locations[blockHash]
+		if !ok {
+			continue
+		}
+		blob, err := readPackedBlob(blobClient, location)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read packed block 0x%016x", blockHash)
+		}
+		path := blockPath(blockHash)
+		objHandle, err := blobClient.NewObject(path)
+		if err != nil {
+			return nil, err
+		}
+		ok, err = objHandle.Write(blob)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to write %s", path)
+		}
+		if !ok {
+			return nil, fmt.Errorf("failed to write `%s`", path)
+		}
+		unpacked[blockHash] = true
+		unpackedBlockHashes = append(unpackedBlockHashes, blockHash)
+	}
+	if len(unpackedBlockHashes) == 0 {
+		return nil, nil
+	}
+	emptyPacks := index.remove(unpacked)
+	err = writePackIndex(blobClient, index)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range emptyPacks {
+		objHandle, err := blobClient.NewObject(key)
+		if err == nil {
+			err = objHandle.Delete()
+		}
+		if err != nil {
+			log.Printf("WARNING: Failed to delete empty pack %s: %v\n", key, err)
+		}
+	}
+	return unpackedBlockHashes, nil
+}
@@ -0,0 +1,114 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestPackStoreBlocks(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestPackStoreBlocks() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	keptBlockHash, _ := storeBlockFromSeed(t, storeAPI, 0)
+	packedBlockHash, _ := storeBlockFromSeed(t, storeAPI, 10)
+	prunedBlockHash, _ := storeBlockFromSeed(t, storeAPI, 20)
+	storeAPI.Dispose()
+
+	keepChunkHashes := []uint64{uint64(0) + 1}
+	packedBlockHashes, err := PackStoreBlocks(context.Background(), blobStore, keepChunkHashes, 0, true)
+	if err != nil || len(packedBlockHashes) != 2 {
+		t.Errorf("TestPackStoreBlocks() PackStoreBlocks() dry run %v, %d != %v, %d", err, len(packedBlockHashes), nil, 2)
+	}
+	if !blobExists(t, blobStore, GetBlockPath("chunks", packedBlockHash)) || blobExists(t, blobStore, packIndexKey) {
+		t.Errorf("TestPackStoreBlocks() PackStoreBlocks() dry run changed the store")
+	}
+	_, err = PackStoreBlocks(context.Background(), blobStore, keepChunkHashes, 0, false, WithImmutable())
+	if !IsImmutable(err) {
+		t.Errorf("TestPackStoreBlocks() PackStoreBlocks() immutable %v != %v", err, ErrImmutable)
+	}
+
+	packedBlockHashes, err = PackStoreBlocks(context.Background(), blobStore, keepChunkHashes, 0, false)
+	if err != nil || len(packedBlockHashes) != 2 {
+		t.Fatalf("TestPackStoreBlocks() PackStoreBlocks() %v, %d != %v, %d", err, len(packedBlockHashes), nil, 2)
+	}
+	for _, blockHash := range []uint64{packedBlockHash, prunedBlockHash} {
+		if blobExists(t, blobStore, GetBlockPath("chunks", blockHash)) {
+			t.Errorf("TestPackStoreBlocks() PackStoreBlocks() did not remove block 0x%016x", blockHash)
+		}
+	}
+	if !blobExists(t, blobStore, GetBlockPath("chunks", keptBlockHash)) {
+		t.Errorf("TestPackStoreBlocks() PackStoreBlocks() removed kept block 0x%016x", keptBlockHash)
+	}
+	client, _ := blobStore.NewClient(context.Background())
+	index, err := readPackIndex(client)
+	client.Close()
+	if err != nil || len(index.Packs) != 1 || len(index.Packs[0].Blocks) != 2 {
+		t.Fatalf("TestPackStoreBlocks() readPackIndex() %v, %+v", err, index)
+	}
+	packKey := index.Packs[0].Key
+	packedBlockHashes, _ = PackStoreBlocks(context.Background(), blobStore, keepChunkHashes, 0, true)
+	if len(packedBlockHashes) != 0 {
+		t.Errorf("TestPackStoreBlocks() PackStoreBlocks() packed blocks again %v", packedBlockHashes)
+	}
+
+	remoteStore, err = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly)
+	if err != nil {
+		t.Fatalf("TestPackStoreBlocks() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	err = remoteStore.(BlockPreflighter).PreflightBlocks(context.Background(), []uint64{keptBlockHash, packedBlockHash})
+	if err != nil {
+		t.Errorf("TestPackStoreBlocks() PreflightBlocks() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, packedBlockHash)
+	if errno != 0 {
+		t.Errorf("TestPackStoreBlocks() fetchBlockFromStore(0x%016x) packed %d != %d", packedBlockHash, errno, 0)
+	} else {
+		validateBlockFromSeed(t, 10, storedBlock)
+		storedBlock.Dispose()
+	}
+	storeAPI.Dispose()
+
+	client, _ = blobStore.NewClient(context.Background())
+	object, _ := client.NewObject("store.lsi")
+	object.Delete()
+	client.Close()
+	recoveredBlockHashes, err := RecoverStoreIndex(context.Background(), blobStore, false)
+	if err != nil || len(recoveredBlockHashes) != 3 {
+		t.Errorf("TestPackStoreBlocks() RecoverStoreIndex() %v, %v != %v, %d", err, recoveredBlockHashes, nil, 3)
+	}
+
+	// The seed blocks have no content hashes so they scrub as corrupt, the packed blocks must not be missing
+	scrubResult, err := ScrubStore(context.Background(), blobStore, ScrubOptions{Passes: 1})
+	if err != nil || scrubResult.ScrubbedBlockCount != 3 || len(scrubResult.MissingBlockHashes) != 0 {
+		t.Errorf("TestPackStoreBlocks() ScrubStore() %v, %+v", err, scrubResult)
+	}
+
+	prunedBlockHashes, err := PruneStore(context.Background(), blobStore, []uint64{uint64(0) + 1, uint64(10) + 1}, false)
+	if err != nil || len(prunedBlockHashes) != 1 || prunedBlockHashes[0] != prunedBlockHash {
+		t.Errorf("TestPackStoreBlocks() PruneStore() %v, %v != %v, [0x%016x]", err, prunedBlockHashes, nil, prunedBlockHash)
+	}
+	restoredBlockHashes, err := UndeleteBlocks(context.Background(), blobStore, []uint64{prunedBlockHash})
+	if err != nil || len(restoredBlockHashes) != 1 {
+		t.Errorf("TestPackStoreBlocks() UndeleteBlocks() %v, %v != %v, [0x%016x]", err, restoredBlockHashes, nil, prunedBlockHash)
+	}
+	if !blobExists(t, blobStore, GetBlockPath("chunks", prunedBlockHash)) {
+		t.Errorf("TestPackStoreBlocks() UndeleteBlocks() did not restore packed block 0x%016x", prunedBlockHash)
+	}
+
+	_, err = PruneStore(context.Background(), blobStore, []uint64{uint64(0) + 1}, false)
+	if err != nil {
+		t.Errorf("TestPackStoreBlocks() PruneStore() %v != %v", err, nil)
+	}
+	if blobExists(t, blobStore, packKey) {
+		t.Errorf("TestPackStoreBlocks() PruneStore() did not delete empty pack %s", packKey)
+	}
+}
@@ -0,0 +1,103 @@
+package longtailstorelib
+
+import "sync"
+
+// defaultPrefetchWindowPerWorker is the default size of the prefetch window per download worker,
+// see WithPrefetchWindow
+const defaultPrefetchWindowPerWorker = 8
+
+// prefetchWindow limits the prefetches of PreflightGet to the next blocks the restore needs. The
+// preflighted blocks are numbered in the order they are needed, see HintDownloadOrder, and only
+// the blocks up to size ahead of the last block the restore has read are queued for prefetching.
+// A read of a block passes it and every block needed before it, the restore has read those from
+// elsewhere or will wait for them anyway, and moves the window forward. A zero size prefetches
+// every block at once.
+type prefetchWindow struct {
+	lock sync.Mutex
+	size int
+	// order are the blocks from the oldest block that has not been passed, the block at
+	// order[i] has the position base+i
+	order     []uint64
+	base      int
+	positions map[uint64]int
+	// queued is the position of the next block to queue for prefetching
+	queued int
+}
+
+// fillLocked returns the blocks that have moved into the window
+func (w *prefetchWindow) fillLocked() []uint64 {
+	blockHashes := []uint64{}
+	for w.queued < w.base+len(w.order) && (w.size <= 0 || w.queued-w.base < w.size) {
+		blockHashes = append(blockHashes, w.order[w.queued-w.base])
+		w.queued++
+	}
+	return blockHashes
+}
+
+// add appends blockHashes in need order and returns the blocks to prefetch now
+func (w *prefetchWindow) add(blockHashes []uint64) []uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.positions == nil {
+		w.positions = map[uint64]int{}
+	}
+	for _, blockHash := range blockHashes {
+		if _, exists := w.positions[blockHash]; exists {
+			continue
+		}
+		w.positions[blockHash] = w.base + len(w.order)
+		w.order = append(w.order, blockHash)
+	}
+	return w.fillLocked()
+}
+
+// passed is called when the restore reads blockHash, it returns the blocks to prefetch now
+func (w *prefetchWindow) passed(blockHash uint64) []uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	position, exists := w.positions[blockHash]
+	if !exists {
+		return nil
+	}
+	passedCount := position + 1 - w.base
+	for _, passedBlockHash := range w.order[:passedCount] {
+		delete(w.positions, passedBlockHash)
+	}
+	w.order = w.order[passedCount:]
+	w.base = position + 1
+	if w.queued < w.base {
+		// The restore is ahead of the prefetches, the blocks it passed are not prefetched
+		w.queued = w.base
+	}
+	return w.fillLocked()
+}
+
+// clear forgets the blocks that have not been prefetched when the store is flushed
+func (w *prefetchWindow) clear() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.base += len(w.order)
+	w.queued = w.base
+	w.order = nil
+	w.positions = nil
+}
+
+// counts returns the number of blocks in the window and the number of blocks waiting to enter it
+func (w *prefetchWindow) counts() (int, int) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.queued - w.base, w.base + len(w.order) - w.queued
+}
+
+// advancePrefetchWindow moves the prefetch window past blockHash when the restore reads it. The
+// blocks that enter the window are dropped if the prefetch queue is full, a worker calls this and
+// can not wait for the queue, they are read without a prefetch.
+func (s *remoteStore) advancePrefetchWindow(blockHash uint64) {
+	for _, nextBlockHash := range s.prefetchWindow.passed(blockHash) {
+		select {
+		case s.prefetchBlockChan <- prefetchBlockMessage{blockHash: nextBlockHash}:
+		default:
+			s.prefetchQueue.full(0).done(true)
+		}
+	}
+}
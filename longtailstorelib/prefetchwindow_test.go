@@ -0,0 +1,105 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func expectBlockHashes(t *testing.T, name string, blockHashes []uint64, expected ...uint64) {
+	if len(blockHashes) != len(expected) {
+		t.Errorf("TestPrefetchWindow() %s %v != %v", name, blockHashes, expected)
+		return
+	}
+	for i := range expected {
+		if blockHashes[i] != expected[i] {
+			t.Errorf("TestPrefetchWindow() %s %v != %v", name, blockHashes, expected)
+			return
+		}
+	}
+}
+
+func TestPrefetchWindow(t *testing.T) {
+	w := prefetchWindow{size: 2}
+	expectBlockHashes(t, "add()", w.add([]uint64{1, 2, 3, 4, 5}), 1, 2)
+	if inWindow, pending := w.counts(); inWindow != 2 || pending != 3 {
+		t.Errorf("TestPrefetchWindow() counts() %d, %d != %d, %d", inWindow, pending, 2, 3)
+	}
+	expectBlockHashes(t, "passed(1)", w.passed(1), 3)
+
+	// The restore read block 4 before it was prefetched, blocks 2 and 3 are passed with it
+	expectBlockHashes(t, "passed(4)", w.passed(4), 5)
+	if inWindow, pending := w.counts(); inWindow != 1 || pending != 0 {
+		t.Errorf("TestPrefetchWindow() counts() %d, %d != %d, %d", inWindow, pending, 1, 0)
+	}
+	expectBlockHashes(t, "passed(2)", w.passed(2))
+	expectBlockHashes(t, "add()", w.add([]uint64{5, 6, 7}), 6)
+
+	w.clear()
+	if inWindow, pending := w.counts(); inWindow != 0 || pending != 0 {
+		t.Errorf("TestPrefetchWindow() counts() after clear() %d, %d != %d, %d", inWindow, pending, 0, 0)
+	}
+	expectBlockHashes(t, "add() after clear()", w.add([]uint64{7, 8, 9}), 7, 8)
+
+	unlimited := prefetchWindow{}
+	expectBlockHashes(t, "add() unlimited", unlimited.add([]uint64{1, 2, 3}), 1, 2, 3)
+}
+
+func TestRemoteStorePrefetchWindow(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blobStore, _ := NewTestBlobStore("the_path")
+
+	store, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithPrefetchWindow(1))
+	if err != nil {
+		t.Fatalf("TestRemoteStorePrefetchWindow() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(store)
+	defer storeAPI.Dispose()
+	blockHashes := []uint64{}
+	for _, seed := range []uint8{0, 4, 8} {
+		blockHash, errno := storeBlockFromSeed(t, storeAPI, seed)
+		if errno != 0 {
+			t.Fatalf("TestRemoteStorePrefetchWindow() storeBlockFromSeed() %d != %d", errno, 0)
+		}
+		blockHashes = append(blockHashes, blockHash)
+	}
+	if errno := flushRemoteStore(storeAPI); errno != 0 {
+		t.Fatalf("TestRemoteStorePrefetchWindow() Flush() %d != %d", errno, 0)
+	}
+
+	s := store.(*remoteStore)
+	waitForPrefetch := func() {
+		for start := time.Now(); atomic.LoadInt64(&s.prefetchMemory) == 0; {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("TestRemoteStorePrefetchWindow() the next block was not prefetched")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	store.PreflightGet(blockHashes, longtaillib.Longtail_AsyncPreflightStartedAPI{})
+	waitForPrefetch()
+	stats := s.GetDownloadPlanStats()
+	if stats.WindowSize != 1 || stats.InWindow != 1 || stats.PendingCount != 2 {
+		t.Errorf("TestRemoteStorePrefetchWindow() GetDownloadPlanStats() %+v", stats)
+	}
+
+	// Each read moves the window on to the next block
+	for i, blockHash := range blockHashes {
+		if i > 0 {
+			waitForPrefetch()
+		}
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+		if errno != 0 {
+			t.Fatalf("TestRemoteStorePrefetchWindow() fetchBlockFromStore() %d != %d", errno, 0)
+		}
+		storedBlock.Dispose()
+	}
+	stats = s.GetDownloadPlanStats()
+	if stats.ReadyCount != 3 || stats.MissedCount != 0 || stats.InWindow != 0 || stats.PendingCount != 0 {
+		t.Errorf("TestRemoteStorePrefetchWindow() GetDownloadPlanStats() after reads %+v", stats)
+	}
+}
@@ -0,0 +1,116 @@
+package longtailstorelib
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BlockPreflighter is implemented by block stores that can check that the blocks of a restore are
+// in the store before any of them is read, so a restore fails up front instead of part way through
+type BlockPreflighter interface {
+	// PreflightBlocks returns a *BlocksMissingError listing the blocks that are not in the store
+	// index or whose objects are gone from the store
+	PreflightBlocks(ctx context.Context, blockHashes []uint64) error
+}
+
+// PreflightBlocks cross-checks blockHashes against the store index and checks that the objects of
+// the indexed blocks exist, the objects are checked by the workers of the store
+func (s *remoteStore) PreflightBlocks(ctx context.Context, blockHashes []uint64) error {
+	reply := make(chan preflightReply, 1)
+	s.preflightGetChan <- preflightGetMessage{blockHashes: blockHashes, missingBlocksReply: reply}
+	indexReply := <-reply
+	if indexReply.err != nil {
+		return errors.Wrapf(indexReply.err, "PreflightBlocks: failed to read the store index of %s", s.blobStore.String())
+	}
+	missingBlockHashes := indexReply.missingBlockHashes
+
+	missing := map[uint64]bool{}
+	for _, blockHash := range missingBlockHashes {
+		missing[blockHash] = true
+	}
+	indexedBlockHashes := make(chan uint64)
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for w := 0; w < s.workerCount; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := s.blobStore.NewClient(ctx)
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = errors.Wrap(err, s.blobStore.String())
+				}
+				mutex.Unlock()
+				for range indexedBlockHashes {
+				}
+				return
+			}
+			defer client.Close()
+			for blockHash := range indexedBlockHashes {
+				if s.resumable.isPreflighted(blockHash) {
+					// Found by an earlier session at the same store index generation
+					continue
+				}
+				key := s.layout.BlockPath("chunks", blockHash)
+				exists, err := blockObjectExists(client, key)
+				if err == nil && !exists {
+					// The block is read from its pack, see PackStoreBlocks
+					_, exists, err = s.packs.locate(client, blockHash)
+				}
+				if err == nil && !exists && s.blockSources != nil {
+					// The block is read from a mirror instead
+					exists = mirrorHasBlock(s, key)
+				}
+				mutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = errors.Wrapf(err, "PreflightBlocks: failed to check `%s`", key)
+				}
+				if err == nil && !exists {
+					missingBlockHashes = append(missingBlockHashes, blockHash)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, blockHash := range blockHashes {
+		if !missing[blockHash] && ctx.Err() == nil {
+			indexedBlockHashes <- blockHash
+		}
+	}
+	close(indexedBlockHashes)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, blockHash := range missingBlockHashes {
+		missing[blockHash] = true
+	}
+	presentBlockHashes := []uint64{}
+	for _, blockHash := range blockHashes {
+		if !missing[blockHash] {
+			presentBlockHashes = append(presentBlockHashes, blockHash)
+		}
+	}
+	s.resumable.addPreflighted(presentBlockHashes)
+	if len(missingBlockHashes) > 0 {
+		sort.Slice(missingBlockHashes, func(i, j int) bool { return missingBlockHashes[i] < missingBlockHashes[j] })
+		return &BlocksMissingError{Store: s.blobStore.String(), BlockHashes: missingBlockHashes}
+	}
+	return nil
+}
+
+func blockObjectExists(client BlobClient, key string) (bool, error) {
+	object, err := client.NewObject(key)
+	if err != nil {
+		return false, err
+	}
+	return object.Exists()
+}
@@ -0,0 +1,58 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestPreflightBlocks(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(
+		jobs,
+		blobStore,
+		"",
+		runtime.NumCPU(),
+		ReadWrite)
+	if err != nil {
+		t.Fatalf("TestPreflightBlocks() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	presentBlockHash, errno := storeBlockFromSeed(t, storeAPI, 1)
+	if errno != 0 {
+		t.Fatalf("TestPreflightBlocks() storeBlockFromSeed(t, storeAPI, 1) %d != %d", errno, 0)
+	}
+	deletedBlockHash, errno := storeBlockFromSeed(t, storeAPI, 2)
+	if errno != 0 {
+		t.Fatalf("TestPreflightBlocks() storeBlockFromSeed(t, storeAPI, 2) %d != %d", errno, 0)
+	}
+	preflighter := remoteStore.(BlockPreflighter)
+	err = preflighter.PreflightBlocks(context.Background(), []uint64{presentBlockHash, deletedBlockHash})
+	if err != nil {
+		t.Errorf("TestPreflightBlocks() PreflightBlocks() %v != %v", err, nil)
+	}
+
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject(GetBlockPath("chunks", deletedBlockHash))
+	object.Delete()
+	unknownBlockHash := uint64(0xdeadbeef)
+
+	err = preflighter.PreflightBlocks(context.Background(), []uint64{presentBlockHash, unknownBlockHash, deletedBlockHash})
+	if !IsBlocksMissing(err) {
+		t.Fatalf("TestPreflightBlocks() PreflightBlocks() %v is not a *BlocksMissingError", err)
+	}
+	missing := err.(*BlocksMissingError).BlockHashes
+	if len(missing) != 2 || missing[0] != deletedBlockHash || missing[1] != unknownBlockHash {
+		t.Errorf("TestPreflightBlocks() missing blocks %v != %v", missing, []uint64{deletedBlockHash, unknownBlockHash})
+	}
+	if longtaillib.ErrorToErrno(err, longtaillib.EIO) != longtaillib.ENOENT {
+		t.Errorf("TestPreflightBlocks() ErrorToErrno() %d != %d", longtaillib.ErrorToErrno(err, longtaillib.EIO), longtaillib.ENOENT)
+	}
+}
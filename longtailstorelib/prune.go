@@ -0,0 +1,413 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// Pruned blocks are moved to trash/<unix time of prune>/chunks/... so they can be restored
+// with UndeleteBlocks until PurgeTrash removes them after the retention window. The trash always
+// uses DefaultBlockLayout.
+const trashPath = "trash"
+
+// GetTrashBlockPath returns the path a block is moved to when it is pruned at deletedAt
+func GetTrashBlockPath(blockHash uint64, deletedAt time.Time) string {
+	return fmt.Sprintf("%s/%d/%s", trashPath, deletedAt.Unix(), GetBlockPath("chunks", blockHash))
+}
+
+type trashedBlock struct {
+	path      string
+	blockHash uint64
+	deletedAt time.Time
+}
+
+// parseTrashBlockPath is the inverse of GetTrashBlockPath
+func parseTrashBlockPath(path string) (trashedBlock, bool) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 5 || parts[0] != trashPath || parts[2] != "chunks" || !strings.HasSuffix(parts[4], ".lsb") {
+		return trashedBlock{}, false
+	}
+	deletedAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return trashedBlock{}, false
+	}
+	blockHash, err := strconv.ParseUint(strings.TrimSuffix(parts[4], ".lsb"), 0, 64)
+	if err != nil {
+		return trashedBlock{}, false
+	}
+	return trashedBlock{path: path, blockHash: blockHash, deletedAt: time.Unix(deletedAt, 0)}, true
+}
+
+func getTrashedBlocks(ctx context.Context, blobClient BlobClient) ([]trashedBlock, error) {
+	var trashedBlocks []trashedBlock
+	err := forEachObject(ctx, blobClient, trashPath+"/", func(blob BlobProperties) error {
+		if trashed, ok := parseTrashBlockPath(blob.Name); ok {
+			trashedBlocks = append(trashedBlocks, trashed)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return trashedBlocks, nil
+}
+
+func copyBlob(blobClient BlobClient, sourcePath string, targetPath string) error {
+	source, err := blobClient.NewObject(sourcePath)
+	if err != nil {
+		return err
+	}
+	data, err := source.Read()
+	if err != nil {
+		return err
+	}
+	target, err := blobClient.NewObject(targetPath)
+	if err != nil {
+		return err
+	}
+	ok, err := target.Write(data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("failed to write `%s`", targetPath)
+	}
+	return nil
+}
+
+func moveBlob(blobClient BlobClient, sourcePath string, targetPath string) error {
+	err := copyBlob(blobClient, sourcePath, targetPath)
+	if err != nil {
+		return err
+	}
+	source, err := blobClient.NewObject(sourcePath)
+	if err != nil {
+		return err
+	}
+	return source.Delete()
+}
+
+// splitStoreIndex returns the part of storeIndex that is needed for keepChunkHashes and the hashes
+// of the remaining blocks
+func splitStoreIndex(storeIndex longtaillib.Longtail_StoreIndex, keepChunkHashes []uint64) (longtaillib.Longtail_StoreIndex, []uint64, error) {
+	keepStoreIndex, errno := longtaillib.GetExistingStoreIndex(storeIndex, keepChunkHashes, 0)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "longtaillib.GetExistingStoreIndex() failed")
+	}
+	keepBlocks := map[uint64]bool{}
+	for _, blockHash := range keepStoreIndex.GetBlockHashes() {
+		keepBlocks[blockHash] = true
+	}
+	var unusedBlockHashes []uint64
+	for _, blockHash := range storeIndex.GetBlockHashes() {
+		if !keepBlocks[blockHash] {
+			unusedBlockHashes = append(unusedBlockHashes, blockHash)
+		}
+	}
+	return keepStoreIndex, unusedBlockHashes, nil
+}
+
+// PruneStore removes all blocks that are not needed for keepChunkHashes from the store index and
+// moves them to the trash of the store. Nothing is changed if dryRun is set.
+// Returns the hashes of the pruned blocks.
+//
+// Prune must not run at the same time as an upsync to the same store, a block that is reused
+// after the store index has been rewritten can be moved to the trash.
+func PruneStore(
+	ctx context.Context,
+	blobStore BlobStore,
+	keepChunkHashes []uint64,
+	dryRun bool,
+	opts ...StoreOption) ([]uint64, error) {
+	if !dryRun && newStoreOptions(opts).Immutable {
+		return nil, errors.Wrap(ErrImmutable, blobStore.String())
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	key := "store.lsi"
+	objHandle, err := blobClient.NewObject(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "PruneStore: blobClient.NewObject(%s) failed", key)
+	}
+
+	var prunedBlockHashes []uint64
+	indexBlockCount := 0
+	for {
+		exists, err := objHandle.LockWriteVersion()
+		if err != nil {
+			return nil, errors.Wrapf(err, "PruneStore: objHandle.LockWriteVersion(%s) failed", key)
+		}
+		if !exists {
+			return nil, errors.Wrapf(longtaillib.ErrENOENT, "PruneStore: %s", key)
+		}
+		blob, err := objHandle.Read()
+		if err != nil {
+			return nil, errors.Wrapf(err, "PruneStore: objHandle.Read(%s) failed", key)
+		}
+		storeIndex, err := readStoreIndexData(blobStore.String(), key, blob)
+		if err != nil {
+			return nil, errors.Wrap(err, "PruneStore")
+		}
+		keepStoreIndex, unusedBlockHashes, err := splitStoreIndex(storeIndex, keepChunkHashes)
+		storeIndex.Dispose()
+		if err != nil {
+			return nil, errors.Wrap(err, "PruneStore")
+		}
+		prunedBlockHashes = unusedBlockHashes
+
+		if dryRun || len(prunedBlockHashes) == 0 {
+			keepStoreIndex.Dispose()
+			return prunedBlockHashes, nil
+		}
+
+		indexBlockCount = int(keepStoreIndex.GetBlockCount())
+		storeBlob, err := writeStoreIndexData(keepStoreIndex)
+		keepStoreIndex.Dispose()
+		if err != nil {
+			return nil, errors.Wrap(err, "PruneStore: writeStoreIndexData() failed")
+		}
+		ok, err := objHandle.Write(storeBlob)
+		if err != nil {
+			return nil, errors.Wrapf(err, "PruneStore: objHandle.Write(%s) failed", key)
+		}
+		if ok {
+			break
+		}
+		log.Printf("Retrying updating remote store index %s\n", key)
+	}
+
+	layout, err := readBlockLayout(blobClient)
+	if err != nil {
+		return prunedBlockHashes, errors.Wrap(err, "PruneStore")
+	}
+	options := resolveStoreOptions(blobStore, opts)
+	err = trashBlocks(ctx, blobStore, blobClient, layout, prunedBlockHashes, time.Now(), options)
+	recordAudit(blobClient, options, AuditEntry{Operation: AuditPrune, RemovedBlockCount: len(prunedBlockHashes), IndexBlockCount: indexBlockCount})
+	if err != nil {
+		return prunedBlockHashes, errors.Wrap(err, "PruneStore")
+	}
+	return prunedBlockHashes, nil
+}
+
+// trashBlocks moves blocks to the trash, see GetTrashBlockPath
+func trashBlocks(ctx context.Context, blobStore BlobStore, blobClient BlobClient, layout BlockLayout, blockHashes []uint64, deletedAt time.Time, options StoreOptions) error {
+	// Packed blocks are written to the trash from their packs
+	unpackedBlockHashes, err := unpackBlocks(blobClient, blockHashes, func(blockHash uint64) string { return GetTrashBlockPath(blockHash, deletedAt) })
+	if err != nil {
+		return errors.Wrap(err, "failed to move packed blocks to trash")
+	}
+	unpacked := map[uint64]bool{}
+	for _, blockHash := range unpackedBlockHashes {
+		unpacked[blockHash] = true
+	}
+	var movedBlockHashes []uint64
+	for _, blockHash := range blockHashes {
+		if !unpacked[blockHash] {
+			movedBlockHashes = append(movedBlockHashes, blockHash)
+		}
+	}
+
+	// The blocks are copied to the trash in parallel and then deleted in batches
+	workerCount := options.WorkerCount
+	if workerCount < 1 {
+		workerCount = defaultDeleteWorkerCount
+	}
+	err = forEachBlob(ctx, blobStore, workerCount, len(movedBlockHashes), func(client BlobClient, i int) error {
+		blockHash := movedBlockHashes[i]
+		err := copyBlob(client, layout.BlockPath("chunks", blockHash), GetTrashBlockPath(blockHash, deletedAt))
+		return errors.Wrapf(err, "failed to move block 0x%016x to trash", blockHash)
+	})
+	if err != nil {
+		return err
+	}
+	blockPaths := make([]string, len(movedBlockHashes))
+	for i, blockHash := range movedBlockHashes {
+		blockPaths[i] = layout.BlockPath("chunks", blockHash)
+	}
+	_, err = deleteBlobs(ctx, blobStore, blockPaths, options)
+	return errors.Wrap(err, "failed to delete blocks moved to trash")
+}
+
+// undeleteBlock moves the trashed block back into the store and returns its block index
+func undeleteBlock(blobClient BlobClient, layout BlockLayout, trashed trashedBlock) (longtaillib.Longtail_BlockIndex, error) {
+	source, err := blobClient.NewObject(trashed.path)
+	if err != nil {
+		return longtaillib.Longtail_BlockIndex{}, err
+	}
+	data, err := source.Read()
+	if err != nil {
+		return longtaillib.Longtail_BlockIndex{}, errors.Wrapf(err, "UndeleteBlocks: failed to read `%s`", trashed.path)
+	}
+	blockIndex, errno := longtaillib.ReadBlockIndexFromBuffer(data)
+	if errno != 0 {
+		return longtaillib.Longtail_BlockIndex{}, &BlockCorruptError{BlockHash: trashed.blockHash, Path: trashed.path, Reason: longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)}
+	}
+	err = moveBlob(blobClient, trashed.path, layout.BlockPath("chunks", trashed.blockHash))
+	if err != nil {
+		blockIndex.Dispose()
+		return longtaillib.Longtail_BlockIndex{}, errors.Wrapf(err, "UndeleteBlocks: failed to restore block 0x%016x", trashed.blockHash)
+	}
+	return blockIndex, nil
+}
+
+// UndeleteBlocks moves blocks from the trash back into the store and adds them to the store index.
+// All trashed blocks are restored if blockHashes is empty. A block that was trashed more than once
+// is restored from its newest trash entry and the older entries are deleted. Returns the hashes of
+// the restored blocks, if restoring a block fails the blocks restored before it are still added to
+// the store index.
+func UndeleteBlocks(
+	ctx context.Context,
+	blobStore BlobStore,
+	blockHashes []uint64,
+	opts ...StoreOption) ([]uint64, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	trashedBlocks, err := getTrashedBlocks(ctx, blobClient)
+	if err != nil {
+		return nil, errors.Wrapf(err, "UndeleteBlocks: failed to list trash of %s", blobStore.String())
+	}
+	layout, err := readBlockLayout(blobClient)
+	if err != nil {
+		return nil, errors.Wrap(err, "UndeleteBlocks")
+	}
+
+	undelete := map[uint64]bool{}
+	for _, blockHash := range blockHashes {
+		undelete[blockHash] = true
+	}
+	newest := map[uint64]trashedBlock{}
+	var superseded []trashedBlock
+	for _, trashed := range trashedBlocks {
+		if len(undelete) > 0 && !undelete[trashed.blockHash] {
+			continue
+		}
+		existing, exists := newest[trashed.blockHash]
+		if !exists {
+			newest[trashed.blockHash] = trashed
+		} else if trashed.deletedAt.After(existing.deletedAt) {
+			superseded = append(superseded, existing)
+			newest[trashed.blockHash] = trashed
+		} else {
+			superseded = append(superseded, trashed)
+		}
+	}
+
+	var restoredBlockHashes []uint64
+	var blockIndexes []longtaillib.Longtail_BlockIndex
+	defer func() {
+		for _, blockIndex := range blockIndexes {
+			blockIndex.Dispose()
+		}
+	}()
+	var restoreErr error
+	for _, trashed := range trashedBlocks {
+		if newest[trashed.blockHash].path != trashed.path {
+			continue
+		}
+		blockIndex, err := undeleteBlock(blobClient, layout, trashed)
+		if err != nil {
+			restoreErr = err
+			break
+		}
+		blockIndexes = append(blockIndexes, blockIndex)
+		restoredBlockHashes = append(restoredBlockHashes, trashed.blockHash)
+	}
+	if len(blockIndexes) == 0 {
+		return restoredBlockHashes, restoreErr
+	}
+
+	addedStoreIndex, errno := longtaillib.CreateStoreIndexFromBlocks(blockIndexes)
+	if errno != 0 {
+		return restoredBlockHashes, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "UndeleteBlocks: longtaillib.CreateStoreIndexFromBlocks() failed")
+	}
+	defer addedStoreIndex.Dispose()
+	newStoreIndex, err := updateRemoteStoreIndex(ctx, blobClient, addedStoreIndex, &StoreHooks{})
+	if err != nil {
+		return restoredBlockHashes, err
+	}
+	indexBlockCount := len(blockIndexes)
+	if newStoreIndex.IsValid() {
+		indexBlockCount = int(newStoreIndex.GetBlockCount())
+		newStoreIndex.Dispose()
+	}
+	recordAudit(blobClient, resolveStoreOptions(blobStore, opts), AuditEntry{Operation: AuditUndelete, AddedBlockCount: len(restoredBlockHashes), IndexBlockCount: indexBlockCount})
+
+	restored := map[uint64]bool{}
+	for _, blockHash := range restoredBlockHashes {
+		restored[blockHash] = true
+	}
+	for _, trashed := range superseded {
+		if !restored[trashed.blockHash] {
+			continue
+		}
+		object, err := blobClient.NewObject(trashed.path)
+		if err == nil {
+			err = object.Delete()
+		}
+		if err != nil {
+			log.Printf("UndeleteBlocks: failed to delete older trash entry `%s`: %v\n", trashed.path, err)
+		}
+	}
+	return restoredBlockHashes, restoreErr
+}
+
+// PurgeTrash permanently deletes the blocks that were moved to the trash more than retention ago.
+// Returns the hashes of the deleted blocks.
+func PurgeTrash(
+	ctx context.Context,
+	blobStore BlobStore,
+	retention time.Duration,
+	opts ...StoreOption) ([]uint64, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	trashedBlocks, err := getTrashedBlocks(ctx, blobClient)
+	if err != nil {
+		return nil, errors.Wrapf(err, "PurgeTrash: failed to list trash of %s", blobStore.String())
+	}
+
+	options := resolveStoreOptions(blobStore, opts)
+	purgedBlockHashes, err := purgeTrashedBlocks(ctx, blobStore, trashedBlocks, time.Now().Add(-retention), options)
+	if len(purgedBlockHashes) > 0 {
+		recordAudit(blobClient, options, AuditEntry{Operation: AuditPurgeTrash, RemovedBlockCount: len(purgedBlockHashes)})
+	}
+	return purgedBlockHashes, err
+}
+
+func purgeTrashedBlocks(ctx context.Context, blobStore BlobStore, trashedBlocks []trashedBlock, expiry time.Time, options StoreOptions) ([]uint64, error) {
+	var expired []trashedBlock
+	var paths []string
+	for _, trashed := range trashedBlocks {
+		if trashed.deletedAt.After(expiry) {
+			continue
+		}
+		expired = append(expired, trashed)
+		paths = append(paths, trashed.path)
+	}
+	deleted, err := deleteBlobs(ctx, blobStore, paths, options)
+	var purgedBlockHashes []uint64
+	for i, trashed := range expired {
+		if deleted[i] {
+			purgedBlockHashes = append(purgedBlockHashes, trashed.blockHash)
+		}
+	}
+	return purgedBlockHashes, errors.Wrap(err, "PurgeTrash")
+}
@@ -0,0 +1,186 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+func blobExists(t *testing.T, blobStore BlobStore, path string) bool {
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject(path)
+	exists, err := object.Exists()
+	if err != nil {
+		t.Errorf("blobExists() object.Exists(%s) %v != %v", path, err, nil)
+	}
+	return exists
+}
+
+func getStoreIndexBlockHashes(t *testing.T, blobStore BlobStore) map[uint64]bool {
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	blob, err := object.Read()
+	if err != nil {
+		t.Errorf("getStoreIndexBlockHashes() object.Read() %v != %v", err, nil)
+		return nil
+	}
+	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(blob)
+	if errno != 0 {
+		t.Errorf("getStoreIndexBlockHashes() longtaillib.ReadStoreIndexFromBuffer() %d != %d", errno, 0)
+		return nil
+	}
+	defer storeIndex.Dispose()
+	blockHashes := map[uint64]bool{}
+	for _, blockHash := range storeIndex.GetBlockHashes() {
+		blockHashes[blockHash] = true
+	}
+	return blockHashes
+}
+
+func TestPruneAndUndelete(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(
+		jobs,
+		blobStore,
+		"",
+		runtime.NumCPU(),
+		ReadWrite)
+	if err != nil {
+		t.Errorf("TestPruneAndUndelete() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	keptBlockHash, _ := storeBlockFromSeed(t, storeAPI, 0)
+	restoredBlockHash, _ := storeBlockFromSeed(t, storeAPI, 10)
+	purgedBlockHash, _ := storeBlockFromSeed(t, storeAPI, 20)
+	storeAPI.Dispose()
+
+	keepChunkHashes := []uint64{uint64(0) + 1, uint64(0) + 2}
+
+	prunedBlockHashes, err := PruneStore(context.Background(), blobStore, keepChunkHashes, true)
+	if err != nil {
+		t.Errorf("TestPruneAndUndelete() PruneStore() dry run %v != %v", err, nil)
+	}
+	if len(prunedBlockHashes) != 2 {
+		t.Errorf("TestPruneAndUndelete() PruneStore() dry run %d != %d", len(prunedBlockHashes), 2)
+	}
+	if !blobExists(t, blobStore, GetBlockPath("chunks", purgedBlockHash)) {
+		t.Errorf("TestPruneAndUndelete() PruneStore() dry run removed block 0x%016x", purgedBlockHash)
+	}
+
+	_, err = PruneStore(context.Background(), blobStore, keepChunkHashes, false, WithImmutable())
+	if !IsImmutable(err) {
+		t.Errorf("TestPruneAndUndelete() PruneStore() immutable %v != %v", err, ErrImmutable)
+	}
+
+	prunedBlockHashes, err = PruneStore(context.Background(), blobStore, keepChunkHashes, false)
+	if err != nil {
+		t.Errorf("TestPruneAndUndelete() PruneStore() %v != %v", err, nil)
+	}
+	if len(prunedBlockHashes) != 2 {
+		t.Errorf("TestPruneAndUndelete() PruneStore() %d != %d", len(prunedBlockHashes), 2)
+	}
+	blockHashes := getStoreIndexBlockHashes(t, blobStore)
+	if len(blockHashes) != 1 || !blockHashes[keptBlockHash] {
+		t.Errorf("TestPruneAndUndelete() PruneStore() store index %v != [0x%016x]", blockHashes, keptBlockHash)
+	}
+	for _, blockHash := range []uint64{restoredBlockHash, purgedBlockHash} {
+		if blobExists(t, blobStore, GetBlockPath("chunks", blockHash)) {
+			t.Errorf("TestPruneAndUndelete() PruneStore() did not remove block 0x%016x", blockHash)
+		}
+	}
+
+	restoredBlockHashes, err := UndeleteBlocks(context.Background(), blobStore, []uint64{restoredBlockHash})
+	if err != nil {
+		t.Errorf("TestPruneAndUndelete() UndeleteBlocks() %v != %v", err, nil)
+	}
+	if len(restoredBlockHashes) != 1 || restoredBlockHashes[0] != restoredBlockHash {
+		t.Errorf("TestPruneAndUndelete() UndeleteBlocks() %v != [0x%016x]", restoredBlockHashes, restoredBlockHash)
+	}
+	if !blobExists(t, blobStore, GetBlockPath("chunks", restoredBlockHash)) {
+		t.Errorf("TestPruneAndUndelete() UndeleteBlocks() did not restore block 0x%016x", restoredBlockHash)
+	}
+	blockHashes = getStoreIndexBlockHashes(t, blobStore)
+	if len(blockHashes) != 2 || !blockHashes[restoredBlockHash] {
+		t.Errorf("TestPruneAndUndelete() UndeleteBlocks() store index %v does not contain 0x%016x", blockHashes, restoredBlockHash)
+	}
+
+	purgedBlockHashes, err := PurgeTrash(context.Background(), blobStore, time.Hour)
+	if err != nil || len(purgedBlockHashes) != 0 {
+		t.Errorf("TestPruneAndUndelete() PurgeTrash() within retention %v, %d != %v, %d", err, len(purgedBlockHashes), nil, 0)
+	}
+	purgedBlockHashes, err = PurgeTrash(context.Background(), blobStore, -time.Second)
+	if err != nil {
+		t.Errorf("TestPruneAndUndelete() PurgeTrash() %v != %v", err, nil)
+	}
+	if len(purgedBlockHashes) != 1 || purgedBlockHashes[0] != purgedBlockHash {
+		t.Errorf("TestPruneAndUndelete() PurgeTrash() %v != [0x%016x]", purgedBlockHashes, purgedBlockHash)
+	}
+	restoredBlockHashes, _ = UndeleteBlocks(context.Background(), blobStore, nil)
+	if len(restoredBlockHashes) != 0 {
+		t.Errorf("TestPruneAndUndelete() UndeleteBlocks() after purge %d != %d", len(restoredBlockHashes), 0)
+	}
+}
+
+func TestUndeleteBlocksTrashedTwice(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestUndeleteBlocksTrashedTwice() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	keptBlockHash, _ := storeBlockFromSeed(t, storeAPI, 0)
+	twiceBlockHash, _ := storeBlockFromSeed(t, storeAPI, 10)
+	onceBlockHash, _ := storeBlockFromSeed(t, storeAPI, 20)
+	storeAPI.Dispose()
+
+	_, err = PruneStore(context.Background(), blobStore, []uint64{uint64(0) + 1, uint64(0) + 2}, false)
+	if err != nil {
+		t.Fatalf("TestUndeleteBlocksTrashedTwice() PruneStore() %v != %v", err, nil)
+	}
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	trashedBlocks, _ := getTrashedBlocks(context.Background(), client)
+	if len(trashedBlocks) != 2 {
+		t.Fatalf("TestUndeleteBlocksTrashedTwice() getTrashedBlocks() %d != %d", len(trashedBlocks), 2)
+	}
+	olderPath := GetTrashBlockPath(twiceBlockHash, trashedBlocks[0].deletedAt.Add(-time.Hour))
+	if err := copyBlob(client, GetTrashBlockPath(twiceBlockHash, trashedBlocks[0].deletedAt), olderPath); err != nil {
+		t.Fatalf("TestUndeleteBlocksTrashedTwice() copyBlob() %v != %v", err, nil)
+	}
+	// A corrupt entry that is listed last fails the undelete after the other blocks are restored
+	corruptObject, _ := client.NewObject(GetTrashBlockPath(0x1234, time.Unix(9999999999, 0)))
+	corruptObject.Write([]byte("not a block"))
+
+	restoredBlockHashes, err := UndeleteBlocks(context.Background(), blobStore, nil)
+	var blockCorruptErr *BlockCorruptError
+	if !errors.As(err, &blockCorruptErr) {
+		t.Errorf("TestUndeleteBlocksTrashedTwice() UndeleteBlocks() %v is not a *BlockCorruptError", err)
+	}
+	if len(restoredBlockHashes) != 2 {
+		t.Errorf("TestUndeleteBlocksTrashedTwice() UndeleteBlocks() %v != 2 blocks", restoredBlockHashes)
+	}
+	blockHashes := getStoreIndexBlockHashes(t, blobStore)
+	if len(blockHashes) != 3 || !blockHashes[keptBlockHash] || !blockHashes[twiceBlockHash] || !blockHashes[onceBlockHash] {
+		t.Errorf("TestUndeleteBlocksTrashedTwice() UndeleteBlocks() store index %v", blockHashes)
+	}
+	storeIndex, err := readStoreIndexObject(client, "store.lsi")
+	if err == nil {
+		if storeIndex.GetBlockCount() != 3 {
+			t.Errorf("TestUndeleteBlocksTrashedTwice() UndeleteBlocks() store index block count %d != %d", storeIndex.GetBlockCount(), 3)
+		}
+		storeIndex.Dispose()
+	}
+	if blobExists(t, blobStore, olderPath) {
+		t.Errorf("TestUndeleteBlocksTrashedTwice() UndeleteBlocks() kept the older trash entry")
+	}
+}
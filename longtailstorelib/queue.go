@@ -0,0 +1,94 @@
+package longtailstorelib
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Queue names of QueueStats
+const (
+	QueuePut        = "put"
+	QueueGet        = "get"
+	QueuePrefetch   = "prefetch"
+	QueueBlockIndex = "block-index"
+	QueueDecode     = "decode"
+)
+
+// The default queue depths of the remote block store per worker, see WithQueueDepths
+const (
+	defaultPutQueueDepthPerWorker        = 8
+	defaultGetQueueDepthPerWorker        = 2048
+	defaultPrefetchQueueDepthPerWorker   = 2048
+	defaultBlockIndexQueueDepthPerWorker = 2048
+)
+
+// QueueStats is the backpressure of a request queue of the remote block store. Requests that
+// find the queue full wait for a worker to take a request from it.
+type QueueStats struct {
+	Name     string
+	Depth    int
+	Capacity int
+	// FullCount is the number of requests that found the queue full
+	FullCount uint64
+	// WaitTime is the total time requests waited for room in the queue
+	WaitTime time.Duration
+	// TimeoutCount is the number of requests that were failed or dropped as the queue stayed full
+	// for the queue timeout, see WithQueueTimeout
+	TimeoutCount uint64
+}
+
+// requestQueue counts how often a queue of the remote block store is full, the zero value is ready to use
+type requestQueue struct {
+	fullCount    uint64
+	waitNanos    int64
+	timeoutCount uint64
+}
+
+// queueWait is a request waiting for room in a full queue
+type queueWait struct {
+	q       *requestQueue
+	start   time.Time
+	timer   *time.Timer
+	timeout <-chan time.Time
+}
+
+// full is called when a request finds the queue full, timeout of the returned wait fires after
+// timeout or never if timeout is zero
+func (q *requestQueue) full(timeout time.Duration) queueWait {
+	atomic.AddUint64(&q.fullCount, 1)
+	w := queueWait{q: q, start: time.Now()}
+	if timeout > 0 {
+		w.timer = time.NewTimer(timeout)
+		w.timeout = w.timer.C
+	}
+	return w
+}
+
+// done ends the wait, timedOut is true if the request gave up
+func (w queueWait) done(timedOut bool) {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	atomic.AddInt64(&w.q.waitNanos, int64(time.Since(w.start)))
+	if timedOut {
+		atomic.AddUint64(&w.q.timeoutCount, 1)
+	}
+}
+
+func (q *requestQueue) stats(name string, depth int, capacity int) QueueStats {
+	return QueueStats{
+		Name:         name,
+		Depth:        depth,
+		Capacity:     capacity,
+		FullCount:    atomic.LoadUint64(&q.fullCount),
+		WaitTime:     time.Duration(atomic.LoadInt64(&q.waitNanos)),
+		TimeoutCount: atomic.LoadUint64(&q.timeoutCount)}
+}
+
+// queueDepth returns depth or the default depth for workerCount workers if depth is zero
+func queueDepth(depth int, workerCount int, perWorker int) int {
+	if depth > 0 {
+		return depth
+	}
+	return workerCount * perWorker
+}
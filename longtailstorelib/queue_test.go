@@ -0,0 +1,68 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestQueueDepths(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 2, ReadWrite, WithQueueDepths(3, 5, 0, 7), WithDecodeWorkerCount(3))
+	if err != nil {
+		t.Fatalf("TestQueueDepths() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	queues := remoteStore.(DetailedStatsProvider).GetDetailedStats().Queues
+	capacities := map[string]int{QueuePut: 3, QueueGet: 5, QueuePrefetch: 2 * defaultPrefetchQueueDepthPerWorker, QueueBlockIndex: 7, QueueDecode: 3 * defaultDecodeQueueDepthPerWorker}
+	if len(queues) != len(capacities) {
+		t.Fatalf("TestQueueDepths() GetDetailedStats().Queues %v", queues)
+	}
+	for _, q := range queues {
+		if q.Capacity != capacities[q.Name] {
+			t.Errorf("TestQueueDepths() queue %s capacity %d != %d", q.Name, q.Capacity, capacities[q.Name])
+		}
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	// No workers take requests from the queue so it stays full
+	s := &remoteStore{
+		blobStore:    blobStore,
+		options:      newStoreOptions([]StoreOption{WithQueueTimeout(10 * time.Millisecond)}),
+		getBlockChan: make(chan getBlockMessage, 1)}
+	errno := s.GetStoredBlock(1, longtaillib.Longtail_AsyncGetStoredBlockAPI{})
+	if errno != 0 {
+		t.Fatalf("TestQueueTimeout() GetStoredBlock() %d != %d", errno, 0)
+	}
+	errno = s.GetStoredBlock(2, longtaillib.Longtail_AsyncGetStoredBlockAPI{})
+	if errno != longtaillib.EBUSY {
+		t.Errorf("TestQueueTimeout() GetStoredBlock() full queue %d != %d", errno, longtaillib.EBUSY)
+	}
+	stats := s.getQueue.stats(QueueGet, len(s.getBlockChan), cap(s.getBlockChan))
+	if stats.Depth != 1 || stats.FullCount != 1 || stats.TimeoutCount != 1 || stats.WaitTime < 10*time.Millisecond {
+		t.Errorf("TestQueueTimeout() queue stats %+v", stats)
+	}
+
+	// Without a timeout the request waits for room
+	s.options.QueueTimeout = 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-s.getBlockChan
+	}()
+	errno = s.GetStoredBlock(3, longtaillib.Longtail_AsyncGetStoredBlockAPI{})
+	if errno != 0 {
+		t.Errorf("TestQueueTimeout() GetStoredBlock() without timeout %d != %d", errno, 0)
+	}
+	stats = s.getQueue.stats(QueueGet, len(s.getBlockChan), cap(s.getBlockChan))
+	if stats.FullCount != 2 || stats.TimeoutCount != 1 {
+		t.Errorf("TestQueueTimeout() queue stats without timeout %+v", stats)
+	}
+}
@@ -0,0 +1,99 @@
+package longtailstorelib
+
+import (
+	"sync/atomic"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// storeUsage is what counts towards the quota of a store, the blocks and their chunk data
+type storeUsage struct {
+	blockCount int64
+	bytes      int64
+}
+
+func (u *storeUsage) add(other storeUsage) {
+	u.blockCount += other.blockCount
+	u.bytes += other.bytes
+}
+
+func sumChunkSizes(chunkSizes []uint32) int64 {
+	bytes := int64(0)
+	for _, chunkSize := range chunkSizes {
+		bytes += int64(chunkSize)
+	}
+	return bytes
+}
+
+func getStoreIndexUsage(storeIndex longtaillib.Longtail_StoreIndex) storeUsage {
+	if !storeIndex.IsValid() {
+		return storeUsage{}
+	}
+	return storeUsage{blockCount: int64(storeIndex.GetBlockCount()), bytes: sumChunkSizes(storeIndex.GetChunkSizes())}
+}
+
+func getBlockIndexesUsage(blockIndexes []longtaillib.Longtail_BlockIndex) storeUsage {
+	usage := storeUsage{}
+	for _, blockIndex := range blockIndexes {
+		usage.add(storeUsage{blockCount: 1, bytes: sumChunkSizes(blockIndex.GetChunkSizes())})
+	}
+	return usage
+}
+
+func (s *remoteStore) hasQuota() bool {
+	return s.options.MaxStoreBytes > 0 || s.options.MaxStoreBlockCount > 0
+}
+
+// checkQuota returns a QuotaExceededError if usage is over the quota of the store
+func (s *remoteStore) checkQuota(usage storeUsage) error {
+	if s.options.MaxStoreBlockCount > 0 && usage.blockCount > s.options.MaxStoreBlockCount {
+		return &QuotaExceededError{Store: s.blobStore.String(), Quota: "block count", Limit: s.options.MaxStoreBlockCount, Size: usage.blockCount}
+	}
+	if s.options.MaxStoreBytes > 0 && usage.bytes > s.options.MaxStoreBytes {
+		return &QuotaExceededError{Store: s.blobStore.String(), Quota: "bytes", Limit: s.options.MaxStoreBytes, Size: usage.bytes}
+	}
+	return nil
+}
+
+// reserveQuota adds a block that is about to be put to the pending usage of the store, the block
+// is rejected if the store index and the pending blocks would be over the quota. Returns the usage
+// of the block to release with releaseQuota.
+func (s *remoteStore) reserveQuota(blockIndex longtaillib.Longtail_BlockIndex) (storeUsage, error) {
+	if !s.hasQuota() {
+		return storeUsage{}, nil
+	}
+	blockUsage := getBlockIndexesUsage([]longtaillib.Longtail_BlockIndex{blockIndex})
+	usage := storeUsage{
+		blockCount: atomic.LoadInt64(&s.indexedUsage.blockCount) + atomic.AddInt64(&s.pendingUsage.blockCount, blockUsage.blockCount),
+		bytes:      atomic.LoadInt64(&s.indexedUsage.bytes) + atomic.AddInt64(&s.pendingUsage.bytes, blockUsage.bytes)}
+	err := s.checkQuota(usage)
+	if err != nil {
+		s.releaseQuota(blockUsage)
+		return storeUsage{}, err
+	}
+	return blockUsage, nil
+}
+
+// releaseQuota removes blocks from the pending usage once they are in the store index or rejected
+func (s *remoteStore) releaseQuota(usage storeUsage) {
+	atomic.AddInt64(&s.pendingUsage.blockCount, -usage.blockCount)
+	atomic.AddInt64(&s.pendingUsage.bytes, -usage.bytes)
+}
+
+func (s *remoteStore) setIndexedUsage(usage storeUsage) {
+	atomic.StoreInt64(&s.indexedUsage.blockCount, usage.blockCount)
+	atomic.StoreInt64(&s.indexedUsage.bytes, usage.bytes)
+}
+
+// updateQuotaUsage checks that updatedStoreIndex, the store index with addedBlockIndexes, is within
+// the quota. The added blocks are released from the pending usage whether they are accepted or not.
+func (s *remoteStore) updateQuotaUsage(updatedStoreIndex longtaillib.Longtail_StoreIndex, addedBlockIndexes []longtaillib.Longtail_BlockIndex) error {
+	s.releaseQuota(getBlockIndexesUsage(addedBlockIndexes))
+	usage := getStoreIndexUsage(updatedStoreIndex)
+	err := s.checkQuota(usage)
+	if err != nil {
+		return err
+	}
+	s.setIndexedUsage(usage)
+	return nil
+}
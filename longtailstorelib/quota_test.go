@@ -0,0 +1,85 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func flushRemoteStore(storeAPI longtaillib.Longtail_BlockStoreAPI) int {
+	flushComplete := &flushCompletionAPI{}
+	flushComplete.wg.Add(1)
+	storeAPI.Flush(longtaillib.CreateAsyncFlushAPI(flushComplete))
+	flushComplete.wg.Wait()
+	return flushComplete.err
+}
+
+func TestStoreBlockCountQuota(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithQuota(0, 2))
+	if err != nil {
+		t.Fatalf("TestStoreBlockCountQuota() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	for seed := uint8(0); seed < 2; seed++ {
+		if _, errno := storeBlockFromSeed(t, storeAPI, seed); errno != 0 {
+			t.Errorf("TestStoreBlockCountQuota() storeBlockFromSeed(%d) %d != %d", seed, errno, 0)
+		}
+	}
+	if _, errno := storeBlockFromSeed(t, storeAPI, 2); errno != longtaillib.ENOSPC {
+		t.Errorf("TestStoreBlockCountQuota() storeBlockFromSeed(2) %d != %d", errno, longtaillib.ENOSPC)
+	}
+	if errno := flushRemoteStore(storeAPI); errno != 0 {
+		t.Errorf("TestStoreBlockCountQuota() Flush() %d != %d", errno, 0)
+	}
+	storeAPI.Dispose()
+	if indexed := getStoreIndexBlockHashes(t, blobStore); len(indexed) != 2 {
+		t.Errorf("TestStoreBlockCountQuota() store index blocks %d != %d", len(indexed), 2)
+	}
+
+	// The quota includes the blocks already in the store index
+	remoteStore, err = NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithQuota(0, 2))
+	if err != nil {
+		t.Fatalf("TestStoreBlockCountQuota() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI = longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	existingContent, _ := getExistingContent(t, storeAPI, []uint64{1}, 0)
+	existingContent.Dispose()
+	if _, errno := storeBlockFromSeed(t, storeAPI, 3); errno != longtaillib.ENOSPC {
+		t.Errorf("TestStoreBlockCountQuota() storeBlockFromSeed(3) %d != %d", errno, longtaillib.ENOSPC)
+	}
+}
+
+func TestStoreBytesQuota(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	// A block from seed 0 has 60 bytes of chunk data
+	quotaStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithQuota(100, 0))
+	if err != nil {
+		t.Fatalf("TestStoreBytesQuota() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(quotaStore)
+	defer storeAPI.Dispose()
+	if _, errno := storeBlockFromSeed(t, storeAPI, 0); errno != 0 {
+		t.Errorf("TestStoreBytesQuota() storeBlockFromSeed(0) %d != %d", errno, 0)
+	}
+	if _, errno := storeBlockFromSeed(t, storeAPI, 1); errno != longtaillib.ENOSPC {
+		t.Errorf("TestStoreBytesQuota() storeBlockFromSeed(1) %d != %d", errno, longtaillib.ENOSPC)
+	}
+	if errno := flushRemoteStore(storeAPI); errno != 0 {
+		t.Errorf("TestStoreBytesQuota() Flush() %d != %d", errno, 0)
+	}
+
+	s := &remoteStore{blobStore: blobStore, options: newStoreOptions([]StoreOption{WithQuota(100, 0)})}
+	err = s.checkQuota(storeUsage{blockCount: 1, bytes: 101})
+	if !IsQuotaExceeded(err) || longtaillib.ErrorToErrno(err, longtaillib.EIO) != longtaillib.ENOSPC {
+		t.Errorf("TestStoreBytesQuota() checkQuota() %v is not a quota error", err)
+	}
+}
@@ -0,0 +1,111 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// getUnindexedBlockKeys returns the keys of the blocks in the store that are not in storeIndex
+func getUnindexedBlockKeys(ctx context.Context, s *remoteStore, blobClient BlobClient, storeIndex longtaillib.Longtail_StoreIndex) ([]string, error) {
+	indexed := map[uint64]bool{}
+	if storeIndex.IsValid() {
+		for _, blockHash := range storeIndex.GetBlockHashes() {
+			indexed[blockHash] = true
+		}
+	}
+	storeBlockKeys, err := listStoreBlocks(ctx, s.blobStore, blobClient, s.layout, s.workerCount)
+	if err != nil {
+		return nil, err
+	}
+	storeBlockKeys, err = appendPackedBlockKeys(blobClient, s.layout, storeBlockKeys)
+	if err != nil {
+		return nil, err
+	}
+	var blockKeys []string
+	for _, blockKey := range storeBlockKeys {
+		blockHash, ok := s.layout.parseBlockPath(blockKey)
+		if ok && !indexed[blockHash] {
+			blockKeys = append(blockKeys, blockKey)
+		}
+	}
+	return blockKeys, nil
+}
+
+// RecoverStoreIndex adds the blocks in chunks/ that are missing from store.lsi to the store index.
+// This heals stores where an upsync uploaded blocks but crashed before it updated the index. Blocks
+// that can not be read, such as partially written ones, are skipped. The store is compared with
+// the index by block name so only the unindexed blocks are read. Returns the hashes of the
+// recovered blocks, with dryRun they are only reported. A corrupt store.lsi is replaced by a store
+// index of all blocks in the store.
+func RecoverStoreIndex(
+	ctx context.Context,
+	blobStore BlobStore,
+	dryRun bool,
+	opts ...StoreOption) ([]uint64, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	s := &remoteStore{
+		blobStore:     blobStore,
+		defaultClient: blobClient,
+		storeOptions:  opts,
+		options:       newStoreOptions(opts),
+		workerCount:   runtime.NumCPU()}
+	s.latencies = newOperationLatencies(s.options.SlowOperationThreshold)
+	if s.options.WorkerCount > 0 {
+		s.workerCount = s.options.WorkerCount
+	}
+	s.layout, err = readBlockLayout(blobClient)
+	if err != nil {
+		return nil, errors.Wrap(err, "RecoverStoreIndex")
+	}
+
+	storeIndex, err := readStoreStoreIndex(ctx, s, blobClient)
+	corruptStoreIndex := IsStoreIndexCorrupt(err)
+	if err != nil && errors.Cause(err) != longtaillib.ErrENOENT && !corruptStoreIndex {
+		return nil, errors.Wrap(err, "RecoverStoreIndex")
+	}
+	blockKeys, err := getUnindexedBlockKeys(ctx, s, blobClient, storeIndex)
+	storeIndex.Dispose()
+	if err != nil {
+		return nil, errors.Wrapf(err, "RecoverStoreIndex: failed to list blocks of %s", blobStore.String())
+	}
+	if len(blockKeys) == 0 {
+		return nil, nil
+	}
+
+	recoveredStoreIndex, err := getStoreIndexFromBlocks(ctx, s, blobClient, blockKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "RecoverStoreIndex")
+	}
+	defer recoveredStoreIndex.Dispose()
+	recoveredBlockHashes := append([]uint64{}, recoveredStoreIndex.GetBlockHashes()...)
+	if dryRun || len(recoveredBlockHashes) == 0 {
+		return recoveredBlockHashes, nil
+	}
+	if corruptStoreIndex {
+		// All blocks are recovered so the store index is replaced rather than merged with the corrupt one
+		err = removeCorruptStoreIndex(blobClient)
+		if err != nil {
+			return nil, errors.Wrap(err, "RecoverStoreIndex")
+		}
+	}
+
+	newStoreIndex, err := updateRemoteStoreIndex(ctx, blobClient, recoveredStoreIndex, &s.options.Hooks)
+	if err != nil {
+		return nil, errors.Wrap(err, "RecoverStoreIndex")
+	}
+	indexBlockCount := len(recoveredBlockHashes)
+	if newStoreIndex.IsValid() {
+		indexBlockCount = int(newStoreIndex.GetBlockCount())
+		newStoreIndex.Dispose()
+	}
+	recordAudit(blobClient, resolveStoreOptions(blobStore, opts), AuditEntry{Operation: AuditRecoverIndex, AddedBlockCount: len(recoveredBlockHashes), IndexBlockCount: indexBlockCount})
+	return recoveredBlockHashes, nil
+}
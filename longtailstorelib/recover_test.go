@@ -0,0 +1,79 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func writeUnindexedBlock(t *testing.T, blobStore BlobStore, seed uint8) uint64 {
+	storedBlock, errno := generateStoredBlock(t, seed)
+	if errno != 0 {
+		t.Fatalf("writeUnindexedBlock() generateStoredBlock() %d != %d", errno, 0)
+	}
+	defer storedBlock.Dispose()
+	blockIndex := storedBlock.GetBlockIndex()
+	blockHash := blockIndex.GetBlockHash()
+	data, errno := longtaillib.WriteStoredBlockToBuffer(storedBlock)
+	if errno != 0 {
+		t.Fatalf("writeUnindexedBlock() longtaillib.WriteStoredBlockToBuffer() %d != %d", errno, 0)
+	}
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject(GetBlockPath("chunks", blockHash))
+	_, err := object.Write(data)
+	if err != nil {
+		t.Fatalf("writeUnindexedBlock() object.Write() %v != %v", err, nil)
+	}
+	return blockHash
+}
+
+func TestRecoverStoreIndex(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestRecoverStoreIndex() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	indexedBlockHash, _ := storeBlockFromSeed(t, storeAPI, 0)
+	storeAPI.Dispose()
+
+	// Blocks uploaded by an upsync that crashed before the index was updated
+	unindexedBlockHash := writeUnindexedBlock(t, blobStore, 10)
+	client, _ := blobStore.NewClient(context.Background())
+	corrupt, _ := client.NewObject(GetBlockPath("chunks", 0x1234))
+	corrupt.Write([]byte("partial block"))
+	client.Close()
+
+	recoveredBlockHashes, err := RecoverStoreIndex(context.Background(), blobStore, true)
+	if err != nil {
+		t.Fatalf("TestRecoverStoreIndex() RecoverStoreIndex() dry run %v != %v", err, nil)
+	}
+	if len(recoveredBlockHashes) != 1 || recoveredBlockHashes[0] != unindexedBlockHash {
+		t.Errorf("TestRecoverStoreIndex() RecoverStoreIndex() dry run %v != [0x%016x]", recoveredBlockHashes, unindexedBlockHash)
+	}
+	if getStoreIndexBlockHashes(t, blobStore)[unindexedBlockHash] {
+		t.Errorf("TestRecoverStoreIndex() RecoverStoreIndex() dry run indexed block 0x%016x", unindexedBlockHash)
+	}
+
+	recoveredBlockHashes, err = RecoverStoreIndex(context.Background(), blobStore, false)
+	if err != nil {
+		t.Fatalf("TestRecoverStoreIndex() RecoverStoreIndex() %v != %v", err, nil)
+	}
+	if len(recoveredBlockHashes) != 1 {
+		t.Errorf("TestRecoverStoreIndex() RecoverStoreIndex() %d != %d", len(recoveredBlockHashes), 1)
+	}
+	indexedBlockHashes := getStoreIndexBlockHashes(t, blobStore)
+	if !indexedBlockHashes[indexedBlockHash] || !indexedBlockHashes[unindexedBlockHash] {
+		t.Errorf("TestRecoverStoreIndex() store index %v missing 0x%016x or 0x%016x", indexedBlockHashes, indexedBlockHash, unindexedBlockHash)
+	}
+
+	recoveredBlockHashes, err = RecoverStoreIndex(context.Background(), blobStore, false)
+	if err != nil || len(recoveredBlockHashes) != 0 {
+		t.Errorf("TestRecoverStoreIndex() RecoverStoreIndex() again %v, %v", recoveredBlockHashes, err)
+	}
+}
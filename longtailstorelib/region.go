@@ -0,0 +1,88 @@
+package longtailstorelib
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RegionProvider is implemented by blob stores that can report the region their data is kept in,
+// see WithAllowedRegions
+type RegionProvider interface {
+	// Region returns the location of the bucket as reported by the provider
+	Region(ctx context.Context) (string, error)
+}
+
+// isAllowedRegion returns true if region is one of allowedRegions
+func isAllowedRegion(region string, allowedRegions []string) bool {
+	for _, allowedRegion := range allowedRegions {
+		if strings.EqualFold(region, allowedRegion) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRegion returns a RegionNotAllowedError if the region of provider is not in allowedRegions
+func checkRegion(ctx context.Context, store string, provider RegionProvider, allowedRegions []string) error {
+	region, err := provider.Region(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to query the region of %s to check it against the allowed regions", store)
+	}
+	if !isAllowedRegion(region, allowedRegions) {
+		return &RegionNotAllowedError{Store: store, Region: region, AllowedRegions: allowedRegions}
+	}
+	return nil
+}
+
+// regionCheck checks the region of a store once, before its first write, and remembers the result
+type regionCheck struct {
+	once sync.Once
+	err  error
+}
+
+// check returns the result of checking the region of provider against allowedRegions, no regions
+// allows any region
+func (c *regionCheck) check(ctx context.Context, store string, provider RegionProvider, allowedRegions []string) error {
+	if len(allowedRegions) == 0 {
+		return nil
+	}
+	c.once.Do(func() {
+		c.err = checkRegion(ctx, store, provider, allowedRegions)
+	})
+	return c.err
+}
+
+// checkRegionProvider refuses to create a store with allowed regions that can not report its region
+func checkRegionProvider(blobStore BlobStore, options StoreOptions) error {
+	if len(options.AllowedRegions) == 0 {
+		return nil
+	}
+	if _, ok := blobStore.(*fsBlobStore); ok {
+		return nil
+	}
+	if _, ok := blobStore.(RegionProvider); !ok {
+		return errors.Errorf("%s can not report its region, it can not be used with allowed regions", blobStore)
+	}
+	return nil
+}
+
+// CheckStoreRegion checks that the bucket of blobStore is in one of the allowed regions of opts
+// and the options the store was created with, so a write can fail before any work is done.
+// Returns nil if no regions are set or the store keeps its data on the local file system.
+func CheckStoreRegion(ctx context.Context, blobStore BlobStore, opts ...StoreOption) error {
+	allowedRegions := resolveStoreOptions(blobStore, opts).AllowedRegions
+	if len(allowedRegions) == 0 {
+		return nil
+	}
+	if err := checkRegionProvider(blobStore, StoreOptions{AllowedRegions: allowedRegions}); err != nil {
+		return errors.Wrap(err, "CheckStoreRegion")
+	}
+	provider, ok := blobStore.(RegionProvider)
+	if !ok {
+		return nil
+	}
+	return errors.Wrap(checkRegion(ctx, blobStore.String(), provider, allowedRegions), "CheckStoreRegion")
+}
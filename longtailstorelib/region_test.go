@@ -0,0 +1,91 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+type regionTestBlobStore struct {
+	BlobStore
+	region  string
+	queries int
+}
+
+func (blobStore *regionTestBlobStore) Region(ctx context.Context) (string, error) {
+	blobStore.queries++
+	return blobStore.region, nil
+}
+
+func TestCheckStoreRegion(t *testing.T) {
+	testStore, _ := NewTestBlobStore("the_path")
+	blobStore := &regionTestBlobStore{BlobStore: testStore, region: "EUROPE-WEST1"}
+
+	err := CheckStoreRegion(context.Background(), blobStore)
+	if err != nil || blobStore.queries != 0 {
+		t.Errorf("TestCheckStoreRegion() CheckStoreRegion() no regions %v, %d queries", err, blobStore.queries)
+	}
+	err = CheckStoreRegion(context.Background(), blobStore, WithAllowedRegions("eu", "europe-west1"))
+	if err != nil {
+		t.Errorf("TestCheckStoreRegion() CheckStoreRegion() allowed %v != %v", err, nil)
+	}
+	err = CheckStoreRegion(context.Background(), blobStore, WithAllowedRegions("EU"))
+	if !IsRegionNotAllowed(err) {
+		t.Errorf("TestCheckStoreRegion() CheckStoreRegion() not allowed %v", err)
+	}
+	if longtaillib.ErrorToErrno(err, 0) != longtaillib.EACCES {
+		t.Errorf("TestCheckStoreRegion() ErrorToErrno() %d != %d", longtaillib.ErrorToErrno(err, 0), longtaillib.EACCES)
+	}
+	// A store without a region can not be checked
+	err = CheckStoreRegion(context.Background(), testStore, WithAllowedRegions("EU"))
+	if err == nil || IsRegionNotAllowed(err) {
+		t.Errorf("TestCheckStoreRegion() CheckStoreRegion() no region %v", err)
+	}
+
+	// The region is only queried once
+	var check regionCheck
+	queries := blobStore.queries
+	for i := 0; i < 2; i++ {
+		err = check.check(context.Background(), blobStore.String(), blobStore, []string{"US"})
+		if !IsRegionNotAllowed(err) {
+			t.Errorf("TestCheckStoreRegion() regionCheck.check() %v", err)
+		}
+	}
+	if blobStore.queries != queries+1 {
+		t.Errorf("TestCheckStoreRegion() regionCheck.check() %d queries != %d", blobStore.queries-queries, 1)
+	}
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	_, err = NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithAllowedRegions("US"))
+	if !IsRegionNotAllowed(err) {
+		t.Errorf("TestCheckStoreRegion() NewRemoteBlockStore() read write %v", err)
+	}
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadOnly, WithAllowedRegions("US"))
+	if err != nil {
+		t.Fatalf("TestCheckStoreRegion() NewRemoteBlockStore() read only %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	storeAPI.Dispose()
+}
+
+func TestCreateBlobStoreAllowedRegions(t *testing.T) {
+	_, err := CreateBlobStoreForURI("gdrive://folder/store", WithAllowedRegions("EU"))
+	if err == nil {
+		t.Errorf("TestCreateBlobStoreAllowedRegions() CreateBlobStoreForURI() gdrive %v", err)
+	}
+	_, err = CreateBlobStoreForURI("gs://bucket/store?allowed-regions=EU,europe-west1")
+	if err != nil {
+		t.Errorf("TestCreateBlobStoreAllowedRegions() CreateBlobStoreForURI() gs %v != %v", err, nil)
+	}
+	_, err = CreateBlobStoreForURI("local/store", WithAllowedRegions("EU"))
+	if err != nil {
+		t.Errorf("TestCreateBlobStoreAllowedRegions() CreateBlobStoreForURI() file %v != %v", err, nil)
+	}
+	_, options, err := ParseStoreURI("gs://bucket/store?allowed-regions=EU,%20us")
+	if err != nil || len(newStoreOptions(options).AllowedRegions) != 2 || newStoreOptions(options).AllowedRegions[1] != "us" {
+		t.Errorf("TestCreateBlobStoreAllowedRegions() ParseStoreURI() %v, %v", err, newStoreOptions(options).AllowedRegions)
+	}
+}
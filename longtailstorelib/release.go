@@ -0,0 +1,160 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A release is a set of versions, for example the builds of one change for several platforms,
+// that become visible together. The version indexes of a release are uploaded to paths of their
+// own next to the requested paths, see ReleaseVersionPath, and stay there. PublishStagedRelease
+// adds the release with all its versions to the version manifest in a single manifest update,
+// which is the only step that makes them visible. Readers find the versions of a release through
+// the version manifest and see all of them or none.
+
+// ReleaseVersion is a version of a release
+type ReleaseVersion struct {
+	// Name identifies the version within the release, for example the platform
+	Name string `json:"name"`
+	// Path is the URI of the version index
+	Path string `json:"path"`
+}
+
+// Release is a set of versions published together, see PublishStagedRelease
+type Release struct {
+	Name     string           `json:"name"`
+	Created  time.Time        `json:"created"`
+	Tags     []string         `json:"tags,omitempty"`
+	Versions []ReleaseVersion `json:"versions"`
+}
+
+// hasVersionIn returns true if any version of the release is in paths
+func (release Release) hasVersionIn(paths map[string]bool) bool {
+	for _, version := range release.Versions {
+		if paths[version.Path] {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleaseVersionPath returns the path that the version index for path is uploaded to for the
+// release releaseName, index/win64.lvi is uploaded to index/win64.release-1.0.lvi for release 1.0.
+// Only the release in the version manifest refers to it, so it is not read before the release is
+// committed and two releases never write the same version index.
+func ReleaseVersionPath(path string, releaseName string) string {
+	base := strings.TrimSuffix(path, ".lvi")
+	return fmt.Sprintf("%s.release-%s.lvi", base, releaseName)
+}
+
+// ReadRelease returns the release with name from the version manifest of the store
+func ReadRelease(ctx context.Context, blobStore BlobStore, name string) (Release, bool, error) {
+	manifest, err := ReadVersionManifest(ctx, blobStore)
+	if err != nil {
+		return Release{}, false, errors.Wrap(err, "ReadRelease")
+	}
+	for _, release := range manifest.Releases {
+		if release.Name == name {
+			return release, true, nil
+		}
+	}
+	return Release{}, false, nil
+}
+
+// CommitRelease adds release and its versions with the tags of the release to the version manifest
+// in one update. Returns ErrReleaseExists if the manifest already has a release with the name.
+func CommitRelease(ctx context.Context, blobStore BlobStore, release Release) error {
+	if len(release.Versions) == 0 {
+		return fmt.Errorf("CommitRelease: release `%s` has no versions", release.Name)
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	err = updateVersionManifest(blobClient, func(manifest *VersionManifest) error {
+		for _, existing := range manifest.Releases {
+			if existing.Name == release.Name {
+				return errors.Wrapf(ErrReleaseExists, "`%s`", release.Name)
+			}
+		}
+		for _, version := range release.Versions {
+			manifest.addVersion(version.Path, release.Created, release.Tags)
+		}
+		manifest.Releases = append(manifest.Releases, release)
+		return nil
+	})
+	return errors.Wrap(err, "CommitRelease")
+}
+
+// PublishStagedRelease publishes the version indexes uploaded to the release paths of the versions
+// of release, see ReleaseVersionPath. Nothing is published if a version index is missing or the
+// release already exists. The version indexes are not moved, the release is committed to the
+// version manifest with the release paths of its versions, so the commit makes all of them visible
+// at once and a failed commit leaves nothing to undo.
+func PublishStagedRelease(ctx context.Context, blobStore BlobStore, release Release, opts ...StoreOption) error {
+	if newStoreOptions(opts).Immutable {
+		return errors.Wrap(ErrImmutable, blobStore.String())
+	}
+	_, exists, err := ReadRelease(ctx, blobStore, release.Name)
+	if err != nil {
+		return errors.Wrap(err, "PublishStagedRelease")
+	}
+	if exists {
+		return errors.Wrapf(ErrReleaseExists, "PublishStagedRelease: `%s`", release.Name)
+	}
+	if release.Created.IsZero() {
+		release.Created = time.Now().UTC()
+	}
+
+	versions := make([]ReleaseVersion, len(release.Versions))
+	for i, version := range release.Versions {
+		releasePath := ReleaseVersionPath(version.Path, release.Name)
+		exists, err := existsURI(ctx, releasePath, opts)
+		if err != nil {
+			return errors.Wrapf(err, "PublishStagedRelease: failed to check %s", releasePath)
+		}
+		if !exists {
+			return fmt.Errorf("PublishStagedRelease: version index `%s` of release `%s` has not been uploaded", releasePath, release.Name)
+		}
+		versions[i] = ReleaseVersion{Name: version.Name, Path: releasePath}
+	}
+	release.Versions = versions
+	return errors.Wrap(CommitRelease(ctx, blobStore, release), "PublishStagedRelease")
+}
+
+// DeleteStagedRelease deletes the version indexes uploaded to the release paths of the versions of
+// a release that has not been published, for example after one of them failed to upload
+func DeleteStagedRelease(ctx context.Context, release Release, opts ...StoreOption) error {
+	for _, version := range release.Versions {
+		releasePath := ReleaseVersionPath(version.Path, release.Name)
+		err := deleteURI(ctx, releasePath, opts)
+		if err != nil {
+			return errors.Wrapf(err, "DeleteStagedRelease: failed to delete %s", releasePath)
+		}
+	}
+	return nil
+}
+
+// existsURI returns true if there is an object at uri
+func existsURI(ctx context.Context, uri string, opts []StoreOption) (bool, error) {
+	uriParent, uriName := splitURI(uri)
+	blobStore, err := CreateBlobStoreForURI(uriParent, opts...)
+	if err != nil {
+		return false, err
+	}
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+	object, err := client.NewObject(uriName)
+	if err != nil {
+		return false, err
+	}
+	return object.Exists()
+}
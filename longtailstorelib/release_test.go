@@ -0,0 +1,103 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestPublishStagedRelease(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_release_test")
+	if err != nil {
+		t.Fatalf("TestPublishStagedRelease() ioutil.TempDir() %v != %v", err, nil)
+	}
+	defer os.RemoveAll(storePath)
+	blobStore, _ := NewFSBlobStore(storePath)
+	ctx := context.Background()
+
+	release := Release{Name: "1.0", Tags: []string{"stable"}}
+	for _, platform := range []string{"win64", "linux"} {
+		path := filepath.ToSlash(filepath.Join(storePath, "index", platform+".lvi"))
+		release.Versions = append(release.Versions, ReleaseVersion{Name: platform, Path: path})
+	}
+
+	// Nothing is published while a version is not staged
+	err = WriteToURI(ReleaseVersionPath(release.Versions[0].Path, release.Name), []byte("win64"))
+	if err != nil {
+		t.Fatalf("TestPublishStagedRelease() WriteToURI() %v != %v", err, nil)
+	}
+	err = PublishStagedRelease(ctx, blobStore, release)
+	if err == nil {
+		t.Errorf("TestPublishStagedRelease() PublishStagedRelease() partial %v == %v", err, nil)
+	}
+	manifest, _ := ReadVersionManifest(ctx, blobStore)
+	if len(manifest.Versions) != 0 || len(manifest.Releases) != 0 {
+		t.Errorf("TestPublishStagedRelease() ReadVersionManifest() partial %+v", manifest)
+	}
+	if _, err = os.Stat(release.Versions[0].Path); !os.IsNotExist(err) {
+		t.Errorf("TestPublishStagedRelease() os.Stat(%s) partial %v", release.Versions[0].Path, err)
+	}
+
+	err = WriteToURI(ReleaseVersionPath(release.Versions[1].Path, release.Name), []byte("linux"))
+	if err != nil {
+		t.Fatalf("TestPublishStagedRelease() WriteToURI() %v != %v", err, nil)
+	}
+	err = PublishStagedRelease(ctx, blobStore, release)
+	if err != nil {
+		t.Fatalf("TestPublishStagedRelease() PublishStagedRelease() %v != %v", err, nil)
+	}
+	manifest, _ = ReadVersionManifest(ctx, blobStore)
+	if len(manifest.Versions) != 2 || len(manifest.Versions[0].Tags) != 1 || manifest.Versions[0].Tags[0] != "stable" {
+		t.Errorf("TestPublishStagedRelease() ReadVersionManifest() versions %+v", manifest.Versions)
+	}
+	read, exists, err := ReadRelease(ctx, blobStore, release.Name)
+	if err != nil || !exists || len(read.Versions) != 2 || read.Created.IsZero() {
+		t.Fatalf("TestPublishStagedRelease() ReadRelease() %v, %v, %+v", err, exists, read)
+	}
+	// The version indexes are read where they were uploaded, nothing is written to the requested paths
+	for i, version := range read.Versions {
+		if version.Path != ReleaseVersionPath(release.Versions[i].Path, release.Name) || manifest.Versions[i].Path != version.Path {
+			t.Errorf("TestPublishStagedRelease() ReadRelease() path %s", version.Path)
+		}
+		data, err := ReadFromURI(version.Path)
+		if err != nil || string(data) != version.Name {
+			t.Errorf("TestPublishStagedRelease() ReadFromURI(%s) %v, %s", version.Path, err, data)
+		}
+		if _, err = os.Stat(release.Versions[i].Path); !os.IsNotExist(err) {
+			t.Errorf("TestPublishStagedRelease() %s written %v", release.Versions[i].Path, err)
+		}
+	}
+
+	err = PublishStagedRelease(ctx, blobStore, release)
+	if !errors.Is(err, ErrReleaseExists) {
+		t.Errorf("TestPublishStagedRelease() PublishStagedRelease() again %v != %v", err, ErrReleaseExists)
+	}
+}
+
+func TestEvaluateRetentionRelease(t *testing.T) {
+	now := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	manifest := VersionManifest{
+		Versions: []VersionEntry{
+			{Path: "index/1.0-win64.lvi", Created: now.AddDate(0, 0, -2)},
+			{Path: "index/1.0-linux.lvi", Created: now.AddDate(0, 0, -3)},
+			{Path: "index/0.9-win64.lvi", Created: now.AddDate(0, 0, -4)},
+			{Path: "index/0.9-linux.lvi", Created: now.AddDate(0, 0, -5)},
+		},
+		Releases: []Release{
+			{Name: "1.0", Versions: []ReleaseVersion{{Name: "win64", Path: "index/1.0-win64.lvi"}, {Name: "linux", Path: "index/1.0-linux.lvi"}}},
+			{Name: "0.9", Versions: []ReleaseVersion{{Name: "win64", Path: "index/0.9-win64.lvi"}, {Name: "linux", Path: "index/0.9-linux.lvi"}}},
+		}}
+
+	report := EvaluateRetention(manifest, RetentionPolicy{KeepLast: 1}, now)
+	if len(report.Retained) != 2 || len(report.Deleted) != 2 {
+		t.Fatalf("TestEvaluateRetentionRelease() EvaluateRetention() %+v", report)
+	}
+	if report.Retained[1].Version.Path != "index/1.0-linux.lvi" || report.Retained[1].Reasons[0] != "release 1.0" {
+		t.Errorf("TestEvaluateRetentionRelease() EvaluateRetention() retained %+v", report.Retained)
+	}
+}
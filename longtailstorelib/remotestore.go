@@ -3,9 +3,11 @@ package longtailstorelib
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,24 +17,59 @@ import (
 	"github.com/pkg/errors"
 )
 
-func createBlobStoreForURI(uri string) (BlobStore, error) {
+// CreateBlobStoreForURI creates the blob store for uri, store options may be given as query parameters
+// of uri and as LONGTAIL_* environment variables, see ParseStoreURI
+func CreateBlobStoreForURI(uri string, opts ...StoreOption) (BlobStore, error) {
+	uri, resolvedOpts, err := resolveStoreURI(uri, opts)
+	if err != nil {
+		return nil, err
+	}
+	return createBlobStoreForURI(uri, resolvedOpts...)
+}
+
+func createBlobStoreForURI(uri string, opts ...StoreOption) (BlobStore, error) {
+	blobStore, err := newBlobStoreForURI(uri, opts...)
+	if err != nil {
+		return nil, err
+	}
+	err = checkRegionProvider(blobStore, newStoreOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return blobStore, nil
+}
+
+func newBlobStoreForURI(uri string, opts ...StoreOption) (BlobStore, error) {
+	if IsFaultyURI(uri) {
+		return NewFaultyBlobStoreForURI(uri, opts...)
+	}
 	blobStoreURL, err := url.Parse(uri)
+	if err != nil && strings.Contains(uri, "://") {
+		// Not a path, opening it as one would create a folder named after the URI
+		return nil, fmt.Errorf("invalid store URI `%s`", RedactStoreURI(uri))
+	}
 	if err == nil {
 		switch blobStoreURL.Scheme {
 		case "gs":
-			return NewGCSBlobStore(blobStoreURL)
+			return NewGCSBlobStore(blobStoreURL, opts...)
 		case "s3":
-			return NewS3BlobStore(blobStoreURL)
+			return NewS3BlobStore(blobStoreURL, opts...)
+		case "ipfs":
+			return NewIPFSBlobStore(blobStoreURL, opts...)
+		case "gdrive":
+			return NewGDriveBlobStore(blobStoreURL, opts...)
+		case "onedrive":
+			return NewOneDriveBlobStore(blobStoreURL, opts...)
 		case "abfs":
 			return nil, fmt.Errorf("azure Gen1 storage not yet implemented")
 		case "abfss":
 			return nil, fmt.Errorf("azure Gen2 storage not yet implemented")
 		case "file":
-			return NewFSBlobStore(blobStoreURL.Path[1:])
+			return NewFSBlobStore(blobStoreURL.Path[1:], opts...)
 		}
 	}
 
-	return NewFSBlobStore(uri)
+	return NewFSBlobStore(uri, opts...)
 }
 
 func splitURI(uri string) (string, string) {
@@ -47,9 +84,9 @@ func splitURI(uri string) (string, string) {
 }
 
 // ReadFromURI ...
-func ReadFromURI(uri string) ([]byte, error) {
+func ReadFromURI(uri string, opts ...StoreOption) ([]byte, error) {
 	uriParent, uriName := splitURI(uri)
-	blobStore, err := createBlobStoreForURI(uriParent)
+	blobStore, err := CreateBlobStoreForURI(uriParent, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -69,10 +106,10 @@ func ReadFromURI(uri string) ([]byte, error) {
 	return vbuffer, nil
 }
 
-// ReadFromURI ...
-func WriteToURI(uri string, data []byte) error {
+// WriteToURI ...
+func WriteToURI(uri string, data []byte, opts ...StoreOption) error {
 	uriParent, uriName := splitURI(uri)
-	blobStore, err := createBlobStoreForURI(uriParent)
+	blobStore, err := CreateBlobStoreForURI(uriParent, opts...)
 	if err != nil {
 		return err
 	}
@@ -107,6 +144,8 @@ const (
 type putBlockMessage struct {
 	storedBlock      longtaillib.Longtail_StoredBlock
 	asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI
+	// memory is the size of the block accounted to the store until the put is done
+	memory int64
 }
 
 type getBlockMessage struct {
@@ -121,6 +160,14 @@ type prefetchBlockMessage struct {
 type preflightGetMessage struct {
 	blockHashes      []uint64
 	asyncCompleteAPI longtaillib.Longtail_AsyncPreflightStartedAPI
+	// missingBlocksReply is set by PreflightBlocks, it gets the blocks that are not in the store
+	// index and no blocks are prefetched
+	missingBlocksReply chan<- preflightReply
+}
+
+type preflightReply struct {
+	missingBlockHashes []uint64
+	err                error
 }
 
 type blockIndexMessage struct {
@@ -133,15 +180,24 @@ type getExistingContentMessage struct {
 	asyncCompleteAPI     longtaillib.Longtail_AsyncGetExistingContentAPI
 }
 
+// pendingPrefetchedBlock is a block that is being fetched or has been prefetched. The map of
+// prefetched blocks holds nil for blocks that were fetched and handed out.
 type pendingPrefetchedBlock struct {
-	storedBlock       longtaillib.Longtail_StoredBlock
+	storedBlock longtaillib.Longtail_StoredBlock
+	// completeCallbacks are the get requests waiting for the block, completed in the order they were made
 	completeCallbacks []longtaillib.Longtail_AsyncGetStoredBlockAPI
+	// blockFile is a prefetched block that was streamed to a temp file, it is decoded when it is requested
+	blockFile *fetchedBlock
+	// requested is set if the fetch was started by a get request rather than a prefetch
+	requested bool
 }
 
 type remoteStore struct {
 	jobAPI        longtaillib.Longtail_JobAPI
 	blobStore     BlobStore
 	defaultClient BlobClient
+	storeOptions  []StoreOption
+	options       StoreOptions
 
 	workerCount int
 
@@ -151,18 +207,72 @@ type remoteStore struct {
 	prefetchBlockChan      chan prefetchBlockMessage
 	blockIndexChan         chan blockIndexMessage
 	getExistingContentChan chan getExistingContentMessage
-	workerFlushChan        chan int
-	workerFlushReplyChan   chan int
+	workerPools            []*workerPool
+	downloadStopChan       chan struct{}
+	decodePool             *workerPool
+	decodeBlockChan        chan decodeBlockMessage
+	decodeErrorChan        chan error
+	decodeQueue            requestQueue
+	pendingDecodes         sync.WaitGroup
 	indexFlushChan         chan int
 	indexFlushReplyChan    chan int
 	workerErrorChan        chan error
+	putQueue               requestQueue
+	getQueue               requestQueue
+	prefetchQueue          requestQueue
+	blockIndexQueue        requestQueue
 	prefetchMemory         int64
 	maxPrefetchMemory      int64
 
+	// memory is the memory held by the store, see WithMaxMemory
+	memory *memoryAccount
+
+	// downloadOrder orders the prefetches of PreflightGet, see HintDownloadOrder
+	downloadOrder downloadOrder
+	// prefetchWindow limits the prefetches to the next blocks the restore needs, see WithPrefetchWindow
+	prefetchWindow prefetchWindow
+	// fetchDedup counts the block requests that were served by another fetch of the block
+	fetchDedup fetchDedupCounter
+
 	fetchedBlocksSync sync.Mutex
 	prefetchBlocks    map[uint64]*pendingPrefetchedBlock
 
-	stats longtaillib.BlockStoreStats
+	// packs locates the blocks that have been moved to packs, see PackStoreBlocks
+	packs storePacks
+
+	// knownBlocks are the blocks that are not written again with conditional puts, see WithConditionalPuts
+	knownBlocks knownBlocks
+
+	// blockSources is set when the store has read mirrors or a CDN, see WithMirrorURIs and WithCDN
+	blockSources *blockSources
+
+	// layout is where the blocks are placed in the store, see BlockLayout
+	layout BlockLayout
+
+	// indexedUsage is the usage of the store index and pendingUsage the usage of the blocks put
+	// since it was updated, they are only tracked if the store has a quota, see WithQuota
+	indexedUsage storeUsage
+	pendingUsage storeUsage
+
+	// flushLock serializes flushes from operations sharing the store, see SharedBlockStore
+	flushLock sync.Mutex
+
+	stats        longtaillib.BlockStoreStats
+	statsRates   rateWindow
+	putsInFlight int64
+	getsInFlight int64
+	// latencies are the per operation latency histograms, see WithSlowOperationThreshold
+	latencies *operationLatencies
+	// bandwidth is the data transferred per backend, see GetBandwidthUsage
+	bandwidth *bandwidthCounter
+	// access counts the reads of each block if WithBlockAccessTracking is set
+	access *blockAccessCounter
+	// session throttles block transfers in Background mode, see SetSessionMode
+	session *sessionThrottle
+	// resumable is the state of the session that ExportSessionState exports
+	resumable resumableSession
+	// hibernation counts the workers that released their resources when idle, see WithIdleHibernation
+	hibernation hibernationCounter
 }
 
 // String() ...
@@ -170,47 +280,130 @@ func (s *remoteStore) String() string {
 	return s.defaultClient.String()
 }
 
+// readBlobWithRetry reads key into buffer, see readBlob, a nil buffer reads into newly allocated memory
 func readBlobWithRetry(
 	ctx context.Context,
 	s *remoteStore,
 	client BlobClient,
-	key string) ([]byte, int, error) {
+	key string,
+	buffer *blobBuffer) ([]byte, int, error) {
 	retryCount := 0
 	objHandle, err := client.NewObject(key)
 	if err != nil {
 		return nil, retryCount, err
 	}
-	exists, err := objHandle.Exists()
+	exists, retryCount, err := existsWithRetry(ctx, s, objHandle, "getBlob", key)
 	if err != nil {
 		return nil, retryCount, err
 	}
 	if !exists {
-		return nil, retryCount, longtaillib.ErrENOENT
+		return readPackedBlockBlob(s, client, key)
 	}
-	blobData, err := objHandle.Read()
-	if err != nil {
-		log.Printf("Retrying getBlob %s in store %s\n", key, s.String())
+	blobData, err := readBlob(objHandle, buffer)
+	if IsArchived(err) {
+		if !s.options.RestoreArchived {
+			return nil, retryCount, err
+		}
+		err = restoreArchivedBlob(objHandle, key, s.options.RestoreTimeout, s.options.RestorePollInterval)
+		if err != nil {
+			return nil, retryCount, err
+		}
+		blobData, err = readBlob(objHandle, buffer)
+	}
+	for err != nil && !IsArchived(err) && retryCount < s.options.maxRetries() && ctx.Err() == nil {
 		retryCount++
-		blobData, err = objHandle.Read()
+		waitForRetry("getBlob", key, s, retryCount)
+		s.options.Hooks.retry(key, retryCount, err)
+		blobData, err = readBlob(objHandle, buffer)
 	}
+
 	if err != nil {
-		log.Printf("Retrying 500 ms delayed getBlob %s in store %s\n", key, s.String())
-		time.Sleep(500 * time.Millisecond)
-		retryCount++
-		blobData, err = objHandle.Read()
+		return nil, retryCount, err
 	}
+
+	return blobData, retryCount, nil
+}
+
+// readPackedBlockBlob reads a block that is not in chunks/ from its pack, see PackStoreBlocks
+func readPackedBlockBlob(s *remoteStore, client BlobClient, key string) ([]byte, int, error) {
+	blockHash, ok := s.layout.parseBlockPath(key)
+	if !ok || s.defaultClient == nil {
+		return nil, 0, longtaillib.ErrENOENT
+	}
+	location, packed, err := s.packs.locate(s.defaultClient, blockHash)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !packed {
+		return nil, 0, longtaillib.ErrENOENT
+	}
+	blobData, err := readPackedBlob(client, location)
 	if err != nil {
-		log.Printf("Retrying 2 s delayed getBlob %s in store %s\n", key, s.String())
-		time.Sleep(2 * time.Second)
+		return nil, 0, errors.Wrapf(err, "failed to read block 0x%016x from pack %s", blockHash, location.key)
+	}
+	return blobData, 0, nil
+}
+
+// existsWithRetry checks if objHandle exists, a failed check is retried like a failed read or write
+func existsWithRetry(ctx context.Context, s *remoteStore, objHandle BlobObject, operation string, key string) (bool, int, error) {
+	retryCount := 0
+	exists, err := objHandle.Exists()
+	for err != nil && retryCount < s.options.maxRetries() && ctx.Err() == nil {
 		retryCount++
-		blobData, err = objHandle.Read()
+		waitForRetry(operation, key, s, retryCount)
+		s.options.Hooks.retry(key, retryCount, err)
+		exists, err = objHandle.Exists()
 	}
+	return exists, retryCount, err
+}
 
-	if err != nil {
-		return nil, retryCount, err
+// retryDelays are the delays before the retries of a failed block read or write, further retries use the last delay
+var retryDelays = []time.Duration{0, 500 * time.Millisecond, 2 * time.Second}
+
+func (options *StoreOptions) maxRetries() int {
+	if options.MaxRetries < 0 {
+		return 0
 	}
+	if options.MaxRetries == 0 {
+		return len(retryDelays)
+	}
+	return options.MaxRetries
+}
 
-	return blobData, retryCount, nil
+func waitForRetry(operation string, key string, s *remoteStore, retryCount int) {
+	delay := retryDelays[len(retryDelays)-1]
+	if retryCount <= len(retryDelays) {
+		delay = retryDelays[retryCount-1]
+	}
+	if delay == 0 {
+		log.Printf("Retrying %s %s in store %s\n", operation, key, s.String())
+		return
+	}
+	log.Printf("Retrying %v delayed %s %s in store %s\n", delay, operation, key, s.String())
+	time.Sleep(delay)
+}
+
+// restoreArchivedBlob requests a restore of an archived blob and waits until it is readable
+func restoreArchivedBlob(objHandle BlobObject, key string, timeout time.Duration, pollInterval time.Duration) error {
+	archivable, ok := objHandle.(ArchivableBlobObject)
+	if !ok {
+		return errors.Wrapf(ErrArchived, "%s: store does not support restore", key)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		restored, err := archivable.Restore()
+		if err != nil {
+			return errors.Wrapf(err, "restoreArchivedBlob: failed to restore %s", key)
+		}
+		if restored {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(ErrArchived, "%s: restore did not complete within %v", key, timeout)
+		}
+		log.Printf("Waiting for restore of archived %s\n", key)
+		time.Sleep(pollInterval)
+	}
 }
 
 func putStoredBlock(
@@ -221,87 +414,324 @@ func putStoredBlock(
 	storedBlock longtaillib.Longtail_StoredBlock) error {
 
 	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count], 1)
+	s.session.begin()
+	transferred := 0
+	defer func() { s.session.end(transferred) }()
+	atomic.AddInt64(&s.putsInFlight, 1)
+	defer atomic.AddInt64(&s.putsInFlight, -1)
+	startTime := time.Now()
 
 	blockIndex := storedBlock.GetBlockIndex()
 	blockHash := blockIndex.GetBlockHash()
-	key := GetBlockPath("chunks", blockHash)
+	key := s.layout.BlockPath("chunks", blockHash)
+	blockUsage, err := s.reserveQuota(blockIndex)
+	if err != nil {
+		log.Printf("Rejected block 0x%016x: %v\n", blockHash, err)
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
+		return err
+	}
+	queued := false
+	defer func() {
+		if !queued {
+			s.releaseQuota(blockUsage)
+		}
+	}()
 	objHandle, err := blobClient.NewObject(key)
 	if err != nil {
 		return err
 	}
-	if exists, err := objHandle.Exists(); err == nil && !exists {
-		blob, errno := longtaillib.WriteStoredBlockToBuffer(storedBlock)
+	exists := false
+	createOnlyObject, createOnly := objHandle.(createOnlyBlobObject)
+	createOnly = createOnly && s.options.ConditionalPuts
+	if s.options.ConditionalPuts && s.knownBlocks.contains(blockHash) {
+		exists = true
+	} else if !createOnly {
+		exists, _, err = existsWithRetry(ctx, s, objHandle, "putBlob", key)
+		if err != nil {
+			// The block may not be in the store, it can not be added to the store index
+			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
+			return errors.Wrapf(err, "putStoredBlock: %s", key)
+		}
+		if exists && s.options.Immutable {
+			err = verifyExistingStoredBlock(objHandle, key, blockIndex)
+			if err != nil {
+				atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
+				return err
+			}
+		}
+	}
+	if !exists {
+		buffer := getBlobBuffer()
+		defer buffer.release()
+		blob, errno := longtaillib.AppendStoredBlockToBuffer(buffer.data, storedBlock)
 		if errno != 0 {
-			return longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
+			return longtaillib.NewError(errno, "AppendStoredBlockToBuffer", key, s.blobStore.String())
 		}
-
-		ok, err := objHandle.Write(blob)
-		if err != nil || !ok {
-			log.Printf("Retrying putBlob %s in store %s\n", key, s.String())
-			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount], 1)
-			ok, err = objHandle.Write(blob)
+		buffer.data = blob
+
+		existed := false
+		write := objHandle.Write
+		if createOnly {
+			write = func(data []byte) (bool, error) {
+				ok, alreadyExists, err := createOnlyObject.WriteIfAbsent(data)
+				existed = alreadyExists
+				return ok, err
+			}
 		}
-		if err != nil || !ok {
-			log.Printf("Retrying 500 ms delayed putBlob %s in store %s\n", key, s.String())
-			time.Sleep(500 * time.Millisecond)
+		ok, err := write(blob)
+		retryCount := 0
+		for {
+			if IsImmutable(err) {
+				// Someone else stored the block since we checked, or a write that seemed to fail
+				// landed, accept it if it holds the same chunks
+				err = verifyExistingStoredBlock(objHandle, key, blockIndex)
+				if err != nil {
+					atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
+					return err
+				}
+				ok = true
+			}
+			if (err == nil && ok) || retryCount >= s.options.maxRetries() {
+				break
+			}
+			retryCount++
+			waitForRetry("putBlob", key, s, retryCount)
+			s.options.Hooks.retry(key, retryCount, err)
 			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount], 1)
-			ok, err = objHandle.Write(blob)
+			ok, err = write(blob)
 		}
-		if err != nil || !ok {
-			log.Printf("Retrying 2 s delayed putBlob %s in store %s\n", key, s.String())
-			time.Sleep(2 * time.Second)
-			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_RetryCount], 1)
-			ok, err = objHandle.Write(blob)
+		if err == nil && ok && existed && s.options.Immutable {
+			err = verifyExistingStoredBlock(objHandle, key, blockIndex)
+			if err != nil {
+				atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
+				return err
+			}
 		}
 
+		s.latencies.record(operation{name: OperationPutBlock, key: key, blockHash: blockHash, backend: s.blobStore.String(), size: len(blob), retryCount: retryCount, err: err}, time.Since(startTime))
+		if err == nil && ok {
+			s.bandwidth.add(s.blobStore.String(), len(blob), 0)
+		}
 		if err != nil || !ok {
 			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 1)
-			return longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
+			if err == nil {
+				return longtaillib.NewError(longtaillib.EIO, "PutStoredBlock", key, s.blobStore.String())
+			}
+			return errors.Wrapf(err, "putStoredBlock: %s", key)
 		}
 
-		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Byte_Count], (uint64)(len(blob)))
-		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Chunk_Count], (uint64)(blockIndex.GetChunkCount()))
+		transferred = len(blob)
+		if !existed {
+			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Byte_Count], (uint64)(len(blob)))
+			atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Chunk_Count], (uint64)(blockIndex.GetChunkCount()))
+			s.options.Hooks.blockUploaded(blockHash, len(blob), time.Since(startTime))
+		}
+	}
+	if s.options.ConditionalPuts {
+		s.knownBlocks.add(blockHash)
 	}
 
 	blockIndexCopy, err := blockIndex.Copy()
 	if err != nil {
 		return err
 	}
-	blockIndexMessages <- blockIndexMessage{blockIndex: blockIndexCopy}
+	queued = true
+	// Block index updates always wait for room, dropping them would leave the block out of the store index
+	select {
+	case blockIndexMessages <- blockIndexMessage{blockIndex: blockIndexCopy}:
+	default:
+		wait := s.blockIndexQueue.full(0)
+		blockIndexMessages <- blockIndexMessage{blockIndex: blockIndexCopy}
+		wait.done(false)
+	}
+	return nil
+}
+
+// verifyExistingStoredBlock checks that a block already in an immutable store holds the same chunks as the one we are putting
+func verifyExistingStoredBlock(objHandle BlobObject, key string, blockIndex longtaillib.Longtail_BlockIndex) error {
+	storedBlockData, err := objHandle.Read()
+	if err != nil {
+		return err
+	}
+	existingBlock, errno := longtaillib.ReadStoredBlockFromBuffer(storedBlockData)
+	if errno != 0 {
+		return &BlockCorruptError{BlockHash: blockIndex.GetBlockHash(), Path: key, Reason: longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)}
+	}
+	defer existingBlock.Dispose()
+	existingBlockIndex := existingBlock.GetBlockIndex()
+	existingChunkHashes := existingBlockIndex.GetChunkHashes()
+	chunkHashes := blockIndex.GetChunkHashes()
+	if existingBlockIndex.GetBlockHash() != blockIndex.GetBlockHash() || len(existingChunkHashes) != len(chunkHashes) {
+		return errors.Wrapf(ErrImmutable, "%s: existing block does not match", key)
+	}
+	for i, chunkHash := range chunkHashes {
+		if existingChunkHashes[i] != chunkHash {
+			return errors.Wrapf(ErrImmutable, "%s: existing block does not match", key)
+		}
+	}
 	return nil
 }
 
+// fetchedBlock is the blob of a block read from the store that has not been decoded yet
+type fetchedBlock struct {
+	blockHash  uint64
+	key        string
+	data       []byte
+	buffer     *blobBuffer
+	size       int
+	sourceName string
+	primaryBad bool
+	startTime  time.Time
+}
+
 func getStoredBlock(
 	ctx context.Context,
 	s *remoteStore,
 	blobClient BlobClient,
 	blockHash uint64) (longtaillib.Longtail_StoredBlock, error) {
+	fetched, err := readStoredBlock(ctx, s, blobClient, blockHash)
+	if err != nil {
+		return longtaillib.Longtail_StoredBlock{}, err
+	}
+	return decodeFetchedBlock(ctx, s, blobClient, fetched)
+}
+
+// readStoredBlock reads the blob of a block, the blob is decoded with decodeFetchedBlock
+func readStoredBlock(
+	ctx context.Context,
+	s *remoteStore,
+	blobClient BlobClient,
+	blockHash uint64) (fetchedBlock, error) {
 
 	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Count], 1)
+	s.session.begin()
+	transferred := 0
+	defer func() { s.session.end(transferred) }()
+	atomic.AddInt64(&s.getsInFlight, 1)
+	defer atomic.AddInt64(&s.getsInFlight, -1)
+	startTime := time.Now()
+
+	key := s.layout.BlockPath("chunks", blockHash)
+
+	// The native block store copies the data when the block is decoded, the buffer is released after that
+	buffer := getBlobBuffer()
+	buffer.fileThreshold = s.options.BlockFileThreshold
+	buffer.fileDir = s.options.BlockFilePath
+	storedBlockData, retryCount, sourceName, primaryBad, err := readBlockBlob(ctx, s, blobClient, key, buffer)
+	size := len(storedBlockData)
+	if buffer.path != "" {
+		size = int(buffer.size)
+	}
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_RetryCount], uint64(retryCount))
+	s.latencies.record(operation{name: OperationGetBlock, key: key, blockHash: blockHash, backend: sourceName, size: size, retryCount: retryCount, err: err}, time.Since(startTime))
+	if err == nil {
+		s.bandwidth.add(sourceName, 0, size)
+	}
 
-	key := GetBlockPath("chunks", blockHash)
+	if err != nil || (storedBlockData == nil && buffer.path == "") {
+		buffer.release()
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_FailCount], 1)
+		if IsChecksumMismatch(err) {
+			corruptErr := &BlockCorruptError{BlockHash: blockHash, Path: key, Reason: err}
+			log.Printf("%v\n", corruptErr)
+			return fetchedBlock{}, corruptErr
+		}
+		if IsArchived(err) {
+			archivedErr := &BlockArchivedError{BlockHash: blockHash, Path: key, Reason: err}
+			log.Printf("%v\n", archivedErr)
+			return fetchedBlock{}, archivedErr
+		}
+		return fetchedBlock{}, err
+	}
+	transferred = size
+	return fetchedBlock{
+		blockHash:  blockHash,
+		key:        key,
+		data:       storedBlockData,
+		buffer:     buffer,
+		size:       size,
+		sourceName: sourceName,
+		primaryBad: primaryBad,
+		startTime:  startTime}, nil
+}
 
-	storedBlockData, retryCount, err := readBlobWithRetry(ctx, s, blobClient, key)
-	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_RetryCount], uint64(retryCount))
+// decodeFetchedBlock decodes the blob read by readStoredBlock and releases its buffer
+func decodeFetchedBlock(
+	ctx context.Context,
+	s *remoteStore,
+	blobClient BlobClient,
+	fetched fetchedBlock) (longtaillib.Longtail_StoredBlock, error) {
+	defer fetched.buffer.release()
+	blockHash, key, storedBlockData, size, sourceName, primaryBad := fetched.blockHash, fetched.key, fetched.data, fetched.size, fetched.sourceName, fetched.primaryBad
 
-	if err != nil || storedBlockData == nil {
+	var storedBlock longtaillib.Longtail_StoredBlock
+	var err error
+	if fetched.buffer.path != "" {
+		storedBlock, err = decodeStoredBlockFile(blockHash, key, fetched.buffer.path)
+	} else {
+		storedBlock, err = decodeStoredBlock(blockHash, key, storedBlockData)
+	}
+	if err != nil && s.blockSources != nil && sourceName == s.blobStore.String() {
+		log.Printf("Failed to read block 0x%016x at `%s` from %s, reading it from a mirror: %v\n", blockHash, key, sourceName, err)
+		mirrorBlock, mirrorBlockData, mirrorName, mirrorErr := readMirrorStoredBlock(ctx, s, key, blockHash)
+		if mirrorErr == nil {
+			storedBlock, storedBlockData, size, sourceName, primaryBad, err = mirrorBlock, mirrorBlockData, len(mirrorBlockData), mirrorName, true, nil
+		}
+	}
+	if err != nil {
 		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_FailCount], 1)
+		if _, ok := err.(*BlockCorruptError); ok {
+			log.Printf("%v\n", err)
+		}
 		return longtaillib.Longtail_StoredBlock{}, err
 	}
 
-	storedBlock, errno := longtaillib.ReadStoredBlockFromBuffer(storedBlockData)
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Byte_Count], (uint64)(size))
+	blockIndex := storedBlock.GetBlockIndex()
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Chunk_Count], (uint64)(blockIndex.GetChunkCount()))
+	if primaryBad && sourceName != s.blobStore.String() && s.options.RepairFromMirrors {
+		if storedBlockData == nil {
+			storedBlockData, err = ioutil.ReadFile(fetched.buffer.path)
+		}
+		if err == nil {
+			repairBlockFromMirror(s, blobClient, key, blockHash, storedBlockData, sourceName)
+		} else {
+			log.Printf("WARNING: Failed to repair block 0x%016x at `%s` from %s: %v\n", blockHash, key, sourceName, err)
+		}
+	}
+	s.options.Hooks.blockDownloaded(blockHash, size, time.Since(fetched.startTime))
+	return storedBlock, nil
+}
+
+// decodeStoredBlock reads a block as written by the remote block store and checks that it is the
+// block with blockHash
+func decodeStoredBlock(blockHash uint64, key string, blob []byte) (longtaillib.Longtail_StoredBlock, error) {
+	storedBlock, errno := longtaillib.ReadStoredBlockFromBuffer(blob)
 	if errno != 0 {
-		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_FailCount], 1)
-		return longtaillib.Longtail_StoredBlock{}, longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
+		return longtaillib.Longtail_StoredBlock{}, longtaillib.NewError(errno, "ReadStoredBlockFromBuffer", key, "")
+	}
+	blockIndex := storedBlock.GetBlockIndex()
+	if blockIndex.GetBlockHash() != blockHash {
+		storedBlock.Dispose()
+		return longtaillib.Longtail_StoredBlock{}, &BlockCorruptError{BlockHash: blockHash, Path: key, Reason: fmt.Errorf("content has block hash 0x%016x", blockIndex.GetBlockHash())}
 	}
+	return storedBlock, nil
+}
 
-	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Byte_Count], (uint64)(len(storedBlockData)))
+// decodeStoredBlockFile reads a block that was streamed to the temp file at path and checks that
+// it is the block with blockHash
+func decodeStoredBlockFile(blockHash uint64, key string, path string) (longtaillib.Longtail_StoredBlock, error) {
+	storageAPI := longtaillib.CreateFSStorageAPI()
+	defer storageAPI.Dispose()
+	storedBlock, errno := longtaillib.ReadStoredBlock(storageAPI, filepath.ToSlash(path))
+	if errno != 0 {
+		return longtaillib.Longtail_StoredBlock{}, longtaillib.NewError(errno, "ReadStoredBlock", key, "")
+	}
 	blockIndex := storedBlock.GetBlockIndex()
 	if blockIndex.GetBlockHash() != blockHash {
-		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_FailCount], 1)
-		return longtaillib.Longtail_StoredBlock{}, longtaillib.ErrnoToError(longtaillib.EBADF, longtaillib.ErrEBADF)
+		storedBlock.Dispose()
+		return longtaillib.Longtail_StoredBlock{}, &BlockCorruptError{BlockHash: blockHash, Path: key, Reason: fmt.Errorf("content has block hash 0x%016x", blockIndex.GetBlockHash())}
 	}
-	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Chunk_Count], (uint64)(blockIndex.GetChunkCount()))
 	return storedBlock, nil
 }
 
@@ -310,54 +740,38 @@ func fetchBlock(
 	s *remoteStore,
 	client BlobClient,
 	getMsg getBlockMessage) {
+	s.advancePrefetchWindow(getMsg.blockHash)
 	s.fetchedBlocksSync.Lock()
 	prefetchedBlock := s.prefetchBlocks[getMsg.blockHash]
 	if prefetchedBlock != nil {
 		storedBlock := prefetchedBlock.storedBlock
 		if storedBlock.IsValid() {
 			s.prefetchBlocks[getMsg.blockHash] = nil
-			blockSize := -int64(storedBlock.GetBlockSize())
-			atomic.AddInt64(&s.prefetchMemory, blockSize)
+			s.addPrefetchMemory(-int64(storedBlock.GetBlockSize()))
 			s.fetchedBlocksSync.Unlock()
+			atomic.AddUint64(&s.downloadOrder.ready, 1)
 			getMsg.asyncCompleteAPI.OnComplete(storedBlock, 0)
 			return
 		}
+		// The block is being fetched already, wait for it
+		if !prefetchedBlock.requested {
+			atomic.AddUint64(&s.downloadOrder.late, 1)
+		}
+		s.fetchDedup.joined(prefetchedBlock)
 		prefetchedBlock.completeCallbacks = append(prefetchedBlock.completeCallbacks, getMsg.asyncCompleteAPI)
+		blockFile := prefetchedBlock.blockFile
+		prefetchedBlock.blockFile = nil
 		s.fetchedBlocksSync.Unlock()
+		if blockFile != nil {
+			decodeAndCompleteBlock(ctx, s, client, *blockFile, prefetchedBlock)
+		}
 		return
 	}
-	prefetchedBlock = &pendingPrefetchedBlock{storedBlock: longtaillib.Longtail_StoredBlock{}}
+	atomic.AddUint64(&s.downloadOrder.missed, 1)
+	prefetchedBlock = &pendingPrefetchedBlock{completeCallbacks: []longtaillib.Longtail_AsyncGetStoredBlockAPI{getMsg.asyncCompleteAPI}, requested: true}
 	s.prefetchBlocks[getMsg.blockHash] = prefetchedBlock
 	s.fetchedBlocksSync.Unlock()
-	storedBlock, getStoredBlockErr := getStoredBlock(ctx, s, client, getMsg.blockHash)
-	s.fetchedBlocksSync.Lock()
-	prefetchedBlock, exists := s.prefetchBlocks[getMsg.blockHash]
-	if exists && prefetchedBlock == nil {
-		storedBlock.Dispose()
-		s.fetchedBlocksSync.Unlock()
-		return
-	}
-	completeCallbacks := prefetchedBlock.completeCallbacks
-	s.prefetchBlocks[getMsg.blockHash] = nil
-	s.fetchedBlocksSync.Unlock()
-	for _, c := range completeCallbacks {
-		if getStoredBlockErr != nil {
-			c.OnComplete(longtaillib.Longtail_StoredBlock{}, longtaillib.ErrorToErrno(getStoredBlockErr, longtaillib.EIO))
-			continue
-		}
-		buf, errno := longtaillib.WriteStoredBlockToBuffer(storedBlock)
-		if errno != 0 {
-			c.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
-			continue
-		}
-		blockCopy, errno := longtaillib.ReadStoredBlockFromBuffer(buf)
-		if errno != 0 {
-			c.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
-			continue
-		}
-		c.OnComplete(blockCopy, 0)
-	}
-	getMsg.asyncCompleteAPI.OnComplete(storedBlock, longtaillib.ErrorToErrno(getStoredBlockErr, longtaillib.EIO))
+	fetchAndCompleteBlock(ctx, s, client, getMsg.blockHash, prefetchedBlock)
 }
 
 func prefetchBlock(
@@ -368,63 +782,134 @@ func prefetchBlock(
 	s.fetchedBlocksSync.Lock()
 	_, exists := s.prefetchBlocks[prefetchMsg.blockHash]
 	if exists {
-		// Already pre-fetched
+		// Already fetched, being fetched or read
 		s.fetchedBlocksSync.Unlock()
+		s.fetchDedup.skippedPrefetch()
 		return
 	}
-	prefetchedBlock := &pendingPrefetchedBlock{storedBlock: longtaillib.Longtail_StoredBlock{}}
+	prefetchedBlock := &pendingPrefetchedBlock{}
 	s.prefetchBlocks[prefetchMsg.blockHash] = prefetchedBlock
 	s.fetchedBlocksSync.Unlock()
+	fetchAndCompleteBlock(ctx, s, client, prefetchMsg.blockHash, prefetchedBlock)
+}
 
-	storedBlock, getErr := getStoredBlock(ctx, s, client, prefetchMsg.blockHash)
-	if getErr != nil {
+// fetchAndCompleteBlock reads a block and hands it to the decode workers, or decodes it right away
+// if the store has none, to complete the requests for it
+func fetchAndCompleteBlock(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	blockHash uint64,
+	prefetchedBlock *pendingPrefetchedBlock) {
+	fetched, err := readStoredBlock(ctx, s, client, blockHash)
+	if err != nil {
+		completeFetchedBlock(s, blockHash, prefetchedBlock, longtaillib.Longtail_StoredBlock{}, err)
 		return
 	}
+	decodeAndCompleteBlock(ctx, s, client, fetched, prefetchedBlock)
+}
 
-	s.fetchedBlocksSync.Lock()
-
-	prefetchedBlock, exists = s.prefetchBlocks[prefetchMsg.blockHash]
-	if prefetchedBlock == nil {
-		storedBlock.Dispose()
-		s.fetchedBlocksSync.Unlock()
+// decodeAndCompleteBlock hands a fetched block to the decode workers, or decodes it right away if
+// the store has none
+func decodeAndCompleteBlock(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	fetched fetchedBlock,
+	prefetchedBlock *pendingPrefetchedBlock) {
+	if s.decodeBlockChan != nil {
+		queueDecode(s, decodeBlockMessage{fetched: fetched, prefetchedBlock: prefetchedBlock})
 		return
 	}
-	completeCallbacks := prefetchedBlock.completeCallbacks
-	if len(completeCallbacks) == 0 {
-		// Nobody is actively waiting for the block
-		blockSize := int64(storedBlock.GetBlockSize())
-		prefetchedBlock.storedBlock = storedBlock
-		atomic.AddInt64(&s.prefetchMemory, blockSize)
+	completeFetchedBlob(ctx, s, client, fetched, prefetchedBlock)
+}
+
+// completeFetchedBlob decodes a fetched block and completes the requests for it. A prefetched
+// block in a temp file that nobody waits for is kept in the file until it is requested.
+func completeFetchedBlob(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient,
+	fetched fetchedBlock,
+	prefetchedBlock *pendingPrefetchedBlock) {
+	if fetched.buffer.path != "" {
+		s.fetchedBlocksSync.Lock()
+		if s.prefetchBlocks[fetched.blockHash] == prefetchedBlock && len(prefetchedBlock.completeCallbacks) == 0 {
+			prefetchedBlock.blockFile = &fetched
+			s.fetchedBlocksSync.Unlock()
+			return
+		}
 		s.fetchedBlocksSync.Unlock()
-		return
 	}
-	s.prefetchBlocks[prefetchMsg.blockHash] = nil
-	s.fetchedBlocksSync.Unlock()
-	for i := 1; i < len(completeCallbacks)-1; i++ {
-		c := completeCallbacks[i]
+	storedBlock, err := decodeFetchedBlock(ctx, s, client, fetched)
+	completeFetchedBlock(s, fetched.blockHash, prefetchedBlock, storedBlock, err)
+}
+
+// completeFetchedBlock hands the result of fetching a block to the get requests that waited for it.
+// A successfully fetched block that nobody waits for is kept as prefetched unless the prefetched blocks
+// were flushed while it was fetched. A failed block is forgotten so it is fetched again if requested.
+func completeFetchedBlock(
+	s *remoteStore,
+	blockHash uint64,
+	prefetchedBlock *pendingPrefetchedBlock,
+	storedBlock longtaillib.Longtail_StoredBlock,
+	getErr error) {
+	s.fetchedBlocksSync.Lock()
+	waiters := prefetchedBlock.completeCallbacks
+	prefetchedBlock.completeCallbacks = nil
+	if s.prefetchBlocks[blockHash] == prefetchedBlock {
 		if getErr != nil {
-			c.OnComplete(longtaillib.Longtail_StoredBlock{}, longtaillib.ErrorToErrno(getErr, longtaillib.EIO))
-			continue
+			delete(s.prefetchBlocks, blockHash)
+		} else if len(waiters) == 0 {
+			// Nobody is actively waiting for the block
+			prefetchedBlock.storedBlock = storedBlock
+			s.addPrefetchMemory(int64(storedBlock.GetBlockSize()))
+			s.fetchedBlocksSync.Unlock()
+			return
+		} else {
+			s.prefetchBlocks[blockHash] = nil
 		}
-		buf, errno := longtaillib.WriteStoredBlockToBuffer(storedBlock)
-		if errno != 0 {
-			c.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
-			continue
+	}
+	s.fetchedBlocksSync.Unlock()
+	completeWaiters(waiters, storedBlock, getErr)
+}
+
+// completeWaiters hands storedBlock to all waiters in the order they requested it, or getErr if the
+// block could not be fetched. The waiters get references to the same block instead of copies and each
+// of them disposes its own. The block is disposed if there are no waiters.
+func completeWaiters(
+	waiters []longtaillib.Longtail_AsyncGetStoredBlockAPI,
+	storedBlock longtaillib.Longtail_StoredBlock,
+	getErr error) {
+	if len(waiters) == 0 {
+		storedBlock.Dispose()
+		return
+	}
+	if getErr != nil || len(waiters) == 1 {
+		errno := longtaillib.ErrorToErrno(getErr, longtaillib.EIO)
+		for _, c := range waiters {
+			c.OnComplete(storedBlock, errno)
 		}
-		blockCopy, errno := longtaillib.ReadStoredBlockFromBuffer(buf)
-		if errno != 0 {
+		return
+	}
+	refs, errno := longtaillib.ShareStoredBlock(storedBlock, len(waiters))
+	if errno != 0 {
+		storedBlock.Dispose()
+		for _, c := range waiters {
 			c.OnComplete(longtaillib.Longtail_StoredBlock{}, errno)
-			continue
 		}
-		c.OnComplete(blockCopy, 0)
+		return
+	}
+	for i, c := range waiters {
+		c.OnComplete(refs[i], 0)
 	}
-	completeCallbacks[0].OnComplete(storedBlock, longtaillib.ErrorToErrno(getErr, longtaillib.EIO))
 }
 
 func flushPrefetch(
 	s *remoteStore,
 	prefetchBlockChan <-chan prefetchBlockMessage) {
 
+	s.prefetchWindow.clear()
 L:
 	for {
 		select {
@@ -438,7 +923,7 @@ L:
 	flushBlocks := []uint64{}
 	for k, v := range s.prefetchBlocks {
 		if v != nil && len(v.completeCallbacks) > 0 {
-			fmt.Printf("Somebody is still waiting for prefetch %d\n", k)
+			// The fetch of the block completes the waiting get requests
 			continue
 		}
 		flushBlocks = append(flushBlocks, k)
@@ -446,9 +931,12 @@ L:
 	for _, h := range flushBlocks {
 		b := s.prefetchBlocks[h]
 		if b != nil {
+			if b.blockFile != nil {
+				b.blockFile.buffer.release()
+				b.blockFile = nil
+			}
 			if b.storedBlock.IsValid() {
-				blockSize := -int64(b.storedBlock.GetBlockSize())
-				atomic.AddInt64(&s.prefetchMemory, blockSize)
+				s.addPrefetchMemory(-int64(b.storedBlock.GetBlockSize()))
 				b.storedBlock.Dispose()
 			}
 		}
@@ -457,21 +945,87 @@ L:
 	s.fetchedBlocksSync.Unlock()
 }
 
+// remoteWorker handles the block requests of a worker pool. Upload workers get nil get and
+// prefetch channels and download workers a nil put channel, download workers stop when stop is
+// closed and the other workers when the put channel is closed.
 func remoteWorker(
 	ctx context.Context,
 	s *remoteStore,
+	pool *workerPool,
 	putBlockMessages <-chan putBlockMessage,
 	getBlockMessages <-chan getBlockMessage,
 	prefetchBlockChan <-chan prefetchBlockMessage,
 	blockIndexMessages chan<- blockIndexMessage,
-	flushMessages <-chan int,
-	flushReplyMessages chan<- int,
+	stop <-chan struct{},
 	accessType AccessType) error {
 	client, err := s.blobStore.NewClient(ctx)
 	if err != nil {
 		return errors.Wrap(err, s.blobStore.String())
 	}
-	defer client.Close()
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+	idle := newIdleTimer(s.options.IdleTimeout)
+	defer idle.stop()
+	// wake restarts the idle timer and creates the blob client again if the worker hibernated
+	wake := func() error {
+		if idle.active() {
+			s.hibernation.woke()
+			s.hibernation.blockWorkerWoke()
+		}
+		if client != nil {
+			return nil
+		}
+		client, err = s.blobStore.NewClient(ctx)
+		return errors.Wrap(err, s.blobStore.String())
+	}
+	hibernate := func() {
+		idle.hibernate()
+		s.hibernation.hibernated()
+		if client != nil {
+			client.Close()
+			client = nil
+		}
+		// The prefetched blocks are shared by all pools, they are only released once the whole
+		// store is idle so an idle upload worker does not drop the prefetches of a restore
+		if s.hibernation.blockWorkerHibernated() == int64(s.blockWorkerCount()) {
+			flushPrefetch(s, s.prefetchBlockChan)
+		}
+	}
+	put := func(putMsg putBlockMessage) {
+		pool.begin()
+		defer pool.end()
+		defer s.memory.add(memoryPuts, -putMsg.memory)
+		if accessType == ReadOnly {
+			putMsg.asyncCompleteAPI.OnComplete(longtaillib.EACCES)
+			return
+		}
+		err := wake()
+		if err == nil {
+			err = putStoredBlock(ctx, s, client, blockIndexMessages, putMsg.storedBlock)
+		}
+		putMsg.asyncCompleteAPI.OnComplete(longtaillib.ErrorToErrno(err, longtaillib.EIO))
+	}
+	get := func(getMsg getBlockMessage) {
+		pool.begin()
+		defer pool.end()
+		if err := wake(); err != nil {
+			getMsg.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoredBlock{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
+			return
+		}
+		fetchBlock(ctx, s, client, getMsg)
+	}
+	prefetch := func(prefetchMsg prefetchBlockMessage) {
+		pool.begin()
+		defer pool.end()
+		if err := wake(); err != nil {
+			// Prefetches are hints, the block is fetched when it is requested
+			return
+		}
+		prefetchBlock(ctx, s, client, prefetchMsg)
+	}
 	run := true
 	for run {
 		received := 0
@@ -479,60 +1033,53 @@ func remoteWorker(
 		case putMsg, more := <-putBlockMessages:
 			if more {
 				received++
-				if accessType == ReadOnly {
-					putMsg.asyncCompleteAPI.OnComplete(longtaillib.EACCES)
-					continue
-				}
-				err := putStoredBlock(ctx, s, client, blockIndexMessages, putMsg.storedBlock)
-				putMsg.asyncCompleteAPI.OnComplete(longtaillib.ErrorToErrno(err, longtaillib.EIO))
+				put(putMsg)
 			} else {
 				run = false
 			}
 		case getMsg := <-getBlockMessages:
 			received++
-			fetchBlock(ctx, s, client, getMsg)
+			get(getMsg)
 		default:
 		}
-		if received == 0 {
-			if s.prefetchMemory < s.maxPrefetchMemory {
+		if received == 0 && run {
+			if s.canPrefetch() {
 				select {
-				case <-flushMessages:
+				case <-pool.flushChan:
 					flushPrefetch(s, prefetchBlockChan)
-					flushReplyMessages <- 0
+					pool.flushReplyChan <- 0
 				case putMsg, more := <-putBlockMessages:
 					if more {
-						if accessType == ReadOnly {
-							putMsg.asyncCompleteAPI.OnComplete(longtaillib.EACCES)
-							continue
-						}
-						err := putStoredBlock(ctx, s, client, blockIndexMessages, putMsg.storedBlock)
-						putMsg.asyncCompleteAPI.OnComplete(longtaillib.ErrorToErrno(err, longtaillib.EIO))
+						put(putMsg)
 					} else {
 						run = false
 					}
 				case getMsg := <-getBlockMessages:
-					fetchBlock(ctx, s, client, getMsg)
+					get(getMsg)
 				case prefetchMsg := <-prefetchBlockChan:
-					prefetchBlock(ctx, s, client, prefetchMsg)
+					prefetch(prefetchMsg)
+				case <-idle.C():
+					hibernate()
+				case <-stop:
+					run = false
 				}
 			} else {
 				select {
-				case <-flushMessages:
+				case <-pool.flushChan:
 					flushPrefetch(s, prefetchBlockChan)
-					flushReplyMessages <- 0
+					pool.flushReplyChan <- 0
 				case putMsg, more := <-putBlockMessages:
 					if more {
-						if accessType == ReadOnly {
-							putMsg.asyncCompleteAPI.OnComplete(longtaillib.EACCES)
-							continue
-						}
-						err := putStoredBlock(ctx, s, client, blockIndexMessages, putMsg.storedBlock)
-						putMsg.asyncCompleteAPI.OnComplete(longtaillib.ErrorToErrno(err, longtaillib.EIO))
+						put(putMsg)
 					} else {
 						run = false
 					}
 				case getMsg := <-getBlockMessages:
-					fetchBlock(ctx, s, client, getMsg)
+					get(getMsg)
+				case <-idle.C():
+					hibernate()
+				case <-stop:
+					run = false
 				}
 			}
 		}
@@ -544,8 +1091,10 @@ func remoteWorker(
 
 func tryUpdateRemoteStoreIndex(
 	ctx context.Context,
+	store string,
 	updatedStoreIndex longtaillib.Longtail_StoreIndex,
-	objHandle BlobObject) (bool, longtaillib.Longtail_StoreIndex, error) {
+	objHandle BlobObject,
+	hooks *StoreHooks) (bool, longtaillib.Longtail_StoreIndex, error) {
 
 	exists, err := objHandle.LockWriteVersion()
 	if err != nil {
@@ -556,10 +1105,11 @@ func tryUpdateRemoteStoreIndex(
 		if err != nil {
 			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: objHandle.Read() failed")
 		}
+		hooks.indexTransferred(0, len(blob))
 
-		remoteStoreIndex, errno := longtaillib.ReadStoreIndexFromBuffer(blob)
-		if errno != 0 {
-			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "updateRemoteStoreIndex: longtaillib.ReadStoreIndexFromBuffer() failed")
+		remoteStoreIndex, err := readStoreIndexData(store, "store.lsi", blob)
+		if err != nil {
+			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrap(err, "updateRemoteStoreIndex")
 		}
 		defer remoteStoreIndex.Dispose()
 
@@ -568,10 +1118,10 @@ func tryUpdateRemoteStoreIndex(
 			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "updateRemoteStoreIndex: longtaillib.MergeStoreIndex() failed")
 		}
 
-		storeBlob, errno := longtaillib.WriteStoreIndexToBuffer(newStoreIndex)
-		if errno != 0 {
+		storeBlob, err := writeStoreIndexData(newStoreIndex)
+		if err != nil {
 			newStoreIndex.Dispose()
-			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "updateRemoteStoreIndex: longtaillib.WriteStoreIndexToBuffer() kfailed")
+			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrap(err, "updateRemoteStoreIndex: writeStoreIndexData() failed")
 		}
 
 		ok, err := objHandle.Write(storeBlob)
@@ -579,48 +1129,59 @@ func tryUpdateRemoteStoreIndex(
 			newStoreIndex.Dispose()
 			return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: objHandle.Write() failed")
 		}
+		hooks.indexTransferred(len(storeBlob), 0)
 		if !ok {
 			newStoreIndex.Dispose()
 			return false, longtaillib.Longtail_StoreIndex{}, nil
 		}
 		return ok, newStoreIndex, nil
 	}
-	storeBlob, errno := longtaillib.WriteStoreIndexToBuffer(updatedStoreIndex)
-	if errno != 0 {
-		return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "updateRemoteStoreIndex: WriteStoreIndexToBuffer() failed")
+	storeBlob, err := writeStoreIndexData(updatedStoreIndex)
+	if err != nil {
+		return false, longtaillib.Longtail_StoreIndex{}, errors.Wrap(err, "updateRemoteStoreIndex: writeStoreIndexData() failed")
 	}
 
 	ok, err := objHandle.Write(storeBlob)
 	if err != nil {
 		return false, longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: objHandle.Write() failed")
 	}
+	hooks.indexTransferred(len(storeBlob), 0)
 	return ok, longtaillib.Longtail_StoreIndex{}, nil
 }
 
 func updateRemoteStoreIndex(
 	ctx context.Context,
 	blobClient BlobClient,
-	updatedStoreIndex longtaillib.Longtail_StoreIndex) (longtaillib.Longtail_StoreIndex, error) {
+	updatedStoreIndex longtaillib.Longtail_StoreIndex,
+	hooks *StoreHooks) (longtaillib.Longtail_StoreIndex, error) {
 
 	key := "store.lsi"
 	objHandle, err := blobClient.NewObject(key)
 	if err != nil {
 		return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: blobClient.NewObject(%s) failed", key)
 	}
-	for {
+	startTime := time.Now()
+	for attempt := 1; ; attempt++ {
 		ok, newStoreIndex, err := tryUpdateRemoteStoreIndex(
 			ctx,
+			blobClient.String(),
 			updatedStoreIndex,
-			objHandle)
+			objHandle,
+			hooks)
 		if ok {
+			writtenStoreIndex := newStoreIndex
+			if !writtenStoreIndex.IsValid() {
+				writtenStoreIndex = updatedStoreIndex
+			}
+			hooks.indexUpdated(len(writtenStoreIndex.GetBlockHashes()), time.Since(startTime))
 			return newStoreIndex, nil
 		}
 		if err != nil {
 			return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(err, "updateRemoteStoreIndex: tryUpdateRemoteStoreIndex(%s) failed", key)
 		}
 		log.Printf("Retrying updating remote store index %s\n", key)
+		hooks.retry(key, attempt, nil)
 	}
-	return longtaillib.Longtail_StoreIndex{}, nil
 }
 
 func getStoreIndexFromBlocks(
@@ -667,7 +1228,8 @@ func getStoreIndexFromBlocks(
 					ctx,
 					s,
 					client,
-					blockKey)
+					blockKey,
+					nil)
 
 				if err != nil {
 					wg.Done()
@@ -680,7 +1242,7 @@ func getStoreIndexFromBlocks(
 					return
 				}
 
-				blockPath := GetBlockPath("chunks", blockIndex.GetBlockHash())
+				blockPath := s.layout.BlockPath("chunks", blockIndex.GetBlockHash())
 				if blockPath == blockKey {
 					batchBlockIndexes[batchPos] = blockIndex
 				} else {
@@ -737,25 +1299,20 @@ func buildStoreIndexFromStoreBlocks(
 	s *remoteStore,
 	blobClient BlobClient) (longtaillib.Longtail_StoreIndex, error) {
 
-	var items []string
-	blobs, err := blobClient.GetObjects()
+	items, err := listStoreBlocks(ctx, s.blobStore, blobClient, s.layout, s.workerCount)
 	if err != nil {
 		return longtaillib.Longtail_StoreIndex{}, err
 	}
-
-	for _, blob := range blobs {
-		if blob.Size == 0 {
-			continue
-		}
-		if strings.HasSuffix(blob.Name, ".lsb") {
-			items = append(items, blob.Name)
-		}
+	items, err = appendPackedBlockKeys(blobClient, s.layout, items)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, err
 	}
 
 	return getStoreIndexFromBlocks(ctx, s, blobClient, items)
 }
 
 func storeIndexWorkerReplyErrorState(
+	preflightGetMessages <-chan preflightGetMessage,
 	blockIndexMessages <-chan blockIndexMessage,
 	getExistingContentMessages <-chan getExistingContentMessage,
 	flushMessages <-chan int,
@@ -770,6 +1327,12 @@ func storeIndexWorkerReplyErrorState(
 			}
 		case getExistingContentMessage := <-getExistingContentMessages:
 			getExistingContentMessage.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, longtaillib.EINVAL)
+		case preflightGetMsg := <-preflightGetMessages:
+			if preflightGetMsg.missingBlocksReply != nil {
+				preflightGetMsg.missingBlocksReply <- preflightReply{err: longtaillib.ErrEINVAL}
+				continue
+			}
+			preflightGetMsg.asyncCompleteAPI.OnComplete([]uint64{}, longtaillib.EINVAL)
 		}
 	}
 }
@@ -778,32 +1341,91 @@ func readStoreStoreIndex(
 	ctx context.Context,
 	s *remoteStore,
 	client BlobClient) (longtaillib.Longtail_StoreIndex, error) {
+	storeIndex, _, err := readStoreStoreIndexBlob(ctx, s, client)
+	return storeIndex, err
+}
+
+// readStoreStoreIndexBlob reads the store index and also returns the serialized store index
+func readStoreStoreIndexBlob(
+	ctx context.Context,
+	s *remoteStore,
+	client BlobClient) (longtaillib.Longtail_StoreIndex, []byte, error) {
 
 	key := "store.lsi"
-	blobData, _, err := readBlobWithRetry(ctx, s, client, key)
+	startTime := time.Now()
+	blobData, retryCount, err := readBlobWithRetry(ctx, s, client, key, nil)
+	s.latencies.record(operation{name: OperationGetIndex, key: key, backend: s.blobStore.String(), size: len(blobData), retryCount: retryCount, err: err}, time.Since(startTime))
+	s.bandwidth.add(s.blobStore.String(), 0, len(blobData))
 	if err != nil {
-		return longtaillib.Longtail_StoreIndex{}, err
+		return longtaillib.Longtail_StoreIndex{}, nil, err
 	}
 	if blobData == nil {
-		return longtaillib.Longtail_StoreIndex{}, nil
+		return longtaillib.Longtail_StoreIndex{}, nil, nil
 	}
-	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(blobData)
-	if errno != 0 {
-		return longtaillib.Longtail_StoreIndex{}, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "contentIndexWorker: longtaillib.ReadStoreIndexFromBuffer() for %s", key)
+	storeIndex, err := readStoreIndexData(s.blobStore.String(), key, blobData)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, nil, errors.Wrap(err, "readStoreStoreIndexBlob")
+	}
+	return storeIndex, blobData, nil
+}
+
+// queuePrefetch queues a prefetch from the content index worker, with a queue timeout a prefetch
+// that does not fit in the queue in time is dropped as the block is fetched when it is read
+func queuePrefetch(s *remoteStore, prefetchBlockMessages chan<- prefetchBlockMessage, message prefetchBlockMessage) {
+	select {
+	case prefetchBlockMessages <- message:
+		return
+	default:
+	}
+	wait := s.prefetchQueue.full(s.options.QueueTimeout)
+	select {
+	case prefetchBlockMessages <- message:
+		wait.done(false)
+	case <-wait.timeout:
+		wait.done(true)
 	}
-	return storeIndex, nil
 }
 
+// onPreflighMessage prefetches the requested blocks that are in the store index, in the order of
+// HintDownloadOrder if the restore gave one and as far ahead as the prefetch window lets it. Blocks that are not in the store index would fail
+// when they are read so the preflight fails with ENOENT
 func onPreflighMessage(
 	s *remoteStore,
 	storeIndex longtaillib.Longtail_StoreIndex,
 	message preflightGetMessage,
 	prefetchBlockMessages chan<- prefetchBlockMessage) {
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PreflightGet_Count], 1)
 
+	indexedBlocks := map[uint64]bool{}
+	if storeIndex.IsValid() {
+		for _, blockHash := range storeIndex.GetBlockHashes() {
+			indexedBlocks[blockHash] = true
+		}
+	}
+	existingBlockHashes := []uint64{}
+	missingBlockHashes := []uint64{}
 	for _, blockHash := range message.blockHashes {
-		prefetchBlockMessages <- prefetchBlockMessage{blockHash: blockHash}
+		if indexedBlocks[blockHash] {
+			existingBlockHashes = append(existingBlockHashes, blockHash)
+		} else {
+			missingBlockHashes = append(missingBlockHashes, blockHash)
+		}
+	}
+	if message.missingBlocksReply != nil {
+		message.missingBlocksReply <- preflightReply{missingBlockHashes: missingBlockHashes}
+		return
 	}
-	message.asyncCompleteAPI.OnComplete(message.blockHashes, 0)
+
+	for _, blockHash := range s.prefetchWindow.add(s.downloadOrder.plan(existingBlockHashes)) {
+		queuePrefetch(s, prefetchBlockMessages, prefetchBlockMessage{blockHash: blockHash})
+	}
+	if len(missingBlockHashes) > 0 {
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PreflightGet_FailCount], 1)
+		log.Printf("PreflightGet: %v\n", &BlocksMissingError{Store: s.blobStore.String(), BlockHashes: missingBlockHashes})
+		message.asyncCompleteAPI.OnComplete(existingBlockHashes, longtaillib.ENOENT)
+		return
+	}
+	message.asyncCompleteAPI.OnComplete(existingBlockHashes, 0)
 }
 
 func onGetExistingContentMessage(
@@ -849,31 +1471,54 @@ func getStoreIndex(
 	addedBlockIndexes []longtaillib.Longtail_BlockIndex) (longtaillib.Longtail_StoreIndex, bool, error) {
 	var err error
 	var errno int
+	loaded := !storeIndex.IsValid()
 	if !storeIndex.IsValid() {
+		corruptStoreIndex := false
 		if accessType == Init {
 			saveStoreIndex = true
 		} else {
 			if accessType == ReadOnly && len(optionalStoreIndexPath) > 0 {
-				sbuffer, err := ReadFromURI(optionalStoreIndexPath)
+				sbuffer, err := ReadFromURI(optionalStoreIndexPath, s.storeOptions...)
 				if err == nil {
-					storeIndex, errno = longtaillib.ReadStoreIndexFromBuffer(sbuffer)
-					if errno != 0 {
-						log.Printf("Failed parsing local store index from %s: %d\n", optionalStoreIndexPath, errno)
+					storeIndex, err = readStoreIndexData(optionalStoreIndexPath, optionalStoreIndexPath, sbuffer)
+					if err != nil {
+						log.Printf("Failed parsing local store index: %v\n", err)
 					}
 				} else {
 					log.Printf("Failed reading local store index: %v\n", err)
 				}
 			}
 			if !storeIndex.IsValid() {
-				storeIndex, err = readStoreStoreIndex(ctx, s, client)
-				if err != nil {
+				storeIndex = readSessionStoreIndex(s, client)
+			}
+			if !storeIndex.IsValid() {
+				// The generation is read first so a store index that changes while it is read is read again when resuming
+				generation := getIndexGeneration(client)
+				var blobData []byte
+				storeIndex, blobData, err = readStoreStoreIndexBlob(ctx, s, client)
+				if IsStoreIndexCorrupt(err) {
+					log.Printf("WARNING: %v, rebuilding it from the blocks of the store\n", errors.Cause(err))
+					corruptStoreIndex = true
+				} else if err != nil {
 					log.Printf("contentIndexWorker: readStoreStoreIndex() failed with %v", err)
+				} else if storeIndex.IsValid() {
+					s.resumable.setIndex(generation, blobData)
 				}
 			}
 		}
 
 		if !storeIndex.IsValid() {
-			if accessType == ReadOnly {
+			if accessType == ReadOnly && corruptStoreIndex {
+				// The rebuilt store index is only used by this session, a read only store does not write it
+				storeIndex, err = buildStoreIndexFromStoreBlocks(
+					ctx,
+					s,
+					client)
+				if err != nil {
+					return longtaillib.Longtail_StoreIndex{}, false, errors.Wrap(err, "contentIndexWorker: buildStoreIndexFromStoreBlocks() failed")
+				}
+				log.Printf("Rebuilt remote index with %d blocks\n", len(storeIndex.GetBlockHashes()))
+			} else if accessType == ReadOnly {
 				storeIndex, errno = longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
 				if errno != 0 {
 					return longtaillib.Longtail_StoreIndex{}, false, errors.Wrapf(longtaillib.ErrnoToError(longtaillib.EACCES, longtaillib.ErrEACCES), "contentIndexWorker: CreateStoreIndexFromBlocks() failed")
@@ -888,10 +1533,18 @@ func getStoreIndex(
 					return longtaillib.Longtail_StoreIndex{}, false, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "contentIndexWorker: buildStoreIndexFromStoreBlocks() failed")
 				}
 				log.Printf("Rebuilt remote index with %d blocks\n", len(storeIndex.GetBlockHashes()))
-				newStoreIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex)
+				if corruptStoreIndex {
+					err = removeCorruptStoreIndex(client)
+					if err != nil {
+						log.Printf("Failed to remove corrupt store index in store %s: %v\n", s.String(), err)
+					}
+				}
+				newStoreIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex, &s.options.Hooks)
 				if err != nil {
 					log.Printf("Failed to update store index in store %s\n", s.String())
 					saveStoreIndex = true
+				} else {
+					recordAudit(client, s.options, AuditEntry{Operation: AuditRebuildIndex, IndexBlockCount: int(storeIndex.GetBlockCount())})
 				}
 				if newStoreIndex.IsValid() {
 					storeIndex.Dispose()
@@ -901,7 +1554,13 @@ func getStoreIndex(
 		}
 	}
 
+	if loaded && s.options.ConditionalPuts && storeIndex.IsValid() {
+		s.knownBlocks.add(storeIndex.GetBlockHashes()...)
+	}
+
 	if len(addedBlockIndexes) > 0 {
+		// The session store index no longer matches the store index
+		s.resumable.resetIndex()
 		updatedStoreIndex, err := updateStoreIndex(storeIndex, addedBlockIndexes)
 		if err != nil {
 			log.Printf("WARNING: Failed to update store index with added blocks %v", err)
@@ -912,6 +1571,9 @@ func getStoreIndex(
 		saveStoreIndex = true
 		addedBlockIndexes = nil
 	}
+	if s.hasQuota() {
+		s.setIndexedUsage(getStoreIndexUsage(storeIndex))
+	}
 	return storeIndex, saveStoreIndex, nil
 }
 
@@ -929,14 +1591,42 @@ func contentIndexWorker(
 
 	client, err := s.blobStore.NewClient(ctx)
 	if err != nil {
-		storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+		storeIndexWorkerReplyErrorState(preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 		return errors.Wrap(err, s.blobStore.String())
 	}
-	defer client.Close()
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+	idle := newIdleTimer(s.options.IdleTimeout)
+	defer idle.stop()
+	// hibernating is set while the store index and the blob client are released, see WithIdleHibernation,
+	// indexDropped until the store index has been read again
+	hibernating := false
+	indexDropped := false
+	// wake restarts the idle timer and creates the blob client again if the worker hibernated
+	wake := func() error {
+		idle.active()
+		if !hibernating {
+			return nil
+		}
+		newClient, err := s.blobStore.NewClient(ctx)
+		if err != nil {
+			return errors.Wrap(err, s.blobStore.String())
+		}
+		client = newClient
+		hibernating = false
+		s.hibernation.woke()
+		return nil
+	}
 
 	saveStoreIndex := false
+	// uploadedBlockCount is the number of added blocks that are not yet in the saved store index
+	uploadedBlockCount := 0
 
 	storeIndex := longtaillib.Longtail_StoreIndex{}
+	defer s.memory.set(memoryStoreIndex, 0)
 
 	var addedBlockIndexes []longtaillib.Longtail_BlockIndex
 	defer func(addedBlockIndexes []longtaillib.Longtail_BlockIndex) {
@@ -945,50 +1635,65 @@ func contentIndexWorker(
 		}
 	}(addedBlockIndexes)
 
+	// loadStoreIndex wakes the worker and reads the store index if it is not loaded
+	loadStoreIndex := func() error {
+		err := wake()
+		if err != nil {
+			return err
+		}
+		storeIndex, saveStoreIndex, err = getStoreIndex(
+			ctx,
+			s,
+			optionalStoreIndexPath,
+			client,
+			accessType,
+			storeIndex,
+			saveStoreIndex,
+			addedBlockIndexes)
+		if err != nil {
+			return err
+		}
+		s.memory.set(memoryStoreIndex, storeIndexMemory(storeIndex))
+		if indexDropped {
+			indexDropped = false
+			atomic.AddUint64(&s.hibernation.indexReloads, 1)
+		}
+		return nil
+	}
+
 	run := true
 	for run {
 		received := 0
 		select {
 		case preflightGetMsg := <-preflightGetMessages:
 			received++
-			storeIndex, saveStoreIndex, err = getStoreIndex(
-				ctx,
-				s,
-				optionalStoreIndexPath,
-				client,
-				accessType,
-				storeIndex,
-				saveStoreIndex,
-				addedBlockIndexes)
+			err = loadStoreIndex()
 			if err != nil {
 				storeIndex.Dispose()
-				preflightGetMsg.asyncCompleteAPI.OnComplete([]uint64{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
-				storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+				if preflightGetMsg.missingBlocksReply != nil {
+					preflightGetMsg.missingBlocksReply <- preflightReply{err: err}
+				} else {
+					preflightGetMsg.asyncCompleteAPI.OnComplete([]uint64{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
+				}
+				storeIndexWorkerReplyErrorState(preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 				return err
 			}
 			onPreflighMessage(s, storeIndex, preflightGetMsg, prefetchBlockMessages)
 		case blockIndexMsg, more := <-blockIndexMessages:
 			if more {
 				received++
+				idle.active()
 				addedBlockIndexes = append(addedBlockIndexes, blockIndexMsg.blockIndex)
 			} else {
 				run = false
 			}
 		case getExistingContentMessage := <-getExistingContentMessages:
 			received++
-			storeIndex, saveStoreIndex, err = getStoreIndex(
-				ctx,
-				s,
-				optionalStoreIndexPath,
-				client,
-				accessType,
-				storeIndex,
-				saveStoreIndex,
-				addedBlockIndexes)
+			err = loadStoreIndex()
 			if err != nil {
 				storeIndex.Dispose()
 				getExistingContentMessage.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
-				storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+				storeIndexWorkerReplyErrorState(preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 				return err
 			}
 			onGetExistingContentMessage(s, storeIndex, getExistingContentMessage)
@@ -1001,19 +1706,41 @@ func contentIndexWorker(
 
 		select {
 		case <-flushMessages:
+			if (len(addedBlockIndexes) > 0 && accessType != ReadOnly) || saveStoreIndex {
+				err = wake()
+				if err != nil {
+					flushReplyMessages <- longtaillib.ErrorToErrno(err, longtaillib.EIO)
+					continue
+				}
+			}
 			if len(addedBlockIndexes) > 0 && accessType != ReadOnly {
 				updatedStoreIndex, err := updateStoreIndex(storeIndex, addedBlockIndexes)
 				if err != nil {
 					flushReplyMessages <- longtaillib.ErrorToErrno(err, longtaillib.ENOMEM)
 					continue
 				}
+				if s.hasQuota() {
+					err = s.updateQuotaUsage(updatedStoreIndex, addedBlockIndexes)
+					if err != nil {
+						log.Printf("Rejected %d added blocks: %v\n", len(addedBlockIndexes), err)
+						updatedStoreIndex.Dispose()
+						for _, blockIndex := range addedBlockIndexes {
+							blockIndex.Dispose()
+						}
+						addedBlockIndexes = nil
+						flushReplyMessages <- longtaillib.ErrorToErrno(err, longtaillib.ENOSPC)
+						continue
+					}
+				}
 				storeIndex.Dispose()
 				storeIndex = updatedStoreIndex
+				s.memory.set(memoryStoreIndex, storeIndexMemory(storeIndex))
+				uploadedBlockCount += len(addedBlockIndexes)
 				addedBlockIndexes = nil
 				saveStoreIndex = true
 			}
 			if saveStoreIndex {
-				newStoreIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex)
+				newStoreIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex, &s.options.Hooks)
 				if err != nil {
 					flushReplyMessages <- longtaillib.ErrorToErrno(err, longtaillib.ENOMEM)
 					continue
@@ -1021,47 +1748,57 @@ func contentIndexWorker(
 				if newStoreIndex.IsValid() {
 					storeIndex.Dispose()
 					storeIndex = newStoreIndex
+					s.memory.set(memoryStoreIndex, storeIndexMemory(storeIndex))
 				}
 				saveStoreIndex = false
+				if uploadedBlockCount > 0 {
+					recordAudit(client, s.options, AuditEntry{Operation: AuditUpload, AddedBlockCount: uploadedBlockCount, IndexBlockCount: int(storeIndex.GetBlockCount())})
+					uploadedBlockCount = 0
+				}
 			}
 			flushReplyMessages <- 0
+		case <-idle.C():
+			idle.hibernate()
+			if len(addedBlockIndexes) == 0 && !saveStoreIndex && !hibernating {
+				if accessType == Init && storeIndex.IsValid() {
+					// The store has been initialized, it is read again like any other store
+					accessType = ReadWrite
+				}
+				storeIndex.Dispose()
+				storeIndex = longtaillib.Longtail_StoreIndex{}
+				s.memory.set(memoryStoreIndex, storeIndexMemory(storeIndex))
+				client.Close()
+				client = nil
+				hibernating = true
+				indexDropped = true
+				s.hibernation.hibernated()
+			}
 		case preflightGetMsg := <-preflightGetMessages:
-			storeIndex, saveStoreIndex, err = getStoreIndex(
-				ctx,
-				s,
-				optionalStoreIndexPath,
-				client,
-				accessType,
-				storeIndex,
-				saveStoreIndex,
-				addedBlockIndexes)
+			err = loadStoreIndex()
 			if err != nil {
 				storeIndex.Dispose()
-				preflightGetMsg.asyncCompleteAPI.OnComplete([]uint64{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
-				storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+				if preflightGetMsg.missingBlocksReply != nil {
+					preflightGetMsg.missingBlocksReply <- preflightReply{err: err}
+				} else {
+					preflightGetMsg.asyncCompleteAPI.OnComplete([]uint64{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
+				}
+				storeIndexWorkerReplyErrorState(preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 				return err
 			}
 			onPreflighMessage(s, storeIndex, preflightGetMsg, prefetchBlockMessages)
 		case blockIndexMsg, more := <-blockIndexMessages:
 			if more {
+				idle.active()
 				addedBlockIndexes = append(addedBlockIndexes, blockIndexMsg.blockIndex)
 			} else {
 				run = false
 			}
 		case getExistingContentMessage := <-getExistingContentMessages:
-			storeIndex, saveStoreIndex, err = getStoreIndex(
-				ctx,
-				s,
-				optionalStoreIndexPath,
-				client,
-				accessType,
-				storeIndex,
-				saveStoreIndex,
-				addedBlockIndexes)
+			err = loadStoreIndex()
 			if err != nil {
 				storeIndex.Dispose()
 				getExistingContentMessage.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoreIndex{}, longtaillib.ErrorToErrno(err, longtaillib.EIO))
-				storeIndexWorkerReplyErrorState(blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
+				storeIndexWorkerReplyErrorState(preflightGetMessages, blockIndexMessages, getExistingContentMessages, flushMessages, flushReplyMessages)
 				return err
 			}
 			onGetExistingContentMessage(s, storeIndex, getExistingContentMessage)
@@ -1073,23 +1810,46 @@ func contentIndexWorker(
 		return nil
 	}
 
+	if len(addedBlockIndexes) > 0 || saveStoreIndex {
+		err = wake()
+		if err != nil {
+			storeIndex.Dispose()
+			return err
+		}
+	}
+
 	if len(addedBlockIndexes) > 0 {
+		// The session store index no longer matches the store index
+		s.resumable.resetIndex()
 		updatedStoreIndex, err := updateStoreIndex(storeIndex, addedBlockIndexes)
 		if err != nil {
 			return errors.Wrapf(err, "WARNING: Failed to update store index with added blocks")
 		}
+		if s.hasQuota() {
+			err = s.updateQuotaUsage(updatedStoreIndex, addedBlockIndexes)
+			if err != nil {
+				updatedStoreIndex.Dispose()
+				storeIndex.Dispose()
+				return err
+			}
+		}
 		storeIndex.Dispose()
 		storeIndex = updatedStoreIndex
 		saveStoreIndex = true
+		uploadedBlockCount += len(addedBlockIndexes)
 		addedBlockIndexes = nil
 	}
 
 	if saveStoreIndex {
-		newIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex)
-		storeIndex.Dispose()
+		newIndex, err := updateRemoteStoreIndex(ctx, client, storeIndex, &s.options.Hooks)
 		if err != nil {
+			storeIndex.Dispose()
 			return err
 		}
+		if uploadedBlockCount > 0 {
+			recordAudit(client, s.options, AuditEntry{Operation: AuditUpload, AddedBlockCount: uploadedBlockCount, IndexBlockCount: int(storeIndex.GetBlockCount())})
+		}
+		storeIndex.Dispose()
 		newIndex.Dispose()
 	}
 	return nil
@@ -1101,8 +1861,19 @@ func NewRemoteBlockStore(
 	blobStore BlobStore,
 	optionalStoreIndexPath string,
 	workerCount int,
-	accessType AccessType) (longtaillib.BlockStoreAPI, error) {
+	accessType AccessType,
+	opts ...StoreOption) (longtaillib.BlockStoreAPI, error) {
 	ctx := context.Background()
+	if options := newStoreOptions(opts); options.AccessType != nil {
+		accessType = *options.AccessType
+	}
+	if accessType != ReadOnly {
+		// Fail before anything is uploaded rather than on the first block
+		err := CheckStoreRegion(ctx, blobStore, opts...)
+		if err != nil {
+			return nil, err
+		}
+	}
 	defaultClient, err := blobStore.NewClient(ctx)
 	if err != nil {
 		return nil, errors.Wrap(err, blobStore.String())
@@ -1111,23 +1882,91 @@ func NewRemoteBlockStore(
 	s := &remoteStore{
 		jobAPI:        jobAPI,
 		blobStore:     blobStore,
-		defaultClient: defaultClient}
+		defaultClient: defaultClient,
+		storeOptions:  opts,
+		options:       newStoreOptions(opts),
+		statsRates:    rateWindow{window: statsRateWindow}}
+
+	if s.options.WorkerCount > 0 {
+		workerCount = s.options.WorkerCount
+	}
 
-	s.workerCount = workerCount
-	s.putBlockChan = make(chan putBlockMessage, s.workerCount*8)
-	s.getBlockChan = make(chan getBlockMessage, s.workerCount*2048)
-	s.prefetchBlockChan = make(chan prefetchBlockMessage, s.workerCount*2048)
+	s.latencies = newOperationLatencies(s.options.SlowOperationThreshold)
+	s.session = newSessionThrottle(s.options)
+	s.bandwidth = newBandwidthCounter()
+	if s.options.BlockAccessDir != "" {
+		s.access = newBlockAccessCounter()
+	}
+	hooks := s.options.Hooks
+	s.options.Hooks.OnIndexUpdated = func(blockCount int, duration time.Duration) {
+		s.latencies.record(operation{name: OperationUpdateIndex, key: "store.lsi", backend: blobStore.String()}, duration)
+		hooks.indexUpdated(blockCount, duration)
+	}
+	s.options.Hooks.onIndexTransferred = func(uploaded int, downloaded int) {
+		s.bandwidth.add(blobStore.String(), uploaded, downloaded)
+	}
+
+	// The audit log and identity can also be set in the URI of the blob store
+	blobStoreOptions := resolveStoreOptions(blobStore, opts)
+	s.options.AuditLog = blobStoreOptions.AuditLog
+	s.options.Identity = blobStoreOptions.Identity
+
+	s.layout, err = readBlockLayout(defaultClient)
+	if err != nil {
+		defaultClient.Close()
+		return nil, err
+	}
+
+	if len(s.options.MirrorURIs) > 0 || s.options.CDNURLTemplate != "" {
+		s.blockSources, err = newBlockSources(ctx, blobStore, s.options.CDNURLTemplate, s.options.MirrorURIs, opts)
+		if err != nil {
+			defaultClient.Close()
+			return nil, err
+		}
+	}
+
+	uploadWorkerCount, downloadWorkerCount := workerPoolSizes(s.options, workerCount)
+	if downloadWorkerCount == 0 {
+		s.workerPools = []*workerPool{newWorkerPool(WorkerPoolShared, workerCount)}
+		downloadWorkerCount = workerCount
+	} else {
+		s.workerPools = []*workerPool{newWorkerPool(WorkerPoolUpload, uploadWorkerCount), newWorkerPool(WorkerPoolDownload, downloadWorkerCount)}
+		s.downloadStopChan = make(chan struct{})
+	}
+	s.workerCount = 0
+	for _, pool := range s.workerPools {
+		s.workerCount += pool.workerCount
+	}
+	s.putBlockChan = make(chan putBlockMessage, queueDepth(s.options.PutQueueDepth, uploadWorkerCount, defaultPutQueueDepthPerWorker))
+	s.getBlockChan = make(chan getBlockMessage, queueDepth(s.options.GetQueueDepth, downloadWorkerCount, defaultGetQueueDepthPerWorker))
+	s.prefetchBlockChan = make(chan prefetchBlockMessage, queueDepth(s.options.PrefetchQueueDepth, downloadWorkerCount, defaultPrefetchQueueDepthPerWorker))
 	s.preflightGetChan = make(chan preflightGetMessage, 16)
-	s.blockIndexChan = make(chan blockIndexMessage, s.workerCount*2048)
+	s.blockIndexChan = make(chan blockIndexMessage, queueDepth(s.options.BlockIndexQueueDepth, uploadWorkerCount, defaultBlockIndexQueueDepthPerWorker))
 	s.getExistingContentChan = make(chan getExistingContentMessage, 16)
-	s.workerFlushChan = make(chan int, s.workerCount)
-	s.workerFlushReplyChan = make(chan int, s.workerCount)
+	decodeWorkerCount := s.options.DecodeWorkerCount
+	if decodeWorkerCount == 0 {
+		decodeWorkerCount = runtime.NumCPU()
+	}
+	if decodeWorkerCount > 0 {
+		s.decodePool = newWorkerPool(WorkerPoolDecode, decodeWorkerCount)
+		s.decodeBlockChan = make(chan decodeBlockMessage, decodeWorkerCount*defaultDecodeQueueDepthPerWorker)
+		s.decodeErrorChan = make(chan error, decodeWorkerCount)
+	}
 	s.indexFlushChan = make(chan int, 1)
 	s.indexFlushReplyChan = make(chan int, 1)
 	s.workerErrorChan = make(chan error, 1+s.workerCount)
 
+	s.prefetchWindow.size = s.options.PrefetchWindow
+	if s.prefetchWindow.size == 0 {
+		s.prefetchWindow.size = downloadWorkerCount * defaultPrefetchWindowPerWorker
+	}
+
 	s.prefetchMemory = 0
 	s.maxPrefetchMemory = 512 * 1024 * 1024
+	if s.options.MaxPrefetchMemory > 0 {
+		s.maxPrefetchMemory = s.options.MaxPrefetchMemory
+	}
+	s.memory = newMemoryAccount(s.options.MaxMemory)
 
 	s.prefetchBlocks = map[uint64]*pendingPrefetchedBlock{}
 
@@ -1136,29 +1975,64 @@ func NewRemoteBlockStore(
 		s.workerErrorChan <- err
 	}()
 
-	for i := 0; i < s.workerCount; i++ {
-		go func() {
-			err := remoteWorker(ctx, s, s.putBlockChan, s.getBlockChan, s.prefetchBlockChan, s.blockIndexChan, s.workerFlushChan, s.workerFlushReplyChan, accessType)
-			s.workerErrorChan <- err
-		}()
+	if s.decodePool != nil {
+		for i := 0; i < s.decodePool.workerCount; i++ {
+			go func() {
+				err := decodeWorker(ctx, s, s.decodePool, s.decodeBlockChan)
+				s.decodeErrorChan <- err
+			}()
+		}
+	}
+
+	for _, pool := range s.workerPools {
+		putBlockChan, getBlockChan, prefetchBlockChan := s.putBlockChan, s.getBlockChan, s.prefetchBlockChan
+		var stop chan struct{}
+		switch pool.name {
+		case WorkerPoolUpload:
+			getBlockChan, prefetchBlockChan = nil, nil
+		case WorkerPoolDownload:
+			putBlockChan, stop = nil, s.downloadStopChan
+		}
+		for i := 0; i < pool.workerCount; i++ {
+			go func(pool *workerPool) {
+				err := remoteWorker(ctx, s, pool, putBlockChan, getBlockChan, prefetchBlockChan, s.blockIndexChan, stop, accessType)
+				s.workerErrorChan <- err
+			}(pool)
+		}
 	}
+	resumePrefetch(s)
 
 	return s, nil
 }
 
-// GetBlockPath ...
+// GetBlockPath returns the path of a block in DefaultBlockLayout, see BlockLayout.BlockPath
 func GetBlockPath(basePath string, blockHash uint64) string {
-	fileName := fmt.Sprintf("0x%016x.lsb", blockHash)
-	dir := filepath.Join(basePath, fileName[2:6])
-	name := filepath.Join(dir, fileName)
-	name = strings.Replace(name, "\\", "/", -1)
-	return name
+	return DefaultBlockLayout.BlockPath(basePath, blockHash)
 }
 
 // PutStoredBlock ...
 func (s *remoteStore) PutStoredBlock(storedBlock longtaillib.Longtail_StoredBlock, asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI) int {
-	s.putBlockChan <- putBlockMessage{storedBlock: storedBlock, asyncCompleteAPI: asyncCompleteAPI}
-	return 0
+	message := putBlockMessage{storedBlock: storedBlock, asyncCompleteAPI: asyncCompleteAPI, memory: int64(storedBlock.GetBlockSize())}
+	if !s.memory.acquire(memoryPuts, message.memory, s.options.QueueTimeout) {
+		log.Printf("PutStoredBlock: %s is still above its memory limit of %d bytes after %s\n", s.blobStore.String(), s.options.MaxMemory, s.options.QueueTimeout)
+		return longtaillib.EBUSY
+	}
+	select {
+	case s.putBlockChan <- message:
+		return 0
+	default:
+	}
+	wait := s.putQueue.full(s.options.QueueTimeout)
+	select {
+	case s.putBlockChan <- message:
+		wait.done(false)
+		return 0
+	case <-wait.timeout:
+		wait.done(true)
+		s.memory.add(memoryPuts, -message.memory)
+		log.Printf("PutStoredBlock: the put queue of %s is still full after %s\n", s.blobStore.String(), s.options.QueueTimeout)
+		return longtaillib.EBUSY
+	}
 }
 
 // PreflightGet ...
@@ -1169,8 +2043,23 @@ func (s *remoteStore) PreflightGet(blockHashes []uint64, asyncCompleteAPI longta
 
 // GetStoredBlock ...
 func (s *remoteStore) GetStoredBlock(blockHash uint64, asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI) int {
-	s.getBlockChan <- getBlockMessage{blockHash: blockHash, asyncCompleteAPI: asyncCompleteAPI}
-	return 0
+	s.access.add(blockHash)
+	message := getBlockMessage{blockHash: blockHash, asyncCompleteAPI: asyncCompleteAPI}
+	select {
+	case s.getBlockChan <- message:
+		return 0
+	default:
+	}
+	wait := s.getQueue.full(s.options.QueueTimeout)
+	select {
+	case s.getBlockChan <- message:
+		wait.done(false)
+		return 0
+	case <-wait.timeout:
+		wait.done(true)
+		log.Printf("GetStoredBlock: the get queue of %s is still full after %s\n", s.blobStore.String(), s.options.QueueTimeout)
+		return longtaillib.EBUSY
+	}
 }
 
 // GetExistingContent ...
@@ -1184,46 +2073,96 @@ func (s *remoteStore) GetExistingContent(
 
 // GetStats ...
 func (s *remoteStore) GetStats() (longtaillib.BlockStoreStats, int) {
-	return s.stats, 0
+	return loadBlockStoreStats(&s.stats), 0
 }
 
 // Flush ...
 func (s *remoteStore) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI) int {
 	go func() {
-		any_errno := 0
-		for i := 0; i < s.workerCount; i++ {
-			s.workerFlushChan <- 1
-		}
-		for i := 0; i < s.workerCount; i++ {
-			errno := <-s.workerFlushReplyChan
-			if errno != 0 && any_errno == 0 {
-				any_errno = errno
+		asyncCompleteAPI.OnComplete(s.flush(nil))
+	}()
+	return 0
+}
+
+// flush waits for the worker pools, the pending decodes and the store index in turn and returns the
+// first error, drained is called as each of them is done if it is not nil
+func (s *remoteStore) flush(drained func(stage string, errno int)) int {
+	// Concurrent flushes would take each others worker replies
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	report := func(stage string, errno int) {
+		if drained != nil {
+			drained(stage, errno)
+		}
+	}
+	any_errno := 0
+	for _, pool := range s.workerPools {
+		for i := 0; i < pool.workerCount; i++ {
+			pool.flushChan <- 1
+		}
+	}
+	for _, pool := range s.workerPools {
+		pool_errno := 0
+		for i := 0; i < pool.workerCount; i++ {
+			errno := <-pool.flushReplyChan
+			if errno != 0 && pool_errno == 0 {
+				pool_errno = errno
 			}
 		}
-		s.indexFlushChan <- 1
-		errno := <-s.indexFlushReplyChan
-		if errno != 0 && any_errno == 0 {
-			any_errno = errno
+		report(pool.name, pool_errno)
+		if pool_errno != 0 && any_errno == 0 {
+			any_errno = pool_errno
 		}
-		asyncCompleteAPI.OnComplete(any_errno)
-	}()
-	return 0
+	}
+	// The gets the workers have read complete once their blocks are decoded
+	s.pendingDecodes.Wait()
+	report(FlushStageDecode, 0)
+	s.indexFlushChan <- 1
+	errno := <-s.indexFlushReplyChan
+	report(FlushStageStoreIndex, errno)
+	if errno != 0 && any_errno == 0 {
+		any_errno = errno
+	}
+	return any_errno
 }
 
 // Close ...
 func (s *remoteStore) Close() {
 	close(s.putBlockChan)
+	if s.downloadStopChan != nil {
+		close(s.downloadStopChan)
+	}
 	for i := 0; i < s.workerCount; i++ {
 		err := <-s.workerErrorChan
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
+	if s.decodePool != nil {
+		close(s.decodeBlockChan)
+		for i := 0; i < s.decodePool.workerCount; i++ {
+			err := <-s.decodeErrorChan
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		// Blocks decoded after the workers flushed their prefetched blocks
+		flushPrefetch(s, nil)
+	}
 	close(s.blockIndexChan)
 	err := <-s.workerErrorChan
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if s.blockSources != nil {
+		s.blockSources.close()
+	}
+	if s.access != nil {
+		err = recordBlockAccess(s.defaultClient, s.options, s.access.take(), time.Now())
+		if err != nil {
+			log.Printf("WARNING: Failed to record block access counts of %s: %v\n", s.blobStore.String(), err)
+		}
+	}
 	s.defaultClient.Close()
 }
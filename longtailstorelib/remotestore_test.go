@@ -2,11 +2,17 @@ package longtailstorelib
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
 )
 
 func TestCreateRemoteBlobStore(t *testing.T) {
@@ -503,3 +509,456 @@ func TestBlockScanning(t *testing.T) {
 		t.Errorf("TestBlockScanning() getExistingContent(t, storeAPI, chunks, 0) %d!= %d", len(existingContent.GetChunkHashes()), len(goodBlockInCorrectPathIndex.GetChunkHashes()))
 	}
 }
+
+func TestCorruptBlockError(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("")
+	blobClient, _ := blobStore.NewClient(context.Background())
+	defer blobClient.Close()
+
+	storedBlock, _ := generateStoredBlock(t, 3)
+	defer storedBlock.Dispose()
+	corruptBlockHash := storeBlock(blobClient, storedBlock, 1, "")
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	s := &remoteStore{jobAPI: jobs, blobStore: blobStore, defaultClient: blobClient, layout: DefaultBlockLayout}
+
+	_, err := getStoredBlock(context.Background(), s, blobClient, corruptBlockHash)
+	corruptErr, ok := err.(*BlockCorruptError)
+	if !ok {
+		t.Errorf("TestCorruptBlockError() getStoredBlock() %v is not a *BlockCorruptError", err)
+	} else if corruptErr.BlockHash != corruptBlockHash {
+		t.Errorf("TestCorruptBlockError() corruptErr.BlockHash %d != %d", corruptErr.BlockHash, corruptBlockHash)
+	}
+	if longtaillib.ErrorToErrno(err, longtaillib.EIO) != longtaillib.EBADF {
+		t.Errorf("TestCorruptBlockError() longtaillib.ErrorToErrno(err) %d != %d", longtaillib.ErrorToErrno(err, longtaillib.EIO), longtaillib.EBADF)
+	}
+}
+
+func TestImmutableRemoteStore(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_immutable_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	// Plant a block with other chunks at the path of the block for seed 7
+	plainBlobStore, _ := NewFSBlobStore(storePath)
+	plainClient, _ := plainBlobStore.NewClient(context.Background())
+	otherBlock, _ := generateStoredBlock(t, 14)
+	defer otherBlock.Dispose()
+	otherBlockIndex := otherBlock.GetBlockIndex()
+	storeBlock(plainClient, otherBlock, uint64(7+21412151)-otherBlockIndex.GetBlockHash(), "")
+
+	blobStore, _ := NewFSBlobStore(storePath, WithImmutable())
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(
+		jobs,
+		blobStore,
+		"",
+		runtime.NumCPU(),
+		ReadWrite,
+		WithImmutable())
+	if err != nil {
+		t.Errorf("TestImmutableRemoteStore() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	_, errno := storeBlockFromSeed(t, storeAPI, 3)
+	if errno != 0 {
+		t.Errorf("TestImmutableRemoteStore() storeBlockFromSeed(t, storeAPI, 3) %d != %d", errno, 0)
+	}
+	_, errno = storeBlockFromSeed(t, storeAPI, 3)
+	if errno != 0 {
+		t.Errorf("TestImmutableRemoteStore() storeBlockFromSeed(t, storeAPI, 3) again %d != %d", errno, 0)
+	}
+	_, errno = storeBlockFromSeed(t, storeAPI, 7)
+	if errno == 0 {
+		t.Errorf("TestImmutableRemoteStore() storeBlockFromSeed(t, storeAPI, 7) %d == %d", errno, 0)
+	}
+}
+
+// lostResponseBlobStore stores the first block write but fails it as if its response was lost, the
+// later writes of the block are refused with ErrImmutable like a bucket with a retention policy does
+type lostResponseBlobStore struct {
+	BlobStore
+	lostWrites int32
+}
+
+type lostResponseBlobClient struct {
+	BlobClient
+	store *lostResponseBlobStore
+}
+
+type lostResponseBlobObject struct {
+	BlobObject
+	store *lostResponseBlobStore
+	path  string
+}
+
+func (blobStore *lostResponseBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	client, err := blobStore.BlobStore.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &lostResponseBlobClient{BlobClient: client, store: blobStore}, nil
+}
+
+func (blobClient *lostResponseBlobClient) NewObject(path string) (BlobObject, error) {
+	object, err := blobClient.BlobClient.NewObject(path)
+	if err != nil {
+		return nil, err
+	}
+	return &lostResponseBlobObject{BlobObject: object, store: blobClient.store, path: path}, nil
+}
+
+func (blobObject *lostResponseBlobObject) Write(data []byte) (bool, error) {
+	if !strings.HasPrefix(blobObject.path, "chunks/") {
+		return blobObject.BlobObject.Write(data)
+	}
+	if atomic.AddInt32(&blobObject.store.lostWrites, 1) > 1 {
+		return false, errors.Wrap(ErrImmutable, blobObject.path)
+	}
+	ok, err := blobObject.BlobObject.Write(data)
+	if err == nil && ok {
+		return false, fmt.Errorf("%s: timeout awaiting response", blobObject.path)
+	}
+	return ok, err
+}
+
+func TestImmutableRemoteStoreLostWriteResponse(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_immutable_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storePath)
+
+	fsBlobStore, _ := NewFSBlobStore(storePath, WithImmutable())
+	blobStore := &lostResponseBlobStore{BlobStore: fsBlobStore}
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite, WithImmutable(), WithMaxRetries(2))
+	if err != nil {
+		t.Fatalf("TestImmutableRemoteStoreLostWriteResponse() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	// The retry finds the block the lost write stored and accepts it
+	if _, errno := storeBlockFromSeed(t, storeAPI, 3); errno != 0 {
+		t.Errorf("TestImmutableRemoteStoreLostWriteResponse() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	if lostWrites := atomic.LoadInt32(&blobStore.lostWrites); lostWrites != 2 {
+		t.Errorf("TestImmutableRemoteStoreLostWriteResponse() %d block writes != %d", lostWrites, 2)
+	}
+	stats, _ := remoteStore.GetStats()
+	if stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount] != 0 {
+		t.Errorf("TestImmutableRemoteStoreLostWriteResponse() PutStoredBlock_FailCount %d != %d", stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_FailCount], 0)
+	}
+}
+
+func TestCompleteWaitersSharesBlock(t *testing.T) {
+	storedBlock, errno := generateStoredBlock(t, 7)
+	if errno != 0 {
+		t.Fatalf("TestCompleteWaitersSharesBlock() generateStoredBlock() %d != %d", errno, 0)
+	}
+	blockData := storedBlock.GetChunksBlockData()
+
+	completions := make([]*getStoredBlockCompletionAPI, 3)
+	waiters := make([]longtaillib.Longtail_AsyncGetStoredBlockAPI, len(completions))
+	for i := range completions {
+		completions[i] = &getStoredBlockCompletionAPI{}
+		completions[i].wg.Add(1)
+		waiters[i] = longtaillib.CreateAsyncGetStoredBlockAPI(completions[i])
+	}
+	completeWaiters(waiters, storedBlock, nil)
+	for i, g := range completions {
+		g.wg.Wait()
+		if g.err != 0 {
+			t.Errorf("TestCompleteWaitersSharesBlock() waiter %d err %d != %d", i, g.err, 0)
+			continue
+		}
+		validateBlockFromSeed(t, 7, g.storedBlock)
+		if &g.storedBlock.GetChunksBlockData()[0] != &blockData[0] {
+			t.Errorf("TestCompleteWaitersSharesBlock() waiter %d got a copy of the block", i)
+		}
+	}
+	for _, g := range completions {
+		g.storedBlock.Dispose()
+	}
+
+	g := &getStoredBlockCompletionAPI{}
+	g.wg.Add(1)
+	completeWaiters([]longtaillib.Longtail_AsyncGetStoredBlockAPI{longtaillib.CreateAsyncGetStoredBlockAPI(g)}, longtaillib.Longtail_StoredBlock{}, longtaillib.ErrENOENT)
+	g.wg.Wait()
+	if g.err != longtaillib.ENOENT || g.storedBlock.IsValid() {
+		t.Errorf("TestCompleteWaitersSharesBlock() failed get err %d != %d", g.err, longtaillib.ENOENT)
+	}
+}
+
+// gatedBlobStore holds reads of blocks until the gate is opened so tests can interleave requests with a fetch
+type gatedBlobStore struct {
+	BlobStore
+	readStarted chan string
+	gate        chan struct{}
+	readErr     error
+}
+
+type gatedBlobClient struct {
+	BlobClient
+	store *gatedBlobStore
+}
+
+type gatedBlobObject struct {
+	BlobObject
+	store *gatedBlobStore
+	path  string
+}
+
+func newGatedBlobStore(t *testing.T) *gatedBlobStore {
+	blobStore, _ := NewTestBlobStore("the_path")
+	return &gatedBlobStore{BlobStore: blobStore, readStarted: make(chan string, 16), gate: make(chan struct{})}
+}
+
+func (blobStore *gatedBlobStore) NewClient(ctx context.Context) (BlobClient, error) {
+	client, err := blobStore.BlobStore.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedBlobClient{BlobClient: client, store: blobStore}, nil
+}
+
+func (blobClient *gatedBlobClient) NewObject(path string) (BlobObject, error) {
+	object, err := blobClient.BlobClient.NewObject(path)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedBlobObject{BlobObject: object, store: blobClient.store, path: path}, nil
+}
+
+func (blobObject *gatedBlobObject) Read() ([]byte, error) {
+	if strings.HasPrefix(blobObject.path, "chunks/") {
+		blobObject.store.readStarted <- blobObject.path
+		<-blobObject.store.gate
+		if blobObject.store.readErr != nil {
+			return nil, blobObject.store.readErr
+		}
+	}
+	return blobObject.BlobObject.Read()
+}
+
+type orderedGetCompletionAPI struct {
+	id    int
+	order *[]int
+	lock  *sync.Mutex
+	getStoredBlockCompletionAPI
+}
+
+func (a *orderedGetCompletionAPI) OnComplete(storedBlock longtaillib.Longtail_StoredBlock, errno int) {
+	a.lock.Lock()
+	*a.order = append(*a.order, a.id)
+	a.lock.Unlock()
+	a.getStoredBlockCompletionAPI.OnComplete(storedBlock, errno)
+}
+
+// newGatedRemoteStore creates a remote store over a gated blob store holding the block generated from seed,
+// call the returned function to close the store
+func newGatedRemoteStore(t *testing.T, seed uint8) (*gatedBlobStore, *remoteStore, BlobClient, uint64, func()) {
+	blobStore := newGatedBlobStore(t)
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	blockStore, err := NewRemoteBlockStore(jobs, blobStore, "", 2, ReadOnly, WithMaxRetries(0))
+	if err != nil {
+		t.Fatalf("newGatedRemoteStore() NewRemoteBlockStore() %v", err)
+	}
+	s := blockStore.(*remoteStore)
+	client, _ := blobStore.NewClient(context.Background())
+
+	storedBlock, errno := generateStoredBlock(t, seed)
+	if errno != 0 {
+		t.Fatalf("newGatedRemoteStore() generateStoredBlock() %d != %d", errno, 0)
+	}
+	defer storedBlock.Dispose()
+	blockIndex := storedBlock.GetBlockIndex()
+	blockHash := blockIndex.GetBlockHash()
+	data, errno := longtaillib.WriteStoredBlockToBuffer(storedBlock)
+	if errno != 0 {
+		t.Fatalf("newGatedRemoteStore() WriteStoredBlockToBuffer() %d != %d", errno, 0)
+	}
+	object, _ := client.NewObject(s.layout.BlockPath("chunks", blockHash))
+	object.Write(data)
+	return blobStore, s, client, blockHash, func() {
+		client.Close()
+		s.Close()
+		jobs.Dispose()
+	}
+}
+
+func newOrderedWaiters(count int) ([]*orderedGetCompletionAPI, *[]int) {
+	order := &[]int{}
+	lock := &sync.Mutex{}
+	waiters := make([]*orderedGetCompletionAPI, count)
+	for i := range waiters {
+		waiters[i] = &orderedGetCompletionAPI{id: i, order: order, lock: lock}
+		waiters[i].wg.Add(1)
+	}
+	return waiters, order
+}
+
+func TestFetchBlockMultipleWaiters(t *testing.T) {
+	blobStore, s, client, blockHash, closeStore := newGatedRemoteStore(t, 3)
+	defer closeStore()
+	ctx := context.Background()
+
+	waiters, order := newOrderedWaiters(3)
+	go fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[0])})
+	<-blobStore.readStarted
+	fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[1])})
+	prefetchBlock(ctx, s, client, prefetchBlockMessage{blockHash: blockHash})
+	fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[2])})
+	close(blobStore.gate)
+
+	for i, w := range waiters {
+		w.wg.Wait()
+		if w.err != 0 {
+			t.Errorf("TestFetchBlockMultipleWaiters() waiter %d err %d != %d", i, w.err, 0)
+			continue
+		}
+		validateBlockFromSeed(t, 3, w.storedBlock)
+		w.storedBlock.Dispose()
+	}
+	for i, id := range *order {
+		if id != i {
+			t.Errorf("TestFetchBlockMultipleWaiters() completion order %v", *order)
+			break
+		}
+	}
+	if len(blobStore.readStarted) != 0 {
+		t.Errorf("TestFetchBlockMultipleWaiters() block was read %d more times", len(blobStore.readStarted))
+	}
+}
+
+func TestPrefetchBlockMultipleWaiters(t *testing.T) {
+	for waiterCount := 1; waiterCount <= 3; waiterCount++ {
+		blobStore, s, client, blockHash, closeStore := newGatedRemoteStore(t, 5)
+		ctx := context.Background()
+
+		waiters, order := newOrderedWaiters(waiterCount)
+		prefetchDone := make(chan struct{})
+		go func() {
+			prefetchBlock(ctx, s, client, prefetchBlockMessage{blockHash: blockHash})
+			close(prefetchDone)
+		}()
+		<-blobStore.readStarted
+		for _, w := range waiters {
+			fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(w)})
+		}
+		close(blobStore.gate)
+		<-prefetchDone
+
+		for i, w := range waiters {
+			w.wg.Wait()
+			if w.err != 0 {
+				t.Errorf("TestPrefetchBlockMultipleWaiters() %d waiters, waiter %d err %d != %d", waiterCount, i, w.err, 0)
+				continue
+			}
+			validateBlockFromSeed(t, 5, w.storedBlock)
+			w.storedBlock.Dispose()
+		}
+		for i, id := range *order {
+			if id != i {
+				t.Errorf("TestPrefetchBlockMultipleWaiters() %d waiters, completion order %v", waiterCount, *order)
+				break
+			}
+		}
+		if atomic.LoadInt64(&s.prefetchMemory) != 0 {
+			t.Errorf("TestPrefetchBlockMultipleWaiters() prefetchMemory %d != %d", s.prefetchMemory, 0)
+		}
+		closeStore()
+	}
+}
+
+func TestFailedFetchCompletesWaiters(t *testing.T) {
+	blobStore, s, client, blockHash, closeStore := newGatedRemoteStore(t, 9)
+	defer closeStore()
+	ctx := context.Background()
+
+	// A fetch interrupted by cancellation fails all requests waiting for it
+	blobStore.readErr = context.Canceled
+	waiters, _ := newOrderedWaiters(3)
+	prefetchDone := make(chan struct{})
+	go func() {
+		prefetchBlock(ctx, s, client, prefetchBlockMessage{blockHash: blockHash})
+		close(prefetchDone)
+	}()
+	<-blobStore.readStarted
+	fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[0])})
+	fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[1])})
+	close(blobStore.gate)
+	<-prefetchDone
+	for i, w := range waiters[:2] {
+		w.wg.Wait()
+		if w.err == 0 || w.storedBlock.IsValid() {
+			t.Errorf("TestFailedFetchCompletesWaiters() waiter %d err %d, valid %t", i, w.err, w.storedBlock.IsValid())
+		}
+	}
+
+	// The failed block is fetched again when it is requested
+	blobStore.readErr = nil
+	storedBlock, errno := func() (longtaillib.Longtail_StoredBlock, int) {
+		fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[2])})
+		waiters[2].wg.Wait()
+		return waiters[2].storedBlock, waiters[2].err
+	}()
+	if errno != 0 {
+		t.Fatalf("TestFailedFetchCompletesWaiters() refetch err %d != %d", errno, 0)
+	}
+	validateBlockFromSeed(t, 9, storedBlock)
+	storedBlock.Dispose()
+}
+
+func TestFlushDuringFetch(t *testing.T) {
+	blobStore, s, client, blockHash, closeStore := newGatedRemoteStore(t, 11)
+	defer closeStore()
+	ctx := context.Background()
+
+	waiters, _ := newOrderedWaiters(2)
+	go fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[0])})
+	<-blobStore.readStarted
+	flushPrefetch(s, s.prefetchBlockChan)
+	close(blobStore.gate)
+	waiters[0].wg.Wait()
+	if waiters[0].err != 0 {
+		t.Fatalf("TestFlushDuringFetch() fetch err %d != %d", waiters[0].err, 0)
+	}
+	validateBlockFromSeed(t, 11, waiters[0].storedBlock)
+	waiters[0].storedBlock.Dispose()
+
+	// A prefetched block that was flushed while it was fetched is dropped
+	flushPrefetch(s, s.prefetchBlockChan)
+	blobStore.gate = make(chan struct{})
+	prefetchDone := make(chan struct{})
+	go func() {
+		prefetchBlock(ctx, s, client, prefetchBlockMessage{blockHash: blockHash})
+		close(prefetchDone)
+	}()
+	<-blobStore.readStarted
+	flushPrefetch(s, s.prefetchBlockChan)
+	close(blobStore.gate)
+	<-prefetchDone
+	s.fetchedBlocksSync.Lock()
+	_, exists := s.prefetchBlocks[blockHash]
+	s.fetchedBlocksSync.Unlock()
+	if exists || atomic.LoadInt64(&s.prefetchMemory) != 0 {
+		t.Errorf("TestFlushDuringFetch() flushed prefetch kept, exists %t, prefetchMemory %d", exists, s.prefetchMemory)
+	}
+
+	fetchBlock(ctx, s, client, getBlockMessage{blockHash: blockHash, asyncCompleteAPI: longtaillib.CreateAsyncGetStoredBlockAPI(waiters[1])})
+	waiters[1].wg.Wait()
+	if waiters[1].err != 0 {
+		t.Fatalf("TestFlushDuringFetch() fetch after flush err %d != %d", waiters[1].err, 0)
+	}
+	validateBlockFromSeed(t, 11, waiters[1].storedBlock)
+	waiters[1].storedBlock.Dispose()
+}
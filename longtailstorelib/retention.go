@@ -0,0 +1,411 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// The versions uploaded to a store are listed in versionManifestKey with the time they were
+// registered and their tags, see RegisterVersion. The retention policy of the store in
+// retentionPolicyKey decides which of them are kept by ApplyRetentionPolicy.
+const (
+	versionManifestKey = "versions.json"
+	retentionPolicyKey = "retention.json"
+)
+
+// VersionEntry is a version in the version manifest of a store
+type VersionEntry struct {
+	// Path is the URI of the version index
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+	Tags    []string  `json:"tags,omitempty"`
+}
+
+// VersionManifest lists the versions of a store and the releases that group them, see CommitRelease
+type VersionManifest struct {
+	Versions []VersionEntry `json:"versions"`
+	Releases []Release      `json:"releases,omitempty"`
+}
+
+// RetentionPolicy decides which versions of a store are kept, a version is kept if any rule keeps it.
+// A policy without rules keeps all versions.
+type RetentionPolicy struct {
+	// KeepLast keeps the KeepLast most recently registered versions
+	KeepLast int `json:"keepLast,omitempty"`
+	// KeepTags keeps the versions with any of these tags
+	KeepTags []string `json:"keepTags,omitempty"`
+	// KeepNewerThanDays keeps the versions registered less than KeepNewerThanDays days ago
+	KeepNewerThanDays int `json:"keepNewerThanDays,omitempty"`
+}
+
+// IsEmpty returns true if the policy has no rules
+func (policy RetentionPolicy) IsEmpty() bool {
+	return policy.KeepLast <= 0 && len(policy.KeepTags) == 0 && policy.KeepNewerThanDays <= 0
+}
+
+func (policy RetentionPolicy) String() string {
+	if policy.IsEmpty() {
+		return "keep all versions"
+	}
+	s := ""
+	if policy.KeepLast > 0 {
+		s += fmt.Sprintf("keep last %d, ", policy.KeepLast)
+	}
+	for _, tag := range policy.KeepTags {
+		s += fmt.Sprintf("keep tag %s, ", tag)
+	}
+	if policy.KeepNewerThanDays > 0 {
+		s += fmt.Sprintf("keep newer than %d days, ", policy.KeepNewerThanDays)
+	}
+	return s[:len(s)-2]
+}
+
+// RetainedVersion is a version kept by a retention policy with the rules that keep it
+type RetainedVersion struct {
+	Version VersionEntry
+	Reasons []string
+}
+
+// RetentionReport is what a retention policy keeps and deletes, newest versions first
+type RetentionReport struct {
+	Retained []RetainedVersion
+	Deleted  []VersionEntry
+}
+
+// EvaluateRetention applies policy to the versions of manifest at time now
+func EvaluateRetention(manifest VersionManifest, policy RetentionPolicy, now time.Time) RetentionReport {
+	versions := append([]VersionEntry(nil), manifest.Versions...)
+	sort.SliceStable(versions, func(a, b int) bool {
+		if versions[a].Created.Equal(versions[b].Created) {
+			return versions[a].Path > versions[b].Path
+		}
+		return versions[a].Created.After(versions[b].Created)
+	})
+	keepTags := map[string]bool{}
+	for _, tag := range policy.KeepTags {
+		keepTags[tag] = true
+	}
+	cutoff := now.AddDate(0, 0, -policy.KeepNewerThanDays)
+
+	versionReasons := make([][]string, len(versions))
+	versionIndexes := map[string]int{}
+	for i, version := range versions {
+		versionIndexes[version.Path] = i
+		var reasons []string
+		if policy.IsEmpty() {
+			reasons = append(reasons, "no retention policy")
+		}
+		if i < policy.KeepLast {
+			reasons = append(reasons, fmt.Sprintf("last %d", policy.KeepLast))
+		}
+		for _, tag := range version.Tags {
+			if keepTags[tag] {
+				reasons = append(reasons, "tag "+tag)
+			}
+		}
+		if policy.KeepNewerThanDays > 0 && version.Created.After(cutoff) {
+			reasons = append(reasons, fmt.Sprintf("newer than %d days", policy.KeepNewerThanDays))
+		}
+		versionReasons[i] = reasons
+	}
+	// The versions of a release are kept or deleted together
+	for _, release := range manifest.Releases {
+		retained := false
+		for _, releaseVersion := range release.Versions {
+			if i, ok := versionIndexes[releaseVersion.Path]; ok && len(versionReasons[i]) > 0 {
+				retained = true
+			}
+		}
+		if !retained {
+			continue
+		}
+		for _, releaseVersion := range release.Versions {
+			if i, ok := versionIndexes[releaseVersion.Path]; ok && len(versionReasons[i]) == 0 {
+				versionReasons[i] = append(versionReasons[i], "release "+release.Name)
+			}
+		}
+	}
+
+	var report RetentionReport
+	for i, version := range versions {
+		if len(versionReasons[i]) == 0 {
+			report.Deleted = append(report.Deleted, version)
+			continue
+		}
+		report.Retained = append(report.Retained, RetainedVersion{Version: version, Reasons: versionReasons[i]})
+	}
+	return report
+}
+
+// ReadVersionManifest reads the version manifest of the store, a store without one has no versions
+func ReadVersionManifest(ctx context.Context, blobStore BlobStore) (VersionManifest, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return VersionManifest{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	return readVersionManifest(blobClient)
+}
+
+func readVersionManifest(blobClient BlobClient) (VersionManifest, error) {
+	data, err := readScrubBlob(blobClient, versionManifestKey)
+	if err != nil {
+		return VersionManifest{}, errors.Wrapf(err, "readVersionManifest: failed to read %s", versionManifestKey)
+	}
+	var manifest VersionManifest
+	if data == nil {
+		return manifest, nil
+	}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return VersionManifest{}, errors.Wrapf(err, "readVersionManifest: %s is malformed", versionManifestKey)
+	}
+	return manifest, nil
+}
+
+// updateVersionManifest applies update to the version manifest, it is read and written again if
+// someone else changes it in between
+func updateVersionManifest(blobClient BlobClient, update func(manifest *VersionManifest) error) error {
+	objHandle, err := blobClient.NewObject(versionManifestKey)
+	if err != nil {
+		return errors.Wrapf(err, "updateVersionManifest: blobClient.NewObject(%s) failed", versionManifestKey)
+	}
+	for {
+		exists, err := objHandle.LockWriteVersion()
+		if err != nil {
+			return errors.Wrapf(err, "updateVersionManifest: objHandle.LockWriteVersion(%s) failed", versionManifestKey)
+		}
+		var manifest VersionManifest
+		if exists {
+			data, err := objHandle.Read()
+			if err != nil {
+				return errors.Wrapf(err, "updateVersionManifest: objHandle.Read(%s) failed", versionManifestKey)
+			}
+			err = json.Unmarshal(data, &manifest)
+			if err != nil {
+				return errors.Wrapf(err, "updateVersionManifest: %s is malformed", versionManifestKey)
+			}
+		}
+		err = update(&manifest)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return errors.Wrap(err, "updateVersionManifest")
+		}
+		ok, err := objHandle.Write(data)
+		if err != nil {
+			return errors.Wrapf(err, "updateVersionManifest: objHandle.Write(%s) failed", versionManifestKey)
+		}
+		if ok {
+			return nil
+		}
+	}
+}
+
+// RegisterVersion adds the version index at path to the version manifest of the store with tags.
+// Registering a version again adds tags to it and keeps the time it was first registered.
+func RegisterVersion(ctx context.Context, blobStore BlobStore, path string, tags []string) error {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	now := time.Now().UTC()
+	err = updateVersionManifest(blobClient, func(manifest *VersionManifest) error {
+		manifest.addVersion(path, now, tags)
+		return nil
+	})
+	return errors.Wrap(err, "RegisterVersion")
+}
+
+// addVersion adds the version at path with tags, or adds tags to it if it is already in the manifest
+func (manifest *VersionManifest) addVersion(path string, created time.Time, tags []string) {
+	for i := range manifest.Versions {
+		version := &manifest.Versions[i]
+		if version.Path != path {
+			continue
+		}
+		for _, tag := range tags {
+			if !containsString(version.Tags, tag) {
+				version.Tags = append(version.Tags, tag)
+			}
+		}
+		return
+	}
+	manifest.Versions = append(manifest.Versions, VersionEntry{Path: path, Created: created, Tags: tags})
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadRetentionPolicy reads the retention policy of the store, a store without one keeps all versions
+func ReadRetentionPolicy(ctx context.Context, blobStore BlobStore) (RetentionPolicy, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return RetentionPolicy{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	data, err := readScrubBlob(blobClient, retentionPolicyKey)
+	if err != nil {
+		return RetentionPolicy{}, errors.Wrapf(err, "ReadRetentionPolicy: failed to read %s", retentionPolicyKey)
+	}
+	var policy RetentionPolicy
+	if data == nil {
+		return policy, nil
+	}
+	err = json.Unmarshal(data, &policy)
+	if err != nil {
+		return RetentionPolicy{}, errors.Wrapf(err, "ReadRetentionPolicy: %s is malformed", retentionPolicyKey)
+	}
+	return policy, nil
+}
+
+// WriteRetentionPolicy sets the retention policy of the store
+func WriteRetentionPolicy(ctx context.Context, blobStore BlobStore, policy RetentionPolicy) error {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return errors.Wrap(err, "WriteRetentionPolicy")
+	}
+	return errors.Wrap(writeJSONObjectData(blobClient, retentionPolicyKey, data), "WriteRetentionPolicy")
+}
+
+// ApplyRetentionPolicy evaluates the retention policy of the store against its version manifest.
+// The version indexes of the deleted versions are removed from the manifest and deleted, then the
+// blocks only they use are pruned with PruneStore. Returns the report and the pruned block hashes,
+// with dryRun nothing is changed. A store without a retention policy is an error rather than a
+// policy that deletes nothing.
+func ApplyRetentionPolicy(ctx context.Context, blobStore BlobStore, dryRun bool, opts ...StoreOption) (RetentionReport, []uint64, error) {
+	if !dryRun && newStoreOptions(opts).Immutable {
+		return RetentionReport{}, nil, errors.Wrap(ErrImmutable, blobStore.String())
+	}
+	policy, err := ReadRetentionPolicy(ctx, blobStore)
+	if err != nil {
+		return RetentionReport{}, nil, errors.Wrap(err, "ApplyRetentionPolicy")
+	}
+	if policy.IsEmpty() {
+		return RetentionReport{}, nil, fmt.Errorf("ApplyRetentionPolicy: %s has no retention policy", blobStore)
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return RetentionReport{}, nil, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	manifest, err := readVersionManifest(blobClient)
+	if err != nil {
+		return RetentionReport{}, nil, errors.Wrap(err, "ApplyRetentionPolicy")
+	}
+	report := EvaluateRetention(manifest, policy, time.Now())
+
+	// Read the retained versions before anything is deleted so a version that can not be read
+	// stops the run with the store untouched
+	chunks := map[uint64]bool{}
+	for _, retained := range report.Retained {
+		chunkHashes, err := readVersionChunkHashes(retained.Version.Path, opts)
+		if err != nil {
+			return report, nil, errors.Wrap(err, "ApplyRetentionPolicy")
+		}
+		for _, chunkHash := range chunkHashes {
+			chunks[chunkHash] = true
+		}
+	}
+	keepChunkHashes := make([]uint64, 0, len(chunks))
+	for chunkHash := range chunks {
+		keepChunkHashes = append(keepChunkHashes, chunkHash)
+	}
+
+	if !dryRun && len(report.Deleted) > 0 {
+		deleted := map[string]bool{}
+		for _, version := range report.Deleted {
+			deleted[version.Path] = true
+		}
+		err = updateVersionManifest(blobClient, func(manifest *VersionManifest) error {
+			versions := manifest.Versions[:0]
+			for _, version := range manifest.Versions {
+				if !deleted[version.Path] {
+					versions = append(versions, version)
+				}
+			}
+			manifest.Versions = versions
+			releases := manifest.Releases[:0]
+			for _, release := range manifest.Releases {
+				if !release.hasVersionIn(deleted) {
+					releases = append(releases, release)
+				}
+			}
+			manifest.Releases = releases
+			return nil
+		})
+		if err != nil {
+			return report, nil, errors.Wrap(err, "ApplyRetentionPolicy")
+		}
+		for _, version := range report.Deleted {
+			err = deleteURI(ctx, version.Path, opts)
+			if err != nil {
+				return report, nil, errors.Wrapf(err, "ApplyRetentionPolicy: failed to delete %s", version.Path)
+			}
+		}
+	}
+
+	prunedBlockHashes, err := PruneStore(ctx, blobStore, keepChunkHashes, dryRun, opts...)
+	if err != nil {
+		return report, prunedBlockHashes, errors.Wrap(err, "ApplyRetentionPolicy")
+	}
+	return report, prunedBlockHashes, nil
+}
+
+// readVersionChunkHashes returns the chunk hashes of the version index at uri
+func readVersionChunkHashes(uri string, opts []StoreOption) ([]uint64, error) {
+	vbuffer, err := ReadFromURI(uri, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", uri)
+	}
+	versionIndex, errno := longtaillib.ReadVersionIndexFromBuffer(vbuffer)
+	if errno != 0 {
+		return nil, errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrEIO), "longtaillib.ReadVersionIndexFromBuffer() failed for `%s`", uri)
+	}
+	defer versionIndex.Dispose()
+	// GetChunkHashes points into the version index, copy it before it is disposed
+	return append([]uint64(nil), versionIndex.GetChunkHashes()...), nil
+}
+
+// deleteURI deletes the object at uri, an object that does not exist is not an error
+func deleteURI(ctx context.Context, uri string, opts []StoreOption) error {
+	uriParent, uriName := splitURI(uri)
+	blobStore, err := CreateBlobStoreForURI(uriParent, opts...)
+	if err != nil {
+		return err
+	}
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	object, err := client.NewObject(uriName)
+	if err != nil {
+		return err
+	}
+	exists, err := object.Exists()
+	if err != nil || !exists {
+		return err
+	}
+	return object.Delete()
+}
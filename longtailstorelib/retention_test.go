@@ -0,0 +1,155 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestEvaluateRetention(t *testing.T) {
+	now := time.Date(2021, 6, 30, 12, 0, 0, 0, time.UTC)
+	manifest := VersionManifest{Versions: []VersionEntry{
+		{Path: "index/v1.lvi", Created: now.AddDate(0, 0, -40), Tags: []string{"release"}},
+		{Path: "index/v2.lvi", Created: now.AddDate(0, 0, -35)},
+		{Path: "index/v3.lvi", Created: now.AddDate(0, 0, -20)},
+		{Path: "index/v5.lvi", Created: now.AddDate(0, 0, -1)},
+		{Path: "index/v4.lvi", Created: now.AddDate(0, 0, -2)},
+	}}
+
+	report := EvaluateRetention(manifest, RetentionPolicy{}, now)
+	if len(report.Retained) != 5 || len(report.Deleted) != 0 {
+		t.Errorf("TestEvaluateRetention() EvaluateRetention() empty policy %+v", report)
+	}
+
+	report = EvaluateRetention(manifest, RetentionPolicy{KeepLast: 1, KeepTags: []string{"release"}, KeepNewerThanDays: 30}, now)
+	retained := []string{}
+	for _, version := range report.Retained {
+		retained = append(retained, version.Version.Path)
+	}
+	expected := []string{"index/v5.lvi", "index/v4.lvi", "index/v3.lvi", "index/v1.lvi"}
+	if len(retained) != len(expected) {
+		t.Fatalf("TestEvaluateRetention() EvaluateRetention() retained %v != %v", retained, expected)
+	}
+	for i := range expected {
+		if retained[i] != expected[i] {
+			t.Errorf("TestEvaluateRetention() EvaluateRetention() retained %v != %v", retained, expected)
+			break
+		}
+	}
+	if len(report.Retained[0].Reasons) != 2 || report.Retained[3].Reasons[0] != "tag release" {
+		t.Errorf("TestEvaluateRetention() EvaluateRetention() reasons %+v", report.Retained)
+	}
+	if len(report.Deleted) != 1 || report.Deleted[0].Path != "index/v2.lvi" {
+		t.Errorf("TestEvaluateRetention() EvaluateRetention() deleted %+v", report.Deleted)
+	}
+}
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_retention_test")
+	if err != nil {
+		t.Fatalf("TestApplyRetentionPolicy() ioutil.TempDir() %v != %v", err, nil)
+	}
+	defer os.RemoveAll(storePath)
+
+	hashAPI := longtaillib.CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	jobAPI := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	storageAPI := longtaillib.CreateInMemStorageAPI()
+	defer storageAPI.Dispose()
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	remoteStore, err := NewRemoteBlockStore(jobAPI, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestApplyRetentionPolicy() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	blockHashes := map[string]uint64{}
+	for _, name := range []string{"old", "live"} {
+		data := make([]byte, 64*1024)
+		rand.Read(data)
+		storageAPI.WriteToStorage(name, "data.bin", data)
+		versionIndex := createTestVersionIndex(t, storageAPI, hashAPI, jobAPI, name)
+		emptyStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+		storeIndex, errno := longtaillib.CreateMissingContent(hashAPI, emptyStoreIndex, versionIndex, 1024*1024, 1024)
+		emptyStoreIndex.Dispose()
+		if errno != 0 {
+			t.Fatalf("TestApplyRetentionPolicy() CreateMissingContent() %d != %d", errno, 0)
+		}
+		errno = longtaillib.WriteContent(storageAPI, storeAPI, jobAPI, nil, storeIndex, versionIndex, name)
+		if errno != 0 {
+			t.Fatalf("TestApplyRetentionPolicy() WriteContent() %d != %d", errno, 0)
+		}
+		blockHashes[name] = storeIndex.GetBlockHashes()[0]
+		storeIndex.Dispose()
+		vbuffer, _ := longtaillib.WriteVersionIndexToBuffer(versionIndex)
+		versionIndex.Dispose()
+		versionPath := filepath.ToSlash(filepath.Join(storePath, "index", name+".lvi"))
+		err = WriteToURI(versionPath, vbuffer)
+		if err != nil {
+			t.Fatalf("TestApplyRetentionPolicy() WriteToURI() %v != %v", err, nil)
+		}
+		err = RegisterVersion(context.Background(), blobStore, versionPath, nil)
+		if err != nil {
+			t.Fatalf("TestApplyRetentionPolicy() RegisterVersion() %v != %v", err, nil)
+		}
+	}
+	storeAPI.Dispose()
+	livePath := filepath.ToSlash(filepath.Join(storePath, "index", "live.lvi"))
+	err = RegisterVersion(context.Background(), blobStore, livePath, []string{"release"})
+	if err != nil {
+		t.Fatalf("TestApplyRetentionPolicy() RegisterVersion() again %v != %v", err, nil)
+	}
+	manifest, err := ReadVersionManifest(context.Background(), blobStore)
+	if err != nil || len(manifest.Versions) != 2 || len(manifest.Versions[1].Tags) != 1 {
+		t.Fatalf("TestApplyRetentionPolicy() ReadVersionManifest() %v, %+v", err, manifest)
+	}
+
+	_, _, err = ApplyRetentionPolicy(context.Background(), blobStore, true)
+	if err == nil {
+		t.Errorf("TestApplyRetentionPolicy() ApplyRetentionPolicy() without policy %v == %v", err, nil)
+	}
+	err = WriteRetentionPolicy(context.Background(), blobStore, RetentionPolicy{KeepTags: []string{"release"}})
+	if err != nil {
+		t.Fatalf("TestApplyRetentionPolicy() WriteRetentionPolicy() %v != %v", err, nil)
+	}
+	policy, err := ReadRetentionPolicy(context.Background(), blobStore)
+	if err != nil || len(policy.KeepTags) != 1 || policy.KeepTags[0] != "release" {
+		t.Errorf("TestApplyRetentionPolicy() ReadRetentionPolicy() %v, %+v", err, policy)
+	}
+
+	report, prunedBlockHashes, err := ApplyRetentionPolicy(context.Background(), blobStore, true)
+	if err != nil || len(report.Retained) != 1 || len(report.Deleted) != 1 || len(prunedBlockHashes) != 1 {
+		t.Fatalf("TestApplyRetentionPolicy() ApplyRetentionPolicy() dry run %v, %+v, %v", err, report, prunedBlockHashes)
+	}
+	oldPath := report.Deleted[0].Path
+	if _, err := os.Stat(oldPath); err != nil {
+		t.Errorf("TestApplyRetentionPolicy() ApplyRetentionPolicy() dry run deleted %s", oldPath)
+	}
+	_, _, err = ApplyRetentionPolicy(context.Background(), blobStore, false, WithImmutable())
+	if !IsImmutable(err) {
+		t.Errorf("TestApplyRetentionPolicy() ApplyRetentionPolicy() immutable %v != %v", err, ErrImmutable)
+	}
+
+	report, prunedBlockHashes, err = ApplyRetentionPolicy(context.Background(), blobStore, false)
+	if err != nil || len(prunedBlockHashes) != 1 || prunedBlockHashes[0] != blockHashes["old"] {
+		t.Fatalf("TestApplyRetentionPolicy() ApplyRetentionPolicy() %v, %v != %v, [0x%016x]", err, prunedBlockHashes, nil, blockHashes["old"])
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("TestApplyRetentionPolicy() ApplyRetentionPolicy() did not delete %s", oldPath)
+	}
+	if !blobExists(t, blobStore, GetBlockPath("chunks", blockHashes["live"])) {
+		t.Errorf("TestApplyRetentionPolicy() ApplyRetentionPolicy() removed retained block 0x%016x", blockHashes["live"])
+	}
+	manifest, _ = ReadVersionManifest(context.Background(), blobStore)
+	if len(manifest.Versions) != 1 || manifest.Versions[0].Path != livePath {
+		t.Errorf("TestApplyRetentionPolicy() ReadVersionManifest() %+v", manifest)
+	}
+}
@@ -0,0 +1,143 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// CheckVersionBlocks returns an error if the store can not restore the version index at
+// versionIndexPath, a *BlocksMissingError if blocks of the version are in the store index but
+// their objects are gone, for example because they were pruned after the store index was read.
+// Chunks that are in no block of the store index are an error of their own, the blocks that held
+// them were pruned and may still be in the trash, see UndeleteBlocks.
+func CheckVersionBlocks(ctx context.Context, blobStore BlobStore, versionIndexPath string, opts ...StoreOption) error {
+	chunkHashes, err := readVersionChunkHashes(versionIndexPath, opts)
+	if err != nil {
+		return errors.Wrap(err, "CheckVersionBlocks")
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	storeIndex, err := readStoreIndexObject(blobClient, "store.lsi")
+	if err != nil {
+		return errors.Wrap(err, "CheckVersionBlocks")
+	}
+	if !storeIndex.IsValid() {
+		return fmt.Errorf("CheckVersionBlocks: %s has no store index", blobStore)
+	}
+	defer storeIndex.Dispose()
+	existingIndex, errno := longtaillib.GetExistingStoreIndex(storeIndex, chunkHashes, 0)
+	if errno != 0 {
+		return errors.Wrapf(longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM), "CheckVersionBlocks: longtaillib.GetExistingStoreIndex() failed")
+	}
+	defer existingIndex.Dispose()
+
+	indexedChunks := map[uint64]bool{}
+	for _, chunkHash := range existingIndex.GetChunkHashes() {
+		indexedChunks[chunkHash] = true
+	}
+	missingChunkCount := 0
+	for _, chunkHash := range chunkHashes {
+		if !indexedChunks[chunkHash] {
+			missingChunkCount++
+		}
+	}
+	if missingChunkCount > 0 {
+		return fmt.Errorf("CheckVersionBlocks: %d chunks of %s are in no block of the store index of %s, their blocks were pruned", missingChunkCount, versionIndexPath, blobStore)
+	}
+
+	layout, err := readBlockLayout(blobClient)
+	if err != nil {
+		return errors.Wrap(err, "CheckVersionBlocks")
+	}
+	packs, err := readPackIndex(blobClient)
+	if err != nil {
+		return errors.Wrap(err, "CheckVersionBlocks")
+	}
+	packedBlocks := packs.locations()
+	missingBlockHashes := []uint64{}
+	for _, blockHash := range existingIndex.GetBlockHashes() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if _, ok := packedBlocks[blockHash]; ok {
+			continue
+		}
+		key := layout.BlockPath("chunks", blockHash)
+		exists, err := blockObjectExists(blobClient, key)
+		if err != nil {
+			return errors.Wrapf(err, "CheckVersionBlocks: failed to check `%s`", key)
+		}
+		if !exists {
+			missingBlockHashes = append(missingBlockHashes, blockHash)
+		}
+	}
+	if len(missingBlockHashes) > 0 {
+		sort.Slice(missingBlockHashes, func(i, j int) bool { return missingBlockHashes[i] < missingBlockHashes[j] })
+		return &BlocksMissingError{Store: blobStore.String(), BlockHashes: missingBlockHashes}
+	}
+	return nil
+}
+
+// Rollback resolves the rollout name to versionIndexPath for all clients, or to the previous
+// version of the rollout if versionIndexPath is empty. The rollout is only changed if all blocks
+// of the version are still in the store, see CheckVersionBlocks. The version the rollout resolved
+// to becomes its previous version and the rollback is recorded in the history of the rollout
+// manifest with reason.
+func Rollback(ctx context.Context, blobStore BlobStore, name string, versionIndexPath string, reason string, opts ...StoreOption) (Rollout, error) {
+	if newStoreOptions(opts).Immutable {
+		return Rollout{}, errors.Wrap(ErrImmutable, blobStore.String())
+	}
+	manifest, err := ReadRolloutManifest(ctx, blobStore)
+	if err != nil {
+		return Rollout{}, errors.Wrap(err, "Rollback")
+	}
+	current, ok := manifest.Find(name)
+	if !ok {
+		return Rollout{}, fmt.Errorf("Rollback: %s has no rollout `%s`", blobStore, name)
+	}
+	if len(versionIndexPath) == 0 {
+		versionIndexPath = current.Previous
+	}
+	if len(versionIndexPath) == 0 {
+		return Rollout{}, fmt.Errorf("Rollback: rollout `%s` has no previous version", name)
+	}
+	err = CheckVersionBlocks(ctx, blobStore, versionIndexPath, opts...)
+	if err != nil {
+		return Rollout{}, errors.Wrapf(err, "Rollback: can not roll back to %s", versionIndexPath)
+	}
+
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return Rollout{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	var result Rollout
+	err = updateRolloutManifest(blobClient, func(manifest *RolloutManifest) error {
+		for i := range manifest.Rollouts {
+			rollout := &manifest.Rollouts[i]
+			if rollout.Name != name {
+				continue
+			}
+			if rollout.Version != current.Version {
+				return fmt.Errorf("rollout `%s` changed to %s during the rollback", name, rollout.Version)
+			}
+			*rollout = Rollout{Name: name, Version: versionIndexPath, Previous: current.Version, Percentage: 100, Updated: time.Now().UTC()}
+			result = *rollout
+			manifest.record(result, RolloutRolledBack, reason)
+			return nil
+		}
+		return fmt.Errorf("there is no rollout `%s`", name)
+	})
+	if err != nil {
+		return Rollout{}, errors.Wrap(err, "Rollback")
+	}
+	return result, nil
+}
@@ -0,0 +1,97 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestRollback(t *testing.T) {
+	storePath, err := ioutil.TempDir("", "longtail_rollback_test")
+	if err != nil {
+		t.Fatalf("TestRollback() ioutil.TempDir() %v != %v", err, nil)
+	}
+	defer os.RemoveAll(storePath)
+
+	hashAPI := longtaillib.CreateBlake3HashAPI()
+	defer hashAPI.Dispose()
+	jobAPI := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobAPI.Dispose()
+	storageAPI := longtaillib.CreateInMemStorageAPI()
+	defer storageAPI.Dispose()
+
+	blobStore, _ := NewFSBlobStore(storePath)
+	remoteStore, err := NewRemoteBlockStore(jobAPI, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestRollback() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	blockHashes := map[string]uint64{}
+	versionPaths := map[string]string{}
+	for _, name := range []string{"v1", "v2"} {
+		data := make([]byte, 64*1024)
+		rand.Read(data)
+		storageAPI.WriteToStorage(name, "data.bin", data)
+		versionIndex := createTestVersionIndex(t, storageAPI, hashAPI, jobAPI, name)
+		emptyStoreIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+		storeIndex, errno := longtaillib.CreateMissingContent(hashAPI, emptyStoreIndex, versionIndex, 1024*1024, 1024)
+		emptyStoreIndex.Dispose()
+		if errno != 0 {
+			t.Fatalf("TestRollback() CreateMissingContent() %d != %d", errno, 0)
+		}
+		errno = longtaillib.WriteContent(storageAPI, storeAPI, jobAPI, nil, storeIndex, versionIndex, name)
+		if errno != 0 {
+			t.Fatalf("TestRollback() WriteContent() %d != %d", errno, 0)
+		}
+		blockHashes[name] = storeIndex.GetBlockHashes()[0]
+		storeIndex.Dispose()
+		vbuffer, _ := longtaillib.WriteVersionIndexToBuffer(versionIndex)
+		versionIndex.Dispose()
+		versionPaths[name] = filepath.ToSlash(filepath.Join(storePath, "index", name+".lvi"))
+		err = WriteToURI(versionPaths[name], vbuffer)
+		if err != nil {
+			t.Fatalf("TestRollback() WriteToURI() %v != %v", err, nil)
+		}
+	}
+	storeAPI.Dispose()
+
+	ctx := context.Background()
+	for _, name := range []string{"v1", "v2"} {
+		_, err = StartRollout(ctx, blobStore, "latest", versionPaths[name], 100)
+		if err != nil {
+			t.Fatalf("TestRollback() StartRollout(%s) %v != %v", name, err, nil)
+		}
+	}
+	_, err = Rollback(ctx, blobStore, "latest", "", "crash on start", WithImmutable())
+	if !IsImmutable(err) {
+		t.Errorf("TestRollback() Rollback() immutable %v != %v", err, ErrImmutable)
+	}
+	rollout, err := Rollback(ctx, blobStore, "latest", "", "crash on start")
+	if err != nil || rollout.Version != versionPaths["v1"] || rollout.Previous != versionPaths["v2"] || rollout.Percentage != 100 {
+		t.Fatalf("TestRollback() Rollback() %v, %+v", err, rollout)
+	}
+
+	// The blocks of v2 are gone, rolling forward to it again must not change the rollout
+	client, _ := blobStore.NewClient(ctx)
+	object, _ := client.NewObject(GetBlockPath("chunks", blockHashes["v2"]))
+	object.Delete()
+	client.Close()
+	_, err = Rollback(ctx, blobStore, "latest", versionPaths["v2"], "")
+	if !IsBlocksMissing(err) {
+		t.Errorf("TestRollback() Rollback(v2) %v is not a missing blocks error", err)
+	}
+	manifest, _ := ReadRolloutManifest(ctx, blobStore)
+	if current, _ := manifest.Find("latest"); current.Version != versionPaths["v1"] {
+		t.Errorf("TestRollback() Rollback(v2) changed the rollout to %s", current.Version)
+	}
+	history := manifest.RolloutHistory("latest")
+	if len(history) != 3 || history[2].Action != RolloutRolledBack || history[2].Reason != "crash on start" || history[2].Version != versionPaths["v1"] {
+		t.Errorf("TestRollback() RolloutHistory() %+v", history)
+	}
+}
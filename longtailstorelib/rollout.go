@@ -0,0 +1,284 @@
+package longtailstorelib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The staged rollouts of a store are listed in rolloutManifestKey. A rollout is a name, such as
+// "latest", that clients resolve to a version index. While a rollout is in progress a percentage
+// of the clients resolve it to the new version and the others to the previous version. Which
+// clients get the new version is decided by a hash of their machine ID, so a client keeps its
+// version between runs and the clients that have the new version keep it when the percentage is
+// raised.
+const rolloutManifestKey = "rollouts.json"
+
+// Rollout is a name that clients resolve to a version index, see ResolveRollout
+type Rollout struct {
+	Name string `json:"name"`
+	// Version is the URI of the version index that Percentage of the clients resolve to
+	Version string `json:"version"`
+	// Previous is the URI of the version index that the other clients resolve to
+	Previous string `json:"previous,omitempty"`
+	// Percentage of the clients that resolve to Version, 100 completes the rollout
+	Percentage int       `json:"percentage"`
+	Updated    time.Time `json:"updated"`
+}
+
+// The actions recorded in the history of a rollout manifest
+const (
+	RolloutStarted    = "rollout"
+	RolloutAborted    = "abort"
+	RolloutRolledBack = "rollback"
+)
+
+// RolloutEvent is a change of a rollout in the history of a rollout manifest
+type RolloutEvent struct {
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// Version and Previous are the versions the rollout resolves to after the change
+	Version    string    `json:"version"`
+	Previous   string    `json:"previous,omitempty"`
+	Percentage int       `json:"percentage"`
+	Time       time.Time `json:"time"`
+	// Identity is user@host of the process that made the change
+	Identity string `json:"identity,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// RolloutManifest lists the rollouts of a store and their history, oldest change first
+type RolloutManifest struct {
+	Rollouts []Rollout      `json:"rollouts"`
+	History  []RolloutEvent `json:"history,omitempty"`
+}
+
+// record appends a change of rollout to the history of the manifest
+func (manifest *RolloutManifest) record(rollout Rollout, action string, reason string) {
+	manifest.History = append(manifest.History, RolloutEvent{
+		Name:       rollout.Name,
+		Action:     action,
+		Version:    rollout.Version,
+		Previous:   rollout.Previous,
+		Percentage: rollout.Percentage,
+		Time:       rollout.Updated,
+		Identity:   defaultIdentity(),
+		Reason:     reason})
+}
+
+// RolloutHistory returns the changes of the rollout name, oldest first
+func (manifest RolloutManifest) RolloutHistory(name string) []RolloutEvent {
+	var history []RolloutEvent
+	for _, event := range manifest.History {
+		if event.Name == name {
+			history = append(history, event)
+		}
+	}
+	return history
+}
+
+// Find returns the rollout with name
+func (manifest RolloutManifest) Find(name string) (Rollout, bool) {
+	for _, rollout := range manifest.Rollouts {
+		if rollout.Name == name {
+			return rollout, true
+		}
+	}
+	return Rollout{}, false
+}
+
+// rolloutBucket returns the bucket in [0, 100) of machineID for the version of rollout. The
+// version is part of the seed so that the canary clients differ between releases.
+func rolloutBucket(rollout Rollout, machineID string) int {
+	sum := sha256.Sum256([]byte(rollout.Name + "\x00" + rollout.Version + "\x00" + machineID))
+	return int(binary.BigEndian.Uint64(sum[:8]) % 100)
+}
+
+// ResolveRollout returns the version index that the client with machineID resolves rollout to
+func ResolveRollout(rollout Rollout, machineID string) string {
+	if rollout.Percentage >= 100 || rollout.Previous == "" {
+		return rollout.Version
+	}
+	if rollout.Percentage <= 0 {
+		return rollout.Previous
+	}
+	if rolloutBucket(rollout, machineID) < rollout.Percentage {
+		return rollout.Version
+	}
+	return rollout.Previous
+}
+
+// MachineID returns an identifier of the machine that is stable between runs, the systemd or
+// D-Bus machine ID where there is one and the host name otherwise
+func MachineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		data, err := ioutil.ReadFile(path)
+		if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	hostName, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostName
+}
+
+// ReadRolloutManifest reads the rollout manifest of the store, a store without one has no rollouts
+func ReadRolloutManifest(ctx context.Context, blobStore BlobStore) (RolloutManifest, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return RolloutManifest{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	data, err := readScrubBlob(blobClient, rolloutManifestKey)
+	if err != nil {
+		return RolloutManifest{}, errors.Wrapf(err, "ReadRolloutManifest: failed to read %s", rolloutManifestKey)
+	}
+	var manifest RolloutManifest
+	if data == nil {
+		return manifest, nil
+	}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return RolloutManifest{}, errors.Wrapf(err, "ReadRolloutManifest: %s is malformed", rolloutManifestKey)
+	}
+	return manifest, nil
+}
+
+// ResolveRolloutFromStore returns the version index that the client with machineID resolves the
+// rollout name of the store to
+func ResolveRolloutFromStore(ctx context.Context, blobStore BlobStore, name string, machineID string) (string, error) {
+	manifest, err := ReadRolloutManifest(ctx, blobStore)
+	if err != nil {
+		return "", errors.Wrap(err, "ResolveRolloutFromStore")
+	}
+	rollout, ok := manifest.Find(name)
+	if !ok {
+		return "", fmt.Errorf("ResolveRolloutFromStore: %s has no rollout `%s`", blobStore, name)
+	}
+	return ResolveRollout(rollout, machineID), nil
+}
+
+// StartRollout starts rolling out version as name to percentage of the clients. The version the
+// rollout resolved to for all clients becomes the previous version, starting a rollout while
+// another one is in progress is an error unless it is for the same version, which only changes
+// the percentage. The first rollout of a name has no previous version and all clients resolve it
+// to version.
+func StartRollout(ctx context.Context, blobStore BlobStore, name string, version string, percentage int) (Rollout, error) {
+	if percentage < 0 || percentage > 100 {
+		return Rollout{}, fmt.Errorf("StartRollout: percentage %d is not in [0, 100]", percentage)
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return Rollout{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	var result Rollout
+	err = updateRolloutManifest(blobClient, func(manifest *RolloutManifest) error {
+		result = Rollout{Name: name, Version: version, Percentage: percentage, Updated: time.Now().UTC()}
+		for i := range manifest.Rollouts {
+			rollout := &manifest.Rollouts[i]
+			if rollout.Name != name {
+				continue
+			}
+			switch {
+			case rollout.Version == version:
+				result.Previous = rollout.Previous
+			case rollout.Percentage < 100 && rollout.Previous != "":
+				return fmt.Errorf("rollout `%s` of %s is at %d%%, complete or abort it first", name, rollout.Version, rollout.Percentage)
+			default:
+				result.Previous = rollout.Version
+			}
+			*rollout = result
+			manifest.record(result, RolloutStarted, "")
+			return nil
+		}
+		manifest.Rollouts = append(manifest.Rollouts, result)
+		manifest.record(result, RolloutStarted, "")
+		return nil
+	})
+	if err != nil {
+		return Rollout{}, errors.Wrap(err, "StartRollout")
+	}
+	return result, nil
+}
+
+// AbortRollout resolves name to the previous version for all clients again
+func AbortRollout(ctx context.Context, blobStore BlobStore, name string) (Rollout, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return Rollout{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	var result Rollout
+	err = updateRolloutManifest(blobClient, func(manifest *RolloutManifest) error {
+		for i := range manifest.Rollouts {
+			rollout := &manifest.Rollouts[i]
+			if rollout.Name != name {
+				continue
+			}
+			if rollout.Previous == "" {
+				return fmt.Errorf("rollout `%s` has no previous version", name)
+			}
+			*rollout = Rollout{Name: name, Version: rollout.Previous, Percentage: 100, Updated: time.Now().UTC()}
+			result = *rollout
+			manifest.record(result, RolloutAborted, "")
+			return nil
+		}
+		return fmt.Errorf("there is no rollout `%s`", name)
+	})
+	if err != nil {
+		return Rollout{}, errors.Wrap(err, "AbortRollout")
+	}
+	return result, nil
+}
+
+// updateRolloutManifest applies update to the rollout manifest, it is read and written again if
+// someone else changes it in between
+func updateRolloutManifest(blobClient BlobClient, update func(manifest *RolloutManifest) error) error {
+	objHandle, err := blobClient.NewObject(rolloutManifestKey)
+	if err != nil {
+		return errors.Wrapf(err, "updateRolloutManifest: blobClient.NewObject(%s) failed", rolloutManifestKey)
+	}
+	for {
+		exists, err := objHandle.LockWriteVersion()
+		if err != nil {
+			return errors.Wrapf(err, "updateRolloutManifest: objHandle.LockWriteVersion(%s) failed", rolloutManifestKey)
+		}
+		var manifest RolloutManifest
+		if exists {
+			data, err := objHandle.Read()
+			if err != nil {
+				return errors.Wrapf(err, "updateRolloutManifest: objHandle.Read(%s) failed", rolloutManifestKey)
+			}
+			err = json.Unmarshal(data, &manifest)
+			if err != nil {
+				return errors.Wrapf(err, "updateRolloutManifest: %s is malformed", rolloutManifestKey)
+			}
+		}
+		err = update(&manifest)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return errors.Wrap(err, "updateRolloutManifest")
+		}
+		ok, err := objHandle.Write(data)
+		if err != nil {
+			return errors.Wrapf(err, "updateRolloutManifest: objHandle.Write(%s) failed", rolloutManifestKey)
+		}
+		if ok {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package longtailstorelib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestResolveRollout(t *testing.T) {
+	rollout := Rollout{Name: "latest", Version: "index/v2.lvi", Previous: "index/v1.lvi", Percentage: 25}
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		machineID := fmt.Sprintf("machine-%d", i)
+		version := ResolveRollout(rollout, machineID)
+		if ResolveRollout(rollout, machineID) != version {
+			t.Fatalf("TestResolveRollout() ResolveRollout(%s) is not stable", machineID)
+		}
+		counts[version]++
+
+		// Raising the percentage keeps the clients that have the new version on it
+		raised := rollout
+		raised.Percentage = 50
+		if version == rollout.Version && ResolveRollout(raised, machineID) != rollout.Version {
+			t.Errorf("TestResolveRollout() ResolveRollout(%s) left the new version at 50%%", machineID)
+		}
+	}
+	if counts[rollout.Version] < 200 || counts[rollout.Version] > 300 {
+		t.Errorf("TestResolveRollout() ResolveRollout() %d of 1000 clients at 25%%", counts[rollout.Version])
+	}
+
+	rollout.Percentage = 0
+	if ResolveRollout(rollout, "machine") != rollout.Previous {
+		t.Errorf("TestResolveRollout() ResolveRollout() at 0%% != %s", rollout.Previous)
+	}
+	rollout.Percentage = 100
+	if ResolveRollout(rollout, "machine") != rollout.Version {
+		t.Errorf("TestResolveRollout() ResolveRollout() at 100%% != %s", rollout.Version)
+	}
+	if MachineID() == "" {
+		t.Errorf("TestResolveRollout() MachineID() is empty")
+	}
+}
+
+func TestStartRollout(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	ctx := context.Background()
+
+	_, err := ResolveRolloutFromStore(ctx, blobStore, "latest", "machine")
+	if err == nil {
+		t.Errorf("TestStartRollout() ResolveRolloutFromStore() no rollout %v == %v", err, nil)
+	}
+	rollout, err := StartRollout(ctx, blobStore, "latest", "index/v1.lvi", 10)
+	if err != nil || rollout.Previous != "" {
+		t.Fatalf("TestStartRollout() StartRollout(v1) %v, %+v", err, rollout)
+	}
+	version, err := ResolveRolloutFromStore(ctx, blobStore, "latest", "machine")
+	if err != nil || version != "index/v1.lvi" {
+		t.Errorf("TestStartRollout() ResolveRolloutFromStore() first rollout %v, %s", err, version)
+	}
+
+	rollout, err = StartRollout(ctx, blobStore, "latest", "index/v2.lvi", 0)
+	if err != nil || rollout.Previous != "index/v1.lvi" {
+		t.Fatalf("TestStartRollout() StartRollout(v2) %v, %+v", err, rollout)
+	}
+	version, _ = ResolveRolloutFromStore(ctx, blobStore, "latest", "machine")
+	if version != "index/v1.lvi" {
+		t.Errorf("TestStartRollout() ResolveRolloutFromStore() at 0%% %s != %s", version, "index/v1.lvi")
+	}
+	_, err = StartRollout(ctx, blobStore, "latest", "index/v3.lvi", 10)
+	if err == nil {
+		t.Errorf("TestStartRollout() StartRollout(v3) during rollout %v == %v", err, nil)
+	}
+	rollout, err = StartRollout(ctx, blobStore, "latest", "index/v2.lvi", 100)
+	if err != nil || rollout.Previous != "index/v1.lvi" || rollout.Percentage != 100 {
+		t.Fatalf("TestStartRollout() StartRollout(v2, 100) %v, %+v", err, rollout)
+	}
+	rollout, err = StartRollout(ctx, blobStore, "latest", "index/v3.lvi", 50)
+	if err != nil || rollout.Previous != "index/v2.lvi" {
+		t.Fatalf("TestStartRollout() StartRollout(v3) %v, %+v", err, rollout)
+	}
+	rollout, err = AbortRollout(ctx, blobStore, "latest")
+	if err != nil || rollout.Version != "index/v2.lvi" || rollout.Percentage != 100 {
+		t.Errorf("TestStartRollout() AbortRollout() %v, %+v", err, rollout)
+	}
+	manifest, _ := ReadRolloutManifest(ctx, blobStore)
+	if len(manifest.Rollouts) != 1 {
+		t.Errorf("TestStartRollout() ReadRolloutManifest() %+v", manifest)
+	}
+}
@@ -1,52 +1,289 @@
 package longtailstorelib
 
 import (
+	"bytes"
 	"context"
+	"encoding/xml"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
-// TODO: Not yet implemented, shell here to show how what it would require to support S3
+// The S3 store reads, lists and restores objects with requests signed by signS3Request, writes are
+// not implemented yet
+
+// s3RestoreDays is the number of days a restored copy of an archived object is kept readable
+const s3RestoreDays = 1
 
 type s3BlobStore struct {
+	bucketName  string
+	prefix      string
+	endpoint    string
+	credentials *s3Credentials
+	options     StoreOptions
+	region      regionCheck
+
+	bucketRegionLock sync.Mutex
+	bucketRegion     string
 }
 
 type s3BlobClient struct {
-	ctx   context.Context
-	store *s3BlobStore
+	ctx        context.Context
+	store      *s3BlobStore
+	httpClient *http.Client
 }
 
 type s3BlobObject struct {
 	ctx    context.Context
 	client *s3BlobClient
+	path   string
+}
+
+// s3Error is the error response of an S3 request
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// isS3Error returns true if err is an S3 error response with statusCode and, unless it is empty, code
+func isS3Error(err error, statusCode int, code string) bool {
+	e, ok := errors.Cause(err).(*s3Error)
+	return ok && e.StatusCode == statusCode && (code == "" || e.Code == code)
+}
+
+// s3ListBucketResult is the response of ListObjectsV2
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
 }
 
 // NewS3BlobStore ...
-func NewS3BlobStore(u *url.URL) (BlobStore, error) {
+func NewS3BlobStore(u *url.URL, opts ...StoreOption) (BlobStore, error) {
 	if u.Scheme != "s3" {
-		return nil, fmt.Errorf("invalid scheme '%s', expected 'gs'", u.Scheme)
+		return nil, fmt.Errorf("invalid scheme '%s', expected 's3'", u.Scheme)
+	}
+	prefix, err := normalizeStorePrefix(u.Path)
+	if err != nil {
+		return nil, err
+	}
+	if secret, ok := u.User.Password(); ok {
+		opts = append(opts, WithStaticCredentials(u.User.Username(), secret))
+	}
+	options := newStoreOptions(opts)
+	err = lookupCredentials(&options, u.Scheme, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if options.Anonymous && options.RequesterPays {
+		return nil, fmt.Errorf("requester pays bucket '%s' can not be read anonymously", u.Host)
+	}
+	if options.Anonymous && len(options.AccessKeyID) > 0 {
+		return nil, fmt.Errorf("bucket '%s' can not be read anonymously with credentials", u.Host)
+	}
+	if len(options.AccessKeyID) > 0 && len(options.SecretAccessKey) == 0 {
+		if options.SecretPrompt == nil {
+			return nil, fmt.Errorf("no secret for the access key of bucket '%s'", u.Host)
+		}
+		secret, err := options.SecretPrompt(CredentialRequest{Scheme: u.Scheme, Host: u.Host}, options.AccessKeyID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read the secret of the access key of bucket '%s'", u.Host)
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("no secret for the access key of bucket '%s'", u.Host)
+		}
+		options.SecretAccessKey = secret
+	}
+	s := &s3BlobStore{bucketName: u.Host, prefix: prefix, endpoint: "https://" + u.Host + ".s3.amazonaws.com", options: options}
+	if len(options.AccessKeyID) > 0 {
+		s.credentials = &s3Credentials{accessKeyID: options.AccessKeyID, secretAccessKey: options.SecretAccessKey}
+	} else if !options.Anonymous && len(os.Getenv("AWS_ACCESS_KEY_ID")) > 0 {
+		s.credentials = &s3Credentials{accessKeyID: os.Getenv("AWS_ACCESS_KEY_ID"), secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), sessionToken: os.Getenv("AWS_SESSION_TOKEN")}
 	}
-	s := &s3BlobStore{}
 	return s, nil
 }
 
 func (blobStore *s3BlobStore) NewClient(ctx context.Context) (BlobClient, error) {
-	return &s3BlobClient{store: blobStore, ctx: ctx}, nil
+	transport, err := NewHTTPTransport(blobStore.options.Transport)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobClient{store: blobStore, ctx: ctx, httpClient: &http.Client{Transport: transport}}, nil
 }
 
 func (blobStore *s3BlobStore) String() string {
-	return ""
+	return "s3://" + blobStore.bucketName + "/" + blobStore.prefix
+}
+
+// Region returns the region of the bucket, S3 reports it in the x-amz-bucket-region header of a
+// HEAD request to the bucket, also when the request is not allowed
+func (blobStore *s3BlobStore) Region(ctx context.Context) (string, error) {
+	blobStore.bucketRegionLock.Lock()
+	defer blobStore.bucketRegionLock.Unlock()
+	if blobStore.bucketRegion != "" {
+		return blobStore.bucketRegion, nil
+	}
+	transport, err := NewHTTPTransport(blobStore.options.Transport)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodHead, blobStore.endpoint+"/", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, blobStore.bucketName)
+	}
+	resp.Body.Close()
+	region := resp.Header.Get("x-amz-bucket-region")
+	if region == "" {
+		return "", errors.Wrap(&s3Error{StatusCode: resp.StatusCode}, blobStore.bucketName)
+	}
+	blobStore.bucketRegion = region
+	return region, nil
 }
 
 func (blobClient *s3BlobClient) NewObject(path string) (BlobObject, error) {
 	return &s3BlobObject{
 			ctx:    blobClient.ctx,
-			client: blobClient},
+			client: blobClient,
+			path:   blobClient.store.prefix + path},
 		nil
 }
 
+// newRequest returns a request for the object at key, signed with the credentials of the store. Without
+// credentials, such as for WithAnonymous, the request is not signed, public buckets accept them. Requests
+// to a requester pays bucket carry the header that accepts the charges, S3 refuses them with 403
+// AccessDenied otherwise.
+func (blobClient *s3BlobClient) newRequest(method string, key string, query url.Values, body []byte) (*http.Request, error) {
+	store := blobClient.store
+	objectURL := store.endpoint + "/" + s3EscapeURI(key, true)
+	if len(query) > 0 {
+		objectURL += "?" + query.Encode()
+	}
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(blobClient.ctx, method, objectURL, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if store.options.RequesterPays {
+		req.Header.Set("x-amz-request-payer", "requester")
+	}
+	if store.credentials != nil {
+		region, err := store.Region(blobClient.ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to look up the region to sign requests for")
+		}
+		signS3Request(req, body, *store.credentials, region, time.Now())
+	}
+	return req, nil
+}
+
+// do sends a request for key and returns the response, a response with an error status is returned as an s3Error
+func (blobClient *s3BlobClient) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := blobClient.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := blobClient.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &s3Error{}
+	if method != http.MethodHead {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(data, e)
+	}
+	e.StatusCode = resp.StatusCode
+	return nil, e
+}
+
+func (blobObject *s3BlobObject) newRequest(method string) (*http.Request, error) {
+	return blobObject.client.newRequest(method, blobObject.path, nil, nil)
+}
+
+// checkWritable refuses modifications of requester pays buckets, they are only supported for reads,
+// and of buckets outside the allowed regions
+func (blobObject *s3BlobObject) checkWritable() error {
+	store := blobObject.client.store
+	if store.options.RequesterPays {
+		return fmt.Errorf("requester pays store %s is read-only", store)
+	}
+	return store.region.check(blobObject.ctx, store.String(), store, store.options.AllowedRegions)
+}
+
 func (blobClient *s3BlobClient) GetObjects() ([]BlobProperties, error) {
-	return nil, fmt.Errorf("S3 storage not yet implemented")
+	var items []BlobProperties
+	pageToken := ""
+	for {
+		page, nextPageToken, err := blobClient.GetObjectsPage("", pageToken, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page...)
+		if nextPageToken == "" {
+			return items, nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+// GetObjectsPage lists a page of objects with ListObjectsV2, the continuation token of S3 is the page token
+func (blobClient *s3BlobClient) GetObjectsPage(prefix string, pageToken string, pageSize int) ([]BlobProperties, string, error) {
+	store := blobClient.store
+	query := url.Values{"list-type": {"2"}, "prefix": {store.prefix + prefix}, "max-keys": {strconv.Itoa(pageSize)}}
+	if pageToken != "" {
+		query.Set("continuation-token", pageToken)
+	}
+	resp, err := blobClient.do(http.MethodGet, "", query, nil)
+	if err != nil {
+		return nil, "", errors.Wrap(err, store.String())
+	}
+	defer resp.Body.Close()
+	var result s3ListBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", errors.Wrapf(err, "invalid listing of %s", store)
+	}
+	items := make([]BlobProperties, len(result.Contents))
+	for i, item := range result.Contents {
+		items[i] = BlobProperties{Size: item.Size, Name: item.Key[len(store.prefix):]}
+	}
+	if !result.IsTruncated {
+		return items, "", nil
+	}
+	return items, result.NextContinuationToken, nil
+}
+
+func (blobClient *s3BlobClient) ListObjects(prefix string) BlobIterator {
+	return newPagedBlobIterator(blobClient, prefix)
 }
 
 func (blobClient *s3BlobClient) Close() {
@@ -56,22 +293,101 @@ func (blobClient *s3BlobClient) String() string {
 	return blobClient.store.String()
 }
 
+// Read reads the object, reads of objects in the GLACIER and DEEP_ARCHIVE storage classes fail with
+// 403 InvalidObjectState until they are restored, they are returned as ErrArchived
 func (blobObject *s3BlobObject) Read() ([]byte, error) {
-	return nil, fmt.Errorf("S3 storage not yet implemented")
+	resp, err := blobObject.client.do(http.MethodGet, blobObject.path, nil, nil)
+	if isS3Error(err, http.StatusForbidden, "InvalidObjectState") {
+		return nil, errors.Wrap(ErrArchived, blobObject.path)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, blobObject.path)
+	}
+	return data, nil
 }
 
 func (blobObject *s3BlobObject) LockWriteVersion() (bool, error) {
+	if err := blobObject.checkWritable(); err != nil {
+		return false, err
+	}
 	return false, fmt.Errorf("S3 storage not yet implemented")
 }
 
 func (blobObject *s3BlobObject) Exists() (bool, error) {
-	return false, fmt.Errorf("S3 storage not yet implemented")
+	resp, err := blobObject.client.do(http.MethodHead, blobObject.path, nil, nil)
+	if isS3Error(err, http.StatusNotFound, "") {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+	resp.Body.Close()
+	return true, nil
 }
 
 func (blobObject *s3BlobObject) Write(data []byte) (bool, error) {
+	if err := blobObject.checkWritable(); err != nil {
+		return false, err
+	}
 	return false, fmt.Errorf("S3 storage not yet implemented")
 }
 
 func (blobObject *s3BlobObject) Delete() error {
+	if err := blobObject.checkWritable(); err != nil {
+		return err
+	}
 	return fmt.Errorf("S3 storage not yet implemented")
 }
+
+// DeleteObjects would send a DeleteObjects request in quiet mode with up to 1000 keys and map the
+// Errors of the response back to paths, a NoSuchKey error counts as deleted.
+func (blobClient *s3BlobClient) DeleteObjects(paths []string) []error {
+	errs := make([]error, len(paths))
+	for i := range paths {
+		errs[i] = fmt.Errorf("S3 storage not yet implemented")
+	}
+	return errs
+}
+
+// Archive would transition the object to storageClass (GLACIER if empty) with a CopyObject onto itself.
+func (blobObject *s3BlobObject) Archive(storageClass string) error {
+	return fmt.Errorf("S3 storage not yet implemented")
+}
+
+// Restore requests a restore of an archived object with RestoreObject and reports true once the
+// x-amz-restore header of HeadObject shows the restore as completed. Objects outside the GLACIER and
+// DEEP_ARCHIVE storage classes can be read without a restore.
+func (blobObject *s3BlobObject) Restore() (bool, error) {
+	resp, err := blobObject.client.do(http.MethodHead, blobObject.path, nil, nil)
+	if err != nil {
+		return false, errors.Wrap(err, blobObject.path)
+	}
+	resp.Body.Close()
+	restore := resp.Header.Get("x-amz-restore")
+	if strings.Contains(restore, `ongoing-request="false"`) {
+		return true, nil
+	}
+	if strings.Contains(restore, `ongoing-request="true"`) {
+		return false, nil
+	}
+	storageClass := resp.Header.Get("x-amz-storage-class")
+	if storageClass != "GLACIER" && storageClass != "DEEP_ARCHIVE" {
+		return true, nil
+	}
+	body := []byte(fmt.Sprintf("<RestoreRequest><Days>%d</Days></RestoreRequest>", s3RestoreDays))
+	resp, err = blobObject.client.do(http.MethodPost, blobObject.path, url.Values{"restore": {""}}, body)
+	if isS3Error(err, http.StatusConflict, "RestoreAlreadyInProgress") {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to restore %s", blobObject.path)
+	}
+	resp.Body.Close()
+	// 200 means a restored copy is already readable, 202 that the restore was started
+	return resp.StatusCode == http.StatusOK, nil
+}
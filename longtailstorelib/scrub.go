@@ -0,0 +1,416 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// scrubStateKey holds the progress of ScrubStore so a scrub that is stopped resumes where it left off
+const scrubStateKey = "scrub.json"
+
+// scrubStateSaveInterval is how often a running scrub saves its progress to the store
+var scrubStateSaveInterval = time.Minute
+
+// ScrubOptions controls the pace of ScrubStore and what it does with bad blocks
+type ScrubOptions struct {
+	// PercentPerDay is the percentage of the blocks in the store index read per day, the reads are
+	// spread evenly over the day. Zero reads the blocks as fast as possible.
+	PercentPerDay float64
+	// Passes is the number of passes over the whole store to complete before returning, zero
+	// scrubs until the context is cancelled
+	Passes int
+	// Repair replaces corrupt and missing blocks with a verified copy from the first mirror of the
+	// store that has one, see WithMirrorURIs
+	Repair bool
+}
+
+// ScrubState is the progress of the current pass of a scrub, it is kept in the store
+type ScrubState struct {
+	PassStarted time.Time `json:"passStarted"`
+	// Cursor is the hash of the last block scrubbed, the blocks are scrubbed in hash order
+	Cursor             uint64 `json:"cursor,string"`
+	ScrubbedBlockCount int    `json:"scrubbedBlockCount"`
+	CorruptBlockCount  int    `json:"corruptBlockCount"`
+	MissingBlockCount  int    `json:"missingBlockCount"`
+	RepairedBlockCount int    `json:"repairedBlockCount"`
+	// LastPassCompleted is when the previous pass over the store completed, zero if none has
+	LastPassCompleted time.Time `json:"lastPassCompleted"`
+}
+
+// ScrubResult holds what ScrubStore found before it returned
+type ScrubResult struct {
+	ScrubbedBlockCount int
+	ScrubbedByteCount  uint64
+	CompletedPassCount int
+	// CorruptBlockHashes and MissingBlockHashes include the blocks that were repaired
+	CorruptBlockHashes  []uint64
+	MissingBlockHashes  []uint64
+	RepairedBlockHashes []uint64
+	State               ScrubState
+}
+
+type scrubBlockStatus int
+
+const (
+	scrubBlockOK scrubBlockStatus = iota
+	scrubBlockCorrupt
+	scrubBlockMissing
+	scrubBlockSkipped
+)
+
+type scrubber struct {
+	blobClient   BlobClient
+	layout       BlockLayout
+	mirrors      *blockSources
+	codec        *blockCodec
+	hashRegistry longtaillib.Longtail_HashRegistryAPI
+	packs        storePacks
+}
+
+func (s *scrubber) dispose() {
+	s.codec.dispose()
+	s.hashRegistry.Dispose()
+	if s.mirrors != nil {
+		s.mirrors.close()
+	}
+}
+
+// verifyBlockBlob decompresses blob, a block as written by the remote block store, and checks the
+// hashes of its chunks
+func (s *scrubber) verifyBlockBlob(blockHash uint64, path string, blob []byte) error {
+	storedBlock, errno := s.codec.decode(blockHash, blob)
+	if errno != 0 {
+		return &BlockCorruptError{BlockHash: blockHash, Path: path, Reason: longtaillib.ErrnoToError(errno, longtaillib.ErrEBADF)}
+	}
+	defer storedBlock.Dispose()
+	err := verifyStoredBlock(s.hashRegistry, blockHash, storedBlock)
+	if corruptErr, ok := err.(*BlockCorruptError); ok {
+		corruptErr.Path = path
+	}
+	return err
+}
+
+// readScrubBlob reads the object at path, it returns nil if the object does not exist
+func readScrubBlob(blobClient BlobClient, path string) ([]byte, error) {
+	objHandle, err := blobClient.NewObject(path)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := objHandle.Exists()
+	if err != nil || !exists {
+		return nil, err
+	}
+	return objHandle.Read()
+}
+
+// scrubBlock reads and verifies a block of the store, the error is only set if the block could not
+// be read for another reason than it being corrupt or missing
+func (s *scrubber) scrubBlock(blockHash uint64) (scrubBlockStatus, int, error) {
+	path := s.layout.BlockPath("chunks", blockHash)
+	blob, err := readScrubBlob(s.blobClient, path)
+	if IsChecksumMismatch(err) {
+		log.Printf("Scrub: %v\n", &BlockCorruptError{BlockHash: blockHash, Path: path, Reason: err})
+		return scrubBlockCorrupt, 0, nil
+	}
+	if IsArchived(err) {
+		return scrubBlockSkipped, 0, nil
+	}
+	if err != nil {
+		return scrubBlockSkipped, 0, errors.Wrapf(err, "failed to read block 0x%016x", blockHash)
+	}
+	if blob == nil {
+		var location packLocation
+		var packed bool
+		location, packed, err = s.packs.locate(s.blobClient, blockHash)
+		if packed {
+			path = fmt.Sprintf("%s@%d", location.key, location.offset)
+			blob, err = readPackedBlob(s.blobClient, location)
+		}
+		if err != nil {
+			return scrubBlockSkipped, 0, errors.Wrapf(err, "failed to read block 0x%016x", blockHash)
+		}
+	}
+	if blob == nil {
+		log.Printf("Scrub: block 0x%016x at `%s` is missing\n", blockHash, path)
+		return scrubBlockMissing, 0, nil
+	}
+	err = s.verifyBlockBlob(blockHash, path, blob)
+	if _, ok := err.(*BlockCorruptError); ok {
+		log.Printf("Scrub: %v\n", err)
+		return scrubBlockCorrupt, len(blob), nil
+	}
+	if err != nil {
+		return scrubBlockSkipped, len(blob), errors.Wrapf(err, "failed to verify block 0x%016x", blockHash)
+	}
+	return scrubBlockOK, len(blob), nil
+}
+
+// repairBlock replaces a corrupt or missing block with the first copy from a mirror that verifies
+func (s *scrubber) repairBlock(blockHash uint64) (bool, error) {
+	if s.mirrors == nil {
+		return false, nil
+	}
+	path := s.layout.BlockPath("chunks", blockHash)
+	for _, mirror := range s.mirrors.sources {
+		if mirror.client == nil {
+			continue
+		}
+		mirrorLayout, err := readBlockLayout(mirror.client)
+		if err != nil {
+			log.Printf("Scrub: failed to read layout of mirror %s: %v\n", mirror.name, err)
+			continue
+		}
+		mirrorPath := mirrorLayout.BlockPath("chunks", blockHash)
+		blob, err := readScrubBlob(mirror.client, mirrorPath)
+		if err != nil || blob == nil {
+			continue
+		}
+		err = s.verifyBlockBlob(blockHash, mirrorPath, blob)
+		if err != nil {
+			log.Printf("Scrub: copy of block 0x%016x in mirror %s is bad: %v\n", blockHash, mirror.name, err)
+			continue
+		}
+		objHandle, err := s.blobClient.NewObject(path)
+		if err != nil {
+			return false, err
+		}
+		ok, err := objHandle.Write(blob)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to write block 0x%016x", blockHash)
+		}
+		if !ok {
+			return false, fmt.Errorf("write of block 0x%016x was rejected", blockHash)
+		}
+		log.Printf("Scrub: repaired block 0x%016x from mirror %s\n", blockHash, mirror.name)
+		return true, nil
+	}
+	log.Printf("Scrub: no mirror has a good copy of block 0x%016x\n", blockHash)
+	return false, nil
+}
+
+func readScrubState(blobClient BlobClient) (ScrubState, error) {
+	state := ScrubState{}
+	data, err := readScrubBlob(blobClient, scrubStateKey)
+	if err != nil || data == nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return ScrubState{}, errors.Wrapf(err, "%s is malformed", scrubStateKey)
+	}
+	return state, nil
+}
+
+func writeScrubState(blobClient BlobClient, state ScrubState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	objHandle, err := blobClient.NewObject(scrubStateKey)
+	if err != nil {
+		return err
+	}
+	// Lock the version so the state may be replaced in immutable stores
+	_, err = objHandle.LockWriteVersion()
+	if err != nil {
+		return err
+	}
+	ok, err := objHandle.Write(data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s was changed by someone else, is another scrub running?", scrubStateKey)
+	}
+	return nil
+}
+
+// ReadScrubState returns the progress of the scrub of the store, see ScrubStore
+func ReadScrubState(ctx context.Context, blobStore BlobStore) (ScrubState, error) {
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return ScrubState{}, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	state, err := readScrubState(blobClient)
+	if err != nil {
+		return ScrubState{}, errors.Wrap(err, "ReadScrubState")
+	}
+	return state, nil
+}
+
+func readStoreIndexBlockHashes(blobClient BlobClient) ([]uint64, error) {
+	key := "store.lsi"
+	objHandle, err := blobClient.NewObject(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "blobClient.NewObject(%s) failed", key)
+	}
+	blob, err := objHandle.Read()
+	if err != nil {
+		return nil, errors.Wrapf(err, "objHandle.Read(%s) failed", key)
+	}
+	if blob == nil {
+		return nil, errors.Wrapf(longtaillib.ErrENOENT, "%s", key)
+	}
+	storeIndex, err := readStoreIndexData(blobClient.String(), key, blob)
+	if err != nil {
+		return nil, err
+	}
+	defer storeIndex.Dispose()
+	blockHashes := append([]uint64{}, storeIndex.GetBlockHashes()...)
+	sort.Slice(blockHashes, func(i, j int) bool { return blockHashes[i] < blockHashes[j] })
+	return blockHashes, nil
+}
+
+// ScrubStore slowly reads the blocks in the store index and verifies the hashes of their chunks,
+// like a ZFS scrub for a blob store. The reads are paced to options.PercentPerDay of the blocks
+// so a full pass over the store takes 100 / PercentPerDay days. Corrupt and missing blocks are
+// logged and, with options.Repair, replaced with a good copy from a mirror of the store.
+//
+// The progress is saved in the store every minute and when ScrubStore returns so a scrub that is
+// stopped resumes where it left off. ScrubStore returns when options.Passes passes have completed
+// or ctx is cancelled, a cancelled scrub returns what it found and no error.
+//
+// Blocks are only read, and with options.Repair written, so a scrub may run at the same time as
+// upsyncs. Blocks that are removed by a prune while the pass runs are reported as missing.
+func ScrubStore(
+	ctx context.Context,
+	blobStore BlobStore,
+	options ScrubOptions,
+	opts ...StoreOption) (ScrubResult, error) {
+	result := ScrubResult{}
+	if options.PercentPerDay <= 0 && options.Passes == 0 {
+		return result, fmt.Errorf("ScrubStore: a scrub that reads as fast as possible needs a pass count")
+	}
+	storeOptions := resolveStoreOptions(blobStore, opts)
+	if options.Repair && storeOptions.Immutable {
+		return result, errors.Wrap(ErrImmutable, blobStore.String())
+	}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return result, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+
+	s := &scrubber{
+		blobClient:   blobClient,
+		codec:        newBlockCodec(),
+		hashRegistry: longtaillib.CreateFullHashRegistry()}
+	defer s.dispose()
+	s.layout, err = readBlockLayout(blobClient)
+	if err != nil {
+		return result, errors.Wrap(err, "ScrubStore")
+	}
+	if options.Repair && len(storeOptions.MirrorURIs) > 0 {
+		s.mirrors, err = newBlockSources(ctx, blobStore, "", storeOptions.MirrorURIs, opts)
+		if err != nil {
+			return result, errors.Wrap(err, "ScrubStore")
+		}
+	}
+
+	state, err := readScrubState(blobClient)
+	if err != nil {
+		return result, errors.Wrap(err, "ScrubStore")
+	}
+	lastSave := time.Now()
+	saveState := func() {
+		err := writeScrubState(blobClient, state)
+		if err != nil {
+			log.Printf("WARNING: Failed to save scrub progress of %s: %v\n", blobStore.String(), err)
+		}
+		lastSave = time.Now()
+	}
+	defer func() {
+		result.State = state
+		saveState()
+	}()
+
+	sleep := func(d time.Duration) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	for options.Passes == 0 || result.CompletedPassCount < options.Passes {
+		blockHashes, err := readStoreIndexBlockHashes(blobClient)
+		if err != nil {
+			return result, errors.Wrap(err, "ScrubStore")
+		}
+		if state.PassStarted.IsZero() {
+			state = ScrubState{PassStarted: time.Now().UTC(), LastPassCompleted: state.LastPassCompleted}
+		}
+		start := 0
+		if state.ScrubbedBlockCount > 0 {
+			start = sort.Search(len(blockHashes), func(i int) bool { return blockHashes[i] > state.Cursor })
+		}
+		delay := time.Duration(0)
+		if options.PercentPerDay > 0 && len(blockHashes) > 0 {
+			delay = time.Duration(float64(24*time.Hour) * 100 / (options.PercentPerDay * float64(len(blockHashes))))
+		}
+		nextRead := time.Now()
+		for _, blockHash := range blockHashes[start:] {
+			if !sleep(time.Until(nextRead)) {
+				return result, nil
+			}
+			nextRead = nextRead.Add(delay)
+			if now := time.Now(); nextRead.Before(now) {
+				nextRead = now
+			}
+			status, size, err := s.scrubBlock(blockHash)
+			if err != nil {
+				log.Printf("WARNING: Scrub: %v\n", err)
+			}
+			switch status {
+			case scrubBlockCorrupt:
+				state.CorruptBlockCount++
+				result.CorruptBlockHashes = append(result.CorruptBlockHashes, blockHash)
+			case scrubBlockMissing:
+				state.MissingBlockCount++
+				result.MissingBlockHashes = append(result.MissingBlockHashes, blockHash)
+			}
+			if (status == scrubBlockCorrupt || status == scrubBlockMissing) && options.Repair {
+				repaired, err := s.repairBlock(blockHash)
+				if err != nil {
+					log.Printf("WARNING: Scrub: failed to repair block 0x%016x: %v\n", blockHash, err)
+				}
+				if repaired {
+					state.RepairedBlockCount++
+					result.RepairedBlockHashes = append(result.RepairedBlockHashes, blockHash)
+				}
+			}
+			state.Cursor = blockHash
+			state.ScrubbedBlockCount++
+			result.ScrubbedBlockCount++
+			result.ScrubbedByteCount += uint64(size)
+			if time.Since(lastSave) >= scrubStateSaveInterval {
+				saveState()
+			}
+		}
+		log.Printf("Scrub of %s completed: %d blocks, %d corrupt, %d missing, %d repaired\n", blobStore.String(), state.ScrubbedBlockCount, state.CorruptBlockCount, state.MissingBlockCount, state.RepairedBlockCount)
+		if state.RepairedBlockCount > 0 {
+			recordAudit(blobClient, storeOptions, AuditEntry{Operation: AuditScrub, RepairedBlockCount: state.RepairedBlockCount})
+		}
+		passStarted := state.PassStarted
+		state = ScrubState{LastPassCompleted: time.Now().UTC()}
+		result.CompletedPassCount++
+		saveState()
+		// A pass over a small store completes early, wait so the store is not read more often than asked
+		if options.PercentPerDay > 0 && (options.Passes == 0 || result.CompletedPassCount < options.Passes) {
+			passDuration := time.Duration(float64(24*time.Hour) * 100 / options.PercentPerDay)
+			if !sleep(time.Until(passStarted.Add(passDuration))) {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,108 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestScrubStore(t *testing.T) {
+	primaryPath, _ := ioutil.TempDir("", "longtail-primary")
+	defer os.RemoveAll(primaryPath)
+	mirrorPath, _ := ioutil.TempDir("", "longtail-mirror")
+	defer os.RemoveAll(mirrorPath)
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+	hashAPI, errno := hashRegistry.GetHashAPI(longtaillib.GetBlake3HashIdentifier())
+	if errno != 0 {
+		t.Fatalf("TestScrubStore() hashRegistry.GetHashAPI() %d != %d", errno, 0)
+	}
+
+	var blockHashes []uint64
+	for _, path := range []string{primaryPath, mirrorPath} {
+		blobStore, _ := NewFSBlobStore(path)
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+		if err != nil {
+			t.Fatalf("TestScrubStore() NewRemoteBlockStore(%s) %v != %v", path, err, nil)
+		}
+		storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+		blockHashes = nil
+		for seed := uint8(1); seed <= 4; seed++ {
+			storedBlock := createHashedStoredBlock(t, hashAPI, seed)
+			blockIndex := storedBlock.GetBlockIndex()
+			blockHashes = append(blockHashes, blockIndex.GetBlockHash())
+			errno := putStoredBlockSync(storeAPI, storedBlock)
+			storedBlock.Dispose()
+			if errno != 0 {
+				t.Fatalf("TestScrubStore() putStoredBlockSync() %d != %d", errno, 0)
+			}
+		}
+		storeAPI.Dispose()
+	}
+	sort.Slice(blockHashes, func(i, j int) bool { return blockHashes[i] < blockHashes[j] })
+
+	corruptPath := filepath.Join(primaryPath, GetBlockPath("chunks", blockHashes[1]))
+	data, _ := ioutil.ReadFile(corruptPath)
+	data[len(data)-1]++
+	ioutil.WriteFile(corruptPath, data, 0644)
+	os.Remove(filepath.Join(primaryPath, GetBlockPath("chunks", blockHashes[2])))
+
+	blobStore, _ := NewFSBlobStore(primaryPath)
+	result, err := ScrubStore(context.Background(), blobStore, ScrubOptions{Passes: 1})
+	if err != nil {
+		t.Fatalf("TestScrubStore() ScrubStore() %v != %v", err, nil)
+	}
+	if result.ScrubbedBlockCount != 4 || result.CompletedPassCount != 1 {
+		t.Errorf("TestScrubStore() ScrubStore() scrubbed %d blocks in %d passes", result.ScrubbedBlockCount, result.CompletedPassCount)
+	}
+	if len(result.CorruptBlockHashes) != 1 || result.CorruptBlockHashes[0] != blockHashes[1] {
+		t.Errorf("TestScrubStore() ScrubStore() corrupt blocks %v", result.CorruptBlockHashes)
+	}
+	if len(result.MissingBlockHashes) != 1 || result.MissingBlockHashes[0] != blockHashes[2] {
+		t.Errorf("TestScrubStore() ScrubStore() missing blocks %v", result.MissingBlockHashes)
+	}
+	state, err := ReadScrubState(context.Background(), blobStore)
+	if err != nil || state.LastPassCompleted.IsZero() || state.ScrubbedBlockCount != 0 {
+		t.Errorf("TestScrubStore() ReadScrubState() %+v, %v", state, err)
+	}
+
+	result, err = ScrubStore(context.Background(), blobStore, ScrubOptions{Passes: 1, Repair: true}, WithMirrorURIs(mirrorPath))
+	if err != nil {
+		t.Fatalf("TestScrubStore() ScrubStore() repair %v != %v", err, nil)
+	}
+	if len(result.RepairedBlockHashes) != 2 {
+		t.Errorf("TestScrubStore() ScrubStore() repaired blocks %v", result.RepairedBlockHashes)
+	}
+	result, err = ScrubStore(context.Background(), blobStore, ScrubOptions{Passes: 1})
+	if err != nil || len(result.CorruptBlockHashes) != 0 || len(result.MissingBlockHashes) != 0 {
+		t.Errorf("TestScrubStore() ScrubStore() after repair %v, %v, %v", result.CorruptBlockHashes, result.MissingBlockHashes, err)
+	}
+
+	// A paced scrub reads the first block right away and is stopped before the next one
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err = ScrubStore(ctx, blobStore, ScrubOptions{PercentPerDay: 1})
+	if err != nil || result.ScrubbedBlockCount != 1 {
+		t.Fatalf("TestScrubStore() ScrubStore() paced scrubbed %d blocks, %v", result.ScrubbedBlockCount, err)
+	}
+	state, err = ReadScrubState(context.Background(), blobStore)
+	if err != nil || state.Cursor != blockHashes[0] || state.ScrubbedBlockCount != 1 {
+		t.Errorf("TestScrubStore() ReadScrubState() paced %+v, %v", state, err)
+	}
+
+	// The next scrub resumes after the cursor
+	result, err = ScrubStore(context.Background(), blobStore, ScrubOptions{Passes: 1})
+	if err != nil || result.ScrubbedBlockCount != 3 || result.State.ScrubbedBlockCount != 0 {
+		t.Errorf("TestScrubStore() ScrubStore() resumed scrubbed %d blocks, %+v, %v", result.ScrubbedBlockCount, result.State, err)
+	}
+}
@@ -0,0 +1,211 @@
+package longtailstorelib
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// SessionState is the state of a remote block store session that can be persisted and passed to
+// WithSessionState when the store is opened again, so a restarted launcher resumes without
+// fetching the store index and checking the blocks of the restore again
+type SessionState struct {
+	// Store is the blob store of the session, the state is ignored by other stores
+	Store string `json:"store"`
+	// IndexGeneration is the generation of the store index saved at IndexPath, the saved index is
+	// only used while the store index has the same generation. Zero if the backend has no
+	// generations or the session changed the store index.
+	IndexGeneration int64  `json:"indexGeneration,omitempty"`
+	IndexPath       string `json:"indexPath,omitempty"`
+	// PreflightedBlocks were found in the store by PreflightBlocks, they are not checked again
+	// while the store index has IndexGeneration
+	PreflightedBlocks []uint64 `json:"preflightedBlocks,omitempty"`
+	// PrefetchedBlocks were prefetched but not yet read, they are prefetched again when resuming
+	PrefetchedBlocks []uint64 `json:"prefetchedBlocks,omitempty"`
+	// Checkpoint is the progress of the restore that used the store, it is not used by the store
+	Checkpoint json.RawMessage `json:"checkpoint,omitempty"`
+}
+
+// SessionStateExporter is implemented by block stores that can export their session state
+type SessionStateExporter interface {
+	// ExportSessionState returns the state of the session, the store index of the session is
+	// written to indexPath, an empty indexPath leaves the store index out of the state
+	ExportSessionState(indexPath string) (SessionState, error)
+}
+
+// ReadSessionState reads a session state written by WriteSessionState
+func ReadSessionState(uri string, opts ...StoreOption) (SessionState, error) {
+	state := SessionState{}
+	data, err := ReadFromURI(uri, opts...)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// WriteSessionState writes state as JSON to uri
+func WriteSessionState(uri string, state SessionState, opts ...StoreOption) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteToURI(uri, data, opts...)
+}
+
+// resumableSession is the part of the session state that the remote block store tracks
+type resumableSession struct {
+	lock sync.Mutex
+	// indexGeneration and indexData are the store index as read from the store, they are reset when
+	// the session adds blocks to the store index
+	indexGeneration int64
+	indexData       []byte
+	// preflightedBlocks are the blocks found in the store at indexGeneration
+	preflightedBlocks map[uint64]bool
+}
+
+func (r *resumableSession) setIndex(generation int64, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.indexGeneration != generation {
+		r.preflightedBlocks = nil
+	}
+	r.indexGeneration = generation
+	r.indexData = data
+}
+
+func (r *resumableSession) resetIndex() {
+	r.setIndex(0, nil)
+}
+
+func (r *resumableSession) addPreflighted(blockHashes []uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.indexGeneration == 0 {
+		return
+	}
+	if r.preflightedBlocks == nil {
+		r.preflightedBlocks = map[uint64]bool{}
+	}
+	for _, blockHash := range blockHashes {
+		r.preflightedBlocks[blockHash] = true
+	}
+}
+
+func (r *resumableSession) isPreflighted(blockHash uint64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.preflightedBlocks[blockHash]
+}
+
+// sessionStoreName identifies the blob store of a session, all file stores have the same String()
+func sessionStoreName(blobStore BlobStore) string {
+	if fsStore, ok := blobStore.(*fsBlobStore); ok {
+		path, err := filepath.Abs(fsStore.prefix)
+		if err != nil {
+			return fsStore.prefix
+		}
+		return "file://" + filepath.ToSlash(path)
+	}
+	return blobStore.String()
+}
+
+// getIndexGeneration returns the generation of the store index object, zero if the backend has none
+func getIndexGeneration(client BlobClient) int64 {
+	objHandle, err := client.NewObject("store.lsi")
+	if err != nil {
+		return 0
+	}
+	versioned, ok := objHandle.(generationBlobObject)
+	if !ok {
+		return 0
+	}
+	generation, err := versioned.Generation()
+	if err != nil {
+		return 0
+	}
+	return generation
+}
+
+// readSessionStoreIndex returns the store index saved with the session state of WithSessionState
+// if the store index has not changed since, otherwise an invalid store index
+func readSessionStoreIndex(s *remoteStore, client BlobClient) longtaillib.Longtail_StoreIndex {
+	state := s.options.SessionState
+	if state == nil || state.Store != sessionStoreName(s.blobStore) || state.IndexGeneration == 0 || len(state.IndexPath) == 0 {
+		return longtaillib.Longtail_StoreIndex{}
+	}
+	if getIndexGeneration(client) != state.IndexGeneration {
+		log.Printf("Store index of %s has changed since the session was saved, reading it again\n", state.Store)
+		return longtaillib.Longtail_StoreIndex{}
+	}
+	data, err := ReadFromURI(state.IndexPath, s.storeOptions...)
+	if err != nil {
+		log.Printf("Failed reading session store index: %v\n", err)
+		return longtaillib.Longtail_StoreIndex{}
+	}
+	storeIndex, err := readStoreIndexData(state.Store, state.IndexPath, data)
+	if err != nil {
+		log.Printf("Failed parsing session store index: %v\n", err)
+		return longtaillib.Longtail_StoreIndex{}
+	}
+	s.resumable.setIndex(state.IndexGeneration, data)
+	s.resumable.addPreflighted(state.PreflightedBlocks)
+	log.Printf("Resumed session of %s at store index generation %d\n", state.Store, state.IndexGeneration)
+	return storeIndex
+}
+
+// resumePrefetch prefetches the blocks that were prefetched when the session state was exported,
+// blocks that do not fit in the prefetch queue are skipped
+func resumePrefetch(s *remoteStore) {
+	state := s.options.SessionState
+	if state == nil || state.Store != sessionStoreName(s.blobStore) {
+		return
+	}
+	for _, blockHash := range state.PrefetchedBlocks {
+		select {
+		case s.prefetchBlockChan <- prefetchBlockMessage{blockHash: blockHash}:
+		default:
+			return
+		}
+	}
+}
+
+// ExportSessionState returns the state of the session, see SessionState
+func (s *remoteStore) ExportSessionState(indexPath string) (SessionState, error) {
+	state := SessionState{Store: sessionStoreName(s.blobStore)}
+
+	s.resumable.lock.Lock()
+	generation := s.resumable.indexGeneration
+	indexData := s.resumable.indexData
+	for blockHash := range s.resumable.preflightedBlocks {
+		state.PreflightedBlocks = append(state.PreflightedBlocks, blockHash)
+	}
+	s.resumable.lock.Unlock()
+
+	if generation != 0 && indexData != nil && len(indexPath) > 0 {
+		err := WriteToURI(indexPath, indexData, s.storeOptions...)
+		if err != nil {
+			return SessionState{}, err
+		}
+		state.IndexGeneration = generation
+		state.IndexPath = indexPath
+	} else {
+		state.PreflightedBlocks = nil
+	}
+
+	s.fetchedBlocksSync.Lock()
+	for blockHash, prefetchedBlock := range s.prefetchBlocks {
+		if prefetchedBlock != nil && prefetchedBlock.storedBlock.IsValid() {
+			state.PrefetchedBlocks = append(state.PrefetchedBlocks, blockHash)
+		}
+	}
+	s.fetchedBlocksSync.Unlock()
+
+	sort.Slice(state.PreflightedBlocks, func(i, j int) bool { return state.PreflightedBlocks[i] < state.PreflightedBlocks[j] })
+	sort.Slice(state.PrefetchedBlocks, func(i, j int) bool { return state.PrefetchedBlocks[i] < state.PrefetchedBlocks[j] })
+	return state, nil
+}
@@ -0,0 +1,92 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestSessionStateResume(t *testing.T) {
+	sessionPath, _ := ioutil.TempDir("", "longtail-session")
+	defer os.RemoveAll(sessionPath)
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	writeStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestSessionStateResume() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	writeStoreAPI := longtaillib.CreateBlockStoreAPI(writeStore)
+	firstBlockHash, _ := storeBlockFromSeed(t, writeStoreAPI, 1)
+	secondBlockHash, _ := storeBlockFromSeed(t, writeStoreAPI, 2)
+	writeStoreAPI.Dispose()
+
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly)
+	if err != nil {
+		t.Fatalf("TestSessionStateResume() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	err = remoteStore.(BlockPreflighter).PreflightBlocks(context.Background(), []uint64{firstBlockHash, secondBlockHash})
+	if err != nil {
+		t.Errorf("TestSessionStateResume() PreflightBlocks() %v != %v", err, nil)
+	}
+	indexPath := filepath.Join(sessionPath, "session.lsi")
+	state, err := remoteStore.(SessionStateExporter).ExportSessionState(indexPath)
+	storeAPI.Dispose()
+	if err != nil {
+		t.Fatalf("TestSessionStateResume() ExportSessionState() %v != %v", err, nil)
+	}
+	if state.IndexGeneration == 0 || state.IndexPath != indexPath {
+		t.Errorf("TestSessionStateResume() state.IndexGeneration %d, state.IndexPath %s", state.IndexGeneration, state.IndexPath)
+	}
+	if len(state.PreflightedBlocks) != 2 {
+		t.Errorf("TestSessionStateResume() len(state.PreflightedBlocks) %d != %d", len(state.PreflightedBlocks), 2)
+	}
+	statePath := filepath.Join(sessionPath, "session.json")
+	err = WriteSessionState(statePath, state)
+	if err != nil {
+		t.Fatalf("TestSessionStateResume() WriteSessionState() %v != %v", err, nil)
+	}
+	state, err = ReadSessionState(statePath)
+	if err != nil {
+		t.Fatalf("TestSessionStateResume() ReadSessionState() %v != %v", err, nil)
+	}
+
+	// The preflighted blocks are trusted while the store index is unchanged
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject(GetBlockPath("chunks", secondBlockHash))
+	object.Delete()
+	resumedStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly, WithSessionState(state))
+	if err != nil {
+		t.Fatalf("TestSessionStateResume() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	resumedStoreAPI := longtaillib.CreateBlockStoreAPI(resumedStore)
+	err = resumedStore.(BlockPreflighter).PreflightBlocks(context.Background(), []uint64{firstBlockHash, secondBlockHash})
+	resumedStoreAPI.Dispose()
+	if err != nil {
+		t.Errorf("TestSessionStateResume() PreflightBlocks() %v != %v", err, nil)
+	}
+
+	// A changed store index makes the resumed session check the blocks again
+	writeStore, _ = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	writeStoreAPI = longtaillib.CreateBlockStoreAPI(writeStore)
+	storeBlockFromSeed(t, writeStoreAPI, 3)
+	writeStoreAPI.Dispose()
+	resumedStore, err = NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadOnly, WithSessionState(state))
+	if err != nil {
+		t.Fatalf("TestSessionStateResume() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	resumedStoreAPI = longtaillib.CreateBlockStoreAPI(resumedStore)
+	defer resumedStoreAPI.Dispose()
+	err = resumedStore.(BlockPreflighter).PreflightBlocks(context.Background(), []uint64{firstBlockHash, secondBlockHash})
+	if !IsBlocksMissing(err) {
+		t.Errorf("TestSessionStateResume() PreflightBlocks() %v is not a *BlocksMissingError", err)
+	}
+}
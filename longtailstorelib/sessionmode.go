@@ -0,0 +1,148 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SessionMode is how much of the bandwidth and workers a remote block store may use
+type SessionMode int
+
+const (
+	// Foreground - all workers transfer blocks at full speed
+	Foreground SessionMode = iota
+	// Background - blocks are transferred by a few workers at a limited rate, see WithBackgroundLimits
+	Background
+)
+
+const defaultBackgroundWorkerCount = 1
+
+func (mode SessionMode) String() string {
+	switch mode {
+	case Foreground:
+		return "foreground"
+	case Background:
+		return "background"
+	}
+	return fmt.Sprintf("SessionMode(%d)", int(mode))
+}
+
+// SessionModeSwitcher is implemented by block stores that can be throttled while they are in use,
+// so a launcher can keep syncing quietly while the user plays
+type SessionModeSwitcher interface {
+	// SetSessionMode switches the mode of the store, block transfers that are waiting for a
+	// worker or bandwidth continue at full speed right away when switched to Foreground,
+	// including those of a Flush
+	SetSessionMode(mode SessionMode)
+	SessionMode() SessionMode
+}
+
+// sessionThrottle limits the number of block transfers and their rate while in Background mode
+type sessionThrottle struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	mode    SessionMode
+	// foreground is closed when switching to Foreground to wake up transfers waiting for bandwidth
+	foreground chan struct{}
+	active     int
+
+	backgroundWorkerCount    int
+	backgroundBytesPerSecond int64
+	// nextTransfer is when the next transfer may start to stay within backgroundBytesPerSecond
+	nextTransfer time.Time
+}
+
+func newSessionThrottle(options StoreOptions) *sessionThrottle {
+	t := &sessionThrottle{
+		foreground:               make(chan struct{}),
+		backgroundWorkerCount:    options.BackgroundWorkerCount,
+		backgroundBytesPerSecond: options.BackgroundBytesPerSecond}
+	t.changed = sync.NewCond(&t.lock)
+	if t.backgroundWorkerCount <= 0 {
+		t.backgroundWorkerCount = defaultBackgroundWorkerCount
+	}
+	close(t.foreground)
+	t.setMode(options.SessionMode)
+	return t
+}
+
+func (t *sessionThrottle) setMode(mode SessionMode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if mode == t.mode {
+		return
+	}
+	t.mode = mode
+	if mode == Foreground {
+		close(t.foreground)
+	} else {
+		t.foreground = make(chan struct{})
+		t.nextTransfer = time.Time{}
+	}
+	t.changed.Broadcast()
+}
+
+func (t *sessionThrottle) getMode() SessionMode {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.mode
+}
+
+// begin blocks until the transfer may start, in Background mode only backgroundWorkerCount
+// transfers run at a time
+func (t *sessionThrottle) begin() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	for t.mode == Background && t.active >= t.backgroundWorkerCount {
+		t.changed.Wait()
+	}
+	t.active++
+	t.lock.Unlock()
+}
+
+// end releases the transfer after size bytes were transferred, in Background mode it first
+// waits long enough to keep the transfers within backgroundBytesPerSecond
+func (t *sessionThrottle) end(size int) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	var delay time.Duration
+	foreground := t.foreground
+	if t.mode == Background && t.backgroundBytesPerSecond > 0 && size > 0 {
+		now := time.Now()
+		if t.nextTransfer.Before(now) {
+			t.nextTransfer = now
+		}
+		t.nextTransfer = t.nextTransfer.Add(time.Duration(int64(size) * int64(time.Second) / t.backgroundBytesPerSecond))
+		delay = t.nextTransfer.Sub(now)
+	}
+	t.lock.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-foreground:
+			timer.Stop()
+		}
+	}
+
+	t.lock.Lock()
+	t.active--
+	t.changed.Signal()
+	t.lock.Unlock()
+}
+
+// SetSessionMode switches the store between full speed and the limits of WithBackgroundLimits
+func (s *remoteStore) SetSessionMode(mode SessionMode) {
+	s.session.setMode(mode)
+}
+
+// SessionMode returns the current mode of the store
+func (s *remoteStore) SessionMode() SessionMode {
+	return s.session.getMode()
+}
@@ -0,0 +1,108 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestSessionThrottleBackgroundWorkers(t *testing.T) {
+	throttle := newSessionThrottle(StoreOptions{SessionMode: Background, BackgroundWorkerCount: 2})
+	var inFlight int32
+	var maxInFlight int32
+	var wg sync.WaitGroup
+	wg.Add(16)
+	for i := 0; i < 16; i++ {
+		go func() {
+			throttle.begin()
+			current := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			throttle.end(0)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if maxInFlight > 2 {
+		t.Errorf("TestSessionThrottleBackgroundWorkers() maxInFlight %d > %d", maxInFlight, 2)
+	}
+}
+
+func TestSessionThrottleSwitchToForeground(t *testing.T) {
+	throttle := newSessionThrottle(StoreOptions{SessionMode: Background, BackgroundBytesPerSecond: 1024})
+	throttle.begin()
+	waiting := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		close(waiting)
+		throttle.begin()
+		throttle.end(0)
+		close(done)
+	}()
+	<-waiting
+	startTime := time.Now()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		throttle.setMode(Foreground)
+	}()
+	// 64 Kb at 1 Kb/s waits for a minute unless the switch to Foreground wakes it up
+	throttle.end(65536)
+	<-done
+	if time.Since(startTime) > 10*time.Second {
+		t.Errorf("TestSessionThrottleSwitchToForeground() took %v", time.Since(startTime))
+	}
+	if throttle.getMode() != Foreground {
+		t.Errorf("TestSessionThrottleSwitchToForeground() getMode() %v != %v", throttle.getMode(), Foreground)
+	}
+}
+
+func TestSessionModeRemoteStore(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(
+		jobs,
+		blobStore,
+		"",
+		runtime.NumCPU(),
+		ReadWrite,
+		WithSessionMode(Background),
+		WithBackgroundLimits(1, 0))
+	if err != nil {
+		t.Fatalf("TestSessionModeRemoteStore() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	switcher := remoteStore.(SessionModeSwitcher)
+	if switcher.SessionMode() != Background {
+		t.Errorf("TestSessionModeRemoteStore() SessionMode() %v != %v", switcher.SessionMode(), Background)
+	}
+	for seed := uint8(0); seed < 4; seed++ {
+		_, errno := storeBlockFromSeed(t, storeAPI, seed)
+		if errno != 0 {
+			t.Fatalf("TestSessionModeRemoteStore() storeBlockFromSeed(t, storeAPI, %d) %d != %d", seed, errno, 0)
+		}
+	}
+	switcher.SetSessionMode(Foreground)
+	if switcher.SessionMode() != Foreground {
+		t.Errorf("TestSessionModeRemoteStore() SessionMode() %v != %v", switcher.SessionMode(), Foreground)
+	}
+	for seed := uint8(0); seed < 4; seed++ {
+		storedBlock, errno := fetchBlockFromStore(t, storeAPI, uint64(seed)+21412151)
+		if errno != 0 {
+			t.Fatalf("TestSessionModeRemoteStore() fetchBlockFromStore(t, storeAPI, %d) %d != %d", seed, errno, 0)
+		}
+		storedBlock.Dispose()
+	}
+}
@@ -0,0 +1,209 @@
+package longtailstorelib
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// ErrStoreClosed is returned by SharedBlockStore.Acquire after the shared store has been closed
+var ErrStoreClosed = errors.New("block store is closed")
+
+// SharedBlockStore lets concurrent operations use one block store, typically a remote store so
+// the store index is only read once by a long running service. Each operation acquires its own
+// handle and closes it when done, the store is closed when the last handle and the shared store
+// itself have been closed.
+type SharedBlockStore struct {
+	lock     sync.Mutex
+	store    longtaillib.BlockStoreAPI
+	refCount int
+	closed   bool
+}
+
+// NewSharedBlockStore takes ownership of store
+func NewSharedBlockStore(store longtaillib.BlockStoreAPI) *SharedBlockStore {
+	return &SharedBlockStore{store: store, refCount: 1}
+}
+
+// Acquire returns a handle to the store that must be closed when the operation is done. Closing
+// the handle does not flush it, operations flush their handle before closing it as usual.
+func (s *SharedBlockStore) Acquire() (longtaillib.BlockStoreAPI, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	s.refCount++
+	return &sharedBlockStoreHandle{shared: s}, nil
+}
+
+// RefCount returns the number of open handles, including the reference of the shared store until it is closed
+func (s *SharedBlockStore) RefCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refCount
+}
+
+// Close releases the reference of the shared store, no new handles can be acquired after Close
+func (s *SharedBlockStore) Close() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.closed = true
+	s.lock.Unlock()
+	s.release()
+}
+
+func (s *SharedBlockStore) release() {
+	s.lock.Lock()
+	s.refCount--
+	last := s.refCount == 0
+	s.lock.Unlock()
+	if last {
+		s.store.Close()
+	}
+}
+
+type sharedBlockStoreHandle struct {
+	shared *SharedBlockStore
+	closed int32
+}
+
+// PutStoredBlock ...
+func (h *sharedBlockStoreHandle) PutStoredBlock(storedBlock longtaillib.Longtail_StoredBlock, asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI) int {
+	return h.shared.store.PutStoredBlock(storedBlock, asyncCompleteAPI)
+}
+
+// PreflightGet ...
+func (h *sharedBlockStoreHandle) PreflightGet(blockHashes []uint64, asyncCompleteAPI longtaillib.Longtail_AsyncPreflightStartedAPI) int {
+	return h.shared.store.PreflightGet(blockHashes, asyncCompleteAPI)
+}
+
+// GetStoredBlock ...
+func (h *sharedBlockStoreHandle) GetStoredBlock(blockHash uint64, asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI) int {
+	return h.shared.store.GetStoredBlock(blockHash, asyncCompleteAPI)
+}
+
+// GetExistingContent ...
+func (h *sharedBlockStoreHandle) GetExistingContent(chunkHashes []uint64, minBlockUsagePercent uint32, asyncCompleteAPI longtaillib.Longtail_AsyncGetExistingContentAPI) int {
+	return h.shared.store.GetExistingContent(chunkHashes, minBlockUsagePercent, asyncCompleteAPI)
+}
+
+// GetStats returns the stats of the shared store, they include the requests of all handles
+func (h *sharedBlockStoreHandle) GetStats() (longtaillib.BlockStoreStats, int) {
+	return h.shared.store.GetStats()
+}
+
+// Flush ...
+func (h *sharedBlockStoreHandle) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI) int {
+	return h.shared.store.Flush(asyncCompleteAPI)
+}
+
+// FlushWithTimeout flushes the shared store with a deadline if it is a TimeoutFlusher, other
+// stores are flushed without one
+func (h *sharedBlockStoreHandle) FlushWithTimeout(timeout time.Duration) (FlushResult, error) {
+	if flusher, ok := h.shared.store.(TimeoutFlusher); ok {
+		return flusher.FlushWithTimeout(timeout)
+	}
+	flushComplete := &compactFlushCompletionAPI{}
+	flushComplete.wg.Add(1)
+	errno := h.shared.store.Flush(longtaillib.CreateAsyncFlushAPI(flushComplete))
+	if errno != 0 {
+		flushComplete.wg.Done()
+		return FlushResult{Errno: errno}, longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
+	}
+	flushComplete.wg.Wait()
+	if flushComplete.err != 0 {
+		return FlushResult{Errno: flushComplete.err}, longtaillib.ErrnoToError(flushComplete.err, longtaillib.ErrEIO)
+	}
+	return FlushResult{}, nil
+}
+
+// Close releases the reference of the handle, closing a handle twice has no effect
+func (h *sharedBlockStoreHandle) Close() {
+	if atomic.CompareAndSwapInt32(&h.closed, 0, 1) {
+		h.shared.release()
+	}
+}
+
+// PreflightBlocks checks the blocks in the shared store if it is a BlockPreflighter
+func (h *sharedBlockStoreHandle) PreflightBlocks(ctx context.Context, blockHashes []uint64) error {
+	preflighter, ok := h.shared.store.(BlockPreflighter)
+	if !ok {
+		return nil
+	}
+	return preflighter.PreflightBlocks(ctx, blockHashes)
+}
+
+// SetSessionMode switches the mode of the shared store if it is a SessionModeSwitcher, it applies
+// to the requests of all handles
+func (h *sharedBlockStoreHandle) SetSessionMode(mode SessionMode) {
+	if switcher, ok := h.shared.store.(SessionModeSwitcher); ok {
+		switcher.SetSessionMode(mode)
+	}
+}
+
+// SessionMode returns the mode of the shared store, stores that can not be switched are always in Foreground mode
+func (h *sharedBlockStoreHandle) SessionMode() SessionMode {
+	if switcher, ok := h.shared.store.(SessionModeSwitcher); ok {
+		return switcher.SessionMode()
+	}
+	return Foreground
+}
+
+// ExportSessionState exports the session state of the shared store if it is a SessionStateExporter
+func (h *sharedBlockStoreHandle) ExportSessionState(indexPath string) (SessionState, error) {
+	exporter, ok := h.shared.store.(SessionStateExporter)
+	if !ok {
+		return SessionState{}, nil
+	}
+	return exporter.ExportSessionState(indexPath)
+}
+
+// GetBandwidthUsage returns the bandwidth usage of the shared store if it is a
+// BandwidthUsageProvider, the data transferred for all handles
+func (h *sharedBlockStoreHandle) GetBandwidthUsage() []BandwidthUsage {
+	if provider, ok := h.shared.store.(BandwidthUsageProvider); ok {
+		return provider.GetBandwidthUsage()
+	}
+	return nil
+}
+
+// GetHibernationStats returns the hibernation stats of the shared store if it is a
+// HibernationStatsProvider
+func (h *sharedBlockStoreHandle) GetHibernationStats() HibernationStats {
+	if provider, ok := h.shared.store.(HibernationStatsProvider); ok {
+		return provider.GetHibernationStats()
+	}
+	return HibernationStats{}
+}
+
+// GetMemoryStats returns the memory stats of the shared store if it is a MemoryStatsProvider
+func (h *sharedBlockStoreHandle) GetMemoryStats() MemoryStats {
+	if provider, ok := h.shared.store.(MemoryStatsProvider); ok {
+		return provider.GetMemoryStats()
+	}
+	return MemoryStats{}
+}
+
+// HintDownloadOrder forwards the hint to the shared store if it is a DownloadOrderHinter
+func (h *sharedBlockStoreHandle) HintDownloadOrder(blockHashes []uint64) {
+	if hinter, ok := h.shared.store.(DownloadOrderHinter); ok {
+		hinter.HintDownloadOrder(blockHashes)
+	}
+}
+
+// GetDownloadPlanStats returns the download plan stats of the shared store if it is a
+// DownloadPlanStatsProvider
+func (h *sharedBlockStoreHandle) GetDownloadPlanStats() DownloadPlanStats {
+	if provider, ok := h.shared.store.(DownloadPlanStatsProvider); ok {
+		return provider.GetDownloadPlanStats()
+	}
+	return DownloadPlanStats{}
+}
@@ -0,0 +1,77 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestSharedBlockStore(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestSharedBlockStore() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	sharedStore := NewSharedBlockStore(remoteStore)
+
+	var wg sync.WaitGroup
+	errnos := make([]int, 8)
+	for i := range errnos {
+		handle, err := sharedStore.Acquire()
+		if err != nil {
+			t.Fatalf("TestSharedBlockStore() Acquire() %v != %v", err, nil)
+		}
+		wg.Add(1)
+		go func(i int, handle longtaillib.BlockStoreAPI) {
+			defer wg.Done()
+			storeAPI := longtaillib.CreateBlockStoreAPI(handle)
+			defer storeAPI.Dispose()
+			blockHash, errno := storeBlockFromSeed(t, storeAPI, uint8(i))
+			if errno == 0 {
+				var storedBlock longtaillib.Longtail_StoredBlock
+				storedBlock, errno = fetchBlockFromStore(t, storeAPI, blockHash)
+				storedBlock.Dispose()
+			}
+			errnos[i] = errno
+			flushComplete := &flushCompletionAPI{}
+			flushComplete.wg.Add(1)
+			storeAPI.Flush(longtaillib.CreateAsyncFlushAPI(flushComplete))
+			flushComplete.wg.Wait()
+			if errnos[i] == 0 {
+				errnos[i] = flushComplete.err
+			}
+		}(i, handle)
+	}
+	wg.Wait()
+	for i, errno := range errnos {
+		if errno != 0 {
+			t.Errorf("TestSharedBlockStore() operation %d errno %d != %d", i, errno, 0)
+		}
+	}
+	if sharedStore.RefCount() != 1 {
+		t.Errorf("TestSharedBlockStore() RefCount() %d != %d", sharedStore.RefCount(), 1)
+	}
+
+	handle, _ := sharedStore.Acquire()
+	stats, _ := handle.GetStats()
+	if stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count] != uint64(len(errnos)) {
+		t.Errorf("TestSharedBlockStore() PutStoredBlock_Count %d != %d", stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count], len(errnos))
+	}
+	sharedStore.Close()
+	if _, err := sharedStore.Acquire(); err != ErrStoreClosed {
+		t.Errorf("TestSharedBlockStore() Acquire() after Close() %v != %v", err, ErrStoreClosed)
+	}
+	// The store stays open until the last handle is closed
+	if sharedStore.RefCount() != 1 {
+		t.Errorf("TestSharedBlockStore() RefCount() %d != %d", sharedStore.RefCount(), 1)
+	}
+	handle.Close()
+	handle.Close()
+	if sharedStore.RefCount() != 0 {
+		t.Errorf("TestSharedBlockStore() RefCount() %d != %d", sharedStore.RefCount(), 0)
+	}
+}
@@ -0,0 +1,176 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Request signing lets a self-hosted block server, read through WithCDN, authenticate clients
+// with a shared secret instead of TLS client certificates. Each request carries the id of the key
+// it was signed with, the time it was signed, the SHA-256 of its body and an HMAC-SHA256 with the
+// secret of the key over the canonical request:
+//
+//	LONGTAIL-HMAC-SHA256
+//	<method>
+//	<host>
+//	<escaped path>
+//	<query, sorted by key and value>
+//	<Range header>
+//	<date header>
+//	<content hash header>
+//
+// joined by newlines. The signature is hex encoded. Servers written in Go can check requests with
+// VerifySignedRequest.
+const (
+	SignatureKeyIDHeader       = "X-Longtail-Key-Id"
+	SignatureDateHeader        = "X-Longtail-Date"
+	SignatureContentHashHeader = "X-Longtail-Content-Sha256"
+	SignatureHeader            = "X-Longtail-Signature"
+)
+
+const signatureAlgorithm = "LONGTAIL-HMAC-SHA256"
+
+// signatureDateFormat is the format of SignatureDateHeader, the time is in UTC
+const signatureDateFormat = "20060102T150405Z"
+
+// requestHost returns the host the request is sent to or was received on
+func requestHost(r *http.Request) string {
+	if r.Host != "" {
+		return r.Host
+	}
+	return r.URL.Host
+}
+
+// canonicalQuery returns the query of u with the keys and values sorted
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// requestSignature returns the hex encoded signature of r with secret, the date and content hash
+// headers must be set
+func requestSignature(r *http.Request, secret []byte) string {
+	canonical := strings.Join([]string{
+		signatureAlgorithm,
+		r.Method,
+		requestHost(r),
+		r.URL.EscapedPath(),
+		canonicalQuery(r.URL),
+		r.Header.Get("Range"),
+		r.Header.Get(SignatureDateHeader),
+		r.Header.Get(SignatureContentHashHeader)}, "\n")
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readRequestBody returns the body of r and puts it back so it can be read again
+func readRequestBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// SignRequest adds the signature headers for the key keyID with secret to r, signed at now
+func SignRequest(r *http.Request, keyID string, secret []byte, now time.Time) error {
+	body, err := readRequestBody(r)
+	if err != nil {
+		return errors.Wrap(err, "SignRequest")
+	}
+	contentHash := sha256.Sum256(body)
+	r.Header.Set(SignatureKeyIDHeader, keyID)
+	r.Header.Set(SignatureDateHeader, now.UTC().Format(signatureDateFormat))
+	r.Header.Set(SignatureContentHashHeader, hex.EncodeToString(contentHash[:]))
+	r.Header.Set(SignatureHeader, requestSignature(r, secret))
+	return nil
+}
+
+// VerifySignedRequest checks the signature of a request signed with SignRequest and returns the
+// id of the key it was signed with. secret returns the secret of a key id, false for an unknown
+// key. Requests signed more than maxSkew before or after now are refused so a captured request
+// can not be replayed later. The body of r is read and put back.
+func VerifySignedRequest(r *http.Request, secret func(keyID string) ([]byte, bool), maxSkew time.Duration, now time.Time) (string, error) {
+	keyID := r.Header.Get(SignatureKeyIDHeader)
+	signature := r.Header.Get(SignatureHeader)
+	if keyID == "" || signature == "" {
+		return "", fmt.Errorf("VerifySignedRequest: the request is not signed")
+	}
+	key, ok := secret(keyID)
+	if !ok {
+		return "", fmt.Errorf("VerifySignedRequest: unknown key `%s`", keyID)
+	}
+	signed, err := time.Parse(signatureDateFormat, r.Header.Get(SignatureDateHeader))
+	if err != nil {
+		return "", errors.Wrap(err, "VerifySignedRequest: invalid date")
+	}
+	if signed.Before(now.Add(-maxSkew)) || signed.After(now.Add(maxSkew)) {
+		return "", fmt.Errorf("VerifySignedRequest: the request was signed at %s, more than %v from now", signed.Format(time.RFC3339), maxSkew)
+	}
+	if !hmac.Equal([]byte(signature), []byte(requestSignature(r, key))) {
+		return "", fmt.Errorf("VerifySignedRequest: bad signature for key `%s`", keyID)
+	}
+	body, err := readRequestBody(r)
+	if err != nil {
+		return "", errors.Wrap(err, "VerifySignedRequest")
+	}
+	contentHash := sha256.Sum256(body)
+	if r.Header.Get(SignatureContentHashHeader) != hex.EncodeToString(contentHash[:]) {
+		return "", fmt.Errorf("VerifySignedRequest: the body does not match its signed hash")
+	}
+	return keyID, nil
+}
+
+// signingTransport signs the requests of an HTTP blob store, see WithRequestSigning
+type signingTransport struct {
+	base   http.RoundTripper
+	keyID  string
+	secret []byte
+}
+
+func (t *signingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	err := SignRequest(r, t.keyID, t.secret, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(r)
+}
+
+// newSigningRoundTripper returns base, wrapped to sign requests if options has a signing key
+func newSigningRoundTripper(base http.RoundTripper, options StoreOptions) http.RoundTripper {
+	if options.RequestSigningKeyID == "" {
+		return base
+	}
+	return &signingTransport{base: base, keyID: options.RequestSigningKeyID, secret: options.RequestSigningSecret}
+}
@@ -0,0 +1,82 @@
+package longtailstorelib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	secrets := map[string][]byte{"client-1": []byte("the secret")}
+	secret := func(keyID string) ([]byte, bool) {
+		s, ok := secrets[keyID]
+		return s, ok
+	}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	newRequest := func() *http.Request {
+		r, _ := http.NewRequest(http.MethodPut, "https://blocks.example.com/store/chunks/0a1b/0a1b2c.lsb?b=2&a=1", strings.NewReader("block data"))
+		r.Header.Set("Range", "bytes=0-9")
+		if err := SignRequest(r, "client-1", secrets["client-1"], now); err != nil {
+			t.Fatalf("TestSignRequest() SignRequest() %v != %v", err, nil)
+		}
+		return r
+	}
+
+	keyID, err := VerifySignedRequest(newRequest(), secret, time.Minute, now.Add(30*time.Second))
+	if err != nil || keyID != "client-1" {
+		t.Errorf("TestSignRequest() VerifySignedRequest() %s, %v", keyID, err)
+	}
+
+	tampered := map[string]func(r *http.Request){
+		"path":     func(r *http.Request) { r.URL.Path = "/store/chunks/0a1b/other.lsb" },
+		"query":    func(r *http.Request) { r.URL.RawQuery = "a=1&b=3" },
+		"range":    func(r *http.Request) { r.Header.Set("Range", "bytes=0-99") },
+		"method":   func(r *http.Request) { r.Method = http.MethodDelete },
+		"body":     func(r *http.Request) { r.Body = http.NoBody },
+		"key":      func(r *http.Request) { r.Header.Set(SignatureKeyIDHeader, "client-2") },
+		"unsigned": func(r *http.Request) { r.Header.Del(SignatureHeader) },
+	}
+	for name, tamper := range tampered {
+		r := newRequest()
+		tamper(r)
+		if _, err := VerifySignedRequest(r, secret, time.Minute, now); err == nil {
+			t.Errorf("TestSignRequest() VerifySignedRequest() accepted request with changed %s", name)
+		}
+	}
+	// A request that was signed too long ago is refused
+	if _, err := VerifySignedRequest(newRequest(), secret, time.Minute, now.Add(2*time.Minute)); err == nil {
+		t.Errorf("TestSignRequest() VerifySignedRequest() accepted an old request")
+	}
+}
+
+func TestCDNRequestSigning(t *testing.T) {
+	secret := []byte("the secret")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := VerifySignedRequest(r, func(keyID string) ([]byte, bool) { return secret, keyID == "client-1" }, time.Minute, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("block"))
+	}))
+	defer server.Close()
+
+	for keyID, ok := range map[string]bool{"client-1": true, "client-2": false} {
+		cdnStore, err := newCDNBlobStore(server.URL+"/store", WithRequestSigning(keyID, secret))
+		if err != nil {
+			t.Fatalf("TestCDNRequestSigning() newCDNBlobStore() %v != %v", err, nil)
+		}
+		client, _ := cdnStore.NewClient(context.Background())
+		object, _ := client.NewObject("chunks/0a1b/0a1b2c.lsb")
+		data, err := object.Read()
+		if ok && (err != nil || string(data) != "block") {
+			t.Errorf("TestCDNRequestSigning() Read() %s `%s`, %v", keyID, string(data), err)
+		}
+		if !ok && err == nil {
+			t.Errorf("TestCDNRequestSigning() Read() %s accepted", keyID)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package longtailstorelib
+
+import (
+	"context"
+	"sort"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// SizeReportVersion is a version of a store to attribute the size of the store to in a
+// StoreSizeReport, usually named by the path of its version index
+type SizeReportVersion struct {
+	Name        string
+	ChunkHashes []uint64
+}
+
+// VersionSizeStats is the part of a store that a version uses. Sizes are the stored, compressed,
+// sizes of the blocks.
+type VersionSizeStats struct {
+	Name       string
+	BlockCount uint64
+	Size       uint64
+	// UniqueBlockCount and UniqueSize are the blocks that no other version uses, what prune
+	// reclaims when only this version is deleted
+	UniqueBlockCount uint64
+	UniqueSize       uint64
+}
+
+// ReclaimStep is a version to delete in StoreSizeReport.ReclaimOrder
+type ReclaimStep struct {
+	Name string
+	// ReclaimedSize is the size of the blocks that deleting the version frees after the versions of
+	// the steps before it have been deleted, TotalReclaimedSize includes the steps before it and
+	// the unreferenced blocks
+	ReclaimedSize      uint64
+	TotalReclaimedSize uint64
+}
+
+// StoreSizeReport attributes the blocks in the store index of a store to versions, see
+// CreateStoreSizeReport
+type StoreSizeReport struct {
+	BlockCount uint64
+	Size       uint64
+	// UnreferencedBlockCount and UnreferencedSize are the blocks that none of the versions use,
+	// prune with all versions reclaims them
+	UnreferencedBlockCount uint64
+	UnreferencedSize       uint64
+	// MissingBlockCount is the number of blocks in the store index that are not in the store,
+	// they are counted with size 0
+	MissingBlockCount uint64
+	// Versions is sorted by UniqueSize, largest first
+	Versions []VersionSizeStats
+	// ReclaimOrder deletes all versions, each step picks the version that frees the most. The
+	// versions to delete to reclaim a size are the steps up to the first with a TotalReclaimedSize
+	// of at least that size, see VersionsToReclaim.
+	ReclaimOrder []ReclaimStep
+}
+
+// VersionsToReclaim returns the names of the versions to delete to reclaim size bytes, following
+// ReclaimOrder. All versions are returned if size can not be reclaimed.
+func (r StoreSizeReport) VersionsToReclaim(size uint64) []string {
+	names := []string{}
+	if r.UnreferencedSize >= size {
+		return names
+	}
+	for _, step := range r.ReclaimOrder {
+		names = append(names, step.Name)
+		if step.TotalReclaimedSize >= size {
+			break
+		}
+	}
+	return names
+}
+
+// readStoredBlockSizes returns the size of the blobs of the blocks of a store, including packed blocks
+func readStoredBlockSizes(ctx context.Context, blobClient BlobClient) (map[uint64]uint64, error) {
+	layout, err := readBlockLayout(blobClient)
+	if err != nil {
+		return nil, err
+	}
+	blockSizes := map[uint64]uint64{}
+	err = forEachObject(ctx, blobClient, "chunks/", func(blob BlobProperties) error {
+		if blockHash, ok := layout.parseBlockPath(blob.Name); ok && blob.Size > 0 {
+			blockSizes[blockHash] = uint64(blob.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	packs, err := readPackIndex(blobClient)
+	if err != nil {
+		return nil, err
+	}
+	for blockHash, location := range packs.locations() {
+		blockSizes[blockHash] = uint64(location.size)
+	}
+	return blockSizes, nil
+}
+
+// CreateStoreSizeReport attributes the blocks in the store index of blobStore to versions to show
+// what deleting versions, and then pruning the store, reclaims. A block is used by a version if it
+// holds any of the chunks of the version, like PruneStore keeps it. The store index is read and the
+// blocks are listed, no blocks are downloaded.
+func CreateStoreSizeReport(ctx context.Context, blobStore BlobStore, versions []SizeReportVersion) (StoreSizeReport, error) {
+	report := StoreSizeReport{}
+	blobClient, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, blobStore.String())
+	}
+	defer blobClient.Close()
+	storeIndex, err := readStoreIndexObject(blobClient, "store.lsi")
+	if err != nil {
+		return report, errors.Wrapf(err, "CreateStoreSizeReport: %s", blobStore.String())
+	}
+	if !storeIndex.IsValid() {
+		return report, errors.Wrapf(longtaillib.ErrENOENT, "CreateStoreSizeReport: %s has no store index", blobStore.String())
+	}
+	defer storeIndex.Dispose()
+	storedSizes, err := readStoredBlockSizes(ctx, blobClient)
+	if err != nil {
+		return report, errors.Wrapf(err, "CreateStoreSizeReport: %s", blobStore.String())
+	}
+
+	blockHashes := storeIndex.GetBlockHashes()
+	blockChunksOffsets := storeIndex.GetBlockChunksOffsets()
+	blockChunkCounts := storeIndex.GetBlockChunkCounts()
+	storeChunkHashes := storeIndex.GetChunkHashes()
+	chunkBlocks := map[uint64]int{}
+	blockSizes := make([]uint64, len(blockHashes))
+	for b, blockHash := range blockHashes {
+		start := blockChunksOffsets[b]
+		for _, chunkHash := range storeChunkHashes[start : start+blockChunkCounts[b]] {
+			chunkBlocks[chunkHash] = b
+		}
+		size, stored := storedSizes[blockHash]
+		if !stored {
+			report.MissingBlockCount++
+		}
+		blockSizes[b] = size
+		report.BlockCount++
+		report.Size += size
+	}
+
+	// owners are the indexes in versions of the versions that use each block
+	owners := make([][]int, len(blockHashes))
+	versionBlocks := make([][]int, len(versions))
+	for v, version := range versions {
+		for _, chunkHash := range version.ChunkHashes {
+			b, exists := chunkBlocks[chunkHash]
+			if !exists {
+				continue
+			}
+			if n := len(owners[b]); n > 0 && owners[b][n-1] == v {
+				continue
+			}
+			owners[b] = append(owners[b], v)
+			versionBlocks[v] = append(versionBlocks[v], b)
+		}
+	}
+
+	// uniqueSizes is the size that deleting each remaining version frees
+	uniqueSizes := make([]uint64, len(versions))
+	for b, blockOwners := range owners {
+		switch len(blockOwners) {
+		case 0:
+			report.UnreferencedBlockCount++
+			report.UnreferencedSize += blockSizes[b]
+		case 1:
+			uniqueSizes[blockOwners[0]] += blockSizes[b]
+		}
+	}
+	for v, version := range versions {
+		stats := VersionSizeStats{Name: version.Name, BlockCount: uint64(len(versionBlocks[v])), UniqueSize: uniqueSizes[v]}
+		for _, b := range versionBlocks[v] {
+			stats.Size += blockSizes[b]
+			if len(owners[b]) == 1 {
+				stats.UniqueBlockCount++
+			}
+		}
+		report.Versions = append(report.Versions, stats)
+	}
+	sort.SliceStable(report.Versions, func(i, j int) bool { return report.Versions[i].UniqueSize > report.Versions[j].UniqueSize })
+
+	// Delete the versions one at a time, a block that is left with one user adds to what deleting
+	// that user frees
+	refCounts := make([]int, len(blockHashes))
+	for b := range owners {
+		refCounts[b] = len(owners[b])
+	}
+	deleted := make([]bool, len(versions))
+	reclaimed := report.UnreferencedSize
+	for range versions {
+		next := -1
+		for v := range versions {
+			if !deleted[v] && (next == -1 || uniqueSizes[v] > uniqueSizes[next]) {
+				next = v
+			}
+		}
+		deleted[next] = true
+		reclaimed += uniqueSizes[next]
+		report.ReclaimOrder = append(report.ReclaimOrder, ReclaimStep{Name: versions[next].Name, ReclaimedSize: uniqueSizes[next], TotalReclaimedSize: reclaimed})
+		for _, b := range versionBlocks[next] {
+			refCounts[b]--
+			if refCounts[b] != 1 {
+				continue
+			}
+			for _, v := range owners[b] {
+				if !deleted[v] {
+					uniqueSizes[v] += blockSizes[b]
+				}
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,56 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestCreateStoreSizeReport(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	// The block of seed 0 is only used by "a", 10 by "a" and "b", 20 by "b" and "c" and 30 by none
+	blobStore := createDedupTestStore(t, jobs, []uint8{0, 10, 20, 30})
+
+	report, err := CreateStoreSizeReport(context.Background(), blobStore, []SizeReportVersion{
+		{Name: "a", ChunkHashes: []uint64{1, 11, 12}},
+		{Name: "b", ChunkHashes: []uint64{11, 21, 99}},
+		{Name: "c", ChunkHashes: []uint64{21}}})
+	if err != nil {
+		t.Fatalf("TestCreateStoreSizeReport() CreateStoreSizeReport() %v != %v", err, nil)
+	}
+	if report.BlockCount != 4 || report.Size == 0 || report.MissingBlockCount != 0 || report.UnreferencedBlockCount != 1 || report.UnreferencedSize == 0 {
+		t.Errorf("TestCreateStoreSizeReport() report %v", report)
+	}
+	if len(report.Versions) != 3 {
+		t.Fatalf("TestCreateStoreSizeReport() report.Versions %v", report.Versions)
+	}
+	a := report.Versions[0]
+	if a.Name != "a" || a.BlockCount != 2 || a.UniqueBlockCount != 1 || a.UniqueSize == 0 || a.Size <= a.UniqueSize {
+		t.Errorf("TestCreateStoreSizeReport() report.Versions[0] %v", a)
+	}
+	for _, version := range report.Versions[1:] {
+		if version.UniqueBlockCount != 0 || version.UniqueSize != 0 {
+			t.Errorf("TestCreateStoreSizeReport() report.Versions %v", version)
+		}
+	}
+
+	// Once "a" is deleted "b" is the only user of the block of seed 10
+	if len(report.ReclaimOrder) != 3 || report.ReclaimOrder[0].Name != "a" || report.ReclaimOrder[1].Name != "b" || report.ReclaimOrder[2].Name != "c" {
+		t.Fatalf("TestCreateStoreSizeReport() report.ReclaimOrder %v", report.ReclaimOrder)
+	}
+	if report.ReclaimOrder[0].TotalReclaimedSize != report.UnreferencedSize+a.UniqueSize || report.ReclaimOrder[1].ReclaimedSize == 0 || report.ReclaimOrder[2].TotalReclaimedSize != report.Size {
+		t.Errorf("TestCreateStoreSizeReport() report.ReclaimOrder %v", report.ReclaimOrder)
+	}
+	if names := report.VersionsToReclaim(report.UnreferencedSize); len(names) != 0 {
+		t.Errorf("TestCreateStoreSizeReport() VersionsToReclaim(%d) %v", report.UnreferencedSize, names)
+	}
+	if names := report.VersionsToReclaim(report.UnreferencedSize + 1); len(names) != 1 || names[0] != "a" {
+		t.Errorf("TestCreateStoreSizeReport() VersionsToReclaim(%d) %v", report.UnreferencedSize+1, names)
+	}
+	if names := report.VersionsToReclaim(report.Size + 1); len(names) != 3 {
+		t.Errorf("TestCreateStoreSizeReport() VersionsToReclaim(%d) %v", report.Size+1, names)
+	}
+}
@@ -0,0 +1,131 @@
+package longtailstorelib
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// statsRateWindow is the period the rates of GetDetailedStats are averaged over
+const statsRateWindow = 5 * time.Second
+
+// DetailedStats holds the counters of GetStats together with rates and the current load of the store
+type DetailedStats struct {
+	// Backend is the name of the blob store of the store
+	Backend string
+	Stats   longtaillib.BlockStoreStats
+	// Window is the period the rates are measured over, zero until GetDetailedStats has been called twice
+	Window                 time.Duration
+	UploadBytesPerSecond   float64
+	DownloadBytesPerSecond float64
+	PutBlocksPerSecond     float64
+	GetBlocksPerSecond     float64
+	// PutsInFlight and GetsInFlight are the block requests currently being sent to the backend
+	PutsInFlight int64
+	GetsInFlight int64
+	// The queue depths are the requests waiting for a free worker
+	PutQueueDepth      int
+	GetQueueDepth      int
+	PrefetchQueueDepth int
+	PrefetchMemory     int64
+	MaxPrefetchMemory  int64
+	// Memory is the memory held by the store against its cap, see WithMaxMemory
+	Memory MemoryStats
+	// FetchDedup are the block requests that were served by another fetch of the same block
+	FetchDedup FetchDedupStats
+	// Queues is the backpressure of the put, get, prefetch, block index and decode queues
+	Queues []QueueStats
+	// WorkerPools is the load of the worker pools, one shared pool or an upload and a download pool,
+	// and the decode pool
+	WorkerPools []WorkerPoolStats
+	// Latencies are the latency histograms of the operations made so far, ordered by operation and backend
+	Latencies []LatencyHistogram
+}
+
+// DetailedStatsProvider is implemented by block stores that can report live transfer rates.
+// The rates are measured between calls so poll it regularly, for example once a second.
+type DetailedStatsProvider interface {
+	GetDetailedStats() DetailedStats
+}
+
+type rateSample struct {
+	time   time.Time
+	values []uint64
+}
+
+// rateWindow turns polled counters into rates averaged over the window
+type rateWindow struct {
+	sync.Mutex
+	window  time.Duration
+	samples []rateSample
+}
+
+// add records the counter values at now and returns their rates per second since the oldest
+// sample in the window together with the measured period
+func (w *rateWindow) add(now time.Time, values []uint64) ([]float64, time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	cutoff := now.Add(-w.window)
+	for len(w.samples) > 1 && !w.samples[1].time.After(cutoff) {
+		w.samples = w.samples[1:]
+	}
+	w.samples = append(w.samples, rateSample{time: now, values: values})
+
+	rates := make([]float64, len(values))
+	oldest := w.samples[0]
+	period := now.Sub(oldest.time)
+	if period <= 0 {
+		return rates, 0
+	}
+	for i, value := range values {
+		if value >= oldest.values[i] {
+			rates[i] = float64(value-oldest.values[i]) / period.Seconds()
+		}
+	}
+	return rates, period
+}
+
+func loadBlockStoreStats(stats *longtaillib.BlockStoreStats) longtaillib.BlockStoreStats {
+	var result longtaillib.BlockStoreStats
+	for i := range stats.StatU64 {
+		result.StatU64[i] = atomic.LoadUint64(&stats.StatU64[i])
+	}
+	return result
+}
+
+// GetDetailedStats ...
+func (s *remoteStore) GetDetailedStats() DetailedStats {
+	stats := loadBlockStoreStats(&s.stats)
+	rates, window := s.statsRates.add(time.Now(), []uint64{
+		stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Byte_Count],
+		stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Byte_Count],
+		stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count],
+		stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Count]})
+	return DetailedStats{
+		Backend:                s.blobStore.String(),
+		Stats:                  stats,
+		Window:                 window,
+		UploadBytesPerSecond:   rates[0],
+		DownloadBytesPerSecond: rates[1],
+		PutBlocksPerSecond:     rates[2],
+		GetBlocksPerSecond:     rates[3],
+		PutsInFlight:           atomic.LoadInt64(&s.putsInFlight),
+		GetsInFlight:           atomic.LoadInt64(&s.getsInFlight),
+		PutQueueDepth:          len(s.putBlockChan),
+		GetQueueDepth:          len(s.getBlockChan),
+		PrefetchQueueDepth:     len(s.prefetchBlockChan),
+		PrefetchMemory:         atomic.LoadInt64(&s.prefetchMemory),
+		MaxPrefetchMemory:      s.maxPrefetchMemory,
+		Memory:                 s.memory.stats(),
+		FetchDedup:             s.fetchDedup.stats(),
+		Queues: []QueueStats{
+			s.putQueue.stats(QueuePut, len(s.putBlockChan), cap(s.putBlockChan)),
+			s.getQueue.stats(QueueGet, len(s.getBlockChan), cap(s.getBlockChan)),
+			s.prefetchQueue.stats(QueuePrefetch, len(s.prefetchBlockChan), cap(s.prefetchBlockChan)),
+			s.blockIndexQueue.stats(QueueBlockIndex, len(s.blockIndexChan), cap(s.blockIndexChan)),
+			s.decodeQueue.stats(QueueDecode, len(s.decodeBlockChan), cap(s.decodeBlockChan))},
+		WorkerPools: s.workerPoolStats(),
+		Latencies:   s.latencies.get()}
+}
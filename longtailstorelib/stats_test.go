@@ -0,0 +1,78 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestRateWindow(t *testing.T) {
+	w := rateWindow{window: 5 * time.Second}
+	start := time.Now()
+	rates, period := w.add(start, []uint64{100})
+	if rates[0] != 0 || period != 0 {
+		t.Errorf("TestRateWindow() first sample %v, %v != 0, 0", rates[0], period)
+	}
+	rates, period = w.add(start.Add(2*time.Second), []uint64{300})
+	if rates[0] != 100 || period != 2*time.Second {
+		t.Errorf("TestRateWindow() second sample %v, %v != 100, 2s", rates[0], period)
+	}
+	w.add(start.Add(4*time.Second), []uint64{500})
+	// The sample at 2s is the newest one at least a window old and becomes the base
+	rates, period = w.add(start.Add(8*time.Second), []uint64{500})
+	if rates[0] != 200.0/6.0 || period != 6*time.Second {
+		t.Errorf("TestRateWindow() windowed sample %v, %v != %v, 6s", rates[0], period, 200.0/6.0)
+	}
+	rates, _ = w.add(start.Add(20*time.Second), []uint64{500})
+	if rates[0] != 0 {
+		t.Errorf("TestRateWindow() idle sample %v != 0", rates[0])
+	}
+}
+
+func TestGetDetailedStats(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestGetDetailedStats() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+	provider := remoteStore.(DetailedStatsProvider)
+
+	stats := provider.GetDetailedStats()
+	if stats.Window != 0 || stats.UploadBytesPerSecond != 0 {
+		t.Errorf("TestGetDetailedStats() initial rates %+v", stats)
+	}
+	if stats.MaxPrefetchMemory == 0 {
+		t.Errorf("TestGetDetailedStats() MaxPrefetchMemory %d == 0", stats.MaxPrefetchMemory)
+	}
+
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Fatalf("TestGetDetailedStats() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+	if errno != 0 {
+		t.Fatalf("TestGetDetailedStats() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	storedBlock.Dispose()
+	time.Sleep(10 * time.Millisecond)
+
+	stats = provider.GetDetailedStats()
+	if stats.Window <= 0 {
+		t.Errorf("TestGetDetailedStats() Window %v <= 0", stats.Window)
+	}
+	if stats.Stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count] != 1 {
+		t.Errorf("TestGetDetailedStats() PutStoredBlock_Count %d != 1", stats.Stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_PutStoredBlock_Count])
+	}
+	if stats.UploadBytesPerSecond <= 0 || stats.DownloadBytesPerSecond <= 0 {
+		t.Errorf("TestGetDetailedStats() rates %v, %v <= 0", stats.UploadBytesPerSecond, stats.DownloadBytesPerSecond)
+	}
+	if stats.PutsInFlight != 0 || stats.GetsInFlight != 0 {
+		t.Errorf("TestGetDetailedStats() in flight %d, %d != 0, 0", stats.PutsInFlight, stats.GetsInFlight)
+	}
+}
@@ -0,0 +1,128 @@
+package longtailstorelib
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// StoreIndexDiff is the difference between the blocks of two store indexes, the blocks to copy to
+// and delete from a mirror that holds the blocks of the old index to make it hold those of the new
+type StoreIndexDiff struct {
+	// Added are the blocks of the new index that are not in the old index, sorted
+	Added []uint64 `json:"added"`
+	// Removed are the blocks of the old index that are not in the new index, sorted
+	Removed []uint64 `json:"removed"`
+}
+
+// IsEmpty returns true if both indexes have the same blocks
+func (diff StoreIndexDiff) IsEmpty() bool {
+	return len(diff.Added) == 0 && len(diff.Removed) == 0
+}
+
+// StoreIndexSnapshot is the set of blocks of a store index at a generation, a mirror keeps the
+// snapshot of its last update to find the blocks that changed since without reading its own index
+type StoreIndexSnapshot struct {
+	Store string `json:"store"`
+	// Generation is the backend generation of the store index, zero if the backend has none
+	Generation  int64    `json:"generation,omitempty"`
+	BlockHashes []uint64 `json:"blockHashes"`
+}
+
+// DiffBlockHashes returns the blocks to add and remove to go from oldBlockHashes to newBlockHashes
+func DiffBlockHashes(oldBlockHashes []uint64, newBlockHashes []uint64) StoreIndexDiff {
+	oldBlocks := make(map[uint64]bool, len(oldBlockHashes))
+	for _, blockHash := range oldBlockHashes {
+		oldBlocks[blockHash] = true
+	}
+	newBlocks := make(map[uint64]bool, len(newBlockHashes))
+	diff := StoreIndexDiff{Added: []uint64{}, Removed: []uint64{}}
+	for _, blockHash := range newBlockHashes {
+		if newBlocks[blockHash] {
+			continue
+		}
+		newBlocks[blockHash] = true
+		if !oldBlocks[blockHash] {
+			diff.Added = append(diff.Added, blockHash)
+		}
+	}
+	for blockHash := range oldBlocks {
+		if !newBlocks[blockHash] {
+			diff.Removed = append(diff.Removed, blockHash)
+		}
+	}
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i] < diff.Added[j] })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i] < diff.Removed[j] })
+	return diff
+}
+
+// DiffStoreIndexes returns the blocks to add and remove to go from oldIndex to newIndex, an
+// invalid store index has no blocks
+func DiffStoreIndexes(oldIndex longtaillib.Longtail_StoreIndex, newIndex longtaillib.Longtail_StoreIndex) StoreIndexDiff {
+	var oldBlockHashes, newBlockHashes []uint64
+	if oldIndex.IsValid() {
+		oldBlockHashes = oldIndex.GetBlockHashes()
+	}
+	if newIndex.IsValid() {
+		newBlockHashes = newIndex.GetBlockHashes()
+	}
+	return DiffBlockHashes(oldBlockHashes, newBlockHashes)
+}
+
+// DiffStoreIndexSnapshots returns the blocks to add and remove to go from oldSnapshot to
+// newSnapshot, the diff is empty without comparing the blocks if both are the same generation of
+// the same store
+func DiffStoreIndexSnapshots(oldSnapshot StoreIndexSnapshot, newSnapshot StoreIndexSnapshot) StoreIndexDiff {
+	if oldSnapshot.Generation != 0 && oldSnapshot.Generation == newSnapshot.Generation && oldSnapshot.Store == newSnapshot.Store {
+		return StoreIndexDiff{Added: []uint64{}, Removed: []uint64{}}
+	}
+	return DiffBlockHashes(oldSnapshot.BlockHashes, newSnapshot.BlockHashes)
+}
+
+// ReadStoreIndexSnapshot returns the blocks of the store index of blobStore and its generation, a
+// store without a store index has no blocks
+func ReadStoreIndexSnapshot(ctx context.Context, blobStore BlobStore) (StoreIndexSnapshot, error) {
+	client, err := blobStore.NewClient(ctx)
+	if err != nil {
+		return StoreIndexSnapshot{}, errors.Wrap(err, "ReadStoreIndexSnapshot")
+	}
+	defer client.Close()
+	// The generation is read first so a store index that changes while it is read gives a
+	// snapshot that differs from the next one
+	snapshot := StoreIndexSnapshot{Store: blobStore.String(), Generation: getIndexGeneration(client), BlockHashes: []uint64{}}
+	storeIndex, err := readStoreIndexObject(client, "store.lsi")
+	if err != nil {
+		return StoreIndexSnapshot{}, errors.Wrap(err, "ReadStoreIndexSnapshot")
+	}
+	if storeIndex.IsValid() {
+		snapshot.BlockHashes = append(snapshot.BlockHashes, storeIndex.GetBlockHashes()...)
+		storeIndex.Dispose()
+	}
+	return snapshot, nil
+}
+
+// ReadStoreIndexSnapshotFromURI reads a snapshot written by WriteStoreIndexSnapshotToURI
+func ReadStoreIndexSnapshotFromURI(uri string, opts ...StoreOption) (StoreIndexSnapshot, error) {
+	data, err := ReadFromURI(uri, opts...)
+	if err != nil {
+		return StoreIndexSnapshot{}, errors.Wrap(err, "ReadStoreIndexSnapshotFromURI")
+	}
+	var snapshot StoreIndexSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return StoreIndexSnapshot{}, errors.Wrapf(err, "ReadStoreIndexSnapshotFromURI: invalid snapshot `%s`", uri)
+	}
+	return snapshot, nil
+}
+
+// WriteStoreIndexSnapshotToURI writes snapshot as JSON to uri
+func WriteStoreIndexSnapshotToURI(uri string, snapshot StoreIndexSnapshot, opts ...StoreOption) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return errors.Wrap(err, "WriteStoreIndexSnapshotToURI")
+	}
+	return WriteToURI(uri, data, opts...)
+}
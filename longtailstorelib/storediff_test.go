@@ -0,0 +1,85 @@
+package longtailstorelib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestDiffBlockHashes(t *testing.T) {
+	diff := DiffBlockHashes([]uint64{5, 1, 3, 3}, []uint64{4, 3, 2, 4})
+	if len(diff.Added) != 2 || diff.Added[0] != 2 || diff.Added[1] != 4 {
+		t.Errorf("TestDiffBlockHashes() DiffBlockHashes() added %v != %v", diff.Added, []uint64{2, 4})
+	}
+	if len(diff.Removed) != 2 || diff.Removed[0] != 1 || diff.Removed[1] != 5 {
+		t.Errorf("TestDiffBlockHashes() DiffBlockHashes() removed %v != %v", diff.Removed, []uint64{1, 5})
+	}
+	if diff.IsEmpty() || !DiffBlockHashes([]uint64{1, 2}, []uint64{2, 1}).IsEmpty() {
+		t.Errorf("TestDiffBlockHashes() IsEmpty()")
+	}
+
+	// The same generation of the same store has not changed
+	oldSnapshot := StoreIndexSnapshot{Store: "gs://a/store", Generation: 7, BlockHashes: []uint64{1}}
+	newSnapshot := StoreIndexSnapshot{Store: "gs://a/store", Generation: 7, BlockHashes: []uint64{1, 2}}
+	if !DiffStoreIndexSnapshots(oldSnapshot, newSnapshot).IsEmpty() {
+		t.Errorf("TestDiffBlockHashes() DiffStoreIndexSnapshots() same generation not empty")
+	}
+	newSnapshot.Generation = 8
+	diff = DiffStoreIndexSnapshots(oldSnapshot, newSnapshot)
+	if len(diff.Added) != 1 || diff.Added[0] != 2 || len(diff.Removed) != 0 {
+		t.Errorf("TestDiffBlockHashes() DiffStoreIndexSnapshots() %+v", diff)
+	}
+}
+
+func TestStoreIndexSnapshot(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+
+	blobStore, _ := NewTestBlobStore("the_path")
+	empty, err := ReadStoreIndexSnapshot(context.Background(), blobStore)
+	if err != nil || len(empty.BlockHashes) != 0 {
+		t.Fatalf("TestStoreIndexSnapshot() ReadStoreIndexSnapshot() empty %v, %+v", err, empty)
+	}
+
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestStoreIndexSnapshot() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	putTestBlock(t, storeAPI, 101, []uint64{1, 2})
+	putTestBlock(t, storeAPI, 102, []uint64{3})
+	errno := flushSync(storeAPI)
+	storeAPI.Dispose()
+	if errno != 0 {
+		t.Fatalf("TestStoreIndexSnapshot() flushSync() %d != %d", errno, 0)
+	}
+
+	snapshot, err := ReadStoreIndexSnapshot(context.Background(), blobStore)
+	if err != nil || snapshot.Store != blobStore.String() {
+		t.Fatalf("TestStoreIndexSnapshot() ReadStoreIndexSnapshot() %v, %+v", err, snapshot)
+	}
+	diff := DiffStoreIndexSnapshots(empty, snapshot)
+	if len(diff.Added) != 2 || diff.Added[0] != 101 || diff.Added[1] != 102 || len(diff.Removed) != 0 {
+		t.Errorf("TestStoreIndexSnapshot() DiffStoreIndexSnapshots() %+v", diff)
+	}
+
+	snapshotFolder, err := ioutil.TempDir("", "longtail_storediff_test")
+	if err != nil {
+		t.Fatalf("TestStoreIndexSnapshot() ioutil.TempDir() %v != %v", err, nil)
+	}
+	defer os.RemoveAll(snapshotFolder)
+	snapshotPath := filepath.ToSlash(filepath.Join(snapshotFolder, "snapshot.json"))
+	err = WriteStoreIndexSnapshotToURI(snapshotPath, snapshot)
+	if err != nil {
+		t.Fatalf("TestStoreIndexSnapshot() WriteStoreIndexSnapshotToURI() %v != %v", err, nil)
+	}
+	read, err := ReadStoreIndexSnapshotFromURI(snapshotPath)
+	if err != nil || !DiffStoreIndexSnapshots(read, snapshot).IsEmpty() {
+		t.Errorf("TestStoreIndexSnapshot() ReadStoreIndexSnapshotFromURI() %v, %+v", err, read)
+	}
+}
@@ -0,0 +1,50 @@
+package storeformat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+)
+
+// The store index written by the remote stores is followed by a footer with the CRC-64 of the
+// index, its length and StoreIndexFooterMagic. Readers of the store index that do not know the
+// footer ignore it as it comes after the data described by the header.
+const (
+	StoreIndexFooterMagic = "LSIXSUM1"
+	StoreIndexFooterSize  = 24
+)
+
+// ErrChecksumMismatch is returned when a store index does not match the checksum in its footer
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var storeIndexCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// AppendStoreIndexFooter returns the store index data followed by its footer
+func AppendStoreIndexFooter(data []byte) []byte {
+	footer := make([]byte, StoreIndexFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], crc64.Checksum(data, storeIndexCRCTable))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(data)))
+	copy(footer[16:], StoreIndexFooterMagic)
+	return append(data, footer...)
+}
+
+// CheckStoreIndexFooter returns the store index data without its footer and whether it had a
+// footer. A store index without a footer, written by an older version, is returned as is.
+func CheckStoreIndexFooter(data []byte) ([]byte, bool, error) {
+	if len(data) < StoreIndexFooterSize || !bytes.Equal(data[len(data)-8:], []byte(StoreIndexFooterMagic)) {
+		return data, false, nil
+	}
+	footer := data[len(data)-StoreIndexFooterSize:]
+	index := data[:len(data)-StoreIndexFooterSize]
+	length := binary.LittleEndian.Uint64(footer[8:])
+	if length != uint64(len(index)) {
+		return nil, true, fmt.Errorf("%w: %d bytes before the footer, the footer expects %d", ErrTruncated, len(index), length)
+	}
+	checksum := binary.LittleEndian.Uint64(footer[0:])
+	if actual := crc64.Checksum(index, storeIndexCRCTable); actual != checksum {
+		return nil, true, fmt.Errorf("%w: 0x%016x, the footer expects 0x%016x", ErrChecksumMismatch, actual, checksum)
+	}
+	return index, true, nil
+}
@@ -0,0 +1,50 @@
+package storeformat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// BlockLayoutKey is the object recording the block layout of a store, stores without it use DefaultBlockLayout
+const BlockLayoutKey = "layout.json"
+
+// BlockLayoutVersion is the newest block layout version this package can read
+const BlockLayoutVersion = 1
+
+// BlockLayout is the content of layout.json, blocks are stored as chunks/<prefix>/.../0x<block hash>.lsb
+// with PrefixDepth prefix directories, each named by the next PrefixWidth hex digits of the block hash
+type BlockLayout struct {
+	Version     int `json:"version"`
+	PrefixDepth int `json:"prefixDepth"`
+	PrefixWidth int `json:"prefixWidth"`
+}
+
+// DefaultBlockLayout is chunks/<4 hex digits>/0x<block hash>.lsb, used by stores that do not record a layout
+var DefaultBlockLayout = BlockLayout{Version: BlockLayoutVersion, PrefixDepth: 1, PrefixWidth: 4}
+
+// ReadBlockLayout reads the content of layout.json
+func ReadBlockLayout(data []byte) (BlockLayout, error) {
+	var layout BlockLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return BlockLayout{}, fmt.Errorf("%s is malformed: %w", BlockLayoutKey, err)
+	}
+	if layout.Version < 1 || layout.Version > BlockLayoutVersion {
+		return BlockLayout{}, fmt.Errorf("%w: block layout version %d", ErrUnsupportedVersion, layout.Version)
+	}
+	if layout.PrefixDepth < 0 || layout.PrefixDepth > 4 || (layout.PrefixDepth > 0 && (layout.PrefixWidth < 1 || layout.PrefixWidth > 4)) {
+		return BlockLayout{}, fmt.Errorf("block layout prefix depth %d width %d is out of range", layout.PrefixDepth, layout.PrefixWidth)
+	}
+	return layout, nil
+}
+
+// BlockPath returns the path of the block with blockHash under basePath
+func (layout BlockLayout) BlockPath(basePath string, blockHash uint64) string {
+	hex := fmt.Sprintf("%016x", blockHash)
+	parts := []string{basePath}
+	for d := 0; d < layout.PrefixDepth; d++ {
+		parts = append(parts, hex[d*layout.PrefixWidth:(d+1)*layout.PrefixWidth])
+	}
+	parts = append(parts, "0x"+hex+".lsb")
+	return strings.Join(parts, "/")
+}
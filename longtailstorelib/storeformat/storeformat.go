@@ -0,0 +1,354 @@
+// Package storeformat reads the store index (.lsi), version index (.lvi) and block (.lsb) files
+// of a longtail store without cgo, so services that only inspect stores do not need the native
+// library. It splits blocks into their header and their compressed chunk data but does not
+// decompress, see the webrestore package for restoring content without longtaillib.
+package storeformat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The format versions this package reads the full content of, the headers are read for any version
+const (
+	StoreIndexVersion   = 1 << 24
+	VersionIndexVersion = 2
+)
+
+// ErrUnsupportedVersion is returned for indexes in a format version this package does not know the layout of
+var ErrUnsupportedVersion = errors.New("unsupported format version")
+
+// ErrTruncated is returned when the data is shorter than the counts in its header require
+var ErrTruncated = errors.New("truncated data")
+
+// StoreIndexHeader is the fixed size start of a store index
+type StoreIndexHeader struct {
+	Version        uint32
+	HashIdentifier uint32
+	BlockCount     uint32
+	ChunkCount     uint32
+}
+
+// StoreIndex is the content of a store index, the chunks of block b are
+// ChunkHashes[BlockChunksOffsets[b]:BlockChunksOffsets[b]+BlockChunkCounts[b]]
+type StoreIndex struct {
+	StoreIndexHeader
+	BlockHashes        []uint64
+	ChunkHashes        []uint64
+	BlockChunksOffsets []uint32
+	BlockChunkCounts   []uint32
+	BlockTags          []uint32
+	ChunkSizes         []uint32
+}
+
+// VersionIndexHeader is the fixed size start of a version index
+type VersionIndexHeader struct {
+	Version              uint32
+	HashIdentifier       uint32
+	TargetChunkSize      uint32
+	AssetCount           uint32
+	ChunkCount           uint32
+	AssetChunkIndexCount uint32
+}
+
+// VersionIndex is the content of a version index, the chunks of asset a are
+// AssetChunkIndexes[AssetChunkIndexStarts[a]:AssetChunkIndexStarts[a]+AssetChunkCounts[a]]
+type VersionIndex struct {
+	VersionIndexHeader
+	PathHashes            []uint64
+	AssetHashes           []uint64
+	AssetSizes            []uint64
+	AssetChunkCounts      []uint32
+	AssetChunkIndexStarts []uint32
+	AssetChunkIndexes     []uint32
+	ChunkHashes           []uint64
+	ChunkSizes            []uint32
+	ChunkTags             []uint32
+	AssetPaths            []string
+	AssetPermissions      []uint16
+}
+
+// BlockHeader is the block index at the start of a block, the chunk data follows it, see ReadBlock
+type BlockHeader struct {
+	BlockHash      uint64
+	HashIdentifier uint32
+	ChunkCount     uint32
+	// Tag is the compression type of the chunk data
+	Tag         uint32
+	ChunkHashes []uint64
+	ChunkSizes  []uint32
+}
+
+// reader reads little endian values and fails once the data runs out
+type reader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *reader) take(size int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if size < 0 || len(r.data)-r.offset < size {
+		r.err = fmt.Errorf("%w: %d bytes needed at offset %d of %d", ErrTruncated, size, r.offset, len(r.data))
+		return nil
+	}
+	b := r.data[r.offset : r.offset+size]
+	r.offset += size
+	return b
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *reader) uint64() uint64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *reader) uint16s(count uint32) []uint16 {
+	b := r.take(int(count) * 2)
+	values := make([]uint16, len(b)/2)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+	return values
+}
+
+func (r *reader) uint32s(count uint32) []uint32 {
+	b := r.take(int(count) * 4)
+	values := make([]uint32, len(b)/4)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return values
+}
+
+func (r *reader) uint64s(count uint32) []uint64 {
+	b := r.take(int(count) * 8)
+	values := make([]uint64, len(b)/8)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint64(b[i*8:])
+	}
+	return values
+}
+
+// IsStoreIndexVersion tells store index format versions, which are tagged in the high byte, from
+// version index format versions, which count from 1
+func IsStoreIndexVersion(version uint32) bool {
+	return version >= 1<<24
+}
+
+// ReadStoreIndexHeader reads the header of a store index in any format version
+func ReadStoreIndexHeader(data []byte) (StoreIndexHeader, error) {
+	r := &reader{data: data}
+	header := StoreIndexHeader{
+		Version:        r.uint32(),
+		HashIdentifier: r.uint32(),
+		BlockCount:     r.uint32(),
+		ChunkCount:     r.uint32()}
+	if r.err != nil {
+		return StoreIndexHeader{}, r.err
+	}
+	if !IsStoreIndexVersion(header.Version) {
+		return StoreIndexHeader{}, fmt.Errorf("version %d is not a store index format version", header.Version)
+	}
+	return header, nil
+}
+
+// ReadStoreIndex reads a store index in StoreIndexVersion, the checksum in the footer of the
+// store index is verified if it has one, see CheckStoreIndexFooter
+func ReadStoreIndex(data []byte) (*StoreIndex, error) {
+	data, _, err := CheckStoreIndexFooter(data)
+	if err != nil {
+		return nil, err
+	}
+	header, err := ReadStoreIndexHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version != StoreIndexVersion {
+		return nil, fmt.Errorf("%w: store index version 0x%08x", ErrUnsupportedVersion, header.Version)
+	}
+	r := &reader{data: data, offset: 16}
+	storeIndex := &StoreIndex{
+		StoreIndexHeader:   header,
+		BlockHashes:        r.uint64s(header.BlockCount),
+		ChunkHashes:        r.uint64s(header.ChunkCount),
+		BlockChunksOffsets: r.uint32s(header.BlockCount),
+		BlockChunkCounts:   r.uint32s(header.BlockCount),
+		BlockTags:          r.uint32s(header.BlockCount),
+		ChunkSizes:         r.uint32s(header.ChunkCount)}
+	if r.err != nil {
+		return nil, r.err
+	}
+	for b, offset := range storeIndex.BlockChunksOffsets {
+		if uint64(offset)+uint64(storeIndex.BlockChunkCounts[b]) > uint64(header.ChunkCount) {
+			return nil, fmt.Errorf("chunks of block 0x%016x are outside of the %d chunks of the store index", storeIndex.BlockHashes[b], header.ChunkCount)
+		}
+	}
+	return storeIndex, nil
+}
+
+// ReadVersionIndexHeader reads the header of a version index in any format version
+func ReadVersionIndexHeader(data []byte) (VersionIndexHeader, error) {
+	r := &reader{data: data}
+	header := VersionIndexHeader{
+		Version:              r.uint32(),
+		HashIdentifier:       r.uint32(),
+		TargetChunkSize:      r.uint32(),
+		AssetCount:           r.uint32(),
+		ChunkCount:           r.uint32(),
+		AssetChunkIndexCount: r.uint32()}
+	if r.err != nil {
+		return VersionIndexHeader{}, r.err
+	}
+	if IsStoreIndexVersion(header.Version) || header.Version == 0 {
+		return VersionIndexHeader{}, fmt.Errorf("version %d is not a version index format version", header.Version)
+	}
+	return header, nil
+}
+
+// ReadVersionIndex reads a version index in VersionIndexVersion
+func ReadVersionIndex(data []byte) (*VersionIndex, error) {
+	header, err := ReadVersionIndexHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version != VersionIndexVersion {
+		return nil, fmt.Errorf("%w: version index version %d", ErrUnsupportedVersion, header.Version)
+	}
+	r := &reader{data: data, offset: 24}
+	versionIndex := &VersionIndex{
+		VersionIndexHeader:    header,
+		PathHashes:            r.uint64s(header.AssetCount),
+		AssetHashes:           r.uint64s(header.AssetCount),
+		AssetSizes:            r.uint64s(header.AssetCount),
+		AssetChunkCounts:      r.uint32s(header.AssetCount),
+		AssetChunkIndexStarts: r.uint32s(header.AssetCount),
+		AssetChunkIndexes:     r.uint32s(header.AssetChunkIndexCount),
+		ChunkHashes:           r.uint64s(header.ChunkCount),
+		ChunkSizes:            r.uint32s(header.ChunkCount),
+		ChunkTags:             r.uint32s(header.ChunkCount)}
+	nameOffsets := r.uint32s(header.AssetCount)
+	versionIndex.AssetPermissions = r.uint16s(header.AssetCount)
+	if r.err != nil {
+		return nil, r.err
+	}
+	nameData := data[r.offset:]
+	versionIndex.AssetPaths = make([]string, header.AssetCount)
+	for a, offset := range nameOffsets {
+		if int(offset) >= len(nameData) {
+			return nil, fmt.Errorf("%w: path of asset %d at offset %d of %d", ErrTruncated, a, offset, len(nameData))
+		}
+		end := int(offset)
+		for end < len(nameData) && nameData[end] != 0 {
+			end++
+		}
+		versionIndex.AssetPaths[a] = string(nameData[offset:end])
+	}
+	for a, start := range versionIndex.AssetChunkIndexStarts {
+		if uint64(start)+uint64(versionIndex.AssetChunkCounts[a]) > uint64(header.AssetChunkIndexCount) {
+			return nil, fmt.Errorf("chunks of asset `%s` are outside of the %d asset chunk indexes", versionIndex.AssetPaths[a], header.AssetChunkIndexCount)
+		}
+	}
+	for _, chunkIndex := range versionIndex.AssetChunkIndexes {
+		if chunkIndex >= header.ChunkCount {
+			return nil, fmt.Errorf("chunk index %d is outside of the %d chunks of the version index", chunkIndex, header.ChunkCount)
+		}
+	}
+	return versionIndex, nil
+}
+
+// ReadBlockHeader reads the block index at the start of a block file, data may be cut off after
+// the header so only the start of a block needs to be downloaded, see BlockHeaderSize
+func ReadBlockHeader(data []byte) (BlockHeader, error) {
+	r := &reader{data: data}
+	header := BlockHeader{
+		BlockHash:      r.uint64(),
+		HashIdentifier: r.uint32(),
+		ChunkCount:     r.uint32(),
+		Tag:            r.uint32()}
+	header.ChunkHashes = r.uint64s(header.ChunkCount)
+	header.ChunkSizes = r.uint32s(header.ChunkCount)
+	if r.err != nil {
+		return BlockHeader{}, r.err
+	}
+	return header, nil
+}
+
+// BlockHeaderSize returns the size of the block header of a block with chunkCount chunks
+func BlockHeaderSize(chunkCount uint32) int {
+	return 20 + int(chunkCount)*12
+}
+
+// BlockData is the chunk data following the header of a block
+type BlockData struct {
+	// UncompressedSize is the size of the chunk data once decompressed, the sum of the chunk sizes
+	UncompressedSize uint32
+	// Data is the chunk data compressed with the algorithm given by the tag of the block, or the
+	// chunk data itself for blocks tagged NoCompression
+	Data []byte
+}
+
+// ReadBlock reads a full block file and returns its header and its chunk data
+func ReadBlock(data []byte) (BlockHeader, BlockData, error) {
+	header, err := ReadBlockHeader(data)
+	if err != nil {
+		return BlockHeader{}, BlockData{}, err
+	}
+	uncompressedSize := uint64(0)
+	for _, size := range header.ChunkSizes {
+		uncompressedSize += uint64(size)
+	}
+	r := &reader{data: data, offset: BlockHeaderSize(header.ChunkCount)}
+	if header.Tag == NoCompression {
+		blockData := BlockData{UncompressedSize: uint32(uncompressedSize), Data: r.take(int(uncompressedSize))}
+		if r.err != nil {
+			return BlockHeader{}, BlockData{}, r.err
+		}
+		return header, blockData, nil
+	}
+	blockData := BlockData{UncompressedSize: r.uint32()}
+	blockData.Data = r.take(int(r.uint32()))
+	if r.err != nil {
+		return BlockHeader{}, BlockData{}, r.err
+	}
+	if uint64(blockData.UncompressedSize) != uncompressedSize {
+		return BlockHeader{}, BlockData{}, fmt.Errorf("block 0x%016x has %d bytes of chunk data, its chunks add up to %d", header.BlockHash, blockData.UncompressedSize, uncompressedSize)
+	}
+	return header, blockData, nil
+}
+
+// NoCompression is the tag of blocks and chunks that are stored uncompressed
+const NoCompression = 0
+
+// CompressionAlgorithm returns "none", "brotli", "lz4", "zstd" or "adaptive" for a block or chunk tag, the
+// tags of the compression levels of an algorithm all decompress the same way. Unknown tags
+// return an empty string.
+func CompressionAlgorithm(tag uint32) string {
+	if tag == NoCompression {
+		return "none"
+	}
+	switch tag >> 8 {
+	case 0x62746c:
+		return "brotli"
+	case 0x6c7a34:
+		return "lz4"
+	case 0x7a7464:
+		return "zstd"
+	case 0x616474:
+		return "adaptive"
+	}
+	return ""
+}
@@ -0,0 +1,230 @@
+package storeformat
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// The tests write indexes and blocks with the native library and check that they read back the same
+
+func TestReadStoreIndex(t *testing.T) {
+	var blockIndexes []longtaillib.Longtail_BlockIndex
+	for b := uint64(1); b <= 3; b++ {
+		blockIndex, errno := longtaillib.CreateBlockIndex(0x1000+b, longtaillib.GetBlake3HashIdentifier(), uint32(b), []uint64{b * 10, b*10 + 1}, []uint32{uint32(b) * 100, uint32(b)*100 + 1})
+		if errno != 0 {
+			t.Fatalf("TestReadStoreIndex() longtaillib.CreateBlockIndex() %d != %d", errno, 0)
+		}
+		defer blockIndex.Dispose()
+		blockIndexes = append(blockIndexes, blockIndex)
+	}
+	nativeIndex, errno := longtaillib.CreateStoreIndexFromBlocks(blockIndexes)
+	if errno != 0 {
+		t.Fatalf("TestReadStoreIndex() longtaillib.CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer nativeIndex.Dispose()
+	data, _ := longtaillib.WriteStoreIndexToBuffer(nativeIndex)
+
+	storeIndex, err := ReadStoreIndex(data)
+	if err != nil {
+		t.Fatalf("TestReadStoreIndex() ReadStoreIndex() %v != %v", err, nil)
+	}
+	if storeIndex.Version != nativeIndex.GetVersion() || storeIndex.HashIdentifier != nativeIndex.GetHashIdentifier() || storeIndex.BlockCount != 3 || storeIndex.ChunkCount != 6 {
+		t.Errorf("TestReadStoreIndex() ReadStoreIndex() header %+v", storeIndex.StoreIndexHeader)
+	}
+	if !reflect.DeepEqual(storeIndex.BlockHashes, nativeIndex.GetBlockHashes()) ||
+		!reflect.DeepEqual(storeIndex.ChunkHashes, nativeIndex.GetChunkHashes()) ||
+		!reflect.DeepEqual(storeIndex.BlockChunksOffsets, nativeIndex.GetBlockChunksOffsets()) ||
+		!reflect.DeepEqual(storeIndex.BlockChunkCounts, nativeIndex.GetBlockChunkCounts()) ||
+		!reflect.DeepEqual(storeIndex.BlockTags, nativeIndex.GetBlockTags()) ||
+		!reflect.DeepEqual(storeIndex.ChunkSizes, nativeIndex.GetChunkSizes()) {
+		t.Errorf("TestReadStoreIndex() ReadStoreIndex() %+v", storeIndex)
+	}
+
+	if _, err := ReadStoreIndex(data[:len(data)-1]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("TestReadStoreIndex() ReadStoreIndex() truncated %v", err)
+	}
+	if _, err := ReadStoreIndexHeader(data[:16]); err != nil {
+		t.Errorf("TestReadStoreIndex() ReadStoreIndexHeader() %v != %v", err, nil)
+	}
+	newer := append([]byte{}, data...)
+	newer[3] = 2
+	if _, err := ReadStoreIndex(newer); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("TestReadStoreIndex() ReadStoreIndex() newer version %v", err)
+	}
+	if _, err := ReadVersionIndexHeader(data); err == nil {
+		t.Errorf("TestReadStoreIndex() ReadVersionIndexHeader() of store index %v == %v", err, nil)
+	}
+}
+
+func TestCheckStoreIndexFooter(t *testing.T) {
+	nativeIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	if errno != 0 {
+		t.Fatalf("TestCheckStoreIndexFooter() longtaillib.CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer nativeIndex.Dispose()
+	data, _ := longtaillib.WriteStoreIndexToBuffer(nativeIndex)
+	withFooter := AppendStoreIndexFooter(append([]byte{}, data...))
+
+	index, hasFooter, err := CheckStoreIndexFooter(withFooter)
+	if err != nil || !hasFooter || !reflect.DeepEqual(index, data) {
+		t.Errorf("TestCheckStoreIndexFooter() CheckStoreIndexFooter() %t, %v", hasFooter, err)
+	}
+	if _, err := ReadStoreIndex(withFooter); err != nil {
+		t.Errorf("TestCheckStoreIndexFooter() ReadStoreIndex() %v != %v", err, nil)
+	}
+	// Store indexes written by older versions have no footer
+	index, hasFooter, err = CheckStoreIndexFooter(data)
+	if err != nil || hasFooter || !reflect.DeepEqual(index, data) {
+		t.Errorf("TestCheckStoreIndexFooter() CheckStoreIndexFooter() legacy %t, %v", hasFooter, err)
+	}
+	corrupt := append([]byte{}, withFooter...)
+	corrupt[4] ^= 0x01
+	if _, err := ReadStoreIndex(corrupt); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("TestCheckStoreIndexFooter() ReadStoreIndex() corrupt %v", err)
+	}
+	truncated := append(append([]byte{}, withFooter[:4]...), withFooter[len(withFooter)-StoreIndexFooterSize:]...)
+	if _, _, err := CheckStoreIndexFooter(truncated); !errors.Is(err, ErrTruncated) {
+		t.Errorf("TestCheckStoreIndexFooter() CheckStoreIndexFooter() truncated %v", err)
+	}
+}
+
+func TestReadVersionIndex(t *testing.T) {
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+	hashAPI, _ := hashRegistry.GetHashAPI(longtaillib.GetBlake3HashIdentifier())
+	assetPaths := []string{"folder/", "folder/a.txt", "b.bin"}
+	pathHashes := make([]uint64, len(assetPaths))
+	for a, path := range assetPaths {
+		pathHashes[a], _ = hashAPI.GetPathHash(path)
+	}
+	nativeIndex, errno := longtaillib.BuildVersionIndex(
+		longtaillib.GetBlake3HashIdentifier(),
+		32768,
+		assetPaths,
+		[]uint64{0, 30, 50},
+		[]uint16{0755, 0644, 0600},
+		pathHashes,
+		[]uint64{0, 0xa, 0xb},
+		[]uint32{0, 0, 2},
+		[]uint32{0, 2, 2},
+		[]uint32{0, 1, 1, 2},
+		[]uint64{0xc0, 0xc1, 0xc2},
+		[]uint32{10, 20, 30},
+		[]uint32{0, 0, 7})
+	if errno != 0 {
+		t.Fatalf("TestReadVersionIndex() longtaillib.BuildVersionIndex() %d != %d", errno, 0)
+	}
+	defer nativeIndex.Dispose()
+	data, _ := longtaillib.WriteVersionIndexToBuffer(nativeIndex)
+
+	versionIndex, err := ReadVersionIndex(data)
+	if err != nil {
+		t.Fatalf("TestReadVersionIndex() ReadVersionIndex() %v != %v", err, nil)
+	}
+	if versionIndex.Version != nativeIndex.GetVersion() || versionIndex.TargetChunkSize != 32768 || versionIndex.AssetCount != 3 || versionIndex.ChunkCount != 3 {
+		t.Errorf("TestReadVersionIndex() ReadVersionIndex() header %+v", versionIndex.VersionIndexHeader)
+	}
+	for a := uint32(0); a < nativeIndex.GetAssetCount(); a++ {
+		if versionIndex.AssetPaths[a] != nativeIndex.GetAssetPath(a) || versionIndex.AssetPermissions[a] != nativeIndex.GetAssetPermissions(a) {
+			t.Errorf("TestReadVersionIndex() ReadVersionIndex() asset %d `%s` %o", a, versionIndex.AssetPaths[a], versionIndex.AssetPermissions[a])
+		}
+	}
+	if !reflect.DeepEqual(versionIndex.PathHashes, pathHashes) ||
+		!reflect.DeepEqual(versionIndex.AssetHashes, nativeIndex.GetAssetHashes()) ||
+		!reflect.DeepEqual(versionIndex.AssetSizes, nativeIndex.GetAssetSizes()) ||
+		!reflect.DeepEqual(versionIndex.AssetChunkCounts, nativeIndex.GetAssetChunkCounts()) ||
+		!reflect.DeepEqual(versionIndex.AssetChunkIndexStarts, nativeIndex.GetAssetChunkIndexStarts()) ||
+		!reflect.DeepEqual(versionIndex.AssetChunkIndexes, nativeIndex.GetAssetChunkIndexes()) ||
+		!reflect.DeepEqual(versionIndex.ChunkHashes, nativeIndex.GetChunkHashes()) ||
+		!reflect.DeepEqual(versionIndex.ChunkSizes, nativeIndex.GetChunkSizes()) ||
+		!reflect.DeepEqual(versionIndex.ChunkTags, nativeIndex.GetChunkTags()) {
+		t.Errorf("TestReadVersionIndex() ReadVersionIndex() %+v", versionIndex)
+	}
+
+	if _, err := ReadVersionIndex(data[:100]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("TestReadVersionIndex() ReadVersionIndex() truncated %v", err)
+	}
+	if _, err := ReadStoreIndexHeader(data); err == nil {
+		t.Errorf("TestReadVersionIndex() ReadStoreIndexHeader() of version index %v == %v", err, nil)
+	}
+}
+
+func TestReadBlockHeader(t *testing.T) {
+	storedBlock, errno := longtaillib.CreateStoredBlock(0xdeadbeef, longtaillib.GetBlake3HashIdentifier(), 9, []uint64{1, 2}, []uint32{3, 4}, make([]byte, 7), false)
+	if errno != 0 {
+		t.Fatalf("TestReadBlockHeader() longtaillib.CreateStoredBlock() %d != %d", errno, 0)
+	}
+	defer storedBlock.Dispose()
+	data, _ := longtaillib.WriteStoredBlockToBuffer(storedBlock)
+
+	header, err := ReadBlockHeader(data[:BlockHeaderSize(2)])
+	if err != nil {
+		t.Fatalf("TestReadBlockHeader() ReadBlockHeader() %v != %v", err, nil)
+	}
+	expected := BlockHeader{BlockHash: 0xdeadbeef, HashIdentifier: longtaillib.GetBlake3HashIdentifier(), ChunkCount: 2, Tag: 9, ChunkHashes: []uint64{1, 2}, ChunkSizes: []uint32{3, 4}}
+	if !reflect.DeepEqual(header, expected) {
+		t.Errorf("TestReadBlockHeader() ReadBlockHeader() %+v != %+v", header, expected)
+	}
+	if len(data) != BlockHeaderSize(2)+7 {
+		t.Errorf("TestReadBlockHeader() BlockHeaderSize() %d != %d", BlockHeaderSize(2)+7, len(data))
+	}
+	if _, err := ReadBlockHeader(data[:BlockHeaderSize(2)-1]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("TestReadBlockHeader() ReadBlockHeader() truncated %v", err)
+	}
+}
+
+func TestReadBlock(t *testing.T) {
+	storedBlock, _ := longtaillib.CreateStoredBlock(0xdeadbeef, longtaillib.GetBlake3HashIdentifier(), longtaillib.GetNoCompressionType(), []uint64{1, 2}, []uint32{3, 4}, []byte("abcdefg"), false)
+	defer storedBlock.Dispose()
+	data, _ := longtaillib.WriteStoredBlockToBuffer(storedBlock)
+	_, blockData, err := ReadBlock(data)
+	if err != nil || blockData.UncompressedSize != 7 || string(blockData.Data) != "abcdefg" {
+		t.Errorf("TestReadBlock() ReadBlock() %+v, %v", blockData, err)
+	}
+	if _, _, err := ReadBlock(data[:len(data)-1]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("TestReadBlock() ReadBlock() truncated %v", err)
+	}
+
+	compressed := []byte{7, 0, 0, 0, 3, 0, 0, 0, 'x', 'y', 'z'}
+	compressedBlock, _ := longtaillib.CreateStoredBlock(0xdeadbeef, longtaillib.GetBlake3HashIdentifier(), longtaillib.GetZStdDefaultCompressionType(), []uint64{1, 2}, []uint32{3, 4}, compressed, false)
+	defer compressedBlock.Dispose()
+	data, _ = longtaillib.WriteStoredBlockToBuffer(compressedBlock)
+	_, blockData, err = ReadBlock(data)
+	if err != nil || blockData.UncompressedSize != 7 || string(blockData.Data) != "xyz" {
+		t.Errorf("TestReadBlock() ReadBlock() compressed %+v, %v", blockData, err)
+	}
+}
+
+func TestCompressionAlgorithm(t *testing.T) {
+	algorithms := map[uint32]string{
+		longtaillib.GetNoCompressionType():               "none",
+		longtaillib.GetBrotliGenericMinCompressionType(): "brotli",
+		longtaillib.GetBrotliTextMaxCompressionType():    "brotli",
+		longtaillib.GetLZ4DefaultCompressionType():       "lz4",
+		longtaillib.GetZStdMinCompressionType():          "zstd",
+		longtaillib.GetZStdMaxCompressionType():          "zstd",
+		0x61647430:                                       "adaptive",
+		0x12345678:                                       "",
+	}
+	for tag, expected := range algorithms {
+		if algorithm := CompressionAlgorithm(tag); algorithm != expected {
+			t.Errorf("TestCompressionAlgorithm() CompressionAlgorithm(0x%08x) %s != %s", tag, algorithm, expected)
+		}
+	}
+}
+
+func TestReadBlockLayout(t *testing.T) {
+	layout, err := ReadBlockLayout([]byte(`{"version":1,"prefixDepth":2,"prefixWidth":3}`))
+	if err != nil || layout.BlockPath("chunks", 0x0123456789abcdef) != "chunks/012/345/0x0123456789abcdef.lsb" {
+		t.Errorf("TestReadBlockLayout() ReadBlockLayout() %+v, %v", layout, err)
+	}
+	if DefaultBlockLayout.BlockPath("chunks", 0x0123456789abcdef) != "chunks/0123/0x0123456789abcdef.lsb" {
+		t.Errorf("TestReadBlockLayout() DefaultBlockLayout.BlockPath() %s", DefaultBlockLayout.BlockPath("chunks", 0x0123456789abcdef))
+	}
+	if _, err := ReadBlockLayout([]byte(`{"version":2,"prefixDepth":1,"prefixWidth":4}`)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("TestReadBlockLayout() ReadBlockLayout() newer version %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package longtailstorelib
+
+import (
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/storeformat"
+	"github.com/pkg/errors"
+)
+
+// readStoreIndexData parses the store index read from key of store, the checksum in its footer is
+// verified first so a damaged store index is reported as a *StoreIndexCorruptError
+func readStoreIndexData(store string, key string, blob []byte) (longtaillib.Longtail_StoreIndex, error) {
+	data, _, err := storeformat.CheckStoreIndexFooter(blob)
+	if err != nil {
+		return longtaillib.Longtail_StoreIndex{}, &StoreIndexCorruptError{Store: store, Key: key, Reason: err}
+	}
+	storeIndex, errno := longtaillib.ReadStoreIndexFromBuffer(data)
+	if errno != 0 {
+		return longtaillib.Longtail_StoreIndex{}, &StoreIndexCorruptError{Store: store, Key: key, Reason: longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)}
+	}
+	return storeIndex, nil
+}
+
+// ReadStoreIndexFromBuffer parses the store index read from uri, like
+// longtaillib.ReadStoreIndexFromBuffer but the checksum in its footer is verified first so a damaged
+// store index is reported as a *StoreIndexCorruptError
+func ReadStoreIndexFromBuffer(uri string, blob []byte) (longtaillib.Longtail_StoreIndex, error) {
+	store, key := splitURI(uri)
+	return readStoreIndexData(RedactStoreURI(store), key, blob)
+}
+
+// writeStoreIndexData serializes the store index followed by the footer with its checksum
+func writeStoreIndexData(storeIndex longtaillib.Longtail_StoreIndex) ([]byte, error) {
+	data, errno := longtaillib.WriteStoreIndexToBuffer(storeIndex)
+	if errno != 0 {
+		return nil, longtaillib.ErrnoToError(errno, longtaillib.ErrENOMEM)
+	}
+	return storeformat.AppendStoreIndexFooter(data), nil
+}
+
+// removeCorruptStoreIndex deletes the store index of client if it is still corrupt so the store
+// index rebuilt from the blocks of the store replaces it rather than being merged with it
+func removeCorruptStoreIndex(client BlobClient) error {
+	key := "store.lsi"
+	objHandle, err := client.NewObject(key)
+	if err != nil {
+		return errors.Wrapf(err, "removeCorruptStoreIndex: client.NewObject(%s) failed", key)
+	}
+	blob, err := objHandle.Read()
+	if err != nil {
+		return errors.Wrapf(err, "removeCorruptStoreIndex: objHandle.Read(%s) failed", key)
+	}
+	if blob == nil {
+		return nil
+	}
+	storeIndex, err := readStoreIndexData(client.String(), key, blob)
+	if err == nil {
+		// Another writer has replaced it already
+		storeIndex.Dispose()
+		return nil
+	}
+	err = objHandle.Delete()
+	if err != nil {
+		return errors.Wrapf(err, "removeCorruptStoreIndex: objHandle.Delete(%s) failed", key)
+	}
+	return nil
+}
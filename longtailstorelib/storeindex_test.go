@@ -0,0 +1,100 @@
+package longtailstorelib
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func corruptStoreIndexObject(t *testing.T, blobStore BlobStore) {
+	client, _ := blobStore.NewClient(context.Background())
+	defer client.Close()
+	object, _ := client.NewObject("store.lsi")
+	blob, err := object.Read()
+	if err != nil || blob == nil {
+		t.Fatalf("corruptStoreIndexObject() object.Read() %v != %v", err, nil)
+	}
+	corrupt := append([]byte{}, blob...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	_, err = object.Write(corrupt)
+	if err != nil {
+		t.Fatalf("corruptStoreIndexObject() object.Write() %v != %v", err, nil)
+	}
+}
+
+func TestCorruptStoreIndex(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blobStore := createDedupTestStore(t, jobs, []uint8{0, 10})
+	corruptStoreIndexObject(t, blobStore)
+
+	client, _ := blobStore.NewClient(context.Background())
+	_, err := readStoreIndexObject(client, "store.lsi")
+	client.Close()
+	if !IsStoreIndexCorrupt(err) {
+		t.Fatalf("TestCorruptStoreIndex() readStoreIndexObject() %v is not a corrupt store index", err)
+	}
+	client, _ = blobStore.NewClient(context.Background())
+	object, _ := client.NewObject("store.lsi")
+	blob, _ := object.Read()
+	client.Close()
+	if _, err := ReadStoreIndexFromBuffer("the_path/store.lsi", blob); !IsStoreIndexCorrupt(err) {
+		t.Errorf("TestCorruptStoreIndex() ReadStoreIndexFromBuffer() %v is not a corrupt store index", err)
+	}
+	if longtaillib.ErrorToErrno(err, longtaillib.EIO) != longtaillib.EBADF {
+		t.Errorf("TestCorruptStoreIndex() longtaillib.ErrorToErrno() %d != %d", longtaillib.ErrorToErrno(err, longtaillib.EIO), longtaillib.EBADF)
+	}
+	_, err = PruneStore(context.Background(), blobStore, []uint64{1}, true)
+	if !IsStoreIndexCorrupt(err) {
+		t.Errorf("TestCorruptStoreIndex() PruneStore() %v is not a corrupt store index", err)
+	}
+
+	chunkHashes := []uint64{1, 2, 11, 13}
+	for _, accessType := range []AccessType{ReadOnly, ReadWrite} {
+		remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", runtime.NumCPU(), accessType)
+		if err != nil {
+			t.Fatalf("TestCorruptStoreIndex() NewRemoteBlockStore() %v != %v", err, nil)
+		}
+		storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+		existingContent, errno := getExistingContent(t, storeAPI, chunkHashes, 0)
+		if errno != 0 || existingContent.GetBlockCount() != 2 {
+			t.Errorf("TestCorruptStoreIndex() getExistingContent() %d blocks, errno %d", existingContent.GetBlockCount(), errno)
+		}
+		existingContent.Dispose()
+		storeAPI.Dispose()
+
+		// Only a read write store replaces the corrupt store index
+		client, _ := blobStore.NewClient(context.Background())
+		storeIndex, err := readStoreIndexObject(client, "store.lsi")
+		client.Close()
+		if accessType == ReadOnly && !IsStoreIndexCorrupt(err) {
+			t.Errorf("TestCorruptStoreIndex() readStoreIndexObject() read only %v is not a corrupt store index", err)
+		}
+		if accessType == ReadWrite {
+			if err != nil || storeIndex.GetBlockCount() != 2 {
+				t.Errorf("TestCorruptStoreIndex() readStoreIndexObject() rebuilt %v != %v", err, nil)
+			}
+			storeIndex.Dispose()
+		}
+	}
+}
+
+func TestRecoverCorruptStoreIndex(t *testing.T) {
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blobStore := createDedupTestStore(t, jobs, []uint8{0, 10})
+	corruptStoreIndexObject(t, blobStore)
+
+	recoveredBlockHashes, err := RecoverStoreIndex(context.Background(), blobStore, false)
+	if err != nil {
+		t.Fatalf("TestRecoverCorruptStoreIndex() RecoverStoreIndex() %v != %v", err, nil)
+	}
+	if len(recoveredBlockHashes) != 2 {
+		t.Errorf("TestRecoverCorruptStoreIndex() RecoverStoreIndex() %d != %d", len(recoveredBlockHashes), 2)
+	}
+	if indexedBlockHashes := getStoreIndexBlockHashes(t, blobStore); len(indexedBlockHashes) != 2 {
+		t.Errorf("TestRecoverCorruptStoreIndex() store index %v", indexedBlockHashes)
+	}
+}
@@ -0,0 +1,93 @@
+package longtailstorelib
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := ParseTLSVersion("1.2")
+	if err != nil {
+		t.Errorf("TestParseTLSVersion() ParseTLSVersion(\"1.2\") %v != %v", err, nil)
+	}
+	if version != tls.VersionTLS12 {
+		t.Errorf("TestParseTLSVersion() ParseTLSVersion(\"1.2\") %d != %d", version, tls.VersionTLS12)
+	}
+	version, err = ParseTLSVersion("")
+	if err != nil || version != 0 {
+		t.Errorf("TestParseTLSVersion() ParseTLSVersion(\"\") %d != %d", version, 0)
+	}
+	_, err = ParseTLSVersion("2.0")
+	if err == nil {
+		t.Errorf("TestParseTLSVersion() ParseTLSVersion(\"2.0\") %v == %v", err, nil)
+	}
+}
+
+func TestTransportRootCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	tmpDir, err := ioutil.TempDir("", "longtail_transport_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rootCAFile := filepath.Join(tmpDir, "root.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = ioutil.WriteFile(rootCAFile, pemData, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := NewHTTPTransport(TransportOptions{})
+	if err != nil {
+		t.Errorf("TestTransportRootCAFile() NewHTTPTransport() %v != %v", err, nil)
+	}
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	if err == nil {
+		t.Errorf("TestTransportRootCAFile() untrusted Get() %v == %v", err, nil)
+	}
+
+	transport, err = NewHTTPTransport(TransportOptions{RootCAFile: rootCAFile, TLSMinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Errorf("TestTransportRootCAFile() NewHTTPTransport() %v != %v", err, nil)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Errorf("TestTransportRootCAFile() trusted Get() %v != %v", err, nil)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	transport, err := NewHTTPTransport(TransportOptions{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Errorf("TestTransportProxy() NewHTTPTransport() %v != %v", err, nil)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://longtail.invalid/store.lsi")
+	if err != nil {
+		t.Errorf("TestTransportProxy() Get() %v != %v", err, nil)
+	} else {
+		resp.Body.Close()
+	}
+	if proxied != "http://longtail.invalid/store.lsi" {
+		t.Errorf("TestTransportProxy() proxied %s != %s", proxied, "http://longtail.invalid/store.lsi")
+	}
+}
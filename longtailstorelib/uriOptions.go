@@ -0,0 +1,454 @@
+package longtailstorelib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/pkg/errors"
+)
+
+// storeOptionParsers parse the store options that can be given as URI query parameters, such as
+// gs://bucket/store?worker-count=8&access-type=read-only, or as LONGTAIL_* environment variables
+// such as LONGTAIL_WORKER_COUNT=8
+var storeOptionParsers = map[string]func(value string) (StoreOption, error){
+	"worker-count": func(value string) (StoreOption, error) {
+		workerCount, err := strconv.Atoi(value)
+		if err != nil || workerCount <= 0 {
+			return nil, fmt.Errorf("invalid worker count `%s`", value)
+		}
+		return WithWorkerCount(workerCount), nil
+	},
+	"access-type": func(value string) (StoreOption, error) {
+		accessType, err := ParseAccessType(value)
+		if err != nil {
+			return nil, err
+		}
+		return WithAccessType(accessType), nil
+	},
+	"max-prefetch-memory": func(value string) (StoreOption, error) {
+		maxPrefetchMemory, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxPrefetchMemory <= 0 {
+			return nil, fmt.Errorf("invalid max prefetch memory `%s`", value)
+		}
+		return WithMaxPrefetchMemory(maxPrefetchMemory), nil
+	},
+	"block-file-threshold": func(value string) (StoreOption, error) {
+		threshold, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("invalid block file threshold `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.BlockFileThreshold = threshold
+		}, nil
+	},
+	"block-file-path": func(value string) (StoreOption, error) {
+		return func(options *StoreOptions) {
+			options.BlockFilePath = value
+		}, nil
+	},
+	"credential-helper": func(value string) (StoreOption, error) {
+		// Store URIs and the environment can come from others, so they can not run commands
+		if value != KeychainCredentialHelper {
+			return nil, fmt.Errorf("invalid credential helper `%s`, only %s can be given in a store URI or LONGTAIL_CREDENTIAL_HELPER", value, KeychainCredentialHelper)
+		}
+		return WithCredentialHelper("", &keychainCredentialHelper{}), nil
+	},
+	"cdn-url": func(value string) (StoreOption, error) {
+		return WithCDN(value), nil
+	},
+	"block-cache-control": func(value string) (StoreOption, error) {
+		return WithBlockCacheControl(value), nil
+	},
+	"put-queue-depth": func(value string) (StoreOption, error) {
+		return parseQueueDepth(value, func(options *StoreOptions, depth int) { options.PutQueueDepth = depth })
+	},
+	"get-queue-depth": func(value string) (StoreOption, error) {
+		return parseQueueDepth(value, func(options *StoreOptions, depth int) { options.GetQueueDepth = depth })
+	},
+	"prefetch-queue-depth": func(value string) (StoreOption, error) {
+		return parseQueueDepth(value, func(options *StoreOptions, depth int) { options.PrefetchQueueDepth = depth })
+	},
+	"block-index-queue-depth": func(value string) (StoreOption, error) {
+		return parseQueueDepth(value, func(options *StoreOptions, depth int) { options.BlockIndexQueueDepth = depth })
+	},
+	"upload-worker-count": func(value string) (StoreOption, error) {
+		return parseWorkerPoolSize(value, func(options *StoreOptions, workerCount int) { options.UploadWorkerCount = workerCount })
+	},
+	"download-worker-count": func(value string) (StoreOption, error) {
+		return parseWorkerPoolSize(value, func(options *StoreOptions, workerCount int) { options.DownloadWorkerCount = workerCount })
+	},
+	"decode-worker-count": func(value string) (StoreOption, error) {
+		return parseWorkerPoolSize(value, func(options *StoreOptions, workerCount int) { options.DecodeWorkerCount = workerCount })
+	},
+	"queue-timeout": func(value string) (StoreOption, error) {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid queue timeout `%s`", value)
+		}
+		return WithQueueTimeout(timeout), nil
+	},
+	"max-retries": func(value string) (StoreOption, error) {
+		maxRetries, err := strconv.Atoi(value)
+		if err != nil || maxRetries < 0 {
+			return nil, fmt.Errorf("invalid max retries `%s`", value)
+		}
+		return WithMaxRetries(maxRetries), nil
+	},
+	"max-concurrent-requests": func(value string) (StoreOption, error) {
+		maxConcurrentRequests, err := strconv.Atoi(value)
+		if err != nil || maxConcurrentRequests < 0 {
+			return nil, fmt.Errorf("invalid max concurrent requests `%s`", value)
+		}
+		return WithMaxConcurrentRequests(maxConcurrentRequests), nil
+	},
+	"max-throttle-backoff": func(value string) (StoreOption, error) {
+		maxBackoff, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max throttle backoff `%s`", value)
+		}
+		return WithMaxThrottleBackoff(maxBackoff), nil
+	},
+	"immutable": func(value string) (StoreOption, error) {
+		immutable, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid immutable `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.Immutable = immutable
+		}, nil
+	},
+	"max-store-bytes": func(value string) (StoreOption, error) {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes < 0 {
+			return nil, fmt.Errorf("invalid max store bytes `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.MaxStoreBytes = maxBytes
+		}, nil
+	},
+	"max-store-blocks": func(value string) (StoreOption, error) {
+		maxBlockCount, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBlockCount < 0 {
+			return nil, fmt.Errorf("invalid max store blocks `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.MaxStoreBlockCount = maxBlockCount
+		}, nil
+	},
+	"conditional-puts": func(value string) (StoreOption, error) {
+		conditionalPuts, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid conditional puts `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.ConditionalPuts = conditionalPuts
+		}, nil
+	},
+	"audit-log": func(value string) (StoreOption, error) {
+		auditLog, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid audit log `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.AuditLog = auditLog
+		}, nil
+	},
+	"requester-pays": func(value string) (StoreOption, error) {
+		requesterPays, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid requester pays `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.RequesterPays = requesterPays
+		}, nil
+	},
+	"anonymous": func(value string) (StoreOption, error) {
+		anonymous, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid anonymous `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.Anonymous = anonymous
+		}, nil
+	},
+	"ipfs-manifest": func(value string) (StoreOption, error) {
+		return WithIPFSManifest(value), nil
+	},
+	"oauth-client-id": func(value string) (StoreOption, error) {
+		return func(options *StoreOptions) {
+			options.OAuthClientID = value
+		}, nil
+	},
+	"oauth-client-secret": func(value string) (StoreOption, error) {
+		return func(options *StoreOptions) {
+			options.OAuthClientSecret = value
+		}, nil
+	},
+	"oauth-token-file": func(value string) (StoreOption, error) {
+		return WithOAuthTokenFile(value), nil
+	},
+	"network-share": func(value string) (StoreOption, error) {
+		networkShare, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network share `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.NetworkShare = networkShare
+		}, nil
+	},
+	"identity": func(value string) (StoreOption, error) {
+		return WithIdentity(value), nil
+	},
+	"signing-key-id": func(value string) (StoreOption, error) {
+		return func(options *StoreOptions) {
+			options.RequestSigningKeyID = value
+		}, nil
+	},
+	"signing-secret-file": func(value string) (StoreOption, error) {
+		secret, err := ioutil.ReadFile(value)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the signing secret")
+		}
+		return func(options *StoreOptions) {
+			options.RequestSigningSecret = bytes.TrimSpace(secret)
+		}, nil
+	},
+	"allowed-regions": func(value string) (StoreOption, error) {
+		regions := []string{}
+		for _, region := range strings.Split(value, ",") {
+			if region = strings.TrimSpace(region); region != "" {
+				regions = append(regions, region)
+			}
+		}
+		if len(regions) == 0 {
+			return nil, fmt.Errorf("invalid allowed regions `%s`", value)
+		}
+		return WithAllowedRegions(regions...), nil
+	},
+	"proxy-url": func(value string) (StoreOption, error) {
+		return WithProxy(value), nil
+	},
+	"root-ca-file": func(value string) (StoreOption, error) {
+		return WithRootCAFile(value), nil
+	},
+	"idle-timeout": func(value string) (StoreOption, error) {
+		idleTimeout, err := time.ParseDuration(value)
+		if err != nil || idleTimeout < 0 {
+			return nil, fmt.Errorf("invalid idle timeout `%s`", value)
+		}
+		return WithIdleHibernation(idleTimeout), nil
+	},
+	"max-memory": func(value string) (StoreOption, error) {
+		maxMemory, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxMemory <= 0 {
+			return nil, fmt.Errorf("invalid max memory `%s`", value)
+		}
+		return WithMaxMemory(maxMemory), nil
+	},
+	"prefetch-window": func(value string) (StoreOption, error) {
+		blocks, err := strconv.Atoi(value)
+		if err != nil || blocks == 0 {
+			return nil, fmt.Errorf("invalid prefetch window `%s`", value)
+		}
+		return WithPrefetchWindow(blocks), nil
+	},
+	"fault-error-rate": func(value string) (StoreOption, error) {
+		return parseFaultRate(value, func(faults *FaultConfig, rate float64) { faults.ErrorRate = rate })
+	},
+	"fault-exists-error-rate": func(value string) (StoreOption, error) {
+		return parseFaultRate(value, func(faults *FaultConfig, rate float64) { faults.ExistsErrorRate = rate })
+	},
+	"fault-partial-write-rate": func(value string) (StoreOption, error) {
+		return parseFaultRate(value, func(faults *FaultConfig, rate float64) { faults.PartialWriteRate = rate })
+	},
+	"fault-stale-read-rate": func(value string) (StoreOption, error) {
+		return parseFaultRate(value, func(faults *FaultConfig, rate float64) { faults.StaleReadRate = rate })
+	},
+	"fault-conflict-rate": func(value string) (StoreOption, error) {
+		return parseFaultRate(value, func(faults *FaultConfig, rate float64) { faults.ConflictRate = rate })
+	},
+	"fault-latency": func(value string) (StoreOption, error) {
+		latency, err := time.ParseDuration(value)
+		if err != nil || latency < 0 {
+			return nil, fmt.Errorf("invalid fault latency `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.Faults.Latency = latency
+		}, nil
+	},
+	"fault-path-prefix": func(value string) (StoreOption, error) {
+		return func(options *StoreOptions) {
+			options.Faults.PathPrefix = value
+		}, nil
+	},
+	"fault-seed": func(value string) (StoreOption, error) {
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault seed `%s`", value)
+		}
+		return func(options *StoreOptions) {
+			options.Faults.Seed = seed
+		}, nil
+	},
+}
+
+// parseFaultRate parses one of the rates of FaultConfig, a probability from 0 to 1
+func parseFaultRate(value string, set func(faults *FaultConfig, rate float64)) (StoreOption, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid fault rate `%s`, expected a value from 0 to 1", value)
+	}
+	return func(options *StoreOptions) {
+		set(&options.Faults, rate)
+	}, nil
+}
+
+// parseQueueDepth parses the depth of one of the queues of WithQueueDepths
+func parseQueueDepth(value string, set func(options *StoreOptions, depth int)) (StoreOption, error) {
+	depth, err := strconv.Atoi(value)
+	if err != nil || depth <= 0 {
+		return nil, fmt.Errorf("invalid queue depth `%s`", value)
+	}
+	return func(options *StoreOptions) {
+		set(options, depth)
+	}, nil
+}
+
+// parseWorkerPoolSize parses the worker count of one of the pools of WithWorkerPools
+func parseWorkerPoolSize(value string, set func(options *StoreOptions, workerCount int)) (StoreOption, error) {
+	workerCount, err := strconv.Atoi(value)
+	if err != nil || workerCount <= 0 {
+		return nil, fmt.Errorf("invalid worker count `%s`", value)
+	}
+	return func(options *StoreOptions) {
+		set(options, workerCount)
+	}, nil
+}
+
+// ParseAccessType parses init, read-write or read-only
+func ParseAccessType(value string) (AccessType, error) {
+	switch value {
+	case "init":
+		return Init, nil
+	case "read-write":
+		return ReadWrite, nil
+	case "read-only":
+		return ReadOnly, nil
+	}
+	return ReadOnly, fmt.Errorf("invalid access type `%s`, expected init, read-write or read-only", value)
+}
+
+// storeOptionEnvar returns the environment variable of a store option, LONGTAIL_WORKER_COUNT for worker-count
+func storeOptionEnvar(name string) string {
+	return "LONGTAIL_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// storeOptionsWithoutEnvar are the store options that are not read from the environment.
+// LONGTAIL_CREDENTIAL_HELPER is the --credential-helper flag of the CLI, which also takes commands.
+var storeOptionsWithoutEnvar = map[string]bool{"credential-helper": true}
+
+// StoreOptionsFromEnvironment returns the store options set with LONGTAIL_* environment variables
+func StoreOptionsFromEnvironment() ([]StoreOption, error) {
+	names := make([]string, 0, len(storeOptionParsers))
+	for name := range storeOptionParsers {
+		if storeOptionsWithoutEnvar[name] {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	opts := []StoreOption{}
+	for _, name := range names {
+		envar := storeOptionEnvar(name)
+		value, ok := os.LookupEnv(envar)
+		if !ok || value == "" {
+			continue
+		}
+		opt, err := storeOptionParsers[name](value)
+		if err != nil {
+			return nil, errors.Wrap(err, envar)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// ParseStoreURI removes the store option query parameters and the credentials, such as in
+// s3://KEY:SECRET@bucket/path, from uri and returns the uri without them together with the
+// options. Unknown query parameters are an error.
+func ParseStoreURI(uri string) (string, []StoreOption, error) {
+	uri, opts, err := parseURICredentials(uri)
+	if err != nil {
+		return "", nil, err
+	}
+	queryStart := strings.LastIndex(uri, "?")
+	if queryStart == -1 {
+		return uri, opts, nil
+	}
+	query, err := url.ParseQuery(uri[queryStart+1:])
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "invalid query in `%s`", uri)
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parser, ok := storeOptionParsers[name]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown store option `%s` in `%s`", name, uri)
+		}
+		for _, value := range query[name] {
+			opt, err := parser(value)
+			if err != nil {
+				return "", nil, errors.Wrapf(err, "store option `%s` in `%s`", name, uri)
+			}
+			opts = append(opts, opt)
+		}
+	}
+	return uri[:queryStart], opts, nil
+}
+
+// resolveStoreURI applies the environment options, then opts and last the options in the query of uri
+func resolveStoreURI(uri string, opts []StoreOption) (string, []StoreOption, error) {
+	envOpts, err := StoreOptionsFromEnvironment()
+	if err != nil {
+		return "", nil, err
+	}
+	uri, uriOpts, err := ParseStoreURI(uri)
+	if err != nil {
+		return "", nil, err
+	}
+	resolved := append(envOpts, opts...)
+	return uri, append(resolved, uriOpts...), nil
+}
+
+// NewRemoteBlockStoreForURI creates the blob store for uri and a remote block store on top of it.
+// Options from LONGTAIL_* environment variables are applied first, then opts and last the options
+// in the query of uri, so tools that only pass a URI can configure the store.
+func NewRemoteBlockStoreForURI(
+	jobAPI longtaillib.Longtail_JobAPI,
+	uri string,
+	optionalStoreIndexPath string,
+	workerCount int,
+	accessType AccessType,
+	opts ...StoreOption) (longtaillib.BlockStoreAPI, error) {
+	uri, resolvedOpts, err := resolveStoreURI(uri, opts)
+	if err != nil {
+		return nil, err
+	}
+	blobStore, err := createBlobStoreForURI(uri, resolvedOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewRemoteBlockStore(jobAPI, blobStore, optionalStoreIndexPath, workerCount, accessType, resolvedOpts...)
+}
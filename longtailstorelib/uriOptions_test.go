@@ -0,0 +1,125 @@
+package longtailstorelib
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestParseStoreURI(t *testing.T) {
+	uri, opts, err := ParseStoreURI("gs://bucket/store?worker-count=4&access-type=read-only&max-retries=0&max-prefetch-memory=1048576")
+	if err != nil {
+		t.Fatalf("TestParseStoreURI() ParseStoreURI() %v != %v", err, nil)
+	}
+	if uri != "gs://bucket/store" {
+		t.Errorf("TestParseStoreURI() uri %s != %s", uri, "gs://bucket/store")
+	}
+	options := newStoreOptions(opts)
+	if options.WorkerCount != 4 || options.AccessType == nil || *options.AccessType != ReadOnly || options.MaxPrefetchMemory != 1048576 {
+		t.Errorf("TestParseStoreURI() options %+v", options)
+	}
+	if options.maxRetries() != 0 {
+		t.Errorf("TestParseStoreURI() maxRetries() %d != %d", options.maxRetries(), 0)
+	}
+
+	_, opts, err = ParseStoreURI("gs://bucket/store?put-queue-depth=16&get-queue-depth=256&prefetch-queue-depth=64&block-index-queue-depth=32&queue-timeout=30s")
+	options = newStoreOptions(opts)
+	if err != nil || options.PutQueueDepth != 16 || options.GetQueueDepth != 256 || options.PrefetchQueueDepth != 64 || options.BlockIndexQueueDepth != 32 || options.QueueTimeout != 30*time.Second {
+		t.Errorf("TestParseStoreURI() ParseStoreURI() queues %+v, %v", options, err)
+	}
+
+	_, opts, err = ParseStoreURI("gs://bucket/store?upload-worker-count=2&download-worker-count=6&decode-worker-count=3&block-file-threshold=8388608&block-file-path=/tmp/blocks")
+	options = newStoreOptions(opts)
+	if err != nil || options.UploadWorkerCount != 2 || options.DownloadWorkerCount != 6 || options.DecodeWorkerCount != 3 || options.BlockFileThreshold != 8388608 || options.BlockFilePath != "/tmp/blocks" {
+		t.Errorf("TestParseStoreURI() ParseStoreURI() worker pools %+v, %v", options, err)
+	}
+
+	_, opts, err = ParseStoreURI("gs://bucket/store?cdn-url=https%3A%2F%2Fcdn.example.com%2Fstore%2F%7Bkey%7D&block-cache-control=public%2C+max-age%3D31536000")
+	options = newStoreOptions(opts)
+	if err != nil || options.CDNURLTemplate != "https://cdn.example.com/store/{key}" || options.BlockCacheControl != "public, max-age=31536000" {
+		t.Errorf("TestParseStoreURI() ParseStoreURI() CDN %+v, %v", options, err)
+	}
+
+	uri, opts, err = ParseStoreURI("local/store")
+	if err != nil || uri != "local/store" || len(opts) != 0 {
+		t.Errorf("TestParseStoreURI() ParseStoreURI(local/store) %s, %d, %v", uri, len(opts), err)
+	}
+	_, _, err = ParseStoreURI("gs://bucket/store?worker-cuont=4")
+	if err == nil {
+		t.Errorf("TestParseStoreURI() ParseStoreURI() unknown option %v == %v", err, nil)
+	}
+	_, opts, err = ParseStoreURI("gs://bucket/store?max-store-bytes=1073741824&max-store-blocks=1000&audit-log=true&identity=ci-job-7")
+	options = newStoreOptions(opts)
+	if err != nil || options.MaxStoreBytes != 1073741824 || options.MaxStoreBlockCount != 1000 || !options.AuditLog || options.Identity != "ci-job-7" {
+		t.Errorf("TestParseStoreURI() ParseStoreURI() quota %+v, %v", options, err)
+	}
+	_, opts, err = ParseStoreURI("s3://bucket/store?requester-pays=true&anonymous=false")
+	if err != nil || !newStoreOptions(opts).RequesterPays || newStoreOptions(opts).Anonymous {
+		t.Errorf("TestParseStoreURI() ParseStoreURI() requester pays %+v, %v", newStoreOptions(opts), err)
+	}
+	_, opts, err = ParseStoreURI("gs://bucket/store?anonymous=true")
+	if err != nil || !newStoreOptions(opts).Anonymous {
+		t.Errorf("TestParseStoreURI() ParseStoreURI() anonymous %+v, %v", newStoreOptions(opts), err)
+	}
+	_, _, err = ParseStoreURI("gs://bucket/store?access-type=write-only")
+	if err == nil {
+		t.Errorf("TestParseStoreURI() ParseStoreURI() invalid access type %v == %v", err, nil)
+	}
+}
+
+func TestStoreOptionsFromEnvironment(t *testing.T) {
+	os.Setenv("LONGTAIL_MAX_RETRIES", "5")
+	defer os.Unsetenv("LONGTAIL_MAX_RETRIES")
+	os.Setenv("LONGTAIL_WORKER_COUNT", "3")
+	defer os.Unsetenv("LONGTAIL_WORKER_COUNT")
+
+	_, opts, err := resolveStoreURI("gs://bucket/store?worker-count=6", []StoreOption{WithMaxRetries(1)})
+	if err != nil {
+		t.Fatalf("TestStoreOptionsFromEnvironment() resolveStoreURI() %v != %v", err, nil)
+	}
+	options := newStoreOptions(opts)
+	// Explicit options override the environment and the URI overrides both
+	if options.maxRetries() != 1 || options.WorkerCount != 6 {
+		t.Errorf("TestStoreOptionsFromEnvironment() options %+v", options)
+	}
+
+	os.Setenv("LONGTAIL_WORKER_COUNT", "none")
+	_, err = StoreOptionsFromEnvironment()
+	if err == nil {
+		t.Errorf("TestStoreOptionsFromEnvironment() StoreOptionsFromEnvironment() %v == %v", err, nil)
+	}
+}
+
+func TestNewRemoteBlockStoreForURI(t *testing.T) {
+	storePath, _ := ioutil.TempDir("", "longtail-uri-options")
+	defer os.RemoveAll(storePath)
+
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	blockStore, err := NewRemoteBlockStoreForURI(jobs, storePath+"?worker-count=2&max-prefetch-memory=1048576", "", runtime.NumCPU(), ReadWrite)
+	if err != nil {
+		t.Fatalf("TestNewRemoteBlockStoreForURI() NewRemoteBlockStoreForURI() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(blockStore)
+	defer storeAPI.Dispose()
+
+	stats := blockStore.(DetailedStatsProvider).GetDetailedStats()
+	if stats.MaxPrefetchMemory != 1048576 {
+		t.Errorf("TestNewRemoteBlockStoreForURI() MaxPrefetchMemory %d != %d", stats.MaxPrefetchMemory, 1048576)
+	}
+	if blockStore.(*remoteStore).workerCount != 2 {
+		t.Errorf("TestNewRemoteBlockStoreForURI() workerCount %d != %d", blockStore.(*remoteStore).workerCount, 2)
+	}
+
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Fatalf("TestNewRemoteBlockStoreForURI() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	if _, err := os.Stat(storePath + "/" + GetBlockPath("chunks", blockHash)); err != nil {
+		t.Errorf("TestNewRemoteBlockStoreForURI() block not stored in %s: %v", storePath, err)
+	}
+}
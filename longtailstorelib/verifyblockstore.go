@@ -0,0 +1,126 @@
+package longtailstorelib
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+// verifyBlockStore re-hashes the chunks of every block fetched from the backing store and
+// fails the request with EBADF if any chunk does not match the hash in the block index.
+// Place it on top of the compression block store so the chunk data is uncompressed.
+//
+// Stats: GetStoredBlock_Count/Chunk_Count/Byte_Count are the verified blocks, chunks and bytes,
+// GetStoredBlock_FailCount is the number of blocks that failed verification.
+type verifyBlockStore struct {
+	backingStore longtaillib.Longtail_BlockStoreAPI
+	hashRegistry longtaillib.Longtail_HashRegistryAPI
+
+	stats longtaillib.BlockStoreStats
+}
+
+type verifyGetStoredBlockCompletionAPI struct {
+	store            *verifyBlockStore
+	blockHash        uint64
+	asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI
+}
+
+// NewVerifyBlockStore ...
+func NewVerifyBlockStore(
+	backingStore longtaillib.Longtail_BlockStoreAPI,
+	hashRegistry longtaillib.Longtail_HashRegistryAPI) longtaillib.BlockStoreAPI {
+	return &verifyBlockStore{backingStore: backingStore, hashRegistry: hashRegistry}
+}
+
+func verifyStoredBlock(
+	hashRegistry longtaillib.Longtail_HashRegistryAPI,
+	blockHash uint64,
+	storedBlock longtaillib.Longtail_StoredBlock) error {
+	blockIndex := storedBlock.GetBlockIndex()
+	if blockIndex.GetBlockHash() != blockHash {
+		return &BlockCorruptError{BlockHash: blockHash, Reason: fmt.Errorf("content has block hash 0x%016x", blockIndex.GetBlockHash())}
+	}
+	hashAPI, errno := hashRegistry.GetHashAPI(blockIndex.GetHashIdentifier())
+	if errno == longtaillib.ENOENT {
+		return &BlockCorruptError{BlockHash: blockHash, Reason: fmt.Errorf("unknown hash identifier 0x%08x", blockIndex.GetHashIdentifier())}
+	}
+	if errno != 0 {
+		return longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
+	}
+	chunkHashes := blockIndex.GetChunkHashes()
+	chunkSizes := blockIndex.GetChunkSizes()
+	blockData := storedBlock.GetChunksBlockData()
+	offset := uint64(0)
+	for i, chunkHash := range chunkHashes {
+		chunkEnd := offset + uint64(chunkSizes[i])
+		if chunkEnd > uint64(len(blockData)) {
+			return &BlockCorruptError{BlockHash: blockHash, Reason: fmt.Errorf("chunk %d of size %d is outside the %d bytes of block data", i, chunkSizes[i], len(blockData))}
+		}
+		hash, errno := hashAPI.HashBuffer(blockData[offset:chunkEnd])
+		if errno != 0 {
+			return longtaillib.ErrnoToError(errno, longtaillib.ErrEIO)
+		}
+		if hash != chunkHash {
+			return &BlockCorruptError{BlockHash: blockHash, Reason: fmt.Errorf("chunk 0x%016x hashes to 0x%016x", chunkHash, hash)}
+		}
+		offset = chunkEnd
+	}
+	return nil
+}
+
+func (a *verifyGetStoredBlockCompletionAPI) OnComplete(storedBlock longtaillib.Longtail_StoredBlock, errno int) {
+	if errno != 0 {
+		a.asyncCompleteAPI.OnComplete(storedBlock, errno)
+		return
+	}
+	s := a.store
+	err := verifyStoredBlock(s.hashRegistry, a.blockHash, storedBlock)
+	if err != nil {
+		atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_FailCount], 1)
+		log.Printf("Verification failed: %v\n", err)
+		storedBlock.Dispose()
+		a.asyncCompleteAPI.OnComplete(longtaillib.Longtail_StoredBlock{}, longtaillib.ErrorToErrno(err, longtaillib.EBADF))
+		return
+	}
+	blockIndex := storedBlock.GetBlockIndex()
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Count], 1)
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Chunk_Count], uint64(blockIndex.GetChunkCount()))
+	atomic.AddUint64(&s.stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Byte_Count], uint64(len(storedBlock.GetChunksBlockData())))
+	a.asyncCompleteAPI.OnComplete(storedBlock, 0)
+}
+
+// PutStoredBlock ...
+func (s *verifyBlockStore) PutStoredBlock(storedBlock longtaillib.Longtail_StoredBlock, asyncCompleteAPI longtaillib.Longtail_AsyncPutStoredBlockAPI) int {
+	return s.backingStore.PutStoredBlock(storedBlock, asyncCompleteAPI)
+}
+
+// PreflightGet ...
+func (s *verifyBlockStore) PreflightGet(blockHashes []uint64, asyncCompleteAPI longtaillib.Longtail_AsyncPreflightStartedAPI) int {
+	return s.backingStore.PreflightGet(blockHashes, asyncCompleteAPI)
+}
+
+// GetStoredBlock ...
+func (s *verifyBlockStore) GetStoredBlock(blockHash uint64, asyncCompleteAPI longtaillib.Longtail_AsyncGetStoredBlockAPI) int {
+	return s.backingStore.GetStoredBlock(blockHash, longtaillib.CreateAsyncGetStoredBlockAPI(&verifyGetStoredBlockCompletionAPI{store: s, blockHash: blockHash, asyncCompleteAPI: asyncCompleteAPI}))
+}
+
+// GetExistingContent ...
+func (s *verifyBlockStore) GetExistingContent(chunkHashes []uint64, minBlockUsagePercent uint32, asyncCompleteAPI longtaillib.Longtail_AsyncGetExistingContentAPI) int {
+	return s.backingStore.GetExistingContent(chunkHashes, minBlockUsagePercent, asyncCompleteAPI)
+}
+
+// GetStats ...
+func (s *verifyBlockStore) GetStats() (longtaillib.BlockStoreStats, int) {
+	return loadBlockStoreStats(&s.stats), 0
+}
+
+// Flush ...
+func (s *verifyBlockStore) Flush(asyncCompleteAPI longtaillib.Longtail_AsyncFlushAPI) int {
+	return s.backingStore.Flush(asyncCompleteAPI)
+}
+
+// Close ...
+func (s *verifyBlockStore) Close() {
+}
@@ -0,0 +1,130 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func createHashedStoredBlock(t *testing.T, hashAPI longtaillib.Longtail_HashAPI, seed uint8) longtaillib.Longtail_StoredBlock {
+	chunkSizes := []uint32{uint32(seed) + 10, uint32(seed) + 20, uint32(seed) + 30}
+	blockData := make([]uint8, chunkSizes[0]+chunkSizes[1]+chunkSizes[2])
+	for p := range blockData {
+		blockData[p] = seed + uint8(p)
+	}
+	chunkHashes := make([]uint64, len(chunkSizes))
+	offset := uint32(0)
+	for i, size := range chunkSizes {
+		hash, errno := hashAPI.HashBuffer(blockData[offset : offset+size])
+		if errno != 0 {
+			t.Fatalf("createHashedStoredBlock() hashAPI.HashBuffer() %d != %d", errno, 0)
+		}
+		chunkHashes[i] = hash
+		offset += size
+	}
+	storedBlock, errno := longtaillib.CreateStoredBlock(
+		uint64(seed)+21412151,
+		hashAPI.GetIdentifier(),
+		0,
+		chunkHashes,
+		chunkSizes,
+		blockData,
+		false)
+	if errno != 0 {
+		t.Fatalf("createHashedStoredBlock() longtaillib.CreateStoredBlock() %d != %d", errno, 0)
+	}
+	return storedBlock
+}
+
+func TestVerifyBlockStore(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+	hashAPI, errno := hashRegistry.GetHashAPI(longtaillib.GetBlake3HashIdentifier())
+	if errno != 0 {
+		t.Fatalf("TestVerifyBlockStore() hashRegistry.GetHashAPI() %d != %d", errno, 0)
+	}
+
+	remoteStore, err := NewRemoteBlockStore(
+		jobs,
+		blobStore,
+		"",
+		runtime.NumCPU(),
+		ReadWrite)
+	if err != nil {
+		t.Errorf("TestVerifyBlockStore() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	remoteStoreAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	verifyStore := NewVerifyBlockStore(remoteStoreAPI, hashRegistry)
+	verifyStoreAPI := longtaillib.CreateBlockStoreAPI(verifyStore)
+	defer remoteStoreAPI.Dispose()
+	defer verifyStoreAPI.Dispose()
+
+	goodBlock := createHashedStoredBlock(t, hashAPI, 4)
+	goodBlockIndex := goodBlock.GetBlockIndex()
+	goodBlockHash := goodBlockIndex.GetBlockHash()
+	p := &putStoredBlockCompletionAPI{}
+	p.wg.Add(1)
+	verifyStoreAPI.PutStoredBlock(goodBlock, longtaillib.CreateAsyncPutStoredBlockAPI(p))
+	p.wg.Wait()
+	goodBlock.Dispose()
+	if p.err != 0 {
+		t.Errorf("TestVerifyBlockStore() PutStoredBlock() %d != %d", p.err, 0)
+	}
+
+	badBlockHash, errno := storeBlockFromSeed(t, remoteStoreAPI, 7)
+	if errno != 0 {
+		t.Errorf("TestVerifyBlockStore() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+
+	storedBlock, errno := fetchBlockFromStore(t, verifyStoreAPI, goodBlockHash)
+	if errno != 0 {
+		t.Errorf("TestVerifyBlockStore() fetchBlockFromStore(goodBlockHash) %d != %d", errno, 0)
+	}
+	storedBlock.Dispose()
+
+	_, errno = fetchBlockFromStore(t, verifyStoreAPI, badBlockHash)
+	if errno != longtaillib.EBADF {
+		t.Errorf("TestVerifyBlockStore() fetchBlockFromStore(badBlockHash) %d != %d", errno, longtaillib.EBADF)
+	}
+
+	stats, _ := verifyStore.GetStats()
+	if stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Count] != 1 {
+		t.Errorf("TestVerifyBlockStore() GetStoredBlock_Count %d != %d", stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_Count], 1)
+	}
+	if stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_FailCount] != 1 {
+		t.Errorf("TestVerifyBlockStore() GetStoredBlock_FailCount %d != %d", stats.StatU64[longtaillib.Longtail_BlockStoreAPI_StatU64_GetStoredBlock_FailCount], 1)
+	}
+}
+
+func TestVerifyBlockStoreFlush(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 1, ReadWrite)
+	if err != nil {
+		t.Fatalf("TestVerifyBlockStoreFlush() NewRemoteBlockStore()) %v != %v", err, nil)
+	}
+	remoteStoreAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer remoteStoreAPI.Dispose()
+	verifyStoreAPI := longtaillib.CreateBlockStoreAPI(NewVerifyBlockStore(remoteStoreAPI, hashRegistry))
+	defer verifyStoreAPI.Dispose()
+
+	blockHash, errno := storeBlockFromSeed(t, verifyStoreAPI, 4)
+	if errno != 0 {
+		t.Fatalf("TestVerifyBlockStoreFlush() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	// The flush reaches the backing store, which adds the block to the store index
+	if errno := flushRemoteStore(verifyStoreAPI); errno != 0 {
+		t.Errorf("TestVerifyBlockStoreFlush() Flush() %d != %d", errno, 0)
+	}
+	if indexed := getStoreIndexBlockHashes(t, blobStore); len(indexed) != 1 || !indexed[blockHash] {
+		t.Errorf("TestVerifyBlockStoreFlush() store index after Flush() %v", indexed)
+	}
+}
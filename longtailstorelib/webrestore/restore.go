@@ -0,0 +1,277 @@
+// Package webrestore restores the content of a version from a longtail store without cgo, so it
+// builds for js/wasm and wasip1 and can serve partial restores and previews in web based asset
+// viewers. It is read only and fetches only the blocks holding the requested part of a file.
+//
+// The package has no decompressors of its own besides the one for uncompressed blocks, callers
+// register one per algorithm they expect in the store, see Options.Decompressors. Chunk content
+// is checked against the chunk sizes but not against the chunk hashes.
+package webrestore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/storeformat"
+)
+
+// Decompressor decompresses the chunk data of a block to uncompressedSize bytes
+type Decompressor func(compressed []byte, uncompressedSize int) ([]byte, error)
+
+// Options configure how a version is read
+type Options struct {
+	// StoreIndexPath is the key of the store index locating the chunks of the version, store.lsi
+	// if empty. Pointing it at a version local store index avoids downloading the full store index.
+	StoreIndexPath string
+	// Decompressors are keyed by storeformat.CompressionAlgorithm, "none" is always available
+	Decompressors map[string]Decompressor
+	// MaxCachedBlocks is the number of decompressed blocks kept for following reads, 8 if zero
+	MaxCachedBlocks int
+}
+
+// Asset is a file or folder of a version, folder paths end with a slash
+type Asset struct {
+	Path        string
+	Size        uint64
+	Permissions uint16
+}
+
+type chunkLocation struct {
+	blockHash uint64
+	offset    uint32
+	size      uint32
+}
+
+// Version reads the content of a version from a store, it is safe for concurrent use
+type Version struct {
+	source        BlobSource
+	layout        storeformat.BlockLayout
+	versionIndex  *storeformat.VersionIndex
+	assetIndexes  map[string]int
+	chunks        map[uint64]chunkLocation
+	decompressors map[string]Decompressor
+	maxBlocks     int
+
+	mutex      sync.Mutex
+	blocks     map[uint64][]byte
+	blockOrder []uint64
+}
+
+// Open reads the block layout and store index of the store in source and locates the chunks of
+// the version in versionIndexData
+func Open(ctx context.Context, source BlobSource, versionIndexData []byte, options Options) (*Version, error) {
+	versionIndex, err := storeformat.ReadVersionIndex(versionIndexData)
+	if err != nil {
+		return nil, fmt.Errorf("webrestore.Open: version index: %w", err)
+	}
+
+	layout := storeformat.DefaultBlockLayout
+	layoutData, err := source.Read(ctx, storeformat.BlockLayoutKey)
+	if err != nil {
+		return nil, fmt.Errorf("webrestore.Open: source.Read(%s) failed: %w", storeformat.BlockLayoutKey, err)
+	}
+	if layoutData != nil {
+		layout, err = storeformat.ReadBlockLayout(layoutData)
+		if err != nil {
+			return nil, fmt.Errorf("webrestore.Open: %w", err)
+		}
+	}
+
+	storeIndexPath := options.StoreIndexPath
+	if storeIndexPath == "" {
+		storeIndexPath = "store.lsi"
+	}
+	storeIndexData, err := source.Read(ctx, storeIndexPath)
+	if err != nil {
+		return nil, fmt.Errorf("webrestore.Open: source.Read(%s) failed: %w", storeIndexPath, err)
+	}
+	if storeIndexData == nil {
+		return nil, fmt.Errorf("webrestore.Open: store index %s does not exist", storeIndexPath)
+	}
+	storeIndex, err := storeformat.ReadStoreIndex(storeIndexData)
+	if err != nil {
+		return nil, fmt.Errorf("webrestore.Open: store index %s: %w", storeIndexPath, err)
+	}
+	if storeIndex.HashIdentifier != versionIndex.HashIdentifier && storeIndex.BlockCount > 0 {
+		return nil, fmt.Errorf("webrestore.Open: store index hash identifier 0x%08x does not match version index hash identifier 0x%08x", storeIndex.HashIdentifier, versionIndex.HashIdentifier)
+	}
+
+	v := &Version{
+		source:        source,
+		layout:        layout,
+		versionIndex:  versionIndex,
+		assetIndexes:  make(map[string]int, len(versionIndex.AssetPaths)),
+		chunks:        make(map[uint64]chunkLocation, len(versionIndex.ChunkHashes)),
+		decompressors: map[string]Decompressor{"none": decompressNone},
+		maxBlocks:     options.MaxCachedBlocks,
+		blocks:        map[uint64][]byte{}}
+	if v.maxBlocks <= 0 {
+		v.maxBlocks = 8
+	}
+	for algorithm, decompressor := range options.Decompressors {
+		v.decompressors[algorithm] = decompressor
+	}
+	for a, path := range versionIndex.AssetPaths {
+		v.assetIndexes[path] = a
+	}
+
+	wanted := make(map[uint64]bool, len(versionIndex.ChunkHashes))
+	for _, chunkHash := range versionIndex.ChunkHashes {
+		wanted[chunkHash] = true
+	}
+	for b, blockHash := range storeIndex.BlockHashes {
+		first := storeIndex.BlockChunksOffsets[b]
+		offset := uint32(0)
+		for c := first; c < first+storeIndex.BlockChunkCounts[b]; c++ {
+			chunkHash := storeIndex.ChunkHashes[c]
+			if _, exists := v.chunks[chunkHash]; wanted[chunkHash] && !exists {
+				v.chunks[chunkHash] = chunkLocation{blockHash: blockHash, offset: offset, size: storeIndex.ChunkSizes[c]}
+			}
+			offset += storeIndex.ChunkSizes[c]
+		}
+	}
+	missing := len(wanted) - len(v.chunks)
+	if missing > 0 {
+		return nil, fmt.Errorf("webrestore.Open: %d chunks of the version are not in store index %s", missing, storeIndexPath)
+	}
+	return v, nil
+}
+
+func decompressNone(compressed []byte, uncompressedSize int) ([]byte, error) {
+	return compressed, nil
+}
+
+// Assets returns the files and folders of the version
+func (v *Version) Assets() []Asset {
+	assets := make([]Asset, len(v.versionIndex.AssetPaths))
+	for a, path := range v.versionIndex.AssetPaths {
+		assets[a] = Asset{Path: path, Size: v.versionIndex.AssetSizes[a], Permissions: v.versionIndex.AssetPermissions[a]}
+	}
+	return assets
+}
+
+// ReadFile returns the content of the file at path in the version
+func (v *Version) ReadFile(ctx context.Context, path string) ([]byte, error) {
+	return v.ReadFileRange(ctx, path, 0, -1)
+}
+
+// ReadFileRange returns up to size bytes of the file at path starting at offset, a negative size
+// reads to the end of the file. Only the blocks holding the range are fetched.
+func (v *Version) ReadFileRange(ctx context.Context, path string, offset uint64, size int64) ([]byte, error) {
+	a, exists := v.assetIndexes[path]
+	if !exists {
+		return nil, fmt.Errorf("webrestore.ReadFileRange: `%s` is not in the version", path)
+	}
+	assetSize := v.versionIndex.AssetSizes[a]
+	if offset > assetSize {
+		offset = assetSize
+	}
+	end := assetSize
+	if size >= 0 && offset+uint64(size) < assetSize {
+		end = offset + uint64(size)
+	}
+	content := make([]byte, 0, end-offset)
+	start := v.versionIndex.AssetChunkIndexStarts[a]
+	chunkStart := uint64(0)
+	for _, chunkIndex := range v.versionIndex.AssetChunkIndexes[start : start+v.versionIndex.AssetChunkCounts[a]] {
+		if chunkStart >= end {
+			break
+		}
+		chunkSize := uint64(v.versionIndex.ChunkSizes[chunkIndex])
+		chunkEnd := chunkStart + chunkSize
+		if chunkEnd > offset {
+			chunk, err := v.readChunk(ctx, v.versionIndex.ChunkHashes[chunkIndex])
+			if err != nil {
+				return nil, fmt.Errorf("webrestore.ReadFileRange: `%s`: %w", path, err)
+			}
+			if uint64(len(chunk)) != chunkSize {
+				return nil, fmt.Errorf("webrestore.ReadFileRange: `%s`: chunk 0x%016x is %d bytes, expected %d", path, v.versionIndex.ChunkHashes[chunkIndex], len(chunk), chunkSize)
+			}
+			from := uint64(0)
+			if offset > chunkStart {
+				from = offset - chunkStart
+			}
+			to := chunkSize
+			if end < chunkEnd {
+				to = end - chunkStart
+			}
+			content = append(content, chunk[from:to]...)
+		}
+		chunkStart = chunkEnd
+	}
+	if uint64(len(content)) != end-offset {
+		return nil, fmt.Errorf("webrestore.ReadFileRange: the chunks of `%s` add up to %d bytes, expected %d", path, chunkStart, assetSize)
+	}
+	return content, nil
+}
+
+func (v *Version) readChunk(ctx context.Context, chunkHash uint64) ([]byte, error) {
+	location := v.chunks[chunkHash]
+	blockData, err := v.readBlock(ctx, location.blockHash)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(location.offset)+uint64(location.size) > uint64(len(blockData)) {
+		return nil, fmt.Errorf("chunk 0x%016x is outside of the %d bytes of block 0x%016x", chunkHash, len(blockData), location.blockHash)
+	}
+	return blockData[location.offset : location.offset+location.size], nil
+}
+
+// readBlock returns the decompressed chunk data of a block, from the cache if it was read recently
+func (v *Version) readBlock(ctx context.Context, blockHash uint64) ([]byte, error) {
+	v.mutex.Lock()
+	blockData, cached := v.blocks[blockHash]
+	v.mutex.Unlock()
+	if cached {
+		return blockData, nil
+	}
+
+	key := v.layout.BlockPath("chunks", blockHash)
+	data, err := v.source.Read(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("source.Read(%s) failed: %w", key, err)
+	}
+	if data == nil {
+		// Stores written to a plain folder path by the native block store name their blocks .lrb
+		nativeKey := strings.TrimSuffix(key, ".lsb") + ".lrb"
+		data, err = v.source.Read(ctx, nativeKey)
+		if err != nil {
+			return nil, fmt.Errorf("source.Read(%s) failed: %w", nativeKey, err)
+		}
+	}
+	if data == nil {
+		return nil, fmt.Errorf("block %s does not exist", key)
+	}
+	header, compressed, err := storeformat.ReadBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("block %s: %w", key, err)
+	}
+	if header.BlockHash != blockHash {
+		return nil, fmt.Errorf("block %s has block hash 0x%016x", key, header.BlockHash)
+	}
+	algorithm := storeformat.CompressionAlgorithm(header.Tag)
+	decompressor, exists := v.decompressors[algorithm]
+	if !exists {
+		return nil, fmt.Errorf("block %s is compressed with tag 0x%08x, there is no decompressor for `%s`", key, header.Tag, algorithm)
+	}
+	blockData, err = decompressor(compressed.Data, int(compressed.UncompressedSize))
+	if err != nil {
+		return nil, fmt.Errorf("block %s: %s decompression failed: %w", key, algorithm, err)
+	}
+	if len(blockData) != int(compressed.UncompressedSize) {
+		return nil, fmt.Errorf("block %s decompressed to %d bytes, expected %d", key, len(blockData), compressed.UncompressedSize)
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if _, cached := v.blocks[blockHash]; !cached {
+		if len(v.blockOrder) >= v.maxBlocks {
+			delete(v.blocks, v.blockOrder[0])
+			v.blockOrder = v.blockOrder[1:]
+		}
+		v.blocks[blockHash] = blockData
+		v.blockOrder = append(v.blockOrder, blockHash)
+	}
+	return blockData, nil
+}
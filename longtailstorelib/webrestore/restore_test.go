@@ -0,0 +1,187 @@
+package webrestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/storeformat"
+)
+
+var testChunks = [][]byte{
+	[]byte("0123456789"),
+	[]byte("abcdefghijklmnopqrst"),
+	[]byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ!?#%"),
+}
+
+func reverse(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed
+}
+
+func writeTestBlock(t *testing.T, storePath string, layout storeformat.BlockLayout, blockHash uint64, tag uint32, chunks []int, data []byte) longtaillib.Longtail_BlockIndex {
+	chunkHashes := make([]uint64, len(chunks))
+	chunkSizes := make([]uint32, len(chunks))
+	for i, c := range chunks {
+		chunkHashes[i] = uint64(0xc0 + c)
+		chunkSizes[i] = uint32(len(testChunks[c]))
+	}
+	storedBlock, errno := longtaillib.CreateStoredBlock(blockHash, longtaillib.GetBlake3HashIdentifier(), tag, chunkHashes, chunkSizes, data, false)
+	if errno != 0 {
+		t.Fatalf("writeTestBlock() longtaillib.CreateStoredBlock() %d != %d", errno, 0)
+	}
+	defer storedBlock.Dispose()
+	blob, _ := longtaillib.WriteStoredBlockToBuffer(storedBlock)
+	blockPath := filepath.Join(storePath, filepath.FromSlash(layout.BlockPath("chunks", blockHash)))
+	os.MkdirAll(filepath.Dir(blockPath), 0755)
+	ioutil.WriteFile(blockPath, blob, 0644)
+	blockIndex, _ := longtaillib.CreateBlockIndex(blockHash, longtaillib.GetBlake3HashIdentifier(), tag, chunkHashes, chunkSizes)
+	return blockIndex
+}
+
+// createTestStore writes a store with an uncompressed block holding chunks 0 and 1 and a block
+// holding chunk 2 tagged as zstd but "compressed" by reversing the bytes
+func createTestStore(t *testing.T, storePath string) []byte {
+	layout := storeformat.BlockLayout{Version: 1, PrefixDepth: 2, PrefixWidth: 2}
+	ioutil.WriteFile(filepath.Join(storePath, "layout.json"), []byte(`{"version":1,"prefixDepth":2,"prefixWidth":2}`), 0644)
+
+	plain := writeTestBlock(t, storePath, layout, 0x1111, longtaillib.GetNoCompressionType(), []int{0, 1}, append(append([]byte{}, testChunks[0]...), testChunks[1]...))
+	defer plain.Dispose()
+	compressed := make([]byte, 8)
+	binary.LittleEndian.PutUint32(compressed, uint32(len(testChunks[2])))
+	binary.LittleEndian.PutUint32(compressed[4:], uint32(len(testChunks[2])))
+	compressed = append(compressed, reverse(testChunks[2])...)
+	zstd := writeTestBlock(t, storePath, layout, 0x2222, longtaillib.GetZStdDefaultCompressionType(), []int{2}, compressed)
+	defer zstd.Dispose()
+
+	storeIndex, errno := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{plain, zstd})
+	if errno != 0 {
+		t.Fatalf("createTestStore() longtaillib.CreateStoreIndexFromBlocks() %d != %d", errno, 0)
+	}
+	defer storeIndex.Dispose()
+	storeIndexData, _ := longtaillib.WriteStoreIndexToBuffer(storeIndex)
+	ioutil.WriteFile(filepath.Join(storePath, "store.lsi"), storeIndexData, 0644)
+
+	hashRegistry := longtaillib.CreateFullHashRegistry()
+	defer hashRegistry.Dispose()
+	hashAPI, _ := hashRegistry.GetHashAPI(longtaillib.GetBlake3HashIdentifier())
+	assetPaths := []string{"folder/", "folder/a.txt", "b.bin"}
+	pathHashes := make([]uint64, len(assetPaths))
+	for a, path := range assetPaths {
+		pathHashes[a], _ = hashAPI.GetPathHash(path)
+	}
+	versionIndex, errno := longtaillib.BuildVersionIndex(
+		longtaillib.GetBlake3HashIdentifier(),
+		32768,
+		assetPaths,
+		[]uint64{0, 30, 40},
+		[]uint16{0755, 0644, 0600},
+		pathHashes,
+		[]uint64{0, 0xa, 0xb},
+		[]uint32{0, 0, 2},
+		[]uint32{0, 2, 2},
+		[]uint32{0, 1, 2, 0},
+		[]uint64{0xc0, 0xc1, 0xc2},
+		[]uint32{10, 20, 30},
+		[]uint32{0, 0, longtaillib.GetZStdDefaultCompressionType()})
+	if errno != 0 {
+		t.Fatalf("createTestStore() longtaillib.BuildVersionIndex() %d != %d", errno, 0)
+	}
+	defer versionIndex.Dispose()
+	versionIndexData, _ := longtaillib.WriteVersionIndexToBuffer(versionIndex)
+	return versionIndexData
+}
+
+func testReadVersion(t *testing.T, source BlobSource, versionIndexData []byte) {
+	ctx := context.Background()
+	version, err := Open(ctx, source, versionIndexData, Options{})
+	if err != nil {
+		t.Fatalf("testReadVersion() Open() %v != %v", err, nil)
+	}
+	if assets := version.Assets(); len(assets) != 3 || assets[2] != (Asset{Path: "b.bin", Size: 40, Permissions: 0600}) {
+		t.Errorf("testReadVersion() Assets() %+v", assets)
+	}
+	data, err := version.ReadFile(ctx, "folder/a.txt")
+	if err != nil || string(data) != "0123456789abcdefghijklmnopqrst" {
+		t.Errorf("testReadVersion() ReadFile(folder/a.txt) `%s`, %v", data, err)
+	}
+	if _, err := version.ReadFile(ctx, "b.bin"); err == nil || !strings.Contains(err.Error(), "zstd") {
+		t.Errorf("testReadVersion() ReadFile(b.bin) without decompressor %v", err)
+	}
+	if _, err := version.ReadFile(ctx, "missing.txt"); err == nil {
+		t.Errorf("testReadVersion() ReadFile(missing.txt) %v == %v", err, nil)
+	}
+
+	version, err = Open(ctx, source, versionIndexData, Options{Decompressors: map[string]Decompressor{
+		"zstd": func(compressed []byte, uncompressedSize int) ([]byte, error) {
+			return reverse(compressed), nil
+		}}})
+	if err != nil {
+		t.Fatalf("testReadVersion() Open() %v != %v", err, nil)
+	}
+	expected := append(append([]byte{}, testChunks[2]...), testChunks[0]...)
+	data, err = version.ReadFile(ctx, "b.bin")
+	if err != nil || !bytes.Equal(data, expected) {
+		t.Errorf("testReadVersion() ReadFile(b.bin) `%s`, %v", data, err)
+	}
+	data, err = version.ReadFileRange(ctx, "b.bin", 25, 10)
+	if err != nil || !bytes.Equal(data, expected[25:35]) {
+		t.Errorf("testReadVersion() ReadFileRange(b.bin, 25, 10) `%s`, %v", data, err)
+	}
+	data, err = version.ReadFileRange(ctx, "b.bin", 35, 100)
+	if err != nil || !bytes.Equal(data, expected[35:]) {
+		t.Errorf("testReadVersion() ReadFileRange(b.bin, 35, 100) `%s`, %v", data, err)
+	}
+	data, err = version.ReadFile(ctx, "folder/")
+	if err != nil || len(data) != 0 {
+		t.Errorf("testReadVersion() ReadFile(folder/) `%s`, %v", data, err)
+	}
+}
+
+func TestReadVersion(t *testing.T) {
+	storePath, _ := ioutil.TempDir("", "longtail-webrestore")
+	defer os.RemoveAll(storePath)
+	versionIndexData := createTestStore(t, storePath)
+	testReadVersion(t, DirBlobSource(storePath), versionIndexData)
+
+	// A store index that lacks chunks of the version is refused
+	if _, err := Open(context.Background(), DirBlobSource(storePath), versionIndexData, Options{StoreIndexPath: "layout.json"}); err == nil {
+		t.Errorf("TestReadVersion() Open() with malformed store index %v == %v", err, nil)
+	}
+	emptyIndex, _ := longtaillib.CreateStoreIndexFromBlocks([]longtaillib.Longtail_BlockIndex{})
+	defer emptyIndex.Dispose()
+	emptyIndexData, _ := longtaillib.WriteStoreIndexToBuffer(emptyIndex)
+	ioutil.WriteFile(filepath.Join(storePath, "empty.lsi"), emptyIndexData, 0644)
+	if _, err := Open(context.Background(), DirBlobSource(storePath), versionIndexData, Options{StoreIndexPath: "empty.lsi"}); err == nil || !strings.Contains(err.Error(), "3 chunks") {
+		t.Errorf("TestReadVersion() Open() with empty store index %v", err)
+	}
+}
+
+func TestReadVersionHTTP(t *testing.T) {
+	storePath, _ := ioutil.TempDir("", "longtail-webrestore")
+	defer os.RemoveAll(storePath)
+	versionIndexData := createTestStore(t, storePath)
+	ioutil.WriteFile(filepath.Join(storePath, "version.lvi"), versionIndexData, 0644)
+	server := httptest.NewServer(http.FileServer(http.Dir(storePath)))
+	defer server.Close()
+
+	fetched, err := FetchURL(context.Background(), nil, server.URL+"/version.lvi")
+	if err != nil || !bytes.Equal(fetched, versionIndexData) {
+		t.Fatalf("TestReadVersionHTTP() FetchURL() %v != %v", err, nil)
+	}
+	if missing, err := FetchURL(context.Background(), nil, server.URL+"/missing.lvi"); missing != nil || err != nil {
+		t.Errorf("TestReadVersionHTTP() FetchURL(missing.lvi) %v, %v", missing, err)
+	}
+	testReadVersion(t, NewHTTPBlobSource(server.URL+"/"), versionIndexData)
+}
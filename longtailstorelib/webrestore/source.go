@@ -0,0 +1,69 @@
+package webrestore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobSource reads the objects of a store, Read returns nil data and no error for objects that do not exist
+type BlobSource interface {
+	Read(ctx context.Context, key string) ([]byte, error)
+}
+
+// HTTPBlobSource reads a store published over HTTP, such as a bucket with public read access or
+// a folder store behind a static file server. In a js/wasm build the requests go through fetch so
+// the server needs to allow the origin of the page.
+type HTTPBlobSource struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewHTTPBlobSource returns a source reading the objects of the store at baseURL
+func NewHTTPBlobSource(baseURL string) *HTTPBlobSource {
+	return &HTTPBlobSource{BaseURL: strings.TrimSuffix(baseURL, "/"), Client: http.DefaultClient}
+}
+
+// Read ...
+func (s *HTTPBlobSource) Read(ctx context.Context, key string) ([]byte, error) {
+	return FetchURL(ctx, s.Client, s.BaseURL+"/"+key)
+}
+
+// FetchURL reads the content of url, it returns nil data and no error if the server responds 404
+func FetchURL(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s failed: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// DirBlobSource reads a store in a local folder, under wasip1 the folder has to be preopened by the runtime
+type DirBlobSource string
+
+// Read ...
+func (s DirBlobSource) Read(ctx context.Context, key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(string(s), filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
@@ -0,0 +1,139 @@
+//go:build js && wasm
+// +build js,wasm
+
+// Command wasm exposes webrestore to JavaScript. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o longtail.wasm
+//
+// and load it with wasm_exec.js from the Go distribution. It sets the globals
+//
+//	longtailRegisterDecompressor(algorithm, fn)
+//	longtailOpen(storeURL, versionIndexURL, storeIndexPath) -> Promise<version>
+//
+// where fn(compressed Uint8Array, uncompressedSize) returns a Uint8Array synchronously, and
+// version has assets() and readFile(path, offset, size) -> Promise<Uint8Array>.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall/js"
+
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/webrestore"
+)
+
+var decompressorsLock sync.Mutex
+var decompressors = map[string]webrestore.Decompressor{}
+
+func toBytes(value js.Value) []byte {
+	data := make([]byte, value.Get("length").Int())
+	js.CopyBytesToGo(data, value)
+	return data
+}
+
+func toUint8Array(data []byte) js.Value {
+	array := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(array, data)
+	return array
+}
+
+// promise runs f in a goroutine so it may block on fetch, and settles the returned promise with its result
+func promise(f func() (interface{}, error)) js.Value {
+	var handler js.Func
+	handler = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		resolve, reject := args[0], args[1]
+		go func() {
+			defer handler.Release()
+			result, err := f()
+			if err != nil {
+				reject.Invoke(js.Global().Get("Error").New(err.Error()))
+				return
+			}
+			resolve.Invoke(result)
+		}()
+		return nil
+	})
+	return js.Global().Get("Promise").New(handler)
+}
+
+func registerDecompressor(this js.Value, args []js.Value) interface{} {
+	algorithm, fn := args[0].String(), args[1]
+	decompressorsLock.Lock()
+	defer decompressorsLock.Unlock()
+	decompressors[algorithm] = func(compressed []byte, uncompressedSize int) (data []byte, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		return toBytes(fn.Invoke(toUint8Array(compressed), uncompressedSize)), nil
+	}
+	return nil
+}
+
+func versionObject(version *webrestore.Version) js.Value {
+	object := js.Global().Get("Object").New()
+	object.Set("assets", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		var assets []interface{}
+		for _, asset := range version.Assets() {
+			assets = append(assets, map[string]interface{}{
+				"path":        asset.Path,
+				"size":        float64(asset.Size),
+				"permissions": int(asset.Permissions)})
+		}
+		return assets
+	}))
+	object.Set("readFile", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		path := args[0].String()
+		offset, size := uint64(0), int64(-1)
+		if len(args) > 1 && args[1].Truthy() {
+			offset = uint64(args[1].Float())
+		}
+		if len(args) > 2 && !args[2].IsUndefined() && !args[2].IsNull() {
+			size = int64(args[2].Float())
+		}
+		return promise(func() (interface{}, error) {
+			data, err := version.ReadFileRange(context.Background(), path, offset, size)
+			if err != nil {
+				return nil, err
+			}
+			return toUint8Array(data), nil
+		})
+	}))
+	return object
+}
+
+func open(this js.Value, args []js.Value) interface{} {
+	storeURL, versionIndexURL := args[0].String(), args[1].String()
+	options := webrestore.Options{Decompressors: map[string]webrestore.Decompressor{}}
+	if len(args) > 2 && args[2].Truthy() {
+		options.StoreIndexPath = args[2].String()
+	}
+	decompressorsLock.Lock()
+	for algorithm, decompressor := range decompressors {
+		options.Decompressors[algorithm] = decompressor
+	}
+	decompressorsLock.Unlock()
+	return promise(func() (interface{}, error) {
+		ctx := context.Background()
+		versionIndexData, err := webrestore.FetchURL(ctx, nil, versionIndexURL)
+		if err != nil {
+			return nil, err
+		}
+		if versionIndexData == nil {
+			return nil, fmt.Errorf("version index %s does not exist", versionIndexURL)
+		}
+		version, err := webrestore.Open(ctx, webrestore.NewHTTPBlobSource(storeURL), versionIndexData, options)
+		if err != nil {
+			return nil, err
+		}
+		return versionObject(version), nil
+	})
+}
+
+func main() {
+	js.Global().Set("longtailRegisterDecompressor", js.FuncOf(registerDecompressor))
+	js.Global().Set("longtailOpen", js.FuncOf(open))
+	select {}
+}
@@ -0,0 +1,53 @@
+//go:build wasip1
+// +build wasip1
+
+// Command wasm built for wasip1 lists or restores files of a version in a preopened store folder
+//
+//	wasmtime --dir store longtail.wasm store version.lvi [path]
+//
+// Without a path it lists the assets of the version, with a path it writes the file to stdout.
+// Only uncompressed stores can be read as the wasip1 build has no decompressors.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/DanEngelbrecht/golongtail/longtailstorelib/webrestore"
+)
+
+func run(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: longtail.wasm <store folder> <version index> [path]")
+	}
+	versionIndexData, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	version, err := webrestore.Open(ctx, webrestore.DirBlobSource(args[0]), versionIndexData, webrestore.Options{})
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		for _, asset := range version.Assets() {
+			fmt.Printf("%s\t%d\t%o\n", asset.Path, asset.Size, asset.Permissions)
+		}
+		return nil
+	}
+	data, err := version.ReadFile(ctx, args[2])
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,89 @@
+package longtailstorelib
+
+import "sync/atomic"
+
+// Worker pool names of WorkerPoolStats
+const (
+	WorkerPoolShared   = "shared"
+	WorkerPoolUpload   = "upload"
+	WorkerPoolDownload = "download"
+	WorkerPoolDecode   = "decode"
+)
+
+// WorkerPoolStats is the size and load of a worker pool of the remote block store. The workers
+// of the remote block store are one shared pool unless the store has separate upload and
+// download pools, see WithWorkerPools. The fetched blocks are decoded by the decode pool, see
+// WithDecodeWorkerCount.
+type WorkerPoolStats struct {
+	Name        string
+	WorkerCount int
+	// BusyCount is the number of workers that are handling a block request
+	BusyCount int64
+	// RequestCount is the number of block puts, gets and prefetches the pool has handled
+	RequestCount uint64
+}
+
+// workerPool is a group of remote workers, each pool has its own flush channels so a flush
+// waits for every worker of every pool
+type workerPool struct {
+	name           string
+	workerCount    int
+	flushChan      chan int
+	flushReplyChan chan int
+	busyCount      int64
+	requestCount   uint64
+}
+
+func newWorkerPool(name string, workerCount int) *workerPool {
+	return &workerPool{
+		name:           name,
+		workerCount:    workerCount,
+		flushChan:      make(chan int, workerCount),
+		flushReplyChan: make(chan int, workerCount)}
+}
+
+// begin is called when a worker of the pool starts on a request and end when it is done
+func (p *workerPool) begin() {
+	atomic.AddInt64(&p.busyCount, 1)
+	atomic.AddUint64(&p.requestCount, 1)
+}
+
+func (p *workerPool) end() {
+	atomic.AddInt64(&p.busyCount, -1)
+}
+
+func (p *workerPool) stats() WorkerPoolStats {
+	return WorkerPoolStats{
+		Name:         p.name,
+		WorkerCount:  p.workerCount,
+		BusyCount:    atomic.LoadInt64(&p.busyCount),
+		RequestCount: atomic.LoadUint64(&p.requestCount)}
+}
+
+func (s *remoteStore) workerPoolStats() []WorkerPoolStats {
+	stats := make([]WorkerPoolStats, 0, len(s.workerPools)+1)
+	for _, pool := range s.workerPools {
+		stats = append(stats, pool.stats())
+	}
+	if s.decodePool != nil {
+		stats = append(stats, s.decodePool.stats())
+	}
+	return stats
+}
+
+// workerPoolSizes returns the number of upload and download workers, zero download workers means
+// that the workerCount workers are shared by uploads and downloads
+func workerPoolSizes(options StoreOptions, workerCount int) (int, int) {
+	if options.UploadWorkerCount <= 0 && options.DownloadWorkerCount <= 0 {
+		return workerCount, 0
+	}
+	uploadWorkerCount := options.UploadWorkerCount
+	if uploadWorkerCount <= 0 {
+		uploadWorkerCount = workerCount
+	}
+	downloadWorkerCount := options.DownloadWorkerCount
+	if downloadWorkerCount <= 0 {
+		downloadWorkerCount = workerCount
+	}
+	return uploadWorkerCount, downloadWorkerCount
+}
@@ -0,0 +1,79 @@
+package longtailstorelib
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/DanEngelbrecht/golongtail/longtaillib"
+)
+
+func TestWorkerPoolSizes(t *testing.T) {
+	for _, test := range []struct {
+		options  []StoreOption
+		upload   int
+		download int
+	}{
+		{nil, 8, 0},
+		{[]StoreOption{WithWorkerPools(2, 6)}, 2, 6},
+		{[]StoreOption{WithWorkerPools(2, 0)}, 2, 8},
+		{[]StoreOption{WithWorkerPools(0, 4)}, 8, 4},
+	} {
+		upload, download := workerPoolSizes(newStoreOptions(test.options), 8)
+		if upload != test.upload || download != test.download {
+			t.Errorf("TestWorkerPoolSizes() workerPoolSizes(%+v) %d, %d != %d, %d", newStoreOptions(test.options), upload, download, test.upload, test.download)
+		}
+	}
+}
+
+func TestSeparateWorkerPools(t *testing.T) {
+	blobStore, _ := NewTestBlobStore("the_path")
+	jobs := longtaillib.CreateBikeshedJobAPI(uint32(runtime.NumCPU()), 0)
+	defer jobs.Dispose()
+	remoteStore, err := NewRemoteBlockStore(jobs, blobStore, "", 4, ReadWrite, WithWorkerPools(1, 3))
+	if err != nil {
+		t.Fatalf("TestSeparateWorkerPools() NewRemoteBlockStore() %v != %v", err, nil)
+	}
+	storeAPI := longtaillib.CreateBlockStoreAPI(remoteStore)
+	defer storeAPI.Dispose()
+
+	blockHash, errno := storeBlockFromSeed(t, storeAPI, 0)
+	if errno != 0 {
+		t.Fatalf("TestSeparateWorkerPools() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+	_, errno = storeBlockFromSeed(t, storeAPI, 10)
+	if errno != 0 {
+		t.Fatalf("TestSeparateWorkerPools() storeBlockFromSeed() %d != %d", errno, 0)
+	}
+
+	flushComplete := &flushCompletionAPI{}
+	flushComplete.wg.Add(1)
+	_ = remoteStore.Flush(longtaillib.CreateAsyncFlushAPI(flushComplete))
+	flushComplete.wg.Wait()
+	if flushComplete.err != 0 {
+		t.Fatalf("TestSeparateWorkerPools() Flush() %d != %d", flushComplete.err, 0)
+	}
+
+	storedBlock, errno := fetchBlockFromStore(t, storeAPI, blockHash)
+	if errno != 0 {
+		t.Fatalf("TestSeparateWorkerPools() fetchBlockFromStore() %d != %d", errno, 0)
+	}
+	defer storedBlock.Dispose()
+	validateBlockFromSeed(t, 0, storedBlock)
+
+	existingContent, errno := getExistingContent(t, storeAPI, []uint64{1, 2, 11}, 0)
+	if errno != 0 {
+		t.Fatalf("TestSeparateWorkerPools() getExistingContent() %d != %d", errno, 0)
+	}
+	defer existingContent.Dispose()
+	if existingContent.GetBlockCount() != 2 {
+		t.Errorf("TestSeparateWorkerPools() existingContent.GetBlockCount() %d != %d", existingContent.GetBlockCount(), 2)
+	}
+
+	pools := remoteStore.(DetailedStatsProvider).GetDetailedStats().WorkerPools
+	if len(pools) != 3 || pools[0].Name != WorkerPoolUpload || pools[0].WorkerCount != 1 || pools[1].Name != WorkerPoolDownload || pools[1].WorkerCount != 3 || pools[2].Name != WorkerPoolDecode {
+		t.Fatalf("TestSeparateWorkerPools() GetDetailedStats().WorkerPools %+v", pools)
+	}
+	if pools[0].RequestCount != 2 || pools[1].RequestCount != 1 || pools[0].BusyCount != 0 || pools[1].BusyCount != 0 {
+		t.Errorf("TestSeparateWorkerPools() GetDetailedStats().WorkerPools %+v", pools)
+	}
+}